@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultAdaptiveUtilizationThreshold = 0.9
+	defaultAdaptiveLeaseTTL             = 10 * time.Minute
+	defaultAdaptiveIdleTimeout          = 5 * time.Minute
+)
+
+var (
+	leasePoolUtilization = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "wiresteward_lease_pool_utilization_ratio",
+		Help: "Fraction of the addresses of the network that are leased.",
+	})
+	adaptiveLeasesActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "wiresteward_adaptive_leases_active",
+		Help: "Whether leases are shortened and idle ones reclaimed because the network is running out of addresses.",
+	})
+)
+
+// leaseCapacity returns the number of addresses that can be leased from
+// network, excluding the network and broadcast addresses and the address of
+// the server.
+func leaseCapacity(network *net.IPNet) int {
+	ones, bits := network.Mask.Size()
+	if bits-ones >= 31 {
+		return int(^uint(0) >> 1)
+	}
+	if c := 1<<uint(bits-ones) - 3; c > 0 {
+		return c
+	}
+	return 0
+}
+
+// underPressure returns whether the utilization of the network is above the
+// adaptive threshold, in which case new and renewed leases are shortened and
+// idle leases are reclaimed. It is always false unless adaptive leases are
+// enabled.
+func (lm *FileLeaseManager) underPressure() bool {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	return lm.underPressureLocked()
+}
+
+func (lm *FileLeaseManager) underPressureLocked() bool {
+	capacity := leaseCapacity(lm.cidr)
+	utilization := 1.0
+	if capacity > 0 {
+		utilization = float64(len(lm.wgRecords)) / float64(capacity)
+	}
+	leasePoolUtilization.Set(utilization)
+	if lm.adaptive == nil {
+		return false
+	}
+	active := utilization >= lm.adaptive.UtilizationThreshold
+	if active != lm.adaptiveActive {
+		if active {
+			logger.Info.Printf("%.0f%% of addresses are leased, shortening leases and reclaiming idle ones", utilization*100)
+		} else {
+			logger.Info.Printf("%.0f%% of addresses are leased, back to regular leases", utilization*100)
+		}
+		lm.adaptiveActive = active
+	}
+	if active {
+		adaptiveLeasesActive.Set(1)
+	} else {
+		adaptiveLeasesActive.Set(0)
+	}
+	return active
+}
+
+// reclaimIdleLeases removes the leases of peers that have not completed a
+// handshake for longer than the idle timeout, while the network is under
+// pressure. It returns whether any leases were reclaimed.
+func (lm *FileLeaseManager) reclaimIdleLeases(now time.Time) bool {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	if !lm.underPressureLocked() || lm.device == nil {
+		return false
+	}
+	dev, err := lm.device(lm.deviceName)
+	if err != nil {
+		logger.Error.Printf("Cannot get peer handshakes of device %s: %v", lm.deviceName, err)
+		return false
+	}
+	handshakes := make(map[string]time.Time, len(dev.Peers))
+	for _, p := range dev.Peers {
+		handshakes[p.PublicKey.String()] = p.LastHandshakeTime
+	}
+	reclaimed := false
+	for username, r := range lm.wgRecords {
+		// Peers that never completed a handshake are given the idle timeout
+		// since the lease was granted
+		lastActive := handshakes[r.PubKey]
+		if lastActive.IsZero() {
+			lastActive = r.granted
+		}
+		if now.Sub(lastActive) < lm.adaptive.IdleTimeout.Duration {
+			continue
+		}
+		logger.Info.Printf("Reclaiming idle lease of user %s (address %s)", username, r.IP)
+		lm.releaseRecord(username, r)
+		lm.emitLeaseEvent(leaseEventRevoked, username, r, "idle")
+		reclaimed = true
+	}
+	if reclaimed {
+		lm.underPressureLocked()
+	}
+	return reclaimed
+}
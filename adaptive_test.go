@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestFileLeaseManager_AdaptiveLeases(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	now := time.Now()
+	ip, network, _ := net.ParseCIDR("10.90.0.1/29")
+	cfg := &serverConfig{
+		LeaseTTL: 24 * time.Hour,
+		AdaptiveLeases: &serverAdaptiveLeasesConfig{
+			UtilizationThreshold: 0.8,
+			LeaseTTL:             duration{10 * time.Minute},
+			IdleTimeout:          duration{5 * time.Minute},
+		},
+	}
+	keys := map[string]wgtypes.Key{}
+	handshakes := map[string]time.Time{
+		"active@example.com": now.Add(-time.Minute),
+		"idle@example.com":   now.Add(-10 * time.Minute),
+	}
+	lm := &FileLeaseManager{
+		adaptive:   cfg.AdaptiveLeases,
+		cidr:       network,
+		deviceName: "wg0",
+		ip:         ip,
+		wgRecords:  map[string]WgRecord{},
+		device: func(name string) (*wgtypes.Device, error) {
+			dev := &wgtypes.Device{Name: name}
+			for username, hs := range handshakes {
+				dev.Peers = append(dev.Peers, wgtypes.Peer{PublicKey: keys[username], LastHandshakeTime: hs})
+			}
+			return dev, nil
+		},
+	}
+	lease := func(username string) {
+		keys[username] = newWgKey()
+		if _, err := lm.createOrUpdatePeer(username, &leaseRequest{PubKey: keys[username].String()}, now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tokenInfo := &introspectionResponse{Active: true, Exp: now.Add(48 * time.Hour).Unix()}
+
+	// 3 out of 5 addresses are leased, below the threshold
+	lease("active@example.com")
+	lease("idle@example.com")
+	lease("new@example.com")
+	assert.False(t, lm.underPressure())
+	assert.False(t, lm.reclaimIdleLeases(now))
+	expires, _ := cfg.leaseTiming(now, tokenInfo, lm.underPressure())
+	assert.Equal(t, now.Add(24*time.Hour), expires)
+
+	// Past the threshold leases are shortened
+	lease("stale@example.com")
+	assert.True(t, lm.underPressure())
+	expires, renewAfter := cfg.leaseTiming(now, tokenInfo, lm.underPressure())
+	assert.Equal(t, now.Add(10*time.Minute), expires)
+	assert.Equal(t, now.Add(5*time.Minute), renewAfter)
+
+	// and leases idle for longer than the timeout are reclaimed, including
+	// ones that never completed a handshake since they were granted
+	record := lm.wgRecords["stale@example.com"]
+	record.granted = now.Add(-10 * time.Minute)
+	lm.wgRecords["stale@example.com"] = record
+	assert.True(t, lm.reclaimIdleLeases(now))
+	assert.Equal(t, 2, len(lm.wgRecords))
+	assert.Contains(t, lm.wgRecords, "active@example.com")
+	assert.Contains(t, lm.wgRecords, "new@example.com")
+
+	// which brings utilization back below the threshold
+	assert.False(t, lm.underPressure())
+	expires, _ = cfg.leaseTiming(now, tokenInfo, lm.underPressure())
+	assert.Equal(t, now.Add(24*time.Hour), expires)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const defaultAddressProbeTimeout = time.Second
+
+// errAddressConflict is returned when a leased address is already in use on
+// the network.
+var errAddressConflict = errors.New("address already in use")
+
+// addressInUseLocally returns whether ip is assigned to a local interface
+// other than the device, eg. by a stale configuration.
+func addressInUseLocally(device string, ip net.IP) (bool, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return false, err
+	}
+	for _, iface := range ifaces {
+		if iface.Name == device {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return false, err
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// newAddressProber returns a function that checks whether an address is
+// already in use, either locally or by another host on the network of iface.
+func newAddressProber(device, iface string, timeout time.Duration) func(ip net.IP) (bool, error) {
+	if timeout == 0 {
+		timeout = defaultAddressProbeTimeout
+	}
+	return func(ip net.IP) (bool, error) {
+		inUse, err := addressInUseLocally(device, ip)
+		if err != nil || inUse || iface == "" {
+			return inUse, err
+		}
+		return probeAddress(iface, ip, timeout)
+	}
+}
+
+// checkAddressConflict probes the IPv4 and IPv6 addresses leased in config,
+// unless they were already configured on the device by the previous lease.
+func (dm *DeviceManager) checkAddressConflict(config, oldConfig *WirestewardPeerConfig) error {
+	if dm.addressInUse == nil {
+		return nil
+	}
+	addresses := []*net.IPNet{config.LocalAddress, config.LocalAddress6}
+	previous := []*net.IPNet{nil, nil}
+	if oldConfig != nil {
+		previous = []*net.IPNet{oldConfig.LocalAddress, oldConfig.LocalAddress6}
+	}
+	for i, a := range addresses {
+		if a == nil || (previous[i] != nil && previous[i].IP.Equal(a.IP)) {
+			continue
+		}
+		inUse, err := dm.addressInUse(a.IP)
+		if err != nil {
+			dm.logger.Error.Printf("Cannot probe address %s for conflicts: %v", a.IP, err)
+			continue
+		}
+		if inUse {
+			return fmt.Errorf("%w: %s", errAddressConflict, a.IP)
+		}
+	}
+	return nil
+}
+
+// requestLease requests a lease from server. If a leased address is already
+// in use on the network, the lease is rejected and requested again, asking
+// the server for a different IPv4 address, which IPv6 addresses are derived
+// from.
+func (dm *DeviceManager) requestLease(server agentPeerConfig, lr *leaseRequest, oldConfig *WirestewardPeerConfig) (*WirestewardPeerConfig, string, error) {
+	if server.ClientCertificate {
+		cert, err := dm.clientCertificate()
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot create client certificate: %w", err)
+		}
+		server.clientCert = cert
+	}
+	config, wgServerAddr, err := dm.requestPeerConfig(server, lr)
+	if err != nil {
+		return nil, "", err
+	}
+	err = dm.checkAddressConflict(config, oldConfig)
+	if err == nil {
+		return config, wgServerAddr, nil
+	}
+	dm.logger.Error.Printf("Rejecting lease from `%s`, requesting a different address: %v", server.URL, err)
+	retry := *lr
+	retry.ConflictingIP = config.LocalAddress.IP.String()
+	config, wgServerAddr, err = dm.requestPeerConfig(server, &retry)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := dm.checkAddressConflict(config, oldConfig); err != nil {
+		return nil, "", err
+	}
+	return config, wgServerAddr, nil
+}
@@ -0,0 +1,13 @@
+// +build darwin
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+func probeAddress(iface string, ip net.IP, timeout time.Duration) (bool, error) {
+	return false, fmt.Errorf("probing addresses on the network is not supported on darwin")
+}
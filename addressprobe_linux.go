@@ -0,0 +1,200 @@
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	arpRequest = 1
+	arpReply   = 2
+
+	icmpv6NeighborSolicitation  = 135
+	icmpv6NeighborAdvertisement = 136
+)
+
+func htons(i uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, i)
+	return binary.LittleEndian.Uint16(b)
+}
+
+// probeAddress sends an ARP probe (RFC 5227) for IPv4 addresses, or a
+// duplicate address detection neighbor solicitation (RFC 4862) for IPv6
+// ones, for ip on iface and returns whether another host claims the address
+// within timeout.
+func probeAddress(iface string, ip net.IP, timeout time.Duration) (bool, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return false, err
+	}
+	if len(ifi.HardwareAddr) != 6 {
+		return false, fmt.Errorf("interface %s does not have an ethernet address", iface)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return probeFrames(ifi, unix.ETH_P_ARP, arpProbePacket(ifi.HardwareAddr, ip4), timeout, func(frame []byte) bool {
+			return arpClaims(frame, ifi.HardwareAddr, ip4)
+		})
+	}
+	return probeFrames(ifi, unix.ETH_P_IPV6, ndpProbePacket(ifi.HardwareAddr, ip), timeout, func(frame []byte) bool {
+		return ndpClaims(frame, ifi.HardwareAddr, ip)
+	})
+}
+
+// probeFrames sends the ethernet frame probe on ifi and returns whether a
+// frame of protocol received within timeout is one claims reports as
+// claiming the probed address.
+func probeFrames(ifi *net.Interface, protocol uint16, probe []byte, timeout time.Duration, claims func(frame []byte) bool) (bool, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(protocol)))
+	if err != nil {
+		return false, err
+	}
+	defer unix.Close(fd)
+	addr := &unix.SockaddrLinklayer{
+		Protocol: htons(protocol),
+		Ifindex:  ifi.Index,
+		Halen:    6,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		return false, err
+	}
+	copy(addr.Addr[:], probe[0:6])
+	// Frames sent to the multicast destination of the probe, such as the
+	// probes of other hosts for the same address, are received too
+	if probe[0]&0x01 == 1 && !bytes.Equal(probe[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+		mreq := &unix.PacketMreq{Ifindex: int32(ifi.Index), Type: unix.PACKET_MR_MULTICAST, Alen: 6}
+		copy(mreq.Address[:], probe[0:6])
+		if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+			return false, err
+		}
+	}
+	if err := unix.Sendto(fd, probe, 0, addr); err != nil {
+		return false, err
+	}
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false, nil
+		}
+		tv := unix.NsecToTimeval(remaining.Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return false, err
+		}
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if claims(buf[:n]) {
+			return true, nil
+		}
+	}
+}
+
+// arpProbePacket returns an ethernet frame carrying an ARP probe for ip,
+// with an unspecified sender address.
+func arpProbePacket(hw net.HardwareAddr, ip net.IP) []byte {
+	b := make([]byte, 0, 42)
+	b = append(b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	b = append(b, hw...)
+	b = append(b, 0x08, 0x06)
+	b = append(b, 0x00, 0x01, 0x08, 0x00, 6, 4, 0x00, arpRequest)
+	b = append(b, hw...)
+	b = append(b, 0, 0, 0, 0)
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	b = append(b, ip...)
+	return b
+}
+
+// arpClaims returns whether frame is an ARP packet from another host using
+// ip as its sender address.
+func arpClaims(frame []byte, hw net.HardwareAddr, ip net.IP) bool {
+	if len(frame) < 42 || frame[12] != 0x08 || frame[13] != 0x06 {
+		return false
+	}
+	arp := frame[14:]
+	op := binary.BigEndian.Uint16(arp[6:8])
+	if op != arpRequest && op != arpReply {
+		return false
+	}
+	return !bytes.Equal(arp[8:14], hw) && net.IP(arp[14:18]).Equal(ip)
+}
+
+// ndpProbePacket returns an ethernet frame carrying a neighbor solicitation
+// for ip from the unspecified address, sent to the solicited-node multicast
+// address of ip, as used for duplicate address detection.
+func ndpProbePacket(hw net.HardwareAddr, ip net.IP) []byte {
+	target := ip.To16()
+	dst := net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, target[13], target[14], target[15]}
+	icmp := make([]byte, 0, 24)
+	icmp = append(icmp, icmpv6NeighborSolicitation, 0, 0, 0, 0, 0, 0, 0)
+	icmp = append(icmp, target...)
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(net.IPv6unspecified, dst, icmp))
+
+	b := make([]byte, 0, 14+40+len(icmp))
+	b = append(b, 0x33, 0x33, dst[12], dst[13], dst[14], dst[15])
+	b = append(b, hw...)
+	b = append(b, 0x86, 0xdd)
+	b = append(b, 0x60, 0, 0, 0)
+	b = append(b, byte(len(icmp)>>8), byte(len(icmp)), unix.IPPROTO_ICMPV6, 255)
+	b = append(b, net.IPv6unspecified...)
+	b = append(b, dst...)
+	b = append(b, icmp...)
+	return b
+}
+
+// icmpv6Checksum returns the checksum of the ICMPv6 message icmp sent from
+// src to dst, computed with a zero checksum field.
+func icmpv6Checksum(src, dst net.IP, icmp []byte) uint16 {
+	pseudo := make([]byte, 0, 40+len(icmp))
+	pseudo = append(pseudo, src.To16()...)
+	pseudo = append(pseudo, dst.To16()...)
+	pseudo = append(pseudo, 0, 0, byte(len(icmp)>>8), byte(len(icmp)), 0, 0, 0, unix.IPPROTO_ICMPV6)
+	pseudo = append(pseudo, icmp...)
+	var sum uint32
+	for i := 0; i+1 < len(pseudo); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudo[i : i+2]))
+	}
+	if len(pseudo)%2 == 1 {
+		sum += uint32(pseudo[len(pseudo)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// ndpClaims returns whether frame is a neighbor advertisement from another
+// host for ip, or a neighbor solicitation of another host probing ip for
+// duplicate address detection at the same time.
+func ndpClaims(frame []byte, hw net.HardwareAddr, ip net.IP) bool {
+	if len(frame) < 14+40+24 || frame[12] != 0x86 || frame[13] != 0xdd || bytes.Equal(frame[6:12], hw) {
+		return false
+	}
+	ipv6 := frame[14:]
+	if ipv6[0]>>4 != 6 || ipv6[6] != unix.IPPROTO_ICMPV6 || ipv6[7] != 255 {
+		return false
+	}
+	icmp := ipv6[40:]
+	switch icmp[0] {
+	case icmpv6NeighborAdvertisement:
+	case icmpv6NeighborSolicitation:
+		if !net.IP(ipv6[8:24]).Equal(net.IPv6unspecified) {
+			return false
+		}
+	default:
+		return false
+	}
+	return icmp[1] == 0 && net.IP(icmp[8:24]).Equal(ip)
+}
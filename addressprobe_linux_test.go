@@ -0,0 +1,52 @@
+// +build linux
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNDPProbePacket(t *testing.T) {
+	hw := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	ip := net.ParseIP("fd00::a5a:2")
+	frame := ndpProbePacket(hw, ip)
+	assert.Equal(t, 14+40+24, len(frame))
+	// Sent to the solicited-node multicast address of ip, from the
+	// unspecified address
+	assert.Equal(t, []byte{0x33, 0x33, 0xff, 0x5a, 0x00, 0x02}, frame[0:6])
+	assert.Equal(t, net.IPv6unspecified, net.IP(frame[22:38]))
+	assert.Equal(t, net.ParseIP("ff02::1:ff5a:2"), net.IP(frame[38:54]))
+	// The checksum of a message with a valid one sums to zero
+	assert.Equal(t, uint16(0), icmpv6Checksum(net.IPv6unspecified, net.IP(frame[38:54]), frame[54:]))
+
+	// Our own probe does not claim the address
+	assert.False(t, ndpClaims(frame, hw, ip))
+}
+
+func TestNDPClaims(t *testing.T) {
+	hw := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	other := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	ip := net.ParseIP("fd00::a5a:2")
+	advertisement := func(target net.IP) []byte {
+		frame := ndpProbePacket(other, target)
+		frame[54] = icmpv6NeighborAdvertisement
+		copy(frame[22:38], net.ParseIP("fd00::a5a:2"))
+		return frame
+	}
+	// Another host advertises the address
+	assert.True(t, ndpClaims(advertisement(ip), hw, ip))
+	assert.False(t, ndpClaims(advertisement(net.ParseIP("fd00::a5a:3")), hw, ip))
+	// or probes it at the same time
+	assert.True(t, ndpClaims(ndpProbePacket(other, ip), hw, ip))
+	// Solicitations from hosts that already have an address are resolving
+	// it, rather than claiming it
+	solicitation := ndpProbePacket(other, ip)
+	copy(solicitation[22:38], net.ParseIP("fd00::1"))
+	assert.False(t, ndpClaims(solicitation, hw, ip))
+	// Truncated and non IPv6 frames are ignored
+	assert.False(t, ndpClaims(advertisement(ip)[:60], hw, ip))
+	assert.False(t, ndpClaims(arpProbePacket(other, net.ParseIP("10.90.0.2").To4()), hw, ip))
+}
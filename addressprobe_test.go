@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceManager_RequestLeaseAddressConflict(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	requests := []leaseRequest{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lr := leaseRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&lr); err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, lr)
+		ip := "10.0.0.2/32"
+		if lr.ConflictingIP == "10.0.0.2" {
+			ip = "10.0.0.3/32"
+		}
+		json.NewEncoder(w).Encode(&leaseResponse{
+			Status:     "success",
+			IP:         ip,
+			AllowedIPs: validAllowedIPs,
+			PubKey:     validPublicKey,
+			Expires:    time.Now().Add(time.Hour),
+		})
+	}))
+	defer ts.Close()
+	server := agentPeerConfig{URL: ts.URL}
+
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", Peers: []agentPeerConfig{server}}, "")
+	// Another host on the network already uses 10.0.0.2
+	dm.addressInUse = func(ip net.IP) (bool, error) {
+		return ip.Equal(net.ParseIP("10.0.0.2")), nil
+	}
+	config, _, err := dm.requestLease(server, &leaseRequest{PubKey: validPublicKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.3/32", config.LocalAddress.String())
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, "", requests[0].ConflictingIP)
+	assert.Equal(t, "10.0.0.2", requests[1].ConflictingIP)
+
+	// The lease is rejected if the server hands out a conflicting address
+	// again
+	dm.addressInUse = func(ip net.IP) (bool, error) { return true, nil }
+	_, _, err = dm.requestLease(server, &leaseRequest{PubKey: validPublicKey}, nil)
+	assert.True(t, errors.Is(err, errAddressConflict))
+
+	// Addresses already configured by the previous lease are not probed
+	old := &WirestewardPeerConfig{LocalAddress: &net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(32, 32)}}
+	requests = nil
+	config, _, err = dm.requestLease(server, &leaseRequest{PubKey: validPublicKey}, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2/32", config.LocalAddress.String())
+	assert.Equal(t, 1, len(requests))
+}
+
+func TestDeviceManager_RequestLeaseAddressConflict6(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	requests := []leaseRequest{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lr := leaseRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&lr); err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, lr)
+		ip, ip6 := "10.0.0.2/32", "fd00::a00:2/128"
+		if lr.ConflictingIP == "10.0.0.2" {
+			ip, ip6 = "10.0.0.3/32", "fd00::a00:3/128"
+		}
+		json.NewEncoder(w).Encode(&leaseResponse{
+			Status:     "success",
+			IP:         ip,
+			IP6:        ip6,
+			AllowedIPs: validAllowedIPs,
+			PubKey:     validPublicKey,
+			Expires:    time.Now().Add(time.Hour),
+		})
+	}))
+	defer ts.Close()
+	server := agentPeerConfig{URL: ts.URL}
+
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", Peers: []agentPeerConfig{server}}, "")
+	probed := []string{}
+	// Another host on the network already uses fd00::a00:2, the IPv4
+	// address it is derived from is free
+	dm.addressInUse = func(ip net.IP) (bool, error) {
+		probed = append(probed, ip.String())
+		return ip.Equal(net.ParseIP("fd00::a00:2")), nil
+	}
+	config, _, err := dm.requestLease(server, &leaseRequest{PubKey: validPublicKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.3/32", config.LocalAddress.String())
+	assert.Equal(t, "fd00::a00:3/128", config.LocalAddress6.String())
+	assert.Equal(t, []string{"10.0.0.2", "fd00::a00:2", "10.0.0.3", "fd00::a00:3"}, probed)
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, "10.0.0.2", requests[1].ConflictingIP)
+
+	// Only the addresses that changed are probed
+	probed = nil
+	old := &WirestewardPeerConfig{
+		LocalAddress:  &net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(32, 32)},
+		LocalAddress6: &net.IPNet{IP: net.ParseIP("fd00::a00:9"), Mask: net.CIDRMask(128, 128)},
+	}
+	dm.addressInUse = func(ip net.IP) (bool, error) {
+		probed = append(probed, ip.String())
+		return false, nil
+	}
+	_, _, err = dm.requestLease(server, &leaseRequest{PubKey: validPublicKey}, old)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"fd00::a00:2"}, probed)
+}
+
+func TestFileLeaseManager_ConflictingIP(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	lm := &FileLeaseManager{
+		wgRecords: map[string]WgRecord{},
+		cidr:      network,
+		ip:        ip,
+	}
+	record, err := lm.createOrUpdatePeer("test@example.com", &leaseRequest{PubKey: validPublicKey}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.2", record.IP.String())
+	record, err = lm.createOrUpdatePeer("test@example.com", &leaseRequest{PubKey: validPublicKey, ConflictingIP: "10.90.0.2"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.3", record.IP.String())
+	// The new address is kept on renewals
+	record, err = lm.createOrUpdatePeer("test@example.com", &leaseRequest{PubKey: validPublicKey, ConflictingIP: "10.90.0.2"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.3", record.IP.String())
+}
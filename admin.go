@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// networkStateFilename returns the file where the address network of the
+// server is persisted after it is expanded via the admin endpoint.
+func networkStateFilename(cfg *serverConfig) string {
+	return cfg.LeasesFilename + ".network"
+}
+
+// verifyNetworkExpansion returns an error unless network is a superset of
+// current, so that all addresses leased from current remain valid.
+func verifyNetworkExpansion(current, network *net.IPNet) error {
+	currentOnes, currentBits := current.Mask.Size()
+	ones, bits := network.Mask.Size()
+	if bits != currentBits {
+		return fmt.Errorf("%s and %s are not of the same address family", network, current)
+	}
+	if ones > currentOnes || !network.Contains(current.IP) {
+		return fmt.Errorf("%s is not a superset of the current network %s", network, current)
+	}
+	return nil
+}
+
+// loadNetworkState applies the address network persisted by a previous
+// expansion to cfg, as long as it is still a superset of the configured one.
+func loadNetworkState(cfg *serverConfig) error {
+	d, err := os.ReadFile(networkStateFilename(cfg))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, network, err := net.ParseCIDR(strings.TrimSpace(string(d)))
+	if err != nil {
+		return fmt.Errorf("cannot parse %s: %w", networkStateFilename(cfg), err)
+	}
+	if err := verifyNetworkExpansion(cfg.WireguardIPNetwork, network); err != nil {
+		logger.Error.Printf("Ignoring persisted network: %v", err)
+		return nil
+	}
+	logger.Info.Printf("Using persisted network %s instead of %s", network, cfg.WireguardIPNetwork)
+	cfg.WireguardIPNetwork = network
+	return nil
+}
+
+// readAdminToken returns the admin token stored in filename.
+func readAdminToken(filename string) (string, error) {
+	d, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(d))
+	if token == "" {
+		return "", fmt.Errorf("admin token file %s is empty", filename)
+	}
+	return token, nil
+}
+
+type networkRequest struct {
+	CIDR string
+}
+
+// HTTPAdminHandler implements the HTTP server for administrative operations.
+// Requests have to present its token.
+type HTTPAdminHandler struct {
+	leaseManager *FileLeaseManager
+	// devices are the lease managers of the additional devices of the
+	// server, by name
+	devices      map[string]*FileLeaseManager
+	networkMutex sync.Mutex
+	// leaseHandler serves lease requests, its config is read and the
+	// expanded network recorded under its lock
+	leaseHandler *HTTPLeaseHandler
+	// updateDeviceNetwork applies a new address network to the server device
+	updateDeviceNetwork func(network *net.IPNet) error
+	// token is the bearer token requests have to present
+	token string
+	// reloadConfig reads the server config again and applies it
+	reloadConfig func() error
+}
+
+// authenticate rejects requests that do not present the admin token. All
+// requests are rejected if no token is set.
+func (ah *HTTPAdminHandler) authenticate(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if ah.token == "" || !strings.HasPrefix(auth, bearerSchema) || subtle.ConstantTimeCompare([]byte(auth[len(bearerSchema):]), []byte(ah.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// leases lists the active leases, or revokes the lease of the user or public
+// key given in the query, removing its peer from the device right away.
+func (ah *HTTPAdminHandler) leases(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(deviceLeases(ah.leaseManager, ah.devices))
+	case "DELETE":
+		username := r.URL.Query().Get("username")
+		pubKey := r.URL.Query().Get("publicKey")
+		if username == "" && pubKey == "" {
+			http.Error(w, "username or publicKey must be set", http.StatusBadRequest)
+			return
+		}
+		user, record, err := revokeDeviceLease(ah.leaseManager, ah.devices, username, pubKey)
+		if errors.Is(err, errLeaseNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		a := newAuditRecord(leaseEventRevoked, user, record)
+		a.Auth = "admin"
+		ah.leaseManager.audit.record(a.fromRequest(r))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("lease revoked but the device could not be updated: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "only GET and DELETE methods are supported", http.StatusMethodNotAllowed)
+	}
+}
+
+// reload reads the server config again and applies the settings that can be
+// changed without a restart.
+func (ah *HTTPAdminHandler) reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST method is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if ah.reloadConfig == nil {
+		http.Error(w, "config reloading is not supported", http.StatusNotImplemented)
+		return
+	}
+	if err := ah.reloadConfig(); err != nil {
+		logger.Error.Printf("Cannot reload config: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// network returns the address network leases are allocated from, or expands
+// it to a superset of the current one. Existing leases keep their addresses.
+func (ah *HTTPAdminHandler) network(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(&networkRequest{CIDR: ah.leaseManager.network().String()})
+	case "POST":
+		var nr networkRequest
+		if err := json.NewDecoder(r.Body).Decode(&nr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, network, err := net.ParseCIDR(nr.CIDR)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ah.networkMutex.Lock()
+		defer ah.networkMutex.Unlock()
+		current := ah.leaseManager.network()
+		if err := verifyNetworkExpansion(current, network); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg := ah.leaseHandler.config()
+		if pool := cfg.DelegatedPrefixPool; pool != nil && (pool.Contains(network.IP) || network.Contains(pool.IP)) {
+			http.Error(w, fmt.Sprintf("%s overlaps with the delegated prefixes %s", network, pool), http.StatusBadRequest)
+			return
+		}
+		if network.String() == current.String() {
+			json.NewEncoder(w).Encode(&networkRequest{CIDR: network.String()})
+			return
+		}
+		logger.Info.Printf("Expanding network from %s to %s", current, network)
+		if err := ah.updateDeviceNetwork(network); err != nil {
+			http.Error(w, fmt.Sprintf("cannot update device: %v", err), http.StatusInternalServerError)
+			return
+		}
+		ah.leaseManager.setNetwork(network)
+		ah.leaseHandler.setNetwork(network)
+		if err := os.WriteFile(networkStateFilename(&cfg), []byte(network.String()+"\n"), 0644); err != nil {
+			http.Error(w, fmt.Sprintf("network expanded but could not be persisted: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(&networkRequest{CIDR: network.String()})
+	default:
+		http.Error(w, "only GET and POST methods are supported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (ah *HTTPAdminHandler) start(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/network", ah.authenticate(ah.network))
+	mux.HandleFunc("/admin/leases", ah.authenticate(ah.leases))
+	mux.HandleFunc("/admin/reload", ah.authenticate(ah.reload))
+	logger.Info.Printf("Starting admin server at %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logger.Error.Fatal(err)
+	}
+}
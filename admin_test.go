@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestHTTPAdminHandler_Network(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	cfg := &serverConfig{
+		LeasesFilename:     filepath.Join(t.TempDir(), "leases"),
+		WireguardIPAddress: ip,
+		WireguardIPNetwork: network,
+	}
+	lm := &FileLeaseManager{
+		wgRecords: map[string]WgRecord{},
+		cidr:      network,
+		ip:        ip,
+	}
+	record, err := lm.createOrUpdatePeer("test@example.com", &leaseRequest{PubKey: validPublicKey}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deviceNetwork *net.IPNet
+	ah := &HTTPAdminHandler{
+		leaseManager: lm,
+		leaseHandler: &HTTPLeaseHandler{serverConfig: cfg},
+		updateDeviceNetwork: func(network *net.IPNet) error {
+			deviceNetwork = network
+			return nil
+		},
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ah.network(w, httptest.NewRequest("POST", "/admin/network", bytes.NewBufferString(body)))
+		return w
+	}
+
+	// Shrinking or moving the network would orphan existing leases
+	for _, cidr := range []string{"10.90.0.0/25", "10.91.0.0/23", "10.90.1.0/24"} {
+		w := post(`{"CIDR": "` + cidr + `"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code, cidr)
+	}
+	assert.Nil(t, deviceNetwork)
+	assert.Equal(t, "10.90.0.0/24", lm.network().String())
+
+	w := post(`{"CIDR": "10.90.0.0/23"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "10.90.0.0/23", deviceNetwork.String())
+	assert.Equal(t, "10.90.0.0/23", lm.network().String())
+	assert.Equal(t, "10.90.0.0/23", ah.leaseHandler.config().WireguardIPNetwork.String())
+	// Existing leases keep their address
+	assert.True(t, record.IP.Equal(lm.wgRecords["test@example.com"].IP))
+
+	// The expanded network should be used after a restart
+	_, configured, _ := net.ParseCIDR("10.90.0.1/24")
+	restarted := &serverConfig{LeasesFilename: cfg.LeasesFilename, WireguardIPNetwork: configured}
+	if err := loadNetworkState(restarted); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.0/23", restarted.WireguardIPNetwork.String())
+}
+
+func TestHTTPAdminHandler_Leases(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	lm := &FileLeaseManager{
+		wgRecords:  map[string]WgRecord{},
+		cidr:       network,
+		deviceName: "wg_test",
+		ip:         ip,
+		store:      newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+	}
+	lostKey := newWgKey()
+	handshake := time.Unix(100, 0).UTC()
+	lm.device = func(name string) (*wgtypes.Device, error) {
+		return &wgtypes.Device{Name: name, Peers: []wgtypes.Peer{{PublicKey: lostKey, LastHandshakeTime: handshake}}}, nil
+	}
+	expiry := time.Now().Add(time.Hour)
+	if _, err := lm.createOrUpdatePeer("lost@example.com", &leaseRequest{PubKey: lostKey.String()}, expiry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lm.createOrUpdatePeer("test@example.com", &leaseRequest{PubKey: validPublicKey}, expiry); err != nil {
+		t.Fatal(err)
+	}
+	ah := &HTTPAdminHandler{leaseManager: lm, token: "secret"}
+	handler := ah.authenticate(ah.leases)
+	request := func(method, target, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		handler(w, r)
+		return w
+	}
+	list := func() []leaseExportEntry {
+		w := request("GET", "/admin/leases", "secret")
+		assert.Equal(t, http.StatusOK, w.Code)
+		leases := []leaseExportEntry{}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&leases))
+		return leases
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/admin/leases", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/admin/leases", "wrong").Code)
+	// Requests are never authenticated without a token
+	ah.token = ""
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/admin/leases", "").Code)
+	ah.token = "secret"
+
+	leases := list()
+	assert.Equal(t, 2, len(leases))
+	assert.Equal(t, "lost@example.com", leases[0].Username)
+	assert.Equal(t, "10.90.0.2", leases[0].IP)
+	assert.Equal(t, handshake, *leases[0].LastHandshake)
+	assert.Nil(t, leases[1].LastHandshake)
+
+	assert.Equal(t, http.StatusBadRequest, request("DELETE", "/admin/leases", "secret").Code)
+	assert.Equal(t, http.StatusNotFound, request("DELETE", "/admin/leases?username=nobody@example.com", "secret").Code)
+	// The username and public key have to match if both are given
+	assert.Equal(t, http.StatusNotFound, request("DELETE", "/admin/leases?username=test@example.com&publicKey="+url.QueryEscape(lostKey.String()), "secret").Code)
+
+	// There is no device to remove the peer from in tests, but the lease
+	// is revoked regardless
+	request("DELETE", "/admin/leases?publicKey="+url.QueryEscape(lostKey.String()), "secret")
+	leases = list()
+	assert.Equal(t, 1, len(leases))
+	assert.Equal(t, "test@example.com", leases[0].Username)
+	for _, p := range lm.peerConfigs() {
+		assert.NotEqual(t, lostKey, p.PublicKey)
+	}
+}
+
+func TestHTTPAdminHandler_DeviceLeases(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	lm := &FileLeaseManager{
+		wgRecords:  map[string]WgRecord{},
+		cidr:       network,
+		deviceName: "wg_test",
+		ip:         ip,
+		store:      newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+	}
+	dip, dnetwork, _ := net.ParseCIDR("10.91.0.1/24")
+	dlm := &FileLeaseManager{
+		wgRecords:  map[string]WgRecord{},
+		cidr:       dnetwork,
+		deviceName: "wg_test1",
+		ip:         dip,
+		store:      newFileLeaseStore(filepath.Join(t.TempDir(), "leases-wg_test1")),
+	}
+	machineKey := newWgKey()
+	expiry := time.Now().Add(time.Hour)
+	if _, err := lm.createOrUpdatePeer("test@example.com", &leaseRequest{PubKey: validPublicKey}, expiry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dlm.createOrUpdatePeer("machine@example.com", &leaseRequest{PubKey: machineKey.String()}, expiry); err != nil {
+		t.Fatal(err)
+	}
+	ah := &HTTPAdminHandler{leaseManager: lm, devices: map[string]*FileLeaseManager{"wg_test1": dlm}, token: "secret"}
+	request := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		ah.authenticate(ah.leases)(w, r)
+		return w
+	}
+
+	// Leases of additional devices are listed along with their device
+	w := request("GET", "/admin/leases")
+	assert.Equal(t, http.StatusOK, w.Code)
+	leases := []leaseExportEntry{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&leases))
+	assert.Equal(t, 2, len(leases))
+	assert.Equal(t, "test@example.com", leases[0].Username)
+	assert.Empty(t, leases[0].Device)
+	assert.Equal(t, "machine@example.com", leases[1].Username)
+	assert.Equal(t, "10.91.0.2", leases[1].IP)
+	assert.Equal(t, "wg_test1", leases[1].Device)
+
+	// and revoked on their device
+	request("DELETE", "/admin/leases?publicKey="+url.QueryEscape(machineKey.String()))
+	assert.Empty(t, dlm.leases())
+	assert.Equal(t, 1, len(lm.leases()))
+}
@@ -1,44 +1,81 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
-	defaultTokenFileLoc = "/var/lib/wiresteward/token"
+	defaultTokenFileLoc          = "/var/lib/wiresteward/token"
+	defaultDeviceMetricsInterval = 10 * time.Second
+	// Failed renewals back off up to this interval in offline start mode,
+	// unless devices set their own maximum
+	defaultOfflineRenewRetryMax = 5 * time.Minute
 )
 
 // Agent is the wirestward client instance that manages a set of network devices
 // based on configuration generated by remote wiresteward servers.
 type Agent struct {
 	deviceManagers []*DeviceManager
+	events         *eventQueue
+	metrics        agentMetricsSink
 	oa             *oauthTokenHandler
+	tokens         *tokenCache
+	statsd         *statsdClient
+	metricsAddress string
+	offlineStart   bool
+	openBrowser    bool
+	stop           chan struct{}
+	// keyStore persists the private keys of devices, if set
+	keyStore secretStore
+	// config is the config the agent was started or last reloaded with,
+	// deviceManagers have to be read with devices as they can be replaced
+	// when it is reloaded
+	config                *agentConfig
+	clientID              string
+	resolver              resolverChain
+	captivePortalDetector *captivePortalDetector
+	hooks                 *hookRunner
+	deviceManagersMutex   sync.Mutex
+	reloadMutex           sync.Mutex
+	// downDevices were brought down with the control socket, they are
+	// not started again on reloads. It is guarded by reloadMutex.
+	downDevices map[string]bool
 }
 
 // NewAgent creates an Agent from an AgentConfig. It generates a DeviceManager
 // per device specified in the configuration, sets up and starts the associated
 // resources.
 func NewAgent(cfg *agentConfig) *Agent {
-	agent := &Agent{}
-	for _, dev := range cfg.Devices {
-		urls := []string{}
-		for _, peer := range dev.Peers {
-			urls = append(urls, peer.URL)
-		}
-		dm := newDeviceManager(dev.Name, dev.MTU, urls)
-		if err := dm.Run(); err != nil {
-			logger.Error.Printf(
-				"Error starting device `%s`: %v",
-				dm.Name(),
-				err,
-			)
-			continue
+	agent := &Agent{
+		events:         newEventQueue(cfg.EventBufferSize),
+		metrics:        noopMetricsSink{},
+		metricsAddress: cfg.MetricsAddress,
+		offlineStart:   cfg.OfflineStart,
+		stop:           make(chan struct{}),
+	}
+	if cfg.StatsD != nil {
+		sc, err := newStatsdClient(
+			cfg.StatsD.Address,
+			cfg.StatsD.Prefix,
+			cfg.StatsD.DogStatsD,
+			cfg.StatsD.FlushInterval.Duration,
+		)
+		if err != nil {
+			logger.Error.Printf("Cannot setup statsd client: %v", err)
+		} else {
+			agent.statsd = sc
+			agent.metrics = sc
 		}
-		agent.deviceManagers = append(agent.deviceManagers, dm)
 	}
 	tokenDir := filepath.Dir(defaultTokenFileLoc)
 	err := os.MkdirAll(tokenDir, 0755)
@@ -48,50 +85,247 @@ func NewAgent(cfg *agentConfig) *Agent {
 	agent.oa = newOAuthTokenHandler(
 		cfg.OAuth.AuthURL,
 		cfg.OAuth.TokenURL,
+		cfg.OAuth.DeviceAuthURL,
 		cfg.OAuth.ClientID,
 		defaultTokenFileLoc,
 	)
+	if agent.oa.tokenStore, err = newSecretStore(cfg.OAuth.TokenStore, cfg.EncryptedStore); err != nil {
+		logger.Error.Fatalf("Cannot open token store: %v", err)
+	}
+	if agent.keyStore, err = newSecretStore(cfg.KeyStore, cfg.EncryptedStore); err != nil {
+		logger.Error.Fatalf("Cannot open key store: %v", err)
+	}
+	agent.openBrowser = cfg.OAuth.OpenBrowser
+	agent.tokens = newTokenCache(agent.oa.refreshToken, cfg.OAuth.TokenCacheTTL.Duration)
+	clientID := cfg.ClientID
+	if clientID == "" {
+		id, err := loadOrCreateClientID(defaultClientIDFileLoc)
+		if err != nil {
+			logger.Error.Printf("Cannot load client id: %v", err)
+		}
+		clientID = id
+	}
+	agent.config = cfg
+	agent.clientID = clientID
+	agent.resolver = newResolverChain(cfg.Resolvers)
+	if cfg.CaptivePortal != nil {
+		agent.captivePortalDetector = newCaptivePortalDetector(cfg.CaptivePortal)
+	}
+	agent.hooks = newHookRunner(cfg.Hooks)
+	for _, dev := range cfg.Devices {
+		dm, err := agent.startDevice(dev)
+		if err != nil {
+			logger.Error.Printf(
+				"Error starting device `%s`: %v",
+				dev.Name,
+				err,
+			)
+			continue
+		}
+		agent.deviceManagers = append(agent.deviceManagers, dm)
+	}
+	for _, b := range cfg.Bonds {
+		members := []bondMember{}
+		for _, name := range b.Devices {
+			for _, dm := range agent.deviceManagers {
+				if dm.Name() == name {
+					members = append(members, dm)
+				}
+			}
+		}
+		if len(members) < 2 {
+			logger.Error.Printf("Not enough running devices for bond %s", b.Name)
+			continue
+		}
+		bond := newTunnelBond(b.Name, members, b.HandshakeTimeout.Duration, b.StaleChecks)
+		bond.events = agent.events
+		interval := b.CheckInterval.Duration
+		if interval == 0 {
+			interval = bondCheckInterval
+		}
+		go bond.run(interval, agent.stop)
+	}
+	if agent.statsd != nil {
+		go agent.collectDeviceMetrics(defaultDeviceMetricsInterval)
+	}
 	return agent
 }
 
+// startDevice creates a DeviceManager for the device config and runs it.
+func (a *Agent) startDevice(dev agentDeviceConfig) (*DeviceManager, error) {
+	dm := newDeviceManager(dev, a.clientID)
+	dm.resolver = a.resolver
+	dm.captivePortalDetector = a.captivePortalDetector
+	dm.events = a.events
+	dm.metrics = a.metrics
+	dm.tokens = a.tokens
+	dm.keyStore = a.keyStore
+	dm.hooks = a.hooks
+	if a.offlineStart && dm.renewRetryMax == 0 {
+		dm.renewRetryMax = defaultOfflineRenewRetryMax
+	}
+	if err := dm.Run(); err != nil {
+		return nil, err
+	}
+	return dm, nil
+}
+
+// devices returns the DeviceManagers the agent currently controls.
+func (a *Agent) devices() []*DeviceManager {
+	a.deviceManagersMutex.Lock()
+	defer a.deviceManagersMutex.Unlock()
+	return append([]*DeviceManager{}, a.deviceManagers...)
+}
+
+// Events returns a channel on which events about the devices managed by the
+// agent are delivered.
+func (a *Agent) Events() <-chan agentEvent {
+	return a.events.Events()
+}
+
 // ListenAndServe sets up and starts an http server, to allow for the OAuth2
-// exchange and token renewal.
+// exchange and token renewal, and to expose the agent metrics.
 func (a *Agent) ListenAndServe() {
 	http.HandleFunc("/oauth2/callback", a.callbackHandler)
 	http.HandleFunc("/renew", a.renewHandler)
+	http.HandleFunc("/status.json", a.statusHandler)
+	http.HandleFunc("/healthz", a.healthzHandler)
 	http.HandleFunc("/", a.mainHandler)
+	prometheus.MustRegister(eventsDroppedTotal, agentRenewalErrorsTotal, newAgentCollector(a.devices))
+	http.Handle("/metrics", promhttp.Handler())
+	if a.metricsAddress != "" {
+		go a.serveMetrics(a.metricsAddress)
+	}
+	if *flagAgentSocket != "" {
+		go a.serveStatusSocket(*flagAgentSocket)
+	}
+	if *flagAgentControlSocket != "" {
+		go a.serveControlSocket(*flagAgentControlSocket, *flagAgentControlGroup)
+	}
 
 	logger.Info.Printf("Starting agent at http://%s", *flagAgentAddress)
 
+	browserLogin := false
 	token, err := a.oa.getTokenFromFile()
-	if err != nil || token.AccessToken == "" || token.Expiry.Before(time.Now()) {
-		logger.Error.Println("cannot get a valid cached token, you need to authenticate")
-	} else {
+	switch {
+	case err == nil && token.AccessToken != "" && !token.Expiry.Before(time.Now()):
+		a.renewAllLeases(token.AccessToken)
+	case err == nil && token.AccessToken != "" && token.RefreshToken != "" && a.offlineStart:
+		// Renewals refresh the token and are retried until the identity
+		// provider and the servers are reachable
+		logger.Info.Println("cached token expired, refreshing it in the background")
 		a.renewAllLeases(token.AccessToken)
+	default:
+		logger.Error.Println("cannot get a valid cached token, you need to authenticate")
+		if a.oa.deviceAuthURL != "" {
+			go a.deviceCodeLogin()
+		} else {
+			browserLogin = a.openBrowser
+		}
 	}
 
-	if err := http.ListenAndServe(*flagAgentAddress, nil); err != nil {
+	// The browser is only opened once the agent listens, for the login to
+	// reach it
+	l, err := net.Listen("tcp", *flagAgentAddress)
+	if err != nil {
+		logger.Error.Println(err)
+		return
+	}
+	if browserLogin {
+		go a.browserLogin()
+	}
+	if err := http.Serve(l, nil); err != nil {
 		logger.Error.Println(err)
 	}
 }
 
+// browserLogin opens the renew page of the agent in the browser, which
+// redirects the user to the identity provider to authenticate.
+func (a *Agent) browserLogin() {
+	url := fmt.Sprintf("http://%s/renew", *flagAgentAddress)
+	logger.Info.Printf("Opening %s in the browser to authenticate", url)
+	if err := openBrowser(url); err != nil {
+		logger.Error.Printf("Cannot open the browser, visit %s to authenticate: %v", url, err)
+	}
+}
+
 // Stop calls the Stop method on all DeviceManager instances that this Agent
 // controls.
 func (a *Agent) Stop() {
-	for _, dm := range a.deviceManagers {
+	close(a.stop)
+	for _, dm := range a.devices() {
 		dm.Stop()
 	}
+	a.hooks.fire(newHookEvent(hookEventShutdown, "", nil))
+	a.hooks.close()
+	if a.statsd != nil {
+		if err := a.statsd.Close(); err != nil {
+			logger.Error.Printf("Cannot close statsd client: %v", err)
+		}
+	}
+}
+
+// deviceStatus returns the lease and the WireGuard peer stats of every device
+// the agent runs.
+func (a *Agent) deviceStatus() []agentDeviceStatus {
+	status := []agentDeviceStatus{}
+	for _, dm := range a.devices() {
+		status = append(status, dm.status())
+	}
+	return status
+}
+
+// collectDeviceMetrics periodically records the handshake age and transfer
+// bytes of the peers of all devices.
+func (a *Agent) collectDeviceMetrics(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, ds := range a.deviceStatus() {
+				for _, p := range ds.Peers {
+					tags := map[string]string{"device": ds.Name}
+					if p.Endpoint != "" {
+						tags["endpoint"] = p.Endpoint
+					}
+					if !p.LastHandshake.IsZero() {
+						a.metrics.gauge("peer_handshake_age_seconds", time.Since(p.LastHandshake).Seconds(), tags)
+					}
+					a.metrics.gauge("peer_receive_bytes", float64(p.ReceiveBytes), tags)
+					a.metrics.gauge("peer_transmit_bytes", float64(p.TransmitBytes), tags)
+				}
+			}
+		case <-a.stop:
+			return
+		}
+	}
 }
 
 func (a *Agent) renewAllLeases(token string) {
 	logger.Info.Println("Running renew leases loop..")
-	for _, dm := range a.deviceManagers {
+	a.tokens.set(token)
+	for _, dm := range a.devices() {
 		dm.RenewTokenAndLease(token)
 	}
 }
 
+// deviceCodeLogin authenticates the agent via the device authorization
+// grant and renews all leases with the token obtained.
+func (a *Agent) deviceCodeLogin() {
+	token, err := a.oa.deviceCodeToken()
+	if errors.Is(err, errDeviceCodePending) {
+		return
+	}
+	if err != nil {
+		logger.Error.Printf("Device code authentication failed: %v", err)
+		return
+	}
+	a.renewAllLeases(token.AccessToken)
+}
+
 func (a *Agent) callbackHandler(w http.ResponseWriter, r *http.Request) {
-	token, err := a.oa.ExchangeToken(r.FormValue("code"))
+	token, err := a.oa.ExchangeToken(r.FormValue("state"), r.FormValue("code"))
 	if err != nil {
 		fmt.Fprintf(
 			w,
@@ -111,6 +345,11 @@ func (a *Agent) renewHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil || token.AccessToken == "" || token.Expiry.Before(time.Now()) {
 		logger.Error.Println(
 			"cannot get a valid cached token, need a new one")
+		if a.oa.config.Endpoint.AuthURL == "" {
+			go a.deviceCodeLogin()
+			fmt.Fprintln(w, "authenticating via device code, follow the instructions in the agent logs")
+			return
+		}
 		// Get a url for the token challenge and redirect there
 		url, err := a.oa.prepareTokenWebChalenge()
 		if err != nil {
@@ -139,8 +378,12 @@ func (a *Agent) mainHandler(w http.ResponseWriter, r *http.Request) {
 	token, err := a.oa.getTokenFromFile()
 	if err != nil || token.AccessToken == "" {
 		logger.Error.Println("cannot get a valid cached token, you need to authenticate")
-		statusHTTPWriter(w, r, a.deviceManagers, nil)
+		statusHTTPWriter(w, r, a.devices(), a.events, nil)
 		return
 	}
-	statusHTTPWriter(w, r, a.deviceManagers, token)
+	statusHTTPWriter(w, r, a.devices(), a.events, token)
+}
+
+func (a *Agent) statusHandler(w http.ResponseWriter, r *http.Request) {
+	statusJSONWriter(w, a.deviceStatus(), a.events)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"html/template"
 	"net/http"
 	"time"
@@ -84,7 +85,7 @@ var htmlStatusTemplate = `
           </thead>
           <tbody>
           {{range .Routes}}<tr>
-            <td>{{.Device}}</td>
+            <td>{{.Device}}{{ if .Alias }} ({{.Alias}}){{end}}</td>
             <td>{{.Dst}}</td>
             <td>{{.GW}}</td>
 	    {{ if .IsHealthChecked }}
@@ -100,12 +101,17 @@ var htmlStatusTemplate = `
           </tbody>
       </table>
     </div>
+    <div>
+      <h3 class="text-left">Events</h2>
+      <p>Dropped events: {{.DroppedEvents}}</p>
+    </div>
 </body>
 </html>
 `
 
 type httpRoute struct {
 	Device          string
+	Alias           string
 	Dst             string
 	GW              string
 	IsHealthChecked bool
@@ -118,13 +124,88 @@ type httpStatus struct {
 	TokenExpiry       string
 	RouteTableHeaders []string
 	Routes            []httpRoute
+	DroppedEvents     uint64
+}
+
+// agentStatus is the status of the agent served as json, for `-watch`.
+type agentStatus struct {
+	Time          time.Time
+	Devices       []agentDeviceStatus
+	Events        []agentEvent
+	DroppedEvents uint64
+}
+
+type agentDeviceStatus struct {
+	Name    string
+	Alias   string
+	Address string
+	Server  string
+	Expires time.Time
+	Peers   []agentPeerStatus
+	// Routes are the networks routed via the device
+	Routes []string `json:",omitempty"`
+}
+
+type agentPeerStatus struct {
+	PublicKey     string
+	Endpoint      string
+	LastHandshake time.Time
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+// status returns the lease and peers of the device.
+func (dm *DeviceManager) status() agentDeviceStatus {
+	ds := agentDeviceStatus{Name: dm.Name(), Alias: dm.alias}
+	dm.configMutex.Lock()
+	if dm.config != nil {
+		ds.Address = dm.config.LocalAddress.String()
+		ds.Server = dm.config.ServerURL
+		ds.Expires = dm.config.Expires
+		for _, r := range dm.config.Routes {
+			ds.Routes = append(ds.Routes, r.String())
+		}
+	}
+	dm.configMutex.Unlock()
+	dev, err := dm.wireguardDevice(dm.Name())
+	if err != nil {
+		dm.logger.Error.Printf("Cannot get device %s: %v", dm.Name(), err)
+		return ds
+	}
+	for _, p := range dev.Peers {
+		ps := agentPeerStatus{
+			PublicKey:     p.PublicKey.String(),
+			LastHandshake: p.LastHandshakeTime,
+			ReceiveBytes:  p.ReceiveBytes,
+			TransmitBytes: p.TransmitBytes,
+		}
+		if p.Endpoint != nil {
+			ps.Endpoint = p.Endpoint.String()
+		}
+		ds.Peers = append(ds.Peers, ps)
+	}
+	return ds
+}
+
+func statusJSONWriter(w http.ResponseWriter, devices []agentDeviceStatus, events *eventQueue) {
+	status := agentStatus{
+		Time:          time.Now(),
+		Devices:       devices,
+		Events:        events.Recent(),
+		DroppedEvents: events.Dropped(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&status); err != nil {
+		logger.Error.Printf("Failed to write status: %v\n", err)
+	}
 }
 
-func statusHTTPWriter(w http.ResponseWriter, r *http.Request, deviceManagers []*DeviceManager, token *oauth2.Token) {
+func statusHTTPWriter(w http.ResponseWriter, r *http.Request, deviceManagers []*DeviceManager, events *eventQueue, token *oauth2.Token) {
 	status := httpStatus{
-		Time:         time.Now().Format(timeFmt),
-		TokenMissing: true,
-		TokenActive:  true,
+		Time:          time.Now().Format(timeFmt),
+		TokenMissing:  true,
+		TokenActive:   true,
+		DroppedEvents: events.Dropped(),
 	}
 	if token != nil {
 		status.TokenMissing = false
@@ -138,9 +219,10 @@ func statusHTTPWriter(w http.ResponseWriter, r *http.Request, deviceManagers []*
 	routes := []httpRoute{}
 	for _, dm := range deviceManagers {
 		if dm.config != nil {
-			for _, ip := range dm.config.AllowedIPs {
+			for _, ip := range dm.config.Routes {
 				r := httpRoute{
 					Device:          dm.Name(),
+					Alias:           dm.alias,
 					Dst:             ip.String(),
 					GW:              dm.config.LocalAddress.String(),
 					IsHealthChecked: dm.isHealthChecked(),
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var agentRenewalErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "wiresteward_agent_lease_renewal_errors_total",
+	Help: "Number of failed lease renewals.",
+}, []string{"device"})
+
+// agentCollector is a prometheus.Collector for the devices managed by the
+// agent and their leases.
+type agentCollector struct {
+	PeerLastHandshake *prometheus.Desc
+	PeerReceiveBytes  *prometheus.Desc
+	PeerTransmitBytes *prometheus.Desc
+	LeaseExpiryTime   *prometheus.Desc
+
+	// deviceManagers returns the devices to collect metrics for, they can
+	// change when the agent config is reloaded
+	deviceManagers func() []*DeviceManager
+}
+
+func newAgentCollector(deviceManagers func() []*DeviceManager) prometheus.Collector {
+	labels := []string{"device", "public_key", "endpoint"}
+	return &agentCollector{
+		PeerLastHandshake: prometheus.NewDesc(
+			"wiresteward_agent_peer_last_handshake_seconds",
+			"UNIX timestamp for the last handshake with a given peer.",
+			labels,
+			nil,
+		),
+		PeerReceiveBytes: prometheus.NewDesc(
+			"wiresteward_agent_peer_receive_bytes_total",
+			"Number of bytes received from a given peer.",
+			labels,
+			nil,
+		),
+		PeerTransmitBytes: prometheus.NewDesc(
+			"wiresteward_agent_peer_transmit_bytes_total",
+			"Number of bytes transmitted to a given peer.",
+			labels,
+			nil,
+		),
+		LeaseExpiryTime: prometheus.NewDesc(
+			"wiresteward_agent_lease_expiry_time",
+			"UNIX timestamp for the expiry of the lease of a device.",
+			[]string{"device", "address", "server"},
+			nil,
+		),
+		deviceManagers: deviceManagers,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *agentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ds := []*prometheus.Desc{
+		c.PeerLastHandshake,
+		c.PeerReceiveBytes,
+		c.PeerTransmitBytes,
+		c.LeaseExpiryTime,
+	}
+	for _, d := range ds {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *agentCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, dm := range c.deviceManagers() {
+		ds := dm.status()
+		if ds.Address != "" {
+			var expiry float64
+			if !ds.Expires.IsZero() {
+				expiry = float64(ds.Expires.Unix())
+			}
+			ch <- prometheus.MustNewConstMetric(
+				c.LeaseExpiryTime,
+				prometheus.GaugeValue,
+				expiry,
+				ds.Name, ds.Address, ds.Server,
+			)
+		}
+		for _, p := range ds.Peers {
+			// Expose last handshake of 0 unless a last handshake time is set.
+			var last float64
+			if !p.LastHandshake.IsZero() {
+				last = float64(p.LastHandshake.Unix())
+			}
+			ch <- prometheus.MustNewConstMetric(
+				c.PeerLastHandshake,
+				prometheus.GaugeValue,
+				last,
+				ds.Name, p.PublicKey, p.Endpoint,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				c.PeerReceiveBytes,
+				prometheus.CounterValue,
+				float64(p.ReceiveBytes),
+				ds.Name, p.PublicKey, p.Endpoint,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				c.PeerTransmitBytes,
+				prometheus.CounterValue,
+				float64(p.TransmitBytes),
+				ds.Name, p.PublicKey, p.Endpoint,
+			)
+		}
+	}
+}
+
+// tunnelHealth returns an error describing why the tunnel of the device is
+// down: it has no lease, the lease expired, or the peer of the lease has not
+// completed a handshake within handshakeTimeout. Peers are configured with a
+// persistent keepalive, so handshakes happen regularly even without traffic.
+func (dm *DeviceManager) tunnelHealth(now time.Time, handshakeTimeout time.Duration) error {
+	dm.configMutex.Lock()
+	config := dm.config
+	dm.configMutex.Unlock()
+	if config == nil {
+		return fmt.Errorf("no lease")
+	}
+	if !config.Expires.IsZero() && !config.Expires.After(now) {
+		return fmt.Errorf("lease expired at %s", config.Expires.Format(time.RFC3339))
+	}
+	dev, err := dm.wireguardDevice(dm.Name())
+	if err != nil {
+		return fmt.Errorf("cannot get device: %v", err)
+	}
+	for _, p := range dev.Peers {
+		if p.PublicKey != config.PublicKey {
+			continue
+		}
+		if p.LastHandshakeTime.IsZero() {
+			return fmt.Errorf("no handshake with peer %s", p.PublicKey)
+		}
+		if now.Sub(p.LastHandshakeTime) > handshakeTimeout {
+			return fmt.Errorf("last handshake with peer %s at %s", p.PublicKey, p.LastHandshakeTime.Format(time.RFC3339))
+		}
+		return nil
+	}
+	return fmt.Errorf("peer %s is not configured", config.PublicKey)
+}
+
+// healthzWriter reports the tunnel health of every device, responding with
+// 503 Service Unavailable unless all of them are up.
+func healthzWriter(w http.ResponseWriter, deviceManagers []*DeviceManager) {
+	now := time.Now()
+	status := http.StatusOK
+	devices := map[string]string{}
+	for _, dm := range deviceManagers {
+		devices[dm.Name()] = "ok"
+		if err := dm.tunnelHealth(now, defaultHandshakeTimeout); err != nil {
+			devices[dm.Name()] = err.Error()
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(devices); err != nil {
+		logger.Error.Printf("Failed to write health: %v\n", err)
+	}
+}
+
+// serveMetrics serves the agent metrics and health on address, without the
+// authentication and status endpoints of the main agent server, so that it
+// can be exposed for monitoring.
+func (a *Agent) serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", a.healthzHandler)
+	logger.Info.Printf("Starting agent metrics server at %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logger.Error.Printf("Agent metrics server failed: %v", err)
+	}
+}
+
+func (a *Agent) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	healthzWriter(w, a.devices())
+}
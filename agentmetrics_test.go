@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/promtest"
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestAgentCollector(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	peer := newWgKey()
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	dm.config = &WirestewardPeerConfig{
+		LocalAddress: &net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(32, 32)},
+		PeerConfig:   &wgtypes.PeerConfig{PublicKey: peer},
+		ServerURL:    "https://wiresteward.example.com",
+		Expires:      time.Unix(100, 0),
+	}
+	dm.wireguardDevice = func(name string) (*wgtypes.Device, error) {
+		return &wgtypes.Device{Name: name, Peers: []wgtypes.Peer{{
+			PublicKey:         peer,
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 51820},
+			LastHandshakeTime: time.Unix(10, 0),
+			ReceiveBytes:      1,
+			TransmitBytes:     2,
+		}}}, nil
+	}
+
+	body := promtest.Collect(t, newAgentCollector(func() []*DeviceManager { return []*DeviceManager{dm} }))
+	if !promtest.Lint(t, body) {
+		t.Fatal("one or more promlint errors found")
+	}
+	metrics := []string{
+		`wiresteward_agent_lease_expiry_time{address="10.0.0.2/32",device="wg_test",server="https://wiresteward.example.com"} 100`,
+		fmt.Sprintf(`wiresteward_agent_peer_last_handshake_seconds{device="wg_test",endpoint="1.1.1.1:51820",public_key="%v"} 10`, peer),
+		fmt.Sprintf(`wiresteward_agent_peer_receive_bytes_total{device="wg_test",endpoint="1.1.1.1:51820",public_key="%v"} 1`, peer),
+		fmt.Sprintf(`wiresteward_agent_peer_transmit_bytes_total{device="wg_test",endpoint="1.1.1.1:51820",public_key="%v"} 2`, peer),
+	}
+	if !promtest.Match(t, body, metrics) {
+		t.Fatal("metrics did not match whitelist")
+	}
+}
+
+func TestDeviceManager_TunnelHealth(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	now := time.Now()
+	peer := newWgKey()
+	handshake := now.Add(-time.Minute)
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	dm.wireguardDevice = func(name string) (*wgtypes.Device, error) {
+		return &wgtypes.Device{Name: name, Peers: []wgtypes.Peer{{PublicKey: peer, LastHandshakeTime: handshake}}}, nil
+	}
+	healthz := func() (int, map[string]string) {
+		w := httptest.NewRecorder()
+		healthzWriter(w, []*DeviceManager{dm})
+		devices := map[string]string{}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&devices))
+		return w.Code, devices
+	}
+
+	assert.EqualError(t, dm.tunnelHealth(now, 3*time.Minute), "no lease")
+	code, devices := healthz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, map[string]string{"wg_test": "no lease"}, devices)
+
+	dm.config = &WirestewardPeerConfig{PeerConfig: &wgtypes.PeerConfig{PublicKey: peer}, Expires: now.Add(time.Hour)}
+	assert.NoError(t, dm.tunnelHealth(now, 3*time.Minute))
+	code, devices = healthz()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"wg_test": "ok"}, devices)
+
+	handshake = now.Add(-5 * time.Minute)
+	assert.Error(t, dm.tunnelHealth(now, 3*time.Minute))
+
+	handshake = now
+	dm.config.Expires = now.Add(-time.Second)
+	assert.Error(t, dm.tunnelHealth(now, 3*time.Minute))
+
+	dm.config = &WirestewardPeerConfig{PeerConfig: &wgtypes.PeerConfig{PublicKey: newWgKey()}}
+	assert.Error(t, dm.tunnelHealth(now, 3*time.Minute))
+}
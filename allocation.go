@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"net"
+	"sort"
+)
+
+// Strategies of picking the address of new leases.
+const (
+	addressAllocationSequential = "sequential"
+	addressAllocationRandom     = "random"
+	addressAllocationSticky     = "sticky"
+)
+
+// addressAllocator picks the address of a new lease for pubKey, out of the
+// available addresses of network, which are sorted and never empty.
+type addressAllocator interface {
+	pick(network *net.IPNet, available []net.IP, pubKey string) (net.IP, error)
+}
+
+func newAddressAllocator(strategy string) (addressAllocator, error) {
+	switch strategy {
+	case "", addressAllocationSequential:
+		return sequentialAllocator{}, nil
+	case addressAllocationRandom:
+		return randomAllocator{}, nil
+	case addressAllocationSticky:
+		return stickyAllocator{}, nil
+	}
+	return nil, fmt.Errorf("unknown address allocation strategy %q", strategy)
+}
+
+// sequentialAllocator picks the first available address.
+type sequentialAllocator struct{}
+
+func (sequentialAllocator) pick(network *net.IPNet, available []net.IP, pubKey string) (net.IP, error) {
+	return available[0], nil
+}
+
+// randomAllocator picks any available address, so that the addresses of
+// peers cannot be guessed from the order they connected in.
+type randomAllocator struct{}
+
+func (randomAllocator) pick(network *net.IPNet, available []net.IP, pubKey string) (net.IP, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(available))))
+	if err != nil {
+		return nil, fmt.Errorf("cannot pick a random address: %w", err)
+	}
+	return available[n.Int64()], nil
+}
+
+// stickyAllocator picks the address of the network derived from the hash of
+// the public key, so that a key gets the same address whenever it is free,
+// even without address affinity or after the leases are lost. If the address
+// is taken, the next available one is picked, wrapping around the network.
+type stickyAllocator struct{}
+
+func (stickyAllocator) pick(network *net.IPNet, available []net.IP, pubKey string) (net.IP, error) {
+	ones, bits := network.Mask.Size()
+	// The first and last addresses of the network are never leased
+	hosts := uint64(1)<<uint(bits-ones) - 2
+	if bits != 32 || hosts == 0 {
+		return available[0], nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte(pubKey))
+	ip := make(net.IP, net.IPv4len)
+	base := binary.BigEndian.Uint32(network.IP.To4())
+	binary.BigEndian.PutUint32(ip, base+1+uint32(h.Sum64()%hosts))
+	i := sort.Search(len(available), func(i int) bool {
+		return bytes.Compare(available[i].To4(), ip) >= 0
+	})
+	if i == len(available) {
+		i = 0
+	}
+	return available[i], nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerConfig_AddressAllocation(t *testing.T) {
+	for strategy, valid := range map[string]bool{
+		"":           true,
+		"sequential": true,
+		"random":     true,
+		"sticky":     true,
+		"roundrobin": false,
+	} {
+		cfg := &serverConfig{LeasePolicy: &serverLeasePolicyConfig{AddressAllocation: strategy}}
+		if valid {
+			assert.NoError(t, verifyLeasePolicyConfig(cfg), strategy)
+		} else {
+			assert.Error(t, verifyLeasePolicyConfig(cfg), strategy)
+		}
+	}
+}
+
+func TestAddressAllocators(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.90.0.0/24")
+	available, _ := getAvailableIPAddresses(network, nil)
+	key := newWgKey().String()
+
+	ip, err := sequentialAllocator{}.pick(network, available, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.90.0.1", ip.String())
+
+	ip, err = randomAllocator{}.pick(network, available, key)
+	assert.NoError(t, err)
+	assert.True(t, network.Contains(ip))
+
+	// Sticky addresses only depend on the key
+	ip, err = stickyAllocator{}.pick(network, available, key)
+	assert.NoError(t, err)
+	again, _ := stickyAllocator{}.pick(network, available[1:], key)
+	if !ip.Equal(available[0]) {
+		assert.Equal(t, ip, again)
+	}
+
+	// and the next available address is picked on collisions, wrapping
+	// around the network
+	var rest []net.IP
+	for _, a := range available {
+		if !a.Equal(ip) {
+			rest = append(rest, a)
+		}
+	}
+	next, _ := stickyAllocator{}.pick(network, rest, key)
+	if ip.Equal(available[len(available)-1]) {
+		assert.Equal(t, available[0], next)
+	} else {
+		assert.Equal(t, incIP(ip), next)
+	}
+}
+
+func incIP(ip net.IP) net.IP {
+	next := append(net.IP{}, ip.To4()...)
+	incIPAddress(next)
+	return next
+}
+
+func TestFileLeaseManager_AddressAllocationExhaustion(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	for _, strategy := range []string{addressAllocationSequential, addressAllocationRandom, addressAllocationSticky} {
+		allocator, err := newAddressAllocator(strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 6 addresses, one of which is the server's
+		ip, network, _ := net.ParseCIDR("10.90.0.1/29")
+		lm := &FileLeaseManager{
+			wgRecords: map[string]WgRecord{},
+			cidr:      network,
+			ip:        ip,
+			allocator: allocator,
+		}
+		expiry := time.Now().Add(time.Hour)
+		leased := map[string]bool{}
+		for i := 0; i < 5; i++ {
+			record, err := lm.createOrUpdatePeer(string(rune('a'+i))+"@example.com", &leaseRequest{PubKey: newWgKey().String()}, expiry)
+			if !assert.NoError(t, err, strategy) {
+				continue
+			}
+			assert.True(t, network.Contains(record.IP), strategy)
+			assert.False(t, record.IP.Equal(ip), strategy)
+			assert.False(t, leased[record.IP.String()], "%s: %s leased twice", strategy, record.IP)
+			leased[record.IP.String()] = true
+		}
+		_, err = lm.createOrUpdatePeer("f@example.com", &leaseRequest{PubKey: newWgKey().String()}, expiry)
+		assert.Error(t, err, strategy)
+
+		// Released addresses are leased again
+		lm.releaseRecord("c@example.com", lm.wgRecords["c@example.com"])
+		record, err := lm.createOrUpdatePeer("f@example.com", &leaseRequest{PubKey: newWgKey().String()}, expiry)
+		assert.NoError(t, err, strategy)
+		assert.True(t, leased[record.IP.String()], strategy)
+	}
+}
+
+func TestFileLeaseManager_StickyAllocation(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/16")
+	lm := &FileLeaseManager{
+		wgRecords: map[string]WgRecord{},
+		cidr:      network,
+		ip:        ip,
+		allocator: stickyAllocator{},
+	}
+	key := newWgKey().String()
+	expiry := time.Now().Add(time.Hour)
+	record, err := lm.createOrUpdatePeer("alice@example.com", &leaseRequest{PubKey: key}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lm.releaseRecord("alice@example.com", record)
+
+	// The same key gets the same address back, without address affinity
+	again, err := lm.createOrUpdatePeer("alice@example.com", &leaseRequest{PubKey: key}, expiry)
+	assert.NoError(t, err)
+	assert.Equal(t, record.IP, again.IP)
+}
@@ -0,0 +1,215 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: api/lease.proto
+
+package wirestewardv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// LeaseServiceClient is the client API for LeaseService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type LeaseServiceClient interface {
+	// RequestLease grants a lease to the caller, or renews the current one.
+	RequestLease(ctx context.Context, in *LeaseRequest, opts ...grpc.CallOption) (*LeaseResponse, error)
+	// RevokeLease releases the lease of the caller granted to pub_key.
+	RevokeLease(ctx context.Context, in *RevokeLeaseRequest, opts ...grpc.CallOption) (*RevokeLeaseResponse, error)
+	// WatchConfig streams the version of the settings advertised in lease
+	// responses: the current one first, then every change. Agents renew their
+	// lease once it changes.
+	WatchConfig(ctx context.Context, in *WatchConfigRequest, opts ...grpc.CallOption) (LeaseService_WatchConfigClient, error)
+}
+
+type leaseServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLeaseServiceClient(cc grpc.ClientConnInterface) LeaseServiceClient {
+	return &leaseServiceClient{cc}
+}
+
+func (c *leaseServiceClient) RequestLease(ctx context.Context, in *LeaseRequest, opts ...grpc.CallOption) (*LeaseResponse, error) {
+	out := new(LeaseResponse)
+	err := c.cc.Invoke(ctx, "/wiresteward.v1.LeaseService/RequestLease", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *leaseServiceClient) RevokeLease(ctx context.Context, in *RevokeLeaseRequest, opts ...grpc.CallOption) (*RevokeLeaseResponse, error) {
+	out := new(RevokeLeaseResponse)
+	err := c.cc.Invoke(ctx, "/wiresteward.v1.LeaseService/RevokeLease", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *leaseServiceClient) WatchConfig(ctx context.Context, in *WatchConfigRequest, opts ...grpc.CallOption) (LeaseService_WatchConfigClient, error) {
+	stream, err := c.cc.NewStream(ctx, &LeaseService_ServiceDesc.Streams[0], "/wiresteward.v1.LeaseService/WatchConfig", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &leaseServiceWatchConfigClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LeaseService_WatchConfigClient interface {
+	Recv() (*ConfigNotification, error)
+	grpc.ClientStream
+}
+
+type leaseServiceWatchConfigClient struct {
+	grpc.ClientStream
+}
+
+func (x *leaseServiceWatchConfigClient) Recv() (*ConfigNotification, error) {
+	m := new(ConfigNotification)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LeaseServiceServer is the server API for LeaseService service.
+// All implementations must embed UnimplementedLeaseServiceServer
+// for forward compatibility
+type LeaseServiceServer interface {
+	// RequestLease grants a lease to the caller, or renews the current one.
+	RequestLease(context.Context, *LeaseRequest) (*LeaseResponse, error)
+	// RevokeLease releases the lease of the caller granted to pub_key.
+	RevokeLease(context.Context, *RevokeLeaseRequest) (*RevokeLeaseResponse, error)
+	// WatchConfig streams the version of the settings advertised in lease
+	// responses: the current one first, then every change. Agents renew their
+	// lease once it changes.
+	WatchConfig(*WatchConfigRequest, LeaseService_WatchConfigServer) error
+	mustEmbedUnimplementedLeaseServiceServer()
+}
+
+// UnimplementedLeaseServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedLeaseServiceServer struct {
+}
+
+func (UnimplementedLeaseServiceServer) RequestLease(context.Context, *LeaseRequest) (*LeaseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RequestLease not implemented")
+}
+func (UnimplementedLeaseServiceServer) RevokeLease(context.Context, *RevokeLeaseRequest) (*RevokeLeaseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeLease not implemented")
+}
+func (UnimplementedLeaseServiceServer) WatchConfig(*WatchConfigRequest, LeaseService_WatchConfigServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchConfig not implemented")
+}
+func (UnimplementedLeaseServiceServer) mustEmbedUnimplementedLeaseServiceServer() {}
+
+// UnsafeLeaseServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LeaseServiceServer will
+// result in compilation errors.
+type UnsafeLeaseServiceServer interface {
+	mustEmbedUnimplementedLeaseServiceServer()
+}
+
+func RegisterLeaseServiceServer(s grpc.ServiceRegistrar, srv LeaseServiceServer) {
+	s.RegisterService(&LeaseService_ServiceDesc, srv)
+}
+
+func _LeaseService_RequestLease_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LeaseServiceServer).RequestLease(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wiresteward.v1.LeaseService/RequestLease",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LeaseServiceServer).RequestLease(ctx, req.(*LeaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LeaseService_RevokeLease_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeLeaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LeaseServiceServer).RevokeLease(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wiresteward.v1.LeaseService/RevokeLease",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LeaseServiceServer).RevokeLease(ctx, req.(*RevokeLeaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LeaseService_WatchConfig_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchConfigRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LeaseServiceServer).WatchConfig(m, &leaseServiceWatchConfigServer{stream})
+}
+
+type LeaseService_WatchConfigServer interface {
+	Send(*ConfigNotification) error
+	grpc.ServerStream
+}
+
+type leaseServiceWatchConfigServer struct {
+	grpc.ServerStream
+}
+
+func (x *leaseServiceWatchConfigServer) Send(m *ConfigNotification) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// LeaseService_ServiceDesc is the grpc.ServiceDesc for LeaseService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var LeaseService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "wiresteward.v1.LeaseService",
+	HandlerType: (*LeaseServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RequestLease",
+			Handler:    _LeaseService_RequestLease_Handler,
+		},
+		{
+			MethodName: "RevokeLease",
+			Handler:    _LeaseService_RevokeLease_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchConfig",
+			Handler:       _LeaseService_WatchConfig_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/lease.proto",
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// leaseEventRejected is only recorded in the audit log, for lease requests
+// that were refused.
+const leaseEventRejected leaseEventType = "LeaseRejected"
+
+// auditRecord is an entry of the audit log. Requests record who made them,
+// from where and how they authenticated, changes made by the server itself
+// have no source.
+type auditRecord struct {
+	Type              leaseEventType `json:"type"`
+	Username          string         `json:"username,omitempty"`
+	SourceIP          string         `json:"sourceIP,omitempty"`
+	Auth              string         `json:"auth,omitempty"`
+	ClientID          string         `json:"clientID,omitempty"`
+	PublicKey         string         `json:"publicKey,omitempty"`
+	PreviousPublicKey string         `json:"previousPublicKey,omitempty"`
+	IP                string         `json:"ip,omitempty"`
+	DelegatedPrefix   string         `json:"delegatedPrefix,omitempty"`
+	Expires           *time.Time     `json:"expires,omitempty"`
+	Reason            string         `json:"reason,omitempty"`
+	Time              time.Time      `json:"time"`
+}
+
+// newAuditRecord returns the audit record of a change to the lease r of
+// username.
+func newAuditRecord(t leaseEventType, username string, r WgRecord) auditRecord {
+	expires := r.expires.UTC()
+	a := auditRecord{
+		Type:      t,
+		Username:  username,
+		ClientID:  r.ClientID,
+		PublicKey: r.PubKey,
+		IP:        r.IP.String(),
+		Expires:   &expires,
+	}
+	if r.DelegatedPrefix != nil {
+		a.DelegatedPrefix = r.DelegatedPrefix.String()
+	}
+	return a
+}
+
+// fromRequest records the source address of req in the record.
+func (a auditRecord) fromRequest(req *http.Request) auditRecord {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	a.SourceIP = host
+	return a
+}
+
+// auditLog appends records of lease operations, one JSON object per line, to
+// a file and/or syslog. Records are written synchronously, so that none are
+// lost, and failures to write them are logged.
+type auditLog struct {
+	filename string
+	file     *os.File
+	syslog   io.Writer
+	mutex    sync.Mutex
+}
+
+func newAuditLog(cfg *serverAuditLogConfig) (*auditLog, error) {
+	al := &auditLog{filename: cfg.Filename}
+	if cfg.Filename != "" {
+		if err := al.reopen(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Syslog {
+		w, err := newSyslogWriter()
+		if err != nil {
+			return nil, err
+		}
+		al.syslog = w
+	}
+	return al, nil
+}
+
+// reopen opens the audit log file again, so that it can be rotated.
+func (al *auditLog) reopen() error {
+	if al == nil || al.filename == "" {
+		return nil
+	}
+	f, err := os.OpenFile(al.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	if al.file != nil {
+		al.file.Close()
+	}
+	al.file = f
+	return nil
+}
+
+// record appends r to the log, stamped with the current time. It is safe to
+// call on a nil auditLog.
+func (al *auditLog) record(r auditRecord) {
+	if al == nil {
+		return
+	}
+	r.Time = time.Now().UTC()
+	line, err := json.Marshal(r)
+	if err != nil {
+		logger.Error.Printf("Cannot encode audit record: %v", err)
+		return
+	}
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	if al.file != nil {
+		if _, err := al.file.Write(append(line, '\n')); err != nil {
+			logger.Error.Printf("Cannot write audit log %s: %v", al.filename, err)
+		}
+	}
+	if al.syslog != nil {
+		if _, err := al.syslog.Write(line); err != nil {
+			logger.Error.Printf("Cannot write audit log to syslog: %v", err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readAuditLog returns the records in the audit log filename.
+func readAuditLog(t *testing.T, filename string) []auditRecord {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []auditRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r auditRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	al, err := newAuditLog(&serverAuditLogConfig{Filename: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := WgRecord{PubKey: validPublicKey, IP: net.ParseIP("10.90.0.2"), ClientID: "laptop", expires: time.Now().Add(time.Hour)}
+	al.record(newAuditRecord(leaseEventExpired, "alice@example.com", r))
+	records := readAuditLog(t, filename)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, leaseEventExpired, records[0].Type)
+	assert.Equal(t, "alice@example.com", records[0].Username)
+	assert.Equal(t, "10.90.0.2", records[0].IP)
+	assert.Equal(t, "laptop", records[0].ClientID)
+	assert.False(t, records[0].Time.IsZero())
+
+	// Records are appended to the file opened again after it was rotated
+	if err := os.Rename(filename, filename+".1"); err != nil {
+		t.Fatal(err)
+	}
+	al.record(newAuditRecord(leaseEventRevoked, "bob@example.com", r))
+	assert.NoError(t, al.reopen())
+	al.record(newAuditRecord(leaseEventRevoked, "carol@example.com", r))
+	assert.Equal(t, 2, len(readAuditLog(t, filename+".1")))
+	records = readAuditLog(t, filename)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "carol@example.com", records[0].Username)
+
+	// A nil audit log records nothing
+	var none *auditLog
+	none.record(auditRecord{})
+	assert.NoError(t, none.reopen())
+}
+
+func TestHTTPLeaseHandler_AuditRejected(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	introspection := newTestIntrospectionServer("test@example.com")
+	defer introspection.Close()
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	al, err := newAuditLog(&serverAuditLogConfig{Filename: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lh := &HTTPLeaseHandler{
+		tokenValidator: newTokenValidator("client_id", introspection.URL),
+		policyHooks: []leasePolicyHook{
+			func(username string, req *leaseRequest, dryRun bool) error {
+				return fmt.Errorf("not allowed")
+			},
+		},
+		audit: al,
+	}
+	body, _ := json.Marshal(&leaseRequest{PubKey: validPublicKey, ClientID: "laptop"})
+	req := httptest.NewRequest("POST", "/newPeerLease", bytes.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:40000"
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	lh.newPeerLease(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	records := readAuditLog(t, filename)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, auditRecord{
+		Type:      leaseEventRejected,
+		Username:  "test@example.com",
+		SourceIP:  "192.0.2.1",
+		Auth:      "token",
+		ClientID:  "laptop",
+		PublicKey: validPublicKey,
+		Reason:    "not allowed",
+		Time:      records[0].Time,
+	}, records[0])
+}
@@ -0,0 +1,14 @@
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// newSyslogWriter returns a writer logging to the local syslog daemon, with
+// the authpriv facility.
+func newSyslogWriter() (io.Writer, error) {
+	return syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, "wiresteward")
+}
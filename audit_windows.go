@@ -0,0 +1,13 @@
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Syslog is not available on windows.
+func newSyslogWriter() (io.Writer, error) {
+	return nil, fmt.Errorf("syslog is not supported on windows")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+const (
+	bondModeActiveBackup = "active-backup"
+
+	// Routes of the active member of a bond are installed with a lower
+	// metric than the ones of the backup members, so that the kernel prefers
+	// them.
+	bondActiveRouteMetric   = 100
+	bondBackupRouteMetric   = 200
+	bondCheckInterval       = 5 * time.Second
+	defaultHandshakeTimeout = 3 * time.Minute
+	// By default, traffic is shifted off a member the first time its
+	// handshake is found stale.
+	defaultBondStaleChecks = 1
+)
+
+// bondMember is a device that is part of a tunnelBond.
+type bondMember interface {
+	Name() string
+	// lastHandshake returns the time of the latest handshake with any of
+	// the device peers.
+	lastHandshake() (time.Time, error)
+	setRouteMetric(metric int) error
+}
+
+// tunnelBond implements an active-backup policy over a set of devices with
+// overlapping routes: traffic is routed via the first member that is up, and
+// shifted to the next one once the active member goes down. A member is
+// considered down after its latest handshake was found stale on staleChecks
+// consecutive checks.
+type tunnelBond struct {
+	name             string
+	members          []bondMember
+	handshakeTimeout time.Duration
+	staleChecks      int
+	// stale counts the consecutive checks each member was found stale on
+	stale  []int
+	active int
+	events *eventQueue
+}
+
+func newTunnelBond(name string, members []bondMember, handshakeTimeout time.Duration, staleChecks int) *tunnelBond {
+	if handshakeTimeout == 0 {
+		handshakeTimeout = defaultHandshakeTimeout
+	}
+	if staleChecks == 0 {
+		staleChecks = defaultBondStaleChecks
+	}
+	return &tunnelBond{
+		name:             name,
+		members:          members,
+		handshakeTimeout: handshakeTimeout,
+		staleChecks:      staleChecks,
+		stale:            make([]int, len(members)),
+		active:           -1,
+	}
+}
+
+// check selects the active member of the bond based on the handshakes of
+// the members at the time now, and updates the route metrics if it changed.
+// If all members are down, the first one is used.
+func (b *tunnelBond) check(now time.Time) {
+	active := -1
+	for i, m := range b.members {
+		hs, err := m.lastHandshake()
+		if err != nil {
+			logger.Error.Printf("Cannot get latest handshake of device %s: %v", m.Name(), err)
+			continue
+		}
+		if !hs.IsZero() && now.Sub(hs) < b.handshakeTimeout {
+			b.stale[i] = 0
+		} else {
+			b.stale[i]++
+		}
+		if active < 0 && b.stale[i] < b.staleChecks {
+			active = i
+		}
+	}
+	if active < 0 {
+		active = 0
+	}
+	if active == b.active {
+		return
+	}
+	// Prefer the new member before demoting the old one, so that there is
+	// always a route in place
+	if err := b.members[active].setRouteMetric(bondActiveRouteMetric); err != nil {
+		logger.Error.Printf("Cannot activate device %s of bond %s: %v", b.members[active].Name(), b.name, err)
+		return
+	}
+	for i, m := range b.members {
+		if i == active {
+			continue
+		}
+		if err := m.setRouteMetric(bondBackupRouteMetric); err != nil {
+			logger.Error.Printf("Cannot demote device %s of bond %s: %v", m.Name(), b.name, err)
+		}
+	}
+	if b.active >= 0 {
+		b.events.emit(eventBondFailover, b.name, "traffic shifted from device %s to %s", b.members[b.active].Name(), b.members[active].Name())
+	}
+	b.active = active
+}
+
+func (b *tunnelBond) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	b.check(time.Now())
+	for {
+		select {
+		case <-ticker.C:
+			b.check(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (dm *DeviceManager) lastHandshake() (time.Time, error) {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer wg.Close()
+	dev, err := wg.Device(dm.Name())
+	if err != nil {
+		return time.Time{}, err
+	}
+	var last time.Time
+	for _, p := range dev.Peers {
+		if p.LastHandshakeTime.After(last) {
+			last = p.LastHandshakeTime
+		}
+	}
+	return last, nil
+}
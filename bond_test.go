@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeBondMember struct {
+	name      string
+	handshake time.Time
+	metric    int
+}
+
+func (m *fakeBondMember) Name() string                      { return m.name }
+func (m *fakeBondMember) lastHandshake() (time.Time, error) { return m.handshake, nil }
+func (m *fakeBondMember) setRouteMetric(metric int) error {
+	m.metric = metric
+	return nil
+}
+
+func TestTunnelBond_Failover(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	now := time.Now()
+	primary := &fakeBondMember{name: "wg_primary", handshake: now.Add(-time.Minute)}
+	backup := &fakeBondMember{name: "wg_backup", handshake: now.Add(-time.Minute)}
+	bond := newTunnelBond("test", []bondMember{primary, backup}, 3*time.Minute, 0)
+	bond.events = newEventQueue(defaultEventQueueSize)
+
+	bond.check(now)
+	assert.Equal(t, bondActiveRouteMetric, primary.metric)
+	assert.Equal(t, bondBackupRouteMetric, backup.metric)
+
+	// The handshake of the primary goes stale, traffic should move to the
+	// backup
+	now = now.Add(5 * time.Minute)
+	backup.handshake = now.Add(-time.Minute)
+	bond.check(now)
+	assert.Equal(t, bondBackupRouteMetric, primary.metric)
+	assert.Equal(t, bondActiveRouteMetric, backup.metric)
+	e := <-bond.events.Events()
+	assert.Equal(t, eventBondFailover, e.Type)
+	assert.Equal(t, "test", e.Device)
+
+	// and back once the primary recovers
+	primary.handshake = now
+	bond.check(now)
+	assert.Equal(t, bondActiveRouteMetric, primary.metric)
+	assert.Equal(t, bondBackupRouteMetric, backup.metric)
+}
+
+func TestTunnelBond_StaleChecks(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	now := time.Now()
+	// A quiet link: the primary handshakes rarely and its latest handshake
+	// keeps going stale between them
+	primary := &fakeBondMember{name: "wg_primary", handshake: now}
+	backup := &fakeBondMember{name: "wg_backup", handshake: now}
+	bond := newTunnelBond("test", []bondMember{primary, backup}, 3*time.Minute, 3)
+	bond.events = newEventQueue(defaultEventQueueSize)
+
+	bond.check(now)
+	assert.Equal(t, bondActiveRouteMetric, primary.metric)
+
+	// Stale on two consecutive checks, traffic should stay on the primary
+	for i := 0; i < 2; i++ {
+		now = now.Add(4 * time.Minute)
+		backup.handshake = now
+		bond.check(now)
+		assert.Equal(t, bondActiveRouteMetric, primary.metric)
+		assert.Equal(t, bondBackupRouteMetric, backup.metric)
+	}
+
+	// A handshake resets the count
+	primary.handshake = now
+	bond.check(now)
+	for i := 0; i < 2; i++ {
+		now = now.Add(4 * time.Minute)
+		backup.handshake = now
+		bond.check(now)
+		assert.Equal(t, bondActiveRouteMetric, primary.metric)
+	}
+	select {
+	case e := <-bond.events.Events():
+		t.Fatalf("unexpected event: %v", e)
+	default:
+	}
+
+	// The third consecutive stale check shifts traffic to the backup
+	now = now.Add(4 * time.Minute)
+	backup.handshake = now
+	bond.check(now)
+	assert.Equal(t, bondBackupRouteMetric, primary.metric)
+	assert.Equal(t, bondActiveRouteMetric, backup.metric)
+	e := <-bond.events.Events()
+	assert.Equal(t, eventBondFailover, e.Type)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Linux capabilities needed by the agent, as bit numbers in the capability
+// sets. CAP_NET_ADMIN is needed to create and configure devices, and
+// CAP_NET_RAW for the raw sockets of the ICMP health checks and the probes.
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+)
+
+var capabilityNames = map[uint]string{
+	capNetAdmin: "CAP_NET_ADMIN",
+	capNetRaw:   "CAP_NET_RAW",
+}
+
+// parseEffectiveCapabilities returns the effective capability set from the
+// contents of /proc/<pid>/status.
+func parseEffectiveCapabilities(status io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse effective capabilities: %v", err)
+		}
+		return caps, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("effective capabilities not found")
+}
+
+func hasCapability(effective uint64, capability uint) bool {
+	return effective&(1<<capability) != 0
+}
+
+// preflightAgent checks that the agent holds the capabilities needed by cfg,
+// given its effective capability set. It fails if CAP_NET_ADMIN is missing.
+// If CAP_NET_RAW is missing, the features that need it are disabled in cfg
+// instead and a warning naming them is logged.
+func preflightAgent(cfg *agentConfig, effective uint64) error {
+	if !hasCapability(effective, capNetAdmin) {
+		return fmt.Errorf("missing capability %s, needed to configure wireguard devices", capabilityNames[capNetAdmin])
+	}
+	if hasCapability(effective, capNetRaw) {
+		return nil
+	}
+	for i := range cfg.Devices {
+		dev := &cfg.Devices[i]
+		disabled := []string{}
+		if len(dev.Peers) > 1 || dev.Failover != nil {
+			disabled = append(disabled, "health checks")
+			dev.noHealthCheck = true
+		}
+		if dev.AddressProbe != nil {
+			disabled = append(disabled, "address probe")
+			dev.AddressProbe = nil
+		}
+		if dev.ReachabilityProbe != nil {
+			disabled = append(disabled, "reachability probe")
+			dev.ReachabilityProbe = nil
+		}
+		if len(disabled) > 0 {
+			logger.Error.Printf(
+				"Missing capability %s, disabling %s of device %s",
+				capabilityNames[capNetRaw],
+				strings.Join(disabled, ", "),
+				dev.Name,
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+// +build darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// effectiveCapabilities returns the effective capability set of the agent.
+// There are no capabilities on darwin, where the agent has to run as root and
+// is then allowed everything.
+func effectiveCapabilities() (uint64, error) {
+	if os.Geteuid() != 0 {
+		return 0, fmt.Errorf("the agent must run as root")
+	}
+	return ^uint64(0), nil
+}
@@ -0,0 +1,17 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+)
+
+// effectiveCapabilities returns the effective capability set of the agent.
+func effectiveCapabilities() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseEffectiveCapabilities(f)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEffectiveCapabilities(t *testing.T) {
+	status := "Name:\twiresteward\nCapInh:\t0000000000000000\nCapPrm:\t0000000000003000\nCapEff:\t0000000000003000\n"
+	caps, err := parseEffectiveCapabilities(strings.NewReader(status))
+	assert.NoError(t, err)
+	assert.True(t, hasCapability(caps, capNetAdmin))
+	assert.True(t, hasCapability(caps, capNetRaw))
+
+	caps, err = parseEffectiveCapabilities(strings.NewReader("CapEff:\t0000000000001000\n"))
+	assert.NoError(t, err)
+	assert.True(t, hasCapability(caps, capNetAdmin))
+	assert.False(t, hasCapability(caps, capNetRaw))
+
+	_, err = parseEffectiveCapabilities(strings.NewReader("Name:\twiresteward\n"))
+	assert.Error(t, err)
+}
+
+func TestPreflightAgent(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	newConfig := func() *agentConfig {
+		return &agentConfig{
+			Devices: []agentDeviceConfig{
+				{
+					Name:              "wg_test",
+					Peers:             []agentPeerConfig{{URL: "https://a.example.com"}, {URL: "https://b.example.com"}},
+					AddressProbe:      &agentAddressProbeConfig{},
+					ReachabilityProbe: &agentReachabilityProbeConfig{Target: "10.0.0.1"},
+				},
+			},
+		}
+	}
+
+	// CAP_NET_ADMIN is required
+	err := preflightAgent(newConfig(), 1<<capNetRaw)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "missing capability CAP_NET_ADMIN")
+
+	// Everything is enabled with both capabilities
+	cfg := newConfig()
+	assert.NoError(t, preflightAgent(cfg, 1<<capNetAdmin|1<<capNetRaw))
+	assert.False(t, cfg.Devices[0].noHealthCheck)
+	assert.NotNil(t, cfg.Devices[0].AddressProbe)
+	assert.NotNil(t, cfg.Devices[0].ReachabilityProbe)
+
+	// and the features needing raw sockets are disabled without CAP_NET_RAW
+	cfg = newConfig()
+	assert.NoError(t, preflightAgent(cfg, 1<<capNetAdmin))
+	assert.True(t, cfg.Devices[0].noHealthCheck)
+	assert.Nil(t, cfg.Devices[0].AddressProbe)
+	assert.Nil(t, cfg.Devices[0].ReachabilityProbe)
+}
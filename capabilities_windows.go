@@ -0,0 +1,19 @@
+// +build windows
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// effectiveCapabilities returns the effective capability set of the agent.
+// There are no capabilities on windows, where the agent has to run elevated
+// and is then allowed everything.
+func effectiveCapabilities() (uint64, error) {
+	if !windows.GetCurrentProcessToken().IsElevated() {
+		return 0, fmt.Errorf("the agent must run as administrator")
+	}
+	return ^uint64(0), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultCaptivePortalURL            = "http://connectivitycheck.gstatic.com/generate_204"
+	defaultCaptivePortalExpectedStatus = http.StatusNoContent
+	defaultCaptivePortalInterval       = 10 * time.Second
+	defaultCaptivePortalTimeout        = 5 * time.Second
+)
+
+// errCaptivePortal is returned when a lease renewal is deferred because the
+// network is behind a captive portal.
+var errCaptivePortal = errors.New("captive portal detected")
+
+// captivePortalDetector probes a well known url and expects a specific
+// response status. Captive portals intercept the request and typically
+// respond with a redirect to their login page instead.
+type captivePortalDetector struct {
+	client         *http.Client
+	expectedStatus int
+	interval       time.Duration
+	url            string
+}
+
+func newCaptivePortalDetector(cfg *agentCaptivePortalConfig) *captivePortalDetector {
+	d := &captivePortalDetector{
+		expectedStatus: cfg.ExpectedStatus,
+		interval:       cfg.Interval.Duration,
+		url:            cfg.URL,
+	}
+	if d.expectedStatus == 0 {
+		d.expectedStatus = defaultCaptivePortalExpectedStatus
+	}
+	if d.interval == 0 {
+		d.interval = defaultCaptivePortalInterval
+	}
+	if d.url == "" {
+		d.url = defaultCaptivePortalURL
+	}
+	timeout := cfg.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultCaptivePortalTimeout
+	}
+	d.client = &http.Client{
+		Timeout: timeout,
+		// Redirects are what portals respond with, do not follow them
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return d
+}
+
+// detect returns whether the probe was intercepted by a captive portal.
+// Errors reaching the probe url are not considered a portal, as the network
+// might just be down or the url blocked.
+func (d *captivePortalDetector) detect() (bool, error) {
+	resp, err := d.client.Get(d.url)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != d.expectedStatus {
+		logger.Debug.Printf("Captive portal probe to %s returned %s, expected %d", d.url, resp.Status, d.expectedStatus)
+		return true, nil
+	}
+	return false, nil
+}
+
+// checkCaptivePortal returns errCaptivePortal if captive portal detection is
+// enabled and the network is behind one, so that the tunnel, and potentially
+// a full tunnel default route, is not brought up before the portal is
+// cleared.
+func (dm *DeviceManager) checkCaptivePortal() error {
+	if dm.captivePortalDetector == nil {
+		return nil
+	}
+	detected, err := dm.captivePortalDetector.detect()
+	if err != nil {
+		dm.logger.Error.Printf("Cannot probe for a captive portal: %v", err)
+	}
+	if !detected {
+		if dm.behindCaptivePortal {
+			dm.logger.Info.Printf("Captive portal cleared, bringing up device %s", dm.Name())
+		}
+		dm.behindCaptivePortal = false
+		return nil
+	}
+	if !dm.behindCaptivePortal {
+		dm.events.emit(eventCaptivePortalDetected, dm.Name(), "captive portal detected, deferring the tunnel until it is cleared")
+	}
+	dm.behindCaptivePortal = true
+	return fmt.Errorf("%w, retrying in %s", errCaptivePortal, dm.captivePortalDetector.interval)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceManager_CaptivePortal(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	var cleared int32
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&cleared) == 0 {
+			http.Redirect(w, r, "http://portal.example.com/login", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer portal.Close()
+
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	dm.events = newEventQueue(defaultEventQueueSize)
+	dm.captivePortalDetector = newCaptivePortalDetector(&agentCaptivePortalConfig{
+		URL:      portal.URL + "/generate_204",
+		Interval: duration{time.Second},
+	})
+
+	// The tunnel should not be brought up while the portal intercepts
+	// requests, and the event should only be emitted once
+	for i := 0; i < 2; i++ {
+		err := dm.checkCaptivePortal()
+		assert.True(t, errors.Is(err, errCaptivePortal))
+		assert.Equal(t, time.Second, dm.handleRenewError(err))
+	}
+	e := <-dm.events.Events()
+	assert.Equal(t, eventCaptivePortalDetected, e.Type)
+	assert.Equal(t, "wg_test", e.Device)
+	assert.Equal(t, 0, len(dm.events.Events()))
+
+	atomic.StoreInt32(&cleared, 1)
+	assert.NoError(t, dm.checkCaptivePortal())
+	assert.False(t, dm.behindCaptivePortal)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// checkTimeout bounds each request the agent check sends to servers.
+const checkTimeout = 10 * time.Second
+
+// checkAgent implements `wiresteward -agent -check`: it validates the config,
+// checks the cached token and asks every server for the lease it would grant,
+// printing what the devices would be configured with. Nothing is configured,
+// and the status is non zero if any check failed.
+func checkAgent() {
+	cfg, err := readAgentConfig(*flagConfig)
+	exitOnConfigError(err)
+	fmt.Printf("%s is valid\n", *flagConfig)
+	ok := true
+	if effective, err := effectiveCapabilities(); err != nil {
+		fmt.Printf("cannot check agent capabilities: %v\n", err)
+	} else if err := preflightAgent(cfg, effective); err != nil {
+		fmt.Printf("the agent cannot run: %v\n", err)
+		ok = false
+	}
+	oa := newOAuthTokenHandler(
+		cfg.OAuth.AuthURL,
+		cfg.OAuth.TokenURL,
+		cfg.OAuth.DeviceAuthURL,
+		cfg.OAuth.ClientID,
+		defaultTokenFileLoc,
+	)
+	if oa.tokenStore, err = newSecretStore(cfg.OAuth.TokenStore, cfg.EncryptedStore); err != nil {
+		fmt.Printf("cannot open token store: %v\n", err)
+		os.Exit(1)
+	}
+	token, err := oa.refreshToken(false)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		fmt.Println("no cached token, leases are not checked until the agent is authenticated")
+	case err != nil:
+		fmt.Printf("cannot get token: %v\n", err)
+		ok = false
+	default:
+		if expiry, isJWT := jwtExpiry(token); isJWT {
+			fmt.Printf("token expires: %s\n", expiry.Format(timeFmt))
+		} else {
+			fmt.Println("token found")
+		}
+	}
+	if !checkDevices(os.Stdout, cfg, token) {
+		ok = false
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// checkDevices writes the result of checking the servers of every device to
+// w, and returns whether they all passed. Leases are only requested if token
+// is set.
+func checkDevices(w io.Writer, cfg *agentConfig, token string) bool {
+	resolver := newResolverChain(cfg.Resolvers)
+	ok := true
+	for _, dev := range cfg.Devices {
+		dm := newDeviceManager(dev, cfg.ClientID)
+		fmt.Fprintf(w, "device %s:\n", dev.Name)
+		for _, server := range dev.Peers {
+			fmt.Fprintf(w, "  server %s:\n", server.URL)
+			if err := checkServer(w, dm, server, resolver, token); err != nil {
+				fmt.Fprintf(w, "    error: %v\n", err)
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+// checkServer resolves the host of server and, if token is set, writes the
+// lease it would grant to dm. The lease is requested for the key of the
+// device if it is up, or else for a throwaway key, in which case addresses
+// reserved for the key of the device are not reported.
+func checkServer(w io.Writer, dm *DeviceManager, server agentPeerConfig, resolver resolverChain, token string) error {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		return err
+	}
+	ip, err := resolver.lookupIPv4(u.Hostname())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "    resolves to: %s\n", ip)
+	if token == "" {
+		return nil
+	}
+	pubKey, _, err := getKeys(dm.Name())
+	if err != nil || pubKey == emptyKey {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+		pubKey = key.PublicKey().String()
+	}
+	c, err := verifiedLeaseClient(server)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	response, err := c.DryRun(ctx, token, &leaseRequest{
+		PubKey:          pubKey,
+		ClientID:        dm.clientID,
+		Extra:           server.Extra,
+		DelegatedPrefix: server.RequestDelegatedPrefix,
+		Version:         leaseRequestVersion,
+		Pool:            server.Pool,
+		Device:          server.Device,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot get lease: %w", err)
+	}
+	config, _, err := newWirestewardPeerConfigFromLeaseResponse(response, resolver)
+	if err != nil {
+		return err
+	}
+	if dm.fullTunnel != nil {
+		addDefaultRoutes(config)
+	}
+	fmt.Fprintf(w, "    address: %s\n", config.LocalAddress)
+	if config.LocalAddress6 != nil {
+		fmt.Fprintf(w, "    address6: %s\n", config.LocalAddress6)
+	}
+	if config.Endpoint != nil {
+		fmt.Fprintf(w, "    endpoint: %s (%s)\n", config.ServerEndpoint, config.Endpoint)
+	}
+	routes := []string{}
+	for _, r := range dm.installedRoutes(config) {
+		routes = append(routes, r.String())
+	}
+	fmt.Fprintf(w, "    routes: %s\n", strings.Join(routes, ", "))
+	if dm.mtu == 0 && config.MTU != 0 {
+		fmt.Fprintf(w, "    mtu: %d\n", config.MTU)
+	}
+	if dm.ignoreDNS {
+		return nil
+	}
+	if len(config.DNSServers) > 0 {
+		fmt.Fprintf(w, "    dns servers: %v\n", config.DNSServers)
+	}
+	if len(config.SearchDomains) > 0 {
+		fmt.Fprintf(w, "    search domains: %s\n", strings.Join(config.SearchDomains, ", "))
+	}
+	for _, r := range config.DNSRoutes {
+		fmt.Fprintf(w, "    dns route: %s\n", r)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/wiresteward/client"
+)
+
+func TestCheckDevices(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != client.DryRunPath {
+			http.NotFound(w, r)
+			return
+		}
+		lr := &leaseRequest{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(lr))
+		assert.Equal(t, "ci", lr.ClientID)
+		json.NewEncoder(w).Encode(&leaseResponse{
+			Status:     "success",
+			IP:         "10.90.0.2/32",
+			PubKey:     validPublicKey,
+			Endpoint:   "wiresteward.example.com:51820",
+			AllowedIPs: []string{"10.0.0.0/8", "172.16.0.0/12"},
+			DNSServers: []string{"10.90.0.1"},
+		})
+	}))
+	defer ts.Close()
+	cfg := &agentConfig{
+		ClientID: "ci",
+		Resolvers: []agentResolverConfig{{
+			Type:  resolverTypeStatic,
+			Hosts: map[string]string{"wiresteward.example.com": "1.2.3.4"},
+		}},
+		Devices: []agentDeviceConfig{{Name: "wg_test", Peers: []agentPeerConfig{{URL: ts.URL}}}},
+	}
+
+	out := &bytes.Buffer{}
+	assert.True(t, checkDevices(out, cfg, "token"))
+	assert.Contains(t, out.String(), "  server "+ts.URL+":\n    resolves to: 127.0.0.1\n")
+	assert.Contains(t, out.String(), "    address: 10.90.0.2/32\n")
+	assert.Contains(t, out.String(), "    endpoint: wiresteward.example.com:51820 (1.2.3.4:51820)\n")
+	assert.Contains(t, out.String(), "    routes: 10.0.0.0/8, 172.16.0.0/12\n")
+	assert.Contains(t, out.String(), "    dns servers: [10.90.0.1]\n")
+
+	// Without a token, only the servers are resolved
+	out.Reset()
+	assert.True(t, checkDevices(out, cfg, ""))
+	assert.NotContains(t, out.String(), "address:")
+
+	// Servers that do not support dry runs fail the check
+	cfg.Devices[0].Peers[0].URL = ts.URL + "/old"
+	out.Reset()
+	assert.False(t, checkDevices(out, cfg, "token"))
+	assert.Contains(t, out.String(), "error: cannot get lease: server does not support dry runs\n")
+}
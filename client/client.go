@@ -0,0 +1,325 @@
+// Package client implements the lease API of wiresteward servers, so that
+// tools other than the agent can request leases programmatically.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// LeasePath is the path of version 1 of the lease API.
+	LeasePath = "/api/v1/lease"
+	// LegacyLeasePath is the unversioned path of the lease API, which
+	// servers keep serving for older agents.
+	LegacyLeasePath = "/newPeerLease"
+	// ConfigPath is the path of the version of the settings servers
+	// advertise to agents.
+	ConfigPath = "/api/v1/config"
+	// DryRunPath is the path servers respond with the lease they would grant
+	// on, without granting it.
+	DryRunPath = "/api/v1/lease/dry-run"
+
+	defaultMethod        = "POST"
+	defaultRetryInterval = time.Second
+)
+
+// ErrUnauthorized is returned when a server rejects the token used to request
+// a lease.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrNoLease is returned when a renewal is requested for a public key that
+// does not hold a lease on the server.
+var ErrNoLease = errors.New("no lease to renew")
+
+// LeaseRequest defines the payload of a lease HTTP request submitted by an
+// agent.
+type LeaseRequest struct {
+	PubKey   string
+	ClientID string `json:",omitempty"`
+	// Extra holds deployment specific fields that are passed through to the
+	// server policy hooks.
+	Extra map[string]string `json:",omitempty"`
+	// DelegatedPrefix asks the server to delegate a routed prefix to the
+	// peer, in addition to its address.
+	DelegatedPrefix bool `json:",omitempty"`
+	// ConflictingIP is an address the agent found in use on its network, the
+	// server should lease a different one if it is the current address.
+	ConflictingIP string `json:",omitempty"`
+	// Version is the lease API version spoken by the agent, servers may
+	// redact response fields for older agents.
+	Version int `json:",omitempty"`
+	// PreviousPubKey is set when the agent rotates its key, to the public
+	// key the current lease was granted to. The server moves the lease to
+	// PubKey, keeping its address.
+	PreviousPubKey string `json:",omitempty"`
+	// Pool is the name of the address pool to lease from, the server picks
+	// one if empty.
+	Pool string `json:",omitempty"`
+	// Renew asks the server to only renew the lease held by PubKey, and to
+	// respond with ErrNoLease instead of granting a new one if there is
+	// none, so that retried renewals never lease another address.
+	Renew bool `json:",omitempty"`
+	// Device is the name of the wireguard device of the server to lease
+	// on, the server picks one if empty.
+	Device string `json:",omitempty"`
+}
+
+// LeaseResponse define the payload of a lease HTTP response returned by a
+// server.
+type LeaseResponse struct {
+	Status            string
+	IP                string
+	ServerWireguardIP string
+	AllowedIPs        []string
+	// AllowedIPsFlags maps entries of AllowedIPs to whether they should only
+	// be routed via the device or only added to the peer, entries that are
+	// missing are both
+	AllowedIPsFlags map[string]string `json:",omitempty"`
+	PubKey          string
+	Endpoint        string
+	Expires         time.Time
+	// RenewAfter is the time the agent should renew the lease at, zero if
+	// the server does not advertise a renewal interval
+	RenewAfter      time.Time
+	DelegatedPrefix string `json:",omitempty"`
+	// IP6 is the IPv6 address leased along with IP, if the server leases
+	// IPv6 addresses
+	IP6 string `json:",omitempty"`
+	// ControlURL is the base url of the server reachable through the
+	// tunnel, that agents can renew leases from once it is up
+	ControlURL string `json:",omitempty"`
+	// DNSServers and DNSSearchDomains configure name resolution on agents
+	// while the tunnel is up
+	DNSServers       []string `json:",omitempty"`
+	DNSSearchDomains []string `json:",omitempty"`
+	// MTU is the mtu agents should set on their device, unless they are
+	// configured with one
+	MTU int `json:",omitempty"`
+	// ConfigVersion identifies the advertised settings of the server the
+	// lease was granted with, agents renew their lease once it changes
+	ConfigVersion string `json:",omitempty"`
+	// PresharedKey is the base64 encoded preshared key of the peer, mixed
+	// into the handshake in addition to the public keys
+	PresharedKey string `json:",omitempty"`
+	// DNSRoutes send the queries for some domains to servers reachable
+	// through the tunnel, leaving other queries to the system resolvers
+	DNSRoutes []DNSRoute `json:",omitempty"`
+}
+
+// DNSRoute sends the queries for names under Domains to Servers.
+type DNSRoute struct {
+	Domains []string
+	Servers []string
+}
+
+// ConfigResponse defines the payload of a config HTTP response returned by a
+// server.
+type ConfigResponse struct {
+	// Version changes whenever the settings advertised in lease responses,
+	// like the allowed IPs, change
+	Version string
+}
+
+// Client requests leases from a wiresteward server.
+type Client struct {
+	// URL is the base url of the server, Path is appended to its path.
+	URL string
+	// Path is the path of the lease API, defaults to LeasePath.
+	Path string
+	// Method is the HTTP method of lease requests, defaults to POST.
+	Method string
+	// HTTPClient is used to send requests, defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Retries is the number of times requests are retried after network
+	// errors and server side failures. Rejected requests are not retried.
+	Retries int
+	// RetryInterval is the time to wait between retries, defaults to 1s.
+	RetryInterval time.Duration
+	// VerifyResponse, if set, is called with the headers and the body of
+	// successful responses before they are decoded, eg. to check their
+	// signature.
+	VerifyResponse func(header http.Header, body []byte) error
+}
+
+// New returns a client for the server at serverURL. If tlsConfig is not nil,
+// it is used for connections to the server, eg. to present a client
+// certificate or trust a private CA.
+func New(serverURL string, tlsConfig *tls.Config) *Client {
+	c := &Client{URL: serverURL, HTTPClient: &http.Client{}}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		c.HTTPClient.Transport = transport
+	}
+	return c
+}
+
+// LeaseURL returns the url that leases are requested from.
+func (c *Client) LeaseURL() (string, error) {
+	path := c.Path
+	if path == "" {
+		path = LeasePath
+	}
+	return c.url(path)
+}
+
+// url returns the url of path on the server.
+func (c *Client) url(path string) (string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("lease path must start with '/', got: %q", path)
+	}
+	base, err := url.Parse(c.URL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	if ref.Scheme != "" || ref.Host != "" || ref.RawQuery != "" || ref.Fragment != "" {
+		return "", fmt.Errorf("lease path must only contain a path, got: %q", path)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + ref.Path
+	base.RawPath = ""
+	return base.String(), nil
+}
+
+// Lease requests a lease for lr, authenticating with token. The token can be
+// empty for servers that authenticate the client certificate presented via
+// the tls.Config passed to New instead.
+func (c *Client) Lease(ctx context.Context, token string, lr *LeaseRequest) (*LeaseResponse, error) {
+	body, err := json.Marshal(lr)
+	if err != nil {
+		return nil, err
+	}
+	leaseURL, err := c.LeaseURL()
+	if err != nil {
+		return nil, err
+	}
+	interval := c.RetryInterval
+	if interval == 0 {
+		interval = defaultRetryInterval
+	}
+	for attempt := 0; ; attempt++ {
+		response, retry, err := c.lease(ctx, leaseURL, token, body)
+		if err == nil || !retry || attempt >= c.Retries {
+			return response, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// DryRun returns the lease the server would grant for lr, without granting
+// it. It is not retried.
+func (c *Client) DryRun(ctx context.Context, token string, lr *LeaseRequest) (*LeaseResponse, error) {
+	body, err := json.Marshal(lr)
+	if err != nil {
+		return nil, err
+	}
+	dryRunURL, err := c.url(DryRunPath)
+	if err != nil {
+		return nil, err
+	}
+	response, _, err := c.lease(ctx, dryRunURL, token, body)
+	// Servers that do not support dry runs do not serve the path
+	if errors.Is(err, ErrNoLease) {
+		return nil, fmt.Errorf("server does not support dry runs")
+	}
+	return response, err
+}
+
+// Config returns the version of the settings currently advertised by the
+// server, so that agents can renew their lease when they change.
+func (c *Client) Config(ctx context.Context) (*ConfigResponse, error) {
+	configURL, err := c.url(ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", configURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Response status: %s", resp.Status)
+	}
+	response := &ConfigResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// lease sends a single lease request and returns whether it should be retried
+// if it failed.
+func (c *Client) lease(ctx context.Context, leaseURL, token string, body []byte) (*LeaseResponse, bool, error) {
+	method := c.Method
+	if method == "" {
+		method = defaultMethod
+	}
+	req, err := http.NewRequestWithContext(ctx, method, leaseURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, false, fmt.Errorf("Response status: %s: %w", resp.Status, ErrUnauthorized)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, fmt.Errorf("Response status: %s: %w", resp.Status, ErrNoLease)
+	}
+	if resp.StatusCode != http.StatusOK {
+		retry := resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("Response status: %s", resp.Status)
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("error reading response body: %w", err)
+	}
+	if c.VerifyResponse != nil {
+		if err := c.VerifyResponse(resp.Header, respBody); err != nil {
+			return nil, false, fmt.Errorf("rejecting lease response: %w", err)
+		}
+	}
+	response := &LeaseResponse{}
+	if err := json.Unmarshal(respBody, response); err != nil {
+		return nil, false, err
+	}
+	return response, false, nil
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_LeaseURL(t *testing.T) {
+	c := &Client{URL: "https://wiresteward.example.com"}
+	u, err := c.LeaseURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://wiresteward.example.com/api/v1/lease", u)
+
+	c = &Client{URL: "https://gateway.example.com/vpn/", Path: LegacyLeasePath}
+	u, err = c.LeaseURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://gateway.example.com/vpn/newPeerLease", u)
+
+	for _, path := range []string{"api/lease", "/lease?x=1", "//evil.example.com/lease"} {
+		c = &Client{URL: "https://wiresteward.example.com", Path: path}
+		_, err = c.LeaseURL()
+		assert.Error(t, err, path)
+	}
+}
+
+func TestClient_Lease(t *testing.T) {
+	var requests int
+	var failures int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, LeasePath, r.URL.Path)
+		assert.Equal(t, "POST", r.Method)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if requests <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		lr := &LeaseRequest{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(lr))
+		if lr.Renew {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(&LeaseResponse{Status: "success", IP: "10.0.0.2/32", PubKey: lr.PubKey})
+	}))
+	defer ts.Close()
+	lr := &LeaseRequest{PubKey: "key"}
+
+	c := New(ts.URL, nil)
+	resp, err := c.Lease(context.Background(), "token", lr)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2/32", resp.IP)
+	assert.Equal(t, "key", resp.PubKey)
+
+	// Rejected requests are not retried
+	requests = 0
+	c.Retries = 2
+	_, err = c.Lease(context.Background(), "expired", lr)
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+	assert.Equal(t, 1, requests)
+
+	// Server side failures are retried
+	requests, failures = 0, 2
+	c.RetryInterval = 1
+	resp, err = c.Lease(context.Background(), "token", lr)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2/32", resp.IP)
+	assert.Equal(t, 3, requests)
+
+	requests, failures = 0, 5
+	_, err = c.Lease(context.Background(), "token", lr)
+	assert.EqualError(t, err, "Response status: 503 Service Unavailable")
+	assert.Equal(t, 3, requests)
+
+	// Renewals of leases the server does not hold are not retried
+	requests, failures = 0, 0
+	_, err = c.Lease(context.Background(), "token", &LeaseRequest{PubKey: "key", Renew: true})
+	assert.True(t, errors.Is(err, ErrNoLease))
+	assert.Equal(t, 1, requests)
+
+	// Responses that fail verification are rejected
+	requests, failures = 0, 0
+	c.VerifyResponse = func(h http.Header, body []byte) error {
+		return fmt.Errorf("response is not signed")
+	}
+	_, err = c.Lease(context.Background(), "token", lr)
+	assert.EqualError(t, err, "rejecting lease response: response is not signed")
+	assert.Equal(t, 1, requests)
+}
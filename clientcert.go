@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// clientCertificateValidity is the validity of the client certificates
+// presented by agents, they are generated for every lease request.
+const clientCertificateValidity = time.Hour
+
+// errClientCertificateMismatch is returned when the public key named by the
+// common name of a client certificate does not match the public key of the
+// lease request.
+var errClientCertificateMismatch = errors.New("client certificate common name does not match the requested public key")
+
+// newWireguardClientCertificate returns a self-signed client certificate for
+// the wireguard key privateKey. Its key is derived from privateKey, so that it
+// is stable across requests without storing another secret, and its common
+// name is the wireguard public key.
+func newWireguardClientCertificate(privateKey wgtypes.Key) (*tls.Certificate, error) {
+	seed := sha256.Sum256(append([]byte("wiresteward client certificate"), privateKey[:]...))
+	key := ed25519.NewKeyFromSeed(seed[:])
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: privateKey.PublicKey().String()},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(clientCertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// clientCertificate returns a client certificate for the wireguard key of the
+// device.
+func (dm *DeviceManager) clientCertificate() (*tls.Certificate, error) {
+	_, privateKey, err := getKeys(dm.Name())
+	if err != nil {
+		return nil, err
+	}
+	key, err := wgtypes.ParseKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return newWireguardClientCertificate(key)
+}
+
+// matchClientCertificateCN checks that the common name of the client
+// certificate presented over the connection described by state is pubKey, the
+// wireguard public key of the lease request. Requests without a certificate
+// are accepted.
+//
+// This only matches the common name: certificates are self-signed and
+// wireguard keys cannot sign, so it does not prove that the agent holds the
+// wireguard private key, anyone can present a certificate naming any public
+// key. It catches misconfigured agents and is not a security control, which
+// is why certificates cannot be required. Machines are authenticated by
+// certificates of the client CAs instead.
+func matchClientCertificateCN(state *tls.ConnectionState, pubKey string) error {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("client certificate is not valid at %s", now.Format(time.RFC3339))
+	}
+	certKey, err := wgtypes.ParseKey(cert.Subject.CommonName)
+	if err != nil {
+		return fmt.Errorf("client certificate does not name a wireguard public key: %w", err)
+	}
+	key, err := wgtypes.ParseKey(pubKey)
+	if err != nil || key != certKey {
+		return errClientCertificateMismatch
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestWireguardClientCertificate(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := newWireguardClientCertificate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parsed}}
+
+	// The certificate is bound to the wireguard public key
+	assert.Equal(t, key.PublicKey().String(), parsed.Subject.CommonName)
+	assert.NoError(t, matchClientCertificateCN(state, key.PublicKey().String()))
+
+	// and its key is derived from the wireguard private key
+	again, err := newWireguardClientCertificate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, cert.PrivateKey, again.PrivateKey)
+
+	// A certificate bound to another key is rejected
+	err = matchClientCertificateCN(state, newWgKey().String())
+	assert.True(t, errors.Is(err, errClientCertificateMismatch))
+
+	// Requests without a certificate are accepted
+	assert.NoError(t, matchClientCertificateCN(&tls.ConnectionState{}, validPublicKey))
+	assert.NoError(t, matchClientCertificateCN(nil, validPublicKey))
+}
+
+func TestWireguardClientCertificate_MTLS(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := newWireguardClientCertificate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := matchClientCertificateCN(r.TLS, r.Header.Get("X-Public-Key")); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		}
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+	client := ts.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{*cert}
+
+	get := func(pubKey string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Public-Key", pubKey)
+		return client.Do(req)
+	}
+
+	resp, err := get(key.PublicKey().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = get(newWgKey().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultClientIDFileLoc = "/var/lib/wiresteward/client-id"
+	maxClientIDLength      = 64
+)
+
+// validClientID returns whether id is safe to store and log as an agent
+// client id.
+func validClientID(id string) bool {
+	if len(id) == 0 || len(id) > maxClientIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newClientID returns a random (version 4) UUID.
+func newClientID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// loadOrCreateClientID reads the client id stored in path, or generates and
+// stores a new one if the file does not exist.
+func loadOrCreateClientID(path string) (string, error) {
+	d, err := os.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(d))
+		if !validClientID(id) {
+			return "", fmt.Errorf("invalid client id found in %s", path)
+		}
+		return id, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	id, err := newClientID()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(id), 0644); err != nil {
+		return "", err
+	}
+	logger.Info.Printf("Generated new client id %s", id)
+	return id, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadOrCreateClientID(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	path := filepath.Join(t.TempDir(), "client-id")
+	id, err := loadOrCreateClientID(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, validClientID(id))
+	// A restarted agent should pick up the same id
+	id2, err := loadOrCreateClientID(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, id, id2)
+}
+
+func TestValidClientID(t *testing.T) {
+	assert.True(t, validClientID("laptop-01.example_com"))
+	assert.False(t, validClientID(""))
+	assert.False(t, validClientID("with space"))
+	assert.False(t, validClientID(string(make([]byte, maxClientIDLength+1))))
+}
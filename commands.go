@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+	builtBy = "unknown"
+
+	flagAgentAddress       = new(string)
+	flagAgentSocket        = new(string)
+	flagAgentControlSocket = new(string)
+	flagAgentControlGroup  = new(string)
+	flagCheck              = new(bool)
+	flagConfig             = new(string)
+	flagDeviceType         = new(string)
+	flagLogFormat          = new(string)
+	flagLogLevel           = new(string)
+	flagMetricsAddr        = new(string)
+	flagStatusJSON         = new(bool)
+	flagValidate           = new(bool)
+	flagWatch              = new(bool)
+)
+
+// command is a subcommand of wiresteward, eg. `wiresteward agent`.
+type command struct {
+	name    string
+	args    string
+	summary string
+	// setFlags registers the flags of the command, besides the shared ones
+	setFlags func(fs *flag.FlagSet)
+	run      func(args []string)
+	flags    *flag.FlagSet
+}
+
+// commands are the subcommands of wiresteward, in the order they are listed
+// in the usage.
+var commands = []*command{
+	{
+		name:    "agent",
+		summary: "Run the agent, which configures wireguard devices with the leases of the servers",
+		setFlags: func(fs *flag.FlagSet) {
+			agentFlags(fs)
+			fs.BoolVar(flagCheck, "check", false, "Check the config, servers and cached token, and print the leases devices would be configured with, without configuring anything")
+			fs.BoolVar(flagValidate, "validate", false, "Validate the config file and exit")
+		},
+		run: runAgent,
+	},
+	{
+		name:    "server",
+		summary: "Run the server, which leases addresses to agents",
+		setFlags: func(fs *flag.FlagSet) {
+			serverFlags(fs)
+			fs.BoolVar(flagValidate, "validate", false, "Validate the config file and exit")
+		},
+		run: runServer,
+	},
+	{
+		name:    "status",
+		summary: "Print the status of the running agent",
+		setFlags: func(fs *flag.FlagSet) {
+			statusFlags(fs)
+		},
+		run: func(args []string) {
+			if *flagWatch {
+				newStatusWatcher(*flagAgentSocket, os.Stdout).run(watchInterval)
+				return
+			}
+			statusCommand(*flagStatusJSON)
+		},
+	},
+	controlSubcommand("up", "Start the devices named, or every device, that were brought down"),
+	controlSubcommand("down", "Stop the devices named, or every device, removing their tunnels"),
+	controlSubcommand("renew", "Renew the leases of every device with the cached token"),
+	controlSubcommand("reload", "Reload the config of the agent"),
+	{
+		name:     "version",
+		summary:  "Print the version of wiresteward",
+		setFlags: func(fs *flag.FlagSet) {},
+		run:      func(args []string) { printVersion() },
+	},
+}
+
+// By default the agent runs at a high obscure port. 7773 is chosen by looking
+// wiresteward initials hex on ascii table (w = 0x77 and s = 0x73)
+const defaultAgentAddress = "localhost:7773"
+
+// defaultSocketDir is the directory of the unix sockets of the agent.
+func defaultSocketDir() string {
+	switch runtime.GOOS {
+	case "linux":
+		return "/run/wiresteward"
+	case "windows":
+		return `C:\ProgramData\wiresteward`
+	}
+	return "/var/run/wiresteward"
+}
+
+// sharedFlags registers the flags accepted by every command on fs.
+func sharedFlags(fs *flag.FlagSet) {
+	fs.StringVar(flagConfig, "config", "/etc/wiresteward/config.json", "Config file")
+	fs.StringVar(flagLogFormat, "log-format", "text", "Log format (text|json|logfmt)")
+	fs.StringVar(flagLogLevel, "log-level", "info", "Log Level (debug|info|warn|error)")
+}
+
+// agentFlags registers the flags of the agent on fs.
+func agentFlags(fs *flag.FlagSet) {
+	defaultDeviceType := "tun"
+	if runtime.GOOS == "linux" {
+		defaultDeviceType = "wireguard"
+	}
+	fs.StringVar(flagAgentAddress, "agent-listen-address", defaultAgentAddress, "Address where the agent http server runs.\nThe URL http://<agent-listen-address>/oauth2/callback must be a valid callback url for the oauth2 application.")
+	fs.StringVar(flagAgentSocket, "agent-socket", filepath.Join(defaultSocketDir(), "agent.sock"), "Unix socket where the agent serves its status, for the status command. Empty disables it.")
+	fs.StringVar(flagAgentControlSocket, "agent-control-socket", filepath.Join(defaultSocketDir(), "control.sock"), "Unix socket where the agent accepts the up, down, renew and reload commands. Empty disables it.")
+	fs.StringVar(flagAgentControlGroup, "agent-control-group", "", "Group allowed to use the control socket of the agent, besides root")
+	fs.StringVar(flagDeviceType, "device-type", defaultDeviceType, "Type of the network device to use for the agent, 'tun' or 'wireguard'.\nThe tun device relies on the wireguard-go userspace implementation that is compatible with all platforms.\nA wireguard device relies on wireguard-enabled linux kernels (5.6 or newer).\nDevices can override it with \"type\" in the config file.")
+}
+
+// serverFlags registers the flags of the server on fs.
+func serverFlags(fs *flag.FlagSet) {
+	fs.StringVar(flagMetricsAddr, "metrics-address", ":8081", "Metrics server address")
+}
+
+// statusFlags registers the flags of the status command on fs.
+func statusFlags(fs *flag.FlagSet) {
+	fs.StringVar(flagAgentSocket, "agent-socket", filepath.Join(defaultSocketDir(), "agent.sock"), "Unix socket where the agent serves its status")
+	fs.BoolVar(flagStatusJSON, "json", false, "Print the status as json")
+	fs.BoolVar(flagWatch, "watch", false, "Continuously display the status of the agent serving it at -agent-socket")
+}
+
+// controlSubcommand returns the command that sends name to the control socket
+// of the agent.
+func controlSubcommand(name, summary string) *command {
+	args := "[device...]"
+	if name == "renew" || name == "reload" {
+		args = ""
+	}
+	return &command{
+		name:    name,
+		args:    args,
+		summary: summary,
+		setFlags: func(fs *flag.FlagSet) {
+			fs.StringVar(flagAgentControlSocket, "agent-control-socket", filepath.Join(defaultSocketDir(), "control.sock"), "Unix socket where the agent accepts commands")
+		},
+		run: func(args []string) { controlCommand(name, args) },
+	}
+}
+
+// findCommand returns the command called name, or nil if there is none.
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// usage prints the commands of wiresteward.
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [args]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun `%s <command> -h` for the flags of a command.\n", filepath.Base(os.Args[0]))
+}
+
+func init() {
+	for _, cmd := range commands {
+		cmd := cmd
+		cmd.flags = flag.NewFlagSet(cmd.name, flag.ExitOnError)
+		sharedFlags(cmd.flags)
+		cmd.setFlags(cmd.flags)
+		cmd.flags.Usage = func() {
+			w := cmd.flags.Output()
+			fmt.Fprintf(w, "Usage: %s\n\n%s\n\nFlags:\n", strings.TrimSpace(fmt.Sprintf("%s %s [flags] %s", filepath.Base(os.Args[0]), cmd.name, cmd.args)), cmd.summary)
+			cmd.flags.PrintDefaults()
+		}
+	}
+	// The flags of every command are accepted before the command too, and
+	// by the legacy `-agent` and `-server` invocations
+	sharedFlags(flag.CommandLine)
+	agentFlags(flag.CommandLine)
+	serverFlags(flag.CommandLine)
+	flag.BoolVar(flagCheck, "check", false, "Deprecated: use `agent -check`")
+	flag.BoolVar(flagValidate, "validate", false, "Deprecated: use `agent -validate` or `server -validate`")
+	flag.BoolVar(flagWatch, "watch", false, "Deprecated: use `status -watch`")
+	flag.Usage = usage
+}
+
+// parseDeviceType normalises the device type flag, exiting if it is invalid.
+func parseDeviceType() {
+	*flagDeviceType = strings.ToLower(*flagDeviceType)
+	if *flagDeviceType != "tun" && *flagDeviceType != "wireguard" {
+		logger.Error.Fatalf("Invalid device-type value `%s`", *flagDeviceType)
+	}
+}
+
+func printVersion() {
+	logger.Info.Printf("version=%s commit=%s date=%s builtBy=%s", version, commit, date, builtBy)
+}
+
+func runAgent(args []string) {
+	parseDeviceType()
+	switch {
+	case *flagValidate:
+		_, err := readAgentConfig(*flagConfig)
+		exitOnConfigError(err)
+		fmt.Printf("%s is valid\n", *flagConfig)
+	case *flagCheck:
+		checkAgent()
+	default:
+		agent()
+	}
+}
+
+func runServer(args []string) {
+	if *flagValidate {
+		_, err := readServerConfig(*flagConfig)
+		exitOnConfigError(err)
+		fmt.Printf("%s is valid\n", *flagConfig)
+		return
+	}
+	server()
+}
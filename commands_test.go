@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommands(t *testing.T) {
+	assert.Nil(t, findCommand("unknown"))
+	for _, cmd := range commands {
+		assert.Equal(t, cmd, findCommand(cmd.name))
+		// Every command accepts the shared flags
+		for _, name := range []string{"config", "log-level", "log-format"} {
+			assert.NotNil(t, cmd.flags.Lookup(name), "%s -%s", cmd.name, name)
+		}
+	}
+
+	// Flags given to a command set the same values as the legacy flags
+	defer func(config string, json bool) {
+		*flagConfig = config
+		*flagStatusJSON = json
+	}(*flagConfig, *flagStatusJSON)
+	status := findCommand("status")
+	assert.NoError(t, status.flags.Parse([]string{"-config", "agent.json", "-json"}))
+	assert.Equal(t, "agent.json", *flagConfig)
+	assert.True(t, *flagStatusJSON)
+	down := findCommand("down")
+	assert.NoError(t, down.flags.Parse([]string{"wg0", "wg1"}))
+	assert.Equal(t, []string{"wg0", "wg1"}, down.flags.Args())
+}
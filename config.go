@@ -1,13 +1,21 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -15,19 +23,127 @@ const (
 	defaultLeaserSyncInterval  = 1 * time.Minute
 	defaultLeasesFilename      = "/var/lib/wiresteward/leases"
 	defaultServerListenAddress = "0.0.0.0:8080"
+	// Catches handing out (nearly) the whole IPv4 space, eg. 0.0.0.0/0, by
+	// accident
+	defaultMaxAllowedIPsAddresses = 1 << 31
+)
+
+// Flags of allowed IPs entries, controlling whether agents add them to the
+// allowed IPs of the peer (crypto), route them via the device (route), or
+// both, which is the default.
+const (
+	allowedIPFlagBoth   = "both"
+	allowedIPFlagCrypto = "crypto"
+	allowedIPFlagRoute  = "route"
+)
+
+// Bounds of device mtus, the minimum is the smallest datagram every IPv4 host
+// must accept.
+const (
+	minMTU = 576
+	maxMTU = 65535
 )
 
+// Bounds of the mtus servers can advertise to agents: the minimum IPv6 mtu
+// and jumbo frames. Agents ignore advertised mtus outside of them.
+const (
+	minAdvertisedMTU = 1280
+	maxAdvertisedMTU = 9000
+)
+
+// duration is a time.Duration that is unmarshalled from a string in the
+// format accepted by time.ParseDuration.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
 // agentOAuthConfig encapsulates agent-side OAuth configuration for wiresteward
 type agentOAuthConfig struct {
 	ClientID string `json:"clientID"`
 	AuthURL  string `json:"authUrl"`
 	TokenURL string `json:"tokenUrl"`
+	// DeviceAuthURL is the device authorization endpoint of the identity
+	// provider. If set, agents without a cached token authenticate via the
+	// device authorization grant rather than waiting for the web flow.
+	DeviceAuthURL string `json:"deviceAuthUrl"`
+	// TokenCacheTTL is how long tokens that are not JWTs carrying an
+	// expiry are used for before being refreshed. If zero, they are used
+	// until a server rejects them.
+	TokenCacheTTL duration `json:"tokenCacheTTL"`
+	// OpenBrowser opens the login page of the identity provider in the
+	// browser when the agent has no valid token, for desktop users
+	OpenBrowser bool `json:"openBrowser"`
+	// TokenStore is where the refresh token is kept: file, the default,
+	// keyring for the keyring of the OS or encrypted
+	TokenStore string `json:"tokenStore"`
+}
+
+// encryptedStoreConfig configures the encrypted secret store, which keeps a
+// file per secret encrypted with a key kept in another file.
+type encryptedStoreConfig struct {
+	Directory string `json:"directory"`
+	// KeyFilename is generated if it does not exist, and should be kept
+	// out of backups of Directory
+	KeyFilename string `json:"keyFilename"`
 }
 
 // agentPeerConfig contains the agent-side configuration for a wiresteward
 // server.
 type agentPeerConfig struct {
 	URL string `json:"url"`
+	// LeaseSigningPublicKey is the base64 encoded ed25519 public key used to
+	// verify lease responses. If empty, responses are not verified.
+	LeaseSigningPublicKey string `json:"leaseSigningPublicKey"`
+	// Extra holds deployment specific fields sent to the server along with
+	// lease requests.
+	Extra map[string]string `json:"extra"`
+	// RequestDelegatedPrefix asks the server to delegate a routed prefix to
+	// this agent, for site-to-site setups.
+	RequestDelegatedPrefix bool `json:"requestDelegatedPrefix"`
+	// Pool is the name of the address pool to lease from, the server picks
+	// one if empty.
+	Pool string `json:"pool"`
+	// Device is the name of the wireguard device of the server to lease on,
+	// the server picks one if empty.
+	Device string `json:"device"`
+	// LeasePath and LeaseMethod override the path, relative to URL, and the
+	// HTTP method used to request leases, for servers behind gateways that
+	// rewrite them.
+	LeasePath   string `json:"leasePath"`
+	LeaseMethod string `json:"leaseMethod"`
+	// ControlViaTunnel renews leases through the tunnel, from the control
+	// url advertised by the server, once a handshake with it completed.
+	ControlViaTunnel bool `json:"controlViaTunnel"`
+	// ClientCertificate presents a client certificate bound to the
+	// wireguard key of the device when requesting leases, for servers that
+	// authenticate agents via mTLS.
+	ClientCertificate bool `json:"clientCertificate"`
+	// PersistentKeepaliveInterval is how often keepalives are sent to the
+	// peer, so that agents behind NAT stay reachable. Defaults to 25s.
+	PersistentKeepaliveInterval duration `json:"persistentKeepaliveInterval"`
+	// clientCert is the certificate presented when ClientCertificate is
+	// set, it is generated for every lease request
+	clientCert *tls.Certificate
+	// fwMark is set on the connections of lease requests, so that they
+	// bypass the full tunnel
+	fwMark int
 }
 
 // agentDeviceConfig defines a network device and associated wiresteward
@@ -36,93 +152,1136 @@ type agentDeviceConfig struct {
 	Name  string            `json:"name"`
 	MTU   int               `json:"mtu"`
 	Peers []agentPeerConfig `json:"peers"`
+	// Alias is set as the interface alias of the device, to help identify
+	// it. Defaults to the urls of the device peers (linux only).
+	Alias string `json:"alias"`
+	// RouteProtocol is the protocol number set on routes installed for the
+	// device (linux only).
+	RouteProtocol int `json:"routeProtocol"`
+	// NetlinkRetryAttempts and NetlinkRetryDelay control retries of netlink
+	// operations that fail with transient errors (linux only).
+	NetlinkRetryAttempts int      `json:"netlinkRetryAttempts"`
+	NetlinkRetryDelay    duration `json:"netlinkRetryDelay"`
+	// RouteWorkers is the number of routes installed concurrently (linux
+	// only).
+	RouteWorkers int `json:"routeWorkers"`
+	// InstallConnectedRoutes installs routes for allowed IPs that are
+	// covered by the connected route of the leased address, which are
+	// skipped by default.
+	InstallConnectedRoutes bool `json:"installConnectedRoutes"`
+	// EgressInterface is the name of a network interface that wireguard
+	// traffic to the server endpoint should be pinned to (linux only).
+	EgressInterface string `json:"egressInterface"`
+	// Sysctls are interface scoped sysctls, eg.
+	// net.ipv4.conf.<name>.rp_filter, applied after the device is brought
+	// up and restored when it is stopped (linux only).
+	Sysctls map[string]string `json:"sysctls"`
+	// PeerDrainPeriod is how long a peer that is replaced on lease renewal
+	// is kept after its routes are removed, so that in flight connections
+	// are not cut instantly. Peers are removed immediately if zero.
+	PeerDrainPeriod duration `json:"peerDrainPeriod"`
+	// PeerManagement is either "exclusive", the default, where peers not
+	// configured by the agent are removed from the device, or "coexist",
+	// where they are left untouched and an existing device is adopted.
+	PeerManagement string `json:"peerManagement"`
+	// KeepDevice leaves the device in place when the agent stops, after
+	// removing the addresses, routes and peers it configured. Only applies
+	// to kernel wireguard devices, tun devices are deleted on exit.
+	KeepDevice bool `json:"keepDevice"`
+	// Leases are renewed when the server asks to, or halfway to their
+	// expiry, minus a random delay of up to RenewJitter. Failed renewals are
+	// retried every second, backing off exponentially up to
+	// RenewRetryMaxInterval if set.
+	RenewJitter           duration `json:"renewJitter"`
+	RenewRetryMaxInterval duration `json:"renewRetryMaxInterval"`
+	// The device is recreated if its link is deleted, at most once every
+	// RecreateMinInterval. If it is recreated RecreateMaxAttempts times
+	// within RecreateWindow, the agent gives up until it is restarted.
+	RecreateMinInterval duration `json:"recreateMinInterval"`
+	RecreateMaxAttempts int      `json:"recreateMaxAttempts"`
+	RecreateWindow      duration `json:"recreateWindow"`
+	// AddressProbe enables checking that leased addresses are not already
+	// in use before configuring them.
+	AddressProbe *agentAddressProbeConfig `json:"addressProbe"`
+	// ReachabilityProbe enables rolling back to the previous lease if a
+	// renewed one leaves the probe target unreachable.
+	ReachabilityProbe *agentReachabilityProbeConfig `json:"reachabilityProbe"`
+	// IgnoreDNS leaves the DNS configuration of the system untouched,
+	// instead of applying the DNS servers and search domains sent by the
+	// servers along with leases.
+	IgnoreDNS bool `json:"ignoreDNS"`
+	// The server of the current lease of devices with multiple peers is
+	// pinged every HealthCheckInterval through the tunnel, and a lease is
+	// requested again after HealthCheckThreshold consecutive failed pings.
+	// Default to a second and 3.
+	HealthCheckInterval  duration `json:"healthCheckInterval"`
+	HealthCheckThreshold int      `json:"healthCheckThreshold"`
+	// Failover health checks the server of the current lease through the
+	// tunnel, and requests a lease from another peer when it is unhealthy.
+	Failover *agentFailoverConfig `json:"failover"`
+	// Type is the type of the network device, "tun" or "wireguard",
+	// defaults to the value of the -device-type flag.
+	Type string `json:"type"`
+	// ConfigCheckInterval polls the server of the current lease for
+	// changes to the settings it advertises, eg. its allowed IPs, and
+	// renews the lease once they change, instead of waiting for the next
+	// renewal.
+	ConfigCheckInterval duration `json:"configCheckInterval"`
+	// EndpointResolveInterval is how often the endpoint host name of the
+	// server of the current lease is resolved again, once handshakes with
+	// it stop succeeding. Defaults to a minute.
+	EndpointResolveInterval duration `json:"endpointResolveInterval"`
+	// KeyRotationInterval generates a new key pair for the device at this
+	// interval, moving the lease to the new public key
+	KeyRotationInterval duration `json:"keyRotationInterval"`
+	// FullTunnel routes all traffic through the tunnel (linux only)
+	FullTunnel *agentFullTunnelConfig `json:"fullTunnel"`
+	// KillSwitch drops traffic outside of the tunnel while a lease is
+	// held (linux only)
+	KillSwitch *agentKillSwitchConfig `json:"killSwitch"`
+	// noHealthCheck disables health checking servers, when the agent lacks
+	// the capability to send ICMP echo requests
+	noHealthCheck bool
+}
+
+// agentAddressProbeConfig configures probing leased addresses for conflicts.
+type agentAddressProbeConfig struct {
+	// Interface is the network interface to send ARP probes on (linux
+	// only), defaults to the egress interface of the device. If neither is
+	// set, only local interfaces are checked.
+	Interface string   `json:"interface"`
+	Timeout   duration `json:"timeout"`
+}
+
+// agentReachabilityProbeConfig configures checking that a target is
+// reachable via the device after a lease is applied.
+type agentReachabilityProbeConfig struct {
+	// Target is the IPv4 address pinged via the device
+	Target  string   `json:"target"`
+	Timeout duration `json:"timeout"`
+}
+
+// agentFailoverConfig configures health checking the server of the current
+// lease and failing over to the other peers of the device.
+type agentFailoverConfig struct {
+	// Target is probed through the tunnel, an IPv4 address is pinged and a
+	// host:port is dialled over TCP. Defaults to pinging the wireguard
+	// address of the server.
+	Target string `json:"target"`
+	// The server is unhealthy after Threshold consecutive failed probes,
+	// sent every Interval. Default to the health check settings of the
+	// device.
+	Interval  duration `json:"interval"`
+	Threshold int      `json:"threshold"`
+	// Primary prefers the peers in the order they are listed, instead of
+	// picking one at random. Peers that were unhealthy are probed every
+	// FailbackInterval, and leases are requested from the primary again
+	// once it is reachable.
+	Primary          bool     `json:"primary"`
+	FailbackInterval duration `json:"failbackInterval"`
+}
+
+// agentFullTunnelConfig routes all traffic through the tunnel with policy
+// routing, like wg-quick: the default routes are installed in Table, which is
+// looked up for all packets but the ones marked with FwMark. The device marks
+// its own encrypted packets with it, so that they keep following the main
+// table to the server endpoint.
+type agentFullTunnelConfig struct {
+	Table  int `json:"table"`
+	FwMark int `json:"fwMark"`
+}
+
+// agentKillSwitchConfig configures the firewall rules that drop the traffic
+// of the host that does not go through the tunnel, except to the server and
+// for DHCP.
+type agentKillSwitchConfig struct {
+	// AllowedNetworks can still be reached outside of the tunnel, eg. the
+	// local network
+	AllowedNetworks []string `json:"allowedNetworks"`
+}
+
+// agentBondConfig groups devices with overlapping routes, so that traffic is
+// routed via one of them and fails over to the others (linux only).
+type agentBondConfig struct {
+	Name string `json:"name"`
+	// Devices are the names of the bonded devices, in order of preference
+	Devices []string `json:"devices"`
+	// Mode is the bonding policy, only "active-backup" is supported
+	Mode string `json:"mode"`
+	// HandshakeTimeout is the age of the latest handshake of a device after
+	// which it is considered stale
+	HandshakeTimeout duration `json:"handshakeTimeout"`
+	// CheckInterval is how often the handshakes of the devices are checked
+	CheckInterval duration `json:"checkInterval"`
+	// StaleChecks is the number of consecutive checks the handshake of a
+	// device has to be found stale on before traffic is shifted off it
+	StaleChecks int `json:"staleChecks"`
+}
+
+// agentCaptivePortalConfig configures detecting captive portals before
+// bringing up devices.
+type agentCaptivePortalConfig struct {
+	// URL is probed and expected to respond with ExpectedStatus
+	URL            string   `json:"url"`
+	ExpectedStatus int      `json:"expectedStatus"`
+	Interval       duration `json:"interval"`
+	Timeout        duration `json:"timeout"`
+}
+
+// agentHookConfig runs a command or calls a url on events of the devices of
+// the agent, eg. to mount shares once a tunnel is up.
+type agentHookConfig struct {
+	// Events the hook runs on, every event if empty
+	Events []string `json:"events"`
+	// Command is run with its arguments, without a shell, and receives the
+	// event in its environment
+	Command []string `json:"command"`
+	// URL receives the event as json in a POST request
+	URL     string   `json:"url"`
+	Timeout duration `json:"timeout"`
+}
+
+// agentResolverConfig configures a resolver used to look up the endpoints of
+// wiresteward servers.
+type agentResolverConfig struct {
+	// Type is one of "system", "doh" or "static"
+	Type    string   `json:"type"`
+	Timeout duration `json:"timeout"`
+	// URL is the address of the DNS over HTTPS server, for the "doh" type
+	URL string `json:"url"`
+	// Hosts maps host names to IPv4 addresses, for the "static" type
+	Hosts map[string]string `json:"hosts"`
+}
+
+// agentStatsdConfig configures exporting agent metrics to StatsD.
+type agentStatsdConfig struct {
+	Address string `json:"address"`
+	Prefix  string `json:"prefix"`
+	// DogStatsD enables DogStatsD tags on the emitted metrics.
+	DogStatsD     bool     `json:"dogstatsd"`
+	FlushInterval duration `json:"flushInterval"`
 }
 
 // AgentConfig describes the agent-side configuration of wiresteward.
 type agentConfig struct {
-	OAuth   agentOAuthConfig    `json:"oauth"`
-	Devices []agentDeviceConfig `json:"devices"`
+	// ClientID is a stable identifier for the agent, sent to servers along
+	// with lease requests. It is not related to the oauth client id and it
+	// does not authenticate the agent in any way. If empty, a random id is
+	// generated and persisted on the first run.
+	ClientID string              `json:"clientID"`
+	OAuth    agentOAuthConfig    `json:"oauth"`
+	Devices  []agentDeviceConfig `json:"devices"`
+	// StatsD optionally exports agent metrics to a StatsD server.
+	StatsD *agentStatsdConfig `json:"statsd"`
+	// CaptivePortal enables deferring bringing up devices while the network
+	// is behind a captive portal.
+	CaptivePortal *agentCaptivePortalConfig `json:"captivePortal"`
+	// Bonds fail traffic over between devices
+	Bonds []agentBondConfig `json:"bonds"`
+	// Resolvers are tried in order to look up server endpoints, until one
+	// of them returns an address. Defaults to the system resolver.
+	Resolvers []agentResolverConfig `json:"resolvers"`
+	// EventBufferSize is the number of agent events buffered for consumers,
+	// before the oldest ones are dropped.
+	EventBufferSize int `json:"eventBufferSize"`
+	// MetricsAddress optionally serves the agent metrics and health on a
+	// separate listener, without the authentication endpoints.
+	MetricsAddress string `json:"metricsAddress"`
+	// OfflineStart makes the agent request leases with an expired cached
+	// token on start, refreshing it in the background, so that devices
+	// are configured once the network comes up without logging in again.
+	OfflineStart bool `json:"offlineStart"`
+	// KeyStore persists the private keys of devices across restarts, in
+	// the keyring of the OS or encrypted. Devices get a new key every time
+	// they are created if empty.
+	KeyStore string `json:"keyStore"`
+	// EncryptedStore configures where the encrypted store keeps secrets
+	EncryptedStore *encryptedStoreConfig `json:"encryptedStore"`
+	// Hooks run commands or call urls on events of the devices
+	Hooks []*agentHookConfig `json:"hooks"`
+}
+
+// configFieldError describes a problem with the value of a config field,
+// identified by its dotted path, eg. `devices[0].peers[1].url`.
+type configFieldError struct {
+	Field   string
+	Message string
+}
+
+func (e configFieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// configErrors accumulates all the problems found while validating a config.
+type configErrors []configFieldError
+
+func (ce configErrors) Error() string {
+	msgs := make([]string, len(ce))
+	for i, e := range ce {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("invalid config: %s", strings.Join(msgs, "; "))
+}
+
+func (ce *configErrors) add(field, format string, a ...interface{}) {
+	*ce = append(*ce, configFieldError{Field: field, Message: fmt.Sprintf(format, a...)})
+}
+
+// merge appends the errors found in err, if any.
+func (ce *configErrors) merge(err error) {
+	var other configErrors
+	if errors.As(err, &other) {
+		*ce = append(*ce, other...)
+	} else if err != nil {
+		ce.add("", "%v", err)
+	}
+}
+
+// err returns nil if no errors have been accumulated, or the configErrors
+// otherwise.
+func (ce configErrors) err() error {
+	if len(ce) == 0 {
+		return nil
+	}
+	return ce
 }
 
 func verifyAgentOAuthConfig(conf *agentConfig) error {
+	errs := configErrors{}
 	if conf.OAuth.ClientID == "" {
-		return fmt.Errorf("oauth config missing `clientID`")
+		errs.add("oauth.clientID", "missing value")
 	}
-	if conf.OAuth.AuthURL == "" {
-		return fmt.Errorf("oauth config missing `authUrl`")
+	if conf.OAuth.AuthURL == "" && conf.OAuth.DeviceAuthURL == "" {
+		errs.add("oauth.authUrl", "missing value")
 	}
 	if conf.OAuth.TokenURL == "" {
-		return fmt.Errorf("oauth config missing `tokenUrl`")
+		errs.add("oauth.tokenUrl", "missing value")
 	}
-	return nil
+	if conf.OAuth.OpenBrowser && conf.OAuth.AuthURL == "" {
+		errs.add("oauth.openBrowser", "requires authUrl to be set")
+	}
+	if !isSecretStore(conf.OAuth.TokenStore) {
+		errs.add("oauth.tokenStore", "must be one of %s, %s or %s, got: %q", secretStoreFile, secretStoreKeyring, secretStoreEncrypted, conf.OAuth.TokenStore)
+	}
+	// Private keys of agents are never written to plain files
+	if conf.KeyStore == secretStoreFile || !isSecretStore(conf.KeyStore) {
+		errs.add("keyStore", "must be one of %s or %s, got: %q", secretStoreKeyring, secretStoreEncrypted, conf.KeyStore)
+	}
+	return errs.err()
 }
 
 func verifyAgentDevicesConfig(conf *agentConfig) error {
+	errs := configErrors{}
 	if len(conf.Devices) == 0 {
-		return fmt.Errorf("No devices defined in config")
+		errs.add("devices", "no devices defined")
 	}
-	for _, dev := range conf.Devices {
+	names := map[string]int{}
+	for i, dev := range conf.Devices {
+		field := fmt.Sprintf("devices[%d]", i)
 		if dev.Name == "" {
-			return fmt.Errorf("Device name not specified in config")
+			errs.add(field+".name", "missing value")
+		} else if j, ok := names[dev.Name]; ok {
+			errs.add(field+".name", "duplicate of devices[%d].name: %q", j, dev.Name)
+		} else {
+			names[dev.Name] = i
+		}
+		if dev.RouteProtocol < 0 || dev.RouteProtocol > 255 {
+			errs.add(field+".routeProtocol", "must be between 0 and 255")
+		}
+		if dev.MTU != 0 && (dev.MTU < minMTU || dev.MTU > maxMTU) {
+			errs.add(field+".mtu", "must be between %d and %d", minMTU, maxMTU)
+		}
+		if dev.NetlinkRetryAttempts < 0 {
+			errs.add(field+".netlinkRetryAttempts", "must not be negative")
+		}
+		if dev.NetlinkRetryDelay.Duration < 0 {
+			errs.add(field+".netlinkRetryDelay", "must not be negative")
+		}
+		if dev.RouteWorkers < 0 {
+			errs.add(field+".routeWorkers", "must not be negative")
+		}
+		if dev.PeerDrainPeriod.Duration < 0 {
+			errs.add(field+".peerDrainPeriod", "must not be negative")
+		}
+		if dev.RenewJitter.Duration < 0 {
+			errs.add(field+".renewJitter", "must not be negative")
+		}
+		if dev.RenewRetryMaxInterval.Duration < 0 {
+			errs.add(field+".renewRetryMaxInterval", "must not be negative")
+		}
+		if dev.HealthCheckInterval.Duration < 0 {
+			errs.add(field+".healthCheckInterval", "must not be negative")
+		}
+		if dev.HealthCheckThreshold < 0 {
+			errs.add(field+".healthCheckThreshold", "must not be negative")
+		}
+		if dev.ConfigCheckInterval.Duration < 0 {
+			errs.add(field+".configCheckInterval", "must not be negative")
+		}
+		if dev.EndpointResolveInterval.Duration < 0 {
+			errs.add(field+".endpointResolveInterval", "must not be negative")
+		}
+		if dev.KeyRotationInterval.Duration < 0 {
+			errs.add(field+".keyRotationInterval", "must not be negative")
+		}
+		if dev.Type != "" && dev.Type != "tun" && dev.Type != "wireguard" {
+			errs.add(field+".type", "must be one of \"tun\" or \"wireguard\", got: %q", dev.Type)
+		}
+		if dev.PeerManagement != "" && dev.PeerManagement != peerManagementExclusive && dev.PeerManagement != peerManagementCoexist {
+			errs.add(field+".peerManagement", "must be one of %q or %q, got: %q", peerManagementExclusive, peerManagementCoexist, dev.PeerManagement)
+		}
+		// The private key of an adopted device belongs to whatever else
+		// manages it
+		if dev.PeerManagement == peerManagementCoexist && dev.KeyRotationInterval.Duration > 0 {
+			errs.add(field+".keyRotationInterval", "cannot be set with peerManagement %q", peerManagementCoexist)
+		}
+		if dev.RecreateMinInterval.Duration < 0 {
+			errs.add(field+".recreateMinInterval", "must not be negative")
+		}
+		if dev.RecreateMaxAttempts < 0 {
+			errs.add(field+".recreateMaxAttempts", "must not be negative")
 		}
-		for _, peer := range dev.Peers {
+		if dev.RecreateWindow.Duration < 0 {
+			errs.add(field+".recreateWindow", "must not be negative")
+		}
+		if dev.AddressProbe != nil && dev.AddressProbe.Timeout.Duration < 0 {
+			errs.add(field+".addressProbe.timeout", "must not be negative")
+		}
+		if rp := dev.ReachabilityProbe; rp != nil {
+			if ip := net.ParseIP(rp.Target); ip == nil || ip.To4() == nil {
+				errs.add(field+".reachabilityProbe.target", "must be an IPv4 address, got: %q", rp.Target)
+			}
+			if rp.Timeout.Duration < 0 {
+				errs.add(field+".reachabilityProbe.timeout", "must not be negative")
+			}
+		}
+		for key := range dev.Sysctls {
+			if _, err := interfaceSysctlPath(dev.Name, key); err != nil {
+				errs.add(fmt.Sprintf("%s.sysctls[%s]", field, key), "%v", err)
+			}
+		}
+		if ft := dev.FullTunnel; ft != nil {
+			if runtime.GOOS != "linux" {
+				errs.add(field+".fullTunnel", "is only supported on linux")
+			}
+			if ft.Table < 0 {
+				errs.add(field+".fullTunnel.table", "must not be negative")
+			} else if ft.Table == rtTableMain || ft.Table == rtTableLocal || ft.Table == rtTableDefault {
+				errs.add(field+".fullTunnel.table", "must not be one of the main, local or default tables")
+			}
+			if ft.FwMark < 0 {
+				errs.add(field+".fullTunnel.fwMark", "must not be negative")
+			}
+		}
+		if ks := dev.KillSwitch; ks != nil {
+			if runtime.GOOS != "linux" {
+				errs.add(field+".killSwitch", "is only supported on linux")
+			}
+			for j, n := range ks.AllowedNetworks {
+				if _, _, err := net.ParseCIDR(n); err != nil {
+					errs.add(fmt.Sprintf("%s.killSwitch.allowedNetworks[%d]", field, j), "%v", err)
+				}
+			}
+		}
+		if f := dev.Failover; f != nil {
+			if f.Target != "" {
+				if _, err := newHealthCheckChecker(f.Target); err != nil {
+					errs.add(field+".failover.target", "%v", err)
+				}
+			}
+			if f.Interval.Duration < 0 {
+				errs.add(field+".failover.interval", "must not be negative")
+			}
+			if f.Threshold < 0 {
+				errs.add(field+".failover.threshold", "must not be negative")
+			}
+			if f.FailbackInterval.Duration < 0 {
+				errs.add(field+".failover.failbackInterval", "must not be negative")
+			}
+		}
+		for j, peer := range dev.Peers {
+			field := fmt.Sprintf("%s.peers[%d]", field, j)
 			if peer.URL == "" {
-				return fmt.Errorf("Missing peer url from config")
+				errs.add(field+".url", "missing value")
+			}
+			if peer.LeaseSigningPublicKey != "" {
+				if _, err := parseLeaseVerificationKey(peer.LeaseSigningPublicKey); err != nil {
+					errs.add(field+".leaseSigningPublicKey", "invalid key: %v", err)
+				}
+			}
+			if err := verifyLeaseRequestExtra(peer.Extra); err != nil {
+				errs.add(field+".extra", "%v", err)
+			}
+			if peer.URL != "" {
+				if _, err := peer.leaseURL(); err != nil {
+					errs.add(field+".leasePath", "%v", err)
+				}
+			}
+			switch peer.LeaseMethod {
+			case "", "POST", "PUT":
+			default:
+				errs.add(field+".leaseMethod", "must be POST or PUT, got: %q", peer.LeaseMethod)
+			}
+			if peer.PersistentKeepaliveInterval.Duration < 0 {
+				errs.add(field+".persistentKeepaliveInterval", "must not be negative")
 			}
 		}
 	}
-	return nil
+	return errs.err()
+}
+
+func verifyAgentClientID(conf *agentConfig) error {
+	errs := configErrors{}
+	if conf.ClientID != "" && !validClientID(conf.ClientID) {
+		errs.add("clientID", "must be up to %d characters long and only contain letters, digits, '.', '_' or '-'", maxClientIDLength)
+	}
+	if conf.EventBufferSize < 0 {
+		errs.add("eventBufferSize", "must not be negative")
+	}
+	return errs.err()
+}
+
+func verifyAgentStatsdConfig(conf *agentConfig) error {
+	errs := configErrors{}
+	if conf.StatsD == nil {
+		return nil
+	}
+	if conf.StatsD.Address == "" {
+		errs.add("statsd.address", "missing value")
+	}
+	if conf.StatsD.FlushInterval.Duration < 0 {
+		errs.add("statsd.flushInterval", "must not be negative")
+	}
+	return errs.err()
+}
+
+func verifyAgentResolversConfig(conf *agentConfig) error {
+	errs := configErrors{}
+	for i, r := range conf.Resolvers {
+		field := fmt.Sprintf("resolvers[%d]", i)
+		if r.Timeout.Duration < 0 {
+			errs.add(field+".timeout", "must not be negative")
+		}
+		switch r.Type {
+		case resolverTypeSystem:
+		case resolverTypeDoH:
+			if u, err := url.Parse(r.URL); err != nil || u.Scheme == "" || u.Host == "" {
+				errs.add(field+".url", "must be an absolute url, got: %q", r.URL)
+			}
+		case resolverTypeStatic:
+			if len(r.Hosts) == 0 {
+				errs.add(field+".hosts", "missing value")
+			}
+			for host, ip := range r.Hosts {
+				if net.ParseIP(ip).To4() == nil {
+					errs.add(fmt.Sprintf("%s.hosts[%s]", field, host), "expected an IPv4 address, got: %s", ip)
+				}
+			}
+		default:
+			errs.add(field+".type", "must be one of %q, %q or %q, got: %q", resolverTypeSystem, resolverTypeDoH, resolverTypeStatic, r.Type)
+		}
+	}
+	return errs.err()
+}
+
+func verifyAgentCaptivePortalConfig(conf *agentConfig) error {
+	errs := configErrors{}
+	cp := conf.CaptivePortal
+	if cp == nil {
+		return nil
+	}
+	if cp.URL != "" {
+		if u, err := url.Parse(cp.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs.add("captivePortal.url", "must be an absolute url, got: %q", cp.URL)
+		}
+	}
+	if cp.ExpectedStatus != 0 && (cp.ExpectedStatus < 100 || cp.ExpectedStatus > 599) {
+		errs.add("captivePortal.expectedStatus", "must be a valid HTTP status code, got: %d", cp.ExpectedStatus)
+	}
+	if cp.Interval.Duration < 0 {
+		errs.add("captivePortal.interval", "must not be negative")
+	}
+	if cp.Timeout.Duration < 0 {
+		errs.add("captivePortal.timeout", "must not be negative")
+	}
+	return errs.err()
+}
+
+func verifyAgentHooksConfig(conf *agentConfig) error {
+	errs := configErrors{}
+	for i, h := range conf.Hooks {
+		field := fmt.Sprintf("hooks[%d]", i)
+		if h == nil {
+			errs.add(field, "missing value")
+			continue
+		}
+		if (len(h.Command) > 0) == (h.URL != "") {
+			errs.add(field, "one of command and url is required")
+		}
+		if len(h.Command) > 0 && h.Command[0] == "" {
+			errs.add(field+".command", "must start with the path of the command")
+		}
+		if h.URL != "" {
+			if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs.add(field+".url", "must be an absolute http or https url, got: %q", h.URL)
+			}
+		}
+		for j, e := range h.Events {
+			if !isHookEvent(e) {
+				errs.add(fmt.Sprintf("%s.events[%d]", field, j), "must be one of %s, got: %q", strings.Join(hookEvents, ", "), e)
+			}
+		}
+		if h.Timeout.Duration < 0 {
+			errs.add(field+".timeout", "must not be negative")
+		} else if h.Timeout.Duration == 0 {
+			h.Timeout.Duration = defaultHookTimeout
+		}
+	}
+	return errs.err()
+}
+
+func verifyAgentBondsConfig(conf *agentConfig) error {
+	errs := configErrors{}
+	devices := map[string]bool{}
+	for _, dev := range conf.Devices {
+		devices[dev.Name] = true
+	}
+	bonded := map[string]bool{}
+	for i, b := range conf.Bonds {
+		field := fmt.Sprintf("bonds[%d]", i)
+		if b.Name == "" {
+			errs.add(field+".name", "missing value")
+		}
+		if b.Mode != "" && b.Mode != bondModeActiveBackup {
+			errs.add(field+".mode", "only %q is supported, got: %q", bondModeActiveBackup, b.Mode)
+		}
+		if b.HandshakeTimeout.Duration < 0 {
+			errs.add(field+".handshakeTimeout", "must not be negative")
+		}
+		if b.CheckInterval.Duration < 0 {
+			errs.add(field+".checkInterval", "must not be negative")
+		}
+		if b.StaleChecks < 0 {
+			errs.add(field+".staleChecks", "must not be negative")
+		}
+		if len(b.Devices) < 2 {
+			errs.add(field+".devices", "at least 2 devices are needed")
+		}
+		for j, name := range b.Devices {
+			if !devices[name] {
+				errs.add(fmt.Sprintf("%s.devices[%d]", field, j), "unknown device %q", name)
+			} else if bonded[name] {
+				errs.add(fmt.Sprintf("%s.devices[%d]", field, j), "device %q is already part of a bond", name)
+			}
+			bonded[name] = true
+		}
+	}
+	return errs.err()
+}
+
+func verifyAgentConfig(conf *agentConfig) error {
+	errs := configErrors{}
+	errs.merge(verifyAgentClientID(conf))
+	errs.merge(verifyAgentResolversConfig(conf))
+	errs.merge(verifyAgentStatsdConfig(conf))
+	errs.merge(verifyAgentOAuthConfig(conf))
+	errs.merge(verifyAgentDevicesConfig(conf))
+	errs.merge(verifyAgentBondsConfig(conf))
+	errs.merge(verifyAgentCaptivePortalConfig(conf))
+	errs.merge(verifyAgentHooksConfig(conf))
+	return errs.err()
+}
+
+// readConfigFile returns the content of the config file at path as JSON.
+// Files with a .yaml or .yml extension are converted from YAML.
+func readConfigFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return yamlToJSON(content)
+	}
+	return content, nil
+}
+
+// yamlToJSON converts a YAML document to JSON, so that it can be decoded with
+// the JSON field names and unmarshallers of the config types.
+func yamlToJSON(content []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(content, &v); err != nil {
+		return nil, err
+	}
+	v, err := jsonCompatible(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonCompatible replaces the maps with non-string keys and the timestamps
+// decoded from YAML with values that can be marshalled to JSON.
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			e, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = e
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			e, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = e
+		}
+		return m, nil
+	case []interface{}:
+		for i, e := range v {
+			e, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = e
+		}
+		return v, nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	}
+	return v, nil
 }
 
 func readAgentConfig(path string) (*agentConfig, error) {
 	conf := &agentConfig{}
-	fileContent, err := os.ReadFile(path)
+	fileContent, err := readConfigFile(path)
 	if err != nil {
 		return conf, fmt.Errorf("error reading config file: %v", err)
 	}
 	if err = json.Unmarshal(fileContent, conf); err != nil {
 		return nil, fmt.Errorf("error unmarshalling config: %v", err)
 	}
-	if err = verifyAgentOAuthConfig(conf); err != nil {
-		return nil, err
-	}
-	if err = verifyAgentDevicesConfig(conf); err != nil {
+	if err = verifyAgentConfig(conf); err != nil {
 		return nil, err
 	}
 	return conf, nil
 }
 
+// serverLeaseExportConfig configures periodically exporting the active
+// leases for external systems to sync with.
+type serverLeaseExportConfig struct {
+	// Filename is atomically replaced with the lease table on every export
+	Filename string `json:"filename"`
+	// Format is one of "json" or "prometheus"
+	Format string `json:"format"`
+	// URL receives the lease table in a POST request on every export
+	URL      string   `json:"url"`
+	Interval duration `json:"interval"`
+}
+
+// serverAdaptiveLeasesConfig configures shortening leases and reclaiming
+// idle ones while the network is running out of addresses.
+type serverAdaptiveLeasesConfig struct {
+	// UtilizationThreshold is the fraction of leased addresses above which
+	// leases are shortened and idle ones reclaimed
+	UtilizationThreshold float64 `json:"utilizationThreshold"`
+	// LeaseTTL is the duration of leases granted above the threshold
+	LeaseTTL duration `json:"leaseTTL"`
+	// IdleTimeout is the age of the latest handshake of a peer after which
+	// its lease is reclaimed above the threshold
+	IdleTimeout duration `json:"idleTimeout"`
+}
+
+// serverLeasePolicyConfig configures per user limits and address affinity of
+// leases.
+type serverLeasePolicyConfig struct {
+	// MaxPublicKeys is the number of distinct public keys a user can
+	// request leases for within PublicKeysWindow, unlimited if zero
+	MaxPublicKeys    int      `json:"maxPublicKeys"`
+	PublicKeysWindow duration `json:"publicKeysWindow"`
+	// AddressAffinity is how long the address of a released lease is
+	// preferred for the same user and public key
+	AddressAffinity duration `json:"addressAffinity"`
+	// AddressAllocation is the strategy addresses of new leases are
+	// picked with: sequential, random or sticky
+	AddressAllocation string `json:"addressAllocation"`
+}
+
+// serverRateLimitsConfig limits the rate of lease requests from each source
+// address and with each token.
+type serverRateLimitsConfig struct {
+	SourceIP *rateLimitConfig `json:"sourceIP"`
+	Token    *rateLimitConfig `json:"token"`
+}
+
+// rateLimitConfig configures a token bucket: requests are allowed at Rate per
+// second on average, in bursts of up to Burst.
+type rateLimitConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// serverLeaseEventsConfig configures publishing lease changes to a message
+// queue and webhooks.
+type serverLeaseEventsConfig struct {
+	NATS     *serverNATSConfig      `json:"nats"`
+	Webhooks []*serverWebhookConfig `json:"webhooks"`
+	// BufferSize is the number of events buffered while publishing, events
+	// are dropped when the buffer is full
+	BufferSize     int      `json:"bufferSize"`
+	PublishTimeout duration `json:"publishTimeout"`
+}
+
+// serverNATSConfig configures publishing lease events to a NATS subject,
+// captured by a JetStream stream.
+type serverNATSConfig struct {
+	// URL is the nats:// or, to connect over TLS, tls:// url of the server
+	URL     string `json:"url"`
+	Subject string `json:"subject"`
+	// CAFile is a PEM bundle of the CAs that issue the certificate of the
+	// server, the system CAs are used if empty. Setting it requires TLS.
+	CAFile string `json:"caFile"`
+	// CredentialsFilename is a NATS credentials file, holding the user JWT
+	// and nkey seed the server is connected to with
+	CredentialsFilename string `json:"credentialsFilename"`
+}
+
+// serverWebhookConfig configures POSTing lease events to a url.
+type serverWebhookConfig struct {
+	URL string `json:"url"`
+	// SecretFilename is a file containing the secret requests are signed
+	// with, requests are not signed if empty
+	SecretFilename string `json:"secretFilename"`
+	// Events are the events sent, out of lease.created, lease.renewed,
+	// lease.expired and lease.revoked, all of them if empty
+	Events []string `json:"events"`
+}
+
+// serverLeaseStoreConfig configures a store for leases that several servers
+// can share, instead of the leases file.
+type serverLeaseStoreConfig struct {
+	Consul *serverConsulConfig `json:"consul"`
+}
+
+// serverConsulConfig configures storing leases under a key of the Consul KV
+// store.
+type serverConsulConfig struct {
+	// Address is the url of the Consul HTTP API
+	Address       string `json:"address"`
+	Key           string `json:"key"`
+	TokenFilename string `json:"tokenFilename"`
+}
+
+// serverAuditLogConfig configures the audit log of lease operations.
+type serverAuditLogConfig struct {
+	Filename string `json:"filename"`
+	// Syslog sends records to the local syslog daemon as well
+	Syslog bool `json:"syslog"`
+}
+
+// serverDNSRouteConfig sends the queries of agents for names under Domains to
+// Servers, through the tunnel.
+type serverDNSRouteConfig struct {
+	Domains []string `json:"domains"`
+	Servers []string `json:"servers"`
+	// Scopes limit the route to tokens granted any of them, if set
+	Scopes []string `json:"scopes"`
+}
+
+// serverPoolConfig describes a named pool that addresses can be leased from
+// instead of the address network, with its own advertised routes.
+type serverPoolConfig struct {
+	Name string `json:"name"`
+	// Address is the address of the server in the pool, in CIDR notation
+	Address    string   `json:"address"`
+	AllowedIPs []string `json:"allowedIPs"`
+	// AllowedIPsBroad and MaxAllowedIPsAddresses override the allowed IPs
+	// limit of the server for the pool
+	AllowedIPsBroad        bool   `json:"allowedIPsBroad"`
+	MaxAllowedIPsAddresses uint64 `json:"maxAllowedIPsAddresses"`
+	// Reserved lists the addresses and networks of the pool that are never
+	// leased
+	Reserved []string `json:"reserved"`
+	// Scopes select the pool for tokens granted any of them, and are
+	// required to request the pool by name, if set
+	Scopes []string `json:"scopes"`
+	// LeaseTTL, LeaseMaxLifetime and LeaseRenewInterval override the lease
+	// timing of the server for leases from the pool, if set
+	LeaseTTL           duration `json:"leaseTTL"`
+	LeaseMaxLifetime   duration `json:"leaseMaxLifetime"`
+	LeaseRenewInterval duration `json:"leaseRenewInterval"`
+
+	ip       net.IP
+	network  *net.IPNet
+	reserved []*net.IPNet
+}
+
+// serverGroupNetworkConfig gives the members of an identity provider group
+// access to networks, on top of the allowed IPs of every lease.
+type serverGroupNetworkConfig struct {
+	Group      string   `json:"group"`
+	AllowedIPs []string `json:"allowedIPs"`
+	// AllowedIPsBroad and MaxAllowedIPsAddresses override the allowed IPs
+	// limit of the server for the group network
+	AllowedIPsBroad        bool   `json:"allowedIPsBroad"`
+	MaxAllowedIPsAddresses uint64 `json:"maxAllowedIPsAddresses"`
+}
+
+// serverNATConfig configures the masquerading and forwarding of the traffic
+// of peers by the server.
+type serverNATConfig struct {
+	// UpstreamInterfaces limit masquerading, and forwarding, to traffic
+	// leaving through them. Traffic leaving through any interface is
+	// masqueraded if empty
+	UpstreamInterfaces []string `json:"upstreamInterfaces"`
+	// Forward enables forwarding and accepts the traffic forwarded between
+	// peers and the upstream interfaces
+	Forward bool `json:"forward"`
+}
+
+// serverDeviceConfig describes an additional wireguard device of the server,
+// with a network, listen port and allowed IPs of its own, to lease addresses
+// to a separate class of peers.
+type serverDeviceConfig struct {
+	Name string `json:"name"`
+	// Address is the address of the server on the device, in CIDR
+	// notation, and the network addresses are leased from
+	Address string `json:"address"`
+	// Endpoint is advertised to agents, the device listens on its port
+	Endpoint   string   `json:"endpoint"`
+	AllowedIPs []string `json:"allowedIPs"`
+	DeviceMTU  int      `json:"deviceMTU"`
+	// AllowedIPsBroad and MaxAllowedIPsAddresses override the allowed IPs
+	// limit of the server for the device
+	AllowedIPsBroad        bool   `json:"allowedIPsBroad"`
+	MaxAllowedIPsAddresses uint64 `json:"maxAllowedIPsAddresses"`
+	// KeyFilename and LeasesFilename default to files named after the
+	// device next to the ones of the main device
+	KeyFilename    string `json:"keyFilename"`
+	LeasesFilename string `json:"leasesFilename"`
+	// Scopes and Groups select the device for tokens granted any of the
+	// scopes or members of any of the groups, and one of them is required
+	// to request the device by name, if set
+	Scopes []string `json:"scopes"`
+	Groups []string `json:"groups"`
+
+	ip         net.IP
+	network    *net.IPNet
+	listenPort int
+}
+
+// serverIdentityConfig configures an identity provider that issues
+// the tokens agents authenticate lease requests with. Which fields are used
+// depends on the Type of the provider.
+type serverIdentityConfig struct {
+	Name string `json:"name"`
+	// Type is one of oidc, okta, google, azure, introspection and static
+	Type string `json:"type"`
+	// Issuer of the tokens of oidc providers, JWKSURL is discovered from
+	// it if not set
+	Issuer       string   `json:"issuer"`
+	JWKSURL      string   `json:"jwksURL"`
+	JWKSCacheTTL duration `json:"jwksCacheTTL"`
+	// IntrospectURL is the token introspection endpoint of introspection
+	// providers
+	IntrospectURL string `json:"introspectURL"`
+	ClientID      string `json:"clientID"`
+	// Audience the tokens have to be issued for, defaults to ClientID
+	Audience      string `json:"audience"`
+	UsernameClaim string `json:"usernameClaim"`
+	// GroupsClaim is the claim of JWTs the groups of users are read from
+	GroupsClaim string `json:"groupsClaim"`
+	// Domain and AuthorizationServer locate the authorization server of
+	// okta providers
+	Domain              string `json:"domain"`
+	AuthorizationServer string `json:"authorizationServer"`
+	// Tenant is the directory of azure providers
+	Tenant string `json:"tenant"`
+	// HostedDomain limits google providers to the accounts of a domain
+	HostedDomain string `json:"hostedDomain"`
+	// TokensFilename lists the tokens of static providers
+	TokensFilename string `json:"tokensFilename"`
+	// Listeners are the lease APIs, json and grpc, that accept the tokens
+	// of the provider, all of them if empty
+	Listeners []string `json:"listeners"`
+}
+
 // serverConfig describes the server-side configuration of wiresteward.
 type serverConfig struct {
-	Address             string
-	AllowedIPs          []string
-	DeviceMTU           int
-	DeviceName          string
-	Endpoint            string
-	KeyFilename         string
-	LeaserSyncInterval  time.Duration
-	LeasesFilename      string
-	WireguardIPAddress  net.IP
-	WireguardIPNetwork  *net.IPNet
-	WireguardListenPort int
-	OauthIntrospectURL  string
-	OauthClientID       string
-	ServerListenAddress string
+	Address                 string
+	AdaptiveLeases          *serverAdaptiveLeasesConfig
+	AdminListenAddress      string
+	AllowedIPs              []string
+	AllowedIPsBroad         bool
+	AllowedIPsFlags         map[string]string
+	MaxAllowedIPsAddresses  uint64
+	DelegatedPrefixes       string
+	DelegatedPrefixLength   int
+	DelegatedPrefixPool     *net.IPNet
+	DeviceMTU               int
+	DeviceName              string
+	ControlURL              string
+	Endpoint                string
+	KeyFilename             string
+	LeaseEvents             *serverLeaseEventsConfig
+	LeaseExport             *serverLeaseExportConfig
+	LeaseGracePeriod        time.Duration
+	LeaseMaxLifetime        time.Duration
+	LeaseRenewInterval      time.Duration
+	LeaseTTL                time.Duration
+	LeaserSyncInterval      time.Duration
+	LeasesFilename          string
+	LeaseSigningKeyFilename string
+	WireguardIPAddress      net.IP
+	WireguardIPNetwork      *net.IPNet
+	Network6                string
+	WireguardIP6Address     net.IP
+	WireguardIP6Network     *net.IPNet
+	WireguardListenPort     int
+	OauthIntrospectURL      string
+	OauthClientID           string
+	ResponseRedaction       serverRedactionRules
+	ServerListenAddress     string
+	SourceRanges            serverSourceRanges
+	// TLSCertFile and TLSKeyFile make the server serve lease requests over
+	// TLS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// DNSServers and DNSSearchDomains are sent to agents along with their
+	// leases, which use them to resolve names while the tunnel is up
+	DNSServers       []string
+	DNSSearchDomains []string
+	// AgentMTU is sent to agents along with their leases, for devices
+	// that do not set an mtu themselves
+	AgentMTU int
+	// Reservations maps wireguard public keys to the address that is always
+	// leased to them and the user they belong to, ReservedIPs holds the
+	// parsed reservations
+	Reservations serverReservations
+	ReservedIPs  map[string]ipReservation
+	// AdminTokenFilename is a file containing the bearer token that
+	// requests to the admin server have to present, it is required when
+	// AdminListenAddress is set
+	AdminTokenFilename string
+	// ClientCAFile is a PEM bundle of the CAs that issue client
+	// certificates to machine agents, which can then request leases
+	// without a token
+	ClientCAFile string
+	// OauthJWKSURL makes the server validate tokens as JWTs signed by the
+	// keys published at the url, instead of introspecting them. Tokens
+	// have to be issued by OauthIssuer for OauthAudience, which defaults
+	// to OauthClientID, and the username is read from OauthUsernameClaim
+	OauthJWKSURL       string
+	OauthJWKSCacheTTL  time.Duration
+	OauthIssuer        string
+	OauthAudience      string
+	OauthUsernameClaim string
+	// LeasePolicy limits the public keys of users and keeps their
+	// addresses stable
+	LeasePolicy *serverLeasePolicyConfig
+	// PresharedKeySecretFilename is a file containing the secret that the
+	// preshared key of every peer is derived from, preshared keys are not
+	// used if empty
+	PresharedKeySecretFilename string
+	// LeaseStore makes the server store leases in a backend shared with
+	// other servers, instead of LeasesFilename
+	LeaseStore *serverLeaseStoreConfig
+	// AuditLog records lease requests and changes to leases
+	AuditLog *serverAuditLogConfig
+	// Pools are named networks that addresses are leased from instead of
+	// the address network, selected by token scopes or requested by agents
+	Pools []*serverPoolConfig
+	// EnableGRPC serves the gRPC lease API alongside the JSON one
+	EnableGRPC bool
+	// DNSRoutes are sent to agents along with their lease, for split DNS
+	DNSRoutes []*serverDNSRouteConfig
+	// IdentityProviders validate the tokens of lease requests, instead of
+	// the oauth settings above
+	IdentityProviders []*serverIdentityConfig
+	// GroupNetworks add networks to the allowed IPs of the members of
+	// groups, and forwarding is limited to the allowed IPs of each lease
+	// if set. OauthGroupsClaim is the claim of JWTs groups are read from
+	GroupNetworks    []*serverGroupNetworkConfig
+	OauthGroupsClaim string
+	// NAT configures the masquerading rules towards upstream interfaces
+	// and the forwarding of the traffic of peers
+	NAT *serverNATConfig
+	// KeyStore is where the private key is kept: file, the default, in
+	// KeyFilename, keyring or encrypted
+	KeyStore       string
+	EncryptedStore *encryptedStoreConfig
+	// Devices are additional wireguard devices, leasing addresses from
+	// networks of their own
+	Devices []*serverDeviceConfig
+	// RateLimits limit the rate of lease requests
+	RateLimits *serverRateLimitsConfig
 }
 
 func (c *serverConfig) UnmarshalJSON(data []byte) error {
 	cfg := &struct {
-		Address             string   `json:"address"`
-		AllowedIPs          []string `json:"allowedIPs"`
-		DeviceMTU           int      `json:"deviceMTU"`
-		DeviceName          string   `json:"deviceName"`
-		Endpoint            string   `json:"endpoint"`
-		KeyFilename         string   `json:"keyFilename"`
-		LeaserSyncInterval  string   `json:"leaserSyncInterval"`
-		LeasesFilename      string   `json:"leasesFilename"`
-		OauthIntrospectURL  string   `json:"oauthIntrospectURL"`
-		OauthClientID       string   `json:"oauthClientID"`
-		ServerListenAddress string   `json:"serverListenAddress"`
+		Address                    string                      `json:"address"`
+		AdaptiveLeases             *serverAdaptiveLeasesConfig `json:"adaptiveLeases"`
+		AdminListenAddress         string                      `json:"adminListenAddress"`
+		AllowedIPs                 []string                    `json:"allowedIPs"`
+		AllowedIPsBroad            bool                        `json:"allowedIPsBroad"`
+		AllowedIPsFlags            map[string]string           `json:"allowedIPsFlags"`
+		MaxAllowedIPsAddresses     uint64                      `json:"maxAllowedIPsAddresses"`
+		Network6                   string                      `json:"network6"`
+		DelegatedPrefixes          string                      `json:"delegatedPrefixes"`
+		DelegatedPrefixLength      int                         `json:"delegatedPrefixLength"`
+		DeviceMTU                  int                         `json:"deviceMTU"`
+		DeviceName                 string                      `json:"deviceName"`
+		ControlURL                 string                      `json:"controlURL"`
+		Endpoint                   string                      `json:"endpoint"`
+		KeyFilename                string                      `json:"keyFilename"`
+		LeaseEvents                *serverLeaseEventsConfig    `json:"leaseEvents"`
+		LeaseExport                *serverLeaseExportConfig    `json:"leaseExport"`
+		LeaseGracePeriod           duration                    `json:"leaseGracePeriod"`
+		LeaseMaxLifetime           duration                    `json:"leaseMaxLifetime"`
+		LeaseRenewInterval         duration                    `json:"leaseRenewInterval"`
+		LeaseTTL                   duration                    `json:"leaseTTL"`
+		LeaserSyncInterval         string                      `json:"leaserSyncInterval"`
+		LeasesFilename             string                      `json:"leasesFilename"`
+		LeaseSigningKeyFilename    string                      `json:"leaseSigningKeyFilename"`
+		OauthIntrospectURL         string                      `json:"oauthIntrospectURL"`
+		ResponseRedaction          serverRedactionRules        `json:"responseRedaction"`
+		OauthClientID              string                      `json:"oauthClientID"`
+		ServerListenAddress        string                      `json:"serverListenAddress"`
+		SourceRanges               serverSourceRanges          `json:"sourceRanges"`
+		TLSCertFile                string                      `json:"tlsCertFile"`
+		TLSKeyFile                 string                      `json:"tlsKeyFile"`
+		DNSServers                 []string                    `json:"dnsServers"`
+		DNSSearchDomains           []string                    `json:"dnsSearchDomains"`
+		AgentMTU                   int                         `json:"agentMTU"`
+		Reservations               serverReservations          `json:"reservations"`
+		AdminTokenFilename         string                      `json:"adminTokenFilename"`
+		ClientCAFile               string                      `json:"clientCAFile"`
+		OauthJWKSURL               string                      `json:"oauthJWKSURL"`
+		OauthJWKSCacheTTL          duration                    `json:"oauthJWKSCacheTTL"`
+		OauthIssuer                string                      `json:"oauthIssuer"`
+		OauthAudience              string                      `json:"oauthAudience"`
+		OauthUsernameClaim         string                      `json:"oauthUsernameClaim"`
+		LeasePolicy                *serverLeasePolicyConfig    `json:"leasePolicy"`
+		PresharedKeySecretFilename string                      `json:"presharedKeySecretFilename"`
+		LeaseStore                 *serverLeaseStoreConfig     `json:"leaseStore"`
+		AuditLog                   *serverAuditLogConfig       `json:"auditLog"`
+		Pools                      []*serverPoolConfig         `json:"pools"`
+		EnableGRPC                 bool                        `json:"enableGRPC"`
+		DNSRoutes                  []*serverDNSRouteConfig     `json:"dnsRoutes"`
+		IdentityProviders          []*serverIdentityConfig     `json:"identityProviders"`
+		GroupNetworks              []*serverGroupNetworkConfig `json:"groupNetworks"`
+		OauthGroupsClaim           string                      `json:"oauthGroupsClaim"`
+		NAT                        *serverNATConfig            `json:"nat"`
+		KeyStore                   string                      `json:"keyStore"`
+		EncryptedStore             *encryptedStoreConfig       `json:"encryptedStore"`
+		Devices                    []*serverDeviceConfig       `json:"devices"`
+		RateLimits                 *serverRateLimitsConfig     `json:"rateLimits"`
 	}{}
 	if err := json.Unmarshal(data, cfg); err != nil {
 		return err
@@ -135,33 +1294,115 @@ func (c *serverConfig) UnmarshalJSON(data []byte) error {
 		c.LeaserSyncInterval = lsi
 	}
 	c.Address = cfg.Address
+	c.AdaptiveLeases = cfg.AdaptiveLeases
+	c.AdminListenAddress = cfg.AdminListenAddress
 	c.AllowedIPs = cfg.AllowedIPs
+	c.AllowedIPsBroad = cfg.AllowedIPsBroad
+	c.AllowedIPsFlags = cfg.AllowedIPsFlags
+	c.MaxAllowedIPsAddresses = cfg.MaxAllowedIPsAddresses
+	c.Network6 = cfg.Network6
+	c.DelegatedPrefixes = cfg.DelegatedPrefixes
+	c.DelegatedPrefixLength = cfg.DelegatedPrefixLength
 	c.DeviceMTU = cfg.DeviceMTU
 	c.DeviceName = cfg.DeviceName
+	c.ControlURL = cfg.ControlURL
 	c.Endpoint = cfg.Endpoint
 	c.KeyFilename = cfg.KeyFilename
+	c.LeaseEvents = cfg.LeaseEvents
+	c.LeaseExport = cfg.LeaseExport
+	c.LeaseGracePeriod = cfg.LeaseGracePeriod.Duration
+	c.LeaseMaxLifetime = cfg.LeaseMaxLifetime.Duration
+	c.LeaseRenewInterval = cfg.LeaseRenewInterval.Duration
+	c.LeaseTTL = cfg.LeaseTTL.Duration
 	c.LeasesFilename = cfg.LeasesFilename
+	c.LeaseSigningKeyFilename = cfg.LeaseSigningKeyFilename
 	c.OauthIntrospectURL = cfg.OauthIntrospectURL
+	c.ResponseRedaction = cfg.ResponseRedaction
 	c.OauthClientID = cfg.OauthClientID
 	c.ServerListenAddress = cfg.ServerListenAddress
+	c.SourceRanges = cfg.SourceRanges
+	c.TLSCertFile = cfg.TLSCertFile
+	c.TLSKeyFile = cfg.TLSKeyFile
+	c.DNSServers = cfg.DNSServers
+	c.DNSSearchDomains = cfg.DNSSearchDomains
+	c.AgentMTU = cfg.AgentMTU
+	c.Reservations = cfg.Reservations
+	c.AdminTokenFilename = cfg.AdminTokenFilename
+	c.ClientCAFile = cfg.ClientCAFile
+	c.OauthJWKSURL = cfg.OauthJWKSURL
+	c.OauthJWKSCacheTTL = cfg.OauthJWKSCacheTTL.Duration
+	c.OauthIssuer = cfg.OauthIssuer
+	c.OauthAudience = cfg.OauthAudience
+	c.OauthUsernameClaim = cfg.OauthUsernameClaim
+	c.LeasePolicy = cfg.LeasePolicy
+	c.PresharedKeySecretFilename = cfg.PresharedKeySecretFilename
+	c.LeaseStore = cfg.LeaseStore
+	c.AuditLog = cfg.AuditLog
+	c.Pools = cfg.Pools
+	c.EnableGRPC = cfg.EnableGRPC
+	c.DNSRoutes = cfg.DNSRoutes
+	c.IdentityProviders = cfg.IdentityProviders
+	c.GroupNetworks = cfg.GroupNetworks
+	c.OauthGroupsClaim = cfg.OauthGroupsClaim
+	c.NAT = cfg.NAT
+	c.KeyStore = cfg.KeyStore
+	c.EncryptedStore = cfg.EncryptedStore
+	c.Devices = cfg.Devices
+	c.RateLimits = cfg.RateLimits
 	return nil
 }
 
 func verifyServerConfig(conf *serverConfig) error {
+	errs := configErrors{}
 	if conf.Address == "" {
-		return fmt.Errorf("config missing `address`")
+		errs.add("address", "missing value")
+	} else if ip, network, err := net.ParseCIDR(conf.Address); err != nil {
+		errs.add("address", "could not parse as a CIDR: %v", err)
+	} else {
+		conf.WireguardIPAddress = ip
+		conf.WireguardIPNetwork = network
+		if len(conf.AllowedIPs) == 0 {
+			logger.Info.Printf("config missing `allowedIPs`, this server is not exposing any networks")
+		}
+		errs.merge(verifyAllowedIPsBreadth(conf))
+		errs.merge(verifyAllowedIPsFlags(conf))
+		errs.merge(verifyReservations(conf))
+		// Append the server wg /32 ip to the allowed ips in case the agent wants to ping it for health checking
+		conf.AllowedIPs = append(conf.AllowedIPs, fmt.Sprintf("%s/%s", conf.WireguardIPAddress.String(), "32"))
 	}
-	ip, network, err := net.ParseCIDR(conf.Address)
-	if err != nil {
-		return fmt.Errorf("could not parse address as a CIDR: %w", err)
+	if conf.Network6 != "" {
+		_, network, err := net.ParseCIDR(conf.Network6)
+		if err != nil {
+			errs.add("network6", "could not parse as a CIDR: %v", err)
+		} else if network.IP.To4() != nil {
+			errs.add("network6", "must be an IPv6 network, got: %s", network)
+		} else if ones, _ := network.Mask.Size(); ones > maxNetwork6PrefixLength {
+			errs.add("network6", "prefix must be /%d or shorter to fit IPv4 addresses, got: /%d", maxNetwork6PrefixLength, ones)
+		} else if conf.WireguardIPAddress != nil {
+			conf.WireguardIP6Network = network
+			conf.WireguardIP6Address = embedIPv4(network, conf.WireguardIPAddress)
+			conf.AllowedIPs = append(conf.AllowedIPs, fmt.Sprintf("%s/128", conf.WireguardIP6Address))
+		}
 	}
-	conf.WireguardIPAddress = ip
-	conf.WireguardIPNetwork = network
-	if len(conf.AllowedIPs) == 0 {
-		logger.Info.Printf("config missing `allowedIPs`, this server is not exposing any networks")
+	if conf.DelegatedPrefixes != "" {
+		_, pool, err := net.ParseCIDR(conf.DelegatedPrefixes)
+		if err != nil {
+			errs.add("delegatedPrefixes", "could not parse as a CIDR: %v", err)
+		} else if pool.IP.To4() == nil {
+			errs.add("delegatedPrefixes", "only IPv4 networks are supported")
+		} else {
+			conf.DelegatedPrefixPool = pool
+			if conf.WireguardIPNetwork != nil && (pool.Contains(conf.WireguardIPNetwork.IP) || conf.WireguardIPNetwork.Contains(pool.IP)) {
+				errs.add("delegatedPrefixes", "must not overlap with the address network %s", conf.WireguardIPNetwork)
+			}
+			poolSize, _ := pool.Mask.Size()
+			if conf.DelegatedPrefixLength < poolSize || conf.DelegatedPrefixLength > 32 {
+				errs.add("delegatedPrefixLength", "must be between %d and 32, got: %d", poolSize, conf.DelegatedPrefixLength)
+			}
+		}
+	} else if conf.DelegatedPrefixLength != 0 {
+		errs.add("delegatedPrefixLength", "requires delegatedPrefixes to be set")
 	}
-	// Append the server wg /32 ip to the allowed ips in case the agent wants to ping it for health checking
-	conf.AllowedIPs = append(conf.AllowedIPs, fmt.Sprintf("%s/%s", conf.WireguardIPAddress.String(), "32"))
 
 	if conf.DeviceName == "" {
 		conf.DeviceName = defaultWireguardDeviceName
@@ -171,17 +1412,14 @@ func verifyServerConfig(conf *serverConfig) error {
 		)
 	}
 	if conf.Endpoint == "" {
-		return fmt.Errorf("config missing `endpoint`")
-	}
-	ep := strings.Split(conf.Endpoint, ":")
-	if len(ep) != 2 {
-		return fmt.Errorf("invalid `endpoint` value, it must be of the format `<host>:<port>`, got: %s", conf.Endpoint)
+		errs.add("endpoint", "missing value")
+	} else if ep := strings.Split(conf.Endpoint, ":"); len(ep) != 2 {
+		errs.add("endpoint", "must be of the format `<host>:<port>`, got: %s", conf.Endpoint)
+	} else if port, err := strconv.Atoi(ep[1]); err != nil {
+		errs.add("endpoint", "could not parse listen port value: %v", err)
+	} else {
+		conf.WireguardListenPort = port
 	}
-	port, err := strconv.Atoi(ep[1])
-	if err != nil {
-		return fmt.Errorf("could not parse listen port value: %w", err)
-	}
-	conf.WireguardListenPort = port
 	if conf.KeyFilename == "" {
 		conf.KeyFilename = defaultKeyFilename
 		logger.Info.Printf(
@@ -189,6 +1427,34 @@ func verifyServerConfig(conf *serverConfig) error {
 			defaultKeyFilename,
 		)
 	}
+	errs.merge(verifyLeaseEventsConfig(conf))
+	errs.merge(verifyLeaseExportConfig(conf))
+	errs.merge(verifyAdaptiveLeasesConfig(conf))
+	errs.merge(verifyLeasePolicyConfig(conf))
+	errs.merge(verifyLeaseStoreConfig(conf))
+	errs.merge(verifyPoolsConfig(conf))
+	errs.merge(verifyDNSRoutesConfig(conf))
+	errs.merge(verifyIdentityProvidersConfig(conf))
+	errs.merge(verifyGroupNetworksConfig(conf))
+	errs.merge(verifyNATConfig(conf))
+	errs.merge(verifyRateLimitsConfig(conf))
+	if !isSecretStore(conf.KeyStore) {
+		errs.add("keyStore", "must be one of %s, %s or %s, got: %q", secretStoreFile, secretStoreKeyring, secretStoreEncrypted, conf.KeyStore)
+	}
+	if conf.LeaseTTL < 0 {
+		errs.add("leaseTTL", "must not be negative")
+	}
+	if conf.LeaseMaxLifetime < 0 {
+		errs.add("leaseMaxLifetime", "must not be negative")
+	}
+	if conf.LeaseGracePeriod < 0 {
+		errs.add("leaseGracePeriod", "must not be negative")
+	}
+	if conf.LeaseRenewInterval < 0 {
+		errs.add("leaseRenewInterval", "must not be negative")
+	} else if conf.LeaseTTL > 0 && conf.LeaseRenewInterval >= conf.LeaseTTL {
+		errs.add("leaseRenewInterval", "must be shorter than leaseTTL")
+	}
 	if conf.LeaserSyncInterval == 0 {
 		conf.LeaserSyncInterval = defaultLeaserSyncInterval
 		logger.Info.Printf(
@@ -203,11 +1469,32 @@ func verifyServerConfig(conf *serverConfig) error {
 			defaultLeasesFilename,
 		)
 	}
-	if conf.OauthIntrospectURL == "" {
-		return fmt.Errorf("config missing `oauthIntrospectURL`")
+	errs.merge(verifyDevicesConfig(conf))
+	if len(conf.IdentityProviders) > 0 {
+		if conf.OauthIntrospectURL != "" || conf.OauthJWKSURL != "" {
+			errs.add("identityProviders", "cannot be combined with oauthIntrospectURL and oauthJWKSURL")
+		}
+	} else {
+		if conf.OauthIntrospectURL == "" && conf.OauthJWKSURL == "" {
+			errs.add("oauthIntrospectURL", "missing value, one of oauthIntrospectURL, oauthJWKSURL and identityProviders is required")
+		}
+		if conf.OauthClientID == "" {
+			errs.add("oauthClientID", "missing value")
+		}
+	}
+	if conf.OauthJWKSURL != "" {
+		if _, err := url.ParseRequestURI(conf.OauthJWKSURL); err != nil {
+			errs.add("oauthJWKSURL", "could not parse as a url: %v", err)
+		}
+		if conf.OauthIssuer == "" {
+			errs.add("oauthIssuer", "missing value, it is required to validate JWTs")
+		}
+		if conf.OauthAudience == "" {
+			conf.OauthAudience = conf.OauthClientID
+		}
 	}
-	if conf.OauthClientID == "" {
-		return fmt.Errorf("config missing `oauthClientID`")
+	if conf.OauthJWKSCacheTTL < 0 {
+		errs.add("oauthJWKSCacheTTL", "must not be negative")
 	}
 	if conf.ServerListenAddress == "" {
 		conf.ServerListenAddress = defaultServerListenAddress
@@ -216,12 +1503,712 @@ func verifyServerConfig(conf *serverConfig) error {
 			defaultServerListenAddress,
 		)
 	}
-	return nil
+	if conf.ControlURL != "" {
+		if u, err := url.Parse(conf.ControlURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("controlURL", "must be an absolute http(s) url, got: %q", conf.ControlURL)
+		} else if ip := net.ParseIP(u.Hostname()); ip != nil && conf.WireguardIPNetwork != nil && !conf.WireguardIPNetwork.Contains(ip) {
+			errs.add("controlURL", "must be reachable through the tunnel, %s is not in %s", ip, conf.WireguardIPNetwork)
+		}
+	}
+	for i, s := range conf.DNSServers {
+		if net.ParseIP(s) == nil {
+			errs.add(fmt.Sprintf("dnsServers[%d]", i), "could not parse as an IP address: %q", s)
+		}
+	}
+	for i, d := range conf.DNSSearchDomains {
+		if d == "" || strings.ContainsAny(d, " \t/") {
+			errs.add(fmt.Sprintf("dnsSearchDomains[%d]", i), "invalid domain: %q", d)
+		}
+	}
+	if conf.AgentMTU != 0 && (conf.AgentMTU < minAdvertisedMTU || conf.AgentMTU > maxAdvertisedMTU) {
+		errs.add("agentMTU", "must be between %d and %d", minAdvertisedMTU, maxAdvertisedMTU)
+	}
+	for field, rule := range conf.ResponseRedaction {
+		if _, ok := redactableResponseFields[field]; !ok {
+			errs.add(fmt.Sprintf("responseRedaction[%s]", field), "field cannot be redacted")
+		}
+		if rule.MinVersion < 0 {
+			errs.add(fmt.Sprintf("responseRedaction[%s].minVersion", field), "must not be negative")
+		}
+	}
+	for username, ranges := range conf.SourceRanges {
+		if len(ranges) == 0 {
+			errs.add(fmt.Sprintf("sourceRanges[%s]", username), "at least one range is needed")
+		}
+		for i, r := range ranges {
+			if _, _, err := net.ParseCIDR(r); err != nil {
+				errs.add(fmt.Sprintf("sourceRanges[%s][%d]", username, i), "could not parse as a CIDR: %v", err)
+			}
+		}
+	}
+	if (conf.TLSCertFile == "") != (conf.TLSKeyFile == "") {
+		errs.add("tlsCertFile", "tlsCertFile and tlsKeyFile must be set together")
+	}
+	if conf.ClientCAFile != "" && conf.TLSCertFile == "" {
+		errs.add("clientCAFile", "requires tlsCertFile and tlsKeyFile to be set")
+	}
+	if conf.AdminTokenFilename != "" && conf.AdminListenAddress == "" {
+		errs.add("adminTokenFilename", "requires adminListenAddress to be set")
+	}
+	if conf.AdminListenAddress != "" && conf.AdminTokenFilename == "" {
+		errs.add("adminListenAddress", "requires adminTokenFilename to be set")
+	}
+	if al := conf.AuditLog; al != nil {
+		if al.Filename == "" && !al.Syslog {
+			errs.add("auditLog", "at least one of filename and syslog is required")
+		}
+		if al.Syslog && runtime.GOOS == "windows" {
+			errs.add("auditLog.syslog", "is not supported on windows")
+		}
+	}
+	return errs.err()
+}
+
+func verifyAdaptiveLeasesConfig(conf *serverConfig) error {
+	errs := configErrors{}
+	al := conf.AdaptiveLeases
+	if al == nil {
+		return nil
+	}
+	if al.UtilizationThreshold == 0 {
+		al.UtilizationThreshold = defaultAdaptiveUtilizationThreshold
+	} else if al.UtilizationThreshold < 0 || al.UtilizationThreshold > 1 {
+		errs.add("adaptiveLeases.utilizationThreshold", "must be between 0 and 1, got: %v", al.UtilizationThreshold)
+	}
+	if al.LeaseTTL.Duration == 0 {
+		al.LeaseTTL.Duration = defaultAdaptiveLeaseTTL
+	} else if al.LeaseTTL.Duration < 0 {
+		errs.add("adaptiveLeases.leaseTTL", "must not be negative")
+	}
+	if al.IdleTimeout.Duration == 0 {
+		al.IdleTimeout.Duration = defaultAdaptiveIdleTimeout
+	} else if al.IdleTimeout.Duration < 0 {
+		errs.add("adaptiveLeases.idleTimeout", "must not be negative")
+	}
+	return errs.err()
+}
+
+func verifyLeasePolicyConfig(conf *serverConfig) error {
+	errs := configErrors{}
+	lp := conf.LeasePolicy
+	if lp == nil {
+		return nil
+	}
+	if lp.MaxPublicKeys < 0 {
+		errs.add("leasePolicy.maxPublicKeys", "must not be negative")
+	}
+	if lp.PublicKeysWindow.Duration == 0 {
+		lp.PublicKeysWindow.Duration = defaultPublicKeysWindow
+	} else if lp.PublicKeysWindow.Duration < 0 {
+		errs.add("leasePolicy.publicKeysWindow", "must not be negative")
+	}
+	if lp.AddressAffinity.Duration < 0 {
+		errs.add("leasePolicy.addressAffinity", "must not be negative")
+	}
+	if _, err := newAddressAllocator(lp.AddressAllocation); err != nil {
+		errs.add("leasePolicy.addressAllocation", "%v", err)
+	}
+	return errs.err()
+}
+
+func verifyDNSRoutesConfig(conf *serverConfig) error {
+	errs := configErrors{}
+	for i, r := range conf.DNSRoutes {
+		field := fmt.Sprintf("dnsRoutes[%d]", i)
+		if r == nil {
+			errs.add(field, "missing value")
+			continue
+		}
+		if len(r.Domains) == 0 {
+			errs.add(field+".domains", "must not be empty")
+		}
+		for j, d := range r.Domains {
+			if !validDNSDomain(d) {
+				errs.add(fmt.Sprintf("%s.domains[%d]", field, j), "invalid domain: %q", d)
+			}
+		}
+		if len(r.Servers) == 0 {
+			errs.add(field+".servers", "must not be empty")
+		}
+		for j, s := range r.Servers {
+			if net.ParseIP(s) == nil {
+				errs.add(fmt.Sprintf("%s.servers[%d]", field, j), "could not parse as an IP address: %q", s)
+			}
+		}
+	}
+	return errs.err()
+}
+
+func verifyIdentityProvidersConfig(conf *serverConfig) error {
+	errs := configErrors{}
+	names := map[string]bool{}
+	for i, ip := range conf.IdentityProviders {
+		field := fmt.Sprintf("identityProviders[%d]", i)
+		if ip == nil {
+			errs.add(field, "missing value")
+			continue
+		}
+		if ip.Name == "" {
+			ip.Name = ip.Type
+		}
+		if names[ip.Name] {
+			errs.add(field+".name", "duplicate identity provider %s", ip.Name)
+		}
+		names[ip.Name] = true
+		if ip.Audience == "" {
+			ip.Audience = ip.ClientID
+		}
+		switch ip.Type {
+		case identityProviderOIDC:
+			if ip.Issuer == "" {
+				errs.add(field+".issuer", "missing value")
+			}
+		case identityProviderOkta:
+			if ip.Domain == "" {
+				errs.add(field+".domain", "missing value")
+			}
+		case identityProviderAzure:
+			if ip.Tenant == "" {
+				errs.add(field+".tenant", "missing value")
+			}
+		case identityProviderIntrospection:
+			if ip.IntrospectURL == "" {
+				errs.add(field+".introspectURL", "missing value")
+			}
+		case identityProviderStatic:
+			if ip.TokensFilename == "" {
+				errs.add(field+".tokensFilename", "missing value")
+			}
+		case identityProviderGoogle:
+		default:
+			errs.add(field+".type", "must be one of oidc, okta, google, azure, introspection and static, got: %q", ip.Type)
+		}
+		if ip.Type != identityProviderStatic && ip.ClientID == "" {
+			errs.add(field+".clientID", "missing value")
+		}
+		for _, u := range []struct{ name, value string }{
+			{"issuer", ip.Issuer},
+			{"jwksURL", ip.JWKSURL},
+			{"introspectURL", ip.IntrospectURL},
+		} {
+			if u.value == "" {
+				continue
+			}
+			if _, err := url.ParseRequestURI(u.value); err != nil {
+				errs.add(field+"."+u.name, "could not parse as a url: %v", err)
+			}
+		}
+		if ip.JWKSCacheTTL.Duration < 0 {
+			errs.add(field+".jwksCacheTTL", "must not be negative")
+		}
+		for j, l := range ip.Listeners {
+			if l != leaseListenerJSON && l != leaseListenerGRPC {
+				errs.add(fmt.Sprintf("%s.listeners[%d]", field, j), "must be one of json and grpc, got: %q", l)
+			}
+		}
+	}
+	return errs.err()
+}
+
+func verifyGroupNetworksConfig(conf *serverConfig) error {
+	errs := configErrors{}
+	// Forwarded IPv6 traffic is not limited by group
+	if len(conf.GroupNetworks) > 0 && conf.Network6 != "" {
+		errs.add("groupNetworks", "cannot be used along with network6")
+	}
+	for i, g := range conf.GroupNetworks {
+		field := fmt.Sprintf("groupNetworks[%d]", i)
+		if g == nil {
+			errs.add(field, "missing value")
+			continue
+		}
+		// Groups are stored with leases, separated by commas
+		if g.Group == "" || strings.ContainsAny(g.Group, " \t\r\n,") {
+			errs.add(field+".group", "must be a non empty name without whitespace and commas, got: %q", g.Group)
+		}
+		if len(g.AllowedIPs) == 0 {
+			errs.add(field+".allowedIPs", "must not be empty")
+		}
+		for j, a := range g.AllowedIPs {
+			if ip, _, err := net.ParseCIDR(a); err != nil {
+				errs.add(fmt.Sprintf("%s.allowedIPs[%d]", field, j), "could not parse as a CIDR: %v", err)
+			} else if ip.To4() == nil {
+				errs.add(fmt.Sprintf("%s.allowedIPs[%d]", field, j), "only IPv4 networks are supported")
+			}
+		}
+	}
+	return errs.err()
+}
+
+func verifyNATConfig(conf *serverConfig) error {
+	errs := configErrors{}
+	if conf.NAT == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	for i, iface := range conf.NAT.UpstreamInterfaces {
+		field := fmt.Sprintf("nat.upstreamInterfaces[%d]", i)
+		// Linux limits interface names to 15 characters
+		if iface == "" || len(iface) > 15 || strings.ContainsAny(iface, " \t\r\n/") {
+			errs.add(field, "must be an interface name, got: %q", iface)
+		}
+		if seen[iface] {
+			errs.add(field, "duplicate interface %q", iface)
+		}
+		seen[iface] = true
+	}
+	return errs.err()
+}
+
+func verifyRateLimitsConfig(conf *serverConfig) error {
+	errs := configErrors{}
+	if conf.RateLimits == nil {
+		return nil
+	}
+	for _, l := range []struct {
+		field string
+		rl    *rateLimitConfig
+	}{{"rateLimits.sourceIP", conf.RateLimits.SourceIP}, {"rateLimits.token", conf.RateLimits.Token}} {
+		field, rl := l.field, l.rl
+		if rl == nil {
+			continue
+		}
+		if rl.Rate <= 0 {
+			errs.add(field+".rate", "must be positive, got: %v", rl.Rate)
+		}
+		if rl.Burst < 0 {
+			errs.add(field+".burst", "must not be negative, got: %d", rl.Burst)
+		} else if rl.Burst == 0 {
+			rl.Burst = defaultRateLimitBurst
+		}
+	}
+	return errs.err()
+}
+
+// verifyDevicesConfig checks the additional devices of the server, which must
+// be called after the address network, pools, key and leases filenames of the
+// main device are set.
+func verifyDevicesConfig(conf *serverConfig) error {
+	errs := configErrors{}
+	names := map[string]bool{conf.DeviceName: true}
+	ports := map[int]bool{conf.WireguardListenPort: true}
+	files := map[string]bool{conf.KeyFilename: true, conf.LeasesFilename: true}
+	var networks []*net.IPNet
+	if conf.WireguardIPNetwork != nil {
+		networks = append(networks, conf.WireguardIPNetwork)
+	}
+	if conf.DelegatedPrefixPool != nil {
+		networks = append(networks, conf.DelegatedPrefixPool)
+	}
+	for _, p := range conf.Pools {
+		if p != nil && p.network != nil {
+			networks = append(networks, p.network)
+		}
+	}
+	for i, d := range conf.Devices {
+		field := fmt.Sprintf("devices[%d]", i)
+		if d == nil {
+			errs.add(field, "missing value")
+			continue
+		}
+		// Linux limits interface names to 15 characters
+		if d.Name == "" || len(d.Name) > 15 || strings.ContainsAny(d.Name, " \t\r\n/") {
+			errs.add(field+".name", "must be an interface name, got: %q", d.Name)
+		} else if names[d.Name] {
+			errs.add(field+".name", "duplicate device %s", d.Name)
+		}
+		names[d.Name] = true
+		if ip, network, err := net.ParseCIDR(d.Address); err != nil {
+			errs.add(field+".address", "could not parse as a CIDR: %v", err)
+		} else if ip.To4() == nil {
+			errs.add(field+".address", "only IPv4 networks are supported")
+		} else {
+			for _, n := range networks {
+				if n.Contains(network.IP) || network.Contains(n.IP) {
+					errs.add(field+".address", "must not overlap with %s", n)
+				}
+			}
+			networks = append(networks, network)
+			d.ip, d.network = ip, network
+		}
+		if ep := strings.Split(d.Endpoint, ":"); len(ep) != 2 {
+			errs.add(field+".endpoint", "must be of the format `<host>:<port>`, got: %s", d.Endpoint)
+		} else if port, err := strconv.Atoi(ep[1]); err != nil {
+			errs.add(field+".endpoint", "could not parse listen port value: %v", err)
+		} else if ports[port] {
+			errs.add(field+".endpoint", "port %d is already used by another device", port)
+		} else {
+			ports[port] = true
+			d.listenPort = port
+		}
+		for j, a := range d.AllowedIPs {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				errs.add(fmt.Sprintf("%s.allowedIPs[%d]", field, j), "could not parse as a CIDR: %v", err)
+			}
+		}
+		if d.DeviceMTU < 0 {
+			errs.add(field+".deviceMTU", "must not be negative")
+		}
+		if d.KeyFilename == "" {
+			d.KeyFilename = filepath.Join(filepath.Dir(conf.KeyFilename), d.Name+".key")
+		}
+		if d.LeasesFilename == "" {
+			d.LeasesFilename = filepath.Join(filepath.Dir(conf.LeasesFilename), "leases-"+d.Name)
+		}
+		for _, f := range []struct{ name, value string }{{"keyFilename", d.KeyFilename}, {"leasesFilename", d.LeasesFilename}} {
+			if files[f.value] {
+				errs.add(field+"."+f.name, "%s is already used by another device", f.value)
+			}
+			files[f.value] = true
+		}
+		// Agents can ping the server address of the device for health
+		// checking
+		if d.ip != nil {
+			d.AllowedIPs = append(d.AllowedIPs, fmt.Sprintf("%s/32", d.ip))
+		}
+	}
+	return errs.err()
+}
+
+func verifyPoolsConfig(conf *serverConfig) error {
+	errs := configErrors{}
+	names := map[string]bool{}
+	var networks []*net.IPNet
+	if conf.WireguardIPNetwork != nil {
+		networks = append(networks, conf.WireguardIPNetwork)
+	}
+	if conf.DelegatedPrefixPool != nil {
+		networks = append(networks, conf.DelegatedPrefixPool)
+	}
+	for i, p := range conf.Pools {
+		field := fmt.Sprintf("pools[%d]", i)
+		if p == nil {
+			errs.add(field, "missing value")
+			continue
+		}
+		if p.Name == "" || strings.ContainsAny(p.Name, " \t\r\n") {
+			errs.add(field+".name", "must be a non empty name without whitespace, got: %q", p.Name)
+		} else if names[p.Name] {
+			errs.add(field+".name", "duplicate pool %s", p.Name)
+		}
+		names[p.Name] = true
+		ip, network, err := net.ParseCIDR(p.Address)
+		if err != nil {
+			errs.add(field+".address", "could not parse as a CIDR: %v", err)
+			continue
+		}
+		if ip.To4() == nil {
+			errs.add(field+".address", "only IPv4 networks are supported")
+			continue
+		}
+		for _, n := range networks {
+			if n.Contains(network.IP) || network.Contains(n.IP) {
+				errs.add(field+".address", "must not overlap with %s", n)
+			}
+		}
+		networks = append(networks, network)
+		p.ip, p.network, p.reserved = ip, network, nil
+		for j, a := range p.AllowedIPs {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				errs.add(fmt.Sprintf("%s.allowedIPs[%d]", field, j), "could not parse as a CIDR: %v", err)
+			}
+		}
+		for j, r := range p.Reserved {
+			reserved := parseIPOrCIDR(r)
+			if reserved == nil {
+				errs.add(fmt.Sprintf("%s.reserved[%d]", field, j), "could not parse as an IP address or CIDR: %q", r)
+			} else if !network.Contains(reserved.IP) {
+				errs.add(fmt.Sprintf("%s.reserved[%d]", field, j), "%s is not in %s", reserved, network)
+			} else {
+				p.reserved = append(p.reserved, reserved)
+			}
+		}
+		if p.LeaseTTL.Duration < 0 {
+			errs.add(field+".leaseTTL", "must not be negative")
+		}
+		if p.LeaseMaxLifetime.Duration < 0 {
+			errs.add(field+".leaseMaxLifetime", "must not be negative")
+		}
+		if p.LeaseRenewInterval.Duration < 0 {
+			errs.add(field+".leaseRenewInterval", "must not be negative")
+		} else if pc := conf.poolConfig(p); pc.LeaseTTL > 0 && pc.LeaseRenewInterval >= pc.LeaseTTL {
+			errs.add(field+".leaseRenewInterval", "must be shorter than leaseTTL")
+		}
+		// Agents can ping the server address of the pool for health checking
+		p.AllowedIPs = append(p.AllowedIPs, fmt.Sprintf("%s/32", ip))
+	}
+	return errs.err()
+}
+
+func verifyLeaseStoreConfig(conf *serverConfig) error {
+	errs := configErrors{}
+	ls := conf.LeaseStore
+	if ls == nil {
+		return nil
+	}
+	if ls.Consul == nil {
+		errs.add("leaseStore.consul", "missing value")
+	} else {
+		if ls.Consul.Address == "" {
+			ls.Consul.Address = defaultConsulAddress
+		} else if u, err := url.Parse(ls.Consul.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("leaseStore.consul.address", "must be an absolute http(s) url, got: %q", ls.Consul.Address)
+		}
+		if ls.Consul.Key == "" {
+			ls.Consul.Key = defaultConsulLeasesKey
+		} else if strings.HasPrefix(ls.Consul.Key, "/") || strings.ContainsAny(ls.Consul.Key, " \t\r\n?#") {
+			errs.add("leaseStore.consul.key", "invalid key: %q", ls.Consul.Key)
+		}
+	}
+	// Handshakes are only seen by the server that peers are connected to
+	if conf.AdaptiveLeases != nil {
+		errs.add("leaseStore", "cannot be used with adaptiveLeases")
+	}
+	return errs.err()
+}
+
+func verifyLeaseEventsConfig(conf *serverConfig) error {
+	errs := configErrors{}
+	le := conf.LeaseEvents
+	if le == nil {
+		return nil
+	}
+	if le.NATS == nil && len(le.Webhooks) == 0 {
+		errs.add("leaseEvents", "must set at least one of `nats` or `webhooks`")
+	}
+	if le.NATS != nil && !natsSupported {
+		errs.add("leaseEvents.nats", "%v", errNATSNotSupported)
+	} else if le.NATS != nil {
+		if _, err := newNATSPublisher(le.NATS); err != nil {
+			errs.add("leaseEvents.nats.url", "%v", err)
+		}
+		if le.NATS.Subject == "" || strings.ContainsAny(le.NATS.Subject, " \t\r\n") {
+			errs.add("leaseEvents.nats.subject", "must be a non empty subject without whitespace, got: %q", le.NATS.Subject)
+		}
+	}
+	for i, w := range le.Webhooks {
+		field := fmt.Sprintf("leaseEvents.webhooks[%d]", i)
+		if w == nil {
+			errs.add(field, "missing value")
+			continue
+		}
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add(field+".url", "must be an http(s) url, got: %q", w.URL)
+		}
+		for j, e := range w.Events {
+			if !isWebhookEvent(e) {
+				errs.add(fmt.Sprintf("%s.events[%d]", field, j), "unknown event %q", e)
+			}
+		}
+	}
+	if le.BufferSize < 0 {
+		errs.add("leaseEvents.bufferSize", "must not be negative")
+	}
+	if le.PublishTimeout.Duration < 0 {
+		errs.add("leaseEvents.publishTimeout", "must not be negative")
+	}
+	return errs.err()
+}
+
+func verifyLeaseExportConfig(conf *serverConfig) error {
+	errs := configErrors{}
+	le := conf.LeaseExport
+	if le == nil {
+		return nil
+	}
+	if le.Filename == "" && le.URL == "" {
+		errs.add("leaseExport", "must set at least one of `filename` or `url`")
+	}
+	if le.URL != "" {
+		if u, err := url.Parse(le.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs.add("leaseExport.url", "must be an absolute url, got: %q", le.URL)
+		}
+	}
+	switch le.Format {
+	case "", leaseExportFormatJSON, leaseExportFormatPrometheus:
+	default:
+		errs.add("leaseExport.format", "must be one of %q or %q, got: %q", leaseExportFormatJSON, leaseExportFormatPrometheus, le.Format)
+	}
+	if le.Interval.Duration < 0 {
+		errs.add("leaseExport.interval", "must not be negative")
+	}
+	return errs.err()
+}
+
+// verifyAllowedIPsFlags checks that flags are only set for entries of the
+// allowed IPs and that they are valid.
+func verifyAllowedIPsFlags(conf *serverConfig) error {
+	errs := configErrors{}
+	allowedIPs := map[string]bool{}
+	for _, a := range conf.AllowedIPs {
+		allowedIPs[a] = true
+	}
+	for a, flag := range conf.AllowedIPsFlags {
+		field := fmt.Sprintf("allowedIPsFlags[%s]", a)
+		if !allowedIPs[a] {
+			errs.add(field, "not an entry of allowedIPs")
+		}
+		switch flag {
+		case allowedIPFlagBoth, allowedIPFlagCrypto, allowedIPFlagRoute:
+		default:
+			errs.add(field, "must be one of %q, %q or %q, got: %q", allowedIPFlagBoth, allowedIPFlagCrypto, allowedIPFlagRoute, flag)
+		}
+	}
+	return errs.err()
+}
+
+// serverReservations maps public keys to their reservation.
+type serverReservations map[string]serverReservationConfig
+
+// serverReservationConfig is the address reserved for a public key. Public
+// keys are not secret, so only the user the key belongs to can lease it.
+type serverReservationConfig struct {
+	IP       string `json:"ip"`
+	Username string `json:"username"`
+}
+
+// verifyReservations checks that the reserved addresses are unique, leasable
+// addresses of the network, owned by a user, and parses them into
+// ReservedIPs.
+func verifyReservations(conf *serverConfig) error {
+	errs := configErrors{}
+	if len(conf.Reservations) == 0 {
+		return nil
+	}
+	network := conf.WireguardIPNetwork
+	// The first and last addresses of the network are never leased
+	last := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		last[i] = network.IP[i] | ^network.Mask[i]
+	}
+	reservedBy := map[string]string{}
+	conf.ReservedIPs = map[string]ipReservation{}
+	for key, reservation := range conf.Reservations {
+		field := fmt.Sprintf("reservations[%s]", key)
+		if _, err := wgtypes.ParseKey(key); err != nil {
+			errs.add(field, "could not parse key as a wireguard public key: %v", err)
+		}
+		if reservation.Username == "" {
+			errs.add(field+".username", "missing value")
+		}
+		ip := net.ParseIP(reservation.IP)
+		if ip == nil {
+			errs.add(field+".ip", "could not parse as an IP address: %q", reservation.IP)
+			continue
+		}
+		if !network.Contains(ip) {
+			errs.add(field, "%s is not in %s", ip, network)
+			continue
+		}
+		if ip.Equal(conf.WireguardIPAddress) {
+			errs.add(field, "%s is the address of the server", ip)
+			continue
+		}
+		if ip.Equal(network.IP) || ip.Equal(last) {
+			errs.add(field, "%s is the network or broadcast address of %s", ip, network)
+			continue
+		}
+		if other, ok := reservedBy[ip.String()]; ok {
+			errs.add(field, "%s is also reserved for %s", ip, other)
+			continue
+		}
+		reservedBy[ip.String()] = key
+		conf.ReservedIPs[key] = ipReservation{ip: ip, username: reservation.Username}
+	}
+	return errs.err()
+}
+
+// countAddresses returns the total number of addresses in the networks,
+// saturating at the maximum uint64 value. IPv6 networks are counted in /64
+// subnets rather than addresses, as that is the size of a single network.
+func countAddresses(networks []*net.IPNet) uint64 {
+	var total uint64
+	for _, n := range networks {
+		ones, bits := n.Mask.Size()
+		if bits == 8*net.IPv6len {
+			bits = 64
+			if ones > bits {
+				ones = bits
+			}
+		}
+		if bits-ones >= 64 {
+			return ^uint64(0)
+		}
+		size := uint64(1) << uint(bits-ones)
+		if total+size < total {
+			return ^uint64(0)
+		}
+		total += size
+	}
+	return total
+}
+
+// verifyAllowedIPsBreadth guards against exposing overly broad networks to
+// peers by mistake: the allowed IPs, and the ones of group networks, pools and
+// additional devices, may not contain more addresses than their maximum,
+// unless they are explicitly marked as broad. Group networks, pools and
+// additional devices are checked against their own limit, falling back to the
+// maximum of the server, and are only exempt when marked as broad themselves.
+func verifyAllowedIPsBreadth(conf *serverConfig) error {
+	errs := configErrors{}
+	for i, a := range conf.AllowedIPs {
+		if _, _, err := net.ParseCIDR(a); err != nil {
+			errs.add(fmt.Sprintf("allowedIPs[%d]", i), "could not parse as a CIDR: %v", err)
+		}
+	}
+	serverMax := conf.MaxAllowedIPsAddresses
+	if serverMax == 0 {
+		serverMax = defaultMaxAllowedIPsAddresses
+	}
+	// The allowed IPs of the other lists are parsed by their own checks
+	type allowedIPsList struct {
+		field      string
+		allowedIPs []string
+		broad      bool
+		max        uint64
+	}
+	lists := []allowedIPsList{{"allowedIPs", conf.AllowedIPs, conf.AllowedIPsBroad, serverMax}}
+	limit := func(max uint64) uint64 {
+		if max == 0 {
+			return serverMax
+		}
+		return max
+	}
+	for i, g := range conf.GroupNetworks {
+		if g != nil {
+			lists = append(lists, allowedIPsList{fmt.Sprintf("groupNetworks[%d].allowedIPs", i), g.AllowedIPs, g.AllowedIPsBroad, limit(g.MaxAllowedIPsAddresses)})
+		}
+	}
+	for i, p := range conf.Pools {
+		if p != nil {
+			lists = append(lists, allowedIPsList{fmt.Sprintf("pools[%d].allowedIPs", i), p.AllowedIPs, p.AllowedIPsBroad, limit(p.MaxAllowedIPsAddresses)})
+		}
+	}
+	for i, d := range conf.Devices {
+		if d != nil {
+			lists = append(lists, allowedIPsList{fmt.Sprintf("devices[%d].allowedIPs", i), d.AllowedIPs, d.AllowedIPsBroad, limit(d.MaxAllowedIPsAddresses)})
+		}
+	}
+	for _, l := range lists {
+		if l.broad {
+			continue
+		}
+		networks := []*net.IPNet{}
+		for _, a := range l.allowedIPs {
+			if _, n, err := net.ParseCIDR(a); err == nil {
+				networks = append(networks, n)
+			}
+		}
+		if total := countAddresses(networks); total > l.max {
+			errs.add(l.field, "contain %d addresses, more than the maximum of %d, set `allowedIPsBroad` if this is intended", total, l.max)
+		}
+	}
+	return errs.err()
 }
 
 func readServerConfig(path string) (*serverConfig, error) {
 	conf := &serverConfig{}
-	fileContent, err := os.ReadFile(path)
+	fileContent, err := readConfigFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("error reading config file: %v", err)
 	}
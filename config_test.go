@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -83,6 +86,8 @@ func TestAgentConfigFmt(t *testing.T) {
     {
       "name": "wg_test",
       "mtu": 1380,
+      "netlinkRetryAttempts": 5,
+      "netlinkRetryDelay": "200ms",
       "peers": [
         {
             "url": "example1.com"
@@ -104,6 +109,8 @@ func TestAgentConfigFmt(t *testing.T) {
 	assert.Equal(t, len(conf.Devices), 1)
 	assert.Equal(t, conf.Devices[0].Name, "wg_test")
 	assert.Equal(t, conf.Devices[0].MTU, 1380)
+	assert.Equal(t, conf.Devices[0].NetlinkRetryAttempts, 5)
+	assert.Equal(t, conf.Devices[0].NetlinkRetryDelay.Duration, 200*time.Millisecond)
 	peers = conf.Devices[0].Peers
 	assert.Equal(t, len(peers), 1)
 	assert.Equal(t, peers[0].URL, "example1.com")
@@ -117,6 +124,32 @@ func TestAgentConfigFmt(t *testing.T) {
 	}
 }
 
+func TestAgentConfig_CoexistKeyRotation(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	for _, tc := range []struct {
+		input string
+		err   bool
+	}{
+		{`"peerManagement": "coexist"`, false},
+		{`"keyRotationInterval": "24h"`, false},
+		{`"peerManagement": "exclusive", "keyRotationInterval": "24h"`, false},
+		{`"peerManagement": "coexist", "keyRotationInterval": "24h"`, true},
+	} {
+		input := `{"oauth": {"clientID": "xxxxx", "authUrl": "example.com/auth", "tokenUrl": "example.com/token"}, "devices": [{"name": "wg_test", "peers": [{"url": "example.com"}], ` + tc.input + `}]}`
+		conf := &agentConfig{}
+		if err := json.Unmarshal([]byte(input), conf); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyAgentConfig(conf)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+		}
+	}
+}
+
 func TestServerConfig(t *testing.T) {
 	setLogLevel("error")
 	logger = newLogger("wiresteward-test")
@@ -185,7 +218,13 @@ func TestServerConfig(t *testing.T) {
 			[]byte(`{
 				"endpoint": ""
 			}`),
-			&serverConfig{},
+			&serverConfig{
+				DeviceName:          "wg0",
+				KeyFilename:         defaultKeyFilename,
+				LeaserSyncInterval:  defaultLeaserSyncInterval,
+				LeasesFilename:      defaultLeasesFilename,
+				ServerListenAddress: "0.0.0.0:8080",
+			},
 			true,
 		},
 	}
@@ -205,3 +244,365 @@ func TestServerConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigErrors(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	input := []byte(`
+{
+  "oauth": {
+    "clientID": "xxxxx",
+    "tokenUrl": "example.com/token"
+  },
+  "devices": [
+    {
+      "name": "wg_test",
+      "peers": [{"url": "example1.com"}]
+    },
+    {
+      "routeProtocol": 300,
+      "mtu": 100,
+      "peers": [{"url": "example1.com"}, {}]
+    },
+    {
+      "name": "wg_test",
+      "peers": [{"url": "example2.com"}]
+    }
+  ]
+}
+`)
+	conf := &agentConfig{}
+	if err := json.Unmarshal(input, conf); err != nil {
+		t.Fatal(err)
+	}
+	err := verifyAgentConfig(conf)
+	var errs configErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected configErrors, got: %v", err)
+	}
+	fields := []string{}
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	assert.Equal(t, []string{
+		"oauth.authUrl",
+		"devices[1].name",
+		"devices[1].routeProtocol",
+		"devices[1].mtu",
+		"devices[1].peers[1].url",
+		"devices[2].name",
+	}, fields)
+
+	// Server config errors should be accumulated as well
+	cfg := &serverConfig{}
+	if err := json.Unmarshal([]byte(`{"address": "foo", "endpoint": "1.2.3.4", "oauthClientID": "id", "dnsServers": ["10.0.0.1", "foo"]}`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	errs = nil
+	if !errors.As(verifyServerConfig(cfg), &errs) {
+		t.Fatal("expected configErrors")
+	}
+	fields = []string{}
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	assert.Equal(t, []string{"address", "endpoint", "oauthIntrospectURL", "dnsServers[1]"}, fields)
+}
+
+func TestServerConfig_AllowedIPsBreadth(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	testCases := []struct {
+		input string
+		err   bool
+	}{
+		{`"allowedIPs": ["10.0.0.0/8", "172.16.0.0/12"]`, false},
+		{`"allowedIPs": ["0.0.0.0/0"]`, true},
+		{`"allowedIPs": ["0.0.0.0/1", "128.0.0.0/1"]`, true},
+		{`"allowedIPs": ["0.0.0.0/0"], "allowedIPsBroad": true`, false},
+		{`"allowedIPs": ["10.0.0.0/8"], "maxAllowedIPsAddresses": 65536`, true},
+		{`"allowedIPs": ["10.0.0.0/16"], "maxAllowedIPsAddresses": 65536`, false},
+		{`"allowedIPs": ["::/0"]`, true},
+		{`"groupNetworks": [{"group": "admins", "allowedIPs": ["0.0.0.0/0"]}]`, true},
+		{`"groupNetworks": [{"group": "admins", "allowedIPs": ["0.0.0.0/0"]}], "allowedIPsBroad": true`, true},
+		{`"groupNetworks": [{"group": "admins", "allowedIPs": ["0.0.0.0/0"], "allowedIPsBroad": true}]`, false},
+		{`"groupNetworks": [{"group": "admins", "allowedIPs": ["10.0.0.0/16"], "maxAllowedIPsAddresses": 256}]`, true},
+		{`"pools": [{"name": "office", "address": "10.91.0.1/24", "allowedIPs": ["0.0.0.0/0"]}]`, true},
+		{`"pools": [{"name": "office", "address": "10.91.0.1/24", "allowedIPs": ["10.0.0.0/16"]}], "maxAllowedIPsAddresses": 256`, true},
+		{`"pools": [{"name": "office", "address": "10.91.0.1/24", "allowedIPs": ["10.0.0.0/16"], "maxAllowedIPsAddresses": 65536}], "maxAllowedIPsAddresses": 256`, false},
+		// A pool allowed to be broad does not make the main device broad
+		{`"allowedIPs": ["10.0.0.0/8"], "pools": [{"name": "office", "address": "10.91.0.1/24", "allowedIPs": ["0.0.0.0/0"], "allowedIPsBroad": true}]`, false},
+		{`"allowedIPs": ["0.0.0.0/0"], "pools": [{"name": "office", "address": "10.91.0.1/24", "allowedIPs": ["0.0.0.0/0"], "allowedIPsBroad": true}]`, true},
+		{`"allowedIPs": ["0.0.0.0/0"], "allowedIPsBroad": true, "pools": [{"name": "office", "address": "10.91.0.1/24", "allowedIPs": ["0.0.0.0/0"]}]`, true},
+		{`"devices": [{"name": "wg1", "address": "10.92.0.1/24", "endpoint": "1.2.3.4:51821", "allowedIPs": ["0.0.0.0/0"]}]`, true},
+		{`"devices": [{"name": "wg1", "address": "10.92.0.1/24", "endpoint": "1.2.3.4:51821", "allowedIPs": ["10.0.0.0/8"]}]`, false},
+		{`"devices": [{"name": "wg1", "address": "10.92.0.1/24", "endpoint": "1.2.3.4:51821", "allowedIPs": ["0.0.0.0/0"], "allowedIPsBroad": true}]`, false},
+	}
+	for _, tc := range testCases {
+		cfg := &serverConfig{}
+		input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthIntrospectURL": "example.com", "oauthClientID": "id", ` + tc.input + `}`
+		if err := json.Unmarshal([]byte(input), cfg); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyServerConfig(cfg)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+		}
+	}
+}
+
+func TestServerConfig_AllowedIPsFlags(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	testCases := []struct {
+		input string
+		err   bool
+	}{
+		{`"allowedIPsFlags": {"10.10.0.0/16": "route", "10.20.0.0/16": "crypto"}`, false},
+		{`"allowedIPsFlags": {"10.10.0.0/16": "both"}`, false},
+		{`"allowedIPsFlags": {"10.10.0.0/16": "neither"}`, true},
+		{`"allowedIPsFlags": {"10.30.0.0/16": "route"}`, true},
+	}
+	for _, tc := range testCases {
+		cfg := &serverConfig{}
+		input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthIntrospectURL": "example.com", "oauthClientID": "id", "allowedIPs": ["10.10.0.0/16", "10.20.0.0/16"], ` + tc.input + `}`
+		if err := json.Unmarshal([]byte(input), cfg); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyServerConfig(cfg)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+		}
+	}
+}
+
+func TestServerConfig_Reservations(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	key1 := "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY="
+	key2 := "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo="
+	testCases := []struct {
+		input string
+		err   bool
+	}{
+		{`"reservations": {"` + key1 + `": {"ip": "10.90.0.10", "username": "ci"}, "` + key2 + `": {"ip": "10.90.0.11", "username": "gw"}}`, false},
+		{`"reservations": {"` + key1 + `": {"ip": "10.90.0.10", "username": "ci"}, "` + key2 + `": {"ip": "10.90.0.10", "username": "gw"}}`, true},
+		{`"reservations": {"` + key1 + `": {"ip": "10.90.0.10"}}`, true},
+		{`"reservations": {"` + key1 + `": {"ip": "10.90.1.10", "username": "ci"}}`, true},
+		{`"reservations": {"` + key1 + `": {"ip": "10.90.0.1", "username": "ci"}}`, true},
+		{`"reservations": {"` + key1 + `": {"ip": "10.90.0.255", "username": "ci"}}`, true},
+		{`"reservations": {"` + key1 + `": {"ip": "foo", "username": "ci"}}`, true},
+		{`"reservations": {"foo": {"ip": "10.90.0.10", "username": "ci"}}`, true},
+	}
+	for _, tc := range testCases {
+		cfg := &serverConfig{}
+		input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthIntrospectURL": "example.com", "oauthClientID": "id", ` + tc.input + `}`
+		if err := json.Unmarshal([]byte(input), cfg); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyServerConfig(cfg)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+			assert.Equal(t, ipReservation{ip: net.ParseIP("10.90.0.10"), username: "ci"}, cfg.ReservedIPs[key1])
+		}
+	}
+}
+
+func TestServerConfig_AdminToken(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	testCases := []struct {
+		input string
+		err   bool
+	}{
+		{`"adminListenAddress": "127.0.0.1:8082", "adminTokenFilename": "/etc/wiresteward/admin-token"`, false},
+		{`"adminListenAddress": "127.0.0.1:8082"`, true},
+		{`"adminTokenFilename": "/etc/wiresteward/admin-token"`, true},
+	}
+	for _, tc := range testCases {
+		cfg := &serverConfig{}
+		input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthIntrospectURL": "example.com", "oauthClientID": "id", ` + tc.input + `}`
+		if err := json.Unmarshal([]byte(input), cfg); err != nil {
+			t.Fatal(err)
+		}
+		if tc.err {
+			assert.Error(t, verifyServerConfig(cfg), tc.input)
+		} else {
+			assert.NoError(t, verifyServerConfig(cfg), tc.input)
+		}
+	}
+}
+
+func TestServerConfig_JWKS(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	testCases := []struct {
+		input string
+		err   bool
+	}{
+		{`"oauthJWKSURL": "https://idp.example.com/jwks", "oauthIssuer": "https://idp.example.com"`, false},
+		{`"oauthJWKSURL": "https://idp.example.com/jwks"`, true},
+		{`"oauthJWKSURL": "jwks", "oauthIssuer": "https://idp.example.com"`, true},
+		{`"oauthJWKSURL": "https://idp.example.com/jwks", "oauthIssuer": "https://idp.example.com", "oauthJWKSCacheTTL": "-1m"`, true},
+		{`"oauthIntrospectURL": "example.com"`, false},
+		{`"oauthIssuer": "https://idp.example.com"`, true},
+	}
+	for _, tc := range testCases {
+		cfg := &serverConfig{}
+		input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthClientID": "id", ` + tc.input + `}`
+		if err := json.Unmarshal([]byte(input), cfg); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyServerConfig(cfg)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+		}
+	}
+	// The audience defaults to the client id
+	cfg := &serverConfig{}
+	input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthClientID": "id", "oauthJWKSURL": "https://idp.example.com/jwks", "oauthIssuer": "https://idp.example.com"}`
+	if err := json.Unmarshal([]byte(input), cfg); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, verifyServerConfig(cfg))
+	assert.Equal(t, "id", cfg.OauthAudience)
+}
+
+func TestServerConfig_LeaseStore(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	testCases := []struct {
+		input string
+		err   bool
+	}{
+		{`"leaseStore": {"consul": {}}`, false},
+		{`"leaseStore": {"consul": {"address": "https://consul.example.com:8501", "key": "vpn/leases"}}`, false},
+		{`"leaseStore": {}`, true},
+		{`"leaseStore": {"consul": {"address": "consul:8500"}}`, true},
+		{`"leaseStore": {"consul": {"key": "/vpn/leases"}}`, true},
+		{`"leaseStore": {"consul": {}}, "adaptiveLeases": {}`, true},
+	}
+	for _, tc := range testCases {
+		cfg := &serverConfig{}
+		input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthClientID": "id", "oauthIntrospectURL": "example.com", ` + tc.input + `}`
+		if err := json.Unmarshal([]byte(input), cfg); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyServerConfig(cfg)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+		}
+	}
+	// The consul agent and key have defaults
+	cfg := &serverConfig{}
+	input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthClientID": "id", "oauthIntrospectURL": "example.com", "leaseStore": {"consul": {}}}`
+	if err := json.Unmarshal([]byte(input), cfg); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, verifyServerConfig(cfg))
+	assert.Equal(t, defaultConsulAddress, cfg.LeaseStore.Consul.Address)
+	assert.Equal(t, defaultConsulLeasesKey, cfg.LeaseStore.Consul.Key)
+}
+
+func TestServerConfig_Pools(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	testCases := []struct {
+		input string
+		err   bool
+	}{
+		{`"pools": [{"name": "office", "address": "10.91.0.1/24", "allowedIPs": ["10.0.0.0/8"], "reserved": ["10.91.0.2", "10.91.0.128/25"]}]`, false},
+		{`"pools": [{"name": "", "address": "10.91.0.1/24"}]`, true},
+		{`"pools": [{"name": "office", "address": "10.91.0.1/24"}, {"name": "office", "address": "10.92.0.1/24"}]`, true},
+		{`"pools": [{"name": "office", "address": "10.91.0.1"}]`, true},
+		{`"pools": [{"name": "office", "address": "10.90.0.129/25"}]`, true},
+		{`"pools": [{"name": "office", "address": "10.91.0.1/24"}, {"name": "infra", "address": "10.91.0.0/16"}]`, true},
+		{`"pools": [{"name": "office", "address": "10.91.0.1/24", "allowedIPs": ["10.0.0.0"]}]`, true},
+		{`"pools": [{"name": "office", "address": "10.91.0.1/24", "reserved": ["10.92.0.2"]}]`, true},
+		{`"leaseRenewInterval": "1h", "pools": [{"name": "office", "address": "10.91.0.1/24", "leaseTTL": "30m", "leaseMaxLifetime": "8h"}]`, false},
+		{`"pools": [{"name": "office", "address": "10.91.0.1/24", "leaseTTL": "-1m"}]`, true},
+		{`"pools": [{"name": "office", "address": "10.91.0.1/24", "leaseTTL": "30m", "leaseRenewInterval": "1h"}]`, true},
+		{`"dnsRoutes": [{"domains": ["corp.example.com"], "servers": ["10.90.0.2", "fd00::2"], "scopes": ["wiresteward.full"]}]`, false},
+		{`"dnsRoutes": [{"domains": [], "servers": ["10.90.0.2"]}]`, true},
+		{`"dnsRoutes": [{"domains": ["~corp.example.com"], "servers": ["10.90.0.2"]}]`, true},
+		{`"dnsRoutes": [{"domains": ["corp.example.com"], "servers": []}]`, true},
+		{`"dnsRoutes": [{"domains": ["corp.example.com"], "servers": ["foo"]}]`, true},
+	}
+	for _, tc := range testCases {
+		cfg := &serverConfig{}
+		input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthClientID": "id", "oauthIntrospectURL": "example.com", ` + tc.input + `}`
+		if err := json.Unmarshal([]byte(input), cfg); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyServerConfig(cfg)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+		}
+	}
+}
+
+func TestReadAgentConfig_YAML(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dir := t.TempDir()
+	jsonConfig := `{
+  "oauth": {"clientID": "xxxxx", "authUrl": "example.com/auth", "tokenUrl": "example.com/token"},
+  "devices": [
+    {"name": "wg_test", "mtu": 1380, "type": "wireguard", "renewJitter": "1m", "peers": [{"url": "https://example1.com", "persistentKeepaliveInterval": "10s"}]},
+    {"name": "wg_test2", "peers": [{"url": "https://example2.com", "extra": {"site": "london"}}]}
+  ]
+}`
+	yamlConfig := `
+oauth:
+  clientID: xxxxx
+  authUrl: example.com/auth
+  tokenUrl: example.com/token
+devices:
+  - name: wg_test
+    mtu: 1380
+    type: wireguard
+    renewJitter: 1m
+    peers:
+      - url: https://example1.com
+        persistentKeepaliveInterval: 10s
+  - name: wg_test2
+    peers:
+      - url: https://example2.com
+        extra:
+          site: london
+`
+	for name, content := range map[string]string{"config.json": jsonConfig, "config.yaml": yamlConfig} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := readAgentConfig(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := readAgentConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, conf)
+	assert.Equal(t, "wireguard", conf.Devices[0].Type)
+	assert.Equal(t, 10*time.Second, conf.Devices[0].Peers[0].PersistentKeepaliveInterval.Duration)
+
+	if err := os.WriteFile(filepath.Join(dir, "invalid.yaml"), []byte("devices:\n  - name: wg_test\n    type: bridge\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = readAgentConfig(filepath.Join(dir, "invalid.yaml"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// configCheckTimeout bounds the requests polling servers for changes to their
+// advertised settings.
+const configCheckTimeout = 10 * time.Second
+
+// configCheckLoop polls the server of the current lease every interval, and
+// renews the lease once the settings it advertises change, so that routes
+// follow changes to the allowed IPs of the server without waiting for the
+// next renewal.
+func (dm *DeviceManager) configCheckLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if dm.configChanged() {
+				dm.triggerRenewal()
+			}
+		case <-dm.stop:
+			return
+		}
+	}
+}
+
+// configChanged returns whether the server of the current lease advertises a
+// different version of its settings than the lease was granted with. Servers
+// that do not version their settings are never polled.
+func (dm *DeviceManager) configChanged() bool {
+	dm.configMutex.Lock()
+	if dm.config == nil || dm.config.ConfigVersion == "" {
+		dm.configMutex.Unlock()
+		return false
+	}
+	serverURL, version := dm.config.ServerURL, dm.config.ConfigVersion
+	dm.configMutex.Unlock()
+
+	for _, s := range dm.serverList() {
+		if s.URL != serverURL {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), configCheckTimeout)
+		defer cancel()
+		resp, err := dm.bypassFullTunnel(s).leaseClient().Config(ctx)
+		if err != nil {
+			dm.logger.Debug.Printf("Cannot check config of server %s: %v", serverURL, err)
+			return false
+		}
+		if resp.Version != version {
+			dm.logger.Info.Printf("Config of server %s changed, renewing lease for device %s", serverURL, dm.Name())
+			return true
+		}
+		return false
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/wiresteward/client"
+)
+
+func TestDeviceManager_ConfigChanged(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	version := "v1"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, client.ConfigPath, r.URL.Path)
+		json.NewEncoder(w).Encode(&client.ConfigResponse{Version: version})
+	}))
+	defer ts.Close()
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", Peers: []agentPeerConfig{{URL: ts.URL}}}, "")
+
+	// Nothing to compare before a lease is granted, or if the server does
+	// not version its settings
+	assert.False(t, dm.configChanged())
+	dm.config = &WirestewardPeerConfig{ServerURL: ts.URL}
+	assert.False(t, dm.configChanged())
+
+	dm.config.ConfigVersion = "v1"
+	assert.False(t, dm.configChanged())
+	version = "v2"
+	assert.True(t, dm.configChanged())
+
+	// Servers that are no longer listed are not polled
+	dm.config.ServerURL = "https://removed.example.com"
+	assert.False(t, dm.configChanged())
+}
+
+func TestHTTPLeaseHandler_ConfigVersion(t *testing.T) {
+	cfg := &serverConfig{AllowedIPs: []string{"10.0.0.0/8"}, DNSServers: []string{"10.0.0.53"}}
+	lh := &HTTPLeaseHandler{serverConfig: cfg}
+	get := func() string {
+		w := httptest.NewRecorder()
+		lh.configVersion(w, httptest.NewRequest("GET", client.ConfigPath, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		resp := &client.ConfigResponse{}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+		return resp.Version
+	}
+	v1 := get()
+	assert.NotEmpty(t, v1)
+	assert.Equal(t, v1, get())
+
+	cfg.AllowedIPs = []string{"10.0.0.0/8", "172.16.0.0/12"}
+	assert.NotEqual(t, v1, get())
+	// Settings that are not advertised do not change the version
+	v2 := get()
+	cfg.LeaseTTL = 1
+	assert.Equal(t, v2, get())
+}
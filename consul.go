@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultConsulAddress   = "http://127.0.0.1:8500"
+	defaultConsulLeasesKey = "wiresteward/leases"
+	consulRequestTimeout   = 10 * time.Second
+)
+
+// consulLeaseStore stores leases under a key of the Consul KV store, in the
+// format of the leases file. Leases are versioned by the modify index of the
+// key, and saved with check-and-set, so that it can be shared by servers.
+type consulLeaseStore struct {
+	client *http.Client
+	key    string
+	token  string
+	url    *url.URL
+}
+
+func newConsulLeaseStore(cfg *serverConsulConfig) (*consulLeaseStore, error) {
+	u, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	s := &consulLeaseStore{
+		client: &http.Client{Timeout: consulRequestTimeout},
+		key:    cfg.Key,
+		url:    u,
+	}
+	if cfg.TokenFilename != "" {
+		d, err := os.ReadFile(cfg.TokenFilename)
+		if err != nil {
+			return nil, err
+		}
+		s.token = strings.TrimSpace(string(d))
+	}
+	logger.Info.Printf("storing leases in consul key %s at %s", s.key, u.Redacted())
+	return s, nil
+}
+
+// kvURL returns the url of the key, with query.
+func (s *consulLeaseStore) kvURL(query url.Values) string {
+	u := *s.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/kv/" + s.key
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (s *consulLeaseStore) do(method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	return s.client.Do(req)
+}
+
+// load implements leaseStore.
+func (s *consulLeaseStore) load() ([]storedLease, error) {
+	leases, _, err := s.loadVersion()
+	return leases, err
+}
+
+// save implements leaseStore, overwriting the leases whatever their version.
+func (s *consulLeaseStore) save(leases []storedLease) error {
+	return s.put(leases, url.Values{})
+}
+
+// loadVersion implements sharedLeaseStore. A missing key holds no leases, at
+// version 0.
+func (s *consulLeaseStore) loadVersion() ([]storedLease, uint64, error) {
+	resp, err := s.do(http.MethodGet, s.kvURL(url.Values{}), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("cannot get consul key %s: %s", s.key, resp.Status)
+	}
+	var pairs []struct {
+		ModifyIndex uint64
+		// Value is decoded from base64
+		Value []byte
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, 0, fmt.Errorf("cannot decode consul key %s: %w", s.key, err)
+	}
+	if len(pairs) != 1 {
+		return nil, 0, fmt.Errorf("expected one value for consul key %s, got %d", s.key, len(pairs))
+	}
+	leases, err := parseLeases(bytes.NewReader(pairs[0].Value))
+	if err != nil {
+		return nil, 0, err
+	}
+	return leases, pairs[0].ModifyIndex, nil
+}
+
+// saveVersion implements sharedLeaseStore.
+func (s *consulLeaseStore) saveVersion(leases []storedLease, version uint64) error {
+	return s.put(leases, url.Values{"cas": {strconv.FormatUint(version, 10)}})
+}
+
+// put writes leases to the key. With a cas query, consul responds false
+// instead of writing if the key was modified since.
+func (s *consulLeaseStore) put(leases []storedLease, query url.Values) error {
+	var buf bytes.Buffer
+	if err := writeLeases(&buf, leases); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPut, s.kvURL(query), buf.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot put consul key %s: %s: %s", s.key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if strings.TrimSpace(string(body)) != "true" {
+		return errLeaseStoreConflict
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestConsul returns a server implementing the get and put requests of the
+// Consul KV API.
+func newTestConsul(t *testing.T, token string) *httptest.Server {
+	var mutex sync.Mutex
+	values := map[string][]byte{}
+	indexes := map[string]uint64{}
+	var index uint64
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Header.Get("X-Consul-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		key := r.URL.Path[len("/v1/kv/"):]
+		switch r.Method {
+		case http.MethodGet:
+			if _, ok := values[key]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode([]map[string]interface{}{{"Key": key, "ModifyIndex": indexes[key], "Value": values[key]}})
+		case http.MethodPut:
+			if cas := r.URL.Query().Get("cas"); cas != "" {
+				if v, _ := strconv.ParseUint(cas, 10, 64); v != indexes[key] {
+					w.Write([]byte("false"))
+					return
+				}
+			}
+			body, _ := io.ReadAll(r.Body)
+			index++
+			values[key] = body
+			indexes[key] = index
+			w.Write([]byte("true"))
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestConsulLeaseStore(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	consul := newTestConsul(t, "")
+	store, err := newConsulLeaseStore(&serverConsulConfig{Address: consul.URL, Key: defaultConsulLeasesKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A missing key holds no leases
+	leases, version, err := store.loadVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(leases))
+	assert.Equal(t, uint64(0), version)
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	saved := []storedLease{{Username: "test@example.com", Record: WgRecord{PubKey: validPublicKey, IP: net.ParseIP("10.90.0.2"), expires: expires}}}
+	assert.NoError(t, store.saveVersion(saved, version))
+	leases, version, err = store.loadVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(leases))
+	assert.Equal(t, saved[0].Record.String(), leases[0].Record.String())
+
+	// Leases changed since they were loaded are not overwritten
+	assert.NoError(t, store.save(nil))
+	err = store.saveVersion(saved, version)
+	assert.True(t, errors.Is(err, errLeaseStoreConflict))
+}
+
+func TestConsulLeaseStore_Token(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	consul := newTestConsul(t, "secret")
+	filename := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(filename, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newConsulLeaseStore(&serverConsulConfig{Address: consul.URL, Key: defaultConsulLeasesKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.load()
+	assert.Error(t, err)
+	store, err = newConsulLeaseStore(&serverConsulConfig{Address: consul.URL, Key: defaultConsulLeasesKey, TokenFilename: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.load()
+	assert.NoError(t, err)
+}
+
+func TestFileLeaseManager_SharedStore(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	consul := newTestConsul(t, "")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	newLeaseManager := func() *FileLeaseManager {
+		store, err := newConsulLeaseStore(&serverConsulConfig{Address: consul.URL, Key: defaultConsulLeasesKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lm := &FileLeaseManager{cidr: network, ip: ip, store: store}
+		if err := lm.loadWgRecords(); err != nil {
+			t.Fatal(err)
+		}
+		return lm
+	}
+	lm1, lm2 := newLeaseManager(), newLeaseManager()
+	expiry := time.Now().Add(time.Hour)
+	lease := func(lm *FileLeaseManager, username string, concurrently func()) WgRecord {
+		var record WgRecord
+		_, err := lm.updateLeases(func() (bool, error) {
+			if concurrently != nil {
+				concurrently()
+				concurrently = nil
+			}
+			var err error
+			record, err = lm.createOrUpdatePeer(username, &leaseRequest{PubKey: newWgKey().String()}, expiry)
+			return true, err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record
+	}
+
+	// Servers see the leases of each other
+	assert.Equal(t, "10.90.0.2", lease(lm1, "alice@example.com", nil).IP.String())
+	assert.Equal(t, "10.90.0.3", lease(lm2, "bob@example.com", nil).IP.String())
+
+	// A lease granted by another server in the meantime is not overwritten,
+	// and its address is not leased twice
+	var carol WgRecord
+	dave := lease(lm2, "dave@example.com", func() {
+		carol = lease(lm1, "carol@example.com", nil)
+	})
+	assert.Equal(t, "10.90.0.4", carol.IP.String())
+	assert.Equal(t, "10.90.0.5", dave.IP.String())
+	if _, err := lm1.updateLeases(func() (bool, error) { return false, nil }); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, len(lm1.leases()))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// controlTimeout bounds the requests of the control commands to the agent.
+const controlTimeout = time.Minute
+
+// serveControlSocket accepts the control commands on the unix socket at path.
+// Commands change the tunnels of every user, so the socket is only accessible
+// to the user running the agent and the control group.
+func (a *Agent) serveControlSocket(path, group string) {
+	listener, err := listenUnixSocket(path, 0660, group)
+	if err != nil {
+		logger.Error.Printf("Cannot listen on control socket: %v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/up", a.upHandler)
+	mux.HandleFunc("/down", a.downHandler)
+	mux.HandleFunc("/renew", a.controlRenewHandler)
+	mux.HandleFunc("/reload", a.reloadHandler)
+	logger.Info.Printf("Accepting agent commands at %s", path)
+	if err := http.Serve(listener, mux); err != nil {
+		logger.Error.Printf("Agent control server failed: %v", err)
+	}
+}
+
+// bondedDevices returns the names of the devices that are part of a bond.
+func (a *Agent) bondedDevices() map[string]bool {
+	bonded := map[string]bool{}
+	for _, b := range a.config.Bonds {
+		for _, name := range b.Devices {
+			bonded[name] = true
+		}
+	}
+	return bonded
+}
+
+// selectDevices returns the configs of the devices named, or of every device
+// if names is empty. It must be called with reloadMutex held.
+func (a *Agent) selectDevices(names []string) ([]agentDeviceConfig, error) {
+	if len(names) == 0 {
+		return a.config.Devices, nil
+	}
+	known := map[string]agentDeviceConfig{}
+	for _, dev := range a.config.Devices {
+		known[dev.Name] = dev
+	}
+	selected := []agentDeviceConfig{}
+	for _, name := range names {
+		dev, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown device %s", name)
+		}
+		selected = append(selected, dev)
+	}
+	return selected, nil
+}
+
+// down stops the devices named, or every device if names is empty, and keeps
+// them stopped across reloads until they are brought up again. It returns the
+// devices that were stopped.
+func (a *Agent) down(names []string) ([]string, error) {
+	a.reloadMutex.Lock()
+	defer a.reloadMutex.Unlock()
+	selected, err := a.selectDevices(names)
+	if err != nil {
+		return nil, err
+	}
+	bonded := a.bondedDevices()
+	for _, dev := range selected {
+		if bonded[dev.Name] {
+			return nil, fmt.Errorf("device %s is part of a bond and cannot be brought down", dev.Name)
+		}
+	}
+	if a.downDevices == nil {
+		a.downDevices = map[string]bool{}
+	}
+	stopped := []string{}
+	for _, dev := range selected {
+		if a.downDevices[dev.Name] {
+			continue
+		}
+		for _, dm := range a.devices() {
+			if dm.Name() == dev.Name {
+				logger.Info.Printf("Bringing down device %s", dev.Name)
+				dm.Stop()
+			}
+		}
+		a.downDevices[dev.Name] = true
+		stopped = append(stopped, dev.Name)
+	}
+	a.deviceManagersMutex.Lock()
+	running := []*DeviceManager{}
+	for _, dm := range a.deviceManagers {
+		if !a.downDevices[dm.Name()] {
+			running = append(running, dm)
+		}
+	}
+	a.deviceManagers = running
+	a.deviceManagersMutex.Unlock()
+	return stopped, nil
+}
+
+// up starts the devices named, or every device if names is empty, that were
+// brought down and requests their leases. It returns the devices that were
+// started.
+func (a *Agent) up(names []string) ([]string, error) {
+	a.reloadMutex.Lock()
+	defer a.reloadMutex.Unlock()
+	selected, err := a.selectDevices(names)
+	if err != nil {
+		return nil, err
+	}
+	running := map[string]*DeviceManager{}
+	for _, dm := range a.devices() {
+		running[dm.Name()] = dm
+	}
+	token, tokenErr := a.tokens.get()
+	if tokenErr != nil {
+		logger.Warn.Printf("Cannot get a token for the devices brought up, they will be configured after authenticating: %v", tokenErr)
+	}
+	started := []string{}
+	for _, dev := range selected {
+		if !a.downDevices[dev.Name] {
+			continue
+		}
+		logger.Info.Printf("Bringing up device %s", dev.Name)
+		dm, startErr := a.startDevice(dev)
+		if startErr != nil {
+			err = fmt.Errorf("cannot start device %s: %w", dev.Name, startErr)
+			break
+		}
+		delete(a.downDevices, dev.Name)
+		running[dev.Name] = dm
+		started = append(started, dev.Name)
+		if token != "" {
+			go dm.RenewTokenAndLease(token)
+		}
+	}
+	deviceManagers := []*DeviceManager{}
+	for _, dev := range a.config.Devices {
+		if dm, ok := running[dev.Name]; ok {
+			deviceManagers = append(deviceManagers, dm)
+		}
+	}
+	a.deviceManagersMutex.Lock()
+	a.deviceManagers = deviceManagers
+	a.deviceManagersMutex.Unlock()
+	return started, err
+}
+
+func (a *Agent) upHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST method is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	started, err := a.up(r.Form["device"])
+	msg := ""
+	for _, name := range started {
+		msg += fmt.Sprintf("device %s is up\n", name)
+	}
+	if err != nil {
+		http.Error(w, msg+err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprint(w, msg)
+	if len(started) == 0 {
+		fmt.Fprintln(w, "no devices were down")
+	}
+}
+
+func (a *Agent) downHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST method is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	stopped, err := a.down(r.Form["device"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, name := range stopped {
+		fmt.Fprintf(w, "device %s is down\n", name)
+	}
+	if len(stopped) == 0 {
+		fmt.Fprintln(w, "no devices were up")
+	}
+}
+
+// controlRenewHandler renews the leases of every device with the cached
+// token. Unlike the renew endpoint of the agent address, it cannot
+// authenticate the user in a browser.
+func (a *Agent) controlRenewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST method is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	token, err := a.tokens.get()
+	if err == nil && token == "" {
+		err = fmt.Errorf("empty token")
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("no valid token, authenticate at http://%s/renew: %v", *flagAgentAddress, err), http.StatusConflict)
+		return
+	}
+	a.renewAllLeases(token)
+	fmt.Fprintln(w, "renewing leases")
+}
+
+// controlCommand implements `wiresteward up|down|renew|reload`, sending the
+// command to the agent listening on the -agent-control-socket. Devices can be
+// named after up and down, every device is affected otherwise.
+func controlCommand(command string, devices []string) {
+	if (command == "renew" || command == "reload") && len(devices) > 0 {
+		fmt.Fprintf(os.Stderr, "%s does not accept devices\n", command)
+		os.Exit(2)
+	}
+	form := url.Values{"device": devices}
+	resp, err := unixSocketClient(*flagAgentControlSocket, controlTimeout).PostForm("http://agent/"+command, form)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot send %s to the agent at %s: %v\n", command, *flagAgentControlSocket, err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprint(os.Stderr, string(body))
+		os.Exit(1)
+	}
+	fmt.Print(string(body))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgent_UpDown(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	cfg := &agentConfig{
+		Devices: []agentDeviceConfig{{Name: "wg_a"}, {Name: "wg_b"}, {Name: "wg_c"}},
+		Bonds:   []agentBondConfig{{Name: "bond", Devices: []string{"wg_c", "wg_d"}}},
+	}
+	a := &Agent{
+		config: cfg,
+		tokens: newTokenCache(func(bool) (string, error) { return "", fmt.Errorf("no token") }, 0),
+	}
+	for _, dev := range cfg.Devices {
+		dm := newDeviceManager(dev, "")
+		dm.agentDevice = &fakeAgentDevice{name: dev.Name}
+		a.deviceManagers = append(a.deviceManagers, dm)
+	}
+	names := func() []string {
+		n := []string{}
+		for _, dm := range a.devices() {
+			n = append(n, dm.Name())
+		}
+		return n
+	}
+
+	_, err := a.down([]string{"wg_x"})
+	assert.Error(t, err)
+	_, err = a.down([]string{"wg_c"})
+	assert.Error(t, err)
+
+	// Bond members cannot be brought down, not even along with every device
+	_, err = a.down(nil)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"wg_a", "wg_b", "wg_c"}, names())
+
+	req := httptest.NewRequest("POST", "/down", strings.NewReader(url.Values{"device": {"wg_a"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	a.downHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "device wg_a is down\n", w.Body.String())
+	assert.Equal(t, []string{"wg_b", "wg_c"}, names())
+
+	stopped, err := a.down([]string{"wg_a"})
+	assert.NoError(t, err)
+	assert.Empty(t, stopped)
+
+	// Devices that are down stay down when their config changes
+	a.reload(&agentConfig{
+		Devices: []agentDeviceConfig{{Name: "wg_a", MTU: 1380}, {Name: "wg_b"}, {Name: "wg_c"}},
+		Bonds:   cfg.Bonds,
+	})
+	assert.Equal(t, []string{"wg_b", "wg_c"}, names())
+	assert.True(t, a.downDevices["wg_a"])
+
+	// Only devices that are down are brought up
+	started, err := a.up([]string{"wg_b"})
+	assert.NoError(t, err)
+	assert.Empty(t, started)
+	_, err = a.up([]string{"wg_x"})
+	assert.Error(t, err)
+
+	// and removed devices are forgotten
+	a.reload(&agentConfig{
+		Devices: []agentDeviceConfig{{Name: "wg_b"}, {Name: "wg_c"}},
+		Bonds:   cfg.Bonds,
+	})
+	assert.Empty(t, a.downDevices)
+}
@@ -0,0 +1,43 @@
+// +build darwin
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// openBrowser opens url in the default browser.
+func openBrowser(url string) error {
+	return exec.Command("open", url).Start()
+}
+
+// osKeyring stores secrets in the login keychain, via security.
+type osKeyring struct{}
+
+func newOSKeyring() secretStore {
+	return osKeyring{}
+}
+
+func (osKeyring) get(account string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", keyringService, "-a", account, "-w").Output()
+	var exitErr *exec.ExitError
+	// security exits with 44 if the item cannot be found
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 44 {
+		return "", errSecretNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("security find-generic-password: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (osKeyring) set(account, secret string) error {
+	// The command is read from stdin, and the secret hex encoded, so that
+	// it does not show in the arguments of the process
+	cmd := fmt.Sprintf("add-generic-password -U -s %s -a %q -X %s\n", keyringService, account, hex.EncodeToString([]byte(secret)))
+	return runCommand(cmd, "security", "-i")
+}
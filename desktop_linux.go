@@ -0,0 +1,42 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// openBrowser opens url in the default browser of the desktop session.
+func openBrowser(url string) error {
+	return exec.Command("xdg-open", url).Start()
+}
+
+// osKeyring stores secrets in the Secret Service of the desktop session, eg.
+// GNOME Keyring or KWallet, via secret-tool.
+type osKeyring struct{}
+
+func newOSKeyring() secretStore {
+	return osKeyring{}
+}
+
+func (osKeyring) get(account string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", keyringService, "account", account).Output()
+	var exitErr *exec.ExitError
+	// secret-tool exits with 1 and no output if there is no secret
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && len(out) == 0 {
+		return "", errSecretNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("secret-tool lookup: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (osKeyring) set(account, secret string) error {
+	// The secret is read from stdin, so that it does not show in the
+	// arguments of the process
+	return runCommand(secret, "secret-tool", "store", "--label=wiresteward "+account, "service", keyringService, "account", account)
+}
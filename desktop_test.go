@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestAgentConfig_TokenStore(t *testing.T) {
+	for _, tc := range []struct {
+		oauth agentOAuthConfig
+		err   bool
+	}{
+		{agentOAuthConfig{TokenStore: secretStoreKeyring, OpenBrowser: true}, false},
+		{agentOAuthConfig{TokenStore: secretStoreFile}, false},
+		{agentOAuthConfig{TokenStore: "vault"}, true},
+		{agentOAuthConfig{OpenBrowser: true, AuthURL: "", DeviceAuthURL: "https://login.example.com/device"}, true},
+	} {
+		conf := &agentConfig{OAuth: tc.oauth}
+		conf.OAuth.ClientID = "client"
+		conf.OAuth.TokenURL = "https://login.example.com/token"
+		if tc.oauth.DeviceAuthURL == "" {
+			conf.OAuth.AuthURL = "https://login.example.com/authorize"
+		}
+		err := verifyAgentOAuthConfig(conf)
+		if tc.err {
+			assert.Error(t, err, fmt.Sprintf("%+v", tc.oauth))
+		} else {
+			assert.NoError(t, err, fmt.Sprintf("%+v", tc.oauth))
+		}
+	}
+}
+
+func TestOAuthTokenHandler_Keyring(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	tokFile := filepath.Join(t.TempDir(), "token")
+	keyring := fakeSecretStore{}
+	oa := newOAuthTokenHandler("", "https://login.example.com/token", "", "client", tokFile)
+	oa.tokenStore = keyring
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	assert.NoError(t, oa.saveToken(&oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: expiry}))
+
+	// The refresh token is only stored in the keyring
+	assert.Equal(t, fakeSecretStore{"client": "refresh"}, keyring)
+	d, err := os.ReadFile(tokFile)
+	assert.NoError(t, err)
+	assert.False(t, strings.Contains(string(d), "refresh"))
+
+	tok, err := oa.getTokenFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, "access", tok.AccessToken)
+	assert.Equal(t, "refresh", tok.RefreshToken)
+	assert.True(t, expiry.Equal(tok.Expiry))
+
+	// Tokens without a refresh token leave the keyring alone
+	delete(keyring, "client")
+	assert.NoError(t, oa.saveToken(&oauth2.Token{AccessToken: "other"}))
+	tok, err = oa.getTokenFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, "", tok.RefreshToken)
+}
+
+func TestOAuthTokenHandler_WebFlow(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	var verifier string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "authorization_code", r.FormValue("grant_type"))
+		assert.Equal(t, "code", r.FormValue("code"))
+		verifier = r.FormValue("code_verifier")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"access","token_type":"Bearer","refresh_token":"refresh","expires_in":3600}`)
+	}))
+	defer ts.Close()
+	keyring := fakeSecretStore{}
+	oa := newOAuthTokenHandler(ts.URL+"/authorize", ts.URL+"/token", "", "client", filepath.Join(t.TempDir(), "token"))
+	oa.tokenStore = keyring
+
+	_, err := oa.ExchangeToken("", "code")
+	assert.Error(t, err)
+
+	authURL, err := oa.prepareTokenWebChalenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+	assert.NotEqual(t, "", q.Get("code_challenge"))
+
+	// Callbacks have to carry the state of the challenge
+	_, err = oa.ExchangeToken("state-token", "code")
+	assert.Error(t, err)
+	tok, err := oa.ExchangeToken(q.Get("state"), "code")
+	assert.NoError(t, err)
+	assert.Equal(t, "access", tok.AccessToken)
+	assert.Equal(t, string(oa.codeVerifier.value), verifier)
+	assert.Equal(t, fakeSecretStore{"client": "refresh"}, keyring)
+}
@@ -0,0 +1,87 @@
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// openBrowser opens url in the default browser.
+func openBrowser(url string) error {
+	return windows.ShellExecute(0, nil, windows.StringToUTF16Ptr(url), nil, nil, windows.SW_SHOWNORMAL)
+}
+
+var (
+	advapi32        = windows.NewLazySystemDLL("advapi32.dll")
+	procCredReadW   = advapi32.NewProc("CredReadW")
+	procCredWriteW  = advapi32.NewProc("CredWriteW")
+	procCredFree    = advapi32.NewProc("CredFree")
+	credTypeGeneric = uint32(1)
+	// credPersistLocalMachine keeps credentials across logons, on this
+	// machine only
+	credPersistLocalMachine = uint32(2)
+)
+
+// credential is the CREDENTIALW structure of the Credential Manager.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        windows.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// osKeyring stores secrets in the Windows Credential Manager.
+type osKeyring struct{}
+
+func newOSKeyring() secretStore {
+	return osKeyring{}
+}
+
+func credentialTarget(account string) *uint16 {
+	return windows.StringToUTF16Ptr(keyringService + ":" + account)
+}
+
+func (osKeyring) get(account string) (string, error) {
+	var cred *credential
+	r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(credentialTarget(account))), uintptr(credTypeGeneric), 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		if errors.Is(err, windows.ERROR_NOT_FOUND) {
+			return "", errSecretNotFound
+		}
+		return "", fmt.Errorf("CredRead: %w", err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	blob := (*[1 << 20]byte)(unsafe.Pointer(cred.CredentialBlob))[:cred.CredentialBlobSize:cred.CredentialBlobSize]
+	return string(blob), nil
+}
+
+func (osKeyring) set(account, secret string) error {
+	blob := []byte(secret)
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         credentialTarget(account),
+		CredentialBlobSize: uint32(len(blob)),
+		Persist:            credPersistLocalMachine,
+		UserName:           windows.StringToUTF16Ptr(account),
+	}
+	if len(blob) > 0 {
+		cred.CredentialBlob = &blob[0]
+	}
+	r, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(&cred)), 0)
+	if r == 0 {
+		return fmt.Errorf("CredWrite: %w", err)
+	}
+	return nil
+}
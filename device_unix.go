@@ -0,0 +1,623 @@
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// listenUAPI opens the UAPI socket file of the named device and listens on it.
+func listenUAPI(name string) (net.Listener, *os.File, error) {
+	uapiSocket, err := ipc.UAPIOpen(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to open uapi socket file: %v", err)
+	}
+	uapi, err := ipc.UAPIListen(name, uapiSocket)
+	if err != nil {
+		uapiSocket.Close()
+		return nil, nil, fmt.Errorf("Failed to listen on uapi socket: %v", err)
+	}
+	return uapi, uapiSocket, nil
+}
+
+// WireguardDevice represents a kernel space wireguard network device on the
+// system. This is utilised by the agent-side wiresteward, to provide a native
+// device on linux systems with kernel support for wireguard.
+type WireguardDevice struct {
+	// adopt allows using a device that already exists, which is then left
+	// in place when stopped
+	adopt   bool
+	adopted bool
+	// keep leaves the device in place when stopped
+	keep       bool
+	deviceName string
+	link       netlink.Link
+	logger     *Logger
+	// userspace runs the device with wireguard-go when the kernel does not
+	// support wireguard, nil otherwise
+	userspace *TunDevice
+	// linkAdd creates the link, it is replaced in tests
+	linkAdd func(link netlink.Link) error
+}
+
+func newWireguardDevice(name string, mtu int) *WireguardDevice {
+	if mtu == 0 {
+		mtu = device.DefaultMTU
+	}
+	return &WireguardDevice{
+		deviceName: name,
+		link: &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{
+			MTU:    mtu,
+			Name:   name,
+			TxQLen: 1000,
+		}},
+		logger: newLogger("wireguard", "device", name),
+	}
+}
+
+// Name returns the name of the device.
+func (wd *WireguardDevice) Name() string {
+	return wd.deviceName
+}
+
+// Run creates the wireguard device. If the kernel does not support
+// wireguard, the device is run in userspace with wireguard-go instead.
+func (wd *WireguardDevice) Run() error {
+	linkAdd := wd.linkAdd
+	if linkAdd == nil {
+		h := netlink.Handle{}
+		defer h.Delete()
+		linkAdd = h.LinkAdd
+	}
+	if err := linkAdd(wd.link); err != nil {
+		if wd.adopt && errors.Is(err, unix.EEXIST) {
+			wd.logger.Info.Println("Adopting existing device")
+			wd.adopted = true
+			return nil
+		}
+		if isWireguardUnsupported(err) {
+			wd.logger.Warn.Printf("Kernel does not support wireguard (%v), running the device in userspace", err)
+			if wd.keep {
+				wd.logger.Warn.Println("Userspace devices do not outlive the agent, ignoring keepDevice")
+			}
+			wd.userspace = newTunDevice(wd.deviceName, wd.link.Attrs().MTU)
+			return wd.userspace.Run()
+		}
+		return err
+	}
+	return nil
+}
+
+// isWireguardUnsupported returns whether err, returned when creating a
+// wireguard link, means that the kernel lacks wireguard support.
+func isWireguardUnsupported(err error) bool {
+	return errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, netlink.ErrNotImplemented)
+}
+
+// Stop will stop the device and cleanup underlying resources.
+func (wd *WireguardDevice) Stop() {
+	if wd.userspace != nil {
+		wd.userspace.Stop()
+		wd.userspace = nil
+		return
+	}
+	if wd.link == nil || wd.adopted || wd.keep {
+		return
+	}
+	h := netlink.Handle{}
+	defer h.Delete()
+	if err := h.LinkSetDown(wd.link); err != nil {
+		wd.logger.Error.Println(err)
+	}
+	if err := h.LinkDel(wd.link); err != nil {
+		wd.logger.Error.Println(err)
+	}
+}
+
+// ServerDevice represents a wireguard network device on the system, setup
+// for use with kernel space wireguard. This is utilised by the server-side
+// wiresteward.
+type ServerDevice struct {
+	deviceAddress netlink.Addr
+	deviceMTU     int
+	iptablesRule  []string
+	keyFilename   string
+	link          netlink.Link
+	listenPort    int
+	// deviceAddress6 and ip6tablesRule are set if IPv6 addresses are
+	// leased
+	deviceAddress6 *netlink.Addr
+	ip6tablesRule  []string
+	// poolAddresses and poolRules are the addresses and masquerading
+	// rules of the address pools
+	poolAddresses []netlink.Addr
+	poolRules     [][]string
+	// forwardChain is set once the chain limiting the traffic forwarded
+	// from peers is installed
+	forwardChain bool
+	// upstreamInterfaces limit masquerading to traffic leaving through
+	// them. If forward is set, forwarding is enabled and the traffic
+	// forwarded between them and peers accepted, previousSysctls holds
+	// the values restored when the device is stopped
+	upstreamInterfaces []string
+	forward            bool
+	previousSysctls    map[string]string
+	// keyStore and encryptedStore configure where the private key is
+	// kept, if not in keyFilename
+	keyStore       string
+	encryptedStore *encryptedStoreConfig
+}
+
+func newServerDevice(cfg *serverConfig) *ServerDevice {
+	link := &netlink.Wireguard{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:   cfg.DeviceName,
+			TxQLen: 1000,
+		},
+	}
+	// Traffic to the networks of groups is masqueraded as well
+	groupIPs := cfg.groupNetworkIPs()
+	allowedIPs, allowedIPs6 := splitIPFamilies(append(append([]string{}, cfg.AllowedIPs...), groupIPs...))
+	sd := &ServerDevice{
+		deviceAddress: netlink.Addr{
+			IPNet: &net.IPNet{
+				IP:   cfg.WireguardIPAddress,
+				Mask: cfg.WireguardIPNetwork.Mask,
+			},
+		},
+		deviceMTU: cfg.DeviceMTU,
+		iptablesRule: []string{
+			"-s", cfg.WireguardIPNetwork.String(),
+			"-d", strings.Join(allowedIPs, ","),
+			"-j", "MASQUERADE",
+		},
+		keyFilename:    cfg.KeyFilename,
+		link:           link,
+		listenPort:     cfg.WireguardListenPort,
+		keyStore:       cfg.KeyStore,
+		encryptedStore: cfg.EncryptedStore,
+	}
+	if cfg.NAT != nil {
+		sd.upstreamInterfaces = cfg.NAT.UpstreamInterfaces
+		sd.forward = cfg.NAT.Forward
+	}
+	if cfg.WireguardIP6Network != nil {
+		sd.deviceAddress6 = &netlink.Addr{
+			IPNet: &net.IPNet{
+				IP:   cfg.WireguardIP6Address,
+				Mask: cfg.WireguardIP6Network.Mask,
+			},
+		}
+		sd.ip6tablesRule = []string{
+			"-s", cfg.WireguardIP6Network.String(),
+			"-d", strings.Join(allowedIPs6, ","),
+			"-j", "MASQUERADE",
+		}
+	}
+	for _, p := range cfg.Pools {
+		sd.poolAddresses = append(sd.poolAddresses, netlink.Addr{
+			IPNet: &net.IPNet{IP: p.ip, Mask: p.network.Mask},
+		})
+		poolAllowedIPs, _ := splitIPFamilies(append(append([]string{}, p.AllowedIPs...), groupIPs...))
+		sd.poolRules = append(sd.poolRules, []string{
+			"-s", p.network.String(),
+			"-d", strings.Join(poolAllowedIPs, ","),
+			"-j", "MASQUERADE",
+		})
+	}
+	return sd
+}
+
+// Start will create and setup the wireguard device.
+func (sd *ServerDevice) Start() error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return err
+	}
+	for _, rule := range sd.masqueradeRules() {
+		logger.Info.Printf("Adding iptables rule %v", rule)
+		if err := ipt.AppendUnique("nat", "POSTROUTING", rule...); err != nil {
+			return err
+		}
+	}
+	if sd.forward {
+		for _, rule := range natForwardRules(sd.link.Attrs().Name, sd.upstreamInterfaces) {
+			logger.Info.Printf("Adding iptables forward rule %v", rule)
+			if err := ipt.AppendUnique("filter", "FORWARD", rule...); err != nil {
+				return err
+			}
+		}
+	}
+	if sd.ip6tablesRule != nil {
+		ip6t, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+		if err != nil {
+			return err
+		}
+		for _, rule := range upstreamRules(sd.ip6tablesRule, sd.upstreamInterfaces) {
+			logger.Info.Printf("Adding ip6tables rule %v", rule)
+			if err := ip6t.AppendUnique("nat", "POSTROUTING", rule...); err != nil {
+				return err
+			}
+		}
+		if sd.forward {
+			for _, rule := range natForwardRules(sd.link.Attrs().Name, sd.upstreamInterfaces) {
+				logger.Info.Printf("Adding ip6tables forward rule %v", rule)
+				if err := ip6t.AppendUnique("filter", "FORWARD", rule...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if sd.forward {
+		previous, err := enableForwarding(sd.ip6tablesRule != nil)
+		sd.previousSysctls = previous
+		if err != nil {
+			return fmt.Errorf("cannot enable forwarding: %w", err)
+		}
+	}
+	h := netlink.Handle{}
+	defer h.Delete()
+	logger.Info.Printf(
+		"Creating device %s with address %s",
+		sd.link.Attrs().Name,
+		sd.deviceAddress,
+	)
+	if err := h.LinkAdd(sd.link); err != nil {
+		return err
+	}
+	if err := sd.ensureLinkIsUp(h); err != nil {
+		return err
+	}
+	if err := sd.configureWireguard(); err != nil {
+		return err
+	}
+	if err := h.AddrAdd(sd.link, &sd.deviceAddress); err != nil {
+		return err
+	}
+	if sd.deviceAddress6 != nil {
+		logger.Info.Printf("Adding address %s to device %s", sd.deviceAddress6, sd.link.Attrs().Name)
+		if err := h.AddrAdd(sd.link, sd.deviceAddress6); err != nil {
+			return err
+		}
+	}
+	for i := range sd.poolAddresses {
+		logger.Info.Printf("Adding address %s to device %s", sd.poolAddresses[i], sd.link.Attrs().Name)
+		if err := h.AddrAdd(sd.link, &sd.poolAddresses[i]); err != nil {
+			return err
+		}
+	}
+	mtu := sd.deviceMTU
+	if mtu <= 0 {
+		defaultMTU, err := sd.defaultMTU(h)
+		if err != nil {
+			logger.Error.Printf(
+				"Could not detect default MTU, defaulting to 1500: %v",
+				err,
+			)
+			defaultMTU = 1500
+		}
+		mtu = defaultMTU - 80
+	}
+	logger.Info.Printf(
+		"Setting MTU to %d on device %s", mtu, sd.link.Attrs().Name)
+	if err := h.LinkSetMTU(sd.link, mtu); err != nil {
+		return err
+	}
+	logger.Info.Printf("Initialised device %s", sd.link.Attrs().Name)
+	return nil
+}
+
+// Stop will cleanup and delete the wireguard device.
+func (sd *ServerDevice) Stop() error {
+	h := netlink.Handle{}
+	defer h.Delete()
+	if err := h.LinkSetDown(sd.link); err != nil {
+		return err
+	}
+	if err := h.LinkDel(sd.link); err != nil {
+		return err
+	}
+	ipt, err := iptables.New()
+	if err != nil {
+		return err
+	}
+	for _, rule := range sd.masqueradeRules() {
+		logger.Info.Printf("Removing iptables rule %v", rule)
+		if err := ipt.Delete("nat", "POSTROUTING", rule...); err != nil {
+			return err
+		}
+	}
+	if sd.forward {
+		for _, rule := range natForwardRules(sd.link.Attrs().Name, sd.upstreamInterfaces) {
+			logger.Info.Printf("Removing iptables forward rule %v", rule)
+			if err := ipt.Delete("filter", "FORWARD", rule...); err != nil {
+				return err
+			}
+		}
+	}
+	if sd.ip6tablesRule != nil {
+		ip6t, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+		if err != nil {
+			return err
+		}
+		for _, rule := range upstreamRules(sd.ip6tablesRule, sd.upstreamInterfaces) {
+			logger.Info.Printf("Removing ip6tables rule %v", rule)
+			if err := ip6t.Delete("nat", "POSTROUTING", rule...); err != nil {
+				return err
+			}
+		}
+		if sd.forward {
+			for _, rule := range natForwardRules(sd.link.Attrs().Name, sd.upstreamInterfaces) {
+				logger.Info.Printf("Removing ip6tables forward rule %v", rule)
+				if err := ip6t.Delete("filter", "FORWARD", rule...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := restoreSysctls(sd.previousSysctls); err != nil {
+		return err
+	}
+	if sd.forwardChain {
+		logger.Info.Printf("Removing iptables chains %v", serverForwardChains)
+		if err := removeChains(ipt, "filter", "FORWARD", serverForwardChains, sd.forwardMatch()); err != nil {
+			return err
+		}
+	}
+	logger.Info.Printf("Cleaned up device %s", sd.link.Attrs().Name)
+	return nil
+}
+
+// serverForwardChains alternately hold the rules that limit the traffic
+// forwarded from peers to the allowed IPs of their leases.
+var serverForwardChains = [2]string{"WIRESTEWARD-FORWARD", "WIRESTEWARD2-FORWARD"}
+
+// forwardMatch matches the traffic forwarded from the device.
+func (sd *ServerDevice) forwardMatch() []string {
+	return []string{"-i", sd.link.Attrs().Name}
+}
+
+// updateForwardRules replaces the rules of the forward chain with rules,
+// swapping in a chain that holds all of them, so that forwarded traffic is
+// never let through while they are replaced. The traffic forwarded from the
+// device is sent to the chain from the first time.
+func (sd *ServerDevice) updateForwardRules(rules [][]string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return err
+	}
+	if !sd.forwardChain {
+		logger.Info.Printf("Adding iptables chain for forwarded traffic")
+	}
+	if err := replaceChain(ipt, "filter", "FORWARD", serverForwardChains, sd.forwardMatch(), rules); err != nil {
+		return err
+	}
+	sd.forwardChain = true
+	logger.Info.Printf("Updated %d forward rules", len(rules))
+	return nil
+}
+
+// updateNetwork changes the network of the device address and the source
+// network of the masquerading rule to network. The old address and rule are
+// only removed once the new ones are in place.
+func (sd *ServerDevice) updateNetwork(network *net.IPNet) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return err
+	}
+	rule := append([]string{}, sd.iptablesRule...)
+	rule[1] = network.String()
+	for _, r := range upstreamRules(rule, sd.upstreamInterfaces) {
+		logger.Info.Printf("Adding iptables rule %v", r)
+		if err := ipt.AppendUnique("nat", "POSTROUTING", r...); err != nil {
+			return err
+		}
+	}
+	h := netlink.Handle{}
+	defer h.Delete()
+	address := netlink.Addr{
+		IPNet: &net.IPNet{IP: sd.deviceAddress.IP, Mask: network.Mask},
+	}
+	logger.Info.Printf("Replacing address %s with %s", sd.deviceAddress, address)
+	if err := h.AddrAdd(sd.link, &address); err != nil {
+		return err
+	}
+	if err := h.AddrDel(sd.link, &sd.deviceAddress); err != nil {
+		return err
+	}
+	sd.deviceAddress = address
+	for _, r := range upstreamRules(sd.iptablesRule, sd.upstreamInterfaces) {
+		logger.Info.Printf("Removing iptables rule %v", r)
+		if err := ipt.Delete("nat", "POSTROUTING", r...); err != nil {
+			logger.Error.Printf("Cannot remove old iptables rule: %v", err)
+		}
+	}
+	sd.iptablesRule = rule
+	return nil
+}
+
+// masqueradeRules returns the IPv4 masquerading rules of the device and the
+// address pools, limited to the upstream interfaces.
+func (sd *ServerDevice) masqueradeRules() [][]string {
+	rules := [][]string{}
+	for _, rule := range append([][]string{sd.iptablesRule}, sd.poolRules...) {
+		rules = append(rules, upstreamRules(rule, sd.upstreamInterfaces)...)
+	}
+	return rules
+}
+
+// privateKey returns the private key of the device, from the key store if
+// set or keyFilename otherwise. A new key is generated if there is none.
+func (sd *ServerDevice) privateKey() (wgtypes.Key, error) {
+	store, err := newSecretStore(sd.keyStore, sd.encryptedStore)
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+	if store != nil {
+		return sd.storedPrivateKey(store)
+	}
+	return sd.filePrivateKey()
+}
+
+// storedPrivateKey returns the private key of the device from store. The key
+// in keyFilename, if any, is imported the first time, so that switching to a
+// store keeps the public key of the server.
+func (sd *ServerDevice) storedPrivateKey(store secretStore) (wgtypes.Key, error) {
+	account := "server/" + sd.link.Attrs().Name
+	stored, err := store.get(account)
+	if err == nil {
+		return wgtypes.ParseKey(stored)
+	}
+	if !errors.Is(err, errSecretNotFound) {
+		return wgtypes.Key{}, err
+	}
+	var key wgtypes.Key
+	if kd, err := os.ReadFile(sd.keyFilename); err == nil {
+		if key, err = wgtypes.ParseKey(string(kd)); err != nil {
+			return wgtypes.Key{}, err
+		}
+		logger.Info.Printf("Importing key from %s into the key store, the file can be removed", sd.keyFilename)
+	} else if errors.Is(err, os.ErrNotExist) {
+		logger.Info.Printf("No key found in the key store, generating a new private key")
+		if key, err = wgtypes.GeneratePrivateKey(); err != nil {
+			return wgtypes.Key{}, err
+		}
+	} else {
+		return wgtypes.Key{}, err
+	}
+	if err := store.set(account, key.String()); err != nil {
+		return wgtypes.Key{}, err
+	}
+	return key, nil
+}
+
+func (sd *ServerDevice) filePrivateKey() (wgtypes.Key, error) {
+	kd, err := os.ReadFile(sd.keyFilename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			logger.Info.Printf(
+				"No key found in %s, generating a new private key",
+				sd.keyFilename,
+			)
+			keyDir := filepath.Dir(sd.keyFilename)
+			err := os.MkdirAll(keyDir, 0755)
+			if err != nil {
+				logger.Error.Printf(
+					"Unable to create directory=%s",
+					keyDir,
+				)
+				return wgtypes.Key{}, err
+			}
+			key, err := wgtypes.GeneratePrivateKey()
+			if err != nil {
+				return wgtypes.Key{}, err
+			}
+			if err := os.WriteFile(sd.keyFilename, []byte(key.String()), 0600); err != nil {
+				return wgtypes.Key{}, err
+			}
+			return key, nil
+		}
+		return wgtypes.Key{}, err
+	}
+	return wgtypes.ParseKey(string(kd))
+}
+
+func (sd *ServerDevice) configureWireguard() error {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := wg.Close(); err != nil {
+			logger.Error.Printf(
+				"Failed to close wireguard client: %v",
+				err,
+			)
+		}
+	}()
+	key, err := sd.privateKey()
+	if err != nil {
+		return err
+	}
+	logger.Info.Printf(
+		"Configuring wireguard on port %v with public key %s",
+		sd.listenPort,
+		key.PublicKey(),
+	)
+	return wg.ConfigureDevice(sd.link.Attrs().Name, wgtypes.Config{
+		PrivateKey: &key,
+		ListenPort: &sd.listenPort,
+	})
+}
+
+// defaultMTU returns the MTU of the default route or the respective device.
+func (sd *ServerDevice) defaultMTU(h netlink.Handle) (int, error) {
+	routes, err := h.RouteList(nil, unix.AF_INET)
+	if err != nil {
+		return -1, err
+	}
+	for _, r := range routes {
+		if r.Dst == nil {
+			if r.MTU > 0 {
+				return r.MTU, nil
+			}
+			link, err := h.LinkByIndex(r.LinkIndex)
+			if err != nil {
+				return -1, err
+			}
+			return link.Attrs().MTU, nil
+		}
+	}
+	return -1, fmt.Errorf("could not detect default route")
+}
+
+// In Flatcar linux, the link automatically transitions to the UP state. In
+// Debian, the link will stay in the DOWN state until LinkSetUp is called.
+// Additionally, if LinkSetUp is called in Flatcar, the link appears to properly
+// get the UP flag set but subsequent AddrAdd() calls might fail, indicating
+// it did not properly set up. This method, will wait for the link to come up
+// automatically and will explicitly bring it up after timeout.
+func (sd *ServerDevice) ensureLinkIsUp(h netlink.Handle) error {
+	tries := 1
+	for {
+		link, err := h.LinkByName(sd.link.Attrs().Name)
+		if err != nil {
+			return err
+		}
+		logger.Info.Printf(
+			"waiting for device %s to come up, current flags: %s",
+			sd.link.Attrs().Name,
+			link.Attrs().Flags,
+		)
+		if link.Attrs().Flags&net.FlagUp != 0 {
+			logger.Info.Printf(
+				"device %s came up automatically",
+				sd.link.Attrs().Name,
+			)
+			return nil
+		}
+		if tries > 4 {
+			logger.Info.Printf(
+				"timeout waiting for device %s to come up automatically",
+				sd.link.Attrs().Name,
+			)
+			return h.LinkSetUp(sd.link)
+		}
+		tries++
+		time.Sleep(time.Second)
+	}
+}
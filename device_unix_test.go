@@ -0,0 +1,38 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestIsWireguardUnsupported(t *testing.T) {
+	assert.True(t, isWireguardUnsupported(unix.EOPNOTSUPP))
+	assert.True(t, isWireguardUnsupported(fmt.Errorf("cannot add link: %w", netlink.ErrNotImplemented)))
+	assert.False(t, isWireguardUnsupported(unix.EPERM))
+	assert.False(t, isWireguardUnsupported(unix.EEXIST))
+}
+
+func TestWireguardDevice_Run(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	wd := newWireguardDevice("wg_test", 0)
+	wd.linkAdd = func(link netlink.Link) error { return nil }
+	assert.NoError(t, wd.Run())
+	assert.Nil(t, wd.userspace)
+
+	// Other errors are not worked around
+	wd.linkAdd = func(link netlink.Link) error { return unix.EPERM }
+	assert.Equal(t, unix.EPERM, wd.Run())
+	assert.Nil(t, wd.userspace)
+
+	wd.adopt = true
+	wd.linkAdd = func(link netlink.Link) error { return unix.EEXIST }
+	assert.NoError(t, wd.Run())
+	assert.True(t, wd.adopted)
+}
@@ -0,0 +1,73 @@
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+// listenUAPI listens on the named pipe of the named device. There is no socket
+// file on windows, so the returned file is always nil.
+func listenUAPI(name string) (net.Listener, *os.File, error) {
+	uapi, err := ipc.UAPIListen(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to listen on uapi named pipe: %v", err)
+	}
+	return uapi, nil, nil
+}
+
+// WireguardDevice is not supported on windows, which lacks kernel space
+// wireguard. Agents have to use tun devices instead.
+type WireguardDevice struct {
+	adopt      bool
+	keep       bool
+	deviceName string
+}
+
+func newWireguardDevice(name string, mtu int) *WireguardDevice {
+	return &WireguardDevice{deviceName: name}
+}
+
+// Name returns the name of the device.
+func (wd *WireguardDevice) Name() string {
+	return wd.deviceName
+}
+
+// Run always fails on windows.
+func (wd *WireguardDevice) Run() error {
+	return fmt.Errorf("wireguard devices are not supported on windows, use a tun device instead")
+}
+
+// Stop is a no-op on windows.
+func (wd *WireguardDevice) Stop() {}
+
+// ServerDevice is not supported on windows, the server relies on netlink and
+// iptables and only runs on linux.
+type ServerDevice struct{}
+
+func newServerDevice(cfg *serverConfig) *ServerDevice {
+	return &ServerDevice{}
+}
+
+// Start always fails on windows.
+func (sd *ServerDevice) Start() error {
+	return fmt.Errorf("server mode is not supported on windows")
+}
+
+// updateForwardRules always fails on windows.
+func (sd *ServerDevice) updateForwardRules(rules [][]string) error {
+	return fmt.Errorf("server mode is not supported on windows")
+}
+
+// Stop is a no-op on windows.
+func (sd *ServerDevice) Stop() error {
+	return nil
+}
+
+func (sd *ServerDevice) updateNetwork(network *net.IPNet) error {
+	return fmt.Errorf("server mode is not supported on windows")
+}
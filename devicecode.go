@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// defaultDeviceCodeInterval is how often the token endpoint is polled if
+	// the identity provider does not specify an interval.
+	defaultDeviceCodeInterval = 5 * time.Second
+	// deviceCodeSlowDown is added to the polling interval every time the
+	// identity provider asks to slow down.
+	deviceCodeSlowDown = 5 * time.Second
+)
+
+var (
+	errDeviceCodeExpired = errors.New("device code expired before the user authorised it")
+	errDeviceCodeDenied  = errors.New("user denied the device authorisation request")
+	errDeviceCodePending = errors.New("device authorisation already pending")
+)
+
+// deviceAuthResponse is the response of the device authorization endpoint.
+// https://tools.ietf.org/html/rfc8628#section-3.2
+type deviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// deviceTokenResponse is the response of the token endpoint while polling
+// for a device code.
+// https://tools.ietf.org/html/rfc8628#section-3.5
+type deviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+// requestDeviceCode starts a device authorization grant, returning the codes
+// the user needs to authorise the agent.
+func (oa *oauthTokenHandler) requestDeviceCode() (*deviceAuthResponse, error) {
+	data := url.Values{}
+	data.Set("client_id", oa.config.ClientID)
+	data.Set("scope", strings.Join(oa.config.Scopes, " "))
+	body, status, err := postForm(oa.ctx, oa.deviceAuthURL, data)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("device authorization request failed with status %d: %s", status, body)
+	}
+	da := &deviceAuthResponse{}
+	if err := json.Unmarshal(body, da); err != nil {
+		return nil, fmt.Errorf("cannot parse device authorization response: %w", err)
+	}
+	if da.DeviceCode == "" || da.UserCode == "" || da.VerificationURI == "" {
+		return nil, fmt.Errorf("incomplete device authorization response: %s", body)
+	}
+	return da, nil
+}
+
+// startDeviceCode returns the pending device authorization grant, or starts
+// one if there is none, in which case started is true and the caller has to
+// poll for its token.
+func (oa *oauthTokenHandler) startDeviceCode() (da *deviceAuthResponse, started bool, err error) {
+	oa.deviceCodeMutex.Lock()
+	defer oa.deviceCodeMutex.Unlock()
+	if oa.deviceCode != nil {
+		return oa.deviceCode, false, nil
+	}
+	if da, err = oa.requestDeviceCode(); err != nil {
+		return nil, false, err
+	}
+	oa.deviceCode = da
+	return da, true, nil
+}
+
+// pollDeviceToken polls the token endpoint until the user authorises the
+// device code of da, the code expires or the user denies the request.
+func (oa *oauthTokenHandler) pollDeviceToken(da *deviceAuthResponse) (*oauth2.Token, error) {
+	interval := time.Duration(da.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultDeviceCodeInterval
+	}
+	var deadline time.Time
+	if da.ExpiresIn > 0 {
+		deadline = time.Now().Add(time.Duration(da.ExpiresIn) * time.Second)
+	}
+	data := url.Values{}
+	data.Set("grant_type", deviceCodeGrantType)
+	data.Set("device_code", da.DeviceCode)
+	data.Set("client_id", oa.config.ClientID)
+	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, errDeviceCodeExpired
+		}
+		select {
+		case <-time.After(interval):
+		case <-oa.ctx.Done():
+			return nil, oa.ctx.Err()
+		}
+		body, status, err := postForm(oa.ctx, oa.config.Endpoint.TokenURL, data)
+		if err != nil {
+			logger.Error.Printf("Cannot poll for device token: %v", err)
+			continue
+		}
+		tr := &deviceTokenResponse{}
+		if err := json.Unmarshal(body, tr); err != nil {
+			return nil, fmt.Errorf("cannot parse token response with status %d: %w", status, err)
+		}
+		switch tr.Error {
+		case "":
+			if status != http.StatusOK || tr.AccessToken == "" {
+				return nil, fmt.Errorf("unexpected token response with status %d: %s", status, body)
+			}
+			tok := &oauth2.Token{
+				AccessToken:  tr.AccessToken,
+				TokenType:    tr.TokenType,
+				RefreshToken: tr.RefreshToken,
+			}
+			if tr.ExpiresIn > 0 {
+				tok.Expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+			}
+			return tok, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += deviceCodeSlowDown
+		case "expired_token":
+			return nil, errDeviceCodeExpired
+		case "access_denied":
+			return nil, errDeviceCodeDenied
+		default:
+			return nil, fmt.Errorf("device token request failed: %s", tr.Error)
+		}
+	}
+}
+
+// deviceCodeToken runs the device authorization grant, printing the
+// instructions for the user to authorise the agent from another device, and
+// caches the token obtained like the web flow does, so that it is refreshed
+// from then on without user interaction. While a grant is waiting for the
+// user, its instructions are printed again and errDeviceCodePending is
+// returned instead of starting another one.
+func (oa *oauthTokenHandler) deviceCodeToken() (*oauth2.Token, error) {
+	da, started, err := oa.startDeviceCode()
+	if err != nil {
+		return nil, err
+	}
+	if da.VerificationURIComplete != "" {
+		logger.Info.Printf("To authenticate, visit %s and confirm the code %s", da.VerificationURIComplete, da.UserCode)
+	} else {
+		logger.Info.Printf("To authenticate, visit %s and enter the code %s", da.VerificationURI, da.UserCode)
+	}
+	if !started {
+		return nil, errDeviceCodePending
+	}
+	defer func() {
+		oa.deviceCodeMutex.Lock()
+		oa.deviceCode = nil
+		oa.deviceCodeMutex.Unlock()
+	}()
+	tok, err := oa.pollDeviceToken(da)
+	if err != nil {
+		return nil, err
+	}
+	if err := oa.saveToken(tok); err != nil {
+		logger.Error.Printf("failed to save token to file: %v", err)
+	}
+	return tok, nil
+}
+
+func postForm(ctx context.Context, endpoint string, data url.Values) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, resp.StatusCode, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDeviceCodeServer(t *testing.T, responses []string) *httptest.Server {
+	polls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "client", r.FormValue("client_id"))
+		assert.Equal(t, "openid email", r.FormValue("scope"))
+		fmt.Fprint(w, `{"device_code":"dev","user_code":"ABCD-EFGH","verification_uri":"https://example.com/device","expires_in":60,"interval":1}`)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, deviceCodeGrantType, r.FormValue("grant_type"))
+		assert.Equal(t, "dev", r.FormValue("device_code"))
+		if polls >= len(responses) {
+			t.Fatal("unexpected token request")
+		}
+		resp := responses[polls]
+		polls++
+		w.Header().Set("Content-Type", "application/json")
+		if resp == "" {
+			fmt.Fprint(w, `{"access_token":"access","token_type":"Bearer","refresh_token":"refresh","expires_in":3600}`)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error":%q}`, resp)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestOAuthTokenHandler_DeviceCodeToken(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ts := newTestDeviceCodeServer(t, []string{"authorization_pending", ""})
+	defer ts.Close()
+	tokFile := filepath.Join(t.TempDir(), "token")
+	oa := newOAuthTokenHandler("", ts.URL+"/token", ts.URL+"/device", "client", tokFile)
+	tok, err := oa.deviceCodeToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "access", tok.AccessToken)
+	assert.Equal(t, "refresh", tok.RefreshToken)
+	cached, err := oa.getTokenFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, "access", cached.AccessToken)
+	assert.Equal(t, "refresh", cached.RefreshToken)
+}
+
+func TestOAuthTokenHandler_DeviceCodeTokenPending(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ts := newTestDeviceCodeServer(t, []string{"authorization_pending", ""})
+	defer ts.Close()
+	oa := newOAuthTokenHandler("", ts.URL+"/token", ts.URL+"/device", "client", filepath.Join(t.TempDir(), "token"))
+	pending := func() *deviceAuthResponse {
+		oa.deviceCodeMutex.Lock()
+		defer oa.deviceCodeMutex.Unlock()
+		return oa.deviceCode
+	}
+	done := make(chan error)
+	go func() {
+		_, err := oa.deviceCodeToken()
+		done <- err
+	}()
+	for pending() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Logins while the user has not authorised the agent yet reuse the
+	// pending code rather than requesting a new one
+	_, err := oa.deviceCodeToken()
+	assert.True(t, errors.Is(err, errDeviceCodePending))
+	assert.NoError(t, <-done)
+	assert.Nil(t, pending())
+}
+
+func TestOAuthTokenHandler_DeviceCodeTokenDenied(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ts := newTestDeviceCodeServer(t, []string{"access_denied"})
+	defer ts.Close()
+	oa := newOAuthTokenHandler("", ts.URL+"/token", ts.URL+"/device", "client", filepath.Join(t.TempDir(), "token"))
+	_, err := oa.deviceCodeToken()
+	assert.True(t, errors.Is(err, errDeviceCodeDenied))
+}
+
+func TestOAuthTokenHandler_DeviceCodeTokenCancelled(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ts := newTestDeviceCodeServer(t, nil)
+	defer ts.Close()
+	oa := newOAuthTokenHandler("", ts.URL+"/token", ts.URL+"/device", "client", filepath.Join(t.TempDir(), "token"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	oa.ctx = ctx
+	_, err := oa.deviceCodeToken()
+	assert.True(t, errors.Is(err, context.Canceled))
+}
@@ -1,19 +1,72 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/utilitywarehouse/wiresteward/client"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// Routes installed by the agent are tagged with this protocol number by
+// default, so that they can be told apart from routes added by other daemons.
+// 0x77 is the hex value of "w" in the ascii table.
+const defaultRouteProtocol = 0x77
+
+const (
+	defaultNetlinkRetryAttempts = 3
+	defaultNetlinkRetryDelay    = 100 * time.Millisecond
+	defaultRouteWorkers         = 8
+)
+
+// Interface aliases are limited to IFALIASZ (256) bytes, including the
+// terminating null byte.
+const maxDeviceAliasLength = 255
+
+// Peer management modes. In exclusive mode, the default, the agent removes
+// any peer of the device it did not configure. In coexist mode, it only
+// touches its own peers, so that other tools can manage peers on the same
+// device, and adopts the device if it already exists.
+const (
+	peerManagementExclusive = "exclusive"
+	peerManagementCoexist   = "coexist"
+)
+
+// Agents default to the unversioned lease path, which is served by servers of
+// all versions.
+const defaultLeasePath = client.LegacyLeasePath
+
+const (
+	renewRetryInterval  = time.Second
+	authRetryMaxBackoff = time.Minute
+)
+
+var (
+	// errDeviceAbsent is returned when the network device of a
+	// DeviceManager does not exist after it was started.
+	errDeviceAbsent = errors.New("device does not exist")
+	// errDeviceNotConfigurable is returned when the network device exists
+	// but cannot be configured via wgctrl.
+	errDeviceNotConfigurable = errors.New("device exists but cannot be configured via wgctrl")
+)
+
+// errLeaseUnauthorized is returned when a server rejects the token used to
+// request a lease.
+var errLeaseUnauthorized = client.ErrUnauthorized
+
+// errNoLease is returned when a server holds no lease to renew for the device.
+var errNoLease = client.ErrNoLease
+
 func init() {
 	rand.Seed(time.Now().Unix())
 }
@@ -23,55 +76,407 @@ func init() {
 // wiresteward servers.
 type DeviceManager struct {
 	agentDevice
-	cachedToken    string // cache the token on every renew lease request in case we need to use it on a renewal triggered by healthchecks
-	configMutex    sync.Mutex
-	config         *WirestewardPeerConfig // To keep the current config
-	serverURLs     []string
-	healthCheck    *healthCheck
-	renewLeaseChan chan struct{}
+	alias       string
+	cachedToken string // cache the token on every renew lease request in case we need to use it on a renewal triggered by healthchecks
+	// cachedTokenMutex guards cachedToken, which is set by the agent while
+	// renewals read it
+	cachedTokenMutex sync.Mutex
+	clientID         string
+	configMutex      sync.Mutex
+	config           *WirestewardPeerConfig // To keep the current config
+	egressInterface  string
+	events           *eventQueue
+	metrics          agentMetricsSink
+	// tokens serves the token used for lease requests and refreshes it when
+	// a server rejects it
+	tokens        *tokenCache
+	authBackoff   time.Duration
+	servers       []agentPeerConfig
+	healthCheck   *healthCheck
+	noHealthCheck bool
+	// The server of the current lease is unhealthy after
+	// healthCheckThreshold consecutive failed probes, sent every
+	// healthCheckInterval
+	healthCheckInterval  time.Duration
+	healthCheckThreshold int
+	renewLeaseChan       chan struct{}
+	renewTimer           *time.Timer
+	renewTimerMutex      sync.Mutex
+	routeProtocol        int
+	// Failed renewals are retried with a backoff up to renewRetryMax,
+	// renewFailures counts the ones since the last successful renewal
+	renewFailures int
+	renewRetryMax time.Duration
+	// renewJitter is the maximum time taken off scheduled renewals
+	renewJitter time.Duration
+	// routeMetric is set on installed routes, it is managed by the bond the
+	// device is part of, if any
+	routeMetric int
+	sysctls     map[string]string
+	// sysctlDefaults holds the values of sysctls before they were applied,
+	// to restore them when the device is stopped
+	sysctlDefaults map[string]string
+	// netlink operations failing with transient errors are retried
+	netlinkRetryAttempts int
+	netlinkRetryDelay    time.Duration
+	// routeWorkers is the number of routes installed concurrently
+	routeWorkers int
+	// connectedRoutes is whether routes covered by the connected route of
+	// the leased address are installed
+	connectedRoutes bool
+	// Replaced peers are kept for peerDrainPeriod before being removed
+	peerDrainPeriod    time.Duration
+	drainingPeers      map[wgtypes.Key]*time.Timer
+	drainingPeersMutex sync.Mutex
+	removePeer         func(deviceName string, key wgtypes.Key) error
+	configureDevice    func(deviceName string, cfg wgtypes.Config) error
+	resolver           resolverChain
+	// coexist restricts peer changes to the peers of the agent
+	coexist bool
+	// keepDevice is set when the device may outlive the agent, which has
+	// to remove its configuration from it when stopping
+	keepDevice bool
+	// keyStore persists the private key of the device across restarts, if
+	// set
+	keyStore secretStore
+	// hooks run on the events of the lease of the device, if set
+	hooks *hookRunner
+	// key is the private key the agent set on the device, which is
+	// restored if something else replaces it
+	key      wgtypes.Key
+	keyMutex sync.Mutex
+	// wireguardDevice and linkExists are used to probe that the device can
+	// be configured after it is started
+	wireguardDevice func(name string) (*wgtypes.Device, error)
+	linkExists      func(name string) bool
+	// recreation limits recreating the device when its link is deleted
+	recreation *recreationBreaker
+	// stop is closed once, by the first call to Stop
+	stop     chan struct{}
+	stopOnce sync.Once
+	// addressInUse probes leased addresses for conflicts, if enabled
+	addressInUse func(ip net.IP) (bool, error)
+	// reachable probes a target via the device after a lease is applied, if
+	// enabled, and configReachable is whether it was reachable with the
+	// current config
+	reachable       func() error
+	configReachable bool
+	// Lease renewals are deferred while behind a captive portal
+	captivePortalDetector *captivePortalDetector
+	behindCaptivePortal   bool
+	// setDNS and revertDNS apply the DNS configuration of leases to the
+	// system, unless ignoreDNS is set, and dnsApplied is whether it is
+	setDNS     func(device string, servers []net.IP, domains []string, routes []dnsRoute) error
+	revertDNS  func(device string) error
+	ignoreDNS  bool
+	dnsApplied bool
+	// mtu is the mtu the device was configured with, which takes precedence
+	// over the one of leases, set with setMTU
+	mtu    int
+	setMTU func(device string, mtu int) error
+	// failover, if set, health checks the server of the current lease and
+	// fails over to the others, skipping the unhealthyServers until
+	// serverReachable succeeds for them
+	failover         *agentFailoverConfig
+	failoverMutex    sync.Mutex
+	unhealthyServers map[string]bool
+	serverReachable  func(serverURL string) error
+	// servers can be replaced when the config is reloaded, they have to be
+	// read with serverList
+	serversMutex sync.Mutex
+	// configCheckInterval is how often the server of the current lease is
+	// polled for changes to its advertised settings, never if zero
+	configCheckInterval time.Duration
+	// resolveInterval is how often the endpoint host name of the
+	// current lease is resolved again while handshakes are failing
+	resolveInterval time.Duration
+	// The key of the device is rotated every keyRotationInterval, never if
+	// zero. keyRotationDue is set to 1 when the next renewal has to rotate
+	// it, and accessed atomically
+	keyRotationInterval time.Duration
+	keyRotationDue      int32
+	// fullTunnel routes all traffic through the tunnel, if set
+	fullTunnel *agentFullTunnelConfig
+	// killSwitch drops traffic outside of the tunnel while a lease is held,
+	// if set. killSwitchRules are the rules currently installed, and
+	// killSwitchAddrs the addresses the servers they let through last
+	// resolved to.
+	killSwitch      *agentKillSwitchConfig
+	killSwitchRules map[bool][][]string
+	killSwitchAddrs map[string][]net.IP
+	// logger adds the name of the device to the lines logged for it
+	logger *Logger
 }
 
-func newDeviceManager(deviceName string, mtu int, wirestewardURLs []string) *DeviceManager {
+func newDeviceManager(cfg agentDeviceConfig, clientID string) *DeviceManager {
+	coexist := cfg.PeerManagement == peerManagementCoexist
+	deviceType := cfg.Type
+	if deviceType == "" {
+		deviceType = *flagDeviceType
+	}
 	var device agentDevice
-	if *flagDeviceType == "wireguard" {
-		device = newWireguardDevice(deviceName, mtu)
+	if deviceType == "wireguard" {
+		wd := newWireguardDevice(cfg.Name, cfg.MTU)
+		wd.adopt = coexist
+		wd.keep = cfg.KeepDevice
+		device = wd
 	} else {
-		device = newTunDevice(deviceName, mtu)
+		device = newTunDevice(cfg.Name, cfg.MTU)
+	}
+	routeProtocol := cfg.RouteProtocol
+	if routeProtocol == 0 {
+		routeProtocol = defaultRouteProtocol
+	}
+	netlinkRetryAttempts := cfg.NetlinkRetryAttempts
+	if netlinkRetryAttempts == 0 {
+		netlinkRetryAttempts = defaultNetlinkRetryAttempts
+	}
+	netlinkRetryDelay := cfg.NetlinkRetryDelay.Duration
+	if netlinkRetryDelay == 0 {
+		netlinkRetryDelay = defaultNetlinkRetryDelay
+	}
+	endpointResolveInterval := cfg.EndpointResolveInterval.Duration
+	if endpointResolveInterval == 0 {
+		endpointResolveInterval = defaultEndpointResolveInterval
+	}
+	healthCheckInterval := cfg.HealthCheckInterval.Duration
+	if healthCheckInterval == 0 {
+		healthCheckInterval = defaultHealthCheckInterval
+	}
+	healthCheckThreshold := cfg.HealthCheckThreshold
+	if healthCheckThreshold == 0 {
+		healthCheckThreshold = defaultHealthCheckThreshold
+	}
+	routeWorkers := cfg.RouteWorkers
+	if routeWorkers == 0 {
+		routeWorkers = defaultRouteWorkers
+	}
+	var addressInUse func(ip net.IP) (bool, error)
+	if cfg.AddressProbe != nil {
+		iface := cfg.AddressProbe.Interface
+		if iface == "" {
+			iface = cfg.EgressInterface
+		}
+		addressInUse = newAddressProber(cfg.Name, iface, cfg.AddressProbe.Timeout.Duration)
+	}
+	dmLogger := logger.with("device", cfg.Name)
+	var reachable func() error
+	if cfg.ReachabilityProbe != nil {
+		var err error
+		reachable, err = newReachabilityProbe(cfg.ReachabilityProbe.Target, cfg.ReachabilityProbe.Timeout.Duration)
+		if err != nil {
+			dmLogger.Error.Printf("Cannot create reachability probe for device %s: %v", cfg.Name, err)
+		}
 	}
 	return &DeviceManager{
-		agentDevice:    device,
-		serverURLs:     wirestewardURLs,
-		healthCheck:    &healthCheck{running: false},
-		renewLeaseChan: make(chan struct{}),
+		addressInUse:         addressInUse,
+		reachable:            reachable,
+		agentDevice:          device,
+		alias:                deviceAlias(cfg),
+		clientID:             clientID,
+		egressInterface:      cfg.EgressInterface,
+		servers:              cfg.Peers,
+		healthCheck:          &healthCheck{running: false},
+		noHealthCheck:        cfg.noHealthCheck,
+		healthCheckInterval:  healthCheckInterval,
+		healthCheckThreshold: healthCheckThreshold,
+		metrics:              noopMetricsSink{},
+		renewLeaseChan:       make(chan struct{}),
+		renewJitter:          cfg.RenewJitter.Duration,
+		renewRetryMax:        cfg.RenewRetryMaxInterval.Duration,
+		routeProtocol:        routeProtocol,
+		sysctls:              cfg.Sysctls,
+		netlinkRetryAttempts: netlinkRetryAttempts,
+		netlinkRetryDelay:    netlinkRetryDelay,
+		routeWorkers:         routeWorkers,
+		connectedRoutes:      cfg.InstallConnectedRoutes,
+		peerDrainPeriod:      cfg.PeerDrainPeriod.Duration,
+		drainingPeers:        make(map[wgtypes.Key]*time.Timer),
+		removePeer:           removePeer,
+		configureDevice:      configureDevice,
+		coexist:              coexist,
+		keepDevice:           coexist || cfg.KeepDevice,
+		resolver:             newResolverChain(nil),
+		wireguardDevice:      getWireguardDevice,
+		linkExists:           linkExists,
+		setDNS:               setDeviceDNS,
+		revertDNS:            revertDeviceDNS,
+		ignoreDNS:            cfg.IgnoreDNS,
+		mtu:                  cfg.MTU,
+		setMTU:               setDeviceMTU,
+		failover:             cfg.Failover,
+		unhealthyServers:     make(map[string]bool),
+		serverReachable:      serverReachable,
+		recreation:           newRecreationBreaker(cfg.RecreateMinInterval.Duration, cfg.RecreateMaxAttempts, cfg.RecreateWindow.Duration),
+		stop:                 make(chan struct{}),
+		configCheckInterval:  cfg.ConfigCheckInterval.Duration,
+		resolveInterval:      endpointResolveInterval,
+		keyRotationInterval:  cfg.KeyRotationInterval.Duration,
+		fullTunnel:           newFullTunnel(cfg.FullTunnel),
+		killSwitch:           cfg.KillSwitch,
+		logger:               dmLogger,
 	}
 }
 
+func linkExists(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+// probeDevice checks that the device can be configured via wgctrl, so that
+// setups where the link can be created but not configured, eg. because the
+// wireguard generic netlink family is not available in a container, fail
+// early with an actionable error.
+func (dm *DeviceManager) probeDevice() error {
+	_, err := dm.wireguardDevice(dm.Name())
+	if err == nil {
+		return nil
+	}
+	if !dm.linkExists(dm.Name()) {
+		return fmt.Errorf("%w: %s: %v", errDeviceAbsent, dm.Name(), err)
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("%w: %s: %v, the agent is probably missing the CAP_NET_ADMIN capability", errDeviceNotConfigurable, dm.Name(), err)
+	}
+	return fmt.Errorf("%w: %s: %v, check that the wireguard kernel module is loaded (or use -device-type=tun for the userspace implementation) and that the device is of type wireguard", errDeviceNotConfigurable, dm.Name(), err)
+}
+
+// deviceAlias returns the configured alias of the device, or one listing the
+// urls of its peers.
+func deviceAlias(cfg agentDeviceConfig) string {
+	alias := cfg.Alias
+	if alias == "" {
+		urls := make([]string, len(cfg.Peers))
+		for i, p := range cfg.Peers {
+			urls[i] = p.URL
+		}
+		alias = "wiresteward: " + strings.Join(urls, " ")
+	}
+	if len(alias) > maxDeviceAliasLength {
+		alias = alias[:maxDeviceAliasLength]
+	}
+	return alias
+}
+
+// Stop restores any sysctls applied to the device, clears its alias and
+// stops the underlying AgentDevice. If the device may be left in place, the
+// addresses, routes and peers configured by the agent are removed first, so
+// that restarts do not leave stale ones behind. Otherwise they are removed
+// along with the device. Only the first call stops the device, eg. a device
+// brought down stays stopped when the agent shuts down.
+func (dm *DeviceManager) Stop() {
+	stopping := false
+	dm.stopOnce.Do(func() {
+		close(dm.stop)
+		stopping = true
+	})
+	if !stopping {
+		return
+	}
+	dm.scheduleRenewal(time.Time{})
+	dm.configMutex.Lock()
+	if dm.config != nil {
+		dm.hooks.fire(newHookEvent(hookEventTunnelDown, dm.Name(), dm.config))
+	}
+	dm.restoreDNS()
+	dm.configMutex.Unlock()
+	dm.restoreSysctls()
+	dm.setAlias("")
+	if dm.keepDevice {
+		dm.removeOwnPeers()
+		dm.removeOwnConfig()
+	}
+	if dm.killSwitch != nil {
+		dm.configMutex.Lock()
+		dm.disableKillSwitch()
+		dm.configMutex.Unlock()
+	}
+	dm.agentDevice.Stop()
+}
+
+// removeOwnConfig removes the addresses and routes of the current lease from
+// the device.
+func (dm *DeviceManager) removeOwnConfig() {
+	dm.configMutex.Lock()
+	defer dm.configMutex.Unlock()
+	if dm.config == nil {
+		return
+	}
+	if err := dm.removeDeviceConfig(dm.config); err != nil {
+		dm.logger.Error.Printf("Cannot remove config from device %s: %v", dm.Name(), err)
+	}
+	dm.config = nil
+}
+
 func (dm *DeviceManager) isHealthy() bool {
 	return dm.healthCheck.isHealthy()
 }
 
 func (dm *DeviceManager) isHealthChecked() bool {
-	return len(dm.serverURLs) > 1
+	return len(dm.serverList()) > 1
 }
 
 // Run starts the AgentDevice by calling its Run() method and proceeds to
-// initialise it.
+// initialise it. The device is recreated if its link is deleted while
+// running.
 func (dm *DeviceManager) Run() error {
+	if err := dm.setup(); err != nil {
+		return err
+	}
+	servers := dm.serverList()
+	if len(servers) > 0 {
+		go dm.renewLoop()
+	}
+	if dm.failover != nil && len(servers) > 1 {
+		interval := dm.failover.FailbackInterval.Duration
+		if interval == 0 {
+			interval = defaultFailoverFailbackInterval
+		}
+		go dm.failbackLoop(interval)
+	}
+	if dm.configCheckInterval > 0 && len(servers) > 0 {
+		go dm.configCheckLoop(dm.configCheckInterval)
+	}
+	if len(servers) > 0 {
+		go dm.endpointResolveLoop(dm.resolveInterval)
+	}
+	if dm.keyRotationInterval > 0 && len(servers) > 0 {
+		go dm.keyRotationLoop(dm.keyRotationInterval)
+	}
+	go dm.watchLink(linkWatchInterval)
+	go dm.reconcileLoop(reconcileInterval)
+	return nil
+}
+
+// emptyKey is the base64 value of the private key of devices without one.
+const emptyKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+// setup starts the AgentDevice and initialises it.
+func (dm *DeviceManager) setup() error {
 	if err := dm.agentDevice.Run(); err != nil {
 		return fmt.Errorf("Error starting tun device `%s`: %w", dm.Name(), err)
 	}
+	if err := dm.probeDevice(); err != nil {
+		return err
+	}
 	if err := dm.ensureLinkUp(); err != nil {
 		return err
 	}
+	dm.applySysctls()
+	dm.setAlias(dm.alias)
 	// Check if there is a private key or generate one
 	_, privKey, err := getKeys(dm.Name())
 	if err != nil {
 		return fmt.Errorf("Cannot get keys for device `%s`: %w", dm.Name(), err)
 	}
-	// the base64 value of an empty key will come as
-	// AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
-	if privKey == "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" {
-		logger.Info.Printf(
+	// The key of an adopted device is left alone in coexist mode, it is
+	// only generated if the device has none
+	if dm.keyStore != nil && !dm.coexist {
+		if err := dm.restoreKey(privKey); err != nil {
+			return err
+		}
+	} else if privKey == emptyKey {
+		dm.logger.Info.Printf(
 			"No keys found for device `%s`, generating a new pair",
 			dm.Name(),
 		)
@@ -83,40 +488,177 @@ func (dm *DeviceManager) Run() error {
 			return err
 		}
 	}
-
-	if len(dm.serverURLs) > 0 {
-		go dm.renewLoop()
-	}
-	return nil
+	return dm.rememberKey()
 }
 
 func (dm *DeviceManager) renewLoop() {
 	for {
 		select {
 		case <-dm.renewLeaseChan:
-			logger.Info.Printf("Renewing lease for device:%s\n", dm.Name())
-			if err := dm.renewLease(); err != nil {
-				logger.Error.Printf("Cannot update lease, will retry in one sec: %s", err)
-				// Wait a second in a goroutine so we do not block here and try again
-				go func() {
-					time.Sleep(1 * time.Second)
-					dm.renewLeaseChan <- struct{}{}
-				}()
+			dm.logger.Info.Printf("Renewing lease for device:%s\n", dm.Name())
+			err := dm.renewLease()
+			if err == nil {
+				dm.authBackoff = 0
+				dm.renewFailures = 0
+				continue
 			}
+			agentRenewalErrorsTotal.WithLabelValues(dm.Name()).Inc()
+			retryIn := dm.handleRenewError(err)
+			dm.logger.Error.Printf("Cannot update lease, will retry in %s: %s", retryIn, err)
+			// Wait in a goroutine so we do not block here and try again
+			go func() {
+				time.Sleep(retryIn)
+				dm.triggerRenewal()
+			}()
+		case <-dm.stop:
+			return
+		}
+	}
+}
+
+// handleRenewError returns the time to wait before retrying a failed lease
+// renewal. If the server rejected the token, the current lease is kept active
+// while a fresh token is requested, retrying with an exponential backoff, as
+// long as the lease has not expired. Once it does, the device configuration
+// is removed.
+func (dm *DeviceManager) handleRenewError(err error) time.Duration {
+	if errors.Is(err, errCaptivePortal) {
+		return dm.captivePortalDetector.interval
+	}
+	if errors.Is(err, errLeaseRolledBack) {
+		return leaseRollbackRetryInterval
+	}
+	if !errors.Is(err, errLeaseUnauthorized) {
+		return dm.renewRetryDelay()
+	}
+	dm.configMutex.Lock()
+	config := dm.config
+	if config != nil && !config.Expires.IsZero() && config.Expires.Before(time.Now()) {
+		dm.events.emit(eventLeaseExpired, dm.Name(), "lease for %s expired at %s", config.LocalAddress, config.Expires)
+		dm.hooks.fire(newHookEvent(hookEventTunnelDown, dm.Name(), config))
+		if err := dm.removeDeviceConfig(config); err != nil {
+			dm.logger.Error.Printf("Could not remove expired config from device %s: %v", dm.Name(), err)
+		}
+		dm.config = nil
+		config = nil
+	}
+	dm.configMutex.Unlock()
+
+	if dm.authBackoff == 0 {
+		dm.authBackoff = renewRetryInterval
+	} else if dm.authBackoff *= 2; dm.authBackoff > authRetryMaxBackoff {
+		dm.authBackoff = authRetryMaxBackoff
+	}
+	if config != nil {
+		dm.events.emit(eventAuthRefreshPending, dm.Name(), "token rejected, keeping lease for %s until %s while refreshing", config.LocalAddress, config.Expires)
+	}
+	if dm.tokens != nil {
+		token, err := dm.tokens.refresh()
+		if err != nil {
+			dm.logger.Error.Printf("Cannot refresh token for device %s: %v", dm.Name(), err)
+		} else {
+			dm.setToken(token)
+		}
+	}
+	return dm.authBackoff
+}
+
+// triggerRenewal asks the renewal loop to renew the lease. It returns without
+// renewing once the device manager is stopped, as nothing reads renewal
+// requests any more.
+func (dm *DeviceManager) triggerRenewal() {
+	select {
+	case dm.renewLeaseChan <- struct{}{}:
+	case <-dm.stop:
+	}
+}
+
+// scheduleRenewal triggers a lease renewal at the given time, replacing any
+// previously scheduled renewal. A zero time only cancels the previous one.
+func (dm *DeviceManager) scheduleRenewal(at time.Time) {
+	dm.renewTimerMutex.Lock()
+	defer dm.renewTimerMutex.Unlock()
+	if dm.renewTimer != nil {
+		dm.renewTimer.Stop()
+		dm.renewTimer = nil
+	}
+	if at.IsZero() {
+		return
+	}
+	dm.logger.Info.Printf("Scheduling lease renewal for device %s at %s", dm.Name(), at)
+	dm.renewTimer = time.AfterFunc(time.Until(at), dm.triggerRenewal)
+}
+
+// drainPeer keeps a peer that is no longer used for the configured drain
+// period before removing it. Its routes are expected to be already removed,
+// so that new traffic is not routed to it.
+func (dm *DeviceManager) drainPeer(key wgtypes.Key) {
+	if dm.peerDrainPeriod == 0 {
+		return
+	}
+	dm.drainingPeersMutex.Lock()
+	defer dm.drainingPeersMutex.Unlock()
+	if _, ok := dm.drainingPeers[key]; ok {
+		return
+	}
+	peerLogger := dm.logger.with("peer", key.String())
+	peerLogger.Info.Printf("Draining peer of device %s for %s", dm.Name(), dm.peerDrainPeriod)
+	dm.drainingPeers[key] = time.AfterFunc(dm.peerDrainPeriod, func() {
+		dm.drainingPeersMutex.Lock()
+		_, ok := dm.drainingPeers[key]
+		delete(dm.drainingPeers, key)
+		dm.drainingPeersMutex.Unlock()
+		if !ok {
+			return
+		}
+		peerLogger.Info.Printf("Removing drained peer of device %s", dm.Name())
+		if err := dm.removePeer(dm.Name(), key); err != nil {
+			peerLogger.Error.Printf("Cannot remove drained peer of device %s: %v", dm.Name(), err)
 		}
+	})
+}
+
+// undrainPeer stops draining a peer that is in use again.
+func (dm *DeviceManager) undrainPeer(key wgtypes.Key) {
+	dm.drainingPeersMutex.Lock()
+	defer dm.drainingPeersMutex.Unlock()
+	if t, ok := dm.drainingPeers[key]; ok {
+		t.Stop()
+		delete(dm.drainingPeers, key)
+	}
+}
+
+// drainingPeerKeys returns the keys of the peers that are being drained.
+func (dm *DeviceManager) drainingPeerKeys() map[wgtypes.Key]bool {
+	dm.drainingPeersMutex.Lock()
+	defer dm.drainingPeersMutex.Unlock()
+	keys := make(map[wgtypes.Key]bool, len(dm.drainingPeers))
+	for k := range dm.drainingPeers {
+		keys[k] = true
 	}
+	return keys
 }
 
-func (dm *DeviceManager) nextServer() string {
-	return dm.serverURLs[rand.Intn(len(dm.serverURLs))]
+// token returns the token lease requests are made with.
+func (dm *DeviceManager) token() string {
+	dm.cachedTokenMutex.Lock()
+	defer dm.cachedTokenMutex.Unlock()
+	return dm.cachedToken
+}
+
+// setToken replaces the token lease requests are made with.
+func (dm *DeviceManager) setToken(token string) {
+	dm.cachedTokenMutex.Lock()
+	defer dm.cachedTokenMutex.Unlock()
+	dm.cachedToken = token
 }
 
 // RenewTokenAndLease is called via the agent to renew the cached token data and
 // trigger a lease renewal
 func (dm *DeviceManager) RenewTokenAndLease(token string) {
-	dm.cachedToken = token
+	dm.setToken(token)
 	dm.healthCheck.Stop() // stop a running healthcheck that could also trigger renewals
-	dm.renewLeaseChan <- struct{}{}
+	dm.triggerRenewal()
 }
 
 // RenewLease uses the provided oauth2 token to retrieve a new leases from one
@@ -124,33 +666,120 @@ func (dm *DeviceManager) RenewTokenAndLease(token string) {
 // healthchecks are disabled then all serveres would be considered healthy. The
 // received configuration is then applied to the device.
 func (dm *DeviceManager) renewLease() error {
-	if dm.cachedToken == "" {
+	if dm.tokens != nil {
+		if token, err := dm.tokens.get(); err != nil {
+			dm.logger.Error.Printf("Cannot get token for device %s, using the cached one: %v", dm.Name(), err)
+		} else {
+			dm.setToken(token)
+		}
+	}
+	if dm.token() == "" {
 		return fmt.Errorf("Empty cached token")
 	}
+	if err := dm.checkCaptivePortal(); err != nil {
+		return err
+	}
 	publicKey, _, err := getKeys(dm.Name())
 	if err != nil {
 		return fmt.Errorf("Could not get keys from device %s: %w", dm.Name(), err)
 	}
 
-	serverURL := dm.nextServer()
+	server := dm.nextServer()
+	serverURL := server.URL
 	if serverURL == "" {
 		return fmt.Errorf("No healthy servers found for device: %s", dm.Name())
 	}
 	oldConfig := dm.config
-	peers := []wgtypes.PeerConfig{}
-	config, wgServerAddr, err := requestWirestewardPeerConfig(serverURL, dm.cachedToken, publicKey)
+	req := &leaseRequest{
+		PubKey:          publicKey,
+		ClientID:        dm.clientID,
+		Extra:           server.Extra,
+		DelegatedPrefix: server.RequestDelegatedPrefix,
+		Version:         leaseRequestVersion,
+		Pool:            server.Pool,
+		Device:          server.Device,
+	}
+	var newKey *wgtypes.Key
+	if atomic.SwapInt32(&dm.keyRotationDue, 0) == 1 {
+		if newKey, err = rotateKey(req); err != nil {
+			dm.logger.Error.Printf("Cannot generate a new key for device %s: %v", dm.Name(), err)
+		}
+	}
+	// Leases held from the same server are only renewed, so that a retry
+	// after a lost response cannot be granted another address
+	req.Renew = oldConfig != nil && oldConfig.ServerURL == serverURL && req.PreviousPubKey == ""
+	config, wgServerAddr, err := dm.requestLease(server, req, oldConfig)
+	if errors.Is(err, errNoLease) {
+		dm.logger.Info.Printf("Server `%s` holds no lease for device %s, requesting a new one", serverURL, dm.Name())
+		req.Renew = false
+		config, wgServerAddr, err = dm.requestLease(server, req, oldConfig)
+	}
+	tags := map[string]string{"device": dm.Name(), "server": serverURL, "result": "success"}
+	if err != nil {
+		tags["result"] = "error"
+	}
+	dm.metrics.count("lease_requests", 1, tags)
 	if err != nil {
-		logger.Error.Printf(
+		dm.logger.Error.Printf(
 			"Could not get wiresteward peer config from `%s`: %v",
 			serverURL,
 			err,
 		)
 		return err
 	}
-	peers = append(peers, *config.PeerConfig)
+	if newKey != nil {
+		if err := dm.applyKey(*newKey); err != nil {
+			return err
+		}
+	}
+	config.ServerURL = serverURL
+	if dm.fullTunnel != nil {
+		addDefaultRoutes(config)
+	}
+	if err := dm.applyConfig(oldConfig, config); err != nil {
+		return err
+	}
+	if err := dm.checkReachability(oldConfig, config, dm.applyConfig); err != nil {
+		return err
+	}
+	dm.metrics.count("lease_renewals", 1, map[string]string{"device": dm.Name(), "server": serverURL})
+	dm.fireLeaseHook(oldConfig, config)
+	dm.scheduleRenewal(renewalTime(time.Now(), config, dm.renewJitter))
 
+	if dm.failover != nil {
+		return dm.startFailoverHealthCheck(serverURL, wgServerAddr)
+	}
+	// Start health checking if we have an address for the server wg client
+	// and more servers to potentially fell over.
+	if wgServerAddr != "" && len(dm.serverList()) > 1 && !dm.noHealthCheck {
+		dm.healthCheck.Stop()
+		interval, threshold := dm.healthCheckSettings()
+		hc, err := newHealthCheck(wgServerAddr, interval, threshold, dm.renewLeaseChan)
+		if err != nil {
+			return fmt.Errorf("Cannot create healthchek: %v", err)
+		}
+		dm.healthCheck = hc
+		go dm.healthCheck.Run()
+	}
+	return nil
+}
+
+// fireLeaseHook runs the hooks of a lease acquired from a server, or of the
+// lease in oldConfig being renewed.
+func (dm *DeviceManager) fireLeaseHook(oldConfig, config *WirestewardPeerConfig) {
+	event := hookEventLeaseRenewed
+	if oldConfig == nil || oldConfig.ServerURL != config.ServerURL || !oldConfig.LocalAddress.IP.Equal(config.LocalAddress.IP) {
+		event = hookEventLeaseAcquired
+	}
+	dm.hooks.fire(newHookEvent(event, dm.Name(), config))
+}
+
+// applyConfig configures the device with config, replacing oldConfig, and sets
+// the peer of config.
+func (dm *DeviceManager) applyConfig(oldConfig, config *WirestewardPeerConfig) error {
+	leaseLogger := dm.logger.with("peer", config.PublicKey.String())
 	dm.configMutex.Lock()
-	logger.Info.Printf(
+	leaseLogger.Info.Printf(
 		"Configuring offered ip address %s on device %s",
 		config.LocalAddress,
 		dm.Name(),
@@ -159,31 +788,95 @@ func (dm *DeviceManager) renewLease() error {
 	// update fails partially, we might end up with the wrong "old" config
 	// and fail to cleanup properly when we update the next time.
 	if err := dm.updateDeviceConfig(oldConfig, config); err != nil {
-		logger.Error.Printf(
+		leaseLogger.Error.Printf(
 			"Could not update peer configuration for `%s`: %v",
-			serverURL,
+			config.ServerURL,
 			err,
 		)
 	} else {
 		dm.config = config
+		dm.updateMTU(oldConfig, config)
+		dm.updateDNS(oldConfig, config)
 	}
 	dm.configMutex.Unlock()
-	if err := setPeers(dm.Name(), peers); err != nil {
+	if config.DelegatedPrefix != nil {
+		leaseLogger.Info.Printf(
+			"Server `%s` delegated prefix %s to device %s",
+			config.ServerURL,
+			config.DelegatedPrefix,
+			dm.Name(),
+		)
+	}
+	if oldConfig != nil && oldConfig.PublicKey != config.PublicKey {
+		dm.drainPeer(oldConfig.PublicKey)
+	}
+	dm.undrainPeer(config.PublicKey)
+	if err := dm.setPeer(oldConfig, config); err != nil {
 		return fmt.Errorf("Error setting new peers for device %s: %w", dm.Name(), err)
 	}
+	return nil
+}
 
-	// Start health checking if we have an address for the server wg client
-	// and more servers to potentially fell over.
-	if wgServerAddr != "" && len(dm.serverURLs) > 1 {
-		dm.healthCheck.Stop()
-		hc, err := newHealthCheck(wgServerAddr, time.Second, 3, dm.renewLeaseChan)
+// updateMTU sets the mtu the server asked for with config on the device,
+// unless the device was configured with one or it is already set. Mtus out of
+// the bounds servers can advertise are ignored.
+func (dm *DeviceManager) updateMTU(oldConfig, config *WirestewardPeerConfig) {
+	if dm.mtu != 0 || config.MTU == 0 || (oldConfig != nil && oldConfig.MTU == config.MTU) {
+		return
+	}
+	if config.MTU < minAdvertisedMTU || config.MTU > maxAdvertisedMTU {
+		dm.logger.Error.Printf("Ignoring mtu %d advertised for device %s, it must be between %d and %d", config.MTU, dm.Name(), minAdvertisedMTU, maxAdvertisedMTU)
+		return
+	}
+	dm.logger.Info.Printf("Setting mtu %d on device %s", config.MTU, dm.Name())
+	if err := dm.setMTU(dm.Name(), config.MTU); err != nil {
+		dm.logger.Error.Printf("Cannot set mtu of device %s: %v", dm.Name(), err)
+	}
+}
+
+// setPeer configures the peer of config on the device. In exclusive mode,
+// any other peer that is not draining is removed. In coexist mode, only the
+// peer of oldConfig is, if it was replaced and is not draining.
+func (dm *DeviceManager) setPeer(oldConfig, config *WirestewardPeerConfig) error {
+	peer := *config.PeerConfig
+	peer.ReplaceAllowedIPs = true
+	peers := []wgtypes.PeerConfig{peer}
+	draining := dm.drainingPeerKeys()
+	if dm.coexist {
+		if oldConfig != nil && oldConfig.PublicKey != config.PublicKey && !draining[oldConfig.PublicKey] {
+			peers = append(peers, wgtypes.PeerConfig{PublicKey: oldConfig.PublicKey, Remove: true})
+		}
+	} else {
+		device, err := dm.wireguardDevice(dm.Name())
 		if err != nil {
-			return fmt.Errorf("Cannot create healthchek: %v", err)
+			return err
+		}
+		peers = reconcilePeers(device.Peers, peers, draining)
+	}
+	return dm.configureDevice(dm.Name(), wgtypes.Config{Peers: peers})
+}
+
+// removeOwnPeers removes the current and draining peers of the device,
+// leaving the rest untouched.
+func (dm *DeviceManager) removeOwnPeers() {
+	keys := []wgtypes.Key{}
+	dm.drainingPeersMutex.Lock()
+	for key, t := range dm.drainingPeers {
+		t.Stop()
+		keys = append(keys, key)
+	}
+	dm.drainingPeers = map[wgtypes.Key]*time.Timer{}
+	dm.drainingPeersMutex.Unlock()
+	dm.configMutex.Lock()
+	if dm.config != nil {
+		keys = append(keys, dm.config.PublicKey)
+	}
+	dm.configMutex.Unlock()
+	for _, key := range keys {
+		if err := dm.removePeer(dm.Name(), key); err != nil {
+			dm.logger.with("peer", key.String()).Error.Printf("Cannot remove peer of device %s: %v", dm.Name(), err)
 		}
-		dm.healthCheck = hc
-		go dm.healthCheck.Run()
 	}
-	return nil
 }
 
 // WirestewardPeerConfig embeds wgtypes.PeerConfig and additional configuration
@@ -191,58 +884,226 @@ func (dm *DeviceManager) renewLease() error {
 type WirestewardPeerConfig struct {
 	*wgtypes.PeerConfig
 	LocalAddress *net.IPNet
+	// LocalAddress6 is the IPv6 address leased along with LocalAddress, if
+	// any
+	LocalAddress6 *net.IPNet
+	// Expires is the time the lease expires on the server, zero if unknown
+	Expires time.Time
+	// RenewAfter is the time the server asked the lease to be renewed at,
+	// zero if unknown
+	RenewAfter time.Time
+	// DelegatedPrefix is the prefix routed to this peer by the server, if
+	// one was requested
+	DelegatedPrefix *net.IPNet
+	// ServerURL is the url of the server that granted the lease
+	ServerURL string
+	// ServerEndpoint is the endpoint of the server as sent with the lease,
+	// before its host was resolved
+	ServerEndpoint string
+	// ControlURL is the url of the server reachable through the tunnel, if
+	// advertised
+	ControlURL string
+	// Routes are the networks routed via the device. They are the allowed
+	// IPs of the peer, unless the server flagged some of them as crypto or
+	// route only.
+	Routes []net.IPNet
+	// DNSServers and SearchDomains are applied to the system while the lease
+	// is in use
+	DNSServers    []net.IP
+	SearchDomains []string
+	// DNSRoutes send the queries for their domains to their servers
+	DNSRoutes []dnsRoute
+	// MTU is the mtu the server asked the device to use, zero if none
+	MTU int
+	// ConfigVersion is the version of the settings the server advertised
+	// with the lease, empty if the server does not version them
+	ConfigVersion string
+}
+
+// splitAllowedIPs returns the networks that should be added to the allowed
+// IPs of the peer and the ones that should be routed via the device, based on
+// the flags set by the server for each of them.
+func splitAllowedIPs(allowedIPs []string, flags map[string]string) ([]string, []net.IPNet, error) {
+	crypto := []string{}
+	routes := []net.IPNet{}
+	for _, a := range allowedIPs {
+		_, network, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch flag := flags[a]; flag {
+		case "", allowedIPFlagBoth:
+			crypto = append(crypto, a)
+			routes = append(routes, *network)
+		case allowedIPFlagCrypto:
+			crypto = append(crypto, a)
+		case allowedIPFlagRoute:
+			routes = append(routes, *network)
+		default:
+			return nil, nil, fmt.Errorf("unknown flag %q for allowed IPs %s", flag, a)
+		}
+	}
+	return crypto, routes, nil
+}
+
+// installedRoutes returns the routes of config to install. Routes covered by
+// the connected route of the leased address are skipped, unless configured
+// otherwise, as configuring the address already routes them via the device
+// and adding them again may fail or replace the connected route.
+func (dm *DeviceManager) installedRoutes(config *WirestewardPeerConfig) []net.IPNet {
+	if dm.connectedRoutes {
+		return config.Routes
+	}
+	connected := &net.IPNet{
+		IP:   config.LocalAddress.IP.Mask(config.LocalAddress.Mask),
+		Mask: config.LocalAddress.Mask,
+	}
+	connectedOnes, _ := connected.Mask.Size()
+	routes := make([]net.IPNet, 0, len(config.Routes))
+	for _, r := range config.Routes {
+		if ones, _ := r.Mask.Size(); ones >= connectedOnes && connected.Contains(r.IP) {
+			dm.logger.Info.Printf("Skipping route %s on device %s, it is covered by the connected route %s", r.String(), dm.Name(), connected)
+			continue
+		}
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+// leaseClient returns a client for the lease API of the server.
+func (p agentPeerConfig) leaseClient() *client.Client {
+	var tlsConfig *tls.Config
+	if p.clientCert != nil {
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{*p.clientCert}}
+	}
+	c := client.New(p.URL, tlsConfig)
+	if p.fwMark != 0 {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   markControl(p.fwMark),
+		}
+		transport.DialContext = dialer.DialContext
+		c.HTTPClient.Transport = transport
+	}
+	c.Path = p.LeasePath
+	if c.Path == "" {
+		c.Path = defaultLeasePath
+	}
+	c.Method = p.LeaseMethod
+	return c
+}
+
+// leaseURL returns the url that leases are requested from.
+func (p agentPeerConfig) leaseURL() (string, error) {
+	return p.leaseClient().LeaseURL()
 }
 
-func newWirestewardPeerConfigFromLeaseResponse(lr *leaseResponse) (*WirestewardPeerConfig, string, error) {
+func newWirestewardPeerConfigFromLeaseResponse(lr *leaseResponse, resolver resolverChain) (*WirestewardPeerConfig, string, error) {
 	ip, mask, err := net.ParseCIDR(lr.IP)
 	if err != nil {
 		return nil, "", err
 	}
 	address := &net.IPNet{IP: ip, Mask: mask.Mask}
-	pc, err := newPeerConfig(lr.PubKey, "", lr.Endpoint, lr.AllowedIPs)
+	endpoint := lr.Endpoint
+	if endpoint != "" {
+		if endpoint, err = resolver.resolveEndpoint(endpoint); err != nil {
+			return nil, "", fmt.Errorf("cannot resolve server endpoint: %w", err)
+		}
+	}
+	allowedIPs, routes, err := splitAllowedIPs(lr.AllowedIPs, lr.AllowedIPsFlags)
+	if err != nil {
+		return nil, "", err
+	}
+	pc, err := newPeerConfig(lr.PubKey, lr.PresharedKey, endpoint, allowedIPs)
+	if err != nil {
+		return nil, "", err
+	}
+	var prefix *net.IPNet
+	if lr.DelegatedPrefix != "" {
+		if _, prefix, err = net.ParseCIDR(lr.DelegatedPrefix); err != nil {
+			return nil, "", err
+		}
+	}
+	var address6 *net.IPNet
+	if lr.IP6 != "" {
+		ip6, mask6, err := net.ParseCIDR(lr.IP6)
+		if err != nil {
+			return nil, "", err
+		}
+		if ip6.To4() != nil {
+			return nil, "", fmt.Errorf("expected an IPv6 address, got: %s", lr.IP6)
+		}
+		address6 = &net.IPNet{IP: ip6, Mask: mask6.Mask}
+	}
+	dnsServers := make([]net.IP, len(lr.DNSServers))
+	for i, s := range lr.DNSServers {
+		if dnsServers[i] = net.ParseIP(s); dnsServers[i] == nil {
+			return nil, "", fmt.Errorf("invalid DNS server: %s", s)
+		}
+	}
+	// Search domains are passed on to system commands
+	for _, d := range lr.DNSSearchDomains {
+		if !validDNSDomain(d) {
+			return nil, "", fmt.Errorf("invalid DNS search domain: %q", d)
+		}
+	}
+	dnsRoutes, err := parseDNSRoutes(lr.DNSRoutes)
 	if err != nil {
 		return nil, "", err
 	}
 	return &WirestewardPeerConfig{
-		PeerConfig:   pc,
-		LocalAddress: address,
+		PeerConfig:      pc,
+		LocalAddress:    address,
+		LocalAddress6:   address6,
+		Expires:         lr.Expires,
+		RenewAfter:      lr.RenewAfter,
+		DelegatedPrefix: prefix,
+		Routes:          routes,
+		ControlURL:      lr.ControlURL,
+		DNSServers:      dnsServers,
+		SearchDomains:   lr.DNSSearchDomains,
+		DNSRoutes:       dnsRoutes,
+		MTU:             lr.MTU,
+		ConfigVersion:   lr.ConfigVersion,
+		ServerEndpoint:  lr.Endpoint,
 	}, lr.ServerWireguardIP, nil
 }
 
-func requestWirestewardPeerConfig(serverURL, token, publicKey string) (*WirestewardPeerConfig, string, error) {
-	// Marshal key into json
-	r, err := json.Marshal(&leaseRequest{PubKey: publicKey})
-	if err != nil {
-		return nil, "", err
+// verifiedLeaseClient returns the lease client of server, verifying the
+// signature of responses if the server signs them.
+func verifiedLeaseClient(server agentPeerConfig) (*client.Client, error) {
+	c := server.leaseClient()
+	if server.LeaseSigningPublicKey != "" {
+		pub, err := parseLeaseVerificationKey(server.LeaseSigningPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lease signing public key: %w", err)
+		}
+		c.VerifyResponse = func(h http.Header, body []byte) error {
+			return verifyLeaseSignature(pub, h, body)
+		}
 	}
+	return c, nil
+}
 
-	// Prepare the request
-	req, err := http.NewRequest(
-		"POST",
-		fmt.Sprintf("%s/newPeerLease", serverURL),
-		bytes.NewBuffer(r),
-	)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+token)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func requestWirestewardPeerConfig(server agentPeerConfig, token string, resolver resolverChain, lr *leaseRequest) (*WirestewardPeerConfig, string, error) {
+	c, err := verifiedLeaseClient(server)
 	if err != nil {
 		return nil, "", err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("Response status: %s", resp.Status)
-	}
-
-	body, err := io.ReadAll(resp.Body)
+	// Retries are left to the renewal loop of the device manager
+	response, err := c.Lease(context.Background(), token, lr)
 	if err != nil {
-		return nil, "", fmt.Errorf("error reading response body: %w,", err)
+		return nil, "", err
 	}
-
-	response := &leaseResponse{}
-	if err := json.Unmarshal(body, response); err != nil {
+	config, serverWireguardIP, err := newWirestewardPeerConfigFromLeaseResponse(response, resolver)
+	if err != nil {
 		return nil, "", err
 	}
-	return newWirestewardPeerConfigFromLeaseResponse(response)
+	if keepalive := server.PersistentKeepaliveInterval.Duration; keepalive > 0 {
+		config.PersistentKeepaliveInterval = &keepalive
+	}
+	return config, serverWireguardIP, nil
 }
@@ -24,7 +24,7 @@ func (dm *DeviceManager) updateDeviceConfig(oldConfig, config *WirestewardPeerCo
 	}
 	defer func() {
 		if err := unix.Close(fdInet); err != nil {
-			logger.Error.Printf(
+			dm.logger.Error.Printf(
 				"Could not close AF_INET socket: %v", err)
 		}
 	}()
@@ -34,7 +34,7 @@ func (dm *DeviceManager) updateDeviceConfig(oldConfig, config *WirestewardPeerCo
 	}
 	defer func() {
 		if err := unix.Close(fdRoute); err != nil {
-			logger.Error.Printf(
+			dm.logger.Error.Printf(
 				"Could not close AF_ROUTE socket: %v", err)
 		}
 	}()
@@ -44,9 +44,12 @@ func (dm *DeviceManager) updateDeviceConfig(oldConfig, config *WirestewardPeerCo
 		// removing the address below. We maintain this for consistency with the
 		// linux implementation and because it will be needed if we should to
 		// routes via interfaces.
-		for _, r := range oldConfig.AllowedIPs {
+		for _, r := range dm.installedRoutes(oldConfig) {
+			if r.IP.To4() == nil {
+				continue
+			}
 			if err := delRoute(fdRoute, oldConfig.LocalAddress.IP, r.IP, r.Mask); err != nil {
-				logger.Error.Printf(
+				dm.logger.Error.Printf(
 					"Could not remove old route (%s): %s",
 					r,
 					err,
@@ -54,25 +57,96 @@ func (dm *DeviceManager) updateDeviceConfig(oldConfig, config *WirestewardPeerCo
 			}
 		}
 		if err := deleteAddress(fdInet, dm.Name(), oldConfig.LocalAddress.IP); err != nil {
-			logger.Error.Printf(
+			dm.logger.Error.Printf(
 				"Could not remove old address: (%s): %s",
 				oldConfig.LocalAddress,
 				err,
 			)
 		}
+		if err := dm.removeIPv6Config(fdRoute, oldConfig); err != nil {
+			dm.logger.Error.Printf(
+				"Could not remove old address: (%s): %s",
+				oldConfig.LocalAddress6,
+				err,
+			)
+		}
+	}
+	if dm.egressInterface != "" {
+		dm.logger.Warn.Printf(
+			"Pinning the endpoint to interface %s is not supported on darwin, traffic will follow the default route",
+			dm.egressInterface,
+		)
 	}
 	if err := addAddress(fdInet, dm.Name(), config.LocalAddress.IP, config.LocalAddress.IP, config.LocalAddress.Mask); err != nil {
 		return err
 	}
-	for _, r := range config.AllowedIPs {
+	for _, r := range dm.installedRoutes(config) {
+		if r.IP.To4() == nil {
+			continue
+		}
 		if err := addRoute(fdRoute, config.LocalAddress.IP, r.IP, r.Mask); err != nil {
-			logger.Error.Printf(
+			dm.logger.Error.Printf(
 				"Could not add new route (%s): %s", r, err)
 		}
 	}
+	return dm.addIPv6Config(fdRoute, config)
+}
+
+// removeDeviceConfig removes the address and routes of config from the device.
+func (dm *DeviceManager) removeDeviceConfig(config *WirestewardPeerConfig) error {
+	fdInet, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fdInet)
+	fdRoute, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fdRoute)
+	for _, r := range dm.installedRoutes(config) {
+		if r.IP.To4() == nil {
+			continue
+		}
+		if err := delRoute(fdRoute, config.LocalAddress.IP, r.IP, r.Mask); err != nil {
+			dm.logger.Error.Printf("Could not remove route (%s): %s", r, err)
+		}
+	}
+	if err := dm.removeIPv6Config(fdRoute, config); err != nil {
+		dm.logger.Error.Printf("Could not remove address (%s): %s", config.LocalAddress6, err)
+	}
+	return deleteAddress(fdInet, dm.Name(), config.LocalAddress.IP)
+}
+
+func (dm *DeviceManager) applySysctls() {
+	if len(dm.sysctls) > 0 {
+		dm.logger.Warn.Printf("Interface sysctls are not supported on darwin, ignoring them for device %s", dm.Name())
+	}
+}
+
+func (dm *DeviceManager) restoreSysctls() {}
+
+func (dm *DeviceManager) setRouteMetric(metric int) error {
+	return fmt.Errorf("setting route metrics is not supported on darwin")
+}
+
+// Reconciling the device config is not supported on darwin, missing routes are
+// only restored when the lease is renewed.
+func (dm *DeviceManager) reconcileDeviceConfig(config *WirestewardPeerConfig) ([]string, error) {
+	return nil, nil
+}
+
+// The kill switch is not supported on darwin.
+func (dm *DeviceManager) disableKillSwitch() {}
+
+// Full tunnel mode is not supported on darwin, connections are not marked.
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
 	return nil
 }
 
+// Interface aliases are not supported on darwin.
+func (dm *DeviceManager) setAlias(alias string) {}
+
 // This is a no-op for darwin, the device seems to be ready on creation.
 func (dm *DeviceManager) ensureLinkUp() error {
 	return nil
@@ -220,3 +294,15 @@ func setRoute(fd int, tp int, addr []route.Addr) error {
 	}
 	return nil
 }
+
+// setDeviceMTU sets the mtu of the named device.
+func setDeviceMTU(device string, mtu int) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ifr := unix.IfreqMTU{MTU: int32(mtu)}
+	copy(ifr.Name[:], device)
+	return unix.IoctlSetIfreqMTU(fd, &ifr)
+}
@@ -3,7 +3,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 // updateDeviceConfig takes the old WirestewardPeerConfig (optionally) and the
@@ -13,49 +20,508 @@ import (
 func (dm *DeviceManager) updateDeviceConfig(oldConfig, config *WirestewardPeerConfig) error {
 	h := netlink.Handle{}
 	defer h.Delete()
-	link, err := h.LinkByName(dm.Name())
-	if err != nil {
+	var link netlink.Link
+	if err := dm.retryNetlink("get link", func() (err error) {
+		link, err = h.LinkByName(dm.Name())
+		return err
+	}); err != nil {
 		return err
 	}
 	if oldConfig != nil {
-		for _, r := range oldConfig.AllowedIPs {
-			if h.RouteDel(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: &r}); err != nil {
-				logger.Error.Printf(
-					"Could not remove old route (%s): %s",
-					r,
-					err,
-				)
-			}
+		if err := dm.flushRoutes(h, link); err != nil {
+			dm.logger.Error.Printf("Could not remove old routes: %s", err)
 		}
 		if err := h.AddrDel(link, &netlink.Addr{IPNet: oldConfig.LocalAddress}); err != nil {
-			logger.Error.Printf(
+			dm.logger.Error.Printf(
 				"Could not remove old address (%s): %s",
 				oldConfig.LocalAddress,
 				err,
 			)
 		}
+		if oldConfig.LocalAddress6 != nil {
+			if err := h.AddrDel(link, &netlink.Addr{IPNet: oldConfig.LocalAddress6}); err != nil {
+				dm.logger.Error.Printf(
+					"Could not remove old address (%s): %s",
+					oldConfig.LocalAddress6,
+					err,
+				)
+			}
+		}
 	}
-	if err := h.AddrAdd(link, &netlink.Addr{IPNet: config.LocalAddress}); err != nil {
+	if err := dm.retryNetlink("add address", func() error {
+		return h.AddrAdd(link, &netlink.Addr{IPNet: config.LocalAddress})
+	}); err != nil {
 		return err
 	}
-	for _, r := range config.AllowedIPs {
-		if err := h.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: &r, Gw: config.LocalAddress.IP}); err != nil {
-			logger.Error.Printf(
-				"Could not add new route (%s): %s", r, err)
+	if config.LocalAddress6 != nil {
+		if err := dm.retryNetlink("add address", func() error {
+			return h.AddrAdd(link, &netlink.Addr{IPNet: config.LocalAddress6})
+		}); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	routes := dm.deviceRoutes(link, config)
+	for i, err := range dm.installRoutes(routes, h.RouteReplace) {
+		if err != nil {
+			dm.logger.Error.Printf(
+				"Could not add new route (%s): %s", routes[i].Dst, err)
+		}
+	}
+	dm.metrics.gauge("route_apply_duration_seconds", time.Since(start).Seconds(), map[string]string{"device": dm.Name()})
+	if dm.fullTunnel != nil {
+		if err := dm.setupFullTunnel(h, config); err != nil {
+			return err
 		}
 	}
+	if dm.killSwitch != nil {
+		if err := dm.enableKillSwitch(config); err != nil {
+			dm.logger.Error.Printf("Could not enable kill switch of device %s: %s", dm.Name(), err)
+		}
+	}
+	if dm.egressInterface != "" {
+		dm.updateEndpointRoute(&h, oldConfig, config)
+	}
 	return nil
 }
 
-// TODO: confirm that this is still needed for linux after the switch to tun.
-func (dm *DeviceManager) ensureLinkUp() error {
+// deviceRoutes returns the routes to install on link for config.
+func (dm *DeviceManager) deviceRoutes(link netlink.Link, config *WirestewardPeerConfig) []*netlink.Route {
+	installed := dm.installedRoutes(config)
+	routes := make([]*netlink.Route, len(installed))
+	for i, r := range installed {
+		// IPv6 routes cannot use a local address as gateway, they are
+		// routed via the device only
+		var gw net.IP
+		if r.IP.To4() != nil {
+			gw = config.LocalAddress.IP
+		}
+		routes[i] = dm.newRoute(link, r, gw)
+		if dm.fullTunnel != nil && isDefaultRoute(r) {
+			routes[i].Table = dm.fullTunnel.Table
+		}
+	}
+	return routes
+}
+
+// endpointRouter is the subset of netlink.Handle used to pin the server
+// endpoint to the egress interface.
+type endpointRouter interface {
+	LinkByName(name string) (netlink.Link, error)
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+}
+
+// updateEndpointRoute moves the host route pinning the server endpoint to the
+// egress interface from the endpoint of oldConfig to the one of config.
+func (dm *DeviceManager) updateEndpointRoute(h endpointRouter, oldConfig, config *WirestewardPeerConfig) {
+	if oldConfig != nil && oldConfig.Endpoint != nil {
+		if err := dm.unpinEndpoint(h, oldConfig.Endpoint.IP); err != nil {
+			dm.logger.Error.Printf(
+				"Could not remove old endpoint route (%s): %s",
+				oldConfig.Endpoint.IP,
+				err,
+			)
+		}
+	}
+	if config.Endpoint != nil {
+		if err := dm.pinEndpoint(h, config.Endpoint.IP); err != nil {
+			dm.logger.Error.Printf(
+				"Could not pin endpoint %s to interface %s, traffic will follow the default route: %s",
+				config.Endpoint.IP,
+				dm.egressInterface,
+				err,
+			)
+		}
+	}
+}
+
+// pinEndpoint installs a host route to the server endpoint via the configured
+// egress interface, so that tunnel traffic deterministically uses it.
+func (dm *DeviceManager) pinEndpoint(h endpointRouter, endpoint net.IP) error {
+	link, err := h.LinkByName(dm.egressInterface)
+	if err != nil {
+		return err
+	}
+	routes, err := h.RouteList(link, routeFamily(endpoint))
+	if err != nil {
+		return err
+	}
+	route := endpointRoute(link, routes, endpoint, dm.routeProtocol)
+	dm.logger.Info.Printf(
+		"Pinning endpoint %s to interface %s (gateway: %s)",
+		endpoint,
+		dm.egressInterface,
+		route.Gw,
+	)
+	return dm.retryNetlink("add endpoint route", func() error {
+		return h.RouteReplace(route)
+	})
+}
+
+func (dm *DeviceManager) unpinEndpoint(h endpointRouter, endpoint net.IP) error {
+	link, err := h.LinkByName(dm.egressInterface)
+	if err != nil {
+		return err
+	}
+	return h.RouteDel(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       hostNet(endpoint),
+		Protocol:  dm.routeProtocol,
+	})
+}
+
+// endpointRoute returns a host route to endpoint via the gateway of the
+// default route of the same family found in the routes of link. If link has
+// no such default route, the returned route is scoped to the link without a
+// gateway, which works for point-to-point interfaces.
+func endpointRoute(link netlink.Link, routes []netlink.Route, endpoint net.IP, protocol int) *netlink.Route {
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       hostNet(endpoint),
+		Protocol:  protocol,
+		Scope:     netlink.SCOPE_LINK,
+	}
+	for _, r := range routes {
+		if r.Dst == nil && r.Gw != nil && routeFamily(r.Gw) == routeFamily(endpoint) {
+			route.Gw = r.Gw
+			route.Scope = netlink.SCOPE_UNIVERSE
+			break
+		}
+	}
+	return route
+}
+
+// routeFamily returns the netlink address family of ip.
+func routeFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// hostNet returns the single address network of ip.
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// removeDeviceConfig removes the address and routes of config from the device.
+func (dm *DeviceManager) removeDeviceConfig(config *WirestewardPeerConfig) error {
+	h := netlink.Handle{}
+	defer h.Delete()
+	link, err := h.LinkByName(dm.Name())
+	if err != nil {
+		return err
+	}
+	if err := dm.flushRoutes(h, link); err != nil {
+		return err
+	}
+	if dm.fullTunnel != nil {
+		dm.teardownFullTunnel(h)
+	}
+	if dm.killSwitch != nil {
+		dm.disableKillSwitch()
+	}
+	if config.LocalAddress6 != nil {
+		if err := h.AddrDel(link, &netlink.Addr{IPNet: config.LocalAddress6}); err != nil {
+			dm.logger.Error.Printf("Could not remove address (%s): %s", config.LocalAddress6, err)
+		}
+	}
+	return h.AddrDel(link, &netlink.Addr{IPNet: config.LocalAddress})
+}
+
+// newRoute returns a route via the device, tagged with the configured route
+// protocol.
+func (dm *DeviceManager) newRoute(link netlink.Link, dst net.IPNet, gw net.IP) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &dst,
+		Gw:        gw,
+		Protocol:  dm.routeProtocol,
+		Priority:  dm.routeMetric,
+		Scope:     netlink.SCOPE_UNIVERSE,
+	}
+}
+
+// setRouteMetric changes the metric of the routes installed for the device.
+// Routes with the new metric are added before the old ones are removed.
+func (dm *DeviceManager) setRouteMetric(metric int) error {
+	dm.configMutex.Lock()
+	defer dm.configMutex.Unlock()
+	old := dm.routeMetric
+	dm.routeMetric = metric
+	if dm.config == nil || old == metric {
+		return nil
+	}
 	h := netlink.Handle{}
 	defer h.Delete()
 	link, err := h.LinkByName(dm.Name())
 	if err != nil {
 		return err
 	}
-	return h.LinkSetUp(link)
+	return dm.changeRouteMetric(dm.deviceRoutes(link, dm.config), old, h.RouteReplace, h.RouteDel)
+}
+
+// changeRouteMetric adds routes and then removes the routes with the old
+// metric they replace. A stale route is only removed once its replacement
+// has been added, so that its destination is never left without a route.
+func (dm *DeviceManager) changeRouteMetric(routes []*netlink.Route, old int, replace, del func(*netlink.Route) error) error {
+	var err error
+	for i, addErr := range dm.installRoutes(routes, replace) {
+		if addErr != nil {
+			if err == nil {
+				err = addErr
+			}
+			continue
+		}
+		stale := *routes[i]
+		stale.Priority = old
+		if err := del(&stale); err != nil {
+			dm.logger.Error.Printf("Could not remove route (%s) with metric %d: %s", stale.Dst, old, err)
+		}
+	}
+	return err
+}
+
+// installRoutes adds routes using replace, running up to dm.routeWorkers
+// netlink operations concurrently, and returns once all of them are done.
+// The returned errors are indexed like routes, nil for the ones that were
+// added.
+func (dm *DeviceManager) installRoutes(routes []*netlink.Route, replace func(*netlink.Route) error) []error {
+	errs := make([]error, len(routes))
+	workers := dm.routeWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, route := range routes {
+		i, route := i, route
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = dm.retryNetlink("add route", func() error {
+				return replace(route)
+			})
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// flushRoutes removes all the routes of the device that carry the configured
+// route protocol, leaving routes added by others untouched.
+func (dm *DeviceManager) flushRoutes(h netlink.Handle, link netlink.Link) error {
+	routes, err := dm.linkRoutes(h, link)
+	if err != nil {
+		return err
+	}
+	for _, r := range filterRoutesByProtocol(routes, dm.routeProtocol) {
+		if err := h.RouteDel(&r); err != nil {
+			dm.logger.Error.Printf("Could not remove route (%s): %s", r.Dst, err)
+		}
+	}
+	return nil
+}
+
+// reconcileDeviceConfig adds back the addresses and routes of config that
+// are missing from the device, for example after another daemon flushed them,
+// and returns a description of each repair.
+func (dm *DeviceManager) reconcileDeviceConfig(config *WirestewardPeerConfig) ([]string, error) {
+	h := netlink.Handle{}
+	defer h.Delete()
+	link, err := h.LinkByName(dm.Name())
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := h.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := dm.linkRoutes(h, link)
+	if err != nil {
+		return nil, err
+	}
+	var repaired []string
+	for _, a := range missingAddresses(config, addrs) {
+		if err := h.AddrAdd(link, &netlink.Addr{IPNet: a}); err != nil {
+			return repaired, fmt.Errorf("cannot restore address %s: %w", a, err)
+		}
+		repaired = append(repaired, fmt.Sprintf("address %s", a))
+	}
+	// Removing an address also removes the routes via it, so routes are
+	// only listed once addresses are in place
+	if len(repaired) > 0 {
+		if routes, err = dm.linkRoutes(h, link); err != nil {
+			return repaired, err
+		}
+	}
+	for _, r := range missingRoutes(dm.deviceRoutes(link, config), filterRoutesByProtocol(routes, dm.routeProtocol)) {
+		if err := h.RouteReplace(r); err != nil {
+			return repaired, fmt.Errorf("cannot restore route %s: %w", r.Dst, err)
+		}
+		repaired = append(repaired, fmt.Sprintf("route %s", r.Dst))
+	}
+	return repaired, nil
+}
+
+// missingAddresses returns the local addresses of config that are not in
+// addrs.
+func missingAddresses(config *WirestewardPeerConfig, addrs []netlink.Addr) []*net.IPNet {
+	var missing []*net.IPNet
+	for _, want := range []*net.IPNet{config.LocalAddress, config.LocalAddress6} {
+		if want == nil {
+			continue
+		}
+		found := false
+		for _, a := range addrs {
+			if a.IPNet != nil && a.IPNet.String() == want.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, want)
+		}
+	}
+	return missing
+}
+
+// missingRoutes returns the routes of want whose destination is not in
+// installed.
+func missingRoutes(want []*netlink.Route, installed []netlink.Route) []*netlink.Route {
+	have := make(map[string]bool, len(installed))
+	for _, r := range installed {
+		if r.Dst != nil {
+			have[r.Dst.String()] = true
+		}
+	}
+	var missing []*netlink.Route
+	for _, r := range want {
+		if !have[r.Dst.String()] {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
+
+func filterRoutesByProtocol(routes []netlink.Route, protocol int) []netlink.Route {
+	var ret []netlink.Route
+	for _, r := range routes {
+		if r.Protocol == protocol {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// applySysctls writes the configured interface sysctls, remembering their
+// previous values. Failures are logged and do not prevent the device from
+// running.
+func (dm *DeviceManager) applySysctls() {
+	if len(dm.sysctls) == 0 {
+		return
+	}
+	dm.sysctlDefaults = make(map[string]string)
+	for key, value := range dm.sysctls {
+		path, err := interfaceSysctlPath(dm.Name(), key)
+		if err != nil {
+			dm.logger.Error.Printf("Not applying sysctl: %v", err)
+			continue
+		}
+		old, err := readSysctl(path)
+		if err != nil {
+			dm.logger.Error.Printf("Cannot read sysctl %s: %v", key, err)
+			continue
+		}
+		if err := writeSysctl(path, value); err != nil {
+			dm.logger.Error.Printf("Cannot set sysctl %s=%s: %v", key, value, err)
+			continue
+		}
+		dm.sysctlDefaults[path] = old
+		dm.logger.Info.Printf("Set sysctl %s=%s (was: %s)", key, value, old)
+	}
+}
+
+// restoreSysctls restores the values of the sysctls changed by applySysctls.
+func (dm *DeviceManager) restoreSysctls() {
+	for path, value := range dm.sysctlDefaults {
+		if err := writeSysctl(path, value); err != nil {
+			dm.logger.Error.Printf("Cannot restore sysctl %s=%s: %v", path, value, err)
+		}
+	}
+	dm.sysctlDefaults = nil
+}
+
+// setAlias sets the interface alias of the device, an empty alias clears it.
+// Failures are logged as the alias is only informational.
+func (dm *DeviceManager) setAlias(alias string) {
+	h := netlink.Handle{}
+	defer h.Delete()
+	if err := dm.retryNetlink("set link alias", func() error {
+		link, err := h.LinkByName(dm.Name())
+		if err != nil {
+			return err
+		}
+		return h.LinkSetAlias(link, alias)
+	}); err != nil {
+		dm.logger.Error.Printf("Cannot set alias of device %s: %v", dm.Name(), err)
+	}
+}
+
+// TODO: confirm that this is still needed for linux after the switch to tun.
+func (dm *DeviceManager) ensureLinkUp() error {
+	h := netlink.Handle{}
+	defer h.Delete()
+	return dm.retryNetlink("set link up", func() error {
+		link, err := h.LinkByName(dm.Name())
+		if err != nil {
+			return err
+		}
+		return h.LinkSetUp(link)
+	})
+}
+
+// retryNetlink calls f until it succeeds, up to the configured number of
+// attempts, as long as it fails with a transient error. EEXIST errors are
+// considered successful, to make adding addresses and routes idempotent.
+func (dm *DeviceManager) retryNetlink(op string, f func() error) error {
+	return retryNetlink(op, dm.netlinkRetryAttempts, dm.netlinkRetryDelay, f)
+}
+
+func retryNetlink(op string, attempts int, delay time.Duration, f func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+		}
+		err = f()
+		switch {
+		case err == nil, errors.Is(err, unix.EEXIST):
+			return nil
+		case errors.Is(err, unix.EPERM):
+			return fmt.Errorf("%s: %w (is the agent running with CAP_NET_ADMIN?)", op, err)
+		case !isTransientNetlinkError(err):
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		logger.Debug.Printf("%s failed with a transient error, retrying: %v", op, err)
+	}
+	return fmt.Errorf("%s: giving up after %d attempts: %w", op, attempts, err)
+}
+
+func isTransientNetlinkError(err error) bool {
+	return errors.Is(err, unix.EBUSY) ||
+		errors.Is(err, unix.EAGAIN) ||
+		errors.Is(err, unix.EINTR) ||
+		errors.Is(err, unix.ENOBUFS)
 }
 
 func (dm *DeviceManager) flushAddresses() error {
@@ -74,3 +540,15 @@ func (dm *DeviceManager) flushAddresses() error {
 	}
 	return nil
 }
+
+// setDeviceMTU sets the mtu of the named device. wireguard-go picks up mtu
+// changes of tun devices from netlink.
+func setDeviceMTU(device string, mtu int) error {
+	h := netlink.Handle{}
+	defer h.Delete()
+	link, err := h.LinkByName(device)
+	if err != nil {
+		return err
+	}
+	return h.LinkSetMTU(link, mtu)
+}
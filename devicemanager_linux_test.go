@@ -0,0 +1,549 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestDeviceManager_RouteProtocol(t *testing.T) {
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", RouteProtocol: 42}, "")
+	link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "wg_test", Index: 7}}
+	_, dst, _ := net.ParseCIDR("10.10.0.0/16")
+
+	r := dm.newRoute(link, *dst, net.ParseIP("10.0.0.2"))
+	assert.Equal(t, 42, r.Protocol)
+	assert.Equal(t, 7, r.LinkIndex)
+
+	// Only routes carrying our protocol should be selected for cleanup
+	routes := []netlink.Route{
+		*r,
+		{LinkIndex: 7, Dst: dst, Protocol: 2},
+		{LinkIndex: 7, Dst: dst, Protocol: 4},
+	}
+	owned := filterRoutesByProtocol(routes, dm.routeProtocol)
+	assert.Equal(t, []netlink.Route{*r}, owned)
+}
+
+func TestDeviceManager_DeviceRoutes(t *testing.T) {
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "wg_test", Index: 7}}
+	config, _, err := newWirestewardPeerConfigFromLeaseResponse(&leaseResponse{
+		IP:         "10.0.0.2/32",
+		PubKey:     validPublicKey,
+		AllowedIPs: []string{"10.10.0.0/16", "10.30.0.0/16", "10.40.0.0/16"},
+		AllowedIPsFlags: map[string]string{
+			"10.30.0.0/16": allowedIPFlagCrypto,
+			"10.40.0.0/16": allowedIPFlagRoute,
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsts := []string{}
+	for _, r := range dm.deviceRoutes(link, config) {
+		assert.Equal(t, 7, r.LinkIndex)
+		assert.Equal(t, "10.0.0.2", r.Gw.String())
+		dsts = append(dsts, r.Dst.String())
+	}
+	// Crypto only entries should not be routed
+	assert.Equal(t, []string{"10.10.0.0/16", "10.40.0.0/16"}, dsts)
+}
+
+func TestDeviceManager_DeviceRoutesDualStack(t *testing.T) {
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "wg_test", Index: 7}}
+	config, _, err := newWirestewardPeerConfigFromLeaseResponse(&leaseResponse{
+		IP:         "10.0.0.2/32",
+		IP6:        "fd00:77::a00:2/128",
+		PubKey:     validPublicKey,
+		AllowedIPs: []string{"10.10.0.0/16", "fd00:10::/48"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "fd00:77::a00:2/128", config.LocalAddress6.String())
+	routes := dm.deviceRoutes(link, config)
+	assert.Equal(t, 2, len(routes))
+	assert.Equal(t, "10.10.0.0/16", routes[0].Dst.String())
+	assert.Equal(t, "10.0.0.2", routes[0].Gw.String())
+	// IPv6 routes are routed via the device, without a gateway
+	assert.Equal(t, "fd00:10::/48", routes[1].Dst.String())
+	assert.Nil(t, routes[1].Gw)
+}
+
+func TestDeviceManager_DeviceRoutesConnected(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "wg_test", Index: 7}}
+	config, _, err := newWirestewardPeerConfigFromLeaseResponse(&leaseResponse{
+		IP:         "10.99.0.5/24",
+		PubKey:     validPublicKey,
+		AllowedIPs: []string{"10.99.0.0/24", "10.99.0.128/25", "10.99.0.0/16", "10.10.0.0/16"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsts := func(dm *DeviceManager) []string {
+		ret := []string{}
+		for _, r := range dm.deviceRoutes(link, config) {
+			ret = append(ret, r.Dst.String())
+		}
+		return ret
+	}
+
+	// Networks covered by the connected route of the address are skipped,
+	// while they are still allowed IPs of the peer
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	assert.Equal(t, []string{"10.99.0.0/16", "10.10.0.0/16"}, dsts(dm))
+	assert.Equal(t, 4, len(config.AllowedIPs))
+
+	dm = newDeviceManager(agentDeviceConfig{Name: "wg_test", InstallConnectedRoutes: true}, "")
+	assert.Equal(t, []string{"10.99.0.0/24", "10.99.0.128/25", "10.99.0.0/16", "10.10.0.0/16"}, dsts(dm))
+}
+
+// largeRouteSet returns routes via link to n /32 destinations.
+func largeRouteSet(dm *DeviceManager, link netlink.Link, n int) []*netlink.Route {
+	routes := make([]*netlink.Route, n)
+	for i := range routes {
+		dst := net.IPNet{IP: net.IPv4(10, 100, byte(i>>8), byte(i)), Mask: net.CIDRMask(32, 32)}
+		routes[i] = dm.newRoute(link, dst, net.ParseIP("10.0.0.2"))
+	}
+	return routes
+}
+
+func TestDeviceManager_InstallRoutes(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", RouteWorkers: 4}, "")
+	link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "wg_test", Index: 7}}
+	routes := largeRouteSet(dm, link, 1000)
+
+	var mutex sync.Mutex
+	installed := map[string]bool{}
+	running, maxRunning := 0, 0
+	errs := dm.installRoutes(routes, func(r *netlink.Route) error {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		time.Sleep(10 * time.Microsecond)
+		mutex.Lock()
+		defer mutex.Unlock()
+		running--
+		if r.Dst.IP.Equal(net.IPv4(10, 100, 0, 42)) {
+			return unix.EPERM
+		}
+		installed[r.Dst.String()] = true
+		return nil
+	})
+	assert.Equal(t, 999, len(installed))
+	assert.LessOrEqual(t, maxRunning, 4)
+	for i, err := range errs {
+		if i == 42 {
+			assert.True(t, errors.Is(err, unix.EPERM))
+			continue
+		}
+		assert.NoError(t, err)
+		assert.True(t, installed[routes[i].Dst.String()])
+	}
+}
+
+func TestDeviceManager_ChangeRouteMetric(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	dm.routeMetric = 200
+	link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "wg_test", Index: 7}}
+	routes := largeRouteSet(dm, link, 500)
+
+	var mutex sync.Mutex
+	ops := []string{}
+	record := func(op string) func(*netlink.Route) error {
+		return func(r *netlink.Route) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if op == "add" && r.Dst.IP.Equal(net.IPv4(10, 100, 0, 7)) {
+				return unix.EPERM
+			}
+			ops = append(ops, fmt.Sprintf("%s %s %d", op, r.Dst, r.Priority))
+			return nil
+		}
+	}
+	err := dm.changeRouteMetric(routes, 100, record("add"), record("del"))
+	assert.True(t, errors.Is(err, unix.EPERM))
+
+	// Every stale route is removed after its replacement was added, and
+	// routes that could not be replaced are kept
+	added := map[string]int{}
+	for i, op := range ops {
+		var verb, dst string
+		var metric int
+		fmt.Sscanf(op, "%s %s %d", &verb, &dst, &metric)
+		if verb == "add" {
+			assert.Equal(t, 200, metric)
+			added[dst] = i
+			continue
+		}
+		assert.Equal(t, 100, metric)
+		j, ok := added[dst]
+		assert.True(t, ok, "%s removed before it was replaced", dst)
+		assert.Less(t, j, i)
+	}
+	assert.Equal(t, 499, len(added))
+	assert.Equal(t, 2*499, len(ops))
+	assert.NotContains(t, added, "10.100.0.7/32")
+}
+
+func BenchmarkDeviceManager_InstallRoutes(b *testing.B) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "wg_test", Index: 7}}
+	// Simulate the latency of a netlink round trip
+	replace := func(r *netlink.Route) error {
+		time.Sleep(50 * time.Microsecond)
+		return nil
+	}
+	for _, workers := range []int{1, defaultRouteWorkers} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", RouteWorkers: workers}, "")
+			routes := largeRouteSet(dm, link, 500)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dm.installRoutes(routes, replace)
+			}
+		})
+	}
+}
+
+func TestDeviceManager_DefaultRouteProtocol(t *testing.T) {
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	assert.Equal(t, defaultRouteProtocol, dm.routeProtocol)
+}
+
+func TestRetryNetlink(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	// A transient error should be retried until the operation succeeds
+	calls := 0
+	err := retryNetlink("test", 3, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return unix.EBUSY
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	// A permanent error should fail immediately
+	calls = 0
+	err = retryNetlink("test", 3, time.Millisecond, func() error {
+		calls++
+		return unix.EPERM
+	})
+	assert.True(t, errors.Is(err, unix.EPERM))
+	assert.Equal(t, 1, calls)
+
+	// EEXIST should be treated as success
+	calls = 0
+	err = retryNetlink("test", 3, time.Millisecond, func() error {
+		calls++
+		return unix.EEXIST
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	// Transient errors should give up after the configured attempts
+	calls = 0
+	err = retryNetlink("test", 2, time.Millisecond, func() error {
+		calls++
+		return unix.EAGAIN
+	})
+	assert.True(t, errors.Is(err, unix.EAGAIN))
+	assert.Equal(t, 2, calls)
+}
+
+func TestEndpointRoute(t *testing.T) {
+	link := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", Index: 3}}
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	routes := []netlink.Route{
+		{LinkIndex: 3, Dst: lan},
+		{LinkIndex: 3, Gw: net.ParseIP("192.168.1.1")},
+	}
+	endpoint := net.ParseIP("1.2.3.4")
+
+	r := endpointRoute(link, routes, endpoint, defaultRouteProtocol)
+	assert.Equal(t, 3, r.LinkIndex)
+	assert.Equal(t, "1.2.3.4/32", r.Dst.String())
+	assert.True(t, r.Gw.Equal(net.ParseIP("192.168.1.1")))
+	assert.Equal(t, defaultRouteProtocol, r.Protocol)
+
+	// Without a default route, the route should be scoped to the link
+	r = endpointRoute(link, routes[:1], endpoint, defaultRouteProtocol)
+	assert.Nil(t, r.Gw)
+	assert.Equal(t, netlink.SCOPE_LINK, r.Scope)
+
+	// IPv6 endpoints should be pinned via the IPv6 default route only
+	routes = append(routes, netlink.Route{LinkIndex: 3, Gw: net.ParseIP("fe80::1")})
+	endpoint = net.ParseIP("2001:db8::4")
+	r = endpointRoute(link, routes, endpoint, defaultRouteProtocol)
+	assert.Equal(t, "2001:db8::4/128", r.Dst.String())
+	assert.True(t, r.Gw.Equal(net.ParseIP("fe80::1")))
+	assert.Equal(t, netlink.SCOPE_UNIVERSE, r.Scope)
+
+	r = endpointRoute(link, routes[:2], endpoint, defaultRouteProtocol)
+	assert.Nil(t, r.Gw)
+	assert.Equal(t, netlink.SCOPE_LINK, r.Scope)
+}
+
+// fakeEndpointRouter keeps the routes of a single link in memory.
+type fakeEndpointRouter struct {
+	link   netlink.Link
+	routes []netlink.Route
+}
+
+func (f *fakeEndpointRouter) LinkByName(name string) (netlink.Link, error) {
+	if name != f.link.Attrs().Name {
+		return nil, netlink.LinkNotFoundError{}
+	}
+	return f.link, nil
+}
+
+func (f *fakeEndpointRouter) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	var routes []netlink.Route
+	for _, r := range f.routes {
+		ip := r.Gw
+		if r.Dst != nil {
+			ip = r.Dst.IP
+		}
+		if r.LinkIndex == link.Attrs().Index && routeFamily(ip) == family {
+			routes = append(routes, r)
+		}
+	}
+	return routes, nil
+}
+
+func (f *fakeEndpointRouter) RouteReplace(route *netlink.Route) error {
+	if err := f.RouteDel(route); err != nil && !errors.Is(err, unix.ESRCH) {
+		return err
+	}
+	f.routes = append(f.routes, *route)
+	return nil
+}
+
+func (f *fakeEndpointRouter) RouteDel(route *netlink.Route) error {
+	for i, r := range f.routes {
+		if r.LinkIndex == route.LinkIndex && r.Dst != nil && r.Dst.String() == route.Dst.String() {
+			f.routes = append(f.routes[:i], f.routes[i+1:]...)
+			return nil
+		}
+	}
+	return unix.ESRCH
+}
+
+// pinnedRoutes returns the host routes of f by destination.
+func (f *fakeEndpointRouter) pinnedRoutes() map[string]string {
+	pinned := map[string]string{}
+	for _, r := range f.routes {
+		if r.Dst != nil {
+			pinned[r.Dst.String()] = r.Gw.String()
+		}
+	}
+	return pinned
+}
+
+func TestDeviceManager_UpdateEndpointRoute(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", EgressInterface: "eth1"}, "")
+	router := &fakeEndpointRouter{
+		link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", Index: 3}},
+		routes: []netlink.Route{
+			{LinkIndex: 3, Gw: net.ParseIP("192.168.1.1")},
+			{LinkIndex: 3, Gw: net.ParseIP("fe80::1")},
+		},
+	}
+	lease := func(endpoint string) *WirestewardPeerConfig {
+		return &WirestewardPeerConfig{
+			PeerConfig: &wgtypes.PeerConfig{
+				Endpoint: &net.UDPAddr{IP: net.ParseIP(endpoint), Port: 51820},
+			},
+		}
+	}
+
+	// Acquiring a lease pins the endpoint via the IPv4 gateway
+	first := lease("1.2.3.4")
+	dm.updateEndpointRoute(router, nil, first)
+	assert.Equal(t, map[string]string{"1.2.3.4/32": "192.168.1.1"}, router.pinnedRoutes())
+
+	// Renewing against the same endpoint keeps a single route
+	renewed := lease("1.2.3.4")
+	dm.updateEndpointRoute(router, first, renewed)
+	assert.Equal(t, map[string]string{"1.2.3.4/32": "192.168.1.1"}, router.pinnedRoutes())
+
+	// Failing over to an IPv6 endpoint moves the route and its gateway
+	failover := lease("2001:db8::4")
+	dm.updateEndpointRoute(router, renewed, failover)
+	assert.Equal(t, map[string]string{"2001:db8::4/128": "fe80::1"}, router.pinnedRoutes())
+
+	// Moving back to an IPv4 endpoint removes the IPv6 route
+	dm.updateEndpointRoute(router, failover, lease("5.6.7.8"))
+	assert.Equal(t, map[string]string{"5.6.7.8/32": "192.168.1.1"}, router.pinnedRoutes())
+}
+
+func TestDeviceManager_Sysctls(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	root := t.TempDir()
+	defer func(r string) { sysctlRoot = r }(sysctlRoot)
+	sysctlRoot = root
+	for _, dir := range []string{"net/ipv4/conf/wg_test", "net/ipv6/conf/wg_test"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, value := range map[string]string{
+		"net/ipv4/conf/wg_test/rp_filter":    "1",
+		"net/ipv6/conf/wg_test/disable_ipv6": "1",
+	} {
+		if err := os.WriteFile(filepath.Join(root, path), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dm := newDeviceManager(agentDeviceConfig{
+		Name: "wg_test",
+		Sysctls: map[string]string{
+			"net.ipv4.conf.wg_test.rp_filter":    "2",
+			"net.ipv6.conf.wg_test.disable_ipv6": "0",
+			// Not interface scoped, should be ignored
+			"net.ipv4.ip_forward": "1",
+		},
+	}, "")
+	dm.applySysctls()
+	v, _ := readSysctl("net/ipv4/conf/wg_test/rp_filter")
+	assert.Equal(t, "2", v)
+	v, _ = readSysctl("net/ipv6/conf/wg_test/disable_ipv6")
+	assert.Equal(t, "0", v)
+	_, err := os.Stat(filepath.Join(root, "net/ipv4/ip_forward"))
+	assert.True(t, os.IsNotExist(err))
+
+	dm.restoreSysctls()
+	v, _ = readSysctl("net/ipv4/conf/wg_test/rp_filter")
+	assert.Equal(t, "1", v)
+	v, _ = readSysctl("net/ipv6/conf/wg_test/disable_ipv6")
+	assert.Equal(t, "1", v)
+}
+
+func TestInterfaceSysctlPath(t *testing.T) {
+	path, err := interfaceSysctlPath("eth0.100", "net.ipv4.conf.eth0.100.rp_filter")
+	assert.NoError(t, err)
+	assert.Equal(t, "net/ipv4/conf/eth0.100/rp_filter", path)
+	for _, key := range []string{
+		"net.ipv4.ip_forward",
+		"net.ipv4.conf.all.rp_filter",
+		"net.ipv4.conf.wg0.",
+		"net.ipv4.conf.wg0.rp_filter/../../all",
+	} {
+		_, err := interfaceSysctlPath("wg0", key)
+		assert.Error(t, err, key)
+	}
+}
+
+func TestMissingRoutes(t *testing.T) {
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", RouteProtocol: 42}, "")
+	link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "wg_test", Index: 7}}
+	_, dst1, _ := net.ParseCIDR("10.10.0.0/16")
+	_, dst2, _ := net.ParseCIDR("10.20.0.0/16")
+	_, dst6, _ := net.ParseCIDR("fd00:10::/64")
+	want := []*netlink.Route{
+		dm.newRoute(link, *dst1, net.ParseIP("10.0.0.2")),
+		dm.newRoute(link, *dst2, net.ParseIP("10.0.0.2")),
+		dm.newRoute(link, *dst6, nil),
+	}
+	installed := []netlink.Route{*want[0], {Dst: nil}}
+	missing := missingRoutes(want, installed)
+	assert.Equal(t, []*netlink.Route{want[1], want[2]}, missing)
+	assert.Empty(t, missingRoutes(want, []netlink.Route{*want[0], *want[1], *want[2]}))
+}
+
+func TestMissingAddresses(t *testing.T) {
+	ip, addr, _ := net.ParseCIDR("10.0.0.2/24")
+	addr.IP = ip
+	ip6, addr6, _ := net.ParseCIDR("fd00::2/64")
+	addr6.IP = ip6
+	config := &WirestewardPeerConfig{LocalAddress: addr, LocalAddress6: addr6}
+	assert.Equal(t, []*net.IPNet{addr, addr6}, missingAddresses(config, nil))
+	assert.Equal(t, []*net.IPNet{addr6}, missingAddresses(config, []netlink.Addr{{IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: addr.Mask}}}))
+	config.LocalAddress6 = nil
+	assert.Empty(t, missingAddresses(config, []netlink.Addr{{IPNet: addr}}))
+}
+
+func TestDeviceManager_FullTunnelRoutes(t *testing.T) {
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", FullTunnel: &agentFullTunnelConfig{}}, "")
+	link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "wg_test", Index: 7}}
+	_, address, _ := net.ParseCIDR("10.0.0.2/32")
+	_, network, _ := net.ParseCIDR("10.10.0.0/16")
+	config := &WirestewardPeerConfig{
+		PeerConfig:   &wgtypes.PeerConfig{},
+		LocalAddress: address,
+		Routes:       []net.IPNet{*network},
+	}
+	addDefaultRoutes(config)
+	routes := dm.deviceRoutes(link, config)
+	assert.Equal(t, 2, len(routes))
+	// Only the default route goes to the full tunnel table
+	assert.Equal(t, 0, routes[0].Table)
+	assert.Equal(t, "0.0.0.0/0", routes[1].Dst.String())
+	assert.Equal(t, defaultFullTunnelTable, routes[1].Table)
+
+	rules := fullTunnelRules(dm.fullTunnel, netlink.FAMILY_V4)
+	assert.Equal(t, defaultFullTunnelTable, rules[0].Table)
+	assert.Equal(t, defaultFullTunnelFwMark, rules[0].Mark)
+	assert.True(t, rules[0].Invert)
+	assert.Equal(t, unix.RT_TABLE_MAIN, rules[1].Table)
+	assert.Equal(t, 0, rules[1].SuppressPrefixlen)
+}
+
+func TestMarkControl(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	d := net.Dialer{Control: markControl(0x1234)}
+	conn, err := d.Dial("tcp", l.Addr().String())
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("setting the firewall mark requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	assert.NoError(t, rc.Control(func(fd uintptr) {
+		mark, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, 0x1234, mark)
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestDeviceManager_AuthRefreshKeepsLease(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			http.Error(w, "invalid token", http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(&leaseResponse{
+			Status:     "success",
+			IP:         "10.0.0.2/32",
+			AllowedIPs: validAllowedIPs,
+			PubKey:     validPublicKey,
+			Endpoint:   "1.1.1.1:1111",
+			Expires:    time.Now().Add(time.Hour),
+		})
+	}))
+	defer ts.Close()
+	server := agentPeerConfig{URL: ts.URL}
+
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", Peers: []agentPeerConfig{server}}, "")
+	dm.events = newEventQueue(defaultEventQueueSize)
+	dm.cachedToken = "expired"
+	current := &WirestewardPeerConfig{
+		LocalAddress: &net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(32, 32)},
+		Expires:      time.Now().Add(time.Minute),
+	}
+	dm.config = current
+	// The token source fails on the first attempt and refreshes the token on
+	// the second one
+	refreshes := 0
+	dm.tokens = newTokenCache(func(force bool) (string, error) {
+		assert.True(t, force)
+		refreshes++
+		if refreshes < 2 {
+			return "", fmt.Errorf("idp unavailable")
+		}
+		return "fresh", nil
+	}, 0)
+
+	lr := &leaseRequest{PubKey: validPublicKey}
+	_, _, err := requestWirestewardPeerConfig(server, dm.cachedToken, nil, lr)
+	assert.True(t, errors.Is(err, errLeaseUnauthorized))
+	assert.Equal(t, renewRetryInterval, dm.handleRenewError(err))
+	assert.Equal(t, current, dm.config)
+
+	_, _, err = requestWirestewardPeerConfig(server, dm.cachedToken, nil, lr)
+	assert.True(t, errors.Is(err, errLeaseUnauthorized))
+	assert.Equal(t, 2*renewRetryInterval, dm.handleRenewError(err))
+	assert.Equal(t, current, dm.config)
+
+	config, _, err := requestWirestewardPeerConfig(server, dm.cachedToken, nil, lr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2/32", config.LocalAddress.String())
+	assert.False(t, config.Expires.IsZero())
+
+	for i := 0; i < 2; i++ {
+		e := <-dm.events.Events()
+		assert.Equal(t, eventAuthRefreshPending, e.Type)
+		assert.Equal(t, "wg_test", e.Device)
+	}
+}
+
+func TestDeviceManager_RequestPeerConfigRefreshesRejectedToken(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(&leaseResponse{
+			Status:     "success",
+			IP:         "10.0.0.2/32",
+			AllowedIPs: validAllowedIPs,
+			PubKey:     validPublicKey,
+			Endpoint:   "1.1.1.1:1111",
+		})
+	}))
+	defer ts.Close()
+	server := agentPeerConfig{URL: ts.URL}
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", Peers: []agentPeerConfig{server}}, "")
+	dm.cachedToken = "expired"
+	refreshed := "fresh"
+	dm.tokens = newTokenCache(func(force bool) (string, error) {
+		assert.True(t, force)
+		if refreshed == "" {
+			return "", fmt.Errorf("refresh token revoked")
+		}
+		return refreshed, nil
+	}, 0)
+	lr := &leaseRequest{PubKey: validPublicKey}
+
+	config, _, err := dm.requestPeerConfig(server, lr)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2/32", config.LocalAddress.String())
+	assert.Equal(t, "fresh", dm.cachedToken)
+	assert.Equal(t, 2, requests)
+
+	// The error is only surfaced once the token cannot be refreshed
+	dm.cachedToken = "expired"
+	refreshed = ""
+	_, _, err = dm.requestPeerConfig(server, lr)
+	assert.True(t, errors.Is(err, errLeaseUnauthorized))
+	assert.Equal(t, "expired", dm.cachedToken)
+	assert.Equal(t, 3, requests)
+
+	// The agent can replace the token while a renewal uses it
+	refreshed = "fresh"
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dm.setToken("fresh")
+	}()
+	_, _, err = dm.requestPeerConfig(server, lr)
+	assert.NoError(t, err)
+	<-done
+	assert.Equal(t, "fresh", dm.token())
+}
+
+func TestDeviceAlias(t *testing.T) {
+	cfg := agentDeviceConfig{
+		Name: "wg_test",
+		Peers: []agentPeerConfig{
+			{URL: "https://wiresteward.example.com"},
+			{URL: "https://wiresteward2.example.com"},
+		},
+	}
+	assert.Equal(t, "wiresteward: https://wiresteward.example.com https://wiresteward2.example.com", deviceAlias(cfg))
+	cfg.Alias = "london office"
+	dm := newDeviceManager(cfg, "")
+	assert.Equal(t, "london office", dm.alias)
+	cfg.Alias = strings.Repeat("x", 300)
+	assert.Equal(t, maxDeviceAliasLength, len(deviceAlias(cfg)))
+}
+
+func TestDeviceManager_DrainPeer(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{
+		Name:            "wg_test",
+		PeerDrainPeriod: duration{50 * time.Millisecond},
+	}, "")
+	removed := make(chan wgtypes.Key, 1)
+	dm.removePeer = func(deviceName string, key wgtypes.Key) error {
+		removed <- key
+		return nil
+	}
+	oldPeer, _ := newPeerConfig(validPublicKey, "", "", validAllowedIPs)
+	newPeer, _ := newPeerConfig("E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=", "", "", validAllowedIPs)
+	existing := []wgtypes.Peer{{PublicKey: oldPeer.PublicKey}}
+
+	// The replaced peer should linger while draining
+	dm.drainPeer(oldPeer.PublicKey)
+	peers := reconcilePeers(existing, []wgtypes.PeerConfig{*newPeer}, dm.drainingPeerKeys())
+	assert.Equal(t, 1, len(peers))
+	assert.Equal(t, newPeer.PublicKey, peers[0].PublicKey)
+
+	// and be removed once the drain period is over
+	select {
+	case key := <-removed:
+		assert.Equal(t, oldPeer.PublicKey, key)
+	case <-time.After(time.Second):
+		t.Fatal("drained peer was not removed")
+	}
+	peers = reconcilePeers(existing, []wgtypes.PeerConfig{*newPeer}, dm.drainingPeerKeys())
+	assert.Equal(t, 2, len(peers))
+	assert.Equal(t, oldPeer.PublicKey, peers[1].PublicKey)
+	assert.True(t, peers[1].Remove)
+
+	// Peers that are used again should not be removed
+	dm.drainPeer(oldPeer.PublicKey)
+	dm.undrainPeer(oldPeer.PublicKey)
+	select {
+	case <-removed:
+		t.Fatal("undrained peer was removed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDeviceManager_Logger(t *testing.T) {
+	defer setLogFormat("text")
+	setLogFormat("json")
+	setLogLevel("info")
+	defer setLogLevel("error")
+	buf := &bytes.Buffer{}
+	logger = newLoggerTo(buf, "wiresteward")
+	dm := newDeviceManager(agentDeviceConfig{
+		Name:            "wg_test",
+		PeerDrainPeriod: duration{time.Hour},
+	}, "")
+	key, _ := wgtypes.ParseKey(validPublicKey)
+	dm.drainPeer(key)
+	defer dm.undrainPeer(key)
+
+	line := map[string]string{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	delete(line, "time")
+	assert.Equal(t, map[string]string{
+		"level":     "info",
+		"component": "wiresteward",
+		"device":    "wg_test",
+		"peer":      validPublicKey,
+		"msg":       "Draining peer of device wg_test for 1h0m0s",
+	}, line)
+}
+
+func TestDeviceManager_CoexistPeerManagement(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	foreign := newWgKey()
+	// peers holds the peers of a fake device, starting with one managed by
+	// another tool
+	var peers map[wgtypes.Key]bool
+	device := func(name string) (*wgtypes.Device, error) {
+		dev := &wgtypes.Device{Name: name}
+		for key := range peers {
+			dev.Peers = append(dev.Peers, wgtypes.Peer{PublicKey: key})
+		}
+		return dev, nil
+	}
+	configure := func(name string, cfg wgtypes.Config) error {
+		assert.False(t, cfg.ReplacePeers)
+		for _, p := range cfg.Peers {
+			if p.Remove {
+				delete(peers, p.PublicKey)
+			} else {
+				peers[p.PublicKey] = true
+			}
+		}
+		return nil
+	}
+	newConfig := func(pubKey string) *WirestewardPeerConfig {
+		peer, err := newPeerConfig(pubKey, "", "", validAllowedIPs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &WirestewardPeerConfig{PeerConfig: peer}
+	}
+	first := newConfig(validPublicKey)
+	second := newConfig(newWgKey().String())
+
+	for _, mode := range []string{peerManagementCoexist, peerManagementExclusive} {
+		peers = map[wgtypes.Key]bool{foreign: true}
+		dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", PeerManagement: mode}, "")
+		dm.agentDevice = &fakeAgentDevice{name: "wg_test"}
+		dm.wireguardDevice = device
+		dm.configureDevice = configure
+		dm.removePeer = func(name string, key wgtypes.Key) error {
+			return configure(name, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: key, Remove: true}}})
+		}
+
+		// The agent configures its peer, then replaces it on renewal
+		assert.NoError(t, dm.setPeer(nil, first))
+		assert.True(t, peers[first.PublicKey])
+		assert.NoError(t, dm.setPeer(first, second))
+		dm.config = second
+		assert.False(t, peers[first.PublicKey])
+		assert.True(t, peers[second.PublicKey])
+		dm.Stop()
+
+		if mode == peerManagementExclusive {
+			assert.False(t, peers[foreign], "foreign peer should be removed in exclusive mode")
+			continue
+		}
+		// The foreign peer survives the whole lifecycle, and the peer of
+		// the agent is removed when it stops
+		assert.True(t, peers[foreign], "foreign peer should be kept in coexist mode")
+		assert.False(t, peers[second.PublicKey])
+	}
+}
+
+func TestDeviceManager_StopKeepDevice(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	removed := []wgtypes.Key{}
+	for _, keep := range []bool{false, true} {
+		removed = removed[:0]
+		dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", KeepDevice: keep}, "")
+		dm.agentDevice = &fakeAgentDevice{name: "wg_test"}
+		dm.removePeer = func(name string, key wgtypes.Key) error {
+			removed = append(removed, key)
+			return nil
+		}
+		peer, err := newPeerConfig(validPublicKey, "", "", validAllowedIPs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dm.config = &WirestewardPeerConfig{PeerConfig: peer}
+		dm.Stop()
+		if !keep {
+			// The configuration goes along with the device
+			assert.Empty(t, removed)
+			assert.NotNil(t, dm.config)
+			continue
+		}
+		assert.Equal(t, []wgtypes.Key{peer.PublicKey}, removed)
+		assert.Nil(t, dm.config)
+	}
+}
+
+func TestDeviceManager_RenewAfterStop(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	dm.agentDevice = &fakeAgentDevice{name: "wg_test"}
+	dm.scheduleRenewal(time.Now().Add(time.Hour))
+	dm.Stop()
+	assert.Nil(t, dm.renewTimer)
+	// Stopping again, eg. on shutdown after the device was brought down,
+	// does nothing
+	dm.Stop()
+
+	// Nothing reads renewal requests once stopped, they must not block
+	done := make(chan struct{})
+	go func() {
+		dm.RenewTokenAndLease("token")
+		dm.triggerRenewal()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("renewal blocked after the device manager was stopped")
+	}
+}
+
+func TestDeviceManager_UpdateMTU(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	set := []int{}
+	setMTU := func(name string, mtu int) error {
+		set = append(set, mtu)
+		return nil
+	}
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	dm.setMTU = setMTU
+	dm.updateMTU(nil, &WirestewardPeerConfig{})
+	dm.updateMTU(nil, &WirestewardPeerConfig{MTU: 1380})
+	dm.updateMTU(&WirestewardPeerConfig{MTU: 1380}, &WirestewardPeerConfig{MTU: 1380})
+	dm.updateMTU(&WirestewardPeerConfig{MTU: 1380}, &WirestewardPeerConfig{MTU: 1360})
+	assert.Equal(t, []int{1380, 1360}, set)
+
+	// Mtus out of bounds are ignored
+	set = set[:0]
+	for _, mtu := range []int{68, 1279, 9001, 65535} {
+		dm.updateMTU(&WirestewardPeerConfig{MTU: 1360}, &WirestewardPeerConfig{MTU: mtu})
+	}
+	dm.updateMTU(&WirestewardPeerConfig{MTU: 1360}, &WirestewardPeerConfig{MTU: 9000})
+	assert.Equal(t, []int{9000}, set)
+
+	// The mtu of the device config takes precedence
+	set = set[:0]
+	dm = newDeviceManager(agentDeviceConfig{Name: "wg_test", MTU: 1400}, "")
+	dm.setMTU = setMTU
+	dm.updateMTU(nil, &WirestewardPeerConfig{MTU: 1380})
+	assert.Empty(t, set)
+}
+
+func TestRequestWirestewardPeerConfig_LeasePath(t *testing.T) {
+	var gotMethod, gotPath string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		json.NewEncoder(w).Encode(&leaseResponse{
+			Status:     "success",
+			IP:         "10.0.0.2/32",
+			AllowedIPs: validAllowedIPs,
+			PubKey:     validPublicKey,
+			Endpoint:   "1.1.1.1:1111",
+		})
+	}))
+	defer ts.Close()
+	lr := &leaseRequest{PubKey: validPublicKey}
+
+	_, _, err := requestWirestewardPeerConfig(agentPeerConfig{URL: ts.URL}, "token", nil, lr)
+	assert.NoError(t, err)
+	assert.Equal(t, "POST", gotMethod)
+	assert.Equal(t, "/newPeerLease", gotPath)
+
+	server := agentPeerConfig{URL: ts.URL + "/gateway/", LeasePath: "/api/v1/vpn/lease", LeaseMethod: "PUT"}
+	_, _, err = requestWirestewardPeerConfig(server, "token", nil, lr)
+	assert.NoError(t, err)
+	assert.Equal(t, "PUT", gotMethod)
+	assert.Equal(t, "/gateway/api/v1/vpn/lease", gotPath)
+
+	// Keepalives default to 25s and can be set per server
+	config, _, err := requestWirestewardPeerConfig(agentPeerConfig{URL: ts.URL}, "token", nil, lr)
+	assert.NoError(t, err)
+	assert.Equal(t, 25*time.Second, *config.PersistentKeepaliveInterval)
+	server = agentPeerConfig{URL: ts.URL, PersistentKeepaliveInterval: duration{10 * time.Second}}
+	config, _, err = requestWirestewardPeerConfig(server, "token", nil, lr)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, *config.PersistentKeepaliveInterval)
+
+	for _, path := range []string{"api/lease", "/lease?x=1", "//evil.example.com/lease"} {
+		_, err := agentPeerConfig{URL: ts.URL, LeasePath: path}.leaseURL()
+		assert.Error(t, err, path)
+	}
+}
+
+func TestDeviceManager_ProbeDevice(t *testing.T) {
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	dm.wireguardDevice = func(name string) (*wgtypes.Device, error) {
+		return &wgtypes.Device{Name: name}, nil
+	}
+	assert.NoError(t, dm.probeDevice())
+
+	// The link exists but wgctrl cannot find a wireguard device with its name,
+	// as when the generic netlink family is not available
+	dm.wireguardDevice = func(name string) (*wgtypes.Device, error) {
+		return nil, os.ErrNotExist
+	}
+	dm.linkExists = func(name string) bool { return true }
+	err := dm.probeDevice()
+	assert.True(t, errors.Is(err, errDeviceNotConfigurable))
+	assert.Contains(t, err.Error(), "kernel module")
+
+	dm.wireguardDevice = func(name string) (*wgtypes.Device, error) {
+		return nil, os.ErrPermission
+	}
+	err = dm.probeDevice()
+	assert.True(t, errors.Is(err, errDeviceNotConfigurable))
+	assert.Contains(t, err.Error(), "CAP_NET_ADMIN")
+
+	dm.linkExists = func(name string) bool { return false }
+	err = dm.probeDevice()
+	assert.True(t, errors.Is(err, errDeviceAbsent))
+	assert.False(t, errors.Is(err, errDeviceNotConfigurable))
+}
+
+func TestNewWirestewardPeerConfig_AllowedIPsFlags(t *testing.T) {
+	lr := &leaseResponse{
+		IP:         "10.0.0.2/32",
+		PubKey:     validPublicKey,
+		AllowedIPs: []string{"10.10.0.0/16", "10.20.0.0/16", "10.30.0.0/16", "10.40.0.0/16"},
+		AllowedIPsFlags: map[string]string{
+			"10.20.0.0/16": allowedIPFlagBoth,
+			"10.30.0.0/16": allowedIPFlagCrypto,
+			"10.40.0.0/16": allowedIPFlagRoute,
+		},
+	}
+	config, _, err := newWirestewardPeerConfigFromLeaseResponse(lr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowedIPs := []string{}
+	for _, a := range config.AllowedIPs {
+		allowedIPs = append(allowedIPs, a.String())
+	}
+	routes := []string{}
+	for _, r := range config.Routes {
+		routes = append(routes, r.String())
+	}
+	// Entries without flags are both added to the peer and routed
+	assert.Equal(t, []string{"10.10.0.0/16", "10.20.0.0/16", "10.30.0.0/16"}, allowedIPs)
+	assert.Equal(t, []string{"10.10.0.0/16", "10.20.0.0/16", "10.40.0.0/16"}, routes)
+
+	lr.AllowedIPsFlags["10.10.0.0/16"] = "unknown"
+	_, _, err = newWirestewardPeerConfigFromLeaseResponse(lr, nil)
+	assert.Error(t, err)
+}
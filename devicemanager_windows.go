@@ -0,0 +1,228 @@
+// +build windows
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// updateDeviceConfig takes the old WirestewardPeerConfig (optionally) and the
+// desired, new config and performs the necessary operations to setup the IP
+// address and routing table routes. If an "old" config is provided, it will
+// attempt to clean up any system configuration before applying the new one.
+func (dm *DeviceManager) updateDeviceConfig(oldConfig, config *WirestewardPeerConfig) error {
+	if oldConfig != nil {
+		for _, r := range dm.deviceRoutes(oldConfig) {
+			if err := deleteRoute(dm.Name(), r); err != nil {
+				dm.logger.Error.Printf(
+					"Could not remove old route (%s): %s",
+					r,
+					err,
+				)
+			}
+		}
+		if err := deleteAddress(dm.Name(), oldConfig.LocalAddress.IP); err != nil {
+			dm.logger.Error.Printf(
+				"Could not remove old address (%s): %s",
+				oldConfig.LocalAddress,
+				err,
+			)
+		}
+		if oldConfig.LocalAddress6 != nil {
+			if err := deleteAddress(dm.Name(), oldConfig.LocalAddress6.IP); err != nil {
+				dm.logger.Error.Printf(
+					"Could not remove old address (%s): %s",
+					oldConfig.LocalAddress6,
+					err,
+				)
+			}
+		}
+	}
+	if dm.egressInterface != "" {
+		dm.logger.Warn.Printf(
+			"Pinning the endpoint to interface %s is not supported on windows, traffic will follow the default route",
+			dm.egressInterface,
+		)
+	}
+	if err := addAddress(dm.Name(), config.LocalAddress); err != nil {
+		return err
+	}
+	if config.LocalAddress6 != nil {
+		if err := addAddress(dm.Name(), config.LocalAddress6); err != nil {
+			return err
+		}
+	}
+	for _, r := range dm.deviceRoutes(config) {
+		if err := addRoute(dm.Name(), r, dm.routeMetric); err != nil {
+			dm.logger.Error.Printf(
+				"Could not add new route (%s): %s", r, err)
+		}
+	}
+	return nil
+}
+
+// deviceRoutes returns the routes to install on the device for config. IPv6
+// routes are skipped if no IPv6 address was leased.
+func (dm *DeviceManager) deviceRoutes(config *WirestewardPeerConfig) []net.IPNet {
+	routes := []net.IPNet{}
+	for _, r := range dm.installedRoutes(config) {
+		if r.IP.To4() == nil && config.LocalAddress6 == nil {
+			dm.logger.Error.Printf("No IPv6 address leased for device %s, ignoring route %s", dm.Name(), r.String())
+			continue
+		}
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+// removeDeviceConfig removes the address and routes of config from the device.
+func (dm *DeviceManager) removeDeviceConfig(config *WirestewardPeerConfig) error {
+	for _, r := range dm.deviceRoutes(config) {
+		if err := deleteRoute(dm.Name(), r); err != nil {
+			dm.logger.Error.Printf("Could not remove route (%s): %s", r, err)
+		}
+	}
+	if config.LocalAddress6 != nil {
+		if err := deleteAddress(dm.Name(), config.LocalAddress6.IP); err != nil {
+			dm.logger.Error.Printf("Could not remove address (%s): %s", config.LocalAddress6, err)
+		}
+	}
+	return deleteAddress(dm.Name(), config.LocalAddress.IP)
+}
+
+// setRouteMetric changes the metric of the routes installed for the device.
+func (dm *DeviceManager) setRouteMetric(metric int) error {
+	dm.configMutex.Lock()
+	defer dm.configMutex.Unlock()
+	old := dm.routeMetric
+	dm.routeMetric = metric
+	if dm.config == nil || old == metric {
+		return nil
+	}
+	var err error
+	for _, r := range dm.deviceRoutes(dm.config) {
+		if setErr := setRouteMetric(dm.Name(), r, metric); setErr != nil && err == nil {
+			err = setErr
+		}
+	}
+	return err
+}
+
+func (dm *DeviceManager) applySysctls() {
+	if len(dm.sysctls) > 0 {
+		dm.logger.Warn.Printf("Interface sysctls are not supported on windows, ignoring them for device %s", dm.Name())
+	}
+}
+
+func (dm *DeviceManager) restoreSysctls() {}
+
+// Reconciling the device config is not supported on windows, missing routes are
+// only restored when the lease is renewed.
+func (dm *DeviceManager) reconcileDeviceConfig(config *WirestewardPeerConfig) ([]string, error) {
+	return nil, nil
+}
+
+// The kill switch is not supported on windows.
+func (dm *DeviceManager) disableKillSwitch() {}
+
+// Full tunnel mode is not supported on windows, connections are not marked.
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// Interface aliases are not supported on windows.
+func (dm *DeviceManager) setAlias(alias string) {}
+
+// This is a no-op for windows, the wintun adapter is up on creation.
+func (dm *DeviceManager) ensureLinkUp() error {
+	return nil
+}
+
+// netsh runs the netsh command with args. Changes are made with store=active,
+// so that nothing outlives a reboot if the agent is not stopped cleanly.
+func netsh(args ...string) error {
+	return runCommand("", "netsh", args...)
+}
+
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+func addAddress(name string, addr *net.IPNet) error {
+	if addr.IP.To4() != nil {
+		ones, _ := addr.Mask.Size()
+		return netsh(
+			"interface", "ipv4", "add", "address",
+			"name="+name,
+			"address="+addr.IP.String(),
+			"mask="+net.IP(net.CIDRMask(ones, 32)).String(),
+			"store=active",
+		)
+	}
+	return netsh(
+		"interface", "ipv6", "add", "address",
+		"interface="+name,
+		"address="+addr.String(),
+		"store=active",
+	)
+}
+
+func deleteAddress(name string, addr net.IP) error {
+	if addr.To4() != nil {
+		return netsh("interface", "ipv4", "delete", "address", "name="+name, "address="+addr.String(), "store=active")
+	}
+	return netsh("interface", "ipv6", "delete", "address", "interface="+name, "address="+addr.String(), "store=active")
+}
+
+// Routes are on-link, there is no gateway on the point to point tun device.
+func addRoute(name string, dst net.IPNet, metric int) error {
+	return netsh(
+		"interface", ipFamily(dst.IP), "add", "route",
+		"prefix="+dst.String(),
+		"interface="+name,
+		"metric="+strconv.Itoa(metric),
+		"store=active",
+	)
+}
+
+func deleteRoute(name string, dst net.IPNet) error {
+	return netsh(
+		"interface", ipFamily(dst.IP), "delete", "route",
+		"prefix="+dst.String(),
+		"interface="+name,
+		"store=active",
+	)
+}
+
+func setRouteMetric(name string, dst net.IPNet, metric int) error {
+	return netsh(
+		"interface", ipFamily(dst.IP), "set", "route",
+		"prefix="+dst.String(),
+		"interface="+name,
+		"metric="+strconv.Itoa(metric),
+		"store=active",
+	)
+}
+
+// setDeviceMTU sets the mtu of the named device, for both address families.
+// IPv6 requires an mtu of at least 1280, smaller ones are only set for IPv4.
+func setDeviceMTU(device string, mtu int) error {
+	for _, family := range []string{"ipv4", "ipv6"} {
+		if family == "ipv6" && mtu < 1280 {
+			continue
+		}
+		if err := netsh(
+			"interface", family, "set", "subinterface", device,
+			"mtu="+strconv.Itoa(mtu),
+			"store=active",
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/utilitywarehouse/wiresteward/client"
+)
+
+// dnsRoute sends the queries for names under domains to servers, through the
+// tunnel, for split DNS.
+type dnsRoute struct {
+	domains []string
+	servers []net.IP
+}
+
+func (r dnsRoute) String() string {
+	return fmt.Sprintf("%s -> %v", strings.Join(r.domains, ","), r.servers)
+}
+
+// parseDNSRoutes parses the DNS routes of a lease response.
+func parseDNSRoutes(routes []client.DNSRoute) ([]dnsRoute, error) {
+	var parsed []dnsRoute
+	for _, r := range routes {
+		for _, d := range r.Domains {
+			if !validDNSDomain(d) {
+				return nil, fmt.Errorf("invalid DNS route domain: %q", d)
+			}
+		}
+		route := dnsRoute{domains: r.Domains}
+		for _, s := range r.Servers {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid DNS server: %s", s)
+			}
+			route.servers = append(route.servers, ip)
+		}
+		parsed = append(parsed, route)
+	}
+	return parsed, nil
+}
+
+// validDNSDomain returns whether d only consists of the characters of domain
+// names, as it is passed on to system commands.
+func validDNSDomain(d string) bool {
+	if d == "" {
+		return false
+	}
+	for _, c := range d {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// dnsRouteServers returns the servers of routes, without duplicates.
+func dnsRouteServers(routes []dnsRoute) []net.IP {
+	var servers []net.IP
+	seen := map[string]bool{}
+	for _, r := range routes {
+		for _, s := range r.servers {
+			if !seen[s.String()] {
+				seen[s.String()] = true
+				servers = append(servers, s)
+			}
+		}
+	}
+	return servers
+}
+
+// updateDNS applies the DNS servers, search domains and routes of config to
+// the system, unless they are the same as the ones of oldConfig that are
+// already applied. The previous DNS configuration is restored if config has
+// none.
+func (dm *DeviceManager) updateDNS(oldConfig, config *WirestewardPeerConfig) {
+	if dm.ignoreDNS {
+		return
+	}
+	if len(config.DNSServers) == 0 && len(config.SearchDomains) == 0 && len(config.DNSRoutes) == 0 {
+		dm.restoreDNS()
+		return
+	}
+	if dm.dnsApplied && oldConfig != nil && sameDNS(oldConfig, config) {
+		return
+	}
+	dm.logger.Info.Printf(
+		"Setting DNS servers %v, search domains %v and routes %v for device %s",
+		config.DNSServers,
+		config.SearchDomains,
+		config.DNSRoutes,
+		dm.Name(),
+	)
+	if err := dm.setDNS(dm.Name(), config.DNSServers, config.SearchDomains, config.DNSRoutes); err != nil {
+		dm.logger.Error.Printf("Cannot set DNS configuration for device %s: %v", dm.Name(), err)
+		return
+	}
+	dm.dnsApplied = true
+}
+
+// restoreDNS restores the DNS configuration of the system from before the
+// one of the lease was applied.
+func (dm *DeviceManager) restoreDNS() {
+	if !dm.dnsApplied {
+		return
+	}
+	dm.logger.Info.Printf("Restoring DNS configuration for device %s", dm.Name())
+	if err := dm.revertDNS(dm.Name()); err != nil {
+		dm.logger.Error.Printf("Cannot restore DNS configuration for device %s: %v", dm.Name(), err)
+	}
+	dm.dnsApplied = false
+}
+
+func sameDNS(a, b *WirestewardPeerConfig) bool {
+	if len(a.DNSServers) != len(b.DNSServers) || len(a.SearchDomains) != len(b.SearchDomains) || len(a.DNSRoutes) != len(b.DNSRoutes) {
+		return false
+	}
+	for i := range a.DNSServers {
+		if !a.DNSServers[i].Equal(b.DNSServers[i]) {
+			return false
+		}
+	}
+	for i := range a.SearchDomains {
+		if a.SearchDomains[i] != b.SearchDomains[i] {
+			return false
+		}
+	}
+	for i := range a.DNSRoutes {
+		if a.DNSRoutes[i].String() != b.DNSRoutes[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// resolvConf returns the resolv.conf(5) lines for servers and domains.
+func resolvConf(servers []net.IP, domains []string) string {
+	var b strings.Builder
+	for _, s := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	if len(domains) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(domains, " "))
+	}
+	return b.String()
+}
+
+// runCommand runs name with args, feeding stdin to it. The output of the
+// command is only of interest when it fails, it is then part of the error.
+func runCommand(stdin string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
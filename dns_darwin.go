@@ -0,0 +1,50 @@
+// +build darwin
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// dnsStoreKey is the key of the dynamic store that the DNS configuration of
+// device is published under.
+func dnsStoreKey(device string) string {
+	return fmt.Sprintf("State:/Network/Service/wiresteward-%s/DNS", device)
+}
+
+// setDeviceDNS publishes the DNS servers, search domains and routes of device
+// with scutil. The configuration of the primary network service is left
+// untouched, the servers are consulted for names under the search domains and
+// the domains of routes.
+func setDeviceDNS(device string, servers []net.IP, domains []string, routes []dnsRoute) error {
+	var b strings.Builder
+	b.WriteString("d.init\n")
+	all := dnsRouteServers(append([]dnsRoute{{servers: servers}}, routes...))
+	if len(all) > 0 {
+		addrs := make([]string, len(all))
+		for i, s := range all {
+			addrs[i] = s.String()
+		}
+		fmt.Fprintf(&b, "d.add ServerAddresses * %s\n", strings.Join(addrs, " "))
+	}
+	if len(domains) > 0 {
+		fmt.Fprintf(&b, "d.add SearchDomains * %s\n", strings.Join(domains, " "))
+	}
+	match := append([]string{}, domains...)
+	for _, r := range routes {
+		match = append(match, r.domains...)
+	}
+	if len(match) > 0 {
+		fmt.Fprintf(&b, "d.add SupplementalMatchDomains * %s\n", strings.Join(match, " "))
+	}
+	fmt.Fprintf(&b, "set %s\n", dnsStoreKey(device))
+	return runCommand(b.String(), "scutil")
+}
+
+// revertDeviceDNS removes the DNS configuration of device from the dynamic
+// store.
+func revertDeviceDNS(device string) error {
+	return runCommand(fmt.Sprintf("remove %s\n", dnsStoreKey(device)), "scutil")
+}
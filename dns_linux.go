@@ -0,0 +1,64 @@
+// +build linux
+
+package main
+
+import (
+	"net"
+	"os/exec"
+	"strconv"
+)
+
+// setDeviceDNS sets the DNS servers, search domains and routes of device in
+// systemd-resolved, which scopes them to the device and drops them when it is
+// deleted. The domains of routes are set as routing-only domains, and unless
+// there are servers for every name the device is only used for them. If
+// resolvectl is not available, the servers and search domains are registered
+// for the device with resolvconf instead, which cannot route domains.
+func setDeviceDNS(device string, servers []net.IP, domains []string, routes []dnsRoute) error {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		if len(routes) > 0 {
+			logger.Warn.Printf("DNS routes require systemd-resolved, ignoring them for device %s", device)
+		}
+		if len(servers) == 0 && len(domains) == 0 {
+			return nil
+		}
+		return runCommand(resolvConf(servers, domains), "resolvconf", "-a", device)
+	}
+	// An empty argument clears the respective setting
+	all := dnsRouteServers(append([]dnsRoute{{servers: servers}}, routes...))
+	args := []string{"dns", device}
+	for _, s := range all {
+		args = append(args, s.String())
+	}
+	if len(all) == 0 {
+		args = append(args, "")
+	}
+	if err := runCommand("", "resolvectl", args...); err != nil {
+		return err
+	}
+	args = append([]string{"domain", device}, domains...)
+	for _, r := range routes {
+		for _, d := range r.domains {
+			args = append(args, "~"+d)
+		}
+	}
+	if len(args) == 2 {
+		args = append(args, "")
+	}
+	if err := runCommand("", "resolvectl", args...); err != nil {
+		return err
+	}
+	if len(routes) == 0 {
+		return nil
+	}
+	return runCommand("", "resolvectl", "default-route", device, strconv.FormatBool(len(servers) > 0))
+}
+
+// revertDeviceDNS drops the DNS configuration of device, restoring the one of
+// the system.
+func revertDeviceDNS(device string) error {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return runCommand("", "resolvconf", "-d", device)
+	}
+	return runCommand("", "resolvectl", "revert", device)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/wiresteward/client"
+)
+
+func TestDeviceManager_UpdateDNS(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	var applied []string
+	reverts := 0
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	var appliedRoutes [][]dnsRoute
+	dm.setDNS = func(device string, servers []net.IP, domains []string, routes []dnsRoute) error {
+		applied = append(applied, resolvConf(servers, domains))
+		appliedRoutes = append(appliedRoutes, routes)
+		return nil
+	}
+	dm.revertDNS = func(device string) error {
+		reverts++
+		return nil
+	}
+
+	// Leases without DNS configuration leave the system untouched
+	dm.updateDNS(nil, &WirestewardPeerConfig{})
+	dm.restoreDNS()
+	assert.Empty(t, applied)
+	assert.Equal(t, 0, reverts)
+
+	config := &WirestewardPeerConfig{
+		DNSServers:    []net.IP{net.ParseIP("10.0.0.1")},
+		SearchDomains: []string{"example.com"},
+	}
+	dm.updateDNS(nil, config)
+	assert.Equal(t, []string{"nameserver 10.0.0.1\nsearch example.com\n"}, applied)
+
+	// Renewals with the same configuration are not reapplied
+	renewed := *config
+	dm.updateDNS(config, &renewed)
+	assert.Len(t, applied, 1)
+
+	changed := renewed
+	changed.DNSServers = []net.IP{net.ParseIP("10.0.0.2")}
+	dm.updateDNS(&renewed, &changed)
+	assert.Len(t, applied, 2)
+
+	dm.updateDNS(&changed, &WirestewardPeerConfig{})
+	assert.Equal(t, 1, reverts)
+	dm.restoreDNS()
+	assert.Equal(t, 1, reverts)
+
+	// Routes alone are applied, and reapplied when they change
+	routed := &WirestewardPeerConfig{DNSRoutes: []dnsRoute{{domains: []string{"corp.example.com"}, servers: []net.IP{net.ParseIP("10.0.0.1")}}}}
+	dm.updateDNS(nil, routed)
+	assert.Len(t, applied, 3)
+	assert.Equal(t, routed.DNSRoutes, appliedRoutes[2])
+	rerouted := &WirestewardPeerConfig{DNSRoutes: []dnsRoute{{domains: []string{"corp.example.com"}, servers: []net.IP{net.ParseIP("10.0.0.2")}}}}
+	dm.updateDNS(routed, rerouted)
+	assert.Len(t, applied, 4)
+	dm.updateDNS(rerouted, rerouted)
+	assert.Len(t, applied, 4)
+
+	dm.ignoreDNS = true
+	dm.updateDNS(nil, config)
+	assert.Len(t, applied, 4)
+}
+
+func TestParseDNSRoutes(t *testing.T) {
+	routes, err := parseDNSRoutes([]client.DNSRoute{
+		{Domains: []string{"corp.example.com", "example.internal"}, Servers: []string{"10.0.0.1", "fd00::1"}},
+		{Domains: []string{"lab.example.com"}, Servers: []string{"10.0.0.1"}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, routes, 2)
+	assert.Equal(t, "corp.example.com,example.internal -> [10.0.0.1 fd00::1]", routes[0].String())
+	assert.Equal(t, "[10.0.0.1 fd00::1]", fmt.Sprint(dnsRouteServers(routes)))
+
+	_, err = parseDNSRoutes([]client.DNSRoute{{Domains: []string{"corp.example.com"}, Servers: []string{"foo"}}})
+	assert.Error(t, err)
+	_, err = parseDNSRoutes([]client.DNSRoute{{Domains: []string{"corp'; rm"}, Servers: []string{"10.0.0.1"}}})
+	assert.Error(t, err)
+}
+
+func TestNewWirestewardPeerConfig_DNS(t *testing.T) {
+	lr := &leaseResponse{
+		IP:               "10.0.0.2/32",
+		PubKey:           validPublicKey,
+		DNSServers:       []string{"10.0.0.1", "fd00::1"},
+		DNSSearchDomains: []string{"example.com"},
+	}
+	config, _, err := newWirestewardPeerConfigFromLeaseResponse(lr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.1", config.DNSServers[0].String())
+	assert.Equal(t, "fd00::1", config.DNSServers[1].String())
+	assert.Equal(t, []string{"example.com"}, config.SearchDomains)
+
+	lr.DNSServers = []string{"foo"}
+	_, _, err = newWirestewardPeerConfigFromLeaseResponse(lr, nil)
+	assert.Error(t, err)
+
+	lr.DNSServers = []string{"10.0.0.1"}
+	lr.DNSSearchDomains = []string{"example.com\nd.add ServerAddresses * 6.6.6.6"}
+	_, _, err = newWirestewardPeerConfigFromLeaseResponse(lr, nil)
+	assert.Error(t, err)
+}
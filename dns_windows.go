@@ -0,0 +1,75 @@
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// nrptComment tags the name resolution policy table rules of device.
+func nrptComment(device string) string {
+	return "wiresteward-" + device
+}
+
+// setDeviceDNS sets the DNS servers of device with netsh, and adds a rule to
+// the name resolution policy table for every route. Search domains are not
+// supported on windows.
+func setDeviceDNS(device string, servers []net.IP, domains []string, routes []dnsRoute) error {
+	if len(domains) > 0 {
+		logger.Warn.Printf("DNS search domains are not supported on windows, ignoring them for device %s", device)
+	}
+	if err := revertDeviceDNS(device); err != nil {
+		return err
+	}
+	for i, s := range servers {
+		if err := netsh(
+			"interface", ipFamily(s), "add", "dnsservers",
+			"name="+device,
+			"address="+s.String(),
+			"index="+strconv.Itoa(i+1),
+			"validate=no",
+		); err != nil {
+			return err
+		}
+	}
+	for _, r := range routes {
+		namespaces := make([]string, len(r.domains))
+		for i, d := range r.domains {
+			namespaces[i] = "'." + d + "'"
+		}
+		addrs := make([]string, len(r.servers))
+		for i, s := range r.servers {
+			addrs[i] = "'" + s.String() + "'"
+		}
+		if err := powershell(fmt.Sprintf(
+			"Add-DnsClientNrptRule -Namespace %s -NameServers %s -Comment '%s'",
+			strings.Join(namespaces, ","),
+			strings.Join(addrs, ","),
+			nrptComment(device),
+		)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revertDeviceDNS removes the DNS servers and name resolution policy table
+// rules of device.
+func revertDeviceDNS(device string) error {
+	for _, family := range []string{"ipv4", "ipv6"} {
+		if err := netsh("interface", family, "delete", "dnsservers", "name="+device, "address=all", "validate=no"); err != nil {
+			return err
+		}
+	}
+	return powershell(fmt.Sprintf(
+		"Get-DnsClientNrptRule | Where-Object { $_.Comment -eq '%s' } | Remove-DnsClientNrptRule -Force",
+		nrptComment(device),
+	))
+}
+
+func powershell(script string) error {
+	return runCommand("", "powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	defaultEndpointResolveInterval = time.Minute
+	// staleHandshakeAge is how old the latest handshake with the server has
+	// to be for its endpoint to be resolved again. Handshakes are renewed
+	// every two minutes while packets flow, which the persistent keepalive
+	// ensures.
+	staleHandshakeAge = 3 * time.Minute
+)
+
+// endpointResolveLoop checks the endpoint of the current lease every interval,
+// so that the tunnel follows servers whose endpoint host name moves to another
+// address, eg. after their host is restarted.
+func (dm *DeviceManager) endpointResolveLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dm.refreshEndpoint(time.Now(), dm.applyConfig)
+		case <-dm.stop:
+			return
+		}
+	}
+}
+
+// refreshEndpoint resolves the endpoint host name of the current lease again,
+// if the latest handshake with the server is older than staleHandshakeAge, and
+// applies a copy of the config with the new address if it changed. It returns
+// whether the endpoint was updated. Endpoints given as addresses are left
+// alone.
+func (dm *DeviceManager) refreshEndpoint(now time.Time, apply func(oldConfig, config *WirestewardPeerConfig) error) bool {
+	dm.configMutex.Lock()
+	config := dm.config
+	dm.configMutex.Unlock()
+	if config == nil || config.Endpoint == nil || config.ServerEndpoint == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(config.ServerEndpoint)
+	if err != nil || net.ParseIP(host) != nil {
+		return false
+	}
+	device, err := dm.wireguardDevice(dm.Name())
+	if err != nil {
+		dm.logger.Error.Printf("Cannot get peers of device %s: %v", dm.Name(), err)
+		return false
+	}
+	for _, p := range device.Peers {
+		if p.PublicKey == config.PublicKey && now.Sub(p.LastHandshakeTime) < staleHandshakeAge {
+			return false
+		}
+	}
+	endpoint, err := dm.resolver.resolveEndpoint(config.ServerEndpoint)
+	if err != nil {
+		dm.logger.Error.Printf("Cannot resolve endpoint %s of device %s: %v", config.ServerEndpoint, dm.Name(), err)
+		return false
+	}
+	addr, err := net.ResolveUDPAddr("udp4", endpoint)
+	if err != nil || addr.String() == config.Endpoint.String() {
+		return false
+	}
+	dm.configMutex.Lock()
+	replaced := dm.config != config
+	dm.configMutex.Unlock()
+	if replaced {
+		// A renewal raced with the lookup and resolved the endpoint already
+		return false
+	}
+	dm.logger.Info.Printf("Endpoint %s of device %s moved from %s to %s", config.ServerEndpoint, dm.Name(), config.Endpoint, addr)
+	peer := *config.PeerConfig
+	peer.Endpoint = addr
+	updated := *config
+	updated.PeerConfig = &peer
+	if err := apply(config, &updated); err != nil {
+		dm.logger.Error.Printf("Cannot update endpoint of device %s: %v", dm.Name(), err)
+		return false
+	}
+	dm.events.emit(eventEndpointChanged, dm.Name(), "endpoint %s moved from %s to %s", config.ServerEndpoint, config.Endpoint, addr)
+	return true
+}
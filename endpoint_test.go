@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestDeviceManager_RefreshEndpoint(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	now := time.Now()
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	dm.events = newEventQueue(defaultEventQueueSize)
+	hosts := staticResolver{"wiresteward.example.com": net.ParseIP("1.2.3.4").To4()}
+	dm.resolver = resolverChain{{name: resolverTypeStatic, resolver: hosts, timeout: time.Second}}
+	pc, err := newPeerConfig(validPublicKey, "", "1.2.3.4:51820", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm.config = &WirestewardPeerConfig{PeerConfig: pc, ServerEndpoint: "wiresteward.example.com:51820"}
+	handshake := now.Add(-time.Minute)
+	dm.wireguardDevice = func(name string) (*wgtypes.Device, error) {
+		return &wgtypes.Device{Name: name, Peers: []wgtypes.Peer{{PublicKey: pc.PublicKey, LastHandshakeTime: handshake}}}, nil
+	}
+	applied := []*WirestewardPeerConfig{}
+	apply := func(oldConfig, config *WirestewardPeerConfig) error {
+		applied = append(applied, config)
+		dm.config = config
+		return nil
+	}
+
+	// Handshakes are succeeding
+	hosts["wiresteward.example.com"] = net.ParseIP("5.6.7.8").To4()
+	assert.False(t, dm.refreshEndpoint(now, apply))
+
+	// Handshakes stopped but the address did not change
+	handshake = now.Add(-staleHandshakeAge)
+	hosts["wiresteward.example.com"] = net.ParseIP("1.2.3.4").To4()
+	assert.False(t, dm.refreshEndpoint(now, apply))
+	assert.Empty(t, applied)
+
+	// Handshakes stopped and the host moved
+	hosts["wiresteward.example.com"] = net.ParseIP("5.6.7.8").To4()
+	old := dm.config
+	assert.True(t, dm.refreshEndpoint(now, apply))
+	assert.Equal(t, 1, len(applied))
+	assert.Equal(t, "5.6.7.8:51820", dm.config.Endpoint.String())
+	assert.Equal(t, "1.2.3.4:51820", old.Endpoint.String())
+	assert.Equal(t, "wiresteward.example.com:51820", dm.config.ServerEndpoint)
+	e := <-dm.events.Events()
+	assert.Equal(t, eventEndpointChanged, e.Type)
+
+	// Endpoints sent as addresses are not resolved
+	dm.config = &WirestewardPeerConfig{PeerConfig: pc, ServerEndpoint: "1.2.3.4:51820"}
+	assert.False(t, dm.refreshEndpoint(now, apply))
+	assert.Equal(t, 1, len(applied))
+}
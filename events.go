@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultEventQueueSize = 64
+	// recentEventsSize is the number of events kept for the agent status,
+	// regardless of whether they are consumed
+	recentEventsSize = 20
+)
+
+type agentEventType string
+
+const (
+	// eventAuthRefreshPending is emitted when a server rejects the token
+	// during a lease renewal, while the current lease is kept active and the
+	// token is being refreshed.
+	eventAuthRefreshPending agentEventType = "AuthRefreshPending"
+	// eventLeaseExpired is emitted when the lease of a device expires before
+	// it could be renewed and the device configuration is removed.
+	eventLeaseExpired agentEventType = "LeaseExpired"
+	// eventBondFailover is emitted when traffic of a bond is shifted to
+	// another device.
+	eventBondFailover agentEventType = "BondFailover"
+	// eventCaptivePortalDetected is emitted when bringing up a device is
+	// deferred because the network is behind a captive portal.
+	eventCaptivePortalDetected agentEventType = "CaptivePortalDetected"
+	// eventDeviceRecreationGivenUp is emitted when a device that keeps
+	// getting deleted is no longer recreated.
+	eventDeviceRecreationGivenUp agentEventType = "DeviceRecreationGivenUp"
+	// eventLeaseRolledBack is emitted when a renewed lease leaves the
+	// reachability probe target unreachable and the previous lease is
+	// restored.
+	eventLeaseRolledBack agentEventType = "LeaseRolledBack"
+	// eventServerFailover is emitted when the server of the current lease
+	// is found unhealthy and a lease is requested from another one.
+	eventServerFailover agentEventType = "ServerFailover"
+	// eventDeviceConfigRestored is emitted when an address or route of a
+	// device was removed by something else and is added back.
+	eventDeviceConfigRestored agentEventType = "DeviceConfigRestored"
+	// eventEndpointChanged is emitted when the endpoint host name of a
+	// server resolves to a new address and the device is moved to it.
+	eventEndpointChanged agentEventType = "EndpointChanged"
+)
+
+// agentEvent describes something that happened to one of the devices managed
+// by the agent.
+type agentEvent struct {
+	Type    agentEventType
+	Device  string
+	Message string
+	Time    time.Time
+}
+
+var eventsDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "wiresteward_agent_events_dropped_total",
+	Help: "Number of agent events dropped because the event buffer was full.",
+})
+
+// eventQueue delivers agent events to an optional consumer via a bounded
+// buffer. Emitting an event never blocks: when the buffer is full, the oldest
+// event is dropped to make room for the new one.
+type eventQueue struct {
+	ch      chan agentEvent
+	dropped uint64
+	mutex   sync.Mutex
+	recent  []agentEvent
+}
+
+func newEventQueue(size int) *eventQueue {
+	if size <= 0 {
+		size = defaultEventQueueSize
+	}
+	return &eventQueue{ch: make(chan agentEvent, size)}
+}
+
+// emit logs and queues a new event. It is safe to call on a nil eventQueue.
+func (q *eventQueue) emit(t agentEventType, device, format string, a ...interface{}) {
+	e := agentEvent{
+		Type:    t,
+		Device:  device,
+		Message: fmt.Sprintf(format, a...),
+		Time:    time.Now(),
+	}
+	logger.Info.Printf("event=%s device=%s %s", e.Type, e.Device, e.Message)
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.recent = append(q.recent, e)
+	if len(q.recent) > recentEventsSize {
+		q.recent = q.recent[len(q.recent)-recentEventsSize:]
+	}
+	for {
+		select {
+		case q.ch <- e:
+			return
+		default:
+		}
+		// The consumer may have read from the buffer in the meantime, so
+		// only count the event as dropped if one was actually removed
+		select {
+		case <-q.ch:
+			q.dropped++
+			eventsDroppedTotal.Inc()
+		default:
+		}
+	}
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (q *eventQueue) Dropped() uint64 {
+	if q == nil {
+		return 0
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.dropped
+}
+
+// Recent returns the latest events, oldest first, whether they have been
+// consumed or not. It is safe to call on a nil eventQueue.
+func (q *eventQueue) Recent() []agentEvent {
+	if q == nil {
+		return nil
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]agentEvent{}, q.recent...)
+}
+
+// Events returns a channel on which agent events are delivered.
+func (q *eventQueue) Events() <-chan agentEvent {
+	return q.ch
+}
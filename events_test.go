@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventQueue_DropsOldest(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	q := newEventQueue(8)
+
+	// Nobody consumes the events, emitting should never block
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			q.emit(eventAuthRefreshPending, "wg_test", "event %d", i)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("emitting events blocked")
+	}
+	assert.Equal(t, uint64(992), q.Dropped())
+
+	// Only the newest events should be kept
+	for i := 992; i < 1000; i++ {
+		e := <-q.Events()
+		assert.Equal(t, fmt.Sprintf("event %d", i), e.Message)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval      = time.Second
+	defaultHealthCheckThreshold     = 3
+	defaultFailoverFailbackInterval = time.Minute
+)
+
+// serverList returns the servers of the device.
+func (dm *DeviceManager) serverList() []agentPeerConfig {
+	dm.serversMutex.Lock()
+	defer dm.serversMutex.Unlock()
+	return dm.servers
+}
+
+// setServers replaces the servers of the device, when its config is reloaded.
+// The current lease is kept, unless it was leased from a server that is no
+// longer listed, in which case a lease is requested from one of the others.
+func (dm *DeviceManager) setServers(servers []agentPeerConfig) {
+	dm.serversMutex.Lock()
+	dm.servers = servers
+	dm.serversMutex.Unlock()
+
+	listed := map[string]bool{}
+	for _, s := range servers {
+		listed[s.URL] = true
+	}
+	dm.failoverMutex.Lock()
+	for u := range dm.unhealthyServers {
+		if !listed[u] {
+			delete(dm.unhealthyServers, u)
+		}
+	}
+	dm.failoverMutex.Unlock()
+
+	dm.configMutex.Lock()
+	current := ""
+	if dm.config != nil {
+		current = dm.config.ServerURL
+	}
+	dm.configMutex.Unlock()
+	if current != "" && !listed[current] {
+		dm.logger.Info.Printf("Server %s was removed from device %s, renewing lease", current, dm.Name())
+		go dm.triggerRenewal()
+	}
+}
+
+// nextServer returns the server to request a lease from. Without failover,
+// it is picked at random. Otherwise, servers that were found unhealthy are
+// skipped, unless all of them were, and the first one is picked if the
+// primary is preferred.
+func (dm *DeviceManager) nextServer() agentPeerConfig {
+	servers := dm.serverList()
+	if dm.failover == nil {
+		return servers[rand.Intn(len(servers))]
+	}
+	dm.failoverMutex.Lock()
+	defer dm.failoverMutex.Unlock()
+	healthy := []agentPeerConfig{}
+	for _, s := range servers {
+		if !dm.unhealthyServers[s.URL] {
+			healthy = append(healthy, s)
+		}
+	}
+	if len(healthy) == 0 {
+		dm.logger.Warn.Printf("All servers of device %s were unhealthy, trying all of them again", dm.Name())
+		dm.unhealthyServers = map[string]bool{}
+		healthy = servers
+	}
+	if dm.failover.Primary {
+		return healthy[0]
+	}
+	return healthy[rand.Intn(len(healthy))]
+}
+
+// markUnhealthy skips the server with the given url in nextServer, until it
+// is reachable again.
+func (dm *DeviceManager) markUnhealthy(serverURL string) {
+	dm.failoverMutex.Lock()
+	defer dm.failoverMutex.Unlock()
+	if len(dm.serverList()) > 1 {
+		dm.events.emit(eventServerFailover, dm.Name(), "server %s is unhealthy, failing over", serverURL)
+		dm.unhealthyServers[serverURL] = true
+	}
+}
+
+// healthCheckSettings returns the interval of the probes of the health check
+// of the server of the current lease, and the number of consecutive failed
+// probes after which it is unhealthy. The failover config takes precedence
+// over the health check config of the device.
+func (dm *DeviceManager) healthCheckSettings() (time.Duration, int) {
+	interval, threshold := dm.healthCheckInterval, dm.healthCheckThreshold
+	if dm.failover != nil && dm.failover.Interval.Duration != 0 {
+		interval = dm.failover.Interval.Duration
+	}
+	if dm.failover != nil && dm.failover.Threshold != 0 {
+		threshold = dm.failover.Threshold
+	}
+	return interval, threshold
+}
+
+// startFailoverHealthCheck replaces the running health check with one
+// probing the failover target through the tunnel, or the wireguard address
+// of the server if none is set. Once it fails, the server is marked unhealthy
+// and a lease is requested from another one.
+func (dm *DeviceManager) startFailoverHealthCheck(serverURL, wgServerAddr string) error {
+	target := dm.failover.Target
+	if target == "" {
+		target = wgServerAddr
+	}
+	if target == "" {
+		return nil
+	}
+	interval, threshold := dm.healthCheckSettings()
+	hc, err := newHealthCheck(target, interval, threshold, dm.renewLeaseChan)
+	if err != nil {
+		return fmt.Errorf("Cannot create healthcheck: %v", err)
+	}
+	if _, ok := hc.checker.(*pingChecker); ok && dm.noHealthCheck {
+		return nil
+	}
+	hc.unhealthy = func() { dm.markUnhealthy(serverURL) }
+	dm.healthCheck.Stop()
+	dm.healthCheck = hc
+	go dm.healthCheck.Run()
+	return nil
+}
+
+// failbackLoop probes the servers that were found unhealthy every interval,
+// and clears them once they are reachable. If the primary is preferred and a
+// server ahead of the one of the current lease recovers, a lease is
+// requested from it.
+func (dm *DeviceManager) failbackLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if dm.failback() {
+				dm.healthCheck.Stop()
+				dm.triggerRenewal()
+			}
+		case <-dm.stop:
+			return
+		}
+	}
+}
+
+// failback clears the servers that were unhealthy and are reachable again,
+// returning whether the lease should be requested from one of them.
+func (dm *DeviceManager) failback() bool {
+	dm.configMutex.Lock()
+	current := ""
+	if dm.config != nil {
+		current = dm.config.ServerURL
+	}
+	dm.configMutex.Unlock()
+	servers := dm.serverList()
+	dm.failoverMutex.Lock()
+	defer dm.failoverMutex.Unlock()
+	renew := false
+	preferred := true
+	for _, s := range servers {
+		if s.URL == current {
+			preferred = false
+		}
+		if !dm.unhealthyServers[s.URL] {
+			continue
+		}
+		if err := dm.serverReachable(s.URL); err != nil {
+			dm.logger.Debug.Printf("Server %s of device %s is still unreachable: %v", s.URL, dm.Name(), err)
+			continue
+		}
+		dm.logger.Info.Printf("Server %s of device %s is reachable again", s.URL, dm.Name())
+		delete(dm.unhealthyServers, s.URL)
+		if dm.failover.Primary && preferred {
+			renew = true
+		}
+	}
+	return renew
+}
+
+// serverReachable checks that a TCP connection to the host of the server url
+// can be established, outside the tunnel.
+func serverReachable(serverURL string) error {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return (&tcpChecker{address: net.JoinHostPort(u.Hostname(), port)}).Check()
+}
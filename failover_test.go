@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceManager_NextServerFailover(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{
+		Name:     "wg_test",
+		Peers:    []agentPeerConfig{{URL: "https://a"}, {URL: "https://b"}, {URL: "https://c"}},
+		Failover: &agentFailoverConfig{Primary: true},
+	}, "")
+	assert.Equal(t, "https://a", dm.nextServer().URL)
+	dm.markUnhealthy("https://a")
+	assert.Equal(t, "https://b", dm.nextServer().URL)
+	dm.markUnhealthy("https://b")
+	assert.Equal(t, "https://c", dm.nextServer().URL)
+	// Once all servers are unhealthy, they are tried again
+	dm.markUnhealthy("https://c")
+	assert.Equal(t, "https://a", dm.nextServer().URL)
+}
+
+func TestDeviceManager_HealthCheckSettings(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	interval, threshold := dm.healthCheckSettings()
+	assert.Equal(t, defaultHealthCheckInterval, interval)
+	assert.Equal(t, defaultHealthCheckThreshold, threshold)
+
+	dm = newDeviceManager(agentDeviceConfig{
+		Name:                 "wg_test",
+		HealthCheckInterval:  duration{10 * time.Second},
+		HealthCheckThreshold: 5,
+	}, "")
+	interval, threshold = dm.healthCheckSettings()
+	assert.Equal(t, 10*time.Second, interval)
+	assert.Equal(t, 5, threshold)
+
+	// The failover config takes precedence over the one of the device
+	dm = newDeviceManager(agentDeviceConfig{
+		Name:                 "wg_test",
+		HealthCheckInterval:  duration{10 * time.Second},
+		HealthCheckThreshold: 5,
+		Failover:             &agentFailoverConfig{Threshold: 2},
+	}, "")
+	interval, threshold = dm.healthCheckSettings()
+	assert.Equal(t, 10*time.Second, interval)
+	assert.Equal(t, 2, threshold)
+}
+
+func TestDeviceManager_Failback(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	reachable := map[string]bool{}
+	dm := newDeviceManager(agentDeviceConfig{
+		Name:     "wg_test",
+		Peers:    []agentPeerConfig{{URL: "https://a"}, {URL: "https://b"}, {URL: "https://c"}},
+		Failover: &agentFailoverConfig{Primary: true},
+	}, "")
+	dm.serverReachable = func(serverURL string) error {
+		if !reachable[serverURL] {
+			return fmt.Errorf("unreachable")
+		}
+		return nil
+	}
+	dm.markUnhealthy("https://a")
+	dm.markUnhealthy("https://c")
+	dm.config = &WirestewardPeerConfig{ServerURL: "https://b"}
+
+	assert.False(t, dm.failback())
+	assert.Equal(t, "https://b", dm.nextServer().URL)
+
+	// Servers behind the current one recover without a renewal
+	reachable["https://c"] = true
+	assert.False(t, dm.failback())
+	assert.False(t, dm.unhealthyServers["https://c"])
+
+	// The primary is switched back to once it recovers
+	reachable["https://a"] = true
+	assert.True(t, dm.failback())
+	assert.Equal(t, "https://a", dm.nextServer().URL)
+}
+
+func TestNewHealthCheckChecker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newHealthCheckChecker(l.Addr().String())
+	assert.NoError(t, err)
+	assert.IsType(t, &tcpChecker{}, c)
+	assert.NoError(t, c.Check())
+	l.Close()
+	assert.Error(t, c.Check())
+
+	c, err = newHealthCheckChecker("10.0.0.1")
+	assert.NoError(t, err)
+	assert.IsType(t, &pingChecker{}, c)
+
+	_, err = newHealthCheckChecker("foo")
+	assert.Error(t, err)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+)
+
+const (
+	defaultFullTunnelTable  = 51820
+	defaultFullTunnelFwMark = 51820
+)
+
+// Reserved routing tables, that full tunnel routes cannot be installed in.
+const (
+	rtTableDefault = 253
+	rtTableMain    = 254
+	rtTableLocal   = 255
+)
+
+// newFullTunnel returns cfg with defaults applied, or nil if full tunnel
+// mode is disabled.
+func newFullTunnel(cfg *agentFullTunnelConfig) *agentFullTunnelConfig {
+	if cfg == nil {
+		return nil
+	}
+	ft := *cfg
+	if ft.Table == 0 {
+		ft.Table = defaultFullTunnelTable
+	}
+	if ft.FwMark == 0 {
+		ft.FwMark = defaultFullTunnelFwMark
+	}
+	return &ft
+}
+
+// bypassFullTunnel returns server with the firewall mark of the full tunnel
+// set, so that requests to its public url do not loop through the tunnel.
+func (dm *DeviceManager) bypassFullTunnel(server agentPeerConfig) agentPeerConfig {
+	if dm.fullTunnel != nil {
+		server.fwMark = dm.fullTunnel.FwMark
+	}
+	return server
+}
+
+// isDefaultRoute returns whether r covers all addresses of its family.
+func isDefaultRoute(r net.IPNet) bool {
+	ones, _ := r.Mask.Size()
+	return ones == 0
+}
+
+// addDefaultRoutes adds the default routes of the families leased by config
+// to its allowed IPs and routes, so that all traffic goes through the tunnel.
+func addDefaultRoutes(config *WirestewardPeerConfig) {
+	defaults := []net.IPNet{{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}}
+	if config.LocalAddress6 != nil {
+		defaults = append(defaults, net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)})
+	}
+	for _, d := range defaults {
+		if !containsNetwork(config.AllowedIPs, d) {
+			config.AllowedIPs = append(config.AllowedIPs, d)
+		}
+		if !containsNetwork(config.Routes, d) {
+			config.Routes = append(config.Routes, d)
+		}
+	}
+}
+
+func containsNetwork(networks []net.IPNet, n net.IPNet) bool {
+	for _, o := range networks {
+		if o.String() == n.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fullTunnelRules returns the policy routing rules of full tunnel mode for
+// family, in the order they have to be added. Rules added without a priority
+// are placed before the existing ones, so the rule added last is looked up
+// first: routes of the main table that are more specific than the default
+// route, eg. to the local network, still apply, and the rest of the traffic
+// that is not marked as sent by the device follows the full tunnel table.
+func fullTunnelRules(ft *agentFullTunnelConfig, family int) []*netlink.Rule {
+	tunnel := netlink.NewRule()
+	tunnel.Family = family
+	tunnel.Table = ft.Table
+	tunnel.Mark = ft.FwMark
+	tunnel.Invert = true
+	main := netlink.NewRule()
+	main.Family = family
+	main.Table = unix.RT_TABLE_MAIN
+	main.SuppressPrefixlen = 0
+	return []*netlink.Rule{tunnel, main}
+}
+
+// fullTunnelFamilies returns the address families routed through the tunnel
+// for config.
+func fullTunnelFamilies(config *WirestewardPeerConfig) []int {
+	if config.LocalAddress6 != nil {
+		return []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+	}
+	return []int{netlink.FAMILY_V4}
+}
+
+// markControl returns a dialer control function that sets the firewall mark
+// of the full tunnel on connections, so that lease requests to the server
+// follow the main table rather than the tunnel they set up.
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// setupFullTunnel marks the packets of the device and adds the policy routing
+// rules that send the rest of the traffic via the full tunnel table. The
+// packets to the server endpoint are marked, so they never loop through the
+// tunnel.
+func (dm *DeviceManager) setupFullTunnel(h netlink.Handle, config *WirestewardPeerConfig) error {
+	mark := dm.fullTunnel.FwMark
+	if err := dm.configureDevice(dm.Name(), wgtypes.Config{FirewallMark: &mark}); err != nil {
+		return fmt.Errorf("cannot set firewall mark of device %s: %w", dm.Name(), err)
+	}
+	// Replies to marked packets have to pass reverse path filtering
+	if err := writeSysctl("net/ipv4/conf/all/src_valid_mark", "1"); err != nil {
+		dm.logger.Error.Printf("Cannot enable src_valid_mark, reverse path filtering may drop tunnel traffic: %v", err)
+	}
+	for _, family := range fullTunnelFamilies(config) {
+		for _, rule := range fullTunnelRules(dm.fullTunnel, family) {
+			if err := h.RuleAdd(rule); err != nil && !errors.Is(err, unix.EEXIST) {
+				return fmt.Errorf("cannot add policy routing rule for table %d: %w", rule.Table, err)
+			}
+		}
+	}
+	dm.logger.Info.Printf("Routing all traffic through device %s via table %d", dm.Name(), dm.fullTunnel.Table)
+	return nil
+}
+
+// teardownFullTunnel removes the policy routing rules of full tunnel mode.
+func (dm *DeviceManager) teardownFullTunnel(h netlink.Handle) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		for _, rule := range fullTunnelRules(dm.fullTunnel, family) {
+			if err := h.RuleDel(rule); err != nil && !errors.Is(err, unix.ENOENT) {
+				dm.logger.Error.Printf("Could not remove policy routing rule for table %d: %s", rule.Table, err)
+			}
+		}
+	}
+}
+
+// linkRoutes returns the routes via link, including the ones in the full
+// tunnel table.
+func (dm *DeviceManager) linkRoutes(h netlink.Handle, link netlink.Link) ([]netlink.Route, error) {
+	routes, err := h.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil || dm.fullTunnel == nil {
+		return routes, err
+	}
+	tableRoutes, err := h.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Table:     dm.fullTunnel.Table,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	return append(routes, tableRoutes...), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestNewFullTunnel(t *testing.T) {
+	assert.Nil(t, newFullTunnel(nil))
+	assert.Equal(t, &agentFullTunnelConfig{Table: defaultFullTunnelTable, FwMark: defaultFullTunnelFwMark}, newFullTunnel(&agentFullTunnelConfig{}))
+	assert.Equal(t, &agentFullTunnelConfig{Table: 100, FwMark: 0x10}, newFullTunnel(&agentFullTunnelConfig{Table: 100, FwMark: 0x10}))
+}
+
+func TestDeviceManager_BypassFullTunnel(t *testing.T) {
+	server := agentPeerConfig{URL: "https://wiresteward.example.com"}
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	assert.Equal(t, server, dm.bypassFullTunnel(server))
+	assert.Nil(t, server.leaseClient().HTTPClient.Transport)
+
+	// Lease requests dial marked connections in full tunnel mode
+	dm = newDeviceManager(agentDeviceConfig{Name: "wg_test", FullTunnel: &agentFullTunnelConfig{FwMark: 0x10}}, "")
+	marked := dm.bypassFullTunnel(server)
+	assert.Equal(t, 0x10, marked.fwMark)
+	transport, ok := marked.leaseClient().HTTPClient.Transport.(*http.Transport)
+	assert.True(t, ok)
+	assert.NotNil(t, transport.DialContext)
+}
+
+func TestAddDefaultRoutes(t *testing.T) {
+	_, address, _ := net.ParseCIDR("10.0.0.2/32")
+	_, network, _ := net.ParseCIDR("10.10.0.0/16")
+	config := &WirestewardPeerConfig{
+		PeerConfig:   &wgtypes.PeerConfig{AllowedIPs: []net.IPNet{*network}},
+		LocalAddress: address,
+		Routes:       []net.IPNet{*network},
+	}
+	addDefaultRoutes(config)
+	assert.Equal(t, []string{"10.10.0.0/16", "0.0.0.0/0"}, networkStrings(config.AllowedIPs))
+	assert.Equal(t, []string{"10.10.0.0/16", "0.0.0.0/0"}, networkStrings(config.Routes))
+
+	// IPv6 is routed too when an IPv6 address is leased, and routes are
+	// not added twice
+	_, address6, _ := net.ParseCIDR("fd00::2/128")
+	config.LocalAddress6 = address6
+	addDefaultRoutes(config)
+	assert.Equal(t, []string{"10.10.0.0/16", "0.0.0.0/0", "::/0"}, networkStrings(config.AllowedIPs))
+	assert.Equal(t, []string{"10.10.0.0/16", "0.0.0.0/0", "::/0"}, networkStrings(config.Routes))
+}
+
+func networkStrings(networks []net.IPNet) []string {
+	s := make([]string, len(networks))
+	for i, n := range networks {
+		s[i] = n.String()
+	}
+	return s
+}
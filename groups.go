@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// leaseGroups returns the groups of a user that have networks configured,
+// sorted and without duplicates, to be stored with their lease.
+func leaseGroups(groupNetworks []*serverGroupNetworkConfig, groups []string) []string {
+	member := map[string]bool{}
+	for _, g := range groups {
+		member[g] = true
+	}
+	leased := []string{}
+	for _, gn := range groupNetworks {
+		if member[gn.Group] {
+			leased = append(leased, gn.Group)
+			member[gn.Group] = false
+		}
+	}
+	if len(leased) == 0 {
+		return nil
+	}
+	sort.Strings(leased)
+	return leased
+}
+
+// groupAllowedIPs returns allowedIPs followed by the networks of groups that
+// are not in it already.
+func groupAllowedIPs(groupNetworks []*serverGroupNetworkConfig, allowedIPs, groups []string) []string {
+	seen := map[string]bool{}
+	networks := []string{}
+	for _, a := range allowedIPs {
+		seen[a] = true
+		networks = append(networks, a)
+	}
+	for _, g := range groups {
+		for _, gn := range groupNetworks {
+			if gn.Group != g {
+				continue
+			}
+			for _, a := range gn.AllowedIPs {
+				if !seen[a] {
+					seen[a] = true
+					networks = append(networks, a)
+				}
+			}
+		}
+	}
+	return networks
+}
+
+// groupNetworkIPs returns the networks of every group, which the server has
+// to masquerade traffic to.
+func (c *serverConfig) groupNetworkIPs() []string {
+	var groups []string
+	for _, gn := range c.GroupNetworks {
+		groups = append(groups, gn.Group)
+	}
+	return groupAllowedIPs(c.GroupNetworks, nil, groups)
+}
+
+// leaseForwardRules returns the firewall rules that limit the traffic peers
+// can forward to the allowed IPs of their leases: the networks of the groups
+// of each lease, and the allowed IPs of every lease in its pool. Anything
+// else is dropped. Only IPv4 traffic is filtered, which is why group networks
+// cannot be used along with IPv6 leases. It must be called with
+// wgRecordsMutex held.
+func (lm *FileLeaseManager) leaseForwardRules(now time.Time) [][]string {
+	usernames := []string{}
+	for u := range lm.wgRecords {
+		usernames = append(usernames, u)
+	}
+	sort.Strings(usernames)
+	rules := [][]string{}
+	for _, u := range usernames {
+		r := lm.wgRecords[u]
+		if r.expires.Before(now) {
+			continue
+		}
+		sources := []string{fmt.Sprintf("%s/32", r.IP)}
+		if r.DelegatedPrefix != nil {
+			sources = append(sources, r.DelegatedPrefix.String())
+		}
+		networks, _ := splitIPFamilies(groupAllowedIPs(lm.groupNetworks, nil, r.Groups))
+		for _, n := range networks {
+			rules = append(rules, []string{"-s", strings.Join(sources, ","), "-d", n, "-j", "ACCEPT"})
+		}
+	}
+	sources := []string{lm.cidr.String()}
+	if lm.prefixPool != nil {
+		sources = append(sources, lm.prefixPool.String())
+	}
+	if allowedIPs, _ := splitIPFamilies(lm.allowedIPs); len(allowedIPs) > 0 {
+		rules = append(rules, []string{"-s", strings.Join(sources, ","), "-d", strings.Join(allowedIPs, ","), "-j", "ACCEPT"})
+	}
+	for _, p := range lm.pools {
+		if allowedIPs, _ := splitIPFamilies(p.AllowedIPs); len(allowedIPs) > 0 {
+			rules = append(rules, []string{"-s", p.network.String(), "-d", strings.Join(allowedIPs, ","), "-j", "ACCEPT"})
+		}
+	}
+	return append(rules, []string{"-j", "DROP"})
+}
+
+// updateForwardRules applies the forward rules of the leases, if forwarding
+// is limited by group and they changed since they were last applied. It
+// must be called with wgRecordsMutex held.
+func (lm *FileLeaseManager) updateForwardRules() error {
+	if lm.applyForwardRules == nil || len(lm.groupNetworks) == 0 {
+		return nil
+	}
+	rules := lm.leaseForwardRules(time.Now())
+	if reflect.DeepEqual(rules, lm.appliedRules) {
+		return nil
+	}
+	if err := lm.applyForwardRules(rules); err != nil {
+		return fmt.Errorf("cannot apply forward rules: %w", err)
+	}
+	lm.appliedRules = rules
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testGroupNetworks = []*serverGroupNetworkConfig{
+	{Group: "developers", AllowedIPs: []string{"10.0.0.0/16"}},
+	{Group: "admins", AllowedIPs: []string{"10.0.0.0/16", "10.10.0.0/24"}},
+}
+
+func TestServerConfig_GroupNetworks(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	for _, tc := range []struct {
+		input string
+		err   bool
+	}{
+		{`"groupNetworks": [{"group": "admins", "allowedIPs": ["10.10.0.0/24"]}]`, false},
+		{`"groupNetworks": [{"group": "", "allowedIPs": ["10.10.0.0/24"]}]`, true},
+		{`"groupNetworks": [{"group": "ops,admins", "allowedIPs": ["10.10.0.0/24"]}]`, true},
+		{`"groupNetworks": [{"group": "admins"}]`, true},
+		{`"groupNetworks": [{"group": "admins", "allowedIPs": ["10.10.0.0"]}]`, true},
+		{`"groupNetworks": [{"group": "admins", "allowedIPs": ["fd00::/64"]}]`, true},
+		{`"groupNetworks": [{"group": "admins", "allowedIPs": ["10.10.0.0/24"]}], "network6": "fd00::/64"`, true},
+	} {
+		cfg := &serverConfig{}
+		input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthIntrospectURL": "example.com", "oauthClientID": "id", ` + tc.input + `}`
+		if err := json.Unmarshal([]byte(input), cfg); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyServerConfig(cfg)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+		}
+	}
+}
+
+func TestGroupAllowedIPs(t *testing.T) {
+	assert.Nil(t, leaseGroups(testGroupNetworks, []string{"sales"}))
+	groups := leaseGroups(testGroupNetworks, []string{"sales", "developers", "admins", "developers"})
+	assert.Equal(t, []string{"admins", "developers"}, groups)
+
+	allowedIPs := []string{"10.90.0.1/32"}
+	assert.Equal(t, []string{"10.90.0.1/32"}, groupAllowedIPs(testGroupNetworks, allowedIPs, nil))
+	assert.Equal(t, []string{"10.90.0.1/32", "10.0.0.0/16"}, groupAllowedIPs(testGroupNetworks, allowedIPs, []string{"developers"}))
+	assert.Equal(t, []string{"10.90.0.1/32", "10.0.0.0/16", "10.10.0.0/24"}, groupAllowedIPs(testGroupNetworks, allowedIPs, groups))
+	assert.Equal(t, []string{"10.90.0.1/32"}, allowedIPs)
+
+	cfg := &serverConfig{GroupNetworks: testGroupNetworks}
+	assert.Equal(t, []string{"10.0.0.0/16", "10.10.0.0/24"}, cfg.groupNetworkIPs())
+
+	// Group networks are part of the advertised settings
+	version := cfg.advertisedVersion()
+	cfg.GroupNetworks = []*serverGroupNetworkConfig{{Group: "developers", AllowedIPs: []string{"10.0.0.0/16", "10.20.0.0/24"}}}
+	assert.NotEqual(t, version, cfg.advertisedVersion())
+}
+
+func TestFileLeaseManager_ForwardRules(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.90.0.0/24")
+	expires := time.Now().Add(time.Hour)
+	var applied [][]string
+	applies := 0
+	lm := &FileLeaseManager{
+		cidr:          network,
+		allowedIPs:    []string{"10.20.0.0/16", "fd00::/64"},
+		groupNetworks: testGroupNetworks,
+		wgRecords: map[string]WgRecord{
+			"alice@example.com": {IP: net.ParseIP("10.90.0.2"), Groups: []string{"admins", "developers"}, expires: expires},
+			"bob@example.com":   {IP: net.ParseIP("10.90.0.3"), Groups: []string{"developers"}, expires: expires},
+			"carol@example.com": {IP: net.ParseIP("10.90.0.4"), expires: expires},
+			"dave@example.com":  {IP: net.ParseIP("10.90.0.5"), Groups: []string{"admins"}, expires: time.Now().Add(-time.Minute)},
+		},
+		applyForwardRules: func(rules [][]string) error {
+			applied = rules
+			applies++
+			return nil
+		},
+	}
+	assert.NoError(t, lm.updateForwardRules())
+	rules := []string{}
+	for _, r := range applied {
+		rules = append(rules, strings.Join(r, " "))
+	}
+	assert.Equal(t, []string{
+		"-s 10.90.0.2/32 -d 10.0.0.0/16 -j ACCEPT",
+		"-s 10.90.0.2/32 -d 10.10.0.0/24 -j ACCEPT",
+		"-s 10.90.0.3/32 -d 10.0.0.0/16 -j ACCEPT",
+		"-s 10.90.0.0/24 -d 10.20.0.0/16 -j ACCEPT",
+		"-j DROP",
+	}, rules)
+
+	// Rules are only applied again when they change
+	assert.NoError(t, lm.updateForwardRules())
+	assert.Equal(t, 1, applies)
+	delete(lm.wgRecords, "bob@example.com")
+	assert.NoError(t, lm.updateForwardRules())
+	assert.Equal(t, 2, applies)
+	assert.Equal(t, 4, len(applied))
+
+	lm.applyForwardRules = func(rules [][]string) error { return fmt.Errorf("iptables failed") }
+	lm.wgRecords["bob@example.com"] = WgRecord{IP: net.ParseIP("10.90.0.3"), Groups: []string{"developers"}, expires: expires}
+	assert.Error(t, lm.updateForwardRules())
+}
+
+func TestLeaseCacheInputs_Groups(t *testing.T) {
+	// Responses are not served from the cache when the groups changed
+	c := newLeaseCache()
+	p := &leaseRequest{PubKey: validPublicKey}
+	c.put(validPublicKey, "alice@example.com", leaseCacheInputs("alice@example.com", p, "developers"), leaseResponse{})
+	_, ok := c.get(validPublicKey, leaseCacheInputs("alice@example.com", p, "admins", "developers"))
+	assert.False(t, ok)
+	_, ok = c.get(validPublicKey, leaseCacheInputs("alice@example.com", p, "developers"))
+	assert.True(t, ok)
+}
@@ -0,0 +1,169 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/utilitywarehouse/wiresteward --go-grpc_out=. --go-grpc_opt=module=github.com/utilitywarehouse/wiresteward api/lease.proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	wirestewardv1 "github.com/utilitywarehouse/wiresteward/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServicePath is the path prefix of the methods of the gRPC lease
+// service, defined in api/lease.proto.
+const grpcServicePath = "/wiresteward.v1.LeaseService/"
+
+// maxGRPCMessageSize bounds the size of request messages.
+const maxGRPCMessageSize = 1 << 20
+
+// grpcCode returns the gRPC status code matching an HTTP status.
+func grpcCode(status int) codes.Code {
+	switch status {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	default:
+		return codes.Internal
+	}
+}
+
+// grpcRequestKey is the context key of the HTTP request carrying a gRPC
+// call.
+type grpcRequestKey struct{}
+
+// grpcRequest returns the HTTP request carrying the call of ctx, which is
+// authenticated, rate limited and audited like JSON requests.
+func grpcRequest(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(grpcRequestKey{}).(*http.Request)
+	return r
+}
+
+// grpcHandler returns the handler serving the gRPC lease service on the
+// HTTP/2 connections of the lease API.
+func (lh *HTTPLeaseHandler) grpcHandler() http.HandlerFunc {
+	server := grpc.NewServer(grpc.MaxRecvMsgSize(maxGRPCMessageSize))
+	wirestewardv1.RegisterLeaseServiceServer(server, &grpcLeaseService{lh: lh})
+	return func(w http.ResponseWriter, r *http.Request) {
+		server.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), grpcRequestKey{}, r)))
+	}
+}
+
+// grpcLeaseService implements the gRPC lease service.
+type grpcLeaseService struct {
+	wirestewardv1.UnimplementedLeaseServiceServer
+	lh *HTTPLeaseHandler
+}
+
+func (s *grpcLeaseService) RequestLease(ctx context.Context, req *wirestewardv1.LeaseRequest) (*wirestewardv1.LeaseResponse, error) {
+	response, lerr := s.lh.lease(grpcRequest(ctx), func(p *leaseRequest) error {
+		*p = leaseRequestFromProto(req)
+		return nil
+	}, false)
+	if lerr != nil {
+		return nil, status.Error(grpcCode(lerr.status), lerr.message)
+	}
+	return leaseResponseToProto(&response), nil
+}
+
+func (s *grpcLeaseService) RevokeLease(ctx context.Context, req *wirestewardv1.RevokeLeaseRequest) (*wirestewardv1.RevokeLeaseResponse, error) {
+	r := grpcRequest(ctx)
+	tokenInfo, auth, lerr := s.lh.authenticate(r)
+	if lerr != nil {
+		return nil, status.Error(grpcCode(lerr.status), lerr.message)
+	}
+	if req.PubKey == "" {
+		return nil, status.Error(codes.InvalidArgument, "pub_key must be set")
+	}
+	// Users can only revoke their own lease
+	user, record, err := s.lh.revokeLease(tokenInfo.UserName, req.PubKey)
+	if errors.Is(err, errLeaseNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	a := newAuditRecord(leaseEventRevoked, user, record)
+	a.Auth = auth
+	s.lh.audit.record(a.fromRequest(r))
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("lease revoked but the device could not be updated: %v", err))
+	}
+	return &wirestewardv1.RevokeLeaseResponse{}, nil
+}
+
+func (s *grpcLeaseService) WatchConfig(req *wirestewardv1.WatchConfigRequest, stream wirestewardv1.LeaseService_WatchConfigServer) error {
+	if _, _, lerr := s.lh.authenticate(grpcRequest(stream.Context())); lerr != nil {
+		return status.Error(grpcCode(lerr.status), lerr.message)
+	}
+	var sent string
+	for {
+		version, reloaded := s.lh.configUpdates()
+		if version != sent {
+			if err := stream.Send(&wirestewardv1.ConfigNotification{Version: version}); err != nil {
+				return err
+			}
+			sent = version
+		}
+		select {
+		case <-reloaded:
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+// leaseRequestFromProto returns the lease request of the LeaseRequest message
+// req.
+func leaseRequestFromProto(req *wirestewardv1.LeaseRequest) leaseRequest {
+	return leaseRequest{
+		PubKey:          req.PubKey,
+		ClientID:        req.ClientId,
+		Extra:           req.Extra,
+		DelegatedPrefix: req.DelegatedPrefix,
+		ConflictingIP:   req.ConflictingIp,
+		Version:         int(req.Version),
+		PreviousPubKey:  req.PreviousPubKey,
+		Pool:            req.Pool,
+		Renew:           req.Renew,
+		Device:          req.Device,
+	}
+}
+
+// leaseResponseToProto returns r as a LeaseResponse message.
+func leaseResponseToProto(r *leaseResponse) *wirestewardv1.LeaseResponse {
+	resp := &wirestewardv1.LeaseResponse{
+		Ip:                r.IP,
+		ServerWireguardIp: r.ServerWireguardIP,
+		AllowedIps:        r.AllowedIPs,
+		AllowedIpsFlags:   r.AllowedIPsFlags,
+		PubKey:            r.PubKey,
+		Endpoint:          r.Endpoint,
+		DelegatedPrefix:   r.DelegatedPrefix,
+		Ip6:               r.IP6,
+		ControlUrl:        r.ControlURL,
+		DnsServers:        r.DNSServers,
+		DnsSearchDomains:  r.DNSSearchDomains,
+		Mtu:               int32(r.MTU),
+		ConfigVersion:     r.ConfigVersion,
+		PresharedKey:      r.PresharedKey,
+	}
+	if !r.Expires.IsZero() {
+		resp.Expires = r.Expires.Unix()
+	}
+	if !r.RenewAfter.IsZero() {
+		resp.RenewAfter = r.RenewAfter.Unix()
+	}
+	for _, route := range r.DNSRoutes {
+		resp.DnsRoutes = append(resp.DnsRoutes, &wirestewardv1.DNSRoute{Domains: route.Domains, Servers: route.Servers})
+	}
+	return resp
+}
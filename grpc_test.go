@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	wirestewardv1 "github.com/utilitywarehouse/wiresteward/api/v1"
+	"github.com/utilitywarehouse/wiresteward/client"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newTestGRPCClient serves the gRPC lease service of lh over cleartext
+// HTTP/2, like servers without a certificate do, and returns a client
+// connected to it with the bearer token in the metadata of its calls.
+func newTestGRPCClient(t *testing.T, lh *HTTPLeaseHandler) (wirestewardv1.LeaseServiceClient, *grpc.ClientConn, context.Context) {
+	ts := httptest.NewServer(h2c.NewHandler(lh.grpcHandler(), &http2.Server{}))
+	t.Cleanup(ts.Close)
+	conn, err := grpc.Dial(strings.TrimPrefix(ts.URL, "http://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return wirestewardv1.NewLeaseServiceClient(conn), conn, metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer token")
+}
+
+func TestLeaseRequestFromProto(t *testing.T) {
+	p := leaseRequestFromProto(&wirestewardv1.LeaseRequest{
+		PubKey:          validPublicKey,
+		ClientId:        "laptop",
+		Extra:           map[string]string{"site": "london", "team": "infra"},
+		DelegatedPrefix: true,
+		Version:         3,
+		Pool:            "contractors",
+		Renew:           true,
+		Device:          "wg-machines",
+	})
+	assert.Equal(t, leaseRequest{
+		PubKey:          validPublicKey,
+		ClientID:        "laptop",
+		Extra:           map[string]string{"site": "london", "team": "infra"},
+		DelegatedPrefix: true,
+		Version:         3,
+		Pool:            "contractors",
+		Renew:           true,
+		Device:          "wg-machines",
+	}, p)
+}
+
+func TestLeaseResponseToProto(t *testing.T) {
+	expires := time.Unix(1600000000, 0)
+	resp := leaseResponseToProto(&leaseResponse{
+		IP:            "10.90.0.2/32",
+		AllowedIPs:    []string{"10.0.0.0/8", "172.16.0.0/12"},
+		Expires:       expires,
+		MTU:           1380,
+		ConfigVersion: "abc",
+		DNSRoutes:     []client.DNSRoute{{Domains: []string{"corp.example.com"}, Servers: []string{"10.0.0.53"}}},
+	})
+	assert.Equal(t, "10.90.0.2/32", resp.Ip)
+	assert.Equal(t, []string{"10.0.0.0/8", "172.16.0.0/12"}, resp.AllowedIps)
+	assert.Equal(t, int64(1600000000), resp.Expires)
+	// Zero times are sent as zero rather than as a negative timestamp
+	assert.Equal(t, int64(0), resp.RenewAfter)
+	assert.Equal(t, int32(1380), resp.Mtu)
+	assert.Equal(t, "abc", resp.ConfigVersion)
+	assert.Equal(t, []string{"corp.example.com"}, resp.DnsRoutes[0].Domains)
+	assert.Equal(t, []string{"10.0.0.53"}, resp.DnsRoutes[0].Servers)
+}
+
+func TestHTTPLeaseHandler_GRPC(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	introspection := newTestIntrospectionServer("test@example.com")
+	defer introspection.Close()
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	lm := &FileLeaseManager{
+		cidr:  network,
+		store: newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+		ip:    ip,
+		wgRecords: map[string]WgRecord{
+			"test@example.com": {PubKey: validPublicKey, IP: net.ParseIP("10.90.0.2"), expires: time.Now().Add(time.Minute)},
+		},
+	}
+	var gotExtra map[string]string
+	lh := &HTTPLeaseHandler{
+		cache:          newLeaseCache(),
+		leaseManager:   lm,
+		serverConfig:   &serverConfig{LeaseTTL: time.Hour},
+		tokenValidator: newTokenValidator("client_id", introspection.URL),
+		policyHooks: []leasePolicyHook{
+			func(username string, req *leaseRequest, dryRun bool) error {
+				gotExtra = req.Extra
+				if req.Extra["site"] == "paris" {
+					return errors.New("site paris is not allowed")
+				}
+				return nil
+			},
+		},
+	}
+	c, conn, ctx := newTestGRPCClient(t, lh)
+
+	// Renewals are served from the cache, without touching the device
+	lr := &wirestewardv1.LeaseRequest{PubKey: validPublicKey, ClientId: "laptop", Extra: map[string]string{"site": "london"}}
+	cached := leaseRequestFromProto(lr)
+	lh.cache.put(validPublicKey, "test@example.com", leaseCacheInputs("test@example.com", &cached), leaseResponse{
+		Status:  "success",
+		IP:      "10.90.0.2/32",
+		PubKey:  "server",
+		Expires: time.Now().Add(time.Minute),
+	})
+	resp, err := c.RequestLease(ctx, lr)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.90.0.2/32", resp.Ip)
+	assert.Equal(t, "server", resp.PubKey)
+	// only the expiry is refreshed
+	assert.True(t, time.Unix(resp.Expires, 0).After(time.Now().Add(59*time.Minute)))
+	assert.Equal(t, map[string]string{"site": "london"}, gotExtra)
+
+	// Rejected requests carry the status and message of the rejection
+	_, err = c.RequestLease(ctx, &wirestewardv1.LeaseRequest{PubKey: validPublicKey, Extra: map[string]string{"site": "paris"}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, "lease request rejected: site paris is not allowed", status.Convert(err).Message())
+
+	// Users cannot revoke leases of others
+	otherPublicKey := newWgKey().PublicKey().String()
+	lm.wgRecordsMutex.Lock()
+	lm.wgRecords["other@example.com"] = WgRecord{PubKey: otherPublicKey}
+	lm.wgRecordsMutex.Unlock()
+	_, err = c.RevokeLease(ctx, &wirestewardv1.RevokeLeaseRequest{PubKey: otherPublicKey})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Contains(t, lm.wgRecords, "other@example.com")
+
+	_, err = c.RevokeLease(ctx, &wirestewardv1.RevokeLeaseRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	err = conn.Invoke(ctx, grpcServicePath+"Unknown", &wirestewardv1.RevokeLeaseRequest{}, &wirestewardv1.RevokeLeaseResponse{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestHTTPLeaseHandler_GRPCWatchConfig(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	introspection := newTestIntrospectionServer("test@example.com")
+	defer introspection.Close()
+	_, network, _ := net.ParseCIDR("10.90.0.0/24")
+	lh := &HTTPLeaseHandler{
+		tokenValidator: newTokenValidator("client_id", introspection.URL),
+		leaseManager:   &FileLeaseManager{},
+		serverConfig:   &serverConfig{AllowedIPs: []string{"10.0.0.0/8"}, WireguardIPNetwork: network},
+	}
+	before, _ := lh.configUpdates()
+	c, _, ctx := newTestGRPCClient(t, lh)
+
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := c.WatchConfig(ctx, &wirestewardv1.WatchConfigRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, before, n.Version)
+
+	lh.reload(&serverConfig{AllowedIPs: []string{"10.0.0.0/8", "172.16.0.0/12"}, WireguardIPNetwork: network})
+	after, _ := lh.configUpdates()
+	assert.NotEqual(t, before, after)
+	n, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, after, n.Version)
+
+	cancel()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Canceled, status.Code(err))
+}
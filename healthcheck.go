@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"time"
 )
 
@@ -12,15 +13,16 @@ type healthCheck struct {
 	running   bool          // bool to help us identify running healthchecks and stop them if needed
 	stop      chan struct{} // Chan to signal hc to stop
 	renew     chan struct{} // Chan to notify for a reboot
+	unhealthy func()        // Called when the target is marked unhealthy, if set
 }
 
 func newHealthCheck(address string, interval time.Duration, threshold int, renew chan struct{}) (*healthCheck, error) {
-	pc, err := newPingChecker(address)
+	c, err := newHealthCheckChecker(address)
 	if err != nil {
 		return &healthCheck{}, err
 	}
 	return &healthCheck{
-		checker:   pc,
+		checker:   c,
 		interval:  interval,
 		threshold: threshold,
 		healthy:   false, // assume target is not healthy when starting until we make a successful check
@@ -64,6 +66,9 @@ func (hc *healthCheck) Run() {
 				logger.Info.Printf("server at: %s marked unhealthy, need to renew lease", hc.checker.TargetIP())
 				hc.running = false
 				hc.healthy = false
+				if hc.unhealthy != nil {
+					hc.unhealthy()
+				}
 				hc.renew <- struct{}{}
 				return
 			}
@@ -83,3 +88,29 @@ func (hc *healthCheck) Check() bool {
 	}
 	return err == nil
 }
+
+// newHealthCheckChecker returns a checker dialling address over TCP if it is
+// a host:port, or pinging it otherwise.
+func newHealthCheckChecker(address string) (checker, error) {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return &tcpChecker{address: address}, nil
+	}
+	return newPingChecker(address)
+}
+
+// tcpChecker checks that a TCP connection to address can be established.
+type tcpChecker struct {
+	address string
+}
+
+func (tc *tcpChecker) Check() error {
+	conn, err := net.DialTimeout("tcp", tc.address, defaultPingTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (tc *tcpChecker) TargetIP() string {
+	return tc.address
+}
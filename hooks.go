@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events hooks run on.
+const (
+	hookEventLeaseAcquired = "lease-acquired"
+	hookEventLeaseRenewed  = "lease-renewed"
+	hookEventTunnelDown    = "tunnel-down"
+	hookEventShutdown      = "shutdown"
+)
+
+var hookEvents = []string{
+	hookEventLeaseAcquired,
+	hookEventLeaseRenewed,
+	hookEventTunnelDown,
+	hookEventShutdown,
+}
+
+const (
+	defaultHookTimeout = 30 * time.Second
+	// hookQueueSize is the number of events queued for hooks, further
+	// events are dropped while hooks are slow to run
+	hookQueueSize = 64
+)
+
+// isHookEvent returns whether name is an event hooks run on.
+func isHookEvent(name string) bool {
+	for _, e := range hookEvents {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hookEvent is passed to hooks, in the environment of commands and as the
+// body of requests to urls.
+type hookEvent struct {
+	Event  string    `json:"event"`
+	Device string    `json:"device,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	IP6    string    `json:"ip6,omitempty"`
+	Routes []string  `json:"routes,omitempty"`
+	Server string    `json:"server,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// newHookEvent returns the event of device with the lease in config, which
+// can be nil.
+func newHookEvent(event, device string, config *WirestewardPeerConfig) hookEvent {
+	he := hookEvent{Event: event, Device: device, Time: time.Now()}
+	if config == nil {
+		return he
+	}
+	if config.LocalAddress != nil {
+		he.IP = config.LocalAddress.String()
+	}
+	if config.LocalAddress6 != nil {
+		he.IP6 = config.LocalAddress6.String()
+	}
+	for _, r := range config.Routes {
+		he.Routes = append(he.Routes, r.String())
+	}
+	he.Server = config.ServerURL
+	return he
+}
+
+// environ returns the environment variables commands receive the event in.
+func (he hookEvent) environ() []string {
+	return []string{
+		"WIRESTEWARD_EVENT=" + he.Event,
+		"WIRESTEWARD_DEVICE=" + he.Device,
+		"WIRESTEWARD_IP=" + he.IP,
+		"WIRESTEWARD_IP6=" + he.IP6,
+		"WIRESTEWARD_ROUTES=" + strings.Join(he.Routes, " "),
+		"WIRESTEWARD_SERVER=" + he.Server,
+	}
+}
+
+// hookRunner runs the hooks of the agent on events, one at a time and in the
+// order of the events, so that eg. a share is unmounted before it is mounted
+// again.
+type hookRunner struct {
+	hooks  []*agentHookConfig
+	client *http.Client
+	queue  chan hookEvent
+	done   chan struct{}
+	mutex  sync.Mutex
+	closed bool
+}
+
+// newHookRunner returns a runner of hooks, or nil if there are none.
+func newHookRunner(hooks []*agentHookConfig) *hookRunner {
+	if len(hooks) == 0 {
+		return nil
+	}
+	hr := &hookRunner{
+		hooks:  hooks,
+		client: &http.Client{},
+		queue:  make(chan hookEvent, hookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go hr.run()
+	return hr
+}
+
+// fire queues event for the hooks without blocking.
+func (hr *hookRunner) fire(event hookEvent) {
+	if hr == nil {
+		return
+	}
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+	if hr.closed {
+		return
+	}
+	select {
+	case hr.queue <- event:
+	default:
+		logger.Error.Printf("Dropping %s hook event of device %s: queue is full", event.Event, event.Device)
+	}
+}
+
+// close waits for the queued events to be handled and stops the runner.
+func (hr *hookRunner) close() {
+	if hr == nil {
+		return
+	}
+	hr.mutex.Lock()
+	if !hr.closed {
+		hr.closed = true
+		close(hr.queue)
+	}
+	hr.mutex.Unlock()
+	<-hr.done
+}
+
+func (hr *hookRunner) run() {
+	defer close(hr.done)
+	for event := range hr.queue {
+		for _, h := range hr.hooks {
+			if !hookRunsOn(h, event.Event) {
+				continue
+			}
+			if err := hr.runHook(h, event); err != nil {
+				logger.Error.Printf("Hook for %s event of device %s failed: %v", event.Event, event.Device, err)
+			}
+		}
+	}
+}
+
+// hookRunsOn returns whether h runs on event.
+func hookRunsOn(h *agentHookConfig, event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (hr *hookRunner) runHook(h *agentHookConfig, event hookEvent) error {
+	timeout := h.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if len(h.Command) > 0 {
+		cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+		cmd.Env = append(os.Environ(), event.environ()...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %w: %s", h.Command[0], err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event.Event)
+	resp, err := hr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", h.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentConfig_Hooks(t *testing.T) {
+	for _, tc := range []struct {
+		hook agentHookConfig
+		err  bool
+	}{
+		{agentHookConfig{Command: []string{"/usr/local/bin/mount-shares"}}, false},
+		{agentHookConfig{URL: "https://hooks.example.com/wiresteward", Events: []string{hookEventLeaseAcquired, hookEventShutdown}}, false},
+		{agentHookConfig{}, true},
+		{agentHookConfig{Command: []string{"/bin/true"}, URL: "https://hooks.example.com"}, true},
+		{agentHookConfig{Command: []string{""}}, true},
+		{agentHookConfig{URL: "hooks.example.com"}, true},
+		{agentHookConfig{URL: "ftp://hooks.example.com"}, true},
+		{agentHookConfig{Command: []string{"/bin/true"}, Events: []string{"lease-expired"}}, true},
+		{agentHookConfig{Command: []string{"/bin/true"}, Timeout: duration{-1}}, true},
+	} {
+		hook := tc.hook
+		err := verifyAgentHooksConfig(&agentConfig{Hooks: []*agentHookConfig{&hook}})
+		if tc.err {
+			assert.Error(t, err, fmt.Sprintf("%+v", tc.hook))
+		} else {
+			assert.NoError(t, err, fmt.Sprintf("%+v", tc.hook))
+			assert.Equal(t, defaultHookTimeout, hook.Timeout.Duration)
+		}
+	}
+}
+
+func testHookConfig() *WirestewardPeerConfig {
+	_, route, _ := net.ParseCIDR("10.20.0.0/16")
+	return &WirestewardPeerConfig{
+		LocalAddress: &net.IPNet{IP: net.IPv4(10, 90, 0, 2), Mask: net.CIDRMask(24, 32)},
+		Routes:       []net.IPNet{*route},
+		ServerURL:    "https://wiresteward.example.com",
+	}
+}
+
+func TestHookRunner_Command(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook script is a shell script")
+	}
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dir := t.TempDir()
+	script := filepath.Join(dir, "hook.sh")
+	out := filepath.Join(dir, "out")
+	if err := os.WriteFile(script, []byte(`#!/bin/sh
+echo "$WIRESTEWARD_EVENT $WIRESTEWARD_DEVICE $WIRESTEWARD_IP $WIRESTEWARD_ROUTES $WIRESTEWARD_SERVER" >> "$1"
+`), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hr := newHookRunner([]*agentHookConfig{
+		{Command: []string{script, out}, Events: []string{hookEventLeaseAcquired, hookEventTunnelDown}},
+	})
+	hr.fire(newHookEvent(hookEventLeaseAcquired, "wg0", testHookConfig()))
+	hr.fire(newHookEvent(hookEventLeaseRenewed, "wg0", testHookConfig()))
+	hr.fire(newHookEvent(hookEventTunnelDown, "wg0", testHookConfig()))
+	hr.close()
+	// Events are not queued once the runner is closed
+	hr.fire(newHookEvent(hookEventTunnelDown, "wg0", nil))
+
+	d, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"lease-acquired wg0 10.90.0.2/24 10.20.0.0/16 https://wiresteward.example.com",
+		"tunnel-down wg0 10.90.0.2/24 10.20.0.0/16 https://wiresteward.example.com",
+	}, strings.Split(strings.TrimSpace(string(d)), "\n"))
+}
+
+func TestHookRunner_URL(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	events := make(chan hookEvent, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var he hookEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&he))
+		assert.Equal(t, he.Event, r.Header.Get(webhookEventHeader))
+		events <- he
+	}))
+	defer ts.Close()
+
+	hr := newHookRunner([]*agentHookConfig{{URL: ts.URL}})
+	hr.fire(newHookEvent(hookEventLeaseRenewed, "wg0", testHookConfig()))
+	hr.fire(newHookEvent(hookEventShutdown, "", nil))
+	hr.close()
+
+	he := <-events
+	assert.Equal(t, hookEventLeaseRenewed, he.Event)
+	assert.Equal(t, "wg0", he.Device)
+	assert.Equal(t, "10.90.0.2/24", he.IP)
+	assert.Equal(t, []string{"10.20.0.0/16"}, he.Routes)
+	he = <-events
+	assert.Equal(t, hookEventShutdown, he.Event)
+	assert.Empty(t, he.Device)
+
+	// Agents without hooks have no runner
+	assert.Nil(t, newHookRunner(nil))
+}
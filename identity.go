@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of identity providers.
+const (
+	identityProviderOIDC          = "oidc"
+	identityProviderOkta          = "okta"
+	identityProviderGoogle        = "google"
+	identityProviderAzure         = "azure"
+	identityProviderIntrospection = "introspection"
+	identityProviderStatic        = "static"
+)
+
+// Lease APIs that identity providers can be limited to.
+const (
+	leaseListenerJSON = "json"
+	leaseListenerGRPC = "grpc"
+)
+
+const (
+	googleTokenInfoURL              = "https://oauth2.googleapis.com/tokeninfo"
+	defaultOktaAuthorizationServer  = "default"
+	defaultOktaUsernameClaim        = "sub"
+	defaultAzureUsernameClaim       = "preferred_username"
+	azureLoginURL                   = "https://login.microsoftonline.com"
+	identityProviderRequestsTimeout = 10 * time.Second
+)
+
+// identityProvider validates the tokens accepted by the lease APIs in
+// listeners, or by every API if empty.
+type identityProvider struct {
+	name      string
+	listeners []string
+	validator accessTokenValidator
+}
+
+// accepts returns whether the provider validates tokens sent to listener.
+func (ip *identityProvider) accepts(listener string) bool {
+	if len(ip.listeners) == 0 {
+		return true
+	}
+	for _, l := range ip.listeners {
+		if l == listener {
+			return true
+		}
+	}
+	return false
+}
+
+// newIdentityProvider returns the provider described by cfg, which must have
+// been verified.
+func newIdentityProvider(cfg *serverIdentityConfig) (*identityProvider, error) {
+	ip := &identityProvider{name: cfg.Name, listeners: cfg.Listeners}
+	switch cfg.Type {
+	case identityProviderOIDC:
+		jv := newJWTValidator(cfg.JWKSURL, cfg.Issuer, cfg.Audience, cfg.UsernameClaim, cfg.JWKSCacheTTL.Duration)
+		jv.jwks.issuer = cfg.Issuer
+		ip.validator = jv
+	case identityProviderOkta:
+		server := cfg.AuthorizationServer
+		if server == "" {
+			server = defaultOktaAuthorizationServer
+		}
+		claim := cfg.UsernameClaim
+		if claim == "" {
+			claim = defaultOktaUsernameClaim
+		}
+		issuer := fmt.Sprintf("https://%s/oauth2/%s", cfg.Domain, server)
+		ip.validator = newJWTValidator(issuer+"/v1/keys", issuer, cfg.Audience, claim, cfg.JWKSCacheTTL.Duration)
+	case identityProviderAzure:
+		claim := cfg.UsernameClaim
+		if claim == "" {
+			claim = defaultAzureUsernameClaim
+		}
+		issuer := fmt.Sprintf("%s/%s/v2.0", azureLoginURL, cfg.Tenant)
+		jwksURL := fmt.Sprintf("%s/%s/discovery/v2.0/keys", azureLoginURL, cfg.Tenant)
+		ip.validator = newJWTValidator(jwksURL, issuer, cfg.Audience, claim, cfg.JWKSCacheTTL.Duration)
+	case identityProviderGoogle:
+		ip.validator = newGoogleTokenValidator(googleTokenInfoURL, cfg.Audience, cfg.HostedDomain)
+	case identityProviderIntrospection:
+		ip.validator = newTokenValidator(cfg.ClientID, cfg.IntrospectURL)
+	case identityProviderStatic:
+		sv, err := newStaticTokenValidator(cfg.TokensFilename)
+		if err != nil {
+			return nil, err
+		}
+		ip.validator = sv
+	default:
+		return nil, fmt.Errorf("unknown identity provider type %q", cfg.Type)
+	}
+	if jv, ok := ip.validator.(*jwtValidator); ok && cfg.GroupsClaim != "" {
+		jv.groupsClaim = cfg.GroupsClaim
+	}
+	return ip, nil
+}
+
+// identityProviders are the configured identity providers, in the order
+// tokens are checked against them.
+type identityProviders []*identityProvider
+
+func newIdentityProviders(configs []*serverIdentityConfig) (identityProviders, error) {
+	ips := identityProviders{}
+	for _, cfg := range configs {
+		ip, err := newIdentityProvider(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create identity provider %s: %w", cfg.Name, err)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// forListener returns the providers that validate tokens sent to listener.
+func (ips identityProviders) forListener(listener string) identityProviders {
+	selected := identityProviders{}
+	for _, ip := range ips {
+		if ip.accepts(listener) {
+			selected = append(selected, ip)
+		}
+	}
+	return selected
+}
+
+// validate returns the response of the first provider that accepts token.
+// Errors of providers are only returned if no other provider accepts the
+// token, so that a provider being down does not lock out the users of others.
+func (ips identityProviders) validate(token, tokenTypeHint string) (*introspectionResponse, error) {
+	var errs []string
+	for _, ip := range ips {
+		response, err := ip.validator.validate(token, tokenTypeHint)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", ip.name, err))
+			continue
+		}
+		if response.Active {
+			logger.Debug.Printf("Token of %s accepted by identity provider %s", response.UserName, ip.name)
+			return response, nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return &introspectionResponse{Active: false}, nil
+}
+
+// leaseListener returns the lease API that r was sent to.
+func leaseListener(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, grpcServicePath) {
+		return leaseListenerGRPC
+	}
+	return leaseListenerJSON
+}
+
+// googleTokenValidator validates Google access tokens, which are opaque, with
+// the token info endpoint.
+type googleTokenValidator struct {
+	httpClient   *http.Client
+	tokenInfoURL string
+	audience     string
+	hostedDomain string
+}
+
+func newGoogleTokenValidator(tokenInfoURL, audience, hostedDomain string) *googleTokenValidator {
+	return &googleTokenValidator{
+		httpClient:   &http.Client{Timeout: identityProviderRequestsTimeout},
+		tokenInfoURL: tokenInfoURL,
+		audience:     audience,
+		hostedDomain: hostedDomain,
+	}
+}
+
+// validate returns an inactive response for tokens that are not issued for
+// the audience, or to verified accounts of the hosted domain if it is set.
+func (gv *googleTokenValidator) validate(token, tokenTypeHint string) (*introspectionResponse, error) {
+	resp, err := gv.httpClient.PostForm(gv.tokenInfoURL, url.Values{"access_token": {token}})
+	if err != nil {
+		return nil, fmt.Errorf("error requesting token info: %w", err)
+	}
+	defer resp.Body.Close()
+	// Invalid and expired tokens are rejected with a bad request
+	if resp.StatusCode == http.StatusBadRequest {
+		return &introspectionResponse{Active: false}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error requesting token info: Response status: %s", resp.Status)
+	}
+	var info struct {
+		Aud           string `json:"aud"`
+		Email         string `json:"email"`
+		EmailVerified string `json:"email_verified"`
+		Exp           string `json:"exp"`
+		Scope         string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("error decoding token info: %w", err)
+	}
+	if info.Aud != gv.audience {
+		logger.Info.Printf("Rejecting token: token is not issued for audience %q", gv.audience)
+		return &introspectionResponse{Active: false}, nil
+	}
+	if info.Email == "" || info.EmailVerified != "true" {
+		logger.Info.Printf("Rejecting token: missing verified email")
+		return &introspectionResponse{Active: false}, nil
+	}
+	if gv.hostedDomain != "" && !strings.HasSuffix(info.Email, "@"+gv.hostedDomain) {
+		logger.Info.Printf("Rejecting token: %s is not in domain %s", info.Email, gv.hostedDomain)
+		return &introspectionResponse{Active: false}, nil
+	}
+	exp, err := strconv.ParseInt(info.Exp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token info expiry: %w", err)
+	}
+	return &introspectionResponse{Active: true, Exp: exp, UserName: info.Email, Scope: info.Scope}, nil
+}
+
+// staticToken is an entry of the tokens file of static identity providers.
+// Tokens are identified by the hex encoded SHA-256 digest of their value, so
+// that the file does not hold them.
+type staticToken struct {
+	SHA256   string    `json:"sha256"`
+	Username string    `json:"username"`
+	Scope    string    `json:"scope"`
+	Groups   []string  `json:"groups"`
+	Expires  time.Time `json:"expires"`
+}
+
+// staticTokenValidator accepts the tokens listed in a file, for deployments
+// without an identity provider or for automation.
+type staticTokenValidator struct {
+	tokens map[string]staticToken
+}
+
+func newStaticTokenValidator(filename string) (*staticTokenValidator, error) {
+	d, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []staticToken
+	if err := json.Unmarshal(d, &tokens); err != nil {
+		return nil, fmt.Errorf("cannot decode tokens file %s: %w", filename, err)
+	}
+	sv := &staticTokenValidator{tokens: map[string]staticToken{}}
+	for i, t := range tokens {
+		digest, err := hex.DecodeString(t.SHA256)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("token %d of %s: invalid sha256 digest", i, filename)
+		}
+		if t.Username == "" {
+			return nil, fmt.Errorf("token %d of %s: missing username", i, filename)
+		}
+		// Tokens that do not expire are not accepted by the lease APIs
+		if t.Expires.IsZero() {
+			return nil, fmt.Errorf("token %d of %s: missing expiry", i, filename)
+		}
+		sv.tokens[hex.EncodeToString(digest)] = t
+	}
+	return sv, nil
+}
+
+func (sv *staticTokenValidator) validate(token, tokenTypeHint string) (*introspectionResponse, error) {
+	digest := sha256.Sum256([]byte(token))
+	t, ok := sv.tokens[hex.EncodeToString(digest[:])]
+	if !ok || !t.Expires.After(time.Now()) {
+		return &introspectionResponse{Active: false}, nil
+	}
+	return &introspectionResponse{Active: true, Exp: t.Expires.Unix(), UserName: t.Username, Scope: t.Scope, Groups: t.Groups}, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerConfig_IdentityProviders(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	for _, tc := range []struct {
+		input string
+		err   bool
+	}{
+		{`"oauthIntrospectURL": "example.com", "oauthClientID": "id"`, false},
+		{`"identityProviders": [{"type": "google", "clientID": "id"}]`, false},
+		{`"identityProviders": [{"type": "oidc", "clientID": "id", "issuer": "https://idp.example.com"}, {"type": "static", "tokensFilename": "tokens.json", "listeners": ["grpc"]}]`, false},
+		{`"identityProviders": [{"type": "okta", "clientID": "id", "domain": "example.okta.com"}, {"type": "azure", "clientID": "id", "tenant": "example"}]`, false},
+		{`"identityProviders": [{"type": "introspection", "clientID": "id", "introspectURL": "https://idp.example.com/introspect"}]`, false},
+		{`"identityProviders": [{"type": "google", "clientID": "id"}], "oauthIntrospectURL": "example.com"`, true},
+		{`"identityProviders": [{"type": "google", "clientID": "id"}, {"type": "google", "clientID": "other"}]`, true},
+		{`"identityProviders": [{"type": "ldap", "clientID": "id"}]`, true},
+		{`"identityProviders": [{"type": "google"}]`, true},
+		{`"identityProviders": [{"type": "oidc", "clientID": "id"}]`, true},
+		{`"identityProviders": [{"type": "oidc", "clientID": "id", "issuer": "idp"}]`, true},
+		{`"identityProviders": [{"type": "okta", "clientID": "id"}]`, true},
+		{`"identityProviders": [{"type": "azure", "clientID": "id"}]`, true},
+		{`"identityProviders": [{"type": "introspection", "clientID": "id"}]`, true},
+		{`"identityProviders": [{"type": "static"}]`, true},
+		{`"identityProviders": [{"type": "google", "clientID": "id", "listeners": ["admin"]}]`, true},
+		{`"identityProviders": [{"type": "google", "clientID": "id", "jwksCacheTTL": "-1m"}]`, true},
+	} {
+		cfg := &serverConfig{}
+		input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", ` + tc.input + `}`
+		if err := json.Unmarshal([]byte(input), cfg); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyServerConfig(cfg)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+		}
+	}
+	// Names default to the type and audiences to the client id
+	cfg := &serverConfig{}
+	input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "identityProviders": [{"type": "google", "clientID": "id"}]}`
+	if err := json.Unmarshal([]byte(input), cfg); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, verifyServerConfig(cfg))
+	assert.Equal(t, "google", cfg.IdentityProviders[0].Name)
+	assert.Equal(t, "id", cfg.IdentityProviders[0].Audience)
+}
+
+// fakeTokenValidator accepts a single token for a user.
+type fakeTokenValidator struct {
+	token, username string
+	err             error
+}
+
+func (fv *fakeTokenValidator) validate(token, tokenTypeHint string) (*introspectionResponse, error) {
+	if fv.err != nil {
+		return nil, fv.err
+	}
+	if token != fv.token {
+		return &introspectionResponse{Active: false}, nil
+	}
+	return &introspectionResponse{Active: true, Exp: time.Now().Add(time.Hour).Unix(), UserName: fv.username}, nil
+}
+
+func TestIdentityProviders(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ips := identityProviders{
+		{name: "down", validator: &fakeTokenValidator{err: fmt.Errorf("unavailable")}},
+		{name: "users", listeners: []string{leaseListenerJSON}, validator: &fakeTokenValidator{token: "user-token", username: "alice@example.com"}},
+		{name: "machines", listeners: []string{leaseListenerGRPC}, validator: &fakeTokenValidator{token: "machine-token", username: "ci"}},
+	}
+
+	// Providers that are down do not lock out the users of others
+	info, err := ips.forListener(leaseListenerJSON).validate("user-token", "access_token")
+	assert.NoError(t, err)
+	assert.True(t, info.Active)
+	assert.Equal(t, "alice@example.com", info.UserName)
+
+	// Tokens are only accepted by the listeners of their provider, errors
+	// are returned if no provider accepts the token
+	_, err = ips.forListener(leaseListenerGRPC).validate("user-token", "access_token")
+	assert.Error(t, err)
+	info, err = ips[1:].forListener(leaseListenerGRPC).validate("user-token", "access_token")
+	assert.NoError(t, err)
+	assert.False(t, info.Active)
+	info, err = ips.forListener(leaseListenerGRPC).validate("machine-token", "access_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", info.UserName)
+
+	assert.Equal(t, leaseListenerGRPC, leaseListener(httptest.NewRequest("POST", grpcServicePath+"RequestLease", nil)))
+	assert.Equal(t, leaseListenerJSON, leaseListener(httptest.NewRequest("POST", "/api/v1/lease", nil)))
+}
+
+func TestHTTPLeaseHandler_IdentityProviders(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	lh := &HTTPLeaseHandler{
+		tokenValidator: &fakeTokenValidator{token: "legacy-token", username: "legacy"},
+		identityProviders: identityProviders{
+			{name: "users", validator: &fakeTokenValidator{token: "user-token", username: "alice@example.com"}},
+		},
+	}
+	for token, active := range map[string]bool{"user-token": true, "legacy-token": false} {
+		r := httptest.NewRequest("POST", "/api/v1/lease", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		info, lerr := lh.authenticateToken(r)
+		if active {
+			assert.Nil(t, lerr, token)
+			assert.Equal(t, "alice@example.com", info.UserName)
+		} else {
+			assert.Equal(t, http.StatusForbidden, lerr.status, token)
+		}
+	}
+}
+
+func TestGoogleTokenValidator(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	exp := time.Now().Add(time.Hour).Unix()
+	infos := map[string]map[string]string{
+		"valid":      {"aud": "id", "email": "alice@example.com", "email_verified": "true", "scope": "openid email"},
+		"other":      {"aud": "other", "email": "alice@example.com", "email_verified": "true"},
+		"unverified": {"aud": "id", "email": "alice@example.com", "email_verified": "false"},
+		"domain":     {"aud": "id", "email": "alice@gmail.com", "email_verified": "true"},
+	}
+	tokenInfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, ok := infos[r.FormValue("access_token")]
+		if !ok {
+			http.Error(w, `{"error": "invalid_token"}`, http.StatusBadRequest)
+			return
+		}
+		info["exp"] = fmt.Sprint(exp)
+		json.NewEncoder(w).Encode(info)
+	}))
+	defer tokenInfo.Close()
+
+	gv := newGoogleTokenValidator(tokenInfo.URL, "id", "example.com")
+	info, err := gv.validate("valid", "access_token")
+	assert.NoError(t, err)
+	assert.True(t, info.Active)
+	assert.Equal(t, "alice@example.com", info.UserName)
+	assert.Equal(t, "openid email", info.Scope)
+	assert.Equal(t, exp, info.Exp)
+	for _, token := range []string{"other", "unverified", "domain", "unknown"} {
+		info, err := gv.validate(token, "access_token")
+		assert.NoError(t, err, token)
+		assert.False(t, info.Active, token)
+	}
+}
+
+func TestStaticTokenValidator(t *testing.T) {
+	digest := func(token string) string {
+		d := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(d[:])
+	}
+	dir := t.TempDir()
+	write := func(tokens []staticToken) string {
+		filename := filepath.Join(dir, "tokens.json")
+		d, _ := json.Marshal(tokens)
+		if err := os.WriteFile(filename, d, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	sv, err := newStaticTokenValidator(write([]staticToken{
+		{SHA256: digest("ci-token"), Username: "ci", Scope: "wiresteward.infra", Expires: expires},
+		{SHA256: digest("old-token"), Username: "old", Expires: time.Now().Add(-time.Hour)},
+	}))
+	assert.NoError(t, err)
+	info, err := sv.validate("ci-token", "access_token")
+	assert.NoError(t, err)
+	assert.Equal(t, &introspectionResponse{Active: true, Exp: expires.Unix(), UserName: "ci", Scope: "wiresteward.infra"}, info)
+	for _, token := range []string{"old-token", digest("ci-token"), ""} {
+		info, err := sv.validate(token, "access_token")
+		assert.NoError(t, err)
+		assert.False(t, info.Active, token)
+	}
+
+	for _, tokens := range [][]staticToken{
+		{{SHA256: "ci-token", Username: "ci", Expires: expires}},
+		{{SHA256: digest("ci-token"), Expires: expires}},
+		{{SHA256: digest("ci-token"), Username: "ci"}},
+	} {
+		_, err := newStaticTokenValidator(write(tokens))
+		assert.Error(t, err)
+	}
+}
+
+func TestJWTValidator_Discovery(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	idp := httptest.NewServer(mux)
+	defer idp.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": idp.URL, "jwks_uri": idp.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(pub)}}})
+	})
+
+	ip, err := newIdentityProvider(&serverIdentityConfig{Name: "oidc", Type: identityProviderOIDC, Issuer: idp.URL, Audience: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signTestJWT(t, "EdDSA", "ed", key, map[string]interface{}{
+		"iss":    idp.URL,
+		"aud":    "id",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"email":  "alice@example.com",
+		"scp":    "openid wiresteward.full",
+		"groups": []string{"developers", "admins"},
+	})
+	info, err := ip.validator.validate(token, "access_token")
+	assert.NoError(t, err)
+	assert.True(t, info.Active)
+	assert.Equal(t, "alice@example.com", info.UserName)
+	assert.Equal(t, "openid wiresteward.full", info.Scope)
+	assert.Equal(t, []string{"developers", "admins"}, info.Groups)
+}
@@ -0,0 +1,60 @@
+// +build !windows
+
+package main
+
+import (
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// replaceChain replaces the rules jumped to from the builtin chain hook of
+// table with rules. The rules are held by one of chains at a time: they are
+// appended to the chain that is not in use, which is jumped to before the
+// jump to the other one is removed, so that traffic never goes through a
+// chain that is being filled. match limits the traffic jumped to the chain.
+func replaceChain(ipt *iptables.IPTables, table, hook string, chains [2]string, match []string, rules [][]string) error {
+	jump := func(chain string) []string {
+		return append(append([]string{}, match...), "-j", chain)
+	}
+	next, previous := chains[0], chains[1]
+	inUse, err := ipt.Exists(table, hook, jump(next)...)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		next, previous = previous, next
+	}
+	// A jump left behind by an interrupted replacement is removed before
+	// the chain is emptied, the one to the chain in use still comes first
+	if err := ipt.DeleteIfExists(table, hook, jump(next)...); err != nil {
+		return err
+	}
+	// ClearChain creates the chain if it does not exist
+	if err := ipt.ClearChain(table, next); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := ipt.Append(table, next, rule...); err != nil {
+			return err
+		}
+	}
+	if err := ipt.Insert(table, hook, 1, jump(next)...); err != nil {
+		return err
+	}
+	if err := ipt.DeleteIfExists(table, hook, jump(previous)...); err != nil {
+		return err
+	}
+	return ipt.ClearAndDeleteChain(table, previous)
+}
+
+// removeChains removes the jumps from hook to chains, and chains.
+func removeChains(ipt *iptables.IPTables, table, hook string, chains [2]string, match []string) error {
+	for _, chain := range chains {
+		if err := ipt.DeleteIfExists(table, hook, append(append([]string{}, match...), "-j", chain)...); err != nil {
+			return err
+		}
+		if err := ipt.ClearAndDeleteChain(table, chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
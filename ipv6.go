@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+)
+
+// maxNetwork6PrefixLength is the longest prefix of the IPv6 network that
+// leaves room for the 32 bits of the IPv4 addresses embedded in its leases.
+const maxNetwork6PrefixLength = 96
+
+// embedIPv4 returns the address of network whose last 32 bits are those of
+// ip. IPv6 leases are derived from IPv4 ones this way, so that they are as
+// unique and as stable as the IPv4 addresses, without being stored.
+func embedIPv4(network *net.IPNet, ip net.IP) net.IP {
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, network.IP.To16())
+	copy(ip6[12:], ip.To4())
+	return ip6
+}
+
+// leaseIP6 returns the IPv6 address of the lease r, or nil if IPv6 addresses
+// are not leased.
+func (lm *FileLeaseManager) leaseIP6(r WgRecord) net.IP {
+	if lm.cidr6 == nil || r.IP.To4() == nil {
+		return nil
+	}
+	return embedIPv4(lm.cidr6, r.IP)
+}
+
+// splitIPFamilies returns the IPv4 and the IPv6 networks of cidrs.
+func splitIPFamilies(cidrs []string) (v4, v6 []string) {
+	for _, c := range cidrs {
+		if ip, _, err := net.ParseCIDR(c); err == nil && ip.To4() == nil {
+			v6 = append(v6, c)
+		} else {
+			v4 = append(v4, c)
+		}
+	}
+	return v4, v6
+}
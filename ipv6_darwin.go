@@ -0,0 +1,153 @@
+// +build darwin
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/route"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// _IOW('i', 26, struct in6_aliasreq) and _IOW('i', 25, struct in6_ifreq)
+	// https://opensource.apple.com/source/xnu/xnu-6153.81.5/bsd/netinet6/in6_var.h.auto.html
+	siocAIFADDRIn6 = 0x8080691a
+	siocDIFADDRIn6 = 0x81206919
+	// nd6InfiniteLifetime marks addresses that never expire
+	nd6InfiniteLifetime = 0xffffffff
+)
+
+func unixRawSockaddrInet6FromNetIP(ip []byte) unix.RawSockaddrInet6 {
+	sa := unix.RawSockaddrInet6{
+		Len:    unix.SizeofSockaddrInet6,
+		Family: unix.AF_INET6,
+	}
+	copy(sa.Addr[:], net.IP(ip).To16())
+	return sa
+}
+
+// https://developer.apple.com/documentation/kernel/in6_addrlifetime
+type in6AddrLifetime struct {
+	Expire    int64
+	Preferred int64
+	Vltime    uint32
+	Pltime    uint32
+}
+
+// https://developer.apple.com/documentation/kernel/in6_aliasreq
+type in6AliasReq struct {
+	Name       [unix.IFNAMSIZ]byte
+	Addr       unix.RawSockaddrInet6
+	DstAddr    unix.RawSockaddrInet6
+	PrefixMask unix.RawSockaddrInet6
+	Flags      int32
+	Lifetime   in6AddrLifetime
+}
+
+// in6IfReq is struct in6_ifreq, whose union is padded to the size of its
+// largest member, the icmp6 interface statistics.
+type in6IfReq struct {
+	Name [unix.IFNAMSIZ]byte
+	Addr unix.RawSockaddrInet6
+	_    [272 - unix.SizeofSockaddrInet6]byte
+}
+
+func addAddress6(fd int, name string, addr net.IP, mask net.IPMask) error {
+	ifar := in6AliasReq{
+		Addr:       unixRawSockaddrInet6FromNetIP(addr),
+		PrefixMask: unixRawSockaddrInet6FromNetIP(mask),
+		Lifetime: in6AddrLifetime{
+			Vltime: nd6InfiniteLifetime,
+			Pltime: nd6InfiniteLifetime,
+		},
+	}
+	copy(ifar.Name[:], name)
+	if _, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(fd),
+		uintptr(siocAIFADDRIn6),
+		uintptr(unsafe.Pointer(&ifar)),
+	); errno != 0 {
+		return fmt.Errorf("SIOCAIFADDR_IN6 on %s: %w (%v)", name, errno, unix.ErrnoName(errno))
+	}
+	return nil
+}
+
+func deleteAddress6(fd int, name string, addr net.IP) error {
+	ifr := in6IfReq{Addr: unixRawSockaddrInet6FromNetIP(addr)}
+	copy(ifr.Name[:], name)
+	if _, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(fd),
+		uintptr(siocDIFADDRIn6),
+		uintptr(unsafe.Pointer(&ifr)),
+	); errno != 0 {
+		return fmt.Errorf("SIOCDIFADDR_IN6 on %s: %w (%v)", name, errno, unix.ErrnoName(errno))
+	}
+	return nil
+}
+
+func newRoute6(gateway, dst net.IP, mask net.IPMask) []route.Addr {
+	return []route.Addr{
+		syscall.RTAX_DST:     &route.Inet6Addr{IP: unixRawSockaddrInet6FromNetIP(dst).Addr},
+		syscall.RTAX_GATEWAY: &route.Inet6Addr{IP: unixRawSockaddrInet6FromNetIP(gateway).Addr},
+		syscall.RTAX_NETMASK: &route.Inet6Addr{IP: unixRawSockaddrInet6FromNetIP(mask).Addr},
+	}
+}
+
+// addIPv6Config adds the IPv6 address of config to the device, and routes its
+// IPv6 routes via it. IPv6 routes are skipped if no IPv6 address was leased.
+func (dm *DeviceManager) addIPv6Config(fdRoute int, config *WirestewardPeerConfig) error {
+	routes := []net.IPNet{}
+	for _, r := range dm.installedRoutes(config) {
+		if r.IP.To4() == nil {
+			routes = append(routes, r)
+		}
+	}
+	if config.LocalAddress6 == nil {
+		for _, r := range routes {
+			dm.logger.Error.Printf("No IPv6 address leased for device %s, ignoring route %s", dm.Name(), r.String())
+		}
+		return nil
+	}
+	fdInet6, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, unix.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fdInet6)
+	if err := addAddress6(fdInet6, dm.Name(), config.LocalAddress6.IP, config.LocalAddress6.Mask); err != nil {
+		return err
+	}
+	for _, r := range routes {
+		if err := setRoute(fdRoute, unix.RTM_ADD, newRoute6(config.LocalAddress6.IP, r.IP, r.Mask)); err != nil {
+			dm.logger.Error.Printf("Could not add new route (%s): %s", r, err)
+		}
+	}
+	return nil
+}
+
+// removeIPv6Config removes the IPv6 routes and address of config from the
+// device.
+func (dm *DeviceManager) removeIPv6Config(fdRoute int, config *WirestewardPeerConfig) error {
+	if config.LocalAddress6 == nil {
+		return nil
+	}
+	for _, r := range dm.installedRoutes(config) {
+		if r.IP.To4() != nil {
+			continue
+		}
+		if err := setRoute(fdRoute, unix.RTM_DELETE, newRoute6(config.LocalAddress6.IP, r.IP, r.Mask)); err != nil {
+			dm.logger.Error.Printf("Could not remove route (%s): %s", r, err)
+		}
+	}
+	fdInet6, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, unix.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fdInet6)
+	return deleteAddress6(fdInet6, dm.Name(), config.LocalAddress6.IP)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbedIPv4(t *testing.T) {
+	_, network, _ := net.ParseCIDR("fd00:77::/64")
+	assert.Equal(t, "fd00:77::a5a:2", embedIPv4(network, net.ParseIP("10.90.0.2")).String())
+	assert.Equal(t, "fd00:77::c0a8:101", embedIPv4(network, net.ParseIP("192.168.1.1").To4()).String())
+}
+
+func TestFileLeaseManager_IPv6Leases(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	_, network6, _ := net.ParseCIDR("fd00:77::/64")
+	lm := &FileLeaseManager{
+		cidr:      network,
+		cidr6:     network6,
+		ip:        ip,
+		wgRecords: map[string]WgRecord{},
+	}
+	record, err := lm.createOrUpdatePeer("test@example.com", &leaseRequest{PubKey: validPublicKey}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.2", record.IP.String())
+	assert.Equal(t, "fd00:77::a5a:2", lm.leaseIP6(record).String())
+
+	// The peer is allowed both addresses
+	peers := lm.peerConfigs()
+	assert.Equal(t, 1, len(peers))
+	allowed := []string{}
+	for _, a := range peers[0].AllowedIPs {
+		allowed = append(allowed, a.String())
+	}
+	assert.Equal(t, []string{"10.90.0.2/32", "fd00:77::a5a:2/128"}, allowed)
+
+	// and none without an IPv6 network
+	lm.cidr6 = nil
+	assert.Nil(t, lm.leaseIP6(record))
+}
+
+func TestVerifyServerConfig_Network6(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	newConfig := func(network6 string) *serverConfig {
+		return &serverConfig{
+			Address:            "10.90.0.1/24",
+			AllowedIPs:         []string{"10.10.0.0/16", "fd00:10::/48"},
+			Endpoint:           "1.2.3.4:51820",
+			Network6:           network6,
+			OauthIntrospectURL: "https://example.com/introspect",
+			OauthClientID:      "client",
+		}
+	}
+	cfg := newConfig("fd00:77::/64")
+	assert.NoError(t, verifyServerConfig(cfg))
+	assert.Equal(t, "fd00:77::a5a:1", cfg.WireguardIP6Address.String())
+	assert.Contains(t, cfg.AllowedIPs, "fd00:77::a5a:1/128")
+
+	assert.Error(t, verifyServerConfig(newConfig("10.100.0.0/16")))
+	assert.Error(t, verifyServerConfig(newConfig("fd00:77::/112")))
+}
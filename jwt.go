@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultJWKSCacheTTL is how long the keys of the identity provider are
+	// cached for, before they are fetched again.
+	defaultJWKSCacheTTL = time.Hour
+	// jwksMinRefreshInterval limits how often the keys are fetched when a
+	// token is signed by an unknown key, eg. after a key rotation.
+	jwksMinRefreshInterval = time.Minute
+	// jwtLeeway is the clock skew tolerated when checking the expiry and
+	// not before time of tokens.
+	jwtLeeway = time.Minute
+	// defaultJWTUsernameClaim is the claim the username of a lease is read
+	// from.
+	defaultJWTUsernameClaim = "email"
+	// defaultJWTGroupsClaim is the claim the groups of the user are read
+	// from.
+	defaultJWTGroupsClaim = "groups"
+)
+
+// errJWTInvalid is returned for tokens that fail validation, as opposed to
+// errors fetching the keys to validate them with.
+var errJWTInvalid = errors.New("invalid token")
+
+// accessTokenValidator validates the bearer tokens of lease requests.
+type accessTokenValidator interface {
+	validate(token, tokenTypeHint string) (*introspectionResponse, error)
+}
+
+// jwksCache fetches the JSON Web Key Set of the identity provider and caches
+// its keys by id.
+type jwksCache struct {
+	httpClient *http.Client
+	url        string
+	ttl        time.Duration
+	// issuer is used to discover the url of the keys, if it is not set
+	issuer string
+
+	mutex   sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newJWKSCache(url string, ttl time.Duration) *jwksCache {
+	if ttl == 0 {
+		ttl = defaultJWKSCacheTTL
+	}
+	return &jwksCache{httpClient: &http.Client{Timeout: 10 * time.Second}, url: url, ttl: ttl}
+}
+
+// key returns the key with the given id. The keys are fetched again once they
+// expire, or if the id is unknown and they were not fetched recently.
+func (c *jwksCache) key(kid string) (crypto.PublicKey, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key, ok := c.keys[kid]
+	expired := time.Since(c.fetched) >= c.ttl
+	if ok && !expired {
+		return key, nil
+	}
+	if expired || time.Since(c.fetched) >= jwksMinRefreshInterval {
+		keys, err := c.fetch()
+		if err != nil {
+			if ok {
+				logger.Error.Printf("Cannot refresh JWKS, using cached keys: %v", err)
+				return key, nil
+			}
+			return nil, err
+		}
+		c.keys = keys
+		c.fetched = time.Now()
+		key, ok = c.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %q", errJWTInvalid, kid)
+	}
+	return key, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// discover sets the url of the keys to the jwks_uri of the OpenID provider
+// metadata of the issuer.
+func (c *jwksCache) discover() error {
+	resp, err := c.httpClient.Get(strings.TrimSuffix(c.issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return fmt.Errorf("error fetching OpenID configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error fetching OpenID configuration: Response status: %s", resp.Status)
+	}
+	var metadata struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return fmt.Errorf("error decoding OpenID configuration: %w", err)
+	}
+	if metadata.JWKSURI == "" {
+		return fmt.Errorf("OpenID configuration of %s has no jwks_uri", c.issuer)
+	}
+	c.url = metadata.JWKSURI
+	return nil
+}
+
+func (c *jwksCache) fetch() (map[string]crypto.PublicKey, error) {
+	if c.url == "" {
+		if err := c.discover(); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := c.httpClient.Get(c.url)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching JWKS: Response status: %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWKS: %w", err)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, fmt.Errorf("error decoding JWKS: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			logger.Warn.Printf("Ignoring JWKS key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// publicKey returns the RSA, EC or Ed25519 public key described by jwk.
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on curve %s", jwk.Crv)
+		}
+		return key, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key length %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// jwtValidator validates JWT access tokens locally, with the keys published by
+// the identity provider, instead of introspecting them.
+type jwtValidator struct {
+	jwks          *jwksCache
+	issuer        string
+	audience      string
+	usernameClaim string
+	groupsClaim   string
+}
+
+func newJWTValidator(jwksURL, issuer, audience, usernameClaim string, cacheTTL time.Duration) *jwtValidator {
+	if usernameClaim == "" {
+		usernameClaim = defaultJWTUsernameClaim
+	}
+	return &jwtValidator{
+		jwks:          newJWKSCache(jwksURL, cacheTTL),
+		issuer:        issuer,
+		audience:      audience,
+		usernameClaim: usernameClaim,
+		groupsClaim:   defaultJWTGroupsClaim,
+	}
+}
+
+// validate verifies the signature, issuer, audience and lifetime of token. It
+// returns an inactive response for tokens that fail validation, and an error
+// if the keys of the identity provider cannot be fetched.
+func (jv *jwtValidator) validate(token, tokenTypeHint string) (*introspectionResponse, error) {
+	response, err := jv.verify(token, time.Now())
+	if errors.Is(err, errJWTInvalid) {
+		logger.Info.Printf("Rejecting token: %v", err)
+		return &introspectionResponse{Active: false}, nil
+	}
+	return response, err
+}
+
+func (jv *jwtValidator) verify(token string, now time.Time) (*introspectionResponse, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed JWT", errJWTInvalid)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decode signature: %v", errJWTInvalid, err)
+	}
+	key, err := jv.jwks.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != jv.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", errJWTInvalid, iss)
+	}
+	if !jwtAudienceContains(claims["aud"], jv.audience) {
+		return nil, fmt.Errorf("%w: token is not issued for audience %q", errJWTInvalid, jv.audience)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing exp claim", errJWTInvalid)
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("%w: token expired", errJWTInvalid)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("%w: token is not valid yet", errJWTInvalid)
+	}
+	username, _ := claims[jv.usernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("%w: missing %s claim", errJWTInvalid, jv.usernameClaim)
+	}
+	response := &introspectionResponse{Active: true, Exp: int64(exp), UserName: username}
+	if iat, ok := claims["iat"].(float64); ok {
+		response.Iat = int64(iat)
+	}
+	switch groups := claims[jv.groupsClaim].(type) {
+	case string:
+		response.Groups = []string{groups}
+	case []interface{}:
+		for _, g := range groups {
+			if g, ok := g.(string); ok {
+				response.Groups = append(response.Groups, g)
+			}
+		}
+	}
+	switch scope := claims["scope"].(type) {
+	case string:
+		response.Scope = scope
+	default:
+		// Some providers list scopes in an scp array, or a space
+		// separated scp string like Azure AD
+		switch scp := claims["scp"].(type) {
+		case string:
+			response.Scope = scp
+		case []interface{}:
+			scopes := []string{}
+			for _, s := range scp {
+				if s, ok := s.(string); ok {
+					scopes = append(scopes, s)
+				}
+			}
+			response.Scope = strings.Join(scopes, " ")
+		}
+	}
+	return response, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: cannot decode JWT: %v", errJWTInvalid, err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: cannot decode JWT: %v", errJWTInvalid, err)
+	}
+	return nil
+}
+
+// jwtAudienceContains returns whether the aud claim, a string or an array of
+// strings, contains audience.
+func jwtAudienceContains(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyJWTSignature checks signature over signed with key, for the
+// algorithm alg of the token. The algorithm has to match the type of the key,
+// so that tokens cannot pick a weaker verification.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	hashes := map[string]crypto.Hash{
+		"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+		"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	}
+	var valid bool
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		hash, ok := hashes[alg]
+		if !ok || !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("%w: algorithm %q does not match an RSA key", errJWTInvalid, alg)
+		}
+		h := hash.New()
+		h.Write(signed)
+		valid = rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature) == nil
+	case *ecdsa.PublicKey:
+		hash, ok := hashes[alg]
+		if !ok || !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("%w: algorithm %q does not match an EC key", errJWTInvalid, alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("%w: invalid signature length", errJWTInvalid)
+		}
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		valid = ecdsa.Verify(key, h.Sum(nil), r, s)
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("%w: algorithm %q does not match an Ed25519 key", errJWTInvalid, alg)
+		}
+		valid = ed25519.Verify(key, signed, signature)
+	default:
+		return fmt.Errorf("%w: unsupported key type %T", errJWTInvalid, key)
+	}
+	if !valid {
+		return fmt.Errorf("%w: signature verification failed", errJWTInvalid)
+	}
+	return nil
+}
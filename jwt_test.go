@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// signTestJWT returns a JWT with claims, signed by key with alg.
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		h := crypto.SHA256.New()
+		h.Write([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h.Sum(nil))
+	case *ecdsa.PrivateKey:
+		h := crypto.SHA256.New()
+		h.Write([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(signature)
+}
+
+func TestJWTValidator(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+	}
+	var fetches int
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer jwks.Close()
+
+	jv := newJWTValidator(jwks.URL, "https://idp.example.com", "wiresteward", "", 0)
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   "https://idp.example.com",
+			"aud":   []string{"wiresteward", "other"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"email": "alice@example.com",
+			"scp":   []string{"openid", "wiresteward.full"},
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		alg, kid string
+		key      crypto.Signer
+	}{
+		{"RS256", "rsa", rsaKey},
+		{"ES256", "ec", ecKey},
+		{"EdDSA", "ed", edKey},
+	} {
+		info, err := jv.validate(signTestJWT(t, tc.alg, tc.kid, tc.key, claims(nil)), "access_token")
+		assert.NoError(t, err, tc.alg)
+		assert.True(t, info.Active, tc.alg)
+		assert.Equal(t, "alice@example.com", info.UserName, tc.alg)
+		assert.Equal(t, "openid wiresteward.full", info.Scope, tc.alg)
+		assert.True(t, info.Exp > time.Now().Unix(), tc.alg)
+	}
+	assert.Equal(t, 1, fetches)
+
+	for name, token := range map[string]string{
+		"issuer":    signTestJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+		"audience":  signTestJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": "other"})),
+		"expired":   signTestJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"not yet":   signTestJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})),
+		"username":  signTestJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"email": ""})),
+		"algorithm": signTestJWT(t, "ES256", "rsa", ecKey, claims(nil)),
+		"signature": signTestJWT(t, "RS256", "ec", rsaKey, claims(nil)),
+		"malformed": "not.a-jwt",
+	} {
+		info, err := jv.validate(token, "access_token")
+		assert.NoError(t, err, name)
+		assert.False(t, info.Active, name)
+	}
+
+	// Unknown keys are fetched again, at most once a minute
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signTestJWT(t, "RS256", "rotated", rotated, claims(nil))
+	info, err := jv.validate(token, "access_token")
+	assert.NoError(t, err)
+	assert.False(t, info.Active)
+	assert.Equal(t, 1, fetches)
+
+	keys = append(keys, map[string]string{"kty": "RSA", "kid": "rotated", "n": b64(rotated.N.Bytes()), "e": b64(big.NewInt(int64(rotated.E)).Bytes())})
+	jv.jwks.fetched = time.Now().Add(-jwksMinRefreshInterval)
+	info, err = jv.validate(token, "access_token")
+	assert.NoError(t, err)
+	assert.True(t, info.Active)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestJWTValidator_JWKSUnavailable(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer jwks.Close()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jv := newJWTValidator(jwks.URL, "https://idp.example.com", "wiresteward", "sub", 0)
+	_, err = jv.validate(signTestJWT(t, "EdDSA", "ed", key, map[string]interface{}{"sub": "alice"}), "access_token")
+	assert.Error(t, err)
+}
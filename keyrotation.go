@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// keyRotationLoop marks the key of the device for rotation every interval and
+// renews the lease, which requests it for a new key pair.
+func (dm *DeviceManager) keyRotationLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			atomic.StoreInt32(&dm.keyRotationDue, 1)
+			dm.triggerRenewal()
+		case <-dm.stop:
+			return
+		}
+	}
+}
+
+// rotateKey generates a new key pair and updates req to move the lease of
+// its public key to the new one. req is left untouched on errors.
+func rotateKey(req *leaseRequest) (*wgtypes.Key, error) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	req.PreviousPubKey = req.PubKey
+	req.PubKey = key.PublicKey().String()
+	return &key, nil
+}
+
+// applyKey sets key as the private key of the device, once the server has
+// moved the lease to its public key. The address of the lease is kept, so
+// connections survive the handshake with the new key. The key is set and
+// recorded with configMutex held, so that reconciling the device does not
+// restore the previous key in between.
+func (dm *DeviceManager) applyKey(key wgtypes.Key) error {
+	dm.configMutex.Lock()
+	if err := dm.configureDevice(dm.Name(), wgtypes.Config{PrivateKey: &key}); err != nil {
+		dm.configMutex.Unlock()
+		return fmt.Errorf("Cannot set new key of device %s: %w", dm.Name(), err)
+	}
+	dm.setKey(key)
+	dm.configMutex.Unlock()
+	if dm.keyStore != nil {
+		if err := dm.keyStore.set(dm.keyAccount(), key.String()); err != nil {
+			dm.logger.Error.Printf("Cannot store new key of device %s, the previous key is used after a restart: %v", dm.Name(), err)
+		}
+	}
+	dm.logger.Info.Printf("Rotated key of device %s, new public key: %s", dm.Name(), key.PublicKey())
+	dm.metrics.count("key_rotations", 1, map[string]string{"device": dm.Name()})
+	return nil
+}
+
+// keyAccount is the account the private key of the device is stored under.
+func (dm *DeviceManager) keyAccount() string {
+	return "device/" + dm.Name()
+}
+
+// restoreKey sets the private key of the device to the one in the key
+// store. The current key of the device, or a new one if it has none, is
+// stored first if the store has no key for the device yet.
+func (dm *DeviceManager) restoreKey(current string) error {
+	stored, err := dm.keyStore.get(dm.keyAccount())
+	if errors.Is(err, errSecretNotFound) {
+		stored = current
+		if current == emptyKey {
+			key, err := wgtypes.GeneratePrivateKey()
+			if err != nil {
+				return err
+			}
+			stored = key.String()
+		}
+		dm.logger.Info.Printf("No stored key for device %s, storing its key", dm.Name())
+		if err := dm.keyStore.set(dm.keyAccount(), stored); err != nil {
+			return fmt.Errorf("Cannot store key of device %s: %w", dm.Name(), err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("Cannot get stored key of device %s: %w", dm.Name(), err)
+	}
+	if stored == current {
+		return nil
+	}
+	key, err := wgtypes.ParseKey(stored)
+	if err != nil {
+		return fmt.Errorf("Cannot parse stored key of device %s: %w", dm.Name(), err)
+	}
+	return dm.configureDevice(dm.Name(), wgtypes.Config{PrivateKey: &key})
+}
+
+// setKey records key as the private key of the device.
+func (dm *DeviceManager) setKey(key wgtypes.Key) {
+	dm.keyMutex.Lock()
+	defer dm.keyMutex.Unlock()
+	dm.key = key
+}
+
+// currentKey returns the private key the agent set on the device.
+func (dm *DeviceManager) currentKey() wgtypes.Key {
+	dm.keyMutex.Lock()
+	defer dm.keyMutex.Unlock()
+	return dm.key
+}
+
+// rememberKey records the private key of the device, once it is set up.
+func (dm *DeviceManager) rememberKey() error {
+	device, err := dm.wireguardDevice(dm.Name())
+	if err != nil {
+		return fmt.Errorf("Cannot get keys for device `%s`: %w", dm.Name(), err)
+	}
+	dm.setKey(device.PrivateKey)
+	return nil
+}
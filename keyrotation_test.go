@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestRotateKey(t *testing.T) {
+	req := &leaseRequest{PubKey: validPublicKey, ClientID: "client"}
+	key, err := rotateKey(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, validPublicKey, req.PreviousPubKey)
+	assert.Equal(t, key.PublicKey().String(), req.PubKey)
+	assert.Equal(t, "client", req.ClientID)
+}
+
+func TestDeviceManager_ApplyKey(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	var got wgtypes.Config
+	dm.configureDevice = func(deviceName string, cfg wgtypes.Config) error {
+		got = cfg
+		return nil
+	}
+	key := newWgKey()
+	assert.NoError(t, dm.applyKey(key))
+	assert.Equal(t, key, *got.PrivateKey)
+	assert.Empty(t, got.Peers)
+}
+
+func TestDeviceManager_ApplyKeyReconcile(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	// A reconcile started while the key is set must see the new key once
+	// it gets the config lock, rather than restore the previous one
+	var seen wgtypes.Key
+	done := make(chan struct{})
+	dm.configureDevice = func(deviceName string, cfg wgtypes.Config) error {
+		go func() {
+			dm.configMutex.Lock()
+			seen = dm.currentKey()
+			dm.configMutex.Unlock()
+			close(done)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+	key := newWgKey()
+	assert.NoError(t, dm.applyKey(key))
+	<-done
+	assert.Equal(t, key, seen)
+}
+
+func TestFileLeaseManager_PreviousPubKey(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	lm := &FileLeaseManager{
+		wgRecords: map[string]WgRecord{},
+		cidr:      network,
+		ip:        ip,
+	}
+	oldKey, newKey := newWgKey().String(), newWgKey().String()
+	expiry := time.Now().Add(time.Hour)
+	record, err := lm.createOrUpdatePeer("alice@example.com", &leaseRequest{PubKey: oldKey}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, lm.holdsLease("alice@example.com", oldKey))
+	assert.False(t, lm.holdsLease("alice@example.com", newKey))
+	assert.False(t, lm.holdsLease("bob@example.com", oldKey))
+
+	rotated, err := lm.createOrUpdatePeer("alice@example.com", &leaseRequest{PubKey: newKey, PreviousPubKey: oldKey}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, record.IP, rotated.IP)
+	assert.True(t, lm.holdsLease("alice@example.com", newKey))
+	assert.False(t, lm.holdsLease("alice@example.com", oldKey))
+}
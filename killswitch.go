@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// killSwitchChains returns the names of the chains that alternately hold the
+// kill switch rules of device.
+func killSwitchChains(device string) [2]string {
+	return [2]string{"WIRESTEWARD-" + device, "WIRESTEWARD2-" + device}
+}
+
+// killSwitchRules returns the rules of the kill switch chain of device for
+// IPv4, or IPv6 if ipv6 is set. Traffic through the device, to the loopback
+// interface, to the endpoint and lease servers, to the DNS resolvers, to
+// allowed networks and for DHCP returns to the calling chain, the rest is
+// dropped.
+func killSwitchRules(device string, endpoint *net.UDPAddr, servers, resolvers []net.IP, allowed []string, ipv6 bool) [][]string {
+	rules := [][]string{
+		{"-o", "lo", "-j", "RETURN"},
+		{"-o", device, "-j", "RETURN"},
+	}
+	if ipv6 {
+		// Neighbour discovery and router advertisements keep the link
+		// usable
+		rules = append(rules,
+			[]string{"-p", "ipv6-icmp", "-j", "RETURN"},
+			[]string{"-p", "udp", "--sport", "546", "--dport", "547", "-j", "RETURN"},
+		)
+	} else {
+		rules = append(rules, []string{"-p", "udp", "--sport", "68", "--dport", "67", "-j", "RETURN"})
+	}
+	isFamily := func(ip net.IP) bool {
+		return ip != nil && (ip.To4() == nil) == ipv6
+	}
+	if endpoint != nil && isFamily(endpoint.IP) {
+		rules = append(rules, []string{"-d", endpoint.IP.String(), "-p", "udp", "--dport", strconv.Itoa(endpoint.Port), "-j", "RETURN"})
+	}
+	for _, ip := range servers {
+		if isFamily(ip) {
+			rules = append(rules, []string{"-d", ip.String(), "-p", "tcp", "-j", "RETURN"})
+		}
+	}
+	// Resolvers stay reachable, so that lease servers can be resolved
+	// again when the rules are replaced
+	for _, ip := range resolvers {
+		if isFamily(ip) {
+			rules = append(rules,
+				[]string{"-d", ip.String(), "-p", "udp", "--dport", "53", "-j", "RETURN"},
+				[]string{"-d", ip.String(), "-p", "tcp", "--dport", "53", "-j", "RETURN"},
+			)
+		}
+	}
+	for _, n := range allowed {
+		if ip, _, err := net.ParseCIDR(n); err == nil && isFamily(ip) {
+			rules = append(rules, []string{"-d", n, "-j", "RETURN"})
+		}
+	}
+	return append(rules, []string{"-j", "DROP"})
+}
+
+// killSwitchServers returns the addresses of the lease servers of the device
+// and of its DNS over HTTPS resolvers, which have to stay reachable to renew
+// leases. Hosts that cannot be resolved keep the addresses they last resolved
+// to. It must be called with configMutex held.
+func (dm *DeviceManager) killSwitchServers() []net.IP {
+	var hosts []string
+	for _, s := range dm.serverList() {
+		if u, err := url.Parse(s.URL); err == nil {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	for _, r := range dm.resolver {
+		if doh, ok := r.resolver.(*dohResolver); ok {
+			if u, err := url.Parse(doh.url); err == nil {
+				hosts = append(hosts, u.Hostname())
+			}
+		}
+	}
+	if dm.killSwitchAddrs == nil {
+		dm.killSwitchAddrs = map[string][]net.IP{}
+	}
+	var ips []net.IP
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			addrs = dm.killSwitchAddrs[host]
+			dm.logger.Error.Printf("Cannot resolve server %s, the kill switch of device %s keeps its previous addresses %v: %v", host, dm.Name(), addrs, err)
+		}
+		dm.killSwitchAddrs[host] = addrs
+		ips = append(ips, addrs...)
+	}
+	return ips
+}
+
+// parseNameservers returns the addresses of the nameserver lines of the
+// resolv.conf(5) file read from r.
+func parseNameservers(r io.Reader) []net.IP {
+	var ips []net.IP
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
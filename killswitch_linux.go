@@ -0,0 +1,101 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// resolvConfFilenames list the resolv.conf(5) files the DNS resolvers of the
+// system are read from. systemd-resolved lists its upstream servers in the
+// second one, while the first only points to its local stub.
+var resolvConfFilenames = []string{"/etc/resolv.conf", "/run/systemd/resolve/resolv.conf"}
+
+// enableKillSwitch installs the kill switch rules for config, in a chain
+// jumped to from the top of the OUTPUT chain, for IPv4 and IPv6. Rules are
+// only replaced when they change, and are swapped in once the new chain is
+// complete, so that renewals do not open a window where traffic could leak
+// or be dropped. It must be called with configMutex held.
+func (dm *DeviceManager) enableKillSwitch(config *WirestewardPeerConfig) error {
+	servers := dm.killSwitchServers()
+	resolvers := killSwitchResolvers()
+	installed := map[bool][][]string{}
+	for _, ipv6 := range []bool{false, true} {
+		rules := killSwitchRules(dm.Name(), config.Endpoint, servers, resolvers, dm.killSwitch.AllowedNetworks, ipv6)
+		if reflect.DeepEqual(dm.killSwitchRules[ipv6], rules) {
+			installed[ipv6] = rules
+			continue
+		}
+		ipt, err := killSwitchIPTables(ipv6)
+		if err != nil {
+			return err
+		}
+		if err := replaceChain(ipt, "filter", "OUTPUT", killSwitchChains(dm.Name()), nil, rules); err != nil {
+			return err
+		}
+		installed[ipv6] = rules
+	}
+	if dm.killSwitchRules == nil {
+		dm.logger.Info.Printf("Enabled kill switch of device %s", dm.Name())
+	}
+	dm.killSwitchRules = installed
+	return nil
+}
+
+// disableKillSwitch removes the kill switch rules of the device. It must be
+// called with configMutex held.
+func (dm *DeviceManager) disableKillSwitch() {
+	for _, ipv6 := range []bool{false, true} {
+		ipt, err := killSwitchIPTables(ipv6)
+		if err != nil {
+			dm.logger.Error.Printf("Cannot remove kill switch of device %s: %v", dm.Name(), err)
+			continue
+		}
+		if err := removeChains(ipt, "filter", "OUTPUT", killSwitchChains(dm.Name()), nil); err != nil {
+			dm.logger.Error.Printf("Cannot remove kill switch of device %s: %v", dm.Name(), err)
+		}
+	}
+	if dm.killSwitchRules != nil {
+		dm.logger.Info.Printf("Disabled kill switch of device %s", dm.Name())
+	}
+	dm.killSwitchRules = nil
+}
+
+// killSwitchResolvers returns the DNS resolvers of the system, which the
+// kill switch lets through. Resolvers on the loopback interface are already
+// reachable.
+func killSwitchResolvers() []net.IP {
+	var ips []net.IP
+	seen := map[string]bool{}
+	for _, filename := range resolvConfFilenames {
+		f, err := os.Open(filename)
+		if err != nil {
+			continue
+		}
+		for _, ip := range parseNameservers(f) {
+			if !ip.IsLoopback() && !seen[ip.String()] {
+				seen[ip.String()] = true
+				ips = append(ips, ip)
+			}
+		}
+		f.Close()
+	}
+	return ips
+}
+
+func killSwitchIPTables(ipv6 bool) (*iptables.IPTables, error) {
+	proto := iptables.ProtocolIPv4
+	if ipv6 {
+		proto = iptables.ProtocolIPv6
+	}
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil, fmt.Errorf("cannot run iptables: %w", err)
+	}
+	return ipt, nil
+}
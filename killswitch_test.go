@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKillSwitchRules(t *testing.T) {
+	endpoint := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 51820}
+	servers := []net.IP{net.ParseIP("203.0.113.2"), net.ParseIP("2001:db8::2")}
+	resolvers := []net.IP{net.ParseIP("192.168.1.1")}
+	allowed := []string{"192.168.1.0/24", "fd00::/64"}
+
+	assert.Equal(t, [][]string{
+		{"-o", "lo", "-j", "RETURN"},
+		{"-o", "wg0", "-j", "RETURN"},
+		{"-p", "udp", "--sport", "68", "--dport", "67", "-j", "RETURN"},
+		{"-d", "203.0.113.1", "-p", "udp", "--dport", "51820", "-j", "RETURN"},
+		{"-d", "203.0.113.2", "-p", "tcp", "-j", "RETURN"},
+		{"-d", "192.168.1.1", "-p", "udp", "--dport", "53", "-j", "RETURN"},
+		{"-d", "192.168.1.1", "-p", "tcp", "--dport", "53", "-j", "RETURN"},
+		{"-d", "192.168.1.0/24", "-j", "RETURN"},
+		{"-j", "DROP"},
+	}, killSwitchRules("wg0", endpoint, servers, resolvers, allowed, false))
+
+	assert.Equal(t, [][]string{
+		{"-o", "lo", "-j", "RETURN"},
+		{"-o", "wg0", "-j", "RETURN"},
+		{"-p", "ipv6-icmp", "-j", "RETURN"},
+		{"-p", "udp", "--sport", "546", "--dport", "547", "-j", "RETURN"},
+		{"-d", "2001:db8::2", "-p", "tcp", "-j", "RETURN"},
+		{"-d", "fd00::/64", "-j", "RETURN"},
+		{"-j", "DROP"},
+	}, killSwitchRules("wg0", endpoint, servers, resolvers, allowed, true))
+}
+
+func TestDeviceManager_KillSwitchServers(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{
+		Name: "wg_test",
+		Peers: []agentPeerConfig{
+			{URL: "https://203.0.113.2"},
+			{URL: "https://wiresteward.invalid"},
+		},
+	}, "")
+	dm.resolver = newResolverChain([]agentResolverConfig{{Type: resolverTypeDoH, URL: "https://198.51.100.1/dns-query"}})
+	// Servers that cannot be resolved keep their previous addresses
+	dm.killSwitchAddrs = map[string][]net.IP{"wiresteward.invalid": {net.ParseIP("203.0.113.3")}}
+	assert.Equal(t, []net.IP{
+		net.ParseIP("203.0.113.2"),
+		net.ParseIP("203.0.113.3"),
+		net.ParseIP("198.51.100.1"),
+	}, dm.killSwitchServers())
+}
+
+func TestParseNameservers(t *testing.T) {
+	assert.Equal(t, []net.IP{net.ParseIP("192.168.1.1"), net.ParseIP("2001:db8::53")}, parseNameservers(strings.NewReader(`# Generated by NetworkManager
+search example.com
+nameserver 192.168.1.1
+nameserver 2001:db8::53
+nameserver
+options edns0
+`)))
+}
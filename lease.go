@@ -3,7 +3,8 @@
 package main
 
 import (
-	"bufio"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -12,29 +13,136 @@ import (
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+var peerKeyRotationsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "wiresteward_peer_key_rotations_total",
+	Help: "Number of times a client renewed its lease with a new public key.",
+})
+
+// errLeaseNotFound is returned when revoking a lease that does not exist.
+var errLeaseNotFound = errors.New("lease not found")
+
+// errReservedKey is returned for lease requests of a public key that is
+// reserved for another user.
+var errReservedKey = errors.New("public key is reserved for another user")
+
+// ipReservation is an address that is always leased to a public key of a
+// user.
+type ipReservation struct {
+	ip       net.IP
+	username string
+}
+
+// emptyLeaseField is used in the leases file in place of optional fields
+// that are not set.
+const emptyLeaseField = "-"
+
 // WgRecord describes a lease entry for a peer.
 type WgRecord struct {
-	PubKey  string
-	IP      net.IP
+	PubKey          string
+	IP              net.IP
+	ClientID        string
+	DelegatedPrefix *net.IPNet
+	// Groups are the groups of the user that have networks configured
+	Groups  []string
 	expires time.Time
+	// granted is when the lease was last granted or renewed, or loaded
+	// from the leases file
+	granted time.Time
 }
 
 func (wgr WgRecord) String() string {
-	return wgr.PubKey + " " + wgr.IP.String() + " " + wgr.expires.Format(time.RFC3339)
+	s := wgr.PubKey + " " + wgr.IP.String() + " " + wgr.expires.Format(time.RFC3339)
+	// Optional fields are left out from the end, and replaced with
+	// emptyLeaseField before fields that are set
+	optional := []string{emptyLeaseField, emptyLeaseField, emptyLeaseField}
+	if wgr.ClientID != "" {
+		optional[0] = wgr.ClientID
+	}
+	if wgr.DelegatedPrefix != nil {
+		optional[1] = wgr.DelegatedPrefix.String()
+	}
+	if len(wgr.Groups) > 0 {
+		optional[2] = strings.Join(wgr.Groups, ",")
+	}
+	for len(optional) > 0 && optional[len(optional)-1] == emptyLeaseField {
+		optional = optional[:len(optional)-1]
+	}
+	for _, f := range optional {
+		s += " " + f
+	}
+	return s
 }
 
 // FileLeaseManager implements functionality for managing address leases for
 // peers, using a file as a state backend.
 type FileLeaseManager struct {
+	adaptive       *serverAdaptiveLeasesConfig
+	adaptiveActive bool
 	cidr           *net.IPNet
-	deviceName     string
-	filename       string
-	ip             net.IP
+	cidr6          *net.IPNet
+	// device returns the wireguard device, to look up peer handshakes
+	device       func(name string) (*wgtypes.Device, error)
+	deviceName   string
+	events       *leaseEventQueue
+	ip           net.IP
+	prefixLength int
+	prefixPool   *net.IPNet
+	// prefixReservations holds the expired records of users that were
+	// delegated a prefix, so that the same prefix can be returned when they
+	// reconnect.
+	prefixReservations map[string]WgRecord
+	sourceRanges       serverSourceRanges
+	store              leaseStore
+	// storeVersion is the version of the leases loaded from a shared
+	// store, and storeMutex serializes updates of the store, so that an
+	// older snapshot of the leases is never saved over a newer one
+	storeVersion   uint64
+	storeMutex     sync.Mutex
 	wgRecords      map[string]WgRecord
 	wgRecordsMutex sync.Mutex
+	// gracePeriod is how long the address of an expired lease stays
+	// reserved for its user, after its peer is removed, before it is freed
+	gracePeriod time.Duration
+	// lastSync is when syncWgRecords last ran, to tell the leases that
+	// expired since
+	lastSync time.Time
+	// reservations maps public keys to the address that is always leased
+	// to them, dynamic leases are never given reserved addresses
+	reservations map[string]ipReservation
+	// affinity holds the addresses of released leases, by user, which are
+	// preferred for them for affinityPeriod
+	affinity       map[string]leaseAffinity
+	affinityPeriod time.Duration
+	// allocator picks the addresses of new leases, the first available
+	// one if nil
+	allocator addressAllocator
+	// presharedKeySecret is the secret the preshared keys of peers are
+	// derived from, nil if they are not used
+	presharedKeySecret []byte
+	// audit records the leases reclaimed and expired by the server
+	audit *auditLog
+	// onSaved holds what the update of the leases in progress reports, its
+	// events, audit records and metrics, until it is saved, as updates are
+	// applied again after conflicts. It is guarded by wgRecordsMutex, and
+	// peersChanged, whether the update changed the peers of the device, by
+	// storeMutex.
+	onSaved      []func()
+	peersChanged bool
+	// pools are the named networks addresses can be leased from, instead
+	// of cidr
+	pools []*serverPoolConfig
+	// allowedIPs and groupNetworks are the networks peers can reach when
+	// forwarding is limited by group. applyForwardRules applies the firewall
+	// rules of the leases, if set, and appliedRules are the latest rules
+	// applied
+	allowedIPs        []string
+	groupNetworks     []*serverGroupNetworkConfig
+	applyForwardRules func(rules [][]string) error
+	appliedRules      [][]string
 }
 
 func newFileLeaseManager(cfg *serverConfig) (*FileLeaseManager, error) {
@@ -49,11 +157,41 @@ func newFileLeaseManager(cfg *serverConfig) (*FileLeaseManager, error) {
 		return nil, err
 	}
 
+	store, err := newLeaseStore(cfg)
+	if err != nil {
+		return nil, err
+	}
 	lm := &FileLeaseManager{
-		cidr:       cfg.WireguardIPNetwork,
-		deviceName: cfg.DeviceName,
-		filename:   cfg.LeasesFilename,
-		ip:         cfg.WireguardIPAddress,
+		adaptive:     cfg.AdaptiveLeases,
+		cidr:         cfg.WireguardIPNetwork,
+		cidr6:        cfg.WireguardIP6Network,
+		deviceName:   cfg.DeviceName,
+		gracePeriod:  cfg.LeaseGracePeriod,
+		ip:           cfg.WireguardIPAddress,
+		pools:        cfg.Pools,
+		sourceRanges: cfg.SourceRanges,
+		allowedIPs:   cfg.AllowedIPs,
+		store:        store,
+		reservations: cfg.ReservedIPs,
+	}
+	lm.groupNetworks = cfg.GroupNetworks
+	if cfg.LeasePolicy != nil {
+		lm.affinityPeriod = cfg.LeasePolicy.AddressAffinity.Duration
+		if lm.allocator, err = newAddressAllocator(cfg.LeasePolicy.AddressAllocation); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PresharedKeySecretFilename != "" {
+		secret, err := loadOrCreateSecret(cfg.PresharedKeySecretFilename, presharedKeySecretSize)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load preshared key secret: %w", err)
+		}
+		lm.presharedKeySecret = secret
+	}
+	if cfg.DelegatedPrefixPool != nil {
+		lm.prefixPool = cfg.DelegatedPrefixPool
+		lm.prefixLength = cfg.DelegatedPrefixLength
+		logger.Info.Printf("delegating /%d prefixes from %s", lm.prefixLength, lm.prefixPool)
 	}
 
 	if err := lm.loadWgRecords(); err != nil {
@@ -68,148 +206,564 @@ func newFileLeaseManager(cfg *serverConfig) (*FileLeaseManager, error) {
 	return lm, nil
 }
 
-func (lm *FileLeaseManager) loadWgRecords() error {
+// network returns the network that addresses are leased from.
+func (lm *FileLeaseManager) network() *net.IPNet {
 	lm.wgRecordsMutex.Lock()
 	defer lm.wgRecordsMutex.Unlock()
+	return lm.cidr
+}
 
-	lm.wgRecords = make(map[string]WgRecord)
+// setNetwork changes the network that new addresses are leased from.
+func (lm *FileLeaseManager) setNetwork(network *net.IPNet) {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	lm.cidr = network
+}
 
-	r, err := os.Open(lm.filename)
-	if err != nil {
-		logger.Error.Printf("unable to open leases file: %v", err)
-		return nil
+func (lm *FileLeaseManager) loadWgRecords() error {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	if err := lm.loadStoredLeases(); err != nil {
+		return err
 	}
-	defer r.Close()
-
-	sc := bufio.NewScanner(r)
-	for sc.Scan() {
-		line := sc.Text()
-		if len(line) == 0 {
-			continue
-		}
-		tokens := strings.Fields(line)
-		if len(tokens) != 4 {
-			return fmt.Errorf("malformed line, want 3 fields, got %d: %s", len(tokens), line)
-		}
+	logger.Info.Println("records loaded")
+	return nil
+}
 
-		username := tokens[0]
-		pubKey := tokens[1]
-		ipaddr := net.ParseIP(tokens[2])
-		// TODO: support v6?
-		if ipaddr.To4() == nil {
-			return fmt.Errorf("expected an IPv4 address, got: %v", ipaddr)
-		}
-		expires, err := time.Parse(time.RFC3339, tokens[3])
-		if err != nil {
-			return fmt.Errorf("expected time of exipry in RFC3339 format, got: %v", tokens[2])
+// loadStoredLeases replaces the leases with the ones in the store. Leases
+// that were already known keep the time they were granted. It must be called
+// with wgRecordsMutex held.
+func (lm *FileLeaseManager) loadStoredLeases() error {
+	var leases []storedLease
+	var err error
+	if shared, ok := lm.store.(sharedLeaseStore); ok {
+		leases, lm.storeVersion, err = shared.loadVersion()
+	} else {
+		leases, err = lm.store.load()
+	}
+	if err != nil {
+		return err
+	}
+	known := lm.wgRecords
+	lm.wgRecords = make(map[string]WgRecord)
+	lm.prefixReservations = make(map[string]WgRecord)
+	for _, l := range leases {
+		record := l.Record
+		record.granted = time.Now()
+		if r, ok := known[l.Username]; ok && r.PubKey == record.PubKey {
+			record.granted = r.granted
 		}
-		if expires.After(time.Now()) {
-			lm.wgRecords[username] = WgRecord{
-				PubKey:  pubKey,
-				IP:      ipaddr,
-				expires: expires,
-			}
+		if record.expires.Add(lm.gracePeriod).After(time.Now()) {
+			lm.wgRecords[l.Username] = record
+		} else if record.DelegatedPrefix != nil {
+			lm.prefixReservations[l.Username] = record
 		}
 	}
-
-	logger.Info.Println("records loaded")
 	return nil
 }
 
 func (lm *FileLeaseManager) saveWgRecords() error {
+	lm.wgRecordsMutex.Lock()
+	leases := make([]storedLease, 0, len(lm.wgRecords)+len(lm.prefixReservations))
+	for username, record := range lm.wgRecords {
+		leases = append(leases, storedLease{Username: username, Record: record})
+	}
+	for username, record := range lm.prefixReservations {
+		leases = append(leases, storedLease{Username: username, Record: record})
+	}
+	version := lm.storeVersion
+	lm.wgRecordsMutex.Unlock()
+	if shared, ok := lm.store.(sharedLeaseStore); ok {
+		return shared.saveVersion(leases, version)
+	}
+	return lm.store.save(leases)
+}
+
+// maxLeaseStoreAttempts is the number of times an update of the leases is
+// attempted while other servers keep changing them.
+const maxLeaseStoreAttempts = 5
+
+// whenSaved runs f once the update of the leases in progress is saved. It
+// must be called with wgRecordsMutex held.
+func (lm *FileLeaseManager) whenSaved(f func()) {
+	lm.onSaved = append(lm.onSaved, f)
+}
+
+// emitLeaseEvent emits the event and audit record of the lease of username
+// once the update of the leases in progress is saved. It must be called with
+// wgRecordsMutex held.
+func (lm *FileLeaseManager) emitLeaseEvent(eventType leaseEventType, username string, r WgRecord, reason string) {
+	lm.whenSaved(func() {
+		lm.events.emit(newLeaseEvent(eventType, username, r))
+		a := newAuditRecord(eventType, username, r)
+		a.Reason = reason
+		lm.audit.record(a)
+	})
+}
+
+// updatePeersWhenSaved configures the device with the peers of the leases
+// once the update of the leases in progress is saved, so that the device
+// never holds a peer for an address that was not saved, which another server
+// sharing the store may lease. It must be called from an update of
+// updateLeases.
+func (lm *FileLeaseManager) updatePeersWhenSaved() {
+	lm.peersChanged = true
+}
+
+// beginUpdate drops what a previous attempt of the update of the leases
+// reported.
+func (lm *FileLeaseManager) beginUpdate() {
+	lm.wgRecordsMutex.Lock()
+	lm.onSaved = nil
+	lm.wgRecordsMutex.Unlock()
+	lm.peersChanged = false
+}
+
+// commitUpdate runs what the saved update of the leases reported, and
+// configures the device with the peers of the leases if they changed.
+func (lm *FileLeaseManager) commitUpdate() error {
+	lm.wgRecordsMutex.Lock()
+	onSaved := lm.onSaved
+	lm.onSaved = nil
+	lm.wgRecordsMutex.Unlock()
+	for _, f := range onSaved {
+		f()
+	}
+	if !lm.peersChanged {
+		return nil
+	}
+	lm.peersChanged = false
+	return lm.updateWgPeers()
+}
+
+// discardUpdate drops an update of the leases that failed after changing them
+// or could not be saved, along with what it reported, by loading the stored
+// leases again. The device was not configured with it.
+func (lm *FileLeaseManager) discardUpdate() {
+	lm.beginUpdate()
 	lm.wgRecordsMutex.Lock()
 	defer lm.wgRecordsMutex.Unlock()
-	f, err := os.OpenFile(lm.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+	if err := lm.loadStoredLeases(); err != nil {
+		logger.Error.Printf("Cannot reload leases after failing to update them: %v", err)
 	}
-	defer f.Close()
-	for username, record := range lm.wgRecords {
-		if _, err := fmt.Fprintf(f, "%s %s\n", username, record); err != nil {
-			return err
+}
+
+// updateLeases applies update to the leases, and saves them if it reports a
+// change. With a shared store, the leases are reloaded before update is
+// applied, and it is applied again if another server saved leases in the
+// meantime, so that servers never lease the same address twice. What update
+// reports with whenSaved and updatePeersWhenSaved only happens once the leases
+// are saved, so that it happens once, and updates that cannot be saved, or
+// fail after reporting a change, are dropped.
+func (lm *FileLeaseManager) updateLeases(update func() (bool, error)) (bool, error) {
+	lm.storeMutex.Lock()
+	defer lm.storeMutex.Unlock()
+	_, shared := lm.store.(sharedLeaseStore)
+	for attempt := 1; ; attempt++ {
+		if shared {
+			lm.wgRecordsMutex.Lock()
+			err := lm.loadStoredLeases()
+			lm.wgRecordsMutex.Unlock()
+			if err != nil {
+				return false, err
+			}
+		}
+		lm.beginUpdate()
+		changed, err := update()
+		if err != nil && changed {
+			lm.discardUpdate()
+			return true, err
+		}
+		if err != nil {
+			lm.beginUpdate()
+			return false, err
+		}
+		if !changed {
+			return false, lm.commitUpdate()
+		}
+		err = lm.saveWgRecords()
+		if err == nil {
+			return true, lm.commitUpdate()
+		}
+		if !shared || !errors.Is(err, errLeaseStoreConflict) || attempt == maxLeaseStoreAttempts {
+			lm.discardUpdate()
+			return true, err
 		}
+		logger.Info.Printf("Leases were changed by another server, updating them again")
 	}
-	return nil
 }
 
+// syncWgRecords removes the peers of expired leases from the device, and frees
+// their addresses once the grace period has passed as well. Peers that no
+// longer match the leases are reconciled.
 func (lm *FileLeaseManager) syncWgRecords() error {
-	lm.wgRecordsMutex.Lock()
-	changed := false
-	for k, r := range lm.wgRecords {
-		if r.expires.Before(time.Now()) {
-			delete(lm.wgRecords, k)
+	changed, err := lm.updateLeases(func() (bool, error) {
+		lm.wgRecordsMutex.Lock()
+		now := time.Now()
+		changed := false
+		for k, r := range lm.wgRecords {
+			if r.expires.Add(lm.gracePeriod).Before(now) {
+				lm.releaseRecord(k, r)
+				lm.emitLeaseEvent(leaseEventExpired, k, r, "")
+				changed = true
+			} else if r.expires.Before(now) && !r.expires.Before(lm.lastSync) {
+				logger.Info.Printf("Lease of user %s expired, keeping address %s reserved until %s", k, r.IP, r.expires.Add(lm.gracePeriod))
+				changed = true
+			}
+		}
+		lm.lastSync = now
+		lm.expireAffinity(now)
+		lm.wgRecordsMutex.Unlock()
+		if lm.reclaimIdleLeases(time.Now()) {
+			changed = true
+		}
+		if lm.reclaimDriftedLeases() {
 			changed = true
 		}
+		if changed {
+			lm.updatePeersWhenSaved()
+		}
+		return changed, nil
+	})
+	if err != nil {
+		return err
 	}
-	lm.wgRecordsMutex.Unlock()
 	if changed {
-		if err := lm.updateWgPeers(); err != nil {
-			return err
+		return nil
+	}
+	// Leases granted by other servers sharing the store are configured on
+	// every sync
+	if _, ok := lm.store.(sharedLeaseStore); ok {
+		return lm.updateWgPeers()
+	}
+	return lm.reconcileDevicePeers()
+}
+
+// releaseRecord removes the lease of username, keeping the delegated prefix
+// reserved for them. It must be called with wgRecordsMutex held.
+func (lm *FileLeaseManager) releaseRecord(username string, r WgRecord) {
+	delete(lm.wgRecords, username)
+	lm.rememberAddress(username, r)
+	if r.DelegatedPrefix != nil {
+		if lm.prefixReservations == nil {
+			lm.prefixReservations = make(map[string]WgRecord)
 		}
-		if err := lm.saveWgRecords(); err != nil {
-			return err
+		lm.prefixReservations[username] = r
+	}
+}
+
+// revokeLease removes the lease of username, or of the user whose lease is
+// held by pubKey if username is empty, and removes its peer from the device
+// right away. It returns the user and the revoked lease, or errLeaseNotFound
+// if there is no such lease.
+func (lm *FileLeaseManager) revokeLease(username, pubKey string) (string, WgRecord, error) {
+	var r WgRecord
+	var user string
+	_, err := lm.updateLeases(func() (bool, error) {
+		lm.wgRecordsMutex.Lock()
+		user = username
+		if user == "" {
+			for u, r := range lm.wgRecords {
+				if r.PubKey == pubKey {
+					user = u
+					break
+				}
+			}
+		}
+		var ok bool
+		r, ok = lm.wgRecords[user]
+		if !ok || (pubKey != "" && r.PubKey != pubKey) {
+			lm.wgRecordsMutex.Unlock()
+			return false, errLeaseNotFound
 		}
+		logger.Info.Printf("Revoking lease of user %s (address %s)", user, r.IP)
+		lm.releaseRecord(user, r)
+		revoked, user := r, user
+		lm.whenSaved(func() { lm.events.emit(newLeaseEvent(leaseEventRevoked, user, revoked)) })
+		lm.wgRecordsMutex.Unlock()
+		lm.updatePeersWhenSaved()
+		return true, nil
+	})
+	if errors.Is(err, errLeaseNotFound) {
+		return "", WgRecord{}, err
 	}
-	return nil
+	return user, r, err
 }
 
 func (lm *FileLeaseManager) updateWgPeers() error {
 	lm.wgRecordsMutex.Lock()
 	defer lm.wgRecordsMutex.Unlock()
+	if err := setPeers(lm.deviceName, lm.peerConfigs()); err != nil {
+		return err
+	}
+	return lm.updateForwardRules()
+}
+
+// peerConfigs returns the desired peers of the device, one per lease that
+// has not expired. It must be called with wgRecordsMutex held.
+func (lm *FileLeaseManager) peerConfigs() []wgtypes.PeerConfig {
 	peers := []wgtypes.PeerConfig{}
+	now := time.Now()
 	for _, r := range lm.wgRecords {
-		peerConfig, err := newPeerConfig(r.PubKey, "", "", []string{fmt.Sprintf("%s/32", r.IP.String())})
+		if r.expires.Before(now) {
+			continue
+		}
+		allowedIPs := []string{fmt.Sprintf("%s/32", r.IP.String())}
+		if ip6 := lm.leaseIP6(r); ip6 != nil {
+			allowedIPs = append(allowedIPs, fmt.Sprintf("%s/128", ip6))
+		}
+		if r.DelegatedPrefix != nil {
+			allowedIPs = append(allowedIPs, r.DelegatedPrefix.String())
+		}
+		peerConfig, err := newPeerConfig(r.PubKey, lm.presharedKey(r.PubKey), "", allowedIPs)
 		if err != nil {
 			logger.Error.Printf("error calculating peer config %v", err)
 			continue
 		}
 		peers = append(peers, *peerConfig)
 	}
-	return setPeers(lm.deviceName, peers)
+	return peers
 }
 
-func (lm *FileLeaseManager) createOrUpdatePeer(username, pubKey string, expiry time.Time) (WgRecord, error) {
+func (lm *FileLeaseManager) createOrUpdatePeer(username string, lr *leaseRequest, expiry time.Time, groups ...string) (WgRecord, error) {
 	if username == "" {
 		return WgRecord{}, fmt.Errorf("Cannot add peer for empty username")
 	}
-	if pubKey == "" {
+	if lr.PubKey == "" {
 		return WgRecord{}, fmt.Errorf("Cannot add peer for empty public key")
 	}
 	lm.wgRecordsMutex.Lock()
 	defer lm.wgRecordsMutex.Unlock()
-	if record, ok := lm.wgRecords[username]; ok {
-		record.PubKey = pubKey
-		record.expires = expiry
-		lm.wgRecords[username] = record
-		return lm.wgRecords[username], nil
-	}
-	// Find all already allocated IP addresses
-	allocatedIPs := []net.IP{lm.ip}
-	for _, r := range lm.wgRecords {
-		allocatedIPs = append(allocatedIPs, r.IP)
-	}
-	// Add the gateway IP to the list of already allocated IPs
-	availableIPs, err := getAvailableIPAddresses(lm.cidr, allocatedIPs)
+	record, ok := lm.wgRecords[username]
+	previous := record
+	conflicting := net.ParseIP(lr.ConflictingIP)
+	network, _ := lm.poolNetwork(lr.Pool)
+	reserved, err := lm.reservedIP(username, lr.PubKey)
 	if err != nil {
 		return WgRecord{}, err
 	}
-	lm.wgRecords[username] = WgRecord{
-		PubKey:  pubKey,
-		IP:      availableIPs[0],
-		expires: expiry,
+	if reserved != nil {
+		if conflicting != nil && reserved.Equal(conflicting) {
+			logger.Info.Printf("Reserved address %s of user %s is in use on their network, keeping it", conflicting, username)
+		}
+		if !record.IP.Equal(reserved) {
+			if err := lm.releaseReservedIP(username, reserved); err != nil {
+				return WgRecord{}, err
+			}
+			record.IP = reserved
+		}
+	} else if !ok || (conflicting != nil && record.IP.Equal(conflicting)) || lm.isReservedIP(record.IP) || !network.Contains(record.IP) || lm.isPoolReserved(record.IP) {
+		var exclude []net.IP
+		if conflicting != nil {
+			logger.Info.Printf("Address %s of user %s is in use on their network, leasing a different one", conflicting, username)
+			exclude = append(exclude, conflicting)
+		}
+		ip := lm.affinityIP(username, lr.PubKey, lr.Pool, exclude...)
+		if ip != nil {
+			logger.Info.Printf("Leasing previous address %s to user %s", ip, username)
+		} else {
+			var err error
+			if ip, err = lm.allocateIP(lr.Pool, lr.PubKey, exclude...); err != nil {
+				return WgRecord{}, err
+			}
+		}
+		record.IP = ip
+	}
+	if ok && record.PubKey != lr.PubKey {
+		// Leases are keyed on the user, so the address and delegated prefix
+		// carry over to the new key and the old peer is removed from the
+		// device on the next update
+		if (lr.ClientID != "" && lr.ClientID == record.ClientID) || (lr.PreviousPubKey != "" && lr.PreviousPubKey == record.PubKey) {
+			logger.Info.Printf("Client %s of user %s rotated its public key, keeping address %s", lr.ClientID, username, record.IP)
+			peerKeyRotationsTotal.Inc()
+		} else {
+			logger.Info.Printf("Lease of user %s taken over by a new public key (client id: %s)", username, lr.ClientID)
+		}
+	}
+	record.PubKey = lr.PubKey
+	record.ClientID = lr.ClientID
+	record.Groups = groups
+	record.expires = expiry
+	record.granted = time.Now()
+	if lr.DelegatedPrefix && lm.prefixPool != nil {
+		prefix, err := lm.delegatePrefix(username, record.DelegatedPrefix)
+		if err != nil {
+			return WgRecord{}, err
+		}
+		record.DelegatedPrefix = prefix
+	} else {
+		record.DelegatedPrefix = nil
+	}
+	lm.wgRecords[username] = record
+	if ok && record.PubKey == previous.PubKey && record.IP.Equal(previous.IP) {
+		lm.whenSaved(func() {
+			leaseRenewalsTotal.Inc()
+			lm.events.emit(newLeaseEvent(leaseEventRenewed, username, record))
+		})
+	} else {
+		lm.whenSaved(func() {
+			leasesGrantedTotal.Inc()
+			lm.events.emit(newLeaseEvent(leaseEventGranted, username, record))
+		})
 	}
 	return lm.wgRecords[username], nil
 }
 
-func (lm *FileLeaseManager) addNewPeer(username, pubKey string, expiry time.Time) (WgRecord, error) {
-	record, err := lm.createOrUpdatePeer(username, pubKey, expiry)
+// allocateIP returns the address picked by the allocator for pubKey out of
+// the addresses of the network of pool, the address network if empty, that
+// are not the server address, leased to a peer, reserved or in exclude. It
+// must be called with wgRecordsMutex held.
+func (lm *FileLeaseManager) allocateIP(pool, pubKey string, exclude ...net.IP) (net.IP, error) {
+	network, serverIP := lm.poolNetwork(pool)
+	allocatedIPs := append([]net.IP{serverIP}, exclude...)
+	for _, r := range lm.wgRecords {
+		allocatedIPs = append(allocatedIPs, r.IP)
+	}
+	for _, r := range lm.reservations {
+		allocatedIPs = append(allocatedIPs, r.ip)
+	}
+	availableIPs, err := getAvailableIPAddresses(network, allocatedIPs)
 	if err != nil {
-		return WgRecord{}, err
+		return nil, err
 	}
-	if err := lm.updateWgPeers(); err != nil {
-		return WgRecord{}, err
+	unreserved := availableIPs[:0]
+	for _, ip := range availableIPs {
+		if !lm.isPoolReserved(ip) {
+			unreserved = append(unreserved, ip)
+		}
+	}
+	if len(unreserved) == 0 {
+		return nil, fmt.Errorf("no available addresses in %s", network)
+	}
+	allocator := lm.allocator
+	if allocator == nil {
+		allocator = sequentialAllocator{}
+	}
+	return allocator.pick(network, unreserved, pubKey)
+}
+
+// reservedIP returns the address reserved for pubKey, or nil if there is none
+// in the network that addresses are currently leased from. It returns
+// errReservedKey if pubKey is reserved for a user other than username. It
+// must be called with wgRecordsMutex held.
+func (lm *FileLeaseManager) reservedIP(username, pubKey string) (net.IP, error) {
+	r, ok := lm.reservations[pubKey]
+	if !ok {
+		return nil, nil
+	}
+	if r.username != username {
+		return nil, errReservedKey
+	}
+	if !lm.cidr.Contains(r.ip) {
+		return nil, nil
 	}
-	if err := lm.saveWgRecords(); err != nil {
+	return r.ip, nil
+}
+
+// checkReservation returns errReservedKey if pubKey is reserved for a user
+// other than username.
+func (lm *FileLeaseManager) checkReservation(username, pubKey string) error {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	_, err := lm.reservedIP(username, pubKey)
+	return err
+}
+
+// isReservedIP returns whether ip is reserved for any public key.
+func (lm *FileLeaseManager) isReservedIP(ip net.IP) bool {
+	for _, r := range lm.reservations {
+		if r.ip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseReservedIP moves the lease of any other user off ip, so that it can
+// be leased to the key it is reserved for. This only happens for leases
+// granted before the reservation was configured. It must be called with
+// wgRecordsMutex held.
+func (lm *FileLeaseManager) releaseReservedIP(username string, ip net.IP) error {
+	for u, r := range lm.wgRecords {
+		if u == username || !r.IP.Equal(ip) {
+			continue
+		}
+		newIP, err := lm.allocateIP("", r.PubKey)
+		if err != nil {
+			return err
+		}
+		logger.Info.Printf("Address %s of user %s is reserved, moving their lease to %s", ip, u, newIP)
+		r.IP = newIP
+		lm.wgRecords[u] = r
+	}
+	return nil
+}
+
+// delegatePrefix returns the prefix to delegate to username. The current
+// prefix of the user, or the one reserved for them from a previous lease, is
+// preferred so that reconnecting peers keep the same prefix. A new one is
+// only allocated if the old one is no longer reservable, ie. the pool or the
+// prefix length have changed. It must be called with wgRecordsMutex held.
+func (lm *FileLeaseManager) delegatePrefix(username string, current *net.IPNet) (*net.IPNet, error) {
+	if current != nil && lm.prefixReservable(current) {
+		return current, nil
+	}
+	if r, ok := lm.prefixReservations[username]; ok {
+		delete(lm.prefixReservations, username)
+		if lm.prefixReservable(r.DelegatedPrefix) {
+			return r.DelegatedPrefix, nil
+		}
+	}
+	allocated := []*net.IPNet{}
+	for u, r := range lm.wgRecords {
+		if u != username && r.DelegatedPrefix != nil {
+			allocated = append(allocated, r.DelegatedPrefix)
+		}
+	}
+	for _, r := range lm.prefixReservations {
+		allocated = append(allocated, r.DelegatedPrefix)
+	}
+	if prefix := getAvailablePrefix(lm.prefixPool, lm.prefixLength, allocated); prefix != nil {
+		return prefix, nil
+	}
+	// Reclaim the oldest reservation of a user that is not connected
+	oldest := ""
+	for u, r := range lm.prefixReservations {
+		if lm.prefixReservable(r.DelegatedPrefix) && (oldest == "" || r.expires.Before(lm.prefixReservations[oldest].expires)) {
+			oldest = u
+		}
+	}
+	if oldest == "" {
+		return nil, fmt.Errorf("no available prefixes in %s", lm.prefixPool)
+	}
+	prefix := lm.prefixReservations[oldest].DelegatedPrefix
+	delete(lm.prefixReservations, oldest)
+	logger.Info.Printf("reclaimed prefix %s reserved for user %s", prefix, oldest)
+	return prefix, nil
+}
+
+// prefixReservable returns whether prefix can still be delegated from the
+// configured pool.
+func (lm *FileLeaseManager) prefixReservable(prefix *net.IPNet) bool {
+	ones, _ := prefix.Mask.Size()
+	return ones == lm.prefixLength && lm.prefixPool.Contains(prefix.IP)
+}
+
+// addNewPeer grants or renews the lease of username, for the members of
+// groups.
+func (lm *FileLeaseManager) addNewPeer(username string, lr *leaseRequest, expiry time.Time, groups ...string) (WgRecord, error) {
+	var record WgRecord
+	_, err := lm.updateLeases(func() (bool, error) {
+		var err error
+		// Failures can leave the leases of other users moved off a
+		// reserved address, which is dropped as a change
+		if record, err = lm.createOrUpdatePeer(username, lr, expiry, groups...); err != nil {
+			return true, err
+		}
+		lm.updatePeersWhenSaved()
+		return true, nil
+	})
+	if err != nil {
 		return WgRecord{}, err
 	}
 	return record, nil
@@ -236,6 +790,34 @@ func getAvailableIPAddresses(cidr *net.IPNet, allocated []net.IP) ([]net.IP, err
 	return available, nil
 }
 
+// getAvailablePrefix returns the first prefix of the given length in pool
+// that does not overlap with any of the allocated prefixes, or nil if there
+// is none.
+func getAvailablePrefix(pool *net.IPNet, length int, allocated []*net.IPNet) *net.IPNet {
+	mask := net.CIDRMask(length, 32)
+	start := binary.BigEndian.Uint32(pool.IP.To4())
+	step := uint64(1) << uint(32-length)
+	for n := uint64(start); n <= uint64(^uint32(0)); n += step {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(n))
+		if !pool.Contains(ip) {
+			break
+		}
+		prefix := &net.IPNet{IP: ip, Mask: mask}
+		found := false
+		for _, a := range allocated {
+			found = a.Contains(prefix.IP) || prefix.Contains(a.IP)
+			if found {
+				break
+			}
+		}
+		if !found {
+			return prefix
+		}
+	}
+	return nil
+}
+
 func incIPAddress(ip net.IP) {
 	for j := len(ip) - 1; j >= 0; j-- {
 		ip[j]++
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 func TestFileLeaseManager_createOrUpdatePeer(t *testing.T) {
@@ -24,7 +28,7 @@ func TestFileLeaseManager_createOrUpdatePeer(t *testing.T) {
 	testExpiry := time.Unix(0, 0)
 
 	// Test that lm.ip is skipped
-	record, err := lm.createOrUpdatePeer(testUsername, testPubKey1, testExpiry)
+	record, err := lm.createOrUpdatePeer(testUsername, &leaseRequest{PubKey: testPubKey1}, testExpiry)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -35,7 +39,7 @@ func TestFileLeaseManager_createOrUpdatePeer(t *testing.T) {
 	assert.Equal(t, testPubKey1, lm.wgRecords[testUsername].PubKey)
 	// Test that same username with different public key will replace the
 	// existing record, instead of adding a new one and return the same address
-	record2, err := lm.createOrUpdatePeer(testUsername, testPubKey2, testExpiry)
+	record2, err := lm.createOrUpdatePeer(testUsername, &leaseRequest{PubKey: testPubKey2}, testExpiry)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -45,10 +49,210 @@ func TestFileLeaseManager_createOrUpdatePeer(t *testing.T) {
 		t.Fatalf("Expected the same ip address for the same user, got %v", record2.IP)
 	}
 	// Test that empty username will error
-	_, err = lm.createOrUpdatePeer("", testPubKey2, testExpiry)
+	_, err = lm.createOrUpdatePeer("", &leaseRequest{PubKey: testPubKey2}, testExpiry)
 	assert.Equal(t, err, fmt.Errorf("Cannot add peer for empty username"))
 }
 
+func TestFileLeaseManager_ClientIDRoundTrip(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/20")
+	filename := filepath.Join(t.TempDir(), "leases")
+	lm := &FileLeaseManager{
+		wgRecords: map[string]WgRecord{},
+		cidr:      network,
+		store:     newFileLeaseStore(filename),
+		ip:        ip,
+	}
+	testPubKey := "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY="
+	testExpiry := time.Now().Add(time.Hour)
+	if _, err := lm.createOrUpdatePeer("test1@example.com", &leaseRequest{PubKey: testPubKey, ClientID: "laptop-1"}, testExpiry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lm.createOrUpdatePeer("test2@example.com", &leaseRequest{PubKey: testPubKey}, testExpiry); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.saveWgRecords(); err != nil {
+		t.Fatal(err)
+	}
+	lm2 := &FileLeaseManager{store: newFileLeaseStore(filename)}
+	if err := lm2.loadWgRecords(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "laptop-1", lm2.wgRecords["test1@example.com"].ClientID)
+	assert.Equal(t, "", lm2.wgRecords["test2@example.com"].ClientID)
+}
+
+func TestFileLeaseManager_DelegatedPrefixStability(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/20")
+	_, pool, _ := net.ParseCIDR("10.100.0.0/24")
+	filename := filepath.Join(t.TempDir(), "leases")
+	newLeaseManager := func() *FileLeaseManager {
+		return &FileLeaseManager{
+			cidr:         network,
+			store:        newFileLeaseStore(filename),
+			ip:           ip,
+			prefixLength: 29,
+			prefixPool:   pool,
+		}
+	}
+	lr := &leaseRequest{PubKey: "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=", DelegatedPrefix: true}
+	other := &leaseRequest{PubKey: "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=", DelegatedPrefix: true}
+
+	lm := newLeaseManager()
+	if err := lm.loadWgRecords(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lm.createOrUpdatePeer("other@example.com", other, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	record, err := lm.createOrUpdatePeer("site@example.com", lr, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.100.0.8/29", record.DelegatedPrefix.String())
+	if err := lm.saveWgRecords(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart while the lease is still active
+	lm = newLeaseManager()
+	if err := lm.loadWgRecords(); err != nil {
+		t.Fatal(err)
+	}
+	record, err = lm.createOrUpdatePeer("site@example.com", lr, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.100.0.8/29", record.DelegatedPrefix.String())
+
+	// Let the lease expire and restart: the prefix should stay reserved and
+	// not be handed out to other users
+	record.expires = time.Now().Add(-time.Minute)
+	lm.wgRecords["site@example.com"] = record
+	if err := lm.saveWgRecords(); err != nil {
+		t.Fatal(err)
+	}
+	lm = newLeaseManager()
+	if err := lm.loadWgRecords(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(lm.wgRecords))
+	newcomer, err := lm.createOrUpdatePeer("new@example.com", &leaseRequest{PubKey: lr.PubKey, DelegatedPrefix: true}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.100.0.16/29", newcomer.DelegatedPrefix.String())
+	record, err = lm.createOrUpdatePeer("site@example.com", lr, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.100.0.8/29", record.DelegatedPrefix.String())
+}
+
+func TestFileLeaseManager_GracePeriod(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	filename := filepath.Join(t.TempDir(), "leases")
+	newLeaseManager := func() *FileLeaseManager {
+		return &FileLeaseManager{
+			cidr:        network,
+			gracePeriod: time.Hour,
+			store:       newFileLeaseStore(filename),
+			ip:          ip,
+		}
+	}
+	lr := &leaseRequest{PubKey: validPublicKey}
+	lm := newLeaseManager()
+	if err := lm.loadWgRecords(); err != nil {
+		t.Fatal(err)
+	}
+	record, err := lm.createOrUpdatePeer("laptop@example.com", lr, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lm.createOrUpdatePeer("lost@example.com", &leaseRequest{PubKey: newWgKey().String()}, time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// Expired leases have no peer on the device
+	assert.Empty(t, lm.peerConfigs())
+	if err := lm.saveWgRecords(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the lease within the grace period survives a restart, and its
+	// address is not handed out to other users
+	lm = newLeaseManager()
+	if err := lm.loadWgRecords(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(lm.wgRecords))
+	other, err := lm.createOrUpdatePeer("other@example.com", &leaseRequest{PubKey: newWgKey().String()}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, record.IP, other.IP)
+	renewed, err := lm.createOrUpdatePeer("laptop@example.com", lr, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, record.IP.String(), renewed.IP.String())
+	assert.Equal(t, 2, len(lm.peerConfigs()))
+}
+
+// slowLeaseStore saves leases slowly and counts the saves that overlap.
+type slowLeaseStore struct {
+	leaseStore
+	saving, overlaps int32
+}
+
+func (s *slowLeaseStore) save(leases []storedLease) error {
+	if atomic.AddInt32(&s.saving, 1) > 1 {
+		atomic.AddInt32(&s.overlaps, 1)
+	}
+	defer atomic.AddInt32(&s.saving, -1)
+	time.Sleep(time.Millisecond)
+	return s.leaseStore.save(leases)
+}
+
+func TestFileLeaseManager_ConcurrentUpdates(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	store := &slowLeaseStore{leaseStore: newFileLeaseStore(filepath.Join(t.TempDir(), "leases"))}
+	lm := &FileLeaseManager{wgRecords: map[string]WgRecord{}, cidr: network, ip: ip, store: store}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := lm.updateLeases(func() (bool, error) {
+				_, err := lm.createOrUpdatePeer(fmt.Sprintf("user%d@example.com", i), &leaseRequest{PubKey: newWgKey().String()}, time.Now().Add(time.Hour))
+				return true, err
+			})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	// Snapshots of the leases are saved one at a time, so the last save
+	// holds every lease
+	assert.Equal(t, int32(0), store.overlaps)
+	leases, err := store.load()
+	assert.NoError(t, err)
+	assert.Equal(t, 20, len(leases))
+}
+
+func TestGetAvailablePrefix(t *testing.T) {
+	_, pool, _ := net.ParseCIDR("10.100.0.0/28")
+	_, a, _ := net.ParseCIDR("10.100.0.0/29")
+	assert.Equal(t, "10.100.0.8/29", getAvailablePrefix(pool, 29, []*net.IPNet{a}).String())
+	_, b, _ := net.ParseCIDR("10.100.0.12/30")
+	assert.Nil(t, getAvailablePrefix(pool, 29, []*net.IPNet{a, b}))
+}
+
 func TestIncIPAddress(t *testing.T) {
 	testCases := []struct{ t, e net.IP }{
 		{
@@ -93,3 +297,111 @@ func TestGetAvailableIPAddresses(t *testing.T) {
 		}
 	}
 }
+
+func TestFileLeaseManager_KeyRotation(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/20")
+	_, pool, _ := net.ParseCIDR("10.100.0.0/24")
+	lm := &FileLeaseManager{
+		wgRecords:    map[string]WgRecord{},
+		cidr:         network,
+		ip:           ip,
+		prefixLength: 29,
+		prefixPool:   pool,
+	}
+	oldKey := newWgKey()
+	newKey := newWgKey()
+	expiry := time.Now().Add(time.Hour)
+	if _, err := lm.createOrUpdatePeer("other@example.com", &leaseRequest{PubKey: newWgKey().String(), ClientID: "other"}, expiry); err != nil {
+		t.Fatal(err)
+	}
+	before, err := lm.createOrUpdatePeer("test@example.com", &leaseRequest{PubKey: oldKey.String(), ClientID: "laptop", DelegatedPrefix: true}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := lm.createOrUpdatePeer("test@example.com", &leaseRequest{PubKey: newKey.String(), ClientID: "laptop", DelegatedPrefix: true}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, newKey.String(), after.PubKey)
+	assert.Equal(t, before.IP, after.IP)
+	assert.Equal(t, before.DelegatedPrefix, after.DelegatedPrefix)
+	assert.Equal(t, 2, len(lm.wgRecords))
+
+	// The old peer is removed from the device, and the new one added
+	desired := lm.peerConfigs()
+	keys := []wgtypes.Key{}
+	for _, p := range desired {
+		keys = append(keys, p.PublicKey)
+	}
+	assert.Contains(t, keys, newKey)
+	assert.NotContains(t, keys, oldKey)
+	removed := []wgtypes.Key{}
+	for _, p := range reconcilePeers([]wgtypes.Peer{{PublicKey: oldKey}}, desired, nil) {
+		if p.Remove {
+			removed = append(removed, p.PublicKey)
+		}
+	}
+	assert.Equal(t, []wgtypes.Key{oldKey}, removed)
+}
+
+func TestFileLeaseManager_Reservations(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	reservedKey := newWgKey().String()
+	lm := &FileLeaseManager{
+		wgRecords: map[string]WgRecord{},
+		cidr:      network,
+		ip:        ip,
+	}
+	expiry := time.Now().Add(time.Hour)
+	// A lease granted before the reservation was configured
+	old, err := lm.createOrUpdatePeer("old@example.com", &leaseRequest{PubKey: newWgKey().String()}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.2", old.IP.String())
+
+	lm.reservations = map[string]ipReservation{reservedKey: {ip: net.ParseIP("10.90.0.2"), username: "ci@example.com"}}
+	record, err := lm.createOrUpdatePeer("ci@example.com", &leaseRequest{PubKey: reservedKey}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.2", record.IP.String())
+	// The older lease is moved off the reserved address
+	assert.Equal(t, "10.90.0.3", lm.wgRecords["old@example.com"].IP.String())
+
+	// Dynamic leases skip reserved addresses, even if they are not leased
+	lm.reservations[newWgKey().String()] = ipReservation{ip: net.ParseIP("10.90.0.4"), username: "gw@example.com"}
+	record, err = lm.createOrUpdatePeer("new@example.com", &leaseRequest{PubKey: newWgKey().String()}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.5", record.IP.String())
+
+	// The reserved address is kept even if it conflicts on the network of
+	// the agent
+	record, err = lm.createOrUpdatePeer("ci@example.com", &leaseRequest{PubKey: reservedKey, ConflictingIP: "10.90.0.2"}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.2", record.IP.String())
+
+	// Other users cannot lease a reserved key, which is not secret
+	_, err = lm.createOrUpdatePeer("other@example.com", &leaseRequest{PubKey: reservedKey}, expiry)
+	assert.Equal(t, errReservedKey, err)
+	assert.Equal(t, errReservedKey, lm.checkReservation("other@example.com", reservedKey))
+	assert.NoError(t, lm.checkReservation("ci@example.com", reservedKey))
+	_, err = lm.previewLease("other@example.com", &leaseRequest{PubKey: reservedKey})
+	assert.Equal(t, errReservedKey, err)
+	assert.Equal(t, "10.90.0.2", lm.wgRecords["ci@example.com"].IP.String())
+
+	// Users leasing a reserved address with a different key are moved
+	record, err = lm.createOrUpdatePeer("ci@example.com", &leaseRequest{PubKey: newWgKey().String()}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.6", record.IP.String())
+}
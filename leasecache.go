@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+type cachedLease struct {
+	inputs   string
+	response leaseResponse
+	username string
+}
+
+// leaseCache holds the latest lease response per peer public key, so that
+// renewals of an unchanged lease can skip allocating an address and
+// reconfiguring the device.
+type leaseCache struct {
+	leases map[string]cachedLease
+	// pubKeys maps users to the public key of their cached lease
+	pubKeys map[string]string
+	mutex   sync.Mutex
+}
+
+func newLeaseCache() *leaseCache {
+	return &leaseCache{
+		leases:  make(map[string]cachedLease),
+		pubKeys: make(map[string]string),
+	}
+}
+
+// leaseCacheInputs returns the inputs of a lease request that the response
+// depends on, or an empty string if the response should not be cached.
+func leaseCacheInputs(username string, lr *leaseRequest, groups ...string) string {
+	if lr.ConflictingIP != "" {
+		return ""
+	}
+	b, err := json.Marshal(&struct {
+		Username        string
+		ClientID        string
+		Extra           map[string]string
+		DelegatedPrefix bool
+		Pool            string
+		Device          string
+		Groups          []string
+	}{username, lr.ClientID, lr.Extra, lr.DelegatedPrefix, lr.Pool, lr.Device, groups})
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// get returns the cached response for pubKey, if it was cached for the same
+// inputs. It is safe to call on a nil leaseCache.
+func (c *leaseCache) get(pubKey, inputs string) (leaseResponse, bool) {
+	if c == nil || inputs == "" {
+		return leaseResponse{}, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	l, ok := c.leases[pubKey]
+	if !ok || l.inputs != inputs {
+		return leaseResponse{}, false
+	}
+	return l.response, true
+}
+
+// put caches response for pubKey, replacing any lease cached for the same
+// user. It is safe to call on a nil leaseCache.
+func (c *leaseCache) put(pubKey, username, inputs string, response leaseResponse) {
+	if c == nil || inputs == "" {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if old, ok := c.pubKeys[username]; ok {
+		delete(c.leases, old)
+	}
+	c.pubKeys[username] = pubKey
+	c.leases[pubKey] = cachedLease{inputs: inputs, response: response, username: username}
+}
+
+// invalidate removes the lease cached for pubKey. It is safe to call on a
+// nil leaseCache.
+func (c *leaseCache) invalidate(pubKey string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if l, ok := c.leases[pubKey]; ok {
+		delete(c.pubKeys, l.username)
+		delete(c.leases, pubKey)
+	}
+}
+
+// clear removes all cached leases. It is safe to call on a nil leaseCache.
+func (c *leaseCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.leases = make(map[string]cachedLease)
+	c.pubKeys = make(map[string]string)
+}
+
+// holdsLease returns whether the current lease of username is held by pubKey.
+func (lm *FileLeaseManager) holdsLease(username, pubKey string) bool {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	record, ok := lm.wgRecords[username]
+	return ok && record.PubKey == pubKey
+}
+
+// extendLease updates the expiry of the lease of username, as long as it is
+// still held by pubKey. It returns false if the lease no longer exists or
+// has changed, in which case it has to be granted again.
+func (lm *FileLeaseManager) extendLease(username, pubKey string, expiry time.Time) bool {
+	extended, err := lm.updateLeases(func() (bool, error) {
+		lm.wgRecordsMutex.Lock()
+		defer lm.wgRecordsMutex.Unlock()
+		record, ok := lm.wgRecords[username]
+		if !ok || record.PubKey != pubKey || !record.expires.After(time.Now()) {
+			return false, nil
+		}
+		record.expires = expiry
+		record.granted = time.Now()
+		lm.wgRecords[username] = record
+		lm.whenSaved(func() {
+			leaseRenewalsTotal.Inc()
+			lm.events.emit(newLeaseEvent(leaseEventRenewed, username, record))
+		})
+		return true, nil
+	})
+	if err != nil {
+		logger.Error.Printf("Cannot save leases: %v", err)
+	}
+	return extended
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPLeaseHandler_LeaseCache(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	introspection := newTestIntrospectionServer("test@example.com")
+	defer introspection.Close()
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	lm := &FileLeaseManager{
+		cidr:  network,
+		store: newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+		ip:    ip,
+		wgRecords: map[string]WgRecord{
+			"test@example.com": {PubKey: validPublicKey, IP: net.ParseIP("10.90.0.2"), expires: time.Now().Add(time.Minute)},
+		},
+	}
+	lh := &HTTPLeaseHandler{
+		cache:          newLeaseCache(),
+		leaseManager:   lm,
+		serverConfig:   &serverConfig{LeaseTTL: time.Hour},
+		tokenValidator: newTokenValidator("client_id", introspection.URL),
+	}
+	lr := &leaseRequest{PubKey: validPublicKey, ClientID: "laptop", Extra: map[string]string{"site": "london"}}
+	inputs := leaseCacheInputs("test@example.com", lr)
+	lh.cache.put(validPublicKey, "test@example.com", inputs, leaseResponse{
+		Status:  "success",
+		IP:      "10.90.0.2/32",
+		PubKey:  "server",
+		Expires: time.Now().Add(time.Minute),
+	})
+
+	// A pure renewal is served from the cache, without touching the device
+	body, _ := json.Marshal(lr)
+	req := httptest.NewRequest("POST", "/newPeerLease", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	lh.newPeerLease(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := &leaseResponse{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.2/32", resp.IP)
+	// only the expiry is refreshed
+	assert.True(t, resp.Expires.After(time.Now().Add(59*time.Minute)))
+	assert.True(t, lm.wgRecords["test@example.com"].expires.After(time.Now().Add(59*time.Minute)))
+
+	// Changes in the policy inputs miss the cache
+	_, ok := lh.cache.get(validPublicKey, inputs)
+	assert.True(t, ok)
+	changed := *lr
+	changed.Extra = map[string]string{"site": "paris"}
+	_, ok = lh.cache.get(validPublicKey, leaseCacheInputs("test@example.com", &changed))
+	assert.False(t, ok)
+	_, ok = lh.cache.get(validPublicKey, leaseCacheInputs("other@example.com", lr))
+	assert.False(t, ok)
+	conflict := *lr
+	conflict.ConflictingIP = "10.90.0.2"
+	_, ok = lh.cache.get(validPublicKey, leaseCacheInputs("test@example.com", &conflict))
+	assert.False(t, ok)
+
+	// and so do leases that have been replaced or expired
+	assert.False(t, lm.extendLease("test@example.com", "other key", time.Now().Add(time.Hour)))
+	delete(lm.wgRecords, "test@example.com")
+	assert.False(t, lm.extendLease("test@example.com", validPublicKey, time.Now().Add(time.Hour)))
+
+	// Caching a new key of the same user replaces the old entry
+	lh.cache.put("new key", "test@example.com", inputs, leaseResponse{})
+	_, ok = lh.cache.get(validPublicKey, inputs)
+	assert.False(t, ok)
+	assert.Equal(t, 1, len(lh.cache.leases))
+}
+
+func TestHTTPLeaseHandler_Renew(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	introspection := newTestIntrospectionServer("test@example.com")
+	defer introspection.Close()
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	lm := &FileLeaseManager{
+		cidr:  network,
+		store: newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+		ip:    ip,
+		wgRecords: map[string]WgRecord{
+			"test@example.com": {PubKey: validPublicKey, IP: net.ParseIP("10.90.0.2"), expires: time.Now().Add(time.Minute)},
+		},
+	}
+	lh := &HTTPLeaseHandler{
+		cache:          newLeaseCache(),
+		leaseManager:   lm,
+		serverConfig:   &serverConfig{LeaseTTL: time.Hour},
+		tokenValidator: newTokenValidator("client_id", introspection.URL),
+	}
+	renew := func(lr *leaseRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(lr)
+		req := httptest.NewRequest("POST", "/newPeerLease", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		lh.newPeerLease(w, req)
+		return w
+	}
+
+	// Keys that do not hold the lease of the user are not granted one
+	w := renew(&leaseRequest{PubKey: newWgKey().String(), Renew: true})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, validPublicKey, lm.wgRecords["test@example.com"].PubKey)
+
+	// while the key holding it renews it
+	lr := &leaseRequest{PubKey: validPublicKey, Renew: true}
+	lh.cache.put(validPublicKey, "test@example.com", leaseCacheInputs("test@example.com", lr), leaseResponse{
+		Status:  "success",
+		IP:      "10.90.0.2/32",
+		Expires: time.Now().Add(time.Minute),
+	})
+	w = renew(lr)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, lm.wgRecords["test@example.com"].expires.After(time.Now().Add(59*time.Minute)))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultLeaseEventsBufferSize     = 1024
+	defaultLeaseEventsPublishTimeout = 5 * time.Second
+)
+
+// errNATSNotSupported is returned for a `nats` lease events config in builds
+// without the nats tag.
+var errNATSNotSupported = errors.New("NATS support is not built in, rebuild with `-tags nats`")
+
+type leaseEventType string
+
+const (
+	// leaseEventGranted is published when a user is leased a new address.
+	leaseEventGranted leaseEventType = "LeaseGranted"
+	// leaseEventRenewed is published when an existing lease is extended.
+	leaseEventRenewed leaseEventType = "LeaseRenewed"
+	// leaseEventRevoked is published when a lease is reclaimed before it
+	// expires.
+	leaseEventRevoked leaseEventType = "LeaseRevoked"
+	// leaseEventExpired is published when a lease is removed after it
+	// expired.
+	leaseEventExpired leaseEventType = "LeaseExpired"
+)
+
+// leaseEvent describes a change to the lease of a user.
+type leaseEvent struct {
+	Type            leaseEventType `json:"type"`
+	Username        string         `json:"username"`
+	ClientID        string         `json:"clientID,omitempty"`
+	PublicKey       string         `json:"publicKey"`
+	IP              string         `json:"ip"`
+	DelegatedPrefix string         `json:"delegatedPrefix,omitempty"`
+	Expires         time.Time      `json:"expires"`
+	Time            time.Time      `json:"time"`
+}
+
+func newLeaseEvent(t leaseEventType, username string, r WgRecord) leaseEvent {
+	e := leaseEvent{
+		Type:      t,
+		Username:  username,
+		ClientID:  r.ClientID,
+		PublicKey: r.PubKey,
+		IP:        r.IP.String(),
+		Expires:   r.expires.UTC(),
+		Time:      time.Now().UTC(),
+	}
+	if r.DelegatedPrefix != nil {
+		e.DelegatedPrefix = r.DelegatedPrefix.String()
+	}
+	return e
+}
+
+// leaseEventPublisher is implemented by the backends lease events are
+// published to.
+type leaseEventPublisher interface {
+	Publish(ctx context.Context, event leaseEvent) error
+}
+
+var (
+	leaseEventsDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wiresteward_lease_events_dropped_total",
+		Help: "Number of lease events dropped because the event buffer was full.",
+	})
+	leaseEventsPublishErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wiresteward_lease_events_publish_errors_total",
+		Help: "Number of lease events that could not be published.",
+	})
+)
+
+// leaseEventQueue publishes lease events asynchronously via a bounded
+// buffer, so that the lease path never waits on the backend. Events emitted
+// while the buffer is full are dropped.
+type leaseEventQueue struct {
+	ch        chan leaseEvent
+	publisher leaseEventPublisher
+	timeout   time.Duration
+}
+
+func newLeaseEventQueue(publisher leaseEventPublisher, size int, timeout time.Duration) *leaseEventQueue {
+	if size <= 0 {
+		size = defaultLeaseEventsBufferSize
+	}
+	if timeout <= 0 {
+		timeout = defaultLeaseEventsPublishTimeout
+	}
+	return &leaseEventQueue{
+		ch:        make(chan leaseEvent, size),
+		publisher: publisher,
+		timeout:   timeout,
+	}
+}
+
+// emit queues e for publishing without blocking. It is safe to call on a nil
+// leaseEventQueue.
+func (q *leaseEventQueue) emit(e leaseEvent) {
+	if q == nil {
+		return
+	}
+	select {
+	case q.ch <- e:
+	default:
+		leaseEventsDroppedTotal.Inc()
+	}
+}
+
+// run publishes queued events until the queue is closed.
+func (q *leaseEventQueue) run() {
+	for e := range q.ch {
+		ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+		if err := q.publisher.Publish(ctx, e); err != nil {
+			leaseEventsPublishErrorsTotal.Inc()
+			logger.Error.Printf("Cannot publish %s event for user %s: %v", e.Type, e.Username, err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,82 @@
+// +build nats
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsSupported is set in builds with the nats tag, which link the NATS
+// client.
+const natsSupported = true
+
+// natsPublisher publishes lease events as JSON messages to a NATS subject,
+// which has to be captured by a JetStream stream. Publishing waits for the
+// stream to acknowledge the message, so that events are only counted as
+// published once they are stored. The connection is made on the first event,
+// the client reconnects by itself after that.
+type natsPublisher struct {
+	url     string
+	subject string
+	options []nats.Option
+	js      nats.JetStreamContext
+	mutex   sync.Mutex
+}
+
+func newNATSPublisher(cfg *serverNATSConfig) (*natsPublisher, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+		return nil, fmt.Errorf("expected a nats://host:port or tls://host:port url, got: %q", cfg.URL)
+	}
+	options := []nats.Option{nats.Name("wiresteward"), nats.MaxReconnects(-1)}
+	if cfg.CAFile != "" {
+		options = append(options, nats.RootCAs(cfg.CAFile))
+	}
+	if cfg.CredentialsFilename != "" {
+		options = append(options, nats.UserCredentials(cfg.CredentialsFilename))
+	}
+	return &natsPublisher{url: cfg.URL, subject: cfg.Subject, options: options}, nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, event leaseEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	js, err := p.jetStream()
+	if err != nil {
+		return err
+	}
+	_, err = js.Publish(p.subject, payload, nats.Context(ctx))
+	return err
+}
+
+// jetStream returns the JetStream context of the connection to the server,
+// connecting on first use.
+func (p *natsPublisher) jetStream() (nats.JetStreamContext, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.js != nil {
+		return p.js, nil
+	}
+	conn, err := nats.Connect(p.url, p.options...)
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.js = js
+	return js, nil
+}
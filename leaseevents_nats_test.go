@@ -0,0 +1,83 @@
+// +build nats
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNATSPublisher(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	// The server acknowledges published messages like a JetStream stream
+	// capturing the subject does
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"max_payload\":1048576,\"headers\":true}\r\n")
+		sid := ""
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch fields := strings.Fields(line); fields[0] {
+			case "SUB":
+				sid = fields[len(fields)-1]
+			case "PUB":
+				var size int
+				fmt.Sscanf(fields[len(fields)-1], "%d", &size)
+				payload := make([]byte, size+2)
+				if _, err := io.ReadFull(r, payload); err != nil {
+					return
+				}
+				received <- fields[1] + " " + string(payload[:size])
+				if len(fields) == 4 {
+					ack := `{"stream":"LEASES","seq":1}`
+					fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", fields[2], sid, len(ack), ack)
+				}
+			case "PING":
+				fmt.Fprintf(conn, "PONG\r\n")
+			}
+		}
+	}()
+
+	p, err := newNATSPublisher(&serverNATSConfig{URL: "nats://" + l.Addr().String(), Subject: "wiresteward.leases"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	event := leaseEvent{Type: leaseEventExpired, Username: "foo@example.com", IP: "10.90.0.2"}
+	assert.NoError(t, p.Publish(ctx, event))
+	msg := <-received
+	assert.True(t, strings.HasPrefix(msg, "wiresteward.leases "))
+	var got leaseEvent
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(msg, "wiresteward.leases ")), &got))
+	assert.Equal(t, event, got)
+
+	for _, u := range []string{"http://localhost:4222", "nats://", "localhost:4222"} {
+		_, err = newNATSPublisher(&serverNATSConfig{URL: u, Subject: "wiresteward.leases"})
+		assert.Error(t, err, u)
+	}
+	_, err = newNATSPublisher(&serverNATSConfig{URL: "tls://nats.example.com:4222", Subject: "wiresteward.leases", CredentialsFilename: "/etc/wiresteward/nats.creds"})
+	assert.NoError(t, err)
+}
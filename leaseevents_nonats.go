@@ -0,0 +1,11 @@
+// +build !nats
+
+package main
+
+// natsSupported is unset in builds without the nats tag, so that the NATS
+// client is only linked into binaries that need it.
+const natsSupported = false
+
+func newNATSPublisher(cfg *serverNATSConfig) (leaseEventPublisher, error) {
+	return nil, errNATSNotSupported
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeLeaseEventPublisher struct {
+	events chan leaseEvent
+}
+
+func (p *fakeLeaseEventPublisher) Publish(ctx context.Context, event leaseEvent) error {
+	p.events <- event
+	return nil
+}
+
+func TestFileLeaseManager_LeaseEvents(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	publisher := &fakeLeaseEventPublisher{events: make(chan leaseEvent, 10)}
+	lm := &FileLeaseManager{
+		cidr:      network,
+		events:    newLeaseEventQueue(publisher, 10, time.Second),
+		store:     newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+		ip:        ip,
+		wgRecords: map[string]WgRecord{},
+	}
+	go lm.events.run()
+	defer close(lm.events.ch)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	key := newWgKey().String()
+	// Events are emitted once the leases are saved
+	lease := func(lr *leaseRequest, expires time.Time) error {
+		_, err := lm.updateLeases(func() (bool, error) {
+			_, err := lm.createOrUpdatePeer("foo@example.com", lr, expires)
+			return true, err
+		})
+		return err
+	}
+
+	err := lease(&leaseRequest{PubKey: key, ClientID: "laptop"}, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := <-publisher.events
+	assert.Equal(t, leaseEventGranted, e.Type)
+	assert.Equal(t, "foo@example.com", e.Username)
+	assert.Equal(t, "laptop", e.ClientID)
+	assert.Equal(t, key, e.PublicKey)
+	assert.Equal(t, "10.90.0.2", e.IP)
+	assert.True(t, expires.Equal(e.Expires))
+
+	err = lease(&leaseRequest{PubKey: key, ClientID: "laptop"}, expires.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = <-publisher.events
+	assert.Equal(t, leaseEventRenewed, e.Type)
+	assert.True(t, expires.Add(time.Hour).Equal(e.Expires))
+
+	assert.True(t, lm.extendLease("foo@example.com", key, expires.Add(2*time.Hour)))
+	e = <-publisher.events
+	assert.Equal(t, leaseEventRenewed, e.Type)
+	assert.True(t, expires.Add(2*time.Hour).Equal(e.Expires))
+
+	// A new key is leased a new peer
+	newKey := newWgKey().String()
+	err = lease(&leaseRequest{PubKey: newKey}, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = <-publisher.events
+	assert.Equal(t, leaseEventGranted, e.Type)
+	assert.Equal(t, newKey, e.PublicKey)
+	assert.Equal(t, "10.90.0.2", e.IP)
+}
+
+// conflictingLeaseStore is a shared lease store that another server keeps
+// changing, conflicts times.
+type conflictingLeaseStore struct {
+	leases    []storedLease
+	version   uint64
+	conflicts int
+}
+
+func (s *conflictingLeaseStore) load() ([]storedLease, error) { return s.leases, nil }
+
+func (s *conflictingLeaseStore) save(leases []storedLease) error {
+	s.leases = leases
+	return nil
+}
+
+func (s *conflictingLeaseStore) loadVersion() ([]storedLease, uint64, error) {
+	return s.leases, s.version, nil
+}
+
+func (s *conflictingLeaseStore) saveVersion(leases []storedLease, version uint64) error {
+	if s.conflicts > 0 {
+		s.conflicts--
+		s.version++
+		return errLeaseStoreConflict
+	}
+	s.leases, s.version = leases, s.version+1
+	return nil
+}
+
+func TestFileLeaseManager_LeaseEventsConflicts(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	publisher := &fakeLeaseEventPublisher{events: make(chan leaseEvent, 10)}
+	store := &conflictingLeaseStore{conflicts: 2}
+	lm := &FileLeaseManager{
+		cidr:      network,
+		events:    newLeaseEventQueue(publisher, 10, time.Second),
+		store:     store,
+		ip:        ip,
+		wgRecords: map[string]WgRecord{},
+	}
+	lease := func(username string) error {
+		_, err := lm.updateLeases(func() (bool, error) {
+			_, err := lm.createOrUpdatePeer(username, &leaseRequest{PubKey: newWgKey().String()}, time.Now().Add(time.Hour))
+			return true, err
+		})
+		return err
+	}
+
+	// Updates applied again after conflicts are only reported once
+	assert.NoError(t, lease("foo@example.com"))
+	assert.Equal(t, 1, len(lm.events.ch))
+	e := <-lm.events.ch
+	assert.Equal(t, "foo@example.com", e.Username)
+
+	// Updates that cannot be saved are dropped without being reported
+	store.conflicts = maxLeaseStoreAttempts
+	assert.Equal(t, errLeaseStoreConflict, lease("bar@example.com"))
+	assert.Equal(t, 0, len(lm.events.ch))
+	assert.Equal(t, []string{"foo@example.com"}, leaseUsernames(lm))
+}
+
+// leaseUsernames returns the users holding a lease from lm.
+func leaseUsernames(lm *FileLeaseManager) []string {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	usernames := []string{}
+	for u := range lm.wgRecords {
+		usernames = append(usernames, u)
+	}
+	return usernames
+}
+
+func TestLeaseEventQueue_Drop(t *testing.T) {
+	q := newLeaseEventQueue(&fakeLeaseEventPublisher{}, 2, time.Second)
+	dropped := testutil.ToFloat64(leaseEventsDroppedTotal)
+	// Emitting never blocks, events are dropped once the buffer is full
+	for i := 0; i < 5; i++ {
+		q.emit(leaseEvent{Type: leaseEventGranted, Username: fmt.Sprintf("user%d", i)})
+	}
+	assert.Equal(t, 2, len(q.ch))
+	assert.Equal(t, dropped+3, testutil.ToFloat64(leaseEventsDroppedTotal))
+	// and a nil queue ignores them
+	var nilQueue *leaseEventQueue
+	nilQueue.emit(leaseEvent{})
+}
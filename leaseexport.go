@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	leaseExportFormatJSON       = "json"
+	leaseExportFormatPrometheus = "prometheus"
+
+	defaultLeaseExportInterval = time.Minute
+	leaseExportPushTimeout     = 10 * time.Second
+)
+
+// leaseExportEntry describes an active lease in the exported lease table.
+type leaseExportEntry struct {
+	Username        string     `json:"username"`
+	ClientID        string     `json:"clientID,omitempty"`
+	PublicKey       string     `json:"publicKey"`
+	IP              string     `json:"ip"`
+	DelegatedPrefix string     `json:"delegatedPrefix,omitempty"`
+	Expires         time.Time  `json:"expires"`
+	LastHandshake   *time.Time `json:"lastHandshake,omitempty"`
+	// Device is the name of the additional device the lease is held on,
+	// empty for the main device
+	Device string `json:"device,omitempty"`
+}
+
+// leases returns a snapshot of the active leases, sorted by username.
+func (lm *FileLeaseManager) leases() []leaseExportEntry {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	leases := make([]leaseExportEntry, 0, len(lm.wgRecords))
+	for username, r := range lm.wgRecords {
+		l := leaseExportEntry{
+			Username:  username,
+			ClientID:  r.ClientID,
+			PublicKey: r.PubKey,
+			IP:        r.IP.String(),
+			Expires:   r.expires.UTC(),
+		}
+		if r.DelegatedPrefix != nil {
+			l.DelegatedPrefix = r.DelegatedPrefix.String()
+		}
+		leases = append(leases, l)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Username < leases[j].Username })
+	return leases
+}
+
+// leaseExporter periodically writes the lease table to a file and/or pushes
+// it to an http endpoint, so that external systems, like an IPAM, can sync
+// with it.
+type leaseExporter struct {
+	client       *http.Client
+	device       func(name string) (*wgtypes.Device, error)
+	filename     string
+	format       string
+	interval     time.Duration
+	leaseManager *FileLeaseManager
+	url          string
+}
+
+func newLeaseExporter(cfg *serverLeaseExportConfig, lm *FileLeaseManager, device func(name string) (*wgtypes.Device, error)) *leaseExporter {
+	le := &leaseExporter{
+		client:       &http.Client{Timeout: leaseExportPushTimeout},
+		device:       device,
+		filename:     cfg.Filename,
+		format:       cfg.Format,
+		interval:     cfg.Interval.Duration,
+		leaseManager: lm,
+		url:          cfg.URL,
+	}
+	if le.format == "" {
+		le.format = leaseExportFormatJSON
+	}
+	if le.interval == 0 {
+		le.interval = defaultLeaseExportInterval
+	}
+	return le
+}
+
+// snapshot returns the active leases along with the latest handshake of
+// each peer, as reported by the wireguard device.
+func (le *leaseExporter) snapshot() []leaseExportEntry {
+	return le.leaseManager.leasesWithHandshakes(le.device)
+}
+
+// leasesWithHandshakes returns the active leases along with the latest
+// handshake of each peer, as reported by the wireguard device.
+func (lm *FileLeaseManager) leasesWithHandshakes(device func(name string) (*wgtypes.Device, error)) []leaseExportEntry {
+	leases := lm.leases()
+	if device == nil {
+		return leases
+	}
+	dev, err := device(lm.deviceName)
+	if err != nil {
+		logger.Error.Printf("Cannot get peer handshakes of device %s: %v", lm.deviceName, err)
+		return leases
+	}
+	handshakes := make(map[string]time.Time, len(dev.Peers))
+	for _, p := range dev.Peers {
+		if !p.LastHandshakeTime.IsZero() {
+			handshakes[p.PublicKey.String()] = p.LastHandshakeTime.UTC()
+		}
+	}
+	for i := range leases {
+		if hs, ok := handshakes[leases[i].PublicKey]; ok {
+			leases[i].LastHandshake = &hs
+		}
+	}
+	return leases
+}
+
+// encode renders the leases in the configured format and returns the
+// content type of the result.
+func (le *leaseExporter) encode(leases []leaseExportEntry) ([]byte, string, error) {
+	switch le.format {
+	case leaseExportFormatJSON:
+		b, err := json.MarshalIndent(leases, "", "  ")
+		if err != nil {
+			return nil, "", err
+		}
+		return append(b, '\n'), "application/json", nil
+	case leaseExportFormatPrometheus:
+		return encodeLeasesPrometheus(leases), "text/plain; version=0.0.4", nil
+	}
+	return nil, "", fmt.Errorf("unknown lease export format: %s", le.format)
+}
+
+// export writes the current lease table to the configured destinations.
+func (le *leaseExporter) export() error {
+	content, contentType, err := le.encode(le.snapshot())
+	if err != nil {
+		return err
+	}
+	if le.filename != "" {
+		if err := writeFileAtomic(le.filename, content, 0644); err != nil {
+			return fmt.Errorf("cannot write leases to %s: %w", le.filename, err)
+		}
+	}
+	if le.url != "" {
+		resp, err := le.client.Post(le.url, contentType, bytes.NewReader(content))
+		if err != nil {
+			return fmt.Errorf("cannot push leases to %s: %w", le.url, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("cannot push leases to %s: %s", le.url, resp.Status)
+		}
+	}
+	return nil
+}
+
+func (le *leaseExporter) run() {
+	logger.Info.Printf("Exporting leases every %s", le.interval)
+	ticker := time.NewTicker(le.interval)
+	defer ticker.Stop()
+	for {
+		if err := le.export(); err != nil {
+			logger.Error.Printf("Lease export failed: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// filename and renames it into place, so that readers never observe a
+// partially written file.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+var prometheusLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// encodeLeasesPrometheus renders the leases in the Prometheus text format,
+// suitable for the node exporter textfile collector.
+func encodeLeasesPrometheus(leases []leaseExportEntry) []byte {
+	var b bytes.Buffer
+	labels := func(l leaseExportEntry) string {
+		return fmt.Sprintf(`address="%s",client_id="%s",delegated_prefix="%s",public_key="%s",username="%s"`,
+			prometheusLabelValueEscaper.Replace(l.IP),
+			prometheusLabelValueEscaper.Replace(l.ClientID),
+			prometheusLabelValueEscaper.Replace(l.DelegatedPrefix),
+			prometheusLabelValueEscaper.Replace(l.PublicKey),
+			prometheusLabelValueEscaper.Replace(l.Username),
+		)
+	}
+	b.WriteString("# HELP wiresteward_lease_expiry_time UNIX timestamp for the expiry time of an active lease.\n")
+	b.WriteString("# TYPE wiresteward_lease_expiry_time gauge\n")
+	for _, l := range leases {
+		fmt.Fprintf(&b, "wiresteward_lease_expiry_time{%s} %d\n", labels(l), l.Expires.Unix())
+	}
+	b.WriteString("# HELP wiresteward_lease_last_handshake_seconds UNIX timestamp for the last handshake with the peer of an active lease.\n")
+	b.WriteString("# TYPE wiresteward_lease_last_handshake_seconds gauge\n")
+	for _, l := range leases {
+		// Expose last handshake of 0 unless a handshake has happened
+		var last int64
+		if l.LastHandshake != nil {
+			last = l.LastHandshake.Unix()
+		}
+		fmt.Fprintf(&b, "wiresteward_lease_last_handshake_seconds{%s} %d\n", labels(l), last)
+	}
+	return b.Bytes()
+}
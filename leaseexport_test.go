@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestLeaseExporter_Export(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	peerA := newWgKey()
+	peerB := newWgKey()
+	_, prefix, _ := net.ParseCIDR("10.100.0.8/29")
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	handshake := time.Date(2029, 12, 31, 23, 0, 0, 0, time.UTC)
+	lm := &FileLeaseManager{
+		deviceName: "wg0",
+		wgRecords: map[string]WgRecord{
+			"userA@example.com": {PubKey: peerA.String(), IP: net.ParseIP("10.90.0.2"), ClientID: "laptop", DelegatedPrefix: prefix, expires: expires},
+			"userB@example.com": {PubKey: peerB.String(), IP: net.ParseIP("10.90.0.3"), expires: expires},
+		},
+	}
+	device := func(name string) (*wgtypes.Device, error) {
+		assert.Equal(t, "wg0", name)
+		return &wgtypes.Device{Peers: []wgtypes.Peer{
+			{PublicKey: peerA, LastHandshakeTime: handshake},
+			{PublicKey: peerB},
+		}}, nil
+	}
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "leases.json")
+	if err := os.WriteFile(filename, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Readers that opened the file before the export should keep seeing the
+	// old content, rather than a truncated or partially written file
+	old, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+
+	le := newLeaseExporter(&serverLeaseExportConfig{Filename: filename}, lm, device)
+	if err := le.export(); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := io.ReadAll(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "stale", string(stale))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(entries), "temporary files should be cleaned up")
+
+	d, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leases []leaseExportEntry
+	if err := json.Unmarshal(d, &leases); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []leaseExportEntry{
+		{
+			Username:        "userA@example.com",
+			ClientID:        "laptop",
+			PublicKey:       peerA.String(),
+			IP:              "10.90.0.2",
+			DelegatedPrefix: "10.100.0.8/29",
+			Expires:         expires,
+			LastHandshake:   &handshake,
+		},
+		{
+			Username:  "userB@example.com",
+			PublicKey: peerB.String(),
+			IP:        "10.90.0.3",
+			Expires:   expires,
+		},
+	}, leases)
+
+	// A removed lease should disappear from the next export
+	delete(lm.wgRecords, "userB@example.com")
+	le.format = leaseExportFormatPrometheus
+	if err := le.export(); err != nil {
+		t.Fatal(err)
+	}
+	d, err = os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := `{address="10.90.0.2",client_id="laptop",delegated_prefix="10.100.0.8/29",public_key="` + peerA.String() + `",username="userA@example.com"}`
+	assert.Equal(t, strings.Join([]string{
+		"# HELP wiresteward_lease_expiry_time UNIX timestamp for the expiry time of an active lease.",
+		"# TYPE wiresteward_lease_expiry_time gauge",
+		"wiresteward_lease_expiry_time" + labels + " 1893456000",
+		"# HELP wiresteward_lease_last_handshake_seconds UNIX timestamp for the last handshake with the peer of an active lease.",
+		"# TYPE wiresteward_lease_last_handshake_seconds gauge",
+		"wiresteward_lease_last_handshake_seconds" + labels + " 1893452400",
+		"",
+	}, "\n"), string(d))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultPublicKeysWindow is the period the public keys of a user are counted
+// over, when limiting them.
+const defaultPublicKeysWindow = 24 * time.Hour
+
+// publicKeyLimiter limits the number of distinct public keys each user can
+// request leases for within a window. Leases are held per user, so a user
+// requesting leases from many machines keeps moving their lease between
+// them, which usually means that a token is shared.
+type publicKeyLimiter struct {
+	max    int
+	window time.Duration
+
+	mutex sync.Mutex
+	// seen maps users to the time each of their public keys was last seen
+	seen map[string]map[string]time.Time
+}
+
+func newPublicKeyLimiter(max int, window time.Duration) *publicKeyLimiter {
+	return &publicKeyLimiter{max: max, window: window, seen: map[string]map[string]time.Time{}}
+}
+
+// hook implements leasePolicyHook. Dry runs are checked against the limit
+// without being counted.
+func (pl *publicKeyLimiter) hook(username string, req *leaseRequest, dryRun bool) error {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	now := time.Now()
+	keys := pl.seen[username]
+	count, known := 0, false
+	for k, t := range keys {
+		// A rotated key replaces the previous one
+		if now.Sub(t) > pl.window || (req.PreviousPubKey != "" && k == req.PreviousPubKey) {
+			if !dryRun {
+				delete(keys, k)
+			}
+			continue
+		}
+		count++
+		known = known || k == req.PubKey
+	}
+	if !known && count >= pl.max {
+		return fmt.Errorf("user %s requested leases for more than %d public keys within %s", username, pl.max, pl.window)
+	}
+	if dryRun {
+		return nil
+	}
+	if keys == nil {
+		keys = map[string]time.Time{}
+		pl.seen[username] = keys
+	}
+	keys[req.PubKey] = now
+	return nil
+}
+
+// leaseAffinity is the address of a released lease, which is preferred when
+// the same user and public key request a lease again until it expires.
+type leaseAffinity struct {
+	pubKey  string
+	ip      net.IP
+	expires time.Time
+}
+
+// rememberAddress keeps the address of the released lease r of username, if
+// address affinity is enabled. It must be called with wgRecordsMutex held.
+func (lm *FileLeaseManager) rememberAddress(username string, r WgRecord) {
+	if lm.affinityPeriod == 0 || r.IP == nil {
+		return
+	}
+	if lm.affinity == nil {
+		lm.affinity = map[string]leaseAffinity{}
+	}
+	lm.affinity[username] = leaseAffinity{pubKey: r.PubKey, ip: r.IP, expires: time.Now().Add(lm.affinityPeriod)}
+}
+
+// previewLease returns the address that a lease request of username would be
+// granted, without granting it. Address conflicts reported by the agent are
+// not considered.
+func (lm *FileLeaseManager) previewLease(username string, lr *leaseRequest) (net.IP, error) {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	if reserved, err := lm.reservedIP(username, lr.PubKey); err != nil || reserved != nil {
+		return reserved, err
+	}
+	network, _ := lm.poolNetwork(lr.Pool)
+	if record, ok := lm.wgRecords[username]; ok && network.Contains(record.IP) && !lm.isReservedIP(record.IP) && !lm.isPoolReserved(record.IP) {
+		return record.IP, nil
+	}
+	if ip := lm.affinityIP(username, lr.PubKey, lr.Pool); ip != nil {
+		return ip, nil
+	}
+	return lm.allocateIP(lr.Pool, lr.PubKey)
+}
+
+// affinityIP returns the address previously leased to username and pubKey, if
+// it is still free, in pool and not excluded. It must be called with
+// wgRecordsMutex held.
+func (lm *FileLeaseManager) affinityIP(username, pubKey, pool string, exclude ...net.IP) net.IP {
+	a, ok := lm.affinity[username]
+	if !ok {
+		return nil
+	}
+	delete(lm.affinity, username)
+	network, serverIP := lm.poolNetwork(pool)
+	if a.pubKey != pubKey || time.Now().After(a.expires) || !network.Contains(a.ip) || a.ip.Equal(serverIP) || lm.isReservedIP(a.ip) || lm.isPoolReserved(a.ip) {
+		return nil
+	}
+	for _, ip := range exclude {
+		if a.ip.Equal(ip) {
+			return nil
+		}
+	}
+	for _, r := range lm.wgRecords {
+		if r.IP.Equal(a.ip) {
+			return nil
+		}
+	}
+	return a.ip
+}
+
+// expireAffinity forgets the addresses of leases released longer than the
+// affinity period ago. It must be called with wgRecordsMutex held.
+func (lm *FileLeaseManager) expireAffinity(now time.Time) {
+	for username, a := range lm.affinity {
+		if now.After(a.expires) {
+			delete(lm.affinity, username)
+		}
+	}
+}
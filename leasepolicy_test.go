@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublicKeyLimiter(t *testing.T) {
+	pl := newPublicKeyLimiter(2, time.Hour)
+	key1, key2, key3 := newWgKey().String(), newWgKey().String(), newWgKey().String()
+	assert.NoError(t, pl.hook("alice@example.com", &leaseRequest{PubKey: key1}, false))
+	assert.NoError(t, pl.hook("alice@example.com", &leaseRequest{PubKey: key2}, false))
+	// Renewals of known keys are allowed
+	assert.NoError(t, pl.hook("alice@example.com", &leaseRequest{PubKey: key1}, false))
+	assert.Error(t, pl.hook("alice@example.com", &leaseRequest{PubKey: key3}, false))
+	// Other users are limited separately
+	assert.NoError(t, pl.hook("bob@example.com", &leaseRequest{PubKey: key3}, false))
+
+	// Keys that were not seen within the window are no longer counted
+	pl.seen["alice@example.com"][key2] = time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, pl.hook("alice@example.com", &leaseRequest{PubKey: key3}, false))
+
+	// Rotated keys replace the previous one
+	key4 := newWgKey().String()
+	assert.Error(t, pl.hook("alice@example.com", &leaseRequest{PubKey: key4}, false))
+	assert.NoError(t, pl.hook("alice@example.com", &leaseRequest{PubKey: key4, PreviousPubKey: key3}, false))
+}
+
+func TestPublicKeyLimiter_DryRun(t *testing.T) {
+	pl := newPublicKeyLimiter(1, time.Hour)
+	key1, key2 := newWgKey().String(), newWgKey().String()
+	// Dry runs are evaluated without being counted
+	assert.NoError(t, pl.hook("alice@example.com", &leaseRequest{PubKey: key1}, true))
+	assert.Empty(t, pl.seen)
+	assert.NoError(t, pl.hook("alice@example.com", &leaseRequest{PubKey: key1}, false))
+	assert.Error(t, pl.hook("alice@example.com", &leaseRequest{PubKey: key2}, true))
+	assert.NoError(t, pl.hook("alice@example.com", &leaseRequest{PubKey: key1}, true))
+	assert.NoError(t, pl.hook("alice@example.com", &leaseRequest{PubKey: key2, PreviousPubKey: key1}, true))
+	// and leave the keys of the user untouched
+	assert.Len(t, pl.seen["alice@example.com"], 1)
+	assert.Contains(t, pl.seen["alice@example.com"], key1)
+}
+
+func TestFileLeaseManager_AddressAffinity(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	lm := &FileLeaseManager{
+		wgRecords:      map[string]WgRecord{},
+		cidr:           network,
+		ip:             ip,
+		affinityPeriod: time.Hour,
+	}
+	key1, key2 := newWgKey().String(), newWgKey().String()
+	expiry := time.Now().Add(time.Hour)
+	for _, u := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if _, err := lm.createOrUpdatePeer(u, &leaseRequest{PubKey: newWgKey().String()}, expiry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record, err := lm.createOrUpdatePeer("alice@example.com", &leaseRequest{PubKey: key1}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.5", record.IP.String())
+	lm.releaseRecord("alice@example.com", record)
+	lm.releaseRecord("a@example.com", lm.wgRecords["a@example.com"])
+
+	// The same user and key get their previous address back, instead of
+	// the first free one
+	record, err = lm.createOrUpdatePeer("alice@example.com", &leaseRequest{PubKey: key1}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.5", record.IP.String())
+
+	// but not with another key
+	lm.releaseRecord("alice@example.com", record)
+	record, err = lm.createOrUpdatePeer("alice@example.com", &leaseRequest{PubKey: key2}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.2", record.IP.String())
+
+	// or once it was leased to someone else
+	lm.releaseRecord("alice@example.com", record)
+	if _, err := lm.createOrUpdatePeer("bob@example.com", &leaseRequest{PubKey: newWgKey().String()}, expiry); err != nil {
+		t.Fatal(err)
+	}
+	record, err = lm.createOrUpdatePeer("alice@example.com", &leaseRequest{PubKey: key2}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.90.0.5", record.IP.String())
+
+	// Addresses are forgotten after the affinity period
+	lm.releaseRecord("alice@example.com", record)
+	lm.expireAffinity(time.Now().Add(2 * time.Hour))
+	assert.Empty(t, lm.affinity)
+}
+
+func TestFileLeaseManager_PreviewLease(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	lm := &FileLeaseManager{
+		wgRecords: map[string]WgRecord{},
+		cidr:      network,
+		ip:        ip,
+	}
+	expiry := time.Now().Add(time.Hour)
+	if _, err := lm.createOrUpdatePeer("alice@example.com", &leaseRequest{PubKey: newWgKey().String()}, expiry); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users holding a lease keep its address, even with another key
+	preview, err := lm.previewLease("alice@example.com", &leaseRequest{PubKey: newWgKey().String()})
+	assert.NoError(t, err)
+	assert.Equal(t, "10.90.0.2", preview.String())
+
+	// and others are shown the first free address, without leasing it
+	preview, err = lm.previewLease("bob@example.com", &leaseRequest{PubKey: newWgKey().String()})
+	assert.NoError(t, err)
+	assert.Equal(t, "10.90.0.3", preview.String())
+	assert.Equal(t, 1, len(lm.wgRecords))
+}
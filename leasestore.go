@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// storedLease is a lease record as persisted by a leaseStore, along with the
+// user it belongs to.
+type storedLease struct {
+	Username string
+	Record   WgRecord
+}
+
+// leaseStore is implemented by the backends leases are persisted to, so that
+// they survive server restarts. Both active leases and the expired ones that
+// hold prefix reservations are stored.
+type leaseStore interface {
+	load() ([]storedLease, error)
+	save(leases []storedLease) error
+}
+
+// errLeaseStoreConflict is returned by shared lease stores when saving leases
+// that another server changed since they were loaded.
+var errLeaseStoreConflict = errors.New("leases were changed by another server")
+
+// sharedLeaseStore is implemented by the backends that several servers can
+// share. Leases are versioned, and only saved if they are still at the
+// version they were loaded at, so that servers never overwrite each other's
+// leases.
+type sharedLeaseStore interface {
+	leaseStore
+	// loadVersion returns the leases along with their version.
+	loadVersion() ([]storedLease, uint64, error)
+	// saveVersion saves leases if they are still at version, and returns
+	// errLeaseStoreConflict otherwise.
+	saveVersion(leases []storedLease, version uint64) error
+}
+
+// newLeaseStore returns the store configured for the leases of the server,
+// the leases file unless a shared store is configured.
+func newLeaseStore(cfg *serverConfig) (leaseStore, error) {
+	if cfg.LeaseStore != nil && cfg.LeaseStore.Consul != nil {
+		return newConsulLeaseStore(cfg.LeaseStore.Consul)
+	}
+	return newFileLeaseStore(cfg.LeasesFilename), nil
+}
+
+// fileLeaseStore stores leases in a text file, one per line. The file is
+// replaced atomically on save, so that a crash while saving cannot lose
+// leases.
+type fileLeaseStore struct {
+	filename string
+}
+
+func newFileLeaseStore(filename string) *fileLeaseStore {
+	return &fileLeaseStore{filename: filename}
+}
+
+// load returns the leases in the file, or none if it cannot be opened, eg.
+// on the first run.
+func (s *fileLeaseStore) load() ([]storedLease, error) {
+	r, err := os.Open(s.filename)
+	if err != nil {
+		logger.Error.Printf("unable to open leases file: %v", err)
+		return nil, nil
+	}
+	defer r.Close()
+	return parseLeases(r)
+}
+
+// save writes leases to a temporary file next to the leases file and renames
+// it over the leases file.
+func (s *fileLeaseStore) save(leases []storedLease) error {
+	f, err := os.CreateTemp(filepath.Dir(s.filename), filepath.Base(s.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := writeLeases(f, leases); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.filename)
+}
+
+// parseLeases reads leases in the format of the leases file, one per line.
+func parseLeases(r io.Reader) ([]storedLease, error) {
+	leases := []storedLease{}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if len(line) == 0 {
+			continue
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) < 4 || len(tokens) > 7 {
+			return nil, fmt.Errorf("malformed line, want 4 to 7 fields, got %d: %s", len(tokens), line)
+		}
+
+		username := tokens[0]
+		pubKey := tokens[1]
+		ipaddr := net.ParseIP(tokens[2])
+		// TODO: support v6?
+		if ipaddr.To4() == nil {
+			return nil, fmt.Errorf("expected an IPv4 address, got: %v", ipaddr)
+		}
+		expires, err := time.Parse(time.RFC3339, tokens[3])
+		if err != nil {
+			return nil, fmt.Errorf("expected time of exipry in RFC3339 format, got: %v", tokens[2])
+		}
+		var clientID string
+		if len(tokens) >= 5 && tokens[4] != emptyLeaseField {
+			clientID = tokens[4]
+		}
+		var prefix *net.IPNet
+		if len(tokens) >= 6 && tokens[5] != emptyLeaseField {
+			if _, prefix, err = net.ParseCIDR(tokens[5]); err != nil {
+				return nil, fmt.Errorf("expected a delegated prefix in CIDR format, got: %v", tokens[5])
+			}
+		}
+		var groups []string
+		if len(tokens) == 7 {
+			groups = strings.Split(tokens[6], ",")
+		}
+		leases = append(leases, storedLease{
+			Username: username,
+			Record: WgRecord{
+				PubKey:          pubKey,
+				IP:              ipaddr,
+				ClientID:        clientID,
+				DelegatedPrefix: prefix,
+				Groups:          groups,
+				expires:         expires,
+			},
+		})
+	}
+	return leases, sc.Err()
+}
+
+// writeLeases writes leases to w in the format of the leases file.
+func writeLeases(w io.Writer, leases []storedLease) error {
+	bw := bufio.NewWriter(w)
+	for _, l := range leases {
+		if _, err := fmt.Fprintf(bw, "%s %s\n", l.Username, l.Record); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLeaseStore(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dir := t.TempDir()
+	store := newFileLeaseStore(filepath.Join(dir, "leases"))
+
+	// A missing file holds no leases
+	leases, err := store.load()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(leases))
+
+	_, prefix, _ := net.ParseCIDR("10.100.0.8/29")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	saved := []storedLease{
+		{Username: "test1@example.com", Record: WgRecord{PubKey: validPublicKey, IP: net.ParseIP("10.90.0.2"), ClientID: "laptop-1", expires: expires}},
+		{Username: "test2@example.com", Record: WgRecord{PubKey: validPublicKey, IP: net.ParseIP("10.90.0.3"), DelegatedPrefix: prefix, expires: expires}},
+		{Username: "test3@example.com", Record: WgRecord{PubKey: validPublicKey, IP: net.ParseIP("10.90.0.4"), Groups: []string{"admins", "developers"}, expires: expires}},
+	}
+	assert.NoError(t, store.save(saved))
+	leases, err = store.load()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(leases))
+	for i, l := range leases {
+		assert.Equal(t, saved[i].Username, l.Username)
+		assert.Equal(t, saved[i].Record.String(), l.Record.String())
+	}
+	assert.Equal(t, []string{"admins", "developers"}, leases[2].Record.Groups)
+	assert.Nil(t, leases[2].Record.DelegatedPrefix)
+
+	// Saving replaces the file, without leaving temporary files behind
+	assert.NoError(t, store.save(saved[:1]))
+	leases, err = store.load()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(leases))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+}
@@ -1,39 +1,193 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"golang.zx2c4.com/wireguard/device"
 )
 
-// Use device package logger as the global logger for the application.
-// device.Logger is effectively a collection of standard logging library loggers
-var logger *device.Logger
+// Logger extends the wireguard-go device.Logger, which is effectively a
+// collection of standard logging library loggers, with a warning level. The
+// embedded device.Logger is passed to wireguard-go devices.
+type Logger struct {
+	*device.Logger
+	Warn *log.Logger
+
+	output io.Writer
+	name   string
+	fields []string
+}
+
+// Use Logger as the global logger for the application.
+var logger *Logger
+
+const (
+	logLevelError = iota + 1
+	logLevelWarn
+	logLevelInfo
+	logLevelDebug
+)
 
 // logLevel global var, defaults to info
-var logLevel = device.LogLevelInfo
+var logLevel = logLevelInfo
+
+// logFormat global var, defaults to text
+var logFormat = "text"
 
 // Sets the logLevel global variable. Needs to be called before the
 // initialisation of loggers
 func setLogLevel(level string) {
 	switch level {
 	case "debug":
-		logLevel = device.LogLevelDebug
+		logLevel = logLevelDebug
 	case "info":
-		logLevel = device.LogLevelInfo
+		logLevel = logLevelInfo
+	case "warn":
+		logLevel = logLevelWarn
 	case "error":
-		logLevel = device.LogLevelError
+		logLevel = logLevelError
 	default:
 		fmt.Printf(
-			"Invalid log level: %s, can be debug|info|error. Defaulting to info",
+			"Invalid log level: %s, can be debug|info|warn|error. Defaulting to info",
 			level,
 		)
 	}
 }
 
-// Returns a new logger using the global level variable
-func newLogger(name string) *device.Logger {
-	return device.NewLogger(
-		logLevel,
-		fmt.Sprintf("%s: ", name),
-	)
+// Sets the logFormat global variable. Needs to be called before the
+// initialisation of loggers
+func setLogFormat(format string) {
+	switch format {
+	case "text", "json", "logfmt":
+		logFormat = format
+	default:
+		fmt.Printf(
+			"Invalid log format: %s, can be text|json|logfmt. Defaulting to text",
+			format,
+		)
+	}
+}
+
+// Returns a new logger using the global level and format variables. fields
+// are key and value pairs added to every line, eg. the device the logger is
+// used for.
+func newLogger(name string, fields ...string) *Logger {
+	return newLoggerTo(os.Stdout, name, fields...)
+}
+
+func newLoggerTo(output io.Writer, name string, fields ...string) *Logger {
+	level := func(l int, label string) *log.Logger {
+		w := output
+		if logLevel < l {
+			w = ioutil.Discard
+		}
+		if logFormat == "text" {
+			prefix := name
+			for i := 1; i < len(fields); i += 2 {
+				prefix += "/" + fields[i]
+			}
+			return log.New(w, fmt.Sprintf("%s: %s: ", strings.ToUpper(label), prefix), log.Ldate|log.Ltime)
+		}
+		return log.New(&structuredWriter{
+			output:    w,
+			format:    logFormat,
+			level:     label,
+			component: name,
+			fields:    fields,
+		}, "", 0)
+	}
+	return &Logger{
+		Logger: &device.Logger{
+			Debug: level(logLevelDebug, "debug"),
+			Info:  level(logLevelInfo, "info"),
+			Error: level(logLevelError, "error"),
+		},
+		Warn:   level(logLevelWarn, "warn"),
+		output: output,
+		name:   name,
+		fields: fields,
+	}
+}
+
+// with returns a logger writing to the same output as l, with fields added
+// to the ones of l.
+func (l *Logger) with(fields ...string) *Logger {
+	return newLoggerTo(l.output, l.name, append(append([]string{}, l.fields...), fields...)...)
+}
+
+// structuredWriter formats the lines written by a log.Logger as JSON objects
+// or logfmt lines, along with the time, level, component and fields of the
+// logger.
+type structuredWriter struct {
+	output    io.Writer
+	format    string
+	level     string
+	component string
+	fields    []string
+}
+
+func (sw *structuredWriter) Write(p []byte) (int, error) {
+	kv := append([]string{
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", sw.level,
+		"component", sw.component,
+	}, sw.fields...)
+	kv = append(kv, "msg", strings.TrimSuffix(string(p), "\n"))
+	var line []byte
+	if sw.format == "json" {
+		line = jsonLine(kv)
+	} else {
+		line = logfmtLine(kv)
+	}
+	if _, err := sw.output.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// jsonLine returns the key and value pairs of kv as a JSON object, keeping
+// their order.
+func jsonLine(kv []string) []byte {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		k, _ := json.Marshal(kv[i])
+		v, _ := json.Marshal(kv[i+1])
+		b.Write(k)
+		b.WriteString(":")
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+// logfmtLine returns the key and value pairs of kv as a logfmt line, quoting
+// values where needed.
+func logfmtLine(kv []string) []byte {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		v := kv[i+1]
+		if v == "" || strings.ContainsAny(v, " =\"\\") || strconv.Quote(v) != `"`+v+`"` {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(kv[i])
+		b.WriteString("=")
+		b.WriteString(v)
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStructuredLogger(t *testing.T) {
+	defer setLogFormat("text")
+	setLogLevel("warn")
+	defer setLogLevel("error")
+
+	setLogFormat("json")
+	buf := &bytes.Buffer{}
+	l := newLoggerTo(buf, "wireguard-go", "device", "wg0")
+	l.Info.Printf("dropped")
+	l.Warn.Printf("peer %s is stale", "abc=")
+	line := map[string]string{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, line["time"])
+	delete(line, "time")
+	assert.Equal(t, map[string]string{
+		"level":     "warn",
+		"component": "wireguard-go",
+		"device":    "wg0",
+		"msg":       "peer abc= is stale",
+	}, line)
+
+	// Fields are added to the ones of the logger
+	buf.Reset()
+	l.with("peer", "abc=").Warn.Printf("handshake failed")
+	line = map[string]string{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "wg0", line["device"])
+	assert.Equal(t, "abc=", line["peer"])
+	assert.Equal(t, "handshake failed", line["msg"])
+
+	setLogFormat("logfmt")
+	buf.Reset()
+	l = newLoggerTo(buf, "wiresteward")
+	l.Error.Println("cannot renew lease")
+	assert.True(t, strings.HasPrefix(buf.String(), "time="), buf.String())
+	assert.True(t, strings.HasSuffix(buf.String(), ` level=error component=wiresteward msg="cannot renew lease"`+"\n"), buf.String())
+
+	setLogFormat("text")
+	buf.Reset()
+	l = newLoggerTo(buf, "wireguard-go", "device", "wg0")
+	l.Warn.Printf("peer is stale")
+	assert.True(t, strings.HasPrefix(buf.String(), "WARN: wireguard-go/wg0: "), buf.String())
+}
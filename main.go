@@ -1,11 +1,11 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
-	"runtime"
-	"strings"
 	"syscall"
 	"time"
 
@@ -13,68 +13,71 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl"
 )
 
+// Flags of the invocation that predates the commands, which is still
+// supported: `wiresteward -agent` and `wiresteward -server`.
 var (
-	version   = "dev"
-	commit    = "none"
-	date      = "unknown"
-	builtBy   = "unknown"
-	flagAgent = flag.Bool("agent", false, "Run application in \"agent\" mode")
-	// By default the agent runs at a high obscure port. 7773 is chosen by
-	// looking wiresteward initials hex on ascii table (w = 0x77 and s = 0x73)
-	flagAgentAddress = flag.String("agent-listen-address", "localhost:7773", "Address where the agent http server runs.\nThe URL http://<agent-listen-address>/oauth2/callback must be a valid callback url for the oauth2 application.")
-	flagConfig       = flag.String("config", "/etc/wiresteward/config.json", "Config file")
-	flagDeviceType   *string
-	flagLogLevel     = flag.String("log-level", "info", "Log Level (debug|info|error)")
-	flagMetricsAddr  = flag.String("metrics-address", ":8081", "Metrics server address, meaningful when combined with -server flag")
-	flagServer       = flag.Bool("server", false, "Run application in \"server\" mode")
-	flagVersion      = flag.Bool("version", false, "Prints out application version")
+	flagAgent   = flag.Bool("agent", false, "Deprecated: use the agent command")
+	flagServer  = flag.Bool("server", false, "Deprecated: use the server command")
+	flagVersion = flag.Bool("version", false, "Deprecated: use the version command")
 )
 
-func init() {
-	defaultDeviceType := "tun"
-	if runtime.GOOS == "linux" {
-		defaultDeviceType = "wireguard"
-	}
-	flagDeviceType = flag.String("device-type", defaultDeviceType, "Type of the network device to use for the agent, 'tun' or 'wireguard'.\nThe tun device relies on the wireguard-go userspace implementation that is compatible with all platforms.\nA wireguard device relies on wireguard-enabled linux kernels (5.6 or newer).")
-}
-
 func main() {
 	flag.Parse()
 
-	if len(os.Args) < 2 {
-		flag.PrintDefaults()
+	if flag.NArg() > 0 {
+		cmd := findCommand(flag.Arg(0))
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", flag.Arg(0))
+			usage()
+			os.Exit(2)
+		}
+		cmd.flags.Parse(flag.Args()[1:])
+		setupLogger()
+		cmd.run(cmd.flags.Args())
 		return
 	}
-	setLogLevel(*flagLogLevel)
-	logger = newLogger("wiresteward")
 
-	if *flagVersion {
-		logger.Info.Printf("version=%s commit=%s date=%s builtBy=%s", version, commit, date, builtBy)
-		return
-	}
-
-	if *flagAgent && *flagServer {
-		logger.Error.Fatalln(
-			"Must only set -agent or -server, not both",
-		)
+	setupLogger()
+	switch {
+	case *flagVersion:
+		printVersion()
+	case *flagWatch:
+		newStatusWatcher(*flagAgentSocket, os.Stdout).run(watchInterval)
+	case *flagAgent && *flagServer:
+		logger.Error.Fatalln("Must only set -agent or -server, not both")
+	case *flagCheck && !*flagAgent:
+		logger.Error.Fatalln("Must set -agent along with -check")
+	case *flagAgent:
+		runAgent(nil)
+	case *flagServer:
+		runServer(nil)
+	case *flagValidate:
+		logger.Error.Fatalln("Must set -agent or -server along with -validate")
+	default:
+		usage()
 	}
+}
 
-	*flagDeviceType = strings.ToLower(*flagDeviceType)
-	if *flagDeviceType != "tun" && *flagDeviceType != "wireguard" {
-		logger.Error.Fatalf("Invalid device-type value `%s`", *flagDeviceType)
-	}
+func setupLogger() {
+	setLogLevel(*flagLogLevel)
+	setLogFormat(*flagLogFormat)
+	logger = newLogger("wiresteward")
+}
 
-	if *flagAgent {
-		agent()
-		return
+// exitOnConfigError reports err, listing every invalid field of the config,
+// and exits if it is set.
+func exitOnConfigError(err error) {
+	var errs configErrors
+	if errors.As(err, &errs) {
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n", *flagConfig)
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "  - %s\n", e)
+		}
+		os.Exit(1)
 	}
-
-	if *flagServer {
-		server()
-		return
+	if err != nil {
+		logger.Error.Fatalln(err)
 	}
-
-	flag.PrintDefaults()
 }
 
 func server() {
@@ -83,6 +86,9 @@ func server() {
 		logger.Error.Fatalf("Cannot read server config: %v", err)
 	}
 
+	if err := loadNetworkState(cfg); err != nil {
+		logger.Error.Fatalf("Cannot load network state: %v", err)
+	}
 	wg := newServerDevice(cfg)
 	if err := wg.Start(); err != nil {
 		logger.Error.Fatalf(
@@ -105,7 +111,83 @@ func server() {
 	if err != nil {
 		logger.Error.Fatalf("Cannot start lease server: %v", err)
 	}
-	tv := newTokenValidator(cfg.OauthClientID, cfg.OauthIntrospectURL)
+	if cfg.LeaseEvents != nil {
+		publisher := leaseEventPublishers{}
+		if nc := cfg.LeaseEvents.NATS; nc != nil {
+			np, err := newNATSPublisher(nc)
+			if err != nil {
+				logger.Error.Fatalf("Cannot create lease event publisher: %v", err)
+			}
+			publisher = append(publisher, np)
+		}
+		for _, wc := range cfg.LeaseEvents.Webhooks {
+			wp, err := newWebhookPublisher(wc)
+			if err != nil {
+				logger.Error.Fatalf("Cannot create lease event webhook: %v", err)
+			}
+			publisher = append(publisher, wp)
+		}
+		lm.events = newLeaseEventQueue(publisher, cfg.LeaseEvents.BufferSize, cfg.LeaseEvents.PublishTimeout.Duration)
+		go lm.events.run()
+	}
+	if cfg.AuditLog != nil {
+		audit, err := newAuditLog(cfg.AuditLog)
+		if err != nil {
+			logger.Error.Fatalf("Cannot open audit log: %v", err)
+		}
+		lm.audit = audit
+	}
+	// Additional devices lease addresses of their own networks, sharing
+	// the lease events and audit log of the main device
+	devices := map[string]*FileLeaseManager{}
+	for _, d := range cfg.Devices {
+		dc := cfg.deviceConfig(d)
+		dwg := newServerDevice(dc)
+		if err := dwg.Start(); err != nil {
+			logger.Error.Fatalf(
+				"Cannot setup wireguard device '%s': %v",
+				dc.DeviceName,
+				err,
+			)
+		}
+		defer func() {
+			if err := dwg.Stop(); err != nil {
+				logger.Error.Printf(
+					"Cannot cleanup wireguard device '%s': %v",
+					dc.DeviceName,
+					err,
+				)
+			}
+		}()
+		dlm, err := newFileLeaseManager(dc)
+		if err != nil {
+			logger.Error.Fatalf("Cannot start lease server for device '%s': %v", dc.DeviceName, err)
+		}
+		dlm.events = lm.events
+		dlm.audit = lm.audit
+		devices[dc.DeviceName] = dlm
+	}
+	if len(cfg.GroupNetworks) > 0 {
+		lm.applyForwardRules = wg.updateForwardRules
+		if err := lm.updateWgPeers(); err != nil {
+			logger.Error.Fatalf("Cannot limit forwarded traffic: %v", err)
+		}
+	}
+	var tv accessTokenValidator = newTokenValidator(cfg.OauthClientID, cfg.OauthIntrospectURL)
+	if cfg.OauthJWKSURL != "" {
+		jv := newJWTValidator(cfg.OauthJWKSURL, cfg.OauthIssuer, cfg.OauthAudience, cfg.OauthUsernameClaim, cfg.OauthJWKSCacheTTL)
+		if cfg.OauthGroupsClaim != "" {
+			jv.groupsClaim = cfg.OauthGroupsClaim
+		}
+		tv = jv
+	}
+	var ips identityProviders
+	if len(cfg.IdentityProviders) > 0 {
+		ips, err = newIdentityProviders(cfg.IdentityProviders)
+		if err != nil {
+			logger.Error.Fatalf("Cannot load identity providers: %v", err)
+		}
+	}
 
 	// Start metrics server
 	client, err := wgctrl.New()
@@ -116,21 +198,93 @@ func server() {
 		)
 	}
 	defer client.Close()
+	lm.device = client.Device
+	for _, dlm := range devices {
+		dlm.device = client.Device
+	}
 	mc := newMetricsCollector(client.Devices, lm)
-	prometheus.MustRegister(mc)
+	prometheus.MustRegister(
+		mc,
+		leasePoolUtilization,
+		adaptiveLeasesActive,
+		peerKeyRotationsTotal,
+		leaseEventsDroppedTotal,
+		leaseEventsPublishErrorsTotal,
+		leasesGrantedTotal,
+		leaseRenewalsTotal,
+		peerDiscrepanciesTotal,
+		authFailuresTotal,
+		leaseRequestsRateLimitedTotal,
+		httpRequestDuration,
+	)
 	go startMetricsServer(*flagMetricsAddr)
 
-	lh := HTTPLeaseHandler{
-		leaseManager:   lm,
-		serverConfig:   cfg,
-		tokenValidator: tv,
+	lh := &HTTPLeaseHandler{
+		cache:             newLeaseCache(),
+		leaseManager:      lm,
+		serverConfig:      cfg,
+		tokenValidator:    tv,
+		audit:             lm.audit,
+		identityProviders: ips,
+		devices:           devices,
+	}
+	if rl := cfg.RateLimits; rl != nil {
+		lh.sourceIPLimiter = newRateLimiter(rl.SourceIP)
+		lh.tokenLimiter = newRateLimiter(rl.Token)
+	}
+	if cfg.LeaseSigningKeyFilename != "" {
+		signer, err := newLeaseSigner(cfg.LeaseSigningKeyFilename)
+		if err != nil {
+			logger.Error.Fatalf("Cannot load lease signing key: %v", err)
+		}
+		lh.signer = signer
+	}
+	if lp := cfg.LeasePolicy; lp != nil && lp.MaxPublicKeys > 0 {
+		lh.policyHooks = append(lh.policyHooks, newPublicKeyLimiter(lp.MaxPublicKeys, lp.PublicKeysWindow.Duration).hook)
+	}
+	if cfg.ClientCAFile != "" {
+		clientCAs, err := loadClientCAs(cfg.ClientCAFile)
+		if err != nil {
+			logger.Error.Fatalf("Cannot load client CAs: %v", err)
+		}
+		lh.clientCAs = clientCAs
+	}
+	listener, err := lh.listen()
+	if err != nil {
+		logger.Error.Fatalf("Cannot listen for lease requests: %v", err)
+	}
+	go lh.start(listener)
+	if cfg.AdminListenAddress != "" {
+		ah := &HTTPAdminHandler{
+			leaseManager:        lm,
+			devices:             devices,
+			leaseHandler:        lh,
+			updateDeviceNetwork: wg.updateNetwork,
+			reloadConfig:        func() error { return lh.reloadConfig(*flagConfig) },
+		}
+		token, err := readAdminToken(cfg.AdminTokenFilename)
+		if err != nil {
+			logger.Error.Fatalf("Cannot read admin token: %v", err)
+		}
+		ah.token = token
+		go ah.start(cfg.AdminListenAddress)
+	}
+	if cfg.LeaseExport != nil {
+		go newLeaseExporter(cfg.LeaseExport, lm, client.Device).run()
 	}
-	go lh.start()
 	ticker := time.NewTicker(cfg.LeaserSyncInterval)
 	defer ticker.Stop()
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGTERM)
 	signal.Notify(quit, os.Interrupt)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	// The watchdog is only notified while leases can be synced
+	startSdWatchdog(func() {
+		lm.wgRecordsMutex.Lock()
+		lm.wgRecordsMutex.Unlock()
+	})
+	sdNotify(sdNotifyReady)
 	logger.Info.Print("Starting leaser loop")
 	for {
 		select {
@@ -138,8 +292,24 @@ func server() {
 			if err := lm.syncWgRecords(); err != nil {
 				logger.Error.Print(err)
 			}
+			for _, dlm := range devices {
+				if err := dlm.syncWgRecords(); err != nil {
+					logger.Error.Print(err)
+				}
+			}
+		case <-reload:
+			sdNotify(sdNotifyReloading)
+			if err := lh.reloadConfig(*flagConfig); err != nil {
+				logger.Error.Printf("Cannot reload config: %v", err)
+			}
+			// The audit log is reopened, so that it can be rotated
+			if err := lm.audit.reopen(); err != nil {
+				logger.Error.Printf("Cannot reopen audit log: %v", err)
+			}
+			sdNotify(sdNotifyReady)
 		case <-quit:
 			logger.Info.Print("Quitting")
+			sdNotify(sdNotifyStopping)
 			return
 		}
 	}
@@ -150,19 +320,48 @@ func agent() {
 	if err != nil {
 		logger.Error.Fatalf("Cannot read agent config: %v", err)
 	}
+	effective, err := effectiveCapabilities()
+	if err != nil {
+		logger.Error.Fatalf("Cannot check agent capabilities: %v", err)
+	}
+	if err := preflightAgent(agentConf, effective); err != nil {
+		logger.Error.Fatalf("Cannot run agent: %v", err)
+	}
 
 	term := make(chan os.Signal, 1)
 	signal.Notify(term, syscall.SIGTERM)
 	signal.Notify(term, os.Interrupt)
 
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
 	agent := NewAgent(agentConf)
 	go func() {
 		agent.ListenAndServe()
 		close(term)
 	}()
+	// The watchdog is only notified while the config of every device can
+	// be updated
+	startSdWatchdog(func() {
+		for _, dm := range agent.devices() {
+			dm.configMutex.Lock()
+			dm.configMutex.Unlock()
+		}
+	})
+	sdNotify(sdNotifyReady)
 
-	select {
-	case <-term:
+	for {
+		select {
+		case <-reload:
+			sdNotify(sdNotifyReloading)
+			if err := agent.reloadConfig(*flagConfig); err != nil {
+				logger.Error.Printf("Cannot reload config: %v", err)
+			}
+			sdNotify(sdNotifyReady)
+		case <-term:
+			sdNotify(sdNotifyStopping)
+			agent.Stop()
+			return
+		}
 	}
-	agent.Stop()
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -17,6 +18,7 @@ type collector struct {
 	PeerTransmitBytes   *prometheus.Desc
 	PeerLastHandshake   *prometheus.Desc
 	PeerLeaseExpiryTime *prometheus.Desc
+	LeasesActive        *prometheus.Desc
 
 	devices      func() ([]*wgtypes.Device, error)
 	leaseManager *FileLeaseManager
@@ -71,6 +73,12 @@ func newMetricsCollector(devices func() ([]*wgtypes.Device, error), lm *FileLeas
 			[]string{"address", "public_key", "username"},
 			nil,
 		),
+		LeasesActive: prometheus.NewDesc(
+			"wiresteward_leases_active",
+			"Number of leases that have not expired.",
+			nil,
+			nil,
+		),
 		devices:      devices,
 		leaseManager: lm,
 	}
@@ -86,6 +94,7 @@ func (c *collector) Describe(ch chan<- *prometheus.Desc) {
 		c.PeerTransmitBytes,
 		c.PeerLastHandshake,
 		c.PeerLeaseExpiryTime,
+		c.LeasesActive,
 	}
 
 	for _, d := range ds {
@@ -158,7 +167,14 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 			)
 		}
 	}
+	c.leaseManager.wgRecordsMutex.Lock()
+	defer c.leaseManager.wgRecordsMutex.Unlock()
+	active := 0
+	now := time.Now()
 	for username, record := range c.leaseManager.wgRecords {
+		if record.expires.After(now) {
+			active++
+		}
 		// Expose expiry time of 0 if not set.
 		var expiry float64
 		if !record.expires.IsZero() {
@@ -173,6 +189,11 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 			record.PubKey, username,
 		)
 	}
+	ch <- prometheus.MustNewConstMetric(
+		c.LeasesActive,
+		prometheus.GaugeValue,
+		float64(active),
+	)
 }
 
 func (c *collector) getUserFromPubKey(pub string) string {
@@ -18,8 +18,10 @@ func TestCollector(t *testing.T) {
 		pubPeerA = newWgKey()
 		pubPeerB = newWgKey()
 		pubPeerC = newWgKey()
+		pubPeerD = newWgKey()
 		userA    = "userA@example.com"
 		userB    = "userB@example.com"
+		userC    = "userC@example.com"
 	)
 
 	tests := []struct {
@@ -93,6 +95,11 @@ func TestCollector(t *testing.T) {
 						PubKey: pubPeerB.String(),
 						IP:     net.ParseIP("10.0.0.3"),
 					},
+					userC: WgRecord{
+						PubKey:  pubPeerD.String(),
+						IP:      net.ParseIP("10.0.0.5"),
+						expires: time.Unix(4102444800, 0),
+					},
 				},
 			},
 			metrics: []string{
@@ -116,6 +123,8 @@ func TestCollector(t *testing.T) {
 				fmt.Sprintf(`wiresteward_wg_peer_transmit_bytes_total{device="wg1",public_key="%v",username=""} 0`, pubPeerC.String()),
 				fmt.Sprintf(`wiresteward_peer_lease_expiry_time{address="10.0.0.1",public_key="%v",username="%s"} 100`, pubPeerA.String(), userA),
 				fmt.Sprintf(`wiresteward_peer_lease_expiry_time{address="10.0.0.3",public_key="%v",username="%s"} 0`, pubPeerB.String(), userB),
+				fmt.Sprintf(`wiresteward_peer_lease_expiry_time{address="10.0.0.5",public_key="%v",username="%s"} 4.1024448e+09`, pubPeerD.String(), userC),
+				`wiresteward_leases_active 1`,
 			},
 		},
 	}
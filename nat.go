@@ -0,0 +1,79 @@
+package main
+
+// Sysctls that enable forwarding, relative to sysctlRoot.
+const (
+	ipv4ForwardingSysctl = "net/ipv4/ip_forward"
+	ipv6ForwardingSysctl = "net/ipv6/conf/all/forwarding"
+)
+
+// upstreamRules returns the masquerading rule limited to each of the upstream
+// interfaces, or rule alone if there are none. rule has to end with its
+// target.
+func upstreamRules(rule []string, upstreams []string) [][]string {
+	if len(upstreams) == 0 {
+		return [][]string{rule}
+	}
+	target := rule[len(rule)-2:]
+	rules := [][]string{}
+	for _, iface := range upstreams {
+		r := append([]string{}, rule[:len(rule)-2]...)
+		rules = append(rules, append(append(r, "-o", iface), target...))
+	}
+	return rules
+}
+
+// natForwardRules returns the rules accepting the traffic forwarded from
+// device to the upstream interfaces, or any interface if there are none, and
+// the replies to it.
+func natForwardRules(device string, upstreams []string) [][]string {
+	if len(upstreams) == 0 {
+		return [][]string{
+			{"-i", device, "-j", "ACCEPT"},
+			{"-o", device, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		}
+	}
+	rules := [][]string{}
+	for _, iface := range upstreams {
+		rules = append(rules,
+			[]string{"-i", device, "-o", iface, "-j", "ACCEPT"},
+			[]string{"-i", iface, "-o", device, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		)
+	}
+	return rules
+}
+
+// enableForwarding turns on forwarding of IPv4, and of IPv6 if ipv6 is set,
+// and returns the sysctls it changed along with their previous values.
+func enableForwarding(ipv6 bool) (map[string]string, error) {
+	paths := []string{ipv4ForwardingSysctl}
+	if ipv6 {
+		paths = append(paths, ipv6ForwardingSysctl)
+	}
+	previous := map[string]string{}
+	for _, path := range paths {
+		v, err := readSysctl(path)
+		if err != nil {
+			return previous, err
+		}
+		if v == "1" {
+			continue
+		}
+		logger.Info.Printf("Enabling forwarding, setting %s to 1", path)
+		if err := writeSysctl(path, "1"); err != nil {
+			return previous, err
+		}
+		previous[path] = v
+	}
+	return previous, nil
+}
+
+// restoreSysctls sets the sysctls back to the values in previous.
+func restoreSysctls(previous map[string]string) error {
+	for path, v := range previous {
+		logger.Info.Printf("Restoring %s to %s", path, v)
+		if err := writeSysctl(path, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
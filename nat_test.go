@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerConfig_NAT(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	for _, tc := range []struct {
+		input string
+		err   bool
+	}{
+		{`"nat": {"upstreamInterfaces": ["eth0", "eth1"], "forward": true}`, false},
+		{`"nat": {"forward": true}`, false},
+		{`"nat": {"upstreamInterfaces": [""]}`, true},
+		{`"nat": {"upstreamInterfaces": ["eth 0"]}`, true},
+		{`"nat": {"upstreamInterfaces": ["a-very-long-interface"]}`, true},
+		{`"nat": {"upstreamInterfaces": ["eth0", "eth0"]}`, true},
+	} {
+		cfg := &serverConfig{}
+		input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthIntrospectURL": "example.com", "oauthClientID": "id", ` + tc.input + `}`
+		if err := json.Unmarshal([]byte(input), cfg); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyServerConfig(cfg)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+		}
+	}
+}
+
+func TestUpstreamRules(t *testing.T) {
+	rule := []string{"-s", "10.90.0.0/24", "-d", "10.0.0.0/8", "-j", "MASQUERADE"}
+	assert.Equal(t, [][]string{rule}, upstreamRules(rule, nil))
+	assert.Equal(t, [][]string{
+		{"-s", "10.90.0.0/24", "-d", "10.0.0.0/8", "-o", "eth0", "-j", "MASQUERADE"},
+		{"-s", "10.90.0.0/24", "-d", "10.0.0.0/8", "-o", "eth1", "-j", "MASQUERADE"},
+	}, upstreamRules(rule, []string{"eth0", "eth1"}))
+	// The rule is not modified
+	assert.Equal(t, []string{"-s", "10.90.0.0/24", "-d", "10.0.0.0/8", "-j", "MASQUERADE"}, rule)
+
+	assert.Equal(t, [][]string{
+		{"-i", "wg0", "-j", "ACCEPT"},
+		{"-o", "wg0", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}, natForwardRules("wg0", nil))
+	assert.Equal(t, [][]string{
+		{"-i", "wg0", "-o", "eth0", "-j", "ACCEPT"},
+		{"-i", "eth0", "-o", "wg0", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}, natForwardRules("wg0", []string{"eth0"}))
+}
+
+func TestEnableForwarding(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	root := t.TempDir()
+	defer func(r string) { sysctlRoot = r }(sysctlRoot)
+	sysctlRoot = root
+	for path, value := range map[string]string{
+		ipv4ForwardingSysctl: "0",
+		ipv6ForwardingSysctl: "1",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, path), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the sysctls that are changed are restored
+	previous, err := enableForwarding(true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{ipv4ForwardingSysctl: "0"}, previous)
+	v, _ := readSysctl(ipv4ForwardingSysctl)
+	assert.Equal(t, "1", v)
+
+	assert.NoError(t, restoreSysctls(previous))
+	v, _ = readSysctl(ipv4ForwardingSysctl)
+	assert.Equal(t, "0", v)
+	v, _ = readSysctl(ipv6ForwardingSysctl)
+	assert.Equal(t, "1", v)
+}
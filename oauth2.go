@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
@@ -13,6 +14,8 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/oauth2"
 )
@@ -52,9 +55,22 @@ type oauthTokenHandler struct {
 	tokFile      string             // File path to cache the token
 	t            chan *oauth2.Token // to feed the token from the redirect uri
 	codeVerifier *codeVerifier
+	// deviceAuthURL is the device authorization endpoint, used to
+	// authenticate agents without a browser
+	deviceAuthURL string
+	// state is the state of the latest web flow, which the callback
+	// must carry
+	state string
+	// tokenStore keeps the refresh token out of the token file, if set
+	tokenStore secretStore
+	// deviceCode is the device authorization grant waiting for the user to
+	// authorise the agent, if any, which later logins reuse until it
+	// completes or expires
+	deviceCode      *deviceAuthResponse
+	deviceCodeMutex sync.Mutex
 }
 
-func newOAuthTokenHandler(authURL, tokenURL, clientID, tokFile string) *oauthTokenHandler {
+func newOAuthTokenHandler(authURL, tokenURL, deviceAuthURL, clientID, tokFile string) *oauthTokenHandler {
 	oa := &oauthTokenHandler{
 		ctx: context.Background(),
 		config: &oauth2.Config{
@@ -67,8 +83,9 @@ func newOAuthTokenHandler(authURL, tokenURL, clientID, tokFile string) *oauthTok
 				TokenURL: tokenURL,
 			},
 		},
-		t:       make(chan *oauth2.Token),
-		tokFile: tokFile,
+		t:             make(chan *oauth2.Token),
+		tokFile:       tokFile,
+		deviceAuthURL: deviceAuthURL,
 	}
 
 	return oa
@@ -90,8 +107,16 @@ func (oa *oauthTokenHandler) prepareTokenWebChalenge() (string, error) {
 	codeChallengeOpt := oauth2.SetAuthURLParam("code_challenge", codeChallenge)
 	codeChallengeMethodOpt := oauth2.SetAuthURLParam("code_challenge_method", "S256")
 
+	// The state ties the callback to this challenge, so that other sites
+	// cannot make the agent exchange their codes
+	state, err := createCodeVerifier()
+	if err != nil {
+		return "", fmt.Errorf("Cannot create a state: %v", err)
+	}
+	oa.state = string(state.value)
+
 	url := oa.config.AuthCodeURL(
-		"state-token",
+		oa.state,
 		oauth2.AccessTypeOnline,
 		codeChallengeOpt,
 		codeChallengeMethodOpt,
@@ -110,10 +135,29 @@ func (oa *oauthTokenHandler) getTokenFromFile() (*oauth2.Token, error) {
 	if err := json.NewDecoder(f).Decode(tok); err != nil {
 		return nil, err
 	}
+	if oa.tokenStore != nil && tok.RefreshToken == "" {
+		refreshToken, err := oa.tokenStore.get(oa.config.ClientID)
+		switch {
+		case err == nil:
+			tok.RefreshToken = refreshToken
+		case !errors.Is(err, errSecretNotFound):
+			logger.Error.Printf("Cannot read refresh token from token store: %v", err)
+		}
+	}
 	return tok, nil
 }
 
+// saveToken caches token in the token file. If the token store is set, the
+// refresh token is stored there instead.
 func (oa *oauthTokenHandler) saveToken(token *oauth2.Token) error {
+	if oa.tokenStore != nil && token.RefreshToken != "" {
+		if err := oa.tokenStore.set(oa.config.ClientID, token.RefreshToken); err != nil {
+			return fmt.Errorf("unable to store refresh token: %w", err)
+		}
+		t := *token
+		t.RefreshToken = ""
+		token = &t
+	}
 	logger.Info.Printf("Saving credential file to: %s", oa.tokFile)
 	f, err := os.OpenFile(oa.tokFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
@@ -123,13 +167,38 @@ func (oa *oauthTokenHandler) saveToken(token *oauth2.Token) error {
 	return json.NewEncoder(f).Encode(token)
 }
 
-func (oa *oauthTokenHandler) ExchangeToken(code string) (*oauth2.Token, error) {
+// refreshToken returns the cached access token, refreshing it first if it has
+// expired, or if force is set, and a refresh token is available.
+func (oa *oauthTokenHandler) refreshToken(force bool) (string, error) {
+	tok, err := oa.getTokenFromFile()
+	if err != nil {
+		return "", err
+	}
+	if force && tok.RefreshToken != "" {
+		tok.Expiry = time.Now().Add(-time.Second)
+	}
+	newTok, err := oa.config.TokenSource(oa.ctx, tok).Token()
+	if err != nil {
+		return "", err
+	}
+	if newTok.AccessToken != tok.AccessToken {
+		if err := oa.saveToken(newTok); err != nil {
+			logger.Error.Printf("failed to save token to file: %v", err)
+		}
+	}
+	return newTok.AccessToken, nil
+}
+
+func (oa *oauthTokenHandler) ExchangeToken(state, code string) (*oauth2.Token, error) {
 	// Use the authorization code that is pushed to the redirect
 	// URL. Exchange will do the handshake to retrieve the
 	// initial access token.
 	if oa.codeVerifier == nil {
 		return nil, fmt.Errorf("unexpected callback received, please visit the root path instead")
 	}
+	if state != oa.state {
+		return nil, fmt.Errorf("callback state does not match, please visit the root path again")
+	}
 	codeVerifierOpt := oauth2.SetAuthURLParam("code_verifier", string(oa.codeVerifier.value))
 	tok, err := oa.config.Exchange(oa.ctx, code, codeVerifierOpt)
 	if err != nil {
@@ -152,7 +221,12 @@ type tokenValidator struct {
 type introspectionResponse struct {
 	Active   bool   `json:"active"`
 	Exp      int64  `json:"exp"`
+	Iat      int64  `json:"iat"`
 	UserName string `json:"username"`
+	// Scope is the space separated list of scopes granted to the token
+	Scope string `json:"scope"`
+	// Groups are the identity provider groups of the user
+	Groups []string `json:"groups,omitempty"`
 }
 
 func newTokenValidator(clientID, introspectURL string) *tokenValidator {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	peerDiscrepancyMissing    = "missing"
+	peerDiscrepancyUnexpected = "unexpected"
+	peerDiscrepancyChanged    = "changed"
+)
+
+// peerDiscrepancy is a difference between the peers of the device and the
+// ones of the leases.
+type peerDiscrepancy struct {
+	kind    string
+	message string
+}
+
+// reconcileDevicePeers compares the peers of the device with the leases and
+// configures the device again if they differ, eg. because peers were changed
+// with `wg` or the server crashed while updating them, logging each
+// discrepancy.
+func (lm *FileLeaseManager) reconcileDevicePeers() error {
+	if lm.device == nil {
+		return nil
+	}
+	dev, err := lm.device(lm.deviceName)
+	if err != nil {
+		return fmt.Errorf("cannot get peers of device %s: %w", lm.deviceName, err)
+	}
+	lm.wgRecordsMutex.Lock()
+	discrepancies := peerDiscrepancies(dev.Peers, lm.peerConfigs())
+	lm.wgRecordsMutex.Unlock()
+	if len(discrepancies) == 0 {
+		return nil
+	}
+	for _, d := range discrepancies {
+		logger.Warn.Printf("Peers of device %s do not match the leases: %s", lm.deviceName, d.message)
+		peerDiscrepanciesTotal.WithLabelValues(d.kind).Inc()
+	}
+	return lm.updateWgPeers()
+}
+
+// peerDiscrepancies returns the differences between the existing peers of a
+// device and the desired ones, sorted by peer.
+func peerDiscrepancies(existing []wgtypes.Peer, desired []wgtypes.PeerConfig) []peerDiscrepancy {
+	found := make(map[wgtypes.Key]wgtypes.Peer, len(existing))
+	for _, p := range existing {
+		found[p.PublicKey] = p
+	}
+	discrepancies := []peerDiscrepancy{}
+	for _, dp := range desired {
+		ep, ok := found[dp.PublicKey]
+		delete(found, dp.PublicKey)
+		if !ok {
+			discrepancies = append(discrepancies, peerDiscrepancy{peerDiscrepancyMissing, fmt.Sprintf("peer %s (%s) is missing", dp.PublicKey, ipNetsString(dp.AllowedIPs))})
+			continue
+		}
+		if ipNetsString(ep.AllowedIPs) != ipNetsString(dp.AllowedIPs) {
+			discrepancies = append(discrepancies, peerDiscrepancy{peerDiscrepancyChanged, fmt.Sprintf("peer %s has allowed IPs %s instead of %s", dp.PublicKey, ipNetsString(ep.AllowedIPs), ipNetsString(dp.AllowedIPs))})
+		}
+		var psk wgtypes.Key
+		if dp.PresharedKey != nil {
+			psk = *dp.PresharedKey
+		}
+		if ep.PresharedKey != psk {
+			discrepancies = append(discrepancies, peerDiscrepancy{peerDiscrepancyChanged, fmt.Sprintf("peer %s has a different preshared key", dp.PublicKey)})
+		}
+	}
+	for key := range found {
+		discrepancies = append(discrepancies, peerDiscrepancy{peerDiscrepancyUnexpected, fmt.Sprintf("peer %s has no lease", key)})
+	}
+	sort.Slice(discrepancies, func(i, j int) bool {
+		return discrepancies[i].message < discrepancies[j].message
+	})
+	return discrepancies
+}
+
+// ipNetsString returns the sorted networks of nets, joined by commas.
+func ipNetsString(nets []net.IPNet) string {
+	s := make([]string, len(nets))
+	for i, n := range nets {
+		s[i] = n.String()
+	}
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPeerDiscrepancies(t *testing.T) {
+	ipNet := func(s string) net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return *n
+	}
+	synced, moved, missing, stray := newWgKey(), newWgKey(), newWgKey(), newWgKey()
+	psk := newWgKey()
+	desired := []wgtypes.PeerConfig{
+		{PublicKey: synced, AllowedIPs: []net.IPNet{ipNet("10.90.0.2/32"), ipNet("fd00::2/128")}},
+		{PublicKey: moved, PresharedKey: &psk, AllowedIPs: []net.IPNet{ipNet("10.90.0.3/32")}},
+		{PublicKey: missing, AllowedIPs: []net.IPNet{ipNet("10.90.0.4/32")}},
+	}
+	existing := []wgtypes.Peer{
+		{PublicKey: synced, AllowedIPs: []net.IPNet{ipNet("fd00::2/128"), ipNet("10.90.0.2/32")}},
+		{PublicKey: moved, AllowedIPs: []net.IPNet{ipNet("10.90.0.5/32")}},
+		{PublicKey: stray, AllowedIPs: []net.IPNet{ipNet("10.90.0.6/32")}},
+	}
+	got := map[string]string{}
+	for _, d := range peerDiscrepancies(existing, desired) {
+		got[d.message] = d.kind
+	}
+	assert.Equal(t, map[string]string{
+		"peer " + moved.String() + " has allowed IPs 10.90.0.5/32 instead of 10.90.0.3/32": peerDiscrepancyChanged,
+		"peer " + moved.String() + " has a different preshared key":                        peerDiscrepancyChanged,
+		"peer " + missing.String() + " (10.90.0.4/32) is missing":                          peerDiscrepancyMissing,
+		"peer " + stray.String() + " has no lease":                                         peerDiscrepancyUnexpected,
+	}, got)
+
+	assert.Empty(t, peerDiscrepancies(existing[:1], desired[:1]))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseIPOrCIDR parses s as a network in CIDR notation, or as a single
+// address. It returns nil if s is neither.
+func parseIPOrCIDR(s string) *net.IPNet {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// pool returns the pool named name, or nil if there is none.
+func (c *serverConfig) pool(name string) *serverPoolConfig {
+	for _, p := range c.Pools {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// selectPool returns the pool to lease an address from to the owner of a
+// token granted scope, who requested the pool named requested. Pools can only
+// be requested with one of their scopes, if they have any. Without a request,
+// the first pool selected by one of the scopes is used, and nil is returned
+// if there is none, for the address network.
+func (c *serverConfig) selectPool(requested, scope string) (*serverPoolConfig, error) {
+	scopes := strings.Fields(scope)
+	if requested != "" {
+		p := c.pool(requested)
+		if p == nil {
+			return nil, fmt.Errorf("unknown pool %s", requested)
+		}
+		if len(p.Scopes) > 0 && !p.selectedBy(scopes) {
+			return nil, fmt.Errorf("token is not allowed to lease from pool %s", requested)
+		}
+		return p, nil
+	}
+	for _, p := range c.Pools {
+		if len(p.Scopes) > 0 && p.selectedBy(scopes) {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// poolConfig returns the config leases from pool p are granted with, which
+// is c with the lease timing overridden by the pool.
+func (c *serverConfig) poolConfig(p *serverPoolConfig) *serverConfig {
+	pc := *c
+	if p.LeaseTTL.Duration != 0 {
+		pc.LeaseTTL = p.LeaseTTL.Duration
+	}
+	if p.LeaseMaxLifetime.Duration != 0 {
+		pc.LeaseMaxLifetime = p.LeaseMaxLifetime.Duration
+	}
+	if p.LeaseRenewInterval.Duration != 0 {
+		pc.LeaseRenewInterval = p.LeaseRenewInterval.Duration
+	} else if pc.LeaseTTL > 0 && pc.LeaseRenewInterval >= pc.LeaseTTL {
+		// The renew interval of the server does not fit in the TTL of
+		// the pool, leases are renewed halfway through instead
+		pc.LeaseRenewInterval = 0
+	}
+	return &pc
+}
+
+// selectedBy returns whether any of scopes is one of the scopes of the pool.
+func (p *serverPoolConfig) selectedBy(scopes []string) bool {
+	return hasAnyScope(scopes, p.Scopes)
+}
+
+// hasAnyScope returns whether any of scopes is one of allowed.
+func hasAnyScope(scopes, allowed []string) bool {
+	for _, s := range scopes {
+		for _, a := range allowed {
+			if s == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isReserved returns whether ip is in one of the reserved ranges of the pool.
+func (p *serverPoolConfig) isReserved(ip net.IP) bool {
+	for _, r := range p.reserved {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolNetwork returns the network that addresses of the pool named name are
+// leased from and the address of the server in it, the address network for
+// the empty name. It must be called with wgRecordsMutex held.
+func (lm *FileLeaseManager) poolNetwork(name string) (*net.IPNet, net.IP) {
+	for _, p := range lm.pools {
+		if p.Name == name {
+			return p.network, p.ip
+		}
+	}
+	return lm.cidr, lm.ip
+}
+
+// isPoolReserved returns whether ip is in a reserved range of its pool.
+func (lm *FileLeaseManager) isPoolReserved(ip net.IP) bool {
+	for _, p := range lm.pools {
+		if p.network.Contains(ip) {
+			return p.isReserved(ip)
+		}
+	}
+	return false
+}
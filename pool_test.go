@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestPoolConfig returns a server config with the pools, verified.
+func newTestPoolConfig(t *testing.T, pools ...*serverPoolConfig) *serverConfig {
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	cfg := &serverConfig{WireguardIPAddress: ip, WireguardIPNetwork: network, Pools: pools}
+	if err := verifyPoolsConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestServerConfig_SelectPool(t *testing.T) {
+	cfg := newTestPoolConfig(t,
+		&serverPoolConfig{Name: "office", Address: "10.91.0.1/24"},
+		&serverPoolConfig{Name: "infra", Address: "10.92.0.1/24", Scopes: []string{"wiresteward.infra"}},
+		&serverPoolConfig{Name: "ops", Address: "10.93.0.1/24", Scopes: []string{"wiresteward.ops", "wiresteward.infra"}},
+	)
+	for _, tc := range []struct {
+		requested, scope, pool string
+		err                    bool
+	}{
+		{"", "openid", "", false},
+		{"", "openid wiresteward.infra", "infra", false},
+		{"", "wiresteward.ops", "ops", false},
+		{"office", "openid", "office", false},
+		{"ops", "wiresteward.infra", "ops", false},
+		{"infra", "wiresteward.ops", "", true},
+		{"lab", "openid", "", true},
+	} {
+		pool, err := cfg.selectPool(tc.requested, tc.scope)
+		if tc.err {
+			assert.Error(t, err, tc.requested)
+			continue
+		}
+		assert.NoError(t, err, tc.requested)
+		name := ""
+		if pool != nil {
+			name = pool.Name
+		}
+		assert.Equal(t, tc.pool, name, tc.requested+" "+tc.scope)
+	}
+	// The server address of the pool is advertised for health checks
+	assert.Equal(t, []string{"10.91.0.1/32"}, cfg.pool("office").AllowedIPs)
+}
+
+func TestFileLeaseManager_Pools(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	cfg := newTestPoolConfig(t, &serverPoolConfig{Name: "office", Address: "10.91.0.1/24", Reserved: []string{"10.91.0.2", "10.91.0.4/31"}})
+	lm := &FileLeaseManager{
+		wgRecords: map[string]WgRecord{},
+		cidr:      cfg.WireguardIPNetwork,
+		ip:        cfg.WireguardIPAddress,
+		pools:     cfg.Pools,
+	}
+	expiry := time.Now().Add(time.Hour)
+	lease := func(username, pool string) string {
+		record, err := lm.createOrUpdatePeer(username, &leaseRequest{PubKey: validPublicKey, Pool: pool}, expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record.IP.String()
+	}
+	// Reserved ranges of the pool are skipped
+	assert.Equal(t, "10.91.0.3", lease("alice@example.com", "office"))
+	assert.Equal(t, "10.91.0.6", lease("bob@example.com", "office"))
+	assert.Equal(t, "10.90.0.2", lease("carol@example.com", ""))
+
+	// Renewals keep the address, until the lease moves to another pool
+	assert.Equal(t, "10.91.0.3", lease("alice@example.com", "office"))
+	assert.Equal(t, "10.90.0.3", lease("alice@example.com", ""))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// presharedKeyMinVersion is the lease API version agents have to
+	// declare to get a lease from servers using preshared keys, older
+	// agents would not install them and fail to handshake
+	presharedKeyMinVersion = 2
+	presharedKeySecretSize = 32
+)
+
+// derivePresharedKey returns the preshared key of the peer with pubKey. Keys
+// are derived from secret, so that they do not have to be stored along with
+// the leases, and change along with the public key of the peer.
+func derivePresharedKey(secret []byte, pubKey string) wgtypes.Key {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("wiresteward preshared key " + pubKey))
+	var key wgtypes.Key
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// presharedKey returns the base64 encoded preshared key of the peer with
+// pubKey, or an empty string if preshared keys are not used.
+func (lm *FileLeaseManager) presharedKey(pubKey string) string {
+	if lm.presharedKeySecret == nil {
+		return ""
+	}
+	return derivePresharedKey(lm.presharedKeySecret, pubKey).String()
+}
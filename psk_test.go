@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresharedKeySecret(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	filename := filepath.Join(t.TempDir(), "psk", "secret")
+	secret, err := loadOrCreateSecret(filename, presharedKeySecretSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The generated secret is stored and loaded again
+	again, err := loadOrCreateSecret(filename, presharedKeySecretSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, secret, again)
+
+	// Keys are stable per public key
+	key1, key2 := newWgKey().String(), newWgKey().String()
+	assert.Equal(t, derivePresharedKey(secret, key1), derivePresharedKey(secret, key1))
+	assert.NotEqual(t, derivePresharedKey(secret, key1), derivePresharedKey(secret, key2))
+
+	if err := os.WriteFile(filename, []byte("c2hvcnQ="), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadOrCreateSecret(filename, presharedKeySecretSize)
+	assert.Error(t, err)
+}
+
+func TestFileLeaseManager_PresharedKey(t *testing.T) {
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	lm := &FileLeaseManager{
+		wgRecords: map[string]WgRecord{},
+		cidr:      network,
+		ip:        ip,
+	}
+	if _, err := lm.createOrUpdatePeer("alice@example.com", &leaseRequest{PubKey: validPublicKey}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "", lm.presharedKey(validPublicKey))
+	assert.Nil(t, lm.peerConfigs()[0].PresharedKey)
+
+	lm.presharedKeySecret = bytes.Repeat([]byte{1}, presharedKeySecretSize)
+	psk := lm.presharedKey(validPublicKey)
+	assert.NotEmpty(t, psk)
+	assert.Equal(t, psk, lm.peerConfigs()[0].PresharedKey.String())
+
+	// and installed by agents
+	config, _, err := newWirestewardPeerConfigFromLeaseResponse(&leaseResponse{
+		IP:           "10.90.0.2/32",
+		PubKey:       validPublicKey,
+		AllowedIPs:   validAllowedIPs,
+		PresharedKey: psk,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, psk, config.PresharedKey.String())
+}
+
+func TestHTTPLeaseHandler_PresharedKeyVersion(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	introspection := newTestIntrospectionServer("test@example.com")
+	defer introspection.Close()
+	lh := &HTTPLeaseHandler{
+		tokenValidator: newTokenValidator("client_id", introspection.URL),
+		leaseManager:   &FileLeaseManager{presharedKeySecret: bytes.Repeat([]byte{1}, presharedKeySecretSize)},
+	}
+	body, _ := json.Marshal(&leaseRequest{PubKey: validPublicKey, Version: 1})
+	req := httptest.NewRequest("POST", "/newPeerLease", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	lh.newPeerLease(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "upgrade the agent")
+}
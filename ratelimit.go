@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRateLimitBurst = 5
+	// Buckets that refilled are dropped at most this often, so that the
+	// limiters do not grow with every address and token ever seen
+	rateLimiterSweepInterval = time.Minute
+)
+
+// tokenBucket holds the tokens left for a key of a rateLimiter as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the rate of requests per key, eg. source address or
+// token, with a token bucket per key: requests are allowed at rate per second
+// on average, in bursts of up to burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(cfg *rateLimitConfig) *rateLimiter {
+	if cfg == nil {
+		return nil
+	}
+	return &rateLimiter{rate: cfg.Rate, burst: float64(cfg.Burst), buckets: map[string]*tokenBucket{}}
+}
+
+// allow returns whether a request for key is allowed at now, and otherwise
+// how long until the next one is. Every request is allowed by a nil
+// rateLimiter.
+func (rl *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if now.Sub(rl.lastSweep) >= rateLimiterSweepInterval {
+		rl.sweep(now)
+	}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(rl.burst, b.tokens+elapsed.Seconds()*rl.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that are full again at now. It must be called
+// with mutex held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// checkRateLimits returns an error if too many lease requests were sent from
+// the source address of r, or with its token. Tokens are limited before they
+// are validated, so that clients retrying in a loop do not reach the identity
+// providers either.
+func (lh *HTTPLeaseHandler) checkRateLimits(r *http.Request) *leaseError {
+	now := time.Now()
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ok, wait := lh.sourceIPLimiter.allow(host, now); !ok {
+		leaseRequestsRateLimitedTotal.WithLabelValues("source_ip").Inc()
+		return &leaseError{status: http.StatusTooManyRequests, message: fmt.Sprintf("too many lease requests from %s", host), retryAfter: wait}
+	}
+	if token := r.Header.Get("Authorization"); token != "" {
+		digest := sha256.Sum256([]byte(token))
+		if ok, wait := lh.tokenLimiter.allow(hex.EncodeToString(digest[:]), now); !ok {
+			leaseRequestsRateLimitedTotal.WithLabelValues("token").Inc()
+			return &leaseError{status: http.StatusTooManyRequests, message: "too many lease requests with this token", retryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// setRetryAfter sets the Retry-After header of the response to a rate limited
+// request, in whole seconds.
+func setRetryAfter(h http.Header, wait time.Duration) {
+	if wait > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+}
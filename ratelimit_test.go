@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(&rateLimitConfig{Rate: 0.5, Burst: 2})
+	now := time.Now()
+	// Bursts are allowed, then requests at the rate
+	for i := 0; i < 2; i++ {
+		ok, _ := rl.allow("10.0.0.1", now)
+		assert.True(t, ok)
+	}
+	ok, wait := rl.allow("10.0.0.1", now)
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Second, wait)
+	// Keys are limited separately
+	ok, _ = rl.allow("10.0.0.2", now)
+	assert.True(t, ok)
+	ok, _ = rl.allow("10.0.0.1", now.Add(2*time.Second))
+	assert.True(t, ok)
+	ok, wait = rl.allow("10.0.0.1", now.Add(3*time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	// Buckets that refilled are dropped
+	ok, _ = rl.allow("10.0.0.3", now.Add(time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(rl.buckets))
+
+	var unlimited *rateLimiter
+	ok, _ = unlimited.allow("10.0.0.1", now)
+	assert.True(t, ok)
+}
+
+func TestServerConfig_RateLimits(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	for _, tc := range []struct {
+		input string
+		err   bool
+	}{
+		{`"rateLimits": {"sourceIP": {"rate": 1, "burst": 10}, "token": {"rate": 0.1}}`, false},
+		{`"rateLimits": {"sourceIP": {"rate": 0}}`, true},
+		{`"rateLimits": {"token": {"rate": 1, "burst": -1}}`, true},
+	} {
+		cfg := &serverConfig{}
+		input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthClientID": "id", "oauthIntrospectURL": "example.com", ` + tc.input + `}`
+		if err := json.Unmarshal([]byte(input), cfg); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyServerConfig(cfg)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+			assert.Equal(t, defaultRateLimitBurst, cfg.RateLimits.Token.Burst)
+		}
+	}
+}
+
+func TestHTTPLeaseHandler_RateLimits(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	validator := &fakeTokenValidator{token: "token", username: "alice@example.com"}
+	lh := &HTTPLeaseHandler{
+		tokenValidator:  validator,
+		serverConfig:    &serverConfig{},
+		sourceIPLimiter: newRateLimiter(&rateLimitConfig{Rate: 0.001, Burst: 2}),
+		tokenLimiter:    newRateLimiter(&rateLimitConfig{Rate: 0.001, Burst: 1}),
+	}
+	request := func(remoteAddr, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/lease", strings.NewReader("{"))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		lh.newPeerLease(w, req)
+		return w
+	}
+	sourceIP := testutil.ToFloat64(leaseRequestsRateLimitedTotal.WithLabelValues("source_ip"))
+	tokens := testutil.ToFloat64(leaseRequestsRateLimitedTotal.WithLabelValues("token"))
+
+	// Requests within the limits are validated, the body is invalid
+	assert.Equal(t, http.StatusInternalServerError, request("10.0.0.1:1234", "token").Code)
+	// Tokens are limited across addresses
+	w := request("10.0.0.2:1234", "token")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1000", w.Header().Get("Retry-After"))
+	// Addresses are limited across tokens
+	assert.Equal(t, http.StatusForbidden, request("10.0.0.1:1234", "other").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("10.0.0.1:1234", "third").Code)
+	assert.Equal(t, 1.0, testutil.ToFloat64(leaseRequestsRateLimitedTotal.WithLabelValues("source_ip"))-sourceIP)
+	assert.Equal(t, 1.0, testutil.ToFloat64(leaseRequestsRateLimitedTotal.WithLabelValues("token"))-tokens)
+}
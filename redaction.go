@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// leaseRequestVersion is the version of the lease API spoken by the agent,
+// sent along with lease requests. Agents that predate it send none, ie. 0.
+// Agents install preshared keys since version 2.
+const leaseRequestVersion = 2
+
+// serverRedactionRule describes who may receive a lease response field.
+type serverRedactionRule struct {
+	// Scopes, if set, are the token scopes allowed to receive the field,
+	// one of them is enough
+	Scopes []string `json:"scopes"`
+	// MinVersion is the minimum lease API version the agent has to declare
+	MinVersion int `json:"minVersion"`
+}
+
+// serverRedactionRules maps lease response fields to the agents allowed to
+// receive them, they are omitted for the rest.
+type serverRedactionRules map[string]serverRedactionRule
+
+// redactableResponseFields maps the lease response fields that can be
+// redacted to functions clearing them. The rest of the response, including
+// the expiry of the lease and the address of the server, is needed by every
+// agent to configure its device and keep the lease.
+var redactableResponseFields = map[string]func(r *leaseResponse){
+	"DelegatedPrefix": func(r *leaseResponse) { r.DelegatedPrefix = "" },
+	"PresharedKey":    func(r *leaseResponse) { r.PresharedKey = "" },
+	"RenewAfter":      func(r *leaseResponse) { r.RenewAfter = time.Time{} },
+}
+
+// allows returns whether an agent that declared version, with a token
+// granted scopes, may receive the field the rule applies to.
+func (rule serverRedactionRule) allows(scopes []string, version int) bool {
+	if version < rule.MinVersion {
+		return false
+	}
+	if len(rule.Scopes) == 0 {
+		return true
+	}
+	for _, s := range scopes {
+		for _, allowed := range rule.Scopes {
+			if s == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactLeaseResponse clears the fields of r that the requesting agent is not
+// allowed to receive according to rules. scope is the space separated list
+// of scopes of the token, as returned by the introspection endpoint.
+func redactLeaseResponse(r *leaseResponse, rules serverRedactionRules, scope string, version int) {
+	scopes := strings.Fields(scope)
+	for field, rule := range rules {
+		if redact, ok := redactableResponseFields[field]; ok && !rule.allows(scopes, version) {
+			redact(r)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactLeaseResponse(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	full := leaseResponse{
+		Status:            "success",
+		IP:                "10.90.0.2/32",
+		ServerWireguardIP: "10.90.0.1",
+		AllowedIPs:        []string{"10.10.0.0/16"},
+		PubKey:            validPublicKey,
+		Endpoint:          "1.1.1.1:51820",
+		Expires:           expires,
+		RenewAfter:        expires.Add(-30 * time.Minute),
+		DelegatedPrefix:   "10.200.0.0/28",
+		PresharedKey:      validPublicKey,
+	}
+	rules := serverRedactionRules{
+		"DelegatedPrefix": {Scopes: []string{"wiresteward:infra"}},
+		"PresharedKey":    {Scopes: []string{"wiresteward:infra"}, MinVersion: 1},
+		// Fields that cannot be redacted are ignored
+		"Expires": {Scopes: []string{"wiresteward:infra"}},
+	}
+
+	// A trusted infra agent gets the full response
+	r := full
+	redactLeaseResponse(&r, rules, "openid email wiresteward:infra", leaseRequestVersion)
+	assert.Equal(t, full, r)
+
+	// while a low trust scope gets a minimal one
+	r = full
+	redactLeaseResponse(&r, rules, "openid email", leaseRequestVersion)
+	assert.Equal(t, "", r.DelegatedPrefix)
+	assert.Equal(t, "", r.PresharedKey)
+	assert.Equal(t, full.ServerWireguardIP, r.ServerWireguardIP)
+	assert.Equal(t, full.IP, r.IP)
+	assert.Equal(t, full.AllowedIPs, r.AllowedIPs)
+	assert.Equal(t, full.Expires, r.Expires)
+
+	// and agents that predate the required version do not get the fields
+	// either
+	r = full
+	redactLeaseResponse(&r, rules, "wiresteward:infra", 0)
+	assert.Equal(t, full.DelegatedPrefix, r.DelegatedPrefix)
+	assert.Equal(t, "", r.PresharedKey)
+
+	// Without rules nothing is redacted
+	r = full
+	redactLeaseResponse(&r, nil, "", 0)
+	assert.Equal(t, full, r)
+}
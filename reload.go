@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+)
+
+// deviceConfigDiff describes how the devices of a reloaded agent config
+// differ from the running ones.
+type deviceConfigDiff struct {
+	// unchanged devices are left alone
+	unchanged []string
+	// servers are devices that only changed their peers, which can be
+	// replaced without tearing down the tunnel
+	servers []string
+	// replaced devices changed otherwise and have to be recreated
+	replaced []string
+	added    []string
+	removed  []string
+}
+
+// diffDeviceConfigs compares the running device configs with the reloaded
+// ones, by device name.
+func diffDeviceConfigs(running, reloaded []agentDeviceConfig) deviceConfigDiff {
+	diff := deviceConfigDiff{}
+	old := map[string]agentDeviceConfig{}
+	for _, dev := range running {
+		old[dev.Name] = dev
+	}
+	seen := map[string]bool{}
+	for _, dev := range reloaded {
+		seen[dev.Name] = true
+		o, ok := old[dev.Name]
+		switch {
+		case !ok:
+			diff.added = append(diff.added, dev.Name)
+		case reflect.DeepEqual(o, dev):
+			diff.unchanged = append(diff.unchanged, dev.Name)
+		case onlyPeersChanged(o, dev):
+			diff.servers = append(diff.servers, dev.Name)
+		default:
+			diff.replaced = append(diff.replaced, dev.Name)
+		}
+	}
+	for _, dev := range running {
+		if !seen[dev.Name] {
+			diff.removed = append(diff.removed, dev.Name)
+		}
+	}
+	return diff
+}
+
+// onlyPeersChanged returns whether the device configs only differ in their
+// peers, and the device is health checked either way, as that is decided
+// when the device is created.
+func onlyPeersChanged(old, reloaded agentDeviceConfig) bool {
+	if len(old.Peers) == 0 || len(reloaded.Peers) == 0 || (len(old.Peers) > 1) != (len(reloaded.Peers) > 1) {
+		return false
+	}
+	reloaded.Peers = old.Peers
+	return reflect.DeepEqual(old, reloaded)
+}
+
+// reloadConfig reads the agent config at path again and applies it.
+func (a *Agent) reloadConfig(path string) error {
+	cfg, err := readAgentConfig(path)
+	if err != nil {
+		return fmt.Errorf("cannot read agent config: %w", err)
+	}
+	effective, err := effectiveCapabilities()
+	if err != nil {
+		return fmt.Errorf("cannot check agent capabilities: %w", err)
+	}
+	if err := preflightAgent(cfg, effective); err != nil {
+		return err
+	}
+	a.reload(cfg)
+	return nil
+}
+
+// reload applies the devices of cfg. Devices whose config did not change are
+// left alone and devices that only changed their servers keep their tunnel,
+// unless their server was removed. Other devices are recreated.
+func (a *Agent) reload(cfg *agentConfig) {
+	a.reloadMutex.Lock()
+	defer a.reloadMutex.Unlock()
+	warnRestartRequired(a.config, cfg)
+
+	bonded := a.bondedDevices()
+	devices := map[string]agentDeviceConfig{}
+	for _, dev := range cfg.Devices {
+		devices[dev.Name] = dev
+	}
+	running := map[string]*DeviceManager{}
+	for _, dm := range a.devices() {
+		running[dm.Name()] = dm
+	}
+
+	diff := diffDeviceConfigs(a.config.Devices, cfg.Devices)
+	for _, name := range diff.servers {
+		if dm, ok := running[name]; ok {
+			logger.Info.Printf("Updating servers of device %s", name)
+			dm.setServers(devices[name].Peers)
+		}
+	}
+	stop := append(append([]string{}, diff.replaced...), diff.removed...)
+	start := append(append([]string{}, diff.replaced...), diff.added...)
+	for _, name := range stop {
+		if bonded[name] {
+			logger.Warn.Printf("Device %s is part of a bond, its changes require a restart", name)
+			continue
+		}
+		if dm, ok := running[name]; ok {
+			logger.Info.Printf("Stopping device %s", name)
+			dm.Stop()
+			delete(running, name)
+		}
+	}
+	token, err := a.tokens.get()
+	if err != nil {
+		logger.Warn.Printf("Cannot get a token for the reloaded devices, they will be configured after authenticating: %v", err)
+	}
+	for _, name := range diff.removed {
+		delete(a.downDevices, name)
+	}
+	for _, name := range start {
+		if bonded[name] || a.downDevices[name] {
+			continue
+		}
+		logger.Info.Printf("Starting device %s", name)
+		dm, err := a.startDevice(devices[name])
+		if err != nil {
+			logger.Error.Printf("Error starting device `%s`: %v", name, err)
+			continue
+		}
+		running[name] = dm
+		if token != "" {
+			go dm.RenewTokenAndLease(token)
+		}
+	}
+
+	// Bond members keep running with their previous config until the agent
+	// restarts
+	applied := []agentDeviceConfig{}
+	for _, dev := range a.config.Devices {
+		if _, ok := devices[dev.Name]; bonded[dev.Name] && (!ok || !onlyPeersChanged(dev, devices[dev.Name])) {
+			devices[dev.Name] = dev
+			if !ok {
+				applied = append(applied, dev)
+			}
+		}
+	}
+	for _, dev := range cfg.Devices {
+		applied = append(applied, devices[dev.Name])
+	}
+	deviceManagers := []*DeviceManager{}
+	for _, dev := range applied {
+		if dm, ok := running[dev.Name]; ok {
+			deviceManagers = append(deviceManagers, dm)
+		}
+	}
+	a.deviceManagersMutex.Lock()
+	a.deviceManagers = deviceManagers
+	a.deviceManagersMutex.Unlock()
+
+	reloaded := *cfg
+	reloaded.Devices = applied
+	reloaded.Bonds = a.config.Bonds
+	a.config = &reloaded
+	logger.Info.Printf(
+		"Reloaded config: %d unchanged, %d updated, %d recreated, %d added and %d removed devices",
+		len(diff.unchanged),
+		len(diff.servers),
+		len(diff.replaced),
+		len(diff.added),
+		len(diff.removed),
+	)
+}
+
+// warnRestartRequired logs the agent settings that changed in a reloaded
+// config, but are only applied when the agent starts.
+func warnRestartRequired(running, reloaded *agentConfig) {
+	fields := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"clientID", running.ClientID, reloaded.ClientID},
+		{"oauth", running.OAuth, reloaded.OAuth},
+		{"statsd", running.StatsD, reloaded.StatsD},
+		{"captivePortal", running.CaptivePortal, reloaded.CaptivePortal},
+		{"bonds", running.Bonds, reloaded.Bonds},
+		{"resolvers", running.Resolvers, reloaded.Resolvers},
+		{"eventBufferSize", running.EventBufferSize, reloaded.EventBufferSize},
+		{"metricsAddress", running.MetricsAddress, reloaded.MetricsAddress},
+		{"offlineStart", running.OfflineStart, reloaded.OfflineStart},
+		{"hooks", running.Hooks, reloaded.Hooks},
+	}
+	for _, f := range fields {
+		if !reflect.DeepEqual(f.old, f.new) {
+			logger.Warn.Printf("Changes to `%s` require restarting the agent", f.name)
+		}
+	}
+}
+
+// reloadHandler reloads the agent config, so that changes can be applied
+// without sending a signal to the agent. It is only served on the control
+// socket.
+func (a *Agent) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST method is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := a.reloadConfig(*flagConfig); err != nil {
+		logger.Error.Printf("Cannot reload config: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "config reloaded")
+}
+
+// config returns a copy of the server config used to serve lease requests.
+func (lh *HTTPLeaseHandler) config() serverConfig {
+	lh.configMutex.RLock()
+	defer lh.configMutex.RUnlock()
+	return *lh.serverConfig
+}
+
+// setNetwork records network as the address network of the main device, once
+// it was expanded.
+func (lh *HTTPLeaseHandler) setNetwork(network *net.IPNet) {
+	lh.configMutex.Lock()
+	defer lh.configMutex.Unlock()
+	lh.serverConfig.WireguardIPNetwork = network
+}
+
+// configUpdates returns the version of the advertised settings, and a channel
+// that is closed the next time the config is reloaded.
+func (lh *HTTPLeaseHandler) configUpdates() (string, <-chan struct{}) {
+	lh.configMutex.Lock()
+	defer lh.configMutex.Unlock()
+	if lh.configReloaded == nil {
+		lh.configReloaded = make(chan struct{})
+	}
+	return lh.serverConfig.advertisedVersion(), lh.configReloaded
+}
+
+// reloadConfig reads the server config at path again and applies it.
+func (lh *HTTPLeaseHandler) reloadConfig(path string) error {
+	cfg, err := readServerConfig(path)
+	if err != nil {
+		return fmt.Errorf("cannot read server config: %w", err)
+	}
+	if err := loadNetworkState(cfg); err != nil {
+		return fmt.Errorf("cannot load network state: %w", err)
+	}
+	lh.reload(cfg)
+	return nil
+}
+
+// reload applies the settings of cfg that only affect new leases and
+// renewals: the routes, name resolution and mtu advertised to agents, lease
+// timing, response redaction, source ranges and reservations. Existing
+// leases and the device are left alone, other changes require a restart.
+func (lh *HTTPLeaseHandler) reload(cfg *serverConfig) {
+	lh.configMutex.Lock()
+	updated := *lh.serverConfig
+	updated.AllowedIPs = cfg.AllowedIPs
+	updated.AllowedIPsFlags = cfg.AllowedIPsFlags
+	updated.ControlURL = cfg.ControlURL
+	updated.DNSServers = cfg.DNSServers
+	updated.DNSSearchDomains = cfg.DNSSearchDomains
+	updated.DNSRoutes = cfg.DNSRoutes
+	updated.AgentMTU = cfg.AgentMTU
+	updated.ResponseRedaction = cfg.ResponseRedaction
+	updated.LeaseTTL = cfg.LeaseTTL
+	updated.LeaseMaxLifetime = cfg.LeaseMaxLifetime
+	updated.LeaseRenewInterval = cfg.LeaseRenewInterval
+	updated.SourceRanges = cfg.SourceRanges
+	updated.Reservations = cfg.Reservations
+	updated.ReservedIPs = cfg.ReservedIPs
+	if !reflect.DeepEqual(&updated, cfg) {
+		logger.Warn.Printf("Server config changes other than to advertised settings, lease timing, source ranges and reservations require a restart")
+	}
+	*lh.serverConfig = updated
+	if lh.configReloaded != nil {
+		close(lh.configReloaded)
+		lh.configReloaded = nil
+	}
+	lh.configMutex.Unlock()
+
+	lh.leaseManager.wgRecordsMutex.Lock()
+	lh.leaseManager.sourceRanges = cfg.SourceRanges
+	lh.leaseManager.reservations = cfg.ReservedIPs
+	lh.leaseManager.allowedIPs = cfg.AllowedIPs
+	lh.leaseManager.wgRecordsMutex.Unlock()
+	for _, lm := range lh.devices {
+		lm.wgRecordsMutex.Lock()
+		lm.sourceRanges = cfg.SourceRanges
+		lm.wgRecordsMutex.Unlock()
+	}
+	// Cached responses carry the previous settings
+	lh.cache.clear()
+	logger.Info.Print("Reloaded config")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffDeviceConfigs(t *testing.T) {
+	running := []agentDeviceConfig{
+		{Name: "wg0", Peers: []agentPeerConfig{{URL: "https://a"}}},
+		{Name: "wg1", Peers: []agentPeerConfig{{URL: "https://a"}, {URL: "https://b"}}},
+		{Name: "wg2", MTU: 1380, Peers: []agentPeerConfig{{URL: "https://a"}}},
+		{Name: "wg3", Peers: []agentPeerConfig{{URL: "https://a"}}},
+		{Name: "wg4", Peers: []agentPeerConfig{{URL: "https://a"}}},
+	}
+	reloaded := []agentDeviceConfig{
+		{Name: "wg0", Peers: []agentPeerConfig{{URL: "https://a"}}},
+		{Name: "wg1", Peers: []agentPeerConfig{{URL: "https://b"}, {URL: "https://c"}}},
+		{Name: "wg2", MTU: 1420, Peers: []agentPeerConfig{{URL: "https://a"}}},
+		// Adding a server enables health checks, which requires
+		// recreating the device
+		{Name: "wg3", Peers: []agentPeerConfig{{URL: "https://a"}, {URL: "https://b"}}},
+		{Name: "wg5", Peers: []agentPeerConfig{{URL: "https://a"}}},
+	}
+	diff := diffDeviceConfigs(running, reloaded)
+	assert.Equal(t, []string{"wg0"}, diff.unchanged)
+	assert.Equal(t, []string{"wg1"}, diff.servers)
+	assert.Equal(t, []string{"wg2", "wg3"}, diff.replaced)
+	assert.Equal(t, []string{"wg5"}, diff.added)
+	assert.Equal(t, []string{"wg4"}, diff.removed)
+}
+
+func TestDeviceManager_SetServers(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{
+		Name:     "wg_test",
+		Peers:    []agentPeerConfig{{URL: "https://a"}, {URL: "https://b"}},
+		Failover: &agentFailoverConfig{Primary: true},
+	}, "")
+	dm.markUnhealthy("https://a")
+	dm.config = &WirestewardPeerConfig{ServerURL: "https://b"}
+
+	// The lease is kept while its server is listed
+	dm.setServers([]agentPeerConfig{{URL: "https://b"}, {URL: "https://c"}})
+	assert.Equal(t, "https://b", dm.nextServer().URL)
+	assert.Empty(t, dm.unhealthyServers)
+	select {
+	case <-dm.renewLeaseChan:
+		t.Fatal("unexpected renewal")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	dm.setServers([]agentPeerConfig{{URL: "https://c"}, {URL: "https://d"}})
+	assert.Equal(t, "https://c", dm.nextServer().URL)
+	select {
+	case <-dm.renewLeaseChan:
+	case <-time.After(time.Second):
+		t.Fatal("expected a renewal after the server was removed")
+	}
+}
+
+func TestHTTPLeaseHandler_Reload(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	_, network, _ := net.ParseCIDR("10.90.0.0/24")
+	running := &serverConfig{
+		AllowedIPs:         []string{"10.0.0.0/8"},
+		DeviceName:         "wg0",
+		WireguardIPNetwork: network,
+		LeaseTTL:           time.Hour,
+	}
+	lm := &FileLeaseManager{}
+	cache := newLeaseCache()
+	cache.put("key", "user", "inputs", leaseResponse{IP: "10.90.0.2/32"})
+	lh := &HTTPLeaseHandler{cache: cache, leaseManager: lm, serverConfig: running}
+
+	reservedIP := net.ParseIP("10.90.0.10")
+	reloaded := &serverConfig{
+		AllowedIPs:         []string{"10.0.0.0/8", "172.16.0.0/12"},
+		DeviceName:         "wg1",
+		WireguardIPNetwork: network,
+		LeaseTTL:           2 * time.Hour,
+		DNSServers:         []string{"10.0.0.53"},
+		ReservedIPs:        map[string]ipReservation{"key": {ip: reservedIP, username: "ci"}},
+	}
+	lh.reload(reloaded)
+
+	cfg := lh.config()
+	assert.Equal(t, []string{"10.0.0.0/8", "172.16.0.0/12"}, cfg.AllowedIPs)
+	assert.Equal(t, 2*time.Hour, cfg.LeaseTTL)
+	assert.Equal(t, []string{"10.0.0.53"}, cfg.DNSServers)
+	// The device name requires a restart
+	assert.Equal(t, "wg0", cfg.DeviceName)
+	assert.Equal(t, reservedIP, lm.reservations["key"].ip)
+	_, ok := cache.get("key", "inputs")
+	assert.False(t, ok)
+}
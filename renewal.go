@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// renewalTime returns when to renew the lease of config, granted at now: at
+// the time the server asked for or, if it did not, halfway to the expiry of
+// the lease. Up to jitter is taken off, so that agents granted leases at the
+// same time do not all renew them at the same time. It returns zero for
+// leases that neither expire nor ask to be renewed.
+func renewalTime(now time.Time, config *WirestewardPeerConfig, jitter time.Duration) time.Time {
+	at := config.RenewAfter
+	if at.IsZero() {
+		if config.Expires.IsZero() {
+			return time.Time{}
+		}
+		at = now.Add(config.Expires.Sub(now) / 2)
+	}
+	if jitter > 0 {
+		at = at.Add(-time.Duration(rand.Int63n(int64(jitter))))
+	}
+	if at.Before(now) {
+		return now
+	}
+	return at
+}
+
+// renewRetryDelay returns how long to wait before retrying a failed lease
+// renewal. Retries back off exponentially from renewRetryInterval, up to the
+// configured maximum, until a renewal succeeds. Up to a quarter of backed off
+// delays is taken off at random, so that agents that lost connectivity at the
+// same time do not all retry at the same time.
+func (dm *DeviceManager) renewRetryDelay() time.Duration {
+	delay := renewRetryInterval
+	for i := 0; i < dm.renewFailures && delay < dm.renewRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > dm.renewRetryMax {
+		delay = dm.renewRetryMax
+	}
+	if delay > renewRetryInterval {
+		delay -= time.Duration(rand.Int63n(int64(delay) / 4))
+	}
+	if delay < renewRetryInterval {
+		delay = renewRetryInterval
+	}
+	dm.renewFailures++
+	return delay
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenewalTime(t *testing.T) {
+	now := time.Now()
+
+	// The time asked by the server is used as is without jitter
+	config := &WirestewardPeerConfig{RenewAfter: now.Add(time.Hour), Expires: now.Add(2 * time.Hour)}
+	assert.Equal(t, now.Add(time.Hour), renewalTime(now, config, 0))
+
+	// and halfway to the expiry otherwise
+	config = &WirestewardPeerConfig{Expires: now.Add(2 * time.Hour)}
+	assert.Equal(t, now.Add(time.Hour), renewalTime(now, config, 0))
+
+	// Jitter brings renewals forward, but not in the past
+	for i := 0; i < 100; i++ {
+		at := renewalTime(now, config, 10*time.Minute)
+		assert.False(t, at.After(now.Add(time.Hour)))
+		assert.True(t, at.After(now.Add(50*time.Minute)))
+	}
+	assert.Equal(t, now, renewalTime(now, &WirestewardPeerConfig{RenewAfter: now.Add(time.Second)}, time.Hour*24))
+
+	// Leases that do not expire are not renewed
+	assert.True(t, renewalTime(now, &WirestewardPeerConfig{}, time.Minute).IsZero())
+}
+
+func TestDeviceManager_RenewRetryDelay(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	err := errors.New("connection refused")
+
+	// Retries are not backed off by default
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, renewRetryInterval, dm.handleRenewError(err))
+	}
+
+	// Backed off retries are jittered by up to a quarter of the delay
+	dm = newDeviceManager(agentDeviceConfig{Name: "wg_test", RenewRetryMaxInterval: duration{5 * time.Second}}, "")
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		delay := dm.handleRenewError(err)
+		assert.True(t, delay <= expected, "%s > %s", delay, expected)
+		assert.True(t, delay >= expected*3/4, "%s < %s", delay, expected*3/4)
+	}
+	// The backoff starts over after a successful renewal
+	dm.renewFailures = 0
+	assert.Equal(t, time.Second, dm.handleRenewError(err))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	resolverTypeDoH    = "doh"
+	resolverTypeStatic = "static"
+	resolverTypeSystem = "system"
+
+	defaultResolverTimeout = 5 * time.Second
+	// dnsTypeA is the DNS record type of IPv4 addresses
+	dnsTypeA = 1
+)
+
+// hostResolver looks up the IPv4 addresses of a host name.
+type hostResolver interface {
+	lookupIPv4(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// systemResolver uses the resolver of the operating system.
+type systemResolver struct{}
+
+func (systemResolver) lookupIPv4(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if ip := a.IP.To4(); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// dohResolver queries a DNS over HTTPS server, using the JSON API supported by
+// most public DoH providers.
+type dohResolver struct {
+	client *http.Client
+	url    string
+}
+
+func (r *dohResolver) lookupIPv4(ctx context.Context, host string) ([]net.IP, error) {
+	u, err := url.Parse(r.url)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("name", host)
+	q.Set("type", "A")
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Response status: %s", resp.Status)
+	}
+	response := &struct {
+		Status int
+		Answer []struct {
+			Type int    `json:"type"`
+			Data string `json:"data"`
+		}
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return nil, err
+	}
+	if response.Status != 0 {
+		return nil, fmt.Errorf("query failed with DNS response code %d", response.Status)
+	}
+	var ips []net.IP
+	for _, a := range response.Answer {
+		if ip := net.ParseIP(a.Data).To4(); a.Type == dnsTypeA && ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// staticResolver resolves hosts from a fixed map, for pinned or air-gapped
+// setups.
+type staticResolver map[string]net.IP
+
+func (r staticResolver) lookupIPv4(ctx context.Context, host string) ([]net.IP, error) {
+	if ip, ok := r[strings.ToLower(host)]; ok {
+		return []net.IP{ip}, nil
+	}
+	return nil, nil
+}
+
+type chainedResolver struct {
+	name     string
+	resolver hostResolver
+	timeout  time.Duration
+}
+
+// resolverChain tries a list of resolvers in order, until one of them returns
+// an address.
+type resolverChain []chainedResolver
+
+// newResolverChain returns a resolverChain from the agent config. The system
+// resolver is used if none are configured.
+func newResolverChain(cfgs []agentResolverConfig) resolverChain {
+	if len(cfgs) == 0 {
+		return resolverChain{{name: resolverTypeSystem, resolver: systemResolver{}, timeout: defaultResolverTimeout}}
+	}
+	chain := resolverChain{}
+	for _, cfg := range cfgs {
+		timeout := cfg.Timeout.Duration
+		if timeout == 0 {
+			timeout = defaultResolverTimeout
+		}
+		var r hostResolver
+		switch cfg.Type {
+		case resolverTypeDoH:
+			r = &dohResolver{client: &http.Client{}, url: cfg.URL}
+		case resolverTypeStatic:
+			hosts := staticResolver{}
+			for host, ip := range cfg.Hosts {
+				hosts[strings.ToLower(host)] = net.ParseIP(ip).To4()
+			}
+			r = hosts
+		default:
+			r = systemResolver{}
+		}
+		chain = append(chain, chainedResolver{name: cfg.Type, resolver: r, timeout: timeout})
+	}
+	return chain
+}
+
+func (c resolverChain) lookupIPv4(host string) (net.IP, error) {
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		return ip, nil
+	}
+	if len(c) == 0 {
+		c = newResolverChain(nil)
+	}
+	for _, r := range c {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		ips, err := r.resolver.lookupIPv4(ctx, host)
+		cancel()
+		if err != nil {
+			logger.Debug.Printf("Cannot resolve %s using the %s resolver: %v", host, r.name, err)
+			continue
+		}
+		if len(ips) > 0 {
+			return ips[0], nil
+		}
+		logger.Debug.Printf("No addresses found for %s using the %s resolver", host, r.name)
+	}
+	return nil, fmt.Errorf("cannot resolve %s", host)
+}
+
+// resolveEndpoint returns endpoint, in the `<host>:<port>` format, with the
+// host replaced by its IPv4 address.
+func (c resolverChain) resolveEndpoint(endpoint string) (string, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", err
+	}
+	ip, err := c.lookupIPv4(host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
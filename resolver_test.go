@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResolver struct {
+	ips   []net.IP
+	err   error
+	calls int
+}
+
+func (r *fakeResolver) lookupIPv4(ctx context.Context, host string) ([]net.IP, error) {
+	r.calls++
+	return r.ips, r.err
+}
+
+func TestResolverChain_FallThrough(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	failing := &fakeResolver{err: fmt.Errorf("timeout")}
+	empty := &fakeResolver{}
+	working := &fakeResolver{ips: []net.IP{net.ParseIP("10.0.0.1").To4()}}
+	unused := &fakeResolver{ips: []net.IP{net.ParseIP("10.0.0.2").To4()}}
+	chain := resolverChain{
+		{name: "failing", resolver: failing, timeout: time.Second},
+		{name: "empty", resolver: empty, timeout: time.Second},
+		{name: "working", resolver: working, timeout: time.Second},
+		{name: "unused", resolver: unused, timeout: time.Second},
+	}
+	endpoint, err := chain.resolveEndpoint("wiresteward.example.com:51820")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:51820", endpoint)
+	assert.Equal(t, []int{1, 1, 1, 0}, []int{failing.calls, empty.calls, working.calls, unused.calls})
+
+	_, err = chain[:2].resolveEndpoint("wiresteward.example.com:51820")
+	assert.Error(t, err)
+
+	// Addresses are not looked up
+	endpoint, err = chain[:1].resolveEndpoint("1.2.3.4:51820")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4:51820", endpoint)
+}
+
+func TestResolverChain_StaticOverride(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "A", r.URL.Query().Get("type"))
+		if r.URL.Query().Get("name") != "public.example.com" {
+			fmt.Fprint(w, `{"Status": 3}`)
+			return
+		}
+		fmt.Fprint(w, `{"Status": 0, "Answer": [{"type": 5, "data": "cname.example.com."}, {"type": 1, "data": "10.0.0.1"}]}`)
+	}))
+	defer doh.Close()
+	chain := newResolverChain([]agentResolverConfig{
+		{Type: resolverTypeStatic, Hosts: map[string]string{"Pinned.example.com": "10.0.0.9"}},
+		{Type: resolverTypeDoH, URL: doh.URL + "/dns-query"},
+	})
+
+	endpoint, err := chain.resolveEndpoint("pinned.example.com:51820")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.9:51820", endpoint)
+	endpoint, err = chain.resolveEndpoint("public.example.com:51820")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:51820", endpoint)
+	_, err = chain.resolveEndpoint("missing.example.com:51820")
+	assert.Error(t, err)
+}
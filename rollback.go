@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultReachabilityProbeTimeout = 5 * time.Second
+	reachabilityProbeInterval       = 500 * time.Millisecond
+	// A renewal that was rolled back is retried after
+	// leaseRollbackRetryInterval, rather than immediately applying the same
+	// unreachable config again.
+	leaseRollbackRetryInterval = time.Minute
+)
+
+// errLeaseRolledBack is returned when a renewed lease left the reachability
+// probe target unreachable and the previous lease was restored.
+var errLeaseRolledBack = errors.New("lease rolled back")
+
+// newReachabilityProbe returns a function that pings target until it replies
+// or timeout passes.
+func newReachabilityProbe(target string, timeout time.Duration) (func() error, error) {
+	pc, err := newPingChecker(target)
+	if err != nil {
+		return nil, err
+	}
+	if timeout == 0 {
+		timeout = defaultReachabilityProbeTimeout
+	}
+	return func() error {
+		deadline := time.Now().Add(timeout)
+		for {
+			err := pc.Check()
+			if err == nil {
+				return nil
+			}
+			if time.Now().Add(reachabilityProbeInterval).After(deadline) {
+				return fmt.Errorf("%s unreachable: %w", pc.TargetIP(), err)
+			}
+			time.Sleep(reachabilityProbeInterval)
+		}
+	}, nil
+}
+
+// checkReachability probes the target after config replaced oldConfig on the
+// device. If the target is unreachable while it was reachable with oldConfig,
+// apply is used to restore oldConfig and errLeaseRolledBack is returned.
+func (dm *DeviceManager) checkReachability(oldConfig, config *WirestewardPeerConfig, apply func(oldConfig, config *WirestewardPeerConfig) error) error {
+	if dm.reachable == nil {
+		return nil
+	}
+	err := dm.reachable()
+	if err == nil {
+		dm.configReachable = true
+		return nil
+	}
+	wasReachable := dm.configReachable
+	dm.configReachable = false
+	if oldConfig == nil || !wasReachable {
+		dm.logger.Error.Printf("Keeping lease for %s on device %s, as there is no working lease to roll back to: %v", config.LocalAddress, dm.Name(), err)
+		return nil
+	}
+	if err := apply(config, oldConfig); err != nil {
+		return fmt.Errorf("Cannot roll back lease of device %s: %w", dm.Name(), err)
+	}
+	dm.configReachable = true
+	dm.events.emit(eventLeaseRolledBack, dm.Name(), "rolled back lease for %s to %s: %v", config.LocalAddress, oldConfig.LocalAddress, err)
+	return fmt.Errorf("%w: %v", errLeaseRolledBack, err)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceManager_CheckReachability(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	dm.events = newEventQueue(defaultEventQueueSize)
+	_, working, _ := net.ParseCIDR("10.90.0.2/32")
+	_, broken, _ := net.ParseCIDR("10.90.0.3/32")
+	oldConfig := &WirestewardPeerConfig{LocalAddress: working}
+	config := &WirestewardPeerConfig{LocalAddress: broken}
+	applied := []*WirestewardPeerConfig{}
+	apply := func(oldConfig, config *WirestewardPeerConfig) error {
+		applied = append(applied, config)
+		dm.config = config
+		return nil
+	}
+	unreachable := errors.New("timeout")
+	reachable := map[*WirestewardPeerConfig]bool{oldConfig: true}
+
+	// The probe is disabled
+	dm.config = config
+	assert.Nil(t, dm.checkReachability(oldConfig, config, apply))
+	assert.Equal(t, 0, len(applied))
+
+	// The previous config was working, the unreachable one is rolled back
+	dm.reachable = func() error {
+		if !reachable[dm.config] {
+			return unreachable
+		}
+		return nil
+	}
+	dm.config = oldConfig
+	assert.Nil(t, dm.checkReachability(nil, oldConfig, apply))
+	dm.config = config
+	err := dm.checkReachability(oldConfig, config, apply)
+	assert.True(t, errors.Is(err, errLeaseRolledBack))
+	assert.Equal(t, []*WirestewardPeerConfig{oldConfig}, applied)
+	assert.Equal(t, oldConfig, dm.config)
+	assert.Equal(t, leaseRollbackRetryInterval, dm.handleRenewError(err))
+	e := <-dm.events.Events()
+	assert.Equal(t, eventLeaseRolledBack, e.Type)
+	assert.Equal(t, "wg_test", e.Device)
+
+	// Without a working config to roll back to, the new one is kept
+	applied = nil
+	dm.configReachable = false
+	dm.config = config
+	assert.Nil(t, dm.checkReachability(oldConfig, config, apply))
+	assert.Equal(t, 0, len(applied))
+	assert.Equal(t, config, dm.config)
+}
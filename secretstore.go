@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of stores secrets, like refresh tokens and private keys, are kept in.
+// Secrets stay in their plain files with secretStoreFile.
+const (
+	secretStoreFile      = "file"
+	secretStoreKeyring   = "keyring"
+	secretStoreEncrypted = "encrypted"
+)
+
+const (
+	defaultEncryptedStoreDirectory   = "/var/lib/wiresteward/secrets"
+	defaultEncryptedStoreKeyFilename = "/etc/wiresteward/secrets.key"
+	encryptedStoreKeySize            = 32
+)
+
+// keyringService is the service secrets of wiresteward are stored under in
+// the OS keyring.
+const keyringService = "wiresteward"
+
+// errSecretNotFound is returned by secretStores that hold no secret for an
+// account.
+var errSecretNotFound = errors.New("secret not found")
+
+// secretStore keeps secrets by account, eg. in the OS keyring.
+type secretStore interface {
+	get(account string) (string, error)
+	set(account, secret string) error
+}
+
+// newSecretStore returns the store of kind, or nil for secretStoreFile.
+func newSecretStore(kind string, cfg *encryptedStoreConfig) (secretStore, error) {
+	switch kind {
+	case "", secretStoreFile:
+		return nil, nil
+	case secretStoreKeyring:
+		return newOSKeyring(), nil
+	case secretStoreEncrypted:
+		directory, keyFilename := defaultEncryptedStoreDirectory, defaultEncryptedStoreKeyFilename
+		if cfg != nil && cfg.Directory != "" {
+			directory = cfg.Directory
+		}
+		if cfg != nil && cfg.KeyFilename != "" {
+			keyFilename = cfg.KeyFilename
+		}
+		return newEncryptedFileStore(directory, keyFilename)
+	}
+	return nil, fmt.Errorf("unknown secret store %q", kind)
+}
+
+// isSecretStore returns whether kind is a kind of secret store.
+func isSecretStore(kind string) bool {
+	switch kind {
+	case "", secretStoreFile, secretStoreKeyring, secretStoreEncrypted:
+		return true
+	}
+	return false
+}
+
+// encryptedFileStore keeps each secret in a file of a directory, encrypted
+// with AES-GCM under a key read from another file. It is the fallback for
+// hosts without an OS keyring, eg. servers, and keeps secrets out of
+// backups and copies of the directory that do not include the key.
+type encryptedFileStore struct {
+	directory string
+	aead      cipher.AEAD
+}
+
+// newEncryptedFileStore returns a store of secrets in directory, encrypted
+// with the key in keyFilename. A new key is generated if the file does not
+// exist.
+func newEncryptedFileStore(directory, keyFilename string) (*encryptedFileStore, error) {
+	key, err := loadOrCreateSecret(keyFilename, encryptedStoreKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load secret store key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	return &encryptedFileStore{directory: directory, aead: aead}, nil
+}
+
+// loadOrCreateSecret loads the base64 encoded secret of at least size bytes
+// found in filename, or generates and stores a new one if the file does not
+// exist.
+func loadOrCreateSecret(filename string, size int) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Info.Printf("No secret found in %s, generating a new one", filename)
+		secret := make([]byte, size)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return nil, err
+		}
+		data = []byte(base64.StdEncoding.EncodeToString(secret))
+		if err := os.WriteFile(filename, data, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode secret in %s: %w", filename, err)
+	}
+	if len(secret) < size {
+		return nil, fmt.Errorf("secret in %s is too short, expected at least %d bytes, got %d", filename, size, len(secret))
+	}
+	return secret, nil
+}
+
+func (es *encryptedFileStore) filename(account string) string {
+	return filepath.Join(es.directory, url.PathEscape(account))
+}
+
+func (es *encryptedFileStore) get(account string) (string, error) {
+	data, err := os.ReadFile(es.filename(account))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", errSecretNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	size := es.aead.NonceSize()
+	if len(data) < size {
+		return "", fmt.Errorf("secret of %s is truncated", account)
+	}
+	// The account is authenticated along with the secret, so that the
+	// files of secrets cannot be swapped
+	secret, err := es.aead.Open(nil, data[:size], data[size:], []byte(account))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt secret of %s: %w", account, err)
+	}
+	return string(secret), nil
+}
+
+func (es *encryptedFileStore) set(account, secret string) error {
+	nonce := make([]byte, es.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := es.aead.Seal(nonce, nonce, []byte(secret), []byte(account))
+	filename := es.filename(account)
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
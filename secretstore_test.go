@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeSecretStore keeps secrets in memory.
+type fakeSecretStore map[string]string
+
+func (fs fakeSecretStore) get(account string) (string, error) {
+	secret, ok := fs[account]
+	if !ok {
+		return "", errSecretNotFound
+	}
+	return secret, nil
+}
+
+func (fs fakeSecretStore) set(account, secret string) error {
+	fs[account] = secret
+	return nil
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dir := t.TempDir()
+	keyFilename := filepath.Join(dir, "keys", "secrets.key")
+	secretsDir := filepath.Join(dir, "secrets")
+	es, err := newEncryptedFileStore(secretsDir, keyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(keyFilename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	_, err = es.get("device/wg0")
+	assert.True(t, errors.Is(err, errSecretNotFound))
+	assert.NoError(t, es.set("device/wg0", "private"))
+	assert.NoError(t, es.set("client", "refresh"))
+	secret, err := es.get("device/wg0")
+	assert.NoError(t, err)
+	assert.Equal(t, "private", secret)
+
+	// Secrets are not stored in plain text
+	d, err := os.ReadFile(es.filename("device/wg0"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(d), "private")
+
+	// and cannot be read under another account
+	assert.NoError(t, os.Rename(es.filename("device/wg0"), es.filename("client")))
+	_, err = es.get("client")
+	assert.Error(t, err)
+
+	// The key is reused, and secrets cannot be read with another one
+	assert.NoError(t, es.set("device/wg0", "private"))
+	es, err = newEncryptedFileStore(secretsDir, keyFilename)
+	assert.NoError(t, err)
+	secret, err = es.get("device/wg0")
+	assert.NoError(t, err)
+	assert.Equal(t, "private", secret)
+	other, err := newEncryptedFileStore(secretsDir, filepath.Join(dir, "other.key"))
+	assert.NoError(t, err)
+	_, err = other.get("device/wg0")
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(keyFilename, []byte("c2hvcnQ="), 0600))
+	_, err = newEncryptedFileStore(secretsDir, keyFilename)
+	assert.Error(t, err)
+	// Keys longer than the AES-256 key size are rejected rather than cut
+	assert.NoError(t, os.WriteFile(keyFilename, []byte(base64.StdEncoding.EncodeToString(make([]byte, 48))), 0600))
+	_, err = newEncryptedFileStore(secretsDir, keyFilename)
+	assert.Error(t, err)
+}
+
+func TestSecretStoreConfig(t *testing.T) {
+	for _, tc := range []struct {
+		keyStore, tokenStore string
+		err                  bool
+	}{
+		{"", "", false},
+		{secretStoreKeyring, secretStoreEncrypted, false},
+		{secretStoreEncrypted, secretStoreFile, false},
+		{secretStoreFile, "", true},
+		{"", "vault", true},
+	} {
+		conf := &agentConfig{KeyStore: tc.keyStore}
+		conf.OAuth = agentOAuthConfig{ClientID: "client", AuthURL: "https://login.example.com/authorize", TokenURL: "https://login.example.com/token", TokenStore: tc.tokenStore}
+		err := verifyAgentOAuthConfig(conf)
+		if tc.err {
+			assert.Error(t, err, tc)
+		} else {
+			assert.NoError(t, err, tc)
+		}
+	}
+	_, err := newSecretStore("vault", nil)
+	assert.Error(t, err)
+	store, err := newSecretStore(secretStoreFile, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, store)
+}
+
+func TestDeviceManager_RestoreKey(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	var configured []wgtypes.Key
+	dm.configureDevice = func(deviceName string, cfg wgtypes.Config) error {
+		configured = append(configured, *cfg.PrivateKey)
+		return nil
+	}
+	store := fakeSecretStore{}
+	dm.keyStore = store
+
+	// A device without a key gets a new one, which is stored
+	assert.NoError(t, dm.restoreKey(emptyKey))
+	assert.Equal(t, 1, len(configured))
+	assert.Equal(t, configured[0].String(), store["device/wg_test"])
+
+	// and recreated devices get the stored key back
+	assert.NoError(t, dm.restoreKey(emptyKey))
+	assert.Equal(t, 2, len(configured))
+	assert.Equal(t, configured[0], configured[1])
+	assert.NoError(t, dm.restoreKey(configured[0].String()))
+	assert.Equal(t, 2, len(configured))
+
+	// Rotated keys replace the stored one
+	key := newWgKey()
+	assert.NoError(t, dm.applyKey(key))
+	assert.Equal(t, key.String(), store["device/wg_test"])
+
+	// Keys of devices that are kept are stored as they are
+	delete(store, "device/wg_test")
+	assert.NoError(t, dm.restoreKey(key.String()))
+	assert.Equal(t, key.String(), store["device/wg_test"])
+	assert.Equal(t, 3, len(configured))
+}
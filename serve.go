@@ -1,39 +1,183 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/utilitywarehouse/wiresteward/client"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
 	bearerSchema = "Bearer "
+	// Bounds for the extra fields of lease requests
+	maxLeaseRequestExtraEntries  = 16
+	maxLeaseRequestExtraKeyLen   = 64
+	maxLeaseRequestExtraValueLen = 256
 )
 
 // leaseRequest defines the payload of a lease HTTP request submitted by an
 // agent.
-type leaseRequest struct {
-	PubKey string
+type leaseRequest = client.LeaseRequest
+
+// verifyLeaseRequestExtra checks that extra is within the allowed bounds.
+func verifyLeaseRequestExtra(extra map[string]string) error {
+	if len(extra) > maxLeaseRequestExtraEntries {
+		return fmt.Errorf("too many extra fields, up to %d are allowed", maxLeaseRequestExtraEntries)
+	}
+	for k, v := range extra {
+		if k == "" || len(k) > maxLeaseRequestExtraKeyLen {
+			return fmt.Errorf("extra field keys must be between 1 and %d characters long", maxLeaseRequestExtraKeyLen)
+		}
+		if len(v) > maxLeaseRequestExtraValueLen {
+			return fmt.Errorf("extra field %s value is longer than %d characters", k, maxLeaseRequestExtraValueLen)
+		}
+	}
+	return nil
 }
 
+// leasePolicyHook is called for every lease request, after the token has been
+// validated and before an address is allocated. Returning an error rejects
+// the request. Custom deployments can register hooks to drive allocation
+// decisions on the extra fields of requests. Dry runs are evaluated like any
+// other request, but hooks must not record them.
+type leasePolicyHook func(username string, req *leaseRequest, dryRun bool) error
+
 // leaseResponse define the payload of a lease HTTP response returned by a
 // server.
-type leaseResponse struct {
-	Status            string
-	IP                string
-	ServerWireguardIP string
-	AllowedIPs        []string
-	PubKey            string
-	Endpoint          string
+type leaseResponse = client.LeaseResponse
+
+// leaseTiming returns the expiry and renewal time of a lease granted at now
+// to the owner of the token described by tokenInfo. Leases never outlive the
+// token, and are further limited by the configured TTL and the maximum
+// lifetime since the token was issued. When the network is under pressure,
+// the adaptive TTL applies if it is shorter.
+func (c *serverConfig) leaseTiming(now time.Time, tokenInfo *introspectionResponse, underPressure bool) (expires, renewAfter time.Time) {
+	ttl, renewInterval := c.LeaseTTL, c.LeaseRenewInterval
+	if underPressure && c.AdaptiveLeases != nil && (ttl == 0 || c.AdaptiveLeases.LeaseTTL.Duration < ttl) {
+		ttl = c.AdaptiveLeases.LeaseTTL.Duration
+		if renewInterval >= ttl {
+			renewInterval = 0
+		}
+	}
+	expires = time.Unix(tokenInfo.Exp, 0)
+	if ttl > 0 && now.Add(ttl).Before(expires) {
+		expires = now.Add(ttl)
+	}
+	if c.LeaseMaxLifetime > 0 && tokenInfo.Iat > 0 {
+		if max := time.Unix(tokenInfo.Iat, 0).Add(c.LeaseMaxLifetime); max.Before(expires) {
+			expires = max
+		}
+	}
+	if renewInterval == 0 {
+		renewInterval = ttl / 2
+	}
+	if renewInterval > 0 {
+		renewAfter = now.Add(renewInterval)
+		if renewAfter.After(expires) {
+			renewAfter = expires
+		}
+	}
+	return expires, renewAfter
+}
+
+// advertisedVersion returns a version of the settings advertised to agents
+// in lease responses, which changes whenever any of them does.
+func (c *serverConfig) advertisedVersion() string {
+	b, _ := json.Marshal(struct {
+		AllowedIPs        []string
+		AllowedIPsFlags   map[string]string
+		ServerWireguardIP string
+		Endpoint          string
+		ControlURL        string
+		DNSServers        []string
+		DNSSearchDomains  []string
+		MTU               int
+		Pools             []*serverPoolConfig         `json:",omitempty"`
+		DNSRoutes         []*serverDNSRouteConfig     `json:",omitempty"`
+		GroupNetworks     []*serverGroupNetworkConfig `json:",omitempty"`
+	}{
+		c.AllowedIPs,
+		c.AllowedIPsFlags,
+		c.WireguardIPAddress.String(),
+		c.Endpoint,
+		c.ControlURL,
+		c.DNSServers,
+		c.DNSSearchDomains,
+		c.AgentMTU,
+		c.Pools,
+		c.DNSRoutes,
+		c.GroupNetworks,
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// dnsRoutes returns the DNS routes for a token granted scope: the ones
+// without scopes and the ones with any of its scopes.
+func (c *serverConfig) dnsRoutes(scope string) []client.DNSRoute {
+	scopes := strings.Fields(scope)
+	var routes []client.DNSRoute
+	for _, r := range c.DNSRoutes {
+		if len(r.Scopes) > 0 && !hasAnyScope(scopes, r.Scopes) {
+			continue
+		}
+		routes = append(routes, client.DNSRoute{Domains: r.Domains, Servers: r.Servers})
+	}
+	return routes
 }
 
 // HTTPLeaseHandler implements the HTTP server that manages peer address leases.
 type HTTPLeaseHandler struct {
+	cache          *leaseCache
 	leaseManager   *FileLeaseManager
+	policyHooks    []leasePolicyHook
 	serverConfig   *serverConfig
-	tokenValidator *tokenValidator
+	signer         *leaseSigner
+	tokenValidator accessTokenValidator
+	// identityProviders validate tokens instead of tokenValidator, if set
+	identityProviders identityProviders
+	// configMutex guards serverConfig, as parts of it can be reloaded
+	configMutex sync.RWMutex
+	// clientCAs authenticate agents that present a client certificate
+	// issued by them, if set
+	clientCAs *x509.CertPool
+	// audit records lease requests, if set
+	audit *auditLog
+	// configReloaded is closed when the config is reloaded, to notify
+	// streams watching the advertised settings
+	configReloaded chan struct{}
+	// devices are the lease managers of the additional devices of the
+	// server, by name
+	devices map[string]*FileLeaseManager
+	// sourceIPLimiter and tokenLimiter limit the rate of lease requests
+	// from each address and with each token, if set
+	sourceIPLimiter *rateLimiter
+	tokenLimiter    *rateLimiter
+}
+
+// holdsLease returns whether the lease of username on any device of the
+// server is held by pubKey.
+func (lh *HTTPLeaseHandler) holdsLease(username, pubKey string) bool {
+	if lh.leaseManager != nil && lh.leaseManager.holdsLease(username, pubKey) {
+		return true
+	}
+	for _, lm := range lh.devices {
+		if lm.holdsLease(username, pubKey) {
+			return true
+		}
+	}
+	return false
 }
 
 func extractBearerTokenFromHeader(req *http.Request, header string) (string, error) {
@@ -47,80 +191,417 @@ func extractBearerTokenFromHeader(req *http.Request, header string) (string, err
 	return authHeader[len(bearerSchema):], nil
 }
 
+// leaseError is the reason a lease request failed, along with the HTTP status
+// to respond with.
+type leaseError struct {
+	status  int
+	message string
+	// retryAfter is how long rate limited clients should wait before
+	// retrying
+	retryAfter time.Duration
+}
+
+func (e *leaseError) Error() string {
+	return e.message
+}
+
+// authenticateToken validates the bearer token of r and returns the
+// introspection response, or why the token is not accepted.
+func (lh *HTTPLeaseHandler) authenticateToken(r *http.Request) (*introspectionResponse, *leaseError) {
+	token, err := extractBearerTokenFromHeader(r, "Authorization")
+	if err != nil {
+		logger.Error.Println(
+			"Cannot parse authorization token", err)
+		authFailuresTotal.WithLabelValues("malformed_token").Inc()
+		return nil, &leaseError{status: http.StatusInternalServerError, message: fmt.Sprintf("error parsing auth token: %v", err)}
+	}
+	tv := lh.tokenValidator
+	if lh.identityProviders != nil {
+		tv = lh.identityProviders.forListener(leaseListener(r))
+	}
+	tokenInfo, err := tv.validate(token, "access_token")
+	if err != nil {
+		logger.Error.Println("Cannot check token validity", err)
+		authFailuresTotal.WithLabelValues("introspection_error").Inc()
+		return nil, &leaseError{status: http.StatusInternalServerError, message: fmt.Sprintf("error checking token validity: %v", err)}
+	}
+	if !tokenInfo.Active {
+		authFailuresTotal.WithLabelValues("inactive_token").Inc()
+		return nil, &leaseError{status: http.StatusForbidden, message: "invalid token"}
+	}
+	if tokenInfo.Exp <= 0 {
+		authFailuresTotal.WithLabelValues("non_expiring_token").Inc()
+		return nil, &leaseError{status: http.StatusBadRequest, message: "token does not expire, cannot accept this"}
+	}
+	return tokenInfo, nil
+}
+
+// authenticate returns the identity of the sender of r and how it was
+// authenticated: agents presenting a certificate issued by the client CAs do
+// not need a token, tokens take precedence if both are presented.
+func (lh *HTTPLeaseHandler) authenticate(r *http.Request) (*introspectionResponse, string, *leaseError) {
+	if tokenInfo := machineIdentity(r.TLS, lh.clientCAs); tokenInfo != nil && r.Header.Get("Authorization") == "" {
+		return tokenInfo, "certificate", nil
+	}
+	tokenInfo, lerr := lh.authenticateToken(r)
+	if lerr != nil {
+		lh.audit.record(auditRecord{Type: leaseEventRejected, Auth: "token", Reason: "token not accepted"}.fromRequest(r))
+		return nil, "token", lerr
+	}
+	return tokenInfo, "token", nil
+}
+
 func (lh *HTTPLeaseHandler) newPeerLease(w http.ResponseWriter, r *http.Request) {
+	lh.serveLease(w, r, false)
+}
+
+// dryRunLease responds with the lease that would be granted, without granting
+// it, for agents checking their config.
+func (lh *HTTPLeaseHandler) dryRunLease(w http.ResponseWriter, r *http.Request) {
+	lh.serveLease(w, r, true)
+}
+
+func (lh *HTTPLeaseHandler) serveLease(w http.ResponseWriter, r *http.Request, dryRun bool) {
 	switch r.Method {
 	case "POST":
-		token, err := extractBearerTokenFromHeader(r, "Authorization")
-		if err != nil {
-			logger.Error.Println(
-				"Cannot parse authorization token", err)
-			http.Error(
-				w,
-				fmt.Sprintf("error parsing auth token: %v", err),
-				http.StatusInternalServerError,
-			)
+		response, lerr := lh.lease(r, func(p *leaseRequest) error {
+			return json.NewDecoder(r.Body).Decode(p)
+		}, dryRun)
+		if lerr != nil {
+			setRetryAfter(w.Header(), lerr.retryAfter)
+			http.Error(w, lerr.message, lerr.status)
 			return
 		}
-		tokenInfo, err := lh.tokenValidator.validate(token, "access_token")
+		r, err := json.Marshal(&response)
 		if err != nil {
-			logger.Error.Println("Cannot check token validity", err)
-			http.Error(
-				w,
-				fmt.Sprintf("error checking token validity: %v", err),
-				http.StatusInternalServerError,
-			)
+			http.Error(w, "cannot encode response", http.StatusInternalServerError)
 			return
 		}
-		if !tokenInfo.Active {
-			http.Error(w, "invalid token", http.StatusForbidden)
-			return
+		if lh.signer != nil {
+			lh.signer.sign(w.Header(), r)
 		}
-		if tokenInfo.Exp <= 0 {
-			http.Error(w, "token does not expire, cannot accept this", http.StatusBadRequest)
-			return
+		w.Write(r)
+
+	default:
+		fmt.Fprintf(w, "only POST method is supported.")
+	}
+}
+
+// lease grants or renews the lease requested by the sender of r, whether it
+// was sent to the JSON or the gRPC API, and returns the response to send.
+// decode reads the request once the sender is authenticated. With dryRun, the
+// response is the lease that would be granted and nothing is changed.
+func (lh *HTTPLeaseHandler) lease(r *http.Request, decode func(*leaseRequest) error, dryRun bool) (leaseResponse, *leaseError) {
+	if lerr := lh.checkRateLimits(r); lerr != nil {
+		return leaseResponse{}, lerr
+	}
+	tokenInfo, auth, lerr := lh.authenticate(r)
+	if lerr != nil {
+		return leaseResponse{}, lerr
+	}
+	// Machine certificates are bound to the agent rather than the key, also
+	// when a token is presented along with them
+	machineCert := auth == "certificate" || machineIdentity(r.TLS, lh.clientCAs) != nil
+	var p leaseRequest
+	reject := func(reason string) {
+		lh.audit.record(auditRecord{
+			Type:              leaseEventRejected,
+			Username:          tokenInfo.UserName,
+			Auth:              auth,
+			ClientID:          p.ClientID,
+			PublicKey:         p.PubKey,
+			PreviousPublicKey: p.PreviousPubKey,
+			Reason:            reason,
+		}.fromRequest(r))
+	}
+	if err := decode(&p); err != nil {
+		logger.Error.Println("Cannot decode request body", err)
+		reject("cannot decode request body")
+		return leaseResponse{}, &leaseError{status: http.StatusInternalServerError, message: "Cannot decode request body"}
+	}
+	if p.ClientID != "" && !validClientID(p.ClientID) {
+		reject("invalid client id")
+		return leaseResponse{}, &leaseError{status: http.StatusBadRequest, message: "invalid client id"}
+	}
+	if err := verifyLeaseRequestExtra(p.Extra); err != nil {
+		reject(err.Error())
+		return leaseResponse{}, &leaseError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	if lh.leaseManager != nil && lh.leaseManager.presharedKeySecret != nil && p.Version < presharedKeyMinVersion {
+		reject("agent does not support preshared keys")
+		return leaseResponse{}, &leaseError{status: http.StatusBadRequest, message: "the server requires preshared keys, please upgrade the agent"}
+	}
+	// Only the key of a lease the user holds counts as rotated, so that
+	// hooks cannot be bypassed by naming any key as the previous one
+	if p.PreviousPubKey != "" && !lh.holdsLease(tokenInfo.UserName, p.PreviousPubKey) {
+		p.PreviousPubKey = ""
+	}
+	for _, hook := range lh.policyHooks {
+		if err := hook(tokenInfo.UserName, &p, dryRun); err != nil {
+			logger.Info.Printf(
+				"Lease request from user %s rejected by policy: %v",
+				tokenInfo.UserName,
+				err,
+			)
+			reject(err.Error())
+			return leaseResponse{}, &leaseError{status: http.StatusForbidden, message: fmt.Sprintf("lease request rejected: %v", err)}
 		}
-		decoder := json.NewDecoder(r.Body)
-		var p leaseRequest
-		if err := decoder.Decode(&p); err != nil {
-			logger.Error.Println("Cannot decode request body", err)
-			http.Error(w, "Cannot decode request body", http.StatusInternalServerError)
-			return
+	}
+	cfg := lh.config()
+	// Leases on additional devices advertise the settings of the main
+	// device, which are the only ones that can be reloaded
+	version := cfg.advertisedVersion()
+	lm := lh.leaseManager
+	device, err := cfg.selectDevice(p.Device, tokenInfo.Scope, tokenInfo.Groups)
+	if err != nil {
+		logger.Info.Printf(
+			"Lease request from user %s rejected: %v",
+			tokenInfo.UserName,
+			err,
+		)
+		reject(err.Error())
+		return leaseResponse{}, &leaseError{status: http.StatusForbidden, message: err.Error()}
+	}
+	// The device of the request is the one the address is leased on
+	p.Device = ""
+	if device != nil {
+		if lm = lh.devices[device.Name]; lm == nil {
+			return leaseResponse{}, &leaseError{status: http.StatusServiceUnavailable, message: fmt.Sprintf("device %s is not running", device.Name)}
 		}
-		wg, err := lh.leaseManager.addNewPeer(tokenInfo.UserName, p.PubKey, time.Unix(tokenInfo.Exp, 0))
+		p.Device = device.Name
+		cfg = *cfg.deviceConfig(device)
+	}
+	pool, err := cfg.selectPool(p.Pool, tokenInfo.Scope)
+	if err != nil {
+		logger.Info.Printf(
+			"Lease request from user %s rejected: %v",
+			tokenInfo.UserName,
+			err,
+		)
+		reject(err.Error())
+		return leaseResponse{}, &leaseError{status: http.StatusForbidden, message: err.Error()}
+	}
+	// The pool of the request is the one addresses are leased from
+	p.Pool = ""
+	serverIP, allowedIPs := cfg.WireguardIPAddress, cfg.AllowedIPs
+	if pool != nil {
+		p.Pool = pool.Name
+		serverIP, allowedIPs = pool.ip, pool.AllowedIPs
+		cfg = *cfg.poolConfig(pool)
+	}
+	// The groups of the user grant access to more networks
+	groups := leaseGroups(cfg.GroupNetworks, tokenInfo.Groups)
+	allowedIPs = groupAllowedIPs(cfg.GroupNetworks, allowedIPs, groups)
+	// Agents rotating their key present a certificate for the key the
+	// current lease was granted to
+	certKey := p.PubKey
+	if p.PreviousPubKey != "" && lm.holdsLease(tokenInfo.UserName, p.PreviousPubKey) {
+		certKey = p.PreviousPubKey
+	}
+	if err := matchClientCertificateCN(r.TLS, certKey); err != nil && !machineCert {
+		logger.Info.Printf(
+			"Lease request from user %s rejected: %v",
+			tokenInfo.UserName,
+			err,
+		)
+		reject(err.Error())
+		return leaseResponse{}, &leaseError{status: http.StatusForbidden, message: err.Error()}
+	}
+	if err := cfg.SourceRanges.verifyRequest(tokenInfo.UserName, r); err != nil {
+		logger.Info.Printf(
+			"Lease request from user %s rejected: %v",
+			tokenInfo.UserName,
+			err,
+		)
+		reject(err.Error())
+		return leaseResponse{}, &leaseError{status: http.StatusForbidden, message: err.Error()}
+	}
+	if err := lm.checkReservation(tokenInfo.UserName, p.PubKey); err != nil {
+		logger.Info.Printf(
+			"Lease request from user %s rejected: key %s is reserved for another user",
+			tokenInfo.UserName,
+			p.PubKey,
+		)
+		reject(err.Error())
+		return leaseResponse{}, &leaseError{status: http.StatusForbidden, message: err.Error()}
+	}
+	if p.Renew && !lm.holdsLease(tokenInfo.UserName, p.PubKey) {
+		logger.Info.Printf(
+			"Renewal request from user %s rejected: no lease held by %s",
+			tokenInfo.UserName,
+			p.PubKey,
+		)
+		reject("no lease to renew")
+		return leaseResponse{}, &leaseError{status: http.StatusNotFound, message: "no lease held by this public key, request a new one"}
+	}
+	logger.Info.Printf(
+		"Lease request from user %s (client id: %s)",
+		tokenInfo.UserName,
+		p.ClientID,
+	)
+	expires, renewAfter := cfg.leaseTiming(time.Now(), tokenInfo, lm.underPressure())
+	if !expires.After(time.Now()) {
+		reject("maximum lease lifetime exceeded")
+		return leaseResponse{}, &leaseError{status: http.StatusForbidden, message: "maximum lease lifetime exceeded, please login again"}
+	}
+	// Dry runs report the lease that would be granted, leaving the leases
+	// and the device untouched
+	if dryRun {
+		ip, err := lm.previewLease(tokenInfo.UserName, &p)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return leaseResponse{}, &leaseError{status: http.StatusInternalServerError, message: err.Error()}
 		}
-		pubKey, _, err := getKeys("")
-		if err != nil {
-			http.Error(w, "cannot get public key", http.StatusInternalServerError)
-			return
+		response, lerr := lh.newLeaseResponse(&cfg, lm, WgRecord{IP: ip, expires: expires}, p.PubKey, serverIP, allowedIPs, renewAfter)
+		if lerr != nil {
+			return leaseResponse{}, lerr
 		}
-		response := &leaseResponse{
-			Status:            "success",
-			IP:                fmt.Sprintf("%s/32", wg.IP.String()),
-			ServerWireguardIP: lh.serverConfig.WireguardIPAddress.String(),
-			AllowedIPs:        lh.serverConfig.AllowedIPs,
-			PubKey:            pubKey,
-			Endpoint:          lh.serverConfig.Endpoint,
+		response.ConfigVersion = version
+		response.DNSRoutes = cfg.dnsRoutes(tokenInfo.Scope)
+		redactLeaseResponse(&response, cfg.ResponseRedaction, tokenInfo.Scope, p.Version)
+		return response, nil
+	}
+	// Renewals of an unchanged lease are served from the cache, only
+	// extending the expiry
+	inputs := leaseCacheInputs(tokenInfo.UserName, &p, groups...)
+	response, ok := lh.cache.get(p.PubKey, inputs)
+	event := leaseEventRenewed
+	if ok && lm.extendLease(tokenInfo.UserName, p.PubKey, expires) {
+		response.Expires = expires
+		response.RenewAfter = renewAfter
+	} else {
+		lh.cache.invalidate(p.PubKey)
+		if p.PreviousPubKey != "" {
+			lh.cache.invalidate(p.PreviousPubKey)
+		}
+		if !lm.holdsLease(tokenInfo.UserName, p.PubKey) {
+			event = leaseEventGranted
 		}
-		r, err := json.Marshal(response)
+		wg, err := lm.addNewPeer(tokenInfo.UserName, &p, expires, groups...)
 		if err != nil {
-			http.Error(w, "cannot encode response", http.StatusInternalServerError)
-			return
+			reject(err.Error())
+			return leaseResponse{}, &leaseError{status: http.StatusInternalServerError, message: err.Error()}
 		}
-		fmt.Fprintf(w, string(r))
+		if response, lerr = lh.newLeaseResponse(&cfg, lm, wg, p.PubKey, serverIP, allowedIPs, renewAfter); lerr != nil {
+			return leaseResponse{}, lerr
+		}
+		response.ConfigVersion = version
+		lh.cache.put(p.PubKey, tokenInfo.UserName, inputs, response)
+	}
+	// Routes depend on the scopes of the token, which are not part of the
+	// cache inputs
+	response.DNSRoutes = cfg.dnsRoutes(tokenInfo.Scope)
+	granted := response.Expires.UTC()
+	lh.audit.record(auditRecord{
+		Type:              event,
+		Username:          tokenInfo.UserName,
+		Auth:              auth,
+		ClientID:          p.ClientID,
+		PublicKey:         p.PubKey,
+		PreviousPublicKey: p.PreviousPubKey,
+		IP:                strings.TrimSuffix(response.IP, "/32"),
+		DelegatedPrefix:   response.DelegatedPrefix,
+		Expires:           &granted,
+	}.fromRequest(r))
+	redactLeaseResponse(&response, cfg.ResponseRedaction, tokenInfo.Scope, p.Version)
+	return response, nil
+}
 
-	default:
-		fmt.Fprintf(w, "only POST method is supported.")
+// newLeaseResponse returns the response granting the lease wg to pubKey, with
+// the address of the server and the allowed IPs of its pool.
+func (lh *HTTPLeaseHandler) newLeaseResponse(cfg *serverConfig, lm *FileLeaseManager, wg WgRecord, pubKey string, serverIP net.IP, allowedIPs []string, renewAfter time.Time) (leaseResponse, *leaseError) {
+	serverPubKey, _, err := getKeys(cfg.DeviceName)
+	if err != nil {
+		return leaseResponse{}, &leaseError{status: http.StatusInternalServerError, message: "cannot get public key"}
+	}
+	response := leaseResponse{
+		Status:            "success",
+		IP:                fmt.Sprintf("%s/32", wg.IP.String()),
+		ServerWireguardIP: serverIP.String(),
+		AllowedIPs:        allowedIPs,
+		AllowedIPsFlags:   cfg.AllowedIPsFlags,
+		PubKey:            serverPubKey,
+		Endpoint:          cfg.Endpoint,
+		Expires:           wg.expires,
+		RenewAfter:        renewAfter,
+		ControlURL:        cfg.ControlURL,
+		DNSServers:        cfg.DNSServers,
+		DNSSearchDomains:  cfg.DNSSearchDomains,
+		MTU:               cfg.AgentMTU,
+		ConfigVersion:     cfg.advertisedVersion(),
+		PresharedKey:      lm.presharedKey(pubKey),
+	}
+	if ip6 := lm.leaseIP6(wg); ip6 != nil {
+		response.IP6 = fmt.Sprintf("%s/128", ip6)
 	}
+	if wg.DelegatedPrefix != nil {
+		response.DelegatedPrefix = wg.DelegatedPrefix.String()
+	}
+	return response, nil
 }
 
-func (lh *HTTPLeaseHandler) start() {
-	http.HandleFunc("/newPeerLease", lh.newPeerLease)
+// configVersion returns the version of the advertised settings, agents poll
+// it to find out when to renew their lease to pick up changes.
+func (lh *HTTPLeaseHandler) configVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET method is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := lh.config()
+	json.NewEncoder(w).Encode(&client.ConfigResponse{Version: cfg.advertisedVersion()})
+}
+
+// listen returns the listener for lease requests: the socket passed by
+// systemd socket activation, if any, or a new one on the listen address.
+func (lh *HTTPLeaseHandler) listen() (net.Listener, error) {
+	listeners, err := sdListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		logger.Info.Printf("Listening for lease requests on the socket passed by systemd")
+		for _, l := range listeners[1:] {
+			logger.Warn.Printf("Ignoring extra socket %s passed by systemd", l.Addr())
+			l.Close()
+		}
+		return listeners[0], nil
+	}
+	return net.Listen("tcp", lh.serverConfig.ServerListenAddress)
+}
+
+func (lh *HTTPLeaseHandler) start(listener net.Listener) {
+	http.HandleFunc(client.LeasePath, instrumentHandler("lease", lh.newPeerLease))
+	http.HandleFunc(client.LegacyLeasePath, instrumentHandler("newPeerLease", lh.newPeerLease))
+	http.HandleFunc(client.DryRunPath, instrumentHandler("dryRun", lh.dryRunLease))
+	http.HandleFunc(client.ConfigPath, instrumentHandler("config", lh.configVersion))
+	if lh.serverConfig.EnableGRPC {
+		http.HandleFunc(grpcServicePath, instrumentHandler("grpc", lh.grpcHandler()))
+	}
 
 	logger.Info.Printf("Starting server for lease requests\n")
-	if err := http.ListenAndServe(lh.serverConfig.ServerListenAddress, nil); err != nil {
+	if lh.serverConfig.TLSCertFile != "" {
+		certs, err := newCertificateReloader(lh.serverConfig.TLSCertFile, lh.serverConfig.TLSKeyFile)
+		if err != nil {
+			logger.Error.Fatalf("Cannot load server certificate: %v", err)
+		}
+		// Agent certificates are self-signed, they are matched with the
+		// lease request instead of being verified against a CA
+		server := &http.Server{
+			TLSConfig: &tls.Config{
+				ClientAuth:     tls.RequestClientCert,
+				GetCertificate: certs.GetCertificate,
+			},
+		}
+		if err := server.ServeTLS(listener, "", ""); err != nil {
+			logger.Error.Fatal(err)
+		}
+		return
+	}
+	// gRPC requires HTTP/2, which is spoken without TLS as h2c
+	var handler http.Handler
+	if lh.serverConfig.EnableGRPC {
+		handler = h2c.NewHandler(http.DefaultServeMux, &http2.Server{})
+	}
+	if err := http.Serve(listener, handler); err != nil {
 		logger.Error.Fatal(err)
 	}
 }
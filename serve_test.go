@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/wiresteward/client"
+)
+
+// newTestIntrospectionServer returns a server that reports every token as
+// active and belonging to username.
+func newTestIntrospectionServer(username string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&introspectionResponse{
+			Active:   true,
+			Exp:      time.Now().Add(time.Hour).Unix(),
+			UserName: username,
+		})
+	}))
+}
+
+func TestHTTPLeaseHandler_PolicyHookExtra(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	introspection := newTestIntrospectionServer("test@example.com")
+	defer introspection.Close()
+
+	var gotUsername string
+	var gotExtra map[string]string
+	lh := &HTTPLeaseHandler{
+		tokenValidator: newTokenValidator("client_id", introspection.URL),
+		policyHooks: []leasePolicyHook{
+			func(username string, req *leaseRequest, dryRun bool) error {
+				gotUsername = username
+				gotExtra = req.Extra
+				return fmt.Errorf("site %s is not allowed", req.Extra["site"])
+			},
+		},
+	}
+	extra := map[string]string{"site": "london", "team": "infra"}
+	body, _ := json.Marshal(&leaseRequest{PubKey: validPublicKey, Extra: extra})
+	req := httptest.NewRequest("POST", "/newPeerLease", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	lh.newPeerLease(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "site london is not allowed")
+	assert.Equal(t, "test@example.com", gotUsername)
+	assert.Equal(t, extra, gotExtra)
+}
+
+func TestHTTPLeaseHandler_DryRunPolicyHook(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	introspection := newTestIntrospectionServer("test@example.com")
+	defer introspection.Close()
+
+	var gotDryRun bool
+	lh := &HTTPLeaseHandler{
+		tokenValidator: newTokenValidator("client_id", introspection.URL),
+		policyHooks: []leasePolicyHook{
+			func(username string, req *leaseRequest, dryRun bool) error {
+				gotDryRun = dryRun
+				return fmt.Errorf("site %s is not allowed", req.Extra["site"])
+			},
+		},
+	}
+	// Dry runs report the rejections of the policy
+	body, _ := json.Marshal(&leaseRequest{PubKey: validPublicKey, Extra: map[string]string{"site": "paris"}})
+	req := httptest.NewRequest("POST", client.DryRunPath, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	lh.dryRunLease(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "site paris is not allowed")
+	assert.True(t, gotDryRun)
+}
+
+func TestHTTPLeaseHandler_PreviousPubKeyNotHeld(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	introspection := newTestIntrospectionServer("test@example.com")
+	defer introspection.Close()
+
+	held, other, requested := newWgKey().PublicKey().String(), newWgKey().PublicKey().String(), newWgKey().PublicKey().String()
+	pl := newPublicKeyLimiter(1, time.Hour)
+	var reached bool
+	lh := &HTTPLeaseHandler{
+		tokenValidator: newTokenValidator("client_id", introspection.URL),
+		leaseManager: &FileLeaseManager{wgRecords: map[string]WgRecord{
+			"test@example.com": {PubKey: held},
+		}},
+		policyHooks: []leasePolicyHook{
+			pl.hook,
+			func(username string, req *leaseRequest, dryRun bool) error {
+				reached = true
+				return fmt.Errorf("stop")
+			},
+		},
+	}
+	request := func(previous string) *httptest.ResponseRecorder {
+		reached = false
+		body, _ := json.Marshal(&leaseRequest{PubKey: requested, PreviousPubKey: previous})
+		req := httptest.NewRequest("POST", client.DryRunPath, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		lh.dryRunLease(w, req)
+		return w
+	}
+	// The user used up their public keys on another key
+	assert.NoError(t, pl.hook("test@example.com", &leaseRequest{PubKey: other}, false))
+
+	// Naming that key as the previous one does not bypass the limit, as
+	// the user does not hold a lease for it
+	w := request(other)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "more than 1 public keys")
+	assert.False(t, reached)
+
+	// Rotating the key of the lease the user holds replaces it
+	assert.NoError(t, pl.hook("test@example.com", &leaseRequest{PubKey: held, PreviousPubKey: other}, false))
+	w = request(held)
+	assert.Contains(t, w.Body.String(), "stop")
+	assert.True(t, reached)
+}
+
+func TestHTTPLeaseHandler_AuthFailureMetrics(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	introspection := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&introspectionResponse{Active: false})
+	}))
+	defer introspection.Close()
+	lh := &HTTPLeaseHandler{tokenValidator: newTokenValidator("client_id", introspection.URL)}
+	handler := instrumentHandler("newPeerLease", lh.newPeerLease)
+	inactive := testutil.ToFloat64(authFailuresTotal.WithLabelValues("inactive_token"))
+	malformed := testutil.ToFloat64(authFailuresTotal.WithLabelValues("malformed_token"))
+
+	req := httptest.NewRequest("POST", "/newPeerLease", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	req = httptest.NewRequest("POST", "/newPeerLease", strings.NewReader("{}"))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	assert.Equal(t, inactive+1, testutil.ToFloat64(authFailuresTotal.WithLabelValues("inactive_token")))
+	assert.Equal(t, malformed+1, testutil.ToFloat64(authFailuresTotal.WithLabelValues("malformed_token")))
+	assert.Equal(t, 2, testutil.CollectAndCount(httpRequestDuration))
+}
+
+func TestVerifyLeaseRequestExtra(t *testing.T) {
+	assert.NoError(t, verifyLeaseRequestExtra(nil))
+	assert.NoError(t, verifyLeaseRequestExtra(map[string]string{"site": "london"}))
+	tooMany := map[string]string{}
+	for i := 0; i <= maxLeaseRequestExtraEntries; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "v"
+	}
+	assert.Error(t, verifyLeaseRequestExtra(tooMany))
+	assert.Error(t, verifyLeaseRequestExtra(map[string]string{"": "v"}))
+	assert.Error(t, verifyLeaseRequestExtra(map[string]string{"site": strings.Repeat("x", maxLeaseRequestExtraValueLen+1)}))
+}
+
+func TestServerConfig_LeaseTiming(t *testing.T) {
+	now := time.Now()
+	tokenInfo := &introspectionResponse{
+		Active: true,
+		Exp:    now.Add(48 * time.Hour).Unix(),
+		Iat:    now.Add(-time.Hour).Unix(),
+	}
+
+	short := &serverConfig{LeaseTTL: 10 * time.Minute}
+	expires, renewAfter := short.leaseTiming(now, tokenInfo, false)
+	assert.Equal(t, now.Add(10*time.Minute), expires)
+	assert.Equal(t, now.Add(5*time.Minute), renewAfter)
+
+	long := &serverConfig{LeaseTTL: 24 * time.Hour, LeaseRenewInterval: time.Hour}
+	expires, renewAfter = long.leaseTiming(now, tokenInfo, false)
+	assert.Equal(t, now.Add(24*time.Hour), expires)
+	assert.Equal(t, now.Add(time.Hour), renewAfter)
+
+	// Leases are bound by the token expiry and the maximum lifetime
+	unbounded := &serverConfig{}
+	expires, renewAfter = unbounded.leaseTiming(now, tokenInfo, false)
+	assert.Equal(t, time.Unix(tokenInfo.Exp, 0), expires)
+	assert.True(t, renewAfter.IsZero())
+	capped := &serverConfig{LeaseTTL: 24 * time.Hour, LeaseMaxLifetime: 8 * time.Hour}
+	expires, _ = capped.leaseTiming(now, tokenInfo, false)
+	assert.Equal(t, time.Unix(tokenInfo.Iat, 0).Add(8*time.Hour), expires)
+}
+
+func TestServerConfig_PoolLeaseTiming(t *testing.T) {
+	now := time.Now()
+	tokenInfo := &introspectionResponse{
+		Active: true,
+		Exp:    now.Add(48 * time.Hour).Unix(),
+		Iat:    now.Add(-time.Hour).Unix(),
+	}
+	cfg := &serverConfig{LeaseTTL: 12 * time.Hour, LeaseRenewInterval: time.Hour}
+	contractors := &serverPoolConfig{Name: "contractors", LeaseTTL: duration{30 * time.Minute}}
+	machines := &serverPoolConfig{Name: "machines", LeaseTTL: duration{24 * time.Hour}, LeaseMaxLifetime: duration{36 * time.Hour}}
+
+	expires, renewAfter := cfg.poolConfig(contractors).leaseTiming(now, tokenInfo, false)
+	assert.Equal(t, now.Add(30*time.Minute), expires)
+	// The renew interval of the server is longer than the TTL of the pool
+	assert.Equal(t, now.Add(15*time.Minute), renewAfter)
+
+	expires, renewAfter = cfg.poolConfig(machines).leaseTiming(now, tokenInfo, false)
+	assert.Equal(t, now.Add(24*time.Hour), expires)
+	assert.Equal(t, now.Add(time.Hour), renewAfter)
+
+	// Pools without timing use the one of the server
+	expires, _ = cfg.poolConfig(&serverPoolConfig{Name: "office"}).leaseTiming(now, tokenInfo, false)
+	assert.Equal(t, now.Add(12*time.Hour), expires)
+	assert.Equal(t, 12*time.Hour, cfg.LeaseTTL)
+}
+
+func TestServerConfig_DNSRoutes(t *testing.T) {
+	cfg := &serverConfig{DNSRoutes: []*serverDNSRouteConfig{
+		{Domains: []string{"corp.example.com"}, Servers: []string{"10.90.0.2"}},
+		{Domains: []string{"infra.example.com"}, Servers: []string{"10.90.0.3"}, Scopes: []string{"wiresteward.infra"}},
+	}}
+	assert.Equal(t, []client.DNSRoute{
+		{Domains: []string{"corp.example.com"}, Servers: []string{"10.90.0.2"}},
+	}, cfg.dnsRoutes("openid"))
+	assert.Equal(t, []client.DNSRoute{
+		{Domains: []string{"corp.example.com"}, Servers: []string{"10.90.0.2"}},
+		{Domains: []string{"infra.example.com"}, Servers: []string{"10.90.0.3"}},
+	}, cfg.dnsRoutes("openid wiresteward.infra"))
+
+	// Routes are part of the advertised settings
+	version := cfg.advertisedVersion()
+	cfg.DNSRoutes[0].Servers = []string{"10.90.0.4"}
+	assert.NotEqual(t, version, cfg.advertisedVersion())
+}
+
+func TestHTTPLeaseHandler_ReservedKey(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	introspection := newTestIntrospectionServer("other@example.com")
+	defer introspection.Close()
+
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	lh := &HTTPLeaseHandler{
+		serverConfig:   &serverConfig{WireguardIPAddress: ip, WireguardIPNetwork: network},
+		tokenValidator: newTokenValidator("client_id", introspection.URL),
+		leaseManager: &FileLeaseManager{
+			cidr:         network,
+			ip:           ip,
+			wgRecords:    map[string]WgRecord{},
+			reservations: map[string]ipReservation{validPublicKey: {ip: net.ParseIP("10.90.0.10"), username: "ci@example.com"}},
+		},
+	}
+	body, _ := json.Marshal(&leaseRequest{PubKey: validPublicKey})
+	req := httptest.NewRequest("POST", "/newPeerLease", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	lh.newPeerLease(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), errReservedKey.Error())
+	assert.Empty(t, lh.leaseManager.wgRecords)
+}
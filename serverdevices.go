@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// device returns the additional device named name, or nil if there is none.
+func (c *serverConfig) device(name string) *serverDeviceConfig {
+	for _, d := range c.Devices {
+		if d.Name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// selectDevice returns the additional device to lease an address on to the
+// owner of a token granted scope and member of groups, who requested the
+// device named requested. Devices can only be requested with one of their
+// scopes or groups, if they have any. Without a request, the first device
+// selected by one of the scopes or groups is used, and nil is returned if
+// there is none, for the main device.
+func (c *serverConfig) selectDevice(requested, scope string, groups []string) (*serverDeviceConfig, error) {
+	scopes := strings.Fields(scope)
+	if requested != "" && requested != c.DeviceName {
+		d := c.device(requested)
+		if d == nil {
+			return nil, fmt.Errorf("unknown device %s", requested)
+		}
+		if d.restricted() && !d.selectedBy(scopes, groups) {
+			return nil, fmt.Errorf("token is not allowed to lease on device %s", requested)
+		}
+		return d, nil
+	}
+	if requested != "" {
+		return nil, nil
+	}
+	for _, d := range c.Devices {
+		if d.restricted() && d.selectedBy(scopes, groups) {
+			return d, nil
+		}
+	}
+	return nil, nil
+}
+
+// restricted returns whether the device has scopes or groups.
+func (d *serverDeviceConfig) restricted() bool {
+	return len(d.Scopes) > 0 || len(d.Groups) > 0
+}
+
+// selectedBy returns whether any of scopes or groups is one of the scopes or
+// groups of the device.
+func (d *serverDeviceConfig) selectedBy(scopes, groups []string) bool {
+	return hasAnyScope(scopes, d.Scopes) || hasAnyScope(groups, d.Groups)
+}
+
+// deviceConfig returns the config of the additional device d: a copy of c
+// with the network, endpoint, allowed IPs and files of d. Pools,
+// reservations, group networks, IPv6 and delegated prefixes only apply to the
+// main device, and leases of additional devices are always kept in their
+// leases file.
+func (c *serverConfig) deviceConfig(d *serverDeviceConfig) *serverConfig {
+	dc := *c
+	dc.DeviceName = d.Name
+	dc.Address = d.Address
+	dc.WireguardIPAddress, dc.WireguardIPNetwork = d.ip, d.network
+	dc.Endpoint, dc.WireguardListenPort = d.Endpoint, d.listenPort
+	dc.AllowedIPs, dc.AllowedIPsFlags = d.AllowedIPs, nil
+	dc.DeviceMTU = d.DeviceMTU
+	dc.KeyFilename, dc.LeasesFilename = d.KeyFilename, d.LeasesFilename
+	dc.LeaseStore, dc.LeaseExport = nil, nil
+	dc.Pools = nil
+	dc.Reservations, dc.ReservedIPs = nil, nil
+	dc.GroupNetworks = nil
+	dc.Network6, dc.WireguardIP6Address, dc.WireguardIP6Network = "", nil, nil
+	dc.DelegatedPrefixes, dc.DelegatedPrefixPool, dc.DelegatedPrefixLength = "", nil, 0
+	dc.Devices = nil
+	return &dc
+}
+
+// revokeLease revokes the lease held by pubKey, on the main device or the
+// additional device it was granted on.
+func (lh *HTTPLeaseHandler) revokeLease(username, pubKey string) (string, WgRecord, error) {
+	return revokeDeviceLease(lh.leaseManager, lh.devices, username, pubKey)
+}
+
+// revokeDeviceLease revokes the lease of username or pubKey held on the
+// device of lm, or else on one of the additional devices.
+func revokeDeviceLease(lm *FileLeaseManager, devices map[string]*FileLeaseManager, username, pubKey string) (string, WgRecord, error) {
+	user, record, err := lm.revokeLease(username, pubKey)
+	for _, dlm := range devices {
+		if !errors.Is(err, errLeaseNotFound) {
+			break
+		}
+		user, record, err = dlm.revokeLease(username, pubKey)
+	}
+	return user, record, err
+}
+
+// deviceLeases returns the leases held on the device of lm and on the
+// additional devices, with the latest handshake of each peer, sorted by
+// device.
+func deviceLeases(lm *FileLeaseManager, devices map[string]*FileLeaseManager) []leaseExportEntry {
+	leases := lm.leasesWithHandshakes(lm.device)
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dlm := devices[name]
+		dleases := dlm.leasesWithHandshakes(dlm.device)
+		for i := range dleases {
+			dleases[i].Device = name
+		}
+		leases = append(leases, dleases...)
+	}
+	return leases
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerConfig_Devices(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	for _, tc := range []struct {
+		input string
+		err   bool
+	}{
+		{`"devices": [{"name": "wg1", "address": "10.91.0.1/24", "endpoint": "1.2.3.4:51821", "allowedIPs": ["10.1.0.0/16"], "scopes": ["wiresteward.machines"]}]`, false},
+		{`"devices": [{"name": "", "address": "10.91.0.1/24", "endpoint": "1.2.3.4:51821"}]`, true},
+		{`"devices": [{"name": "wg0", "address": "10.91.0.1/24", "endpoint": "1.2.3.4:51821"}]`, true},
+		{`"devices": [{"name": "wiresteward-machines", "address": "10.91.0.1/24", "endpoint": "1.2.3.4:51821"}]`, true},
+		{`"devices": [{"name": "wg1", "address": "10.91.0.1", "endpoint": "1.2.3.4:51821"}]`, true},
+		{`"devices": [{"name": "wg1", "address": "10.90.0.129/25", "endpoint": "1.2.3.4:51821"}]`, true},
+		{`"devices": [{"name": "wg1", "address": "10.91.0.1/24", "endpoint": "1.2.3.4:51820"}]`, true},
+		{`"devices": [{"name": "wg1", "address": "10.91.0.1/24", "endpoint": "1.2.3.4"}]`, true},
+		{`"devices": [{"name": "wg1", "address": "10.91.0.1/24", "endpoint": "1.2.3.4:51821", "allowedIPs": ["10.1.0.0"]}]`, true},
+		{`"devices": [{"name": "wg1", "address": "10.91.0.1/24", "endpoint": "1.2.3.4:51821", "leasesFilename": "/var/lib/wiresteward/leases"}]`, true},
+		{`"devices": [{"name": "wg1", "address": "10.91.0.1/24", "endpoint": "1.2.3.4:51821"}, {"name": "wg2", "address": "10.91.0.1/16", "endpoint": "1.2.3.4:51822"}]`, true},
+		{`"devices": [{"name": "wg1", "address": "10.91.0.1/24", "endpoint": "1.2.3.4:51821"}], "pools": [{"name": "office", "address": "10.91.0.1/16"}]`, true},
+	} {
+		cfg := &serverConfig{}
+		input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthClientID": "id", "oauthIntrospectURL": "example.com", ` + tc.input + `}`
+		if err := json.Unmarshal([]byte(input), cfg); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyServerConfig(cfg)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+		}
+	}
+
+	// Files default to ones named after the device, the server address is
+	// added to the allowed IPs
+	cfg := &serverConfig{}
+	input := `{"address": "10.90.0.1/24", "endpoint": "1.2.3.4:51820", "oauthClientID": "id", "oauthIntrospectURL": "example.com", "devices": [{"name": "wg1", "address": "10.91.0.1/24", "endpoint": "1.2.3.4:51821", "allowedIPs": ["10.1.0.0/16"]}]}`
+	if err := json.Unmarshal([]byte(input), cfg); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, verifyServerConfig(cfg))
+	d := cfg.Devices[0]
+	assert.Equal(t, "/etc/wiresteward/wg1.key", d.KeyFilename)
+	assert.Equal(t, "/var/lib/wiresteward/leases-wg1", d.LeasesFilename)
+	assert.Equal(t, []string{"10.1.0.0/16", "10.91.0.1/32"}, d.AllowedIPs)
+
+	dc := cfg.deviceConfig(d)
+	assert.Equal(t, "wg1", dc.DeviceName)
+	assert.Equal(t, "10.91.0.1", dc.WireguardIPAddress.String())
+	assert.Equal(t, "10.91.0.0/24", dc.WireguardIPNetwork.String())
+	assert.Equal(t, 51821, dc.WireguardListenPort)
+	assert.Equal(t, "1.2.3.4:51821", dc.Endpoint)
+	assert.Equal(t, d.AllowedIPs, dc.AllowedIPs)
+	assert.Nil(t, dc.Devices)
+	// The main config is left untouched
+	assert.Equal(t, "wg0", cfg.DeviceName)
+	assert.Equal(t, 51820, cfg.WireguardListenPort)
+}
+
+func TestServerConfig_SelectDevice(t *testing.T) {
+	machines := &serverDeviceConfig{Name: "wg-machines", Scopes: []string{"wiresteward.machines"}}
+	contractors := &serverDeviceConfig{Name: "wg-contractors", Groups: []string{"contractors"}}
+	open := &serverDeviceConfig{Name: "wg-open"}
+	cfg := &serverConfig{DeviceName: "wg0", Devices: []*serverDeviceConfig{open, machines, contractors}}
+	for _, tc := range []struct {
+		requested, scope string
+		groups           []string
+		want             *serverDeviceConfig
+		err              bool
+	}{
+		{"", "openid", nil, nil, false},
+		{"", "openid wiresteward.machines", nil, machines, false},
+		{"", "openid", []string{"developers", "contractors"}, contractors, false},
+		{"wg0", "wiresteward.machines", nil, nil, false},
+		{"wg-open", "openid", nil, open, false},
+		{"wg-machines", "wiresteward.machines", nil, machines, false},
+		{"wg-machines", "openid", []string{"contractors"}, nil, true},
+		{"wg-unknown", "openid", nil, nil, true},
+	} {
+		d, err := cfg.selectDevice(tc.requested, tc.scope, tc.groups)
+		if tc.err {
+			assert.Error(t, err, tc.requested)
+			continue
+		}
+		assert.NoError(t, err, tc.requested)
+		assert.Equal(t, tc.want, d, tc.requested)
+	}
+}
+
+func TestHTTPLeaseHandler_Devices(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	lh := &HTTPLeaseHandler{
+		tokenValidator: &fakeTokenValidator{token: "token", username: "alice@example.com"},
+		serverConfig: &serverConfig{
+			DeviceName: "wg0",
+			Devices:    []*serverDeviceConfig{{Name: "wg1"}},
+		},
+	}
+	for device, status := range map[string]int{
+		"wg-unknown": http.StatusForbidden,
+		// Devices that were added since the server started are not
+		// running until it restarts
+		"wg1": http.StatusServiceUnavailable,
+	} {
+		body, _ := json.Marshal(&leaseRequest{PubKey: validPublicKey, Device: device})
+		req := httptest.NewRequest("POST", "/api/v1/lease", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		lh.newPeerLease(w, req)
+		assert.Equal(t, status, w.Code, device)
+	}
+}
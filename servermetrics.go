@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	leasesGrantedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wiresteward_leases_granted_total",
+		Help: "Number of leases granted for a new address or public key.",
+	})
+	leaseRenewalsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wiresteward_lease_renewals_total",
+		Help: "Number of existing leases that were extended.",
+	})
+	peerDiscrepanciesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wiresteward_peer_discrepancies_total",
+		Help: "Number of peers of the device found missing, unexpected or changed compared to the leases, by kind.",
+	}, []string{"kind"})
+	authFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wiresteward_auth_failures_total",
+		Help: "Number of lease requests rejected because their token could not be verified, by reason.",
+	}, []string{"reason"})
+	leaseRequestsRateLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wiresteward_lease_requests_rate_limited_total",
+		Help: "Number of lease requests rejected for exceeding a rate limit, by limit.",
+	}, []string{"limit"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wiresteward_http_request_duration_seconds",
+		Help:    "Latency of the requests served by the lease server.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler", "method", "code"})
+)
+
+// instrumentHandler records the latency of the requests served by h under
+// the handler label name.
+func instrumentHandler(name string, h http.HandlerFunc) http.HandlerFunc {
+	return promhttp.InstrumentHandlerDuration(httpRequestDuration.MustCurryWith(prometheus.Labels{"handler": name}), h)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateCheckInterval is how often the server certificate files are
+// checked for changes, at most.
+const certificateCheckInterval = 10 * time.Second
+
+// certificateReloader serves the certificate in certFile and keyFile to TLS
+// clients, loading it again when either file changes, so that certificates
+// can be rotated without restarting the server.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	cr := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// load reads the certificate if its files changed since it was last loaded.
+// It must be called with mutex held, or before the reloader is used.
+func (cr *certificateReloader) load() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil && !modTime.After(cr.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil {
+		logger.Info.Printf("Loaded rotated server certificate from %s", cr.certFile)
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// filesModTime returns the latest modification time of the certificate and
+// key files.
+func (cr *certificateReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If the certificate
+// cannot be loaded again, the previous one is served.
+func (cr *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if time.Since(cr.lastCheck) >= certificateCheckInterval {
+		cr.lastCheck = time.Now()
+		if err := cr.load(); err != nil {
+			logger.Error.Printf("Cannot load server certificate, serving the previous one: %v", err)
+		}
+	}
+	return cr.cert, nil
+}
+
+// loadClientCAs returns a pool of the PEM encoded certificates in path.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// machineIdentity returns the identity of agents that authenticate with a
+// client certificate issued by one of clientCAs, instead of a token. The
+// common name of the certificate is used as the username and leases do not
+// outlive the certificate. It returns nil if no certificate was presented
+// or it was not issued by clientCAs.
+func machineIdentity(state *tls.ConnectionState, clientCAs *x509.CertPool) *introspectionResponse {
+	if clientCAs == nil || state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range state.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil
+	}
+	if cert.Subject.CommonName == "" {
+		return nil
+	}
+	return &introspectionResponse{
+		Active:   true,
+		Exp:      cert.NotAfter.Unix(),
+		UserName: cert.Subject.CommonName,
+	}
+}
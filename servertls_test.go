@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCertificate returns a certificate for commonName, signed by parent
+// or self-signed if parent is nil.
+func newTestCertificate(t *testing.T, commonName string, isCA bool, parent *tls.Certificate) (*tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, key.Public(), signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf
+}
+
+func writeTestCertificate(t *testing.T, cert *tls.Certificate, certFile, keyFile string) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	first, _ := newTestCertificate(t, "first", false, nil)
+	writeTestCertificate(t, first, certFile, keyFile)
+
+	cr, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cr.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, first.Certificate, cert.Certificate)
+
+	// Rotated certificates are served once the files change
+	second, _ := newTestCertificate(t, "second", false, nil)
+	writeTestCertificate(t, second, certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cr.lastCheck = time.Time{}
+	cert, err = cr.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, second.Certificate, cert.Certificate)
+
+	// The previous certificate is kept if the new one cannot be loaded
+	if err := os.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(keyFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	cr.lastCheck = time.Time{}
+	cert, err = cr.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, second.Certificate, cert.Certificate)
+}
+
+func TestMachineIdentity(t *testing.T) {
+	ca, caCert := newTestCertificate(t, "wiresteward CA", true, nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+	_, machine := newTestCertificate(t, "build-agent-1", false, ca)
+	_, selfSigned := newTestCertificate(t, "build-agent-1", false, nil)
+
+	identity := machineIdentity(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{machine}}, clientCAs)
+	if assert.NotNil(t, identity) {
+		assert.True(t, identity.Active)
+		assert.Equal(t, "build-agent-1", identity.UserName)
+		assert.Equal(t, machine.NotAfter.Unix(), identity.Exp)
+	}
+	assert.Nil(t, machineIdentity(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{selfSigned}}, clientCAs))
+	assert.Nil(t, machineIdentity(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{machine}}, nil))
+	assert.Nil(t, machineIdentity(&tls.ConnectionState{}, clientCAs))
+	assert.Nil(t, machineIdentity(nil, clientCAs))
+}
+
+func TestLoadClientCAs(t *testing.T) {
+	_, caCert := newTestCertificate(t, "wiresteward CA", true, nil)
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadClientCAs(path)
+	assert.NoError(t, err)
+
+	if err := os.WriteFile(path, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadClientCAs(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	leaseSignatureHeader = "X-Wiresteward-Signature"
+	leaseKeyIDHeader     = "X-Wiresteward-Key-Id"
+)
+
+// leaseSigner signs lease response bodies so that agents can verify they
+// originate from a trusted server.
+type leaseSigner struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+// newLeaseSigner loads the ed25519 seed found in filename, or generates and
+// stores a new one if the file does not exist.
+func newLeaseSigner(filename string) (*leaseSigner, error) {
+	kd, err := os.ReadFile(filename)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		logger.Info.Printf(
+			"No lease signing key found in %s, generating a new one",
+			filename,
+		)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return nil, err
+		}
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		seed := base64.StdEncoding.EncodeToString(key.Seed())
+		if err := os.WriteFile(filename, []byte(seed), 0600); err != nil {
+			return nil, err
+		}
+		kd = []byte(seed)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(kd)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode lease signing key: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid lease signing key size, expected %d bytes, got %d", ed25519.SeedSize, len(seed))
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	pub := key.Public().(ed25519.PublicKey)
+	logger.Info.Printf(
+		"Signing lease responses with public key %s",
+		base64.StdEncoding.EncodeToString(pub),
+	)
+	return &leaseSigner{key: key, keyID: leaseKeyID(pub)}, nil
+}
+
+// sign sets the signature and key id headers for the given response body.
+func (ls *leaseSigner) sign(h http.Header, body []byte) {
+	h.Set(leaseSignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(ls.key, body)))
+	h.Set(leaseKeyIDHeader, ls.keyID)
+}
+
+// leaseKeyID returns a short identifier for a lease signing public key.
+func leaseKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// parseLeaseVerificationKey parses a base64 encoded ed25519 public key.
+func parseLeaseVerificationKey(s string) (ed25519.PublicKey, error) {
+	k, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected %d bytes, got %d", ed25519.PublicKeySize, len(k))
+	}
+	return ed25519.PublicKey(k), nil
+}
+
+// verifyLeaseSignature checks the signature headers of a lease response
+// against the given body and public key.
+func verifyLeaseSignature(pub ed25519.PublicKey, h http.Header, body []byte) error {
+	sig := h.Get(leaseSignatureHeader)
+	if sig == "" {
+		return fmt.Errorf("response is not signed")
+	}
+	if kid := h.Get(leaseKeyIDHeader); kid != leaseKeyID(pub) {
+		return fmt.Errorf("response signed with unknown key id: %s", kid)
+	}
+	s, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("cannot decode response signature: %w", err)
+	}
+	if !ed25519.Verify(pub, body, s) {
+		return fmt.Errorf("invalid response signature")
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestLeaseSignature(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	signer, err := newLeaseSigner(filepath.Join(t.TempDir(), "signing-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := base64.StdEncoding.EncodeToString(signer.key.Public().(ed25519.PublicKey))
+	body, err := json.Marshal(&leaseResponse{
+		Status:     "success",
+		IP:         "10.0.0.2/32",
+		AllowedIPs: validAllowedIPs,
+		PubKey:     validPublicKey,
+		Endpoint:   "1.1.1.1:1111",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(body, []byte("10.0.0.2"), []byte("10.0.0.3"), 1)
+
+	testCases := []struct {
+		name string
+		body []byte
+		err  bool
+	}{
+		{"valid", body, false},
+		{"tampered", tampered, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				signer.sign(w.Header(), body)
+				w.Write(tc.body)
+			}))
+			defer ts.Close()
+			server := agentPeerConfig{URL: ts.URL, LeaseSigningPublicKey: pub}
+			_, _, err := requestWirestewardPeerConfig(server, "token", nil, &leaseRequest{PubKey: validPublicKey})
+			if tc.err && err == nil {
+				t.Errorf("expected tampered response to be rejected")
+			}
+			if !tc.err && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestLeaseSignature_UnsignedResponse(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyLeaseSignature(key.Public().(ed25519.PublicKey), http.Header{}, []byte("{}")); err == nil {
+		t.Errorf("expected unsigned response to be rejected")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// serverSourceRanges maps usernames to the networks, in CIDR notation, that
+// their agents may use their leases from. Users without an entry are not
+// restricted.
+type serverSourceRanges map[string][]string
+
+// permits returns whether username may use a lease from ip.
+func (sr serverSourceRanges) permits(username string, ip net.IP) bool {
+	ranges, ok := sr[username]
+	if !ok {
+		return true
+	}
+	for _, r := range ranges {
+		if _, network, err := net.ParseCIDR(r); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyRequest returns an error if username is restricted to source
+// ranges that the lease request r did not originate from.
+func (sr serverSourceRanges) verifyRequest(username string, r *http.Request) error {
+	if _, ok := sr[username]; !ok {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !sr.permits(username, ip) {
+		return fmt.Errorf("lease cannot be used from %s", host)
+	}
+	return nil
+}
+
+// reclaimDriftedLeases removes the leases of peers whose endpoint, as last
+// seen by the wireguard device, is outside the source ranges of their user.
+// It returns whether any leases were reclaimed.
+func (lm *FileLeaseManager) reclaimDriftedLeases() bool {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	if len(lm.sourceRanges) == 0 || lm.device == nil {
+		return false
+	}
+	dev, err := lm.device(lm.deviceName)
+	if err != nil {
+		logger.Error.Printf("Cannot get peer endpoints of device %s: %v", lm.deviceName, err)
+		return false
+	}
+	endpoints := make(map[string]*net.UDPAddr, len(dev.Peers))
+	for _, p := range dev.Peers {
+		endpoints[p.PublicKey.String()] = p.Endpoint
+	}
+	reclaimed := false
+	for username, r := range lm.wgRecords {
+		// Peers that have not completed a handshake have no endpoint yet
+		endpoint := endpoints[r.PubKey]
+		if endpoint == nil || lm.sourceRanges.permits(username, endpoint.IP) {
+			continue
+		}
+		logger.Info.Printf("Revoking lease of user %s (address %s) used from %s, outside of its source ranges", username, r.IP, endpoint.IP)
+		lm.releaseRecord(username, r)
+		lm.emitLeaseEvent(leaseEventRevoked, username, r, fmt.Sprintf("used from %s, outside of the source ranges", endpoint.IP))
+		reclaimed = true
+	}
+	return reclaimed
+}
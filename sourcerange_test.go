@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestServerSourceRanges_VerifyRequest(t *testing.T) {
+	ranges := serverSourceRanges{"site@example.com": {"192.0.2.0/24", "198.51.100.7/32"}}
+	request := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest("POST", "/newPeerLease", nil)
+		req.RemoteAddr = remoteAddr
+		return req
+	}
+
+	assert.NoError(t, ranges.verifyRequest("site@example.com", request("192.0.2.10:51820")))
+	assert.NoError(t, ranges.verifyRequest("site@example.com", request("198.51.100.7:443")))
+	assert.Error(t, ranges.verifyRequest("site@example.com", request("203.0.113.5:51820")))
+	// Users without source ranges are not restricted
+	assert.NoError(t, ranges.verifyRequest("roaming@example.com", request("203.0.113.5:51820")))
+}
+
+func TestHTTPLeaseHandler_SourceRanges(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	introspection := newTestIntrospectionServer("site@example.com")
+	defer introspection.Close()
+
+	lh := &HTTPLeaseHandler{
+		serverConfig: &serverConfig{
+			SourceRanges: serverSourceRanges{"site@example.com": {"192.0.2.0/24"}},
+		},
+		tokenValidator: newTokenValidator("client_id", introspection.URL),
+	}
+	body, _ := json.Marshal(&leaseRequest{PubKey: validPublicKey})
+	req := httptest.NewRequest("POST", "/newPeerLease", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer token")
+	req.RemoteAddr = "203.0.113.5:40000"
+	w := httptest.NewRecorder()
+	lh.newPeerLease(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "lease cannot be used from 203.0.113.5")
+}
+
+func TestFileLeaseManager_ReclaimDriftedLeases(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	now := time.Now()
+	ip, network, _ := net.ParseCIDR("10.90.0.1/24")
+	keys := map[string]wgtypes.Key{}
+	endpoints := map[string]*net.UDPAddr{
+		"site@example.com":      {IP: net.ParseIP("192.0.2.10"), Port: 51820},
+		"roaming@example.com":   {IP: net.ParseIP("203.0.113.5"), Port: 51820},
+		"idle-site@example.com": nil,
+	}
+	lm := &FileLeaseManager{
+		cidr:       network,
+		deviceName: "wg0",
+		ip:         ip,
+		sourceRanges: serverSourceRanges{
+			"site@example.com":      {"192.0.2.0/24"},
+			"idle-site@example.com": {"192.0.2.0/24"},
+		},
+		wgRecords: map[string]WgRecord{},
+		device: func(name string) (*wgtypes.Device, error) {
+			dev := &wgtypes.Device{Name: name}
+			for username, ep := range endpoints {
+				dev.Peers = append(dev.Peers, wgtypes.Peer{PublicKey: keys[username], Endpoint: ep})
+			}
+			return dev, nil
+		},
+	}
+	for username := range endpoints {
+		keys[username] = newWgKey()
+		if _, err := lm.createOrUpdatePeer(username, &leaseRequest{PubKey: keys[username].String()}, now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// All peers are within their ranges, or not restricted
+	assert.False(t, lm.reclaimDriftedLeases())
+	assert.Equal(t, 3, len(lm.wgRecords))
+
+	// The endpoint of a restricted peer drifts outside its range
+	endpoints["site@example.com"] = &net.UDPAddr{IP: net.ParseIP("203.0.113.9"), Port: 51820}
+	assert.True(t, lm.reclaimDriftedLeases())
+	assert.NotContains(t, lm.wgRecords, "site@example.com")
+	assert.Contains(t, lm.wgRecords, "roaming@example.com")
+	assert.Contains(t, lm.wgRecords, "idle-site@example.com")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStatsdFlushInterval = time.Second
+	// Keep packets below the common 1500 bytes MTU
+	statsdMaxPacketSize = 1432
+)
+
+// agentMetricsSink records agent metrics. Tags are ignored by sinks that do
+// not support them.
+type agentMetricsSink interface {
+	count(name string, value int64, tags map[string]string)
+	gauge(name string, value float64, tags map[string]string)
+}
+
+// noopMetricsSink discards all metrics.
+type noopMetricsSink struct{}
+
+func (noopMetricsSink) count(string, int64, map[string]string)   {}
+func (noopMetricsSink) gauge(string, float64, map[string]string) {}
+
+// statsdClient is an agentMetricsSink that sends metrics to a StatsD server
+// over UDP. Metrics are buffered and sent in batches, either periodically or
+// when the buffer grows to the maximum packet size.
+type statsdClient struct {
+	conn      net.Conn
+	dogstatsd bool
+	prefix    string
+	buf       bytes.Buffer
+	mutex     sync.Mutex
+	stop      chan struct{}
+}
+
+func newStatsdClient(address, prefix string, dogstatsd bool, flushInterval time.Duration) (*statsdClient, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	if flushInterval == 0 {
+		flushInterval = defaultStatsdFlushInterval
+	}
+	c := &statsdClient{
+		conn:      conn,
+		dogstatsd: dogstatsd,
+		prefix:    prefix,
+		stop:      make(chan struct{}),
+	}
+	go c.flushLoop(flushInterval)
+	return c, nil
+}
+
+func (c *statsdClient) count(name string, value int64, tags map[string]string) {
+	c.write(fmt.Sprintf("%s%s:%d|c", c.prefix, name, value), tags)
+}
+
+func (c *statsdClient) gauge(name string, value float64, tags map[string]string) {
+	c.write(fmt.Sprintf("%s%s:%g|g", c.prefix, name, value), tags)
+}
+
+func (c *statsdClient) write(line string, tags map[string]string) {
+	if c.dogstatsd && len(tags) > 0 {
+		t := make([]string, 0, len(tags))
+		for k, v := range tags {
+			t = append(t, k+":"+v)
+		}
+		sort.Strings(t)
+		line += "|#" + strings.Join(t, ",")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.buf.Len() > 0 && c.buf.Len()+len(line)+1 > statsdMaxPacketSize {
+		c.flushLocked()
+	}
+	if c.buf.Len() > 0 {
+		c.buf.WriteByte('\n')
+	}
+	c.buf.WriteString(line)
+}
+
+func (c *statsdClient) flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.flushLocked()
+}
+
+func (c *statsdClient) flushLocked() {
+	if c.buf.Len() == 0 {
+		return
+	}
+	if _, err := c.conn.Write(c.buf.Bytes()); err != nil {
+		logger.Debug.Printf("Cannot send metrics to statsd: %v", err)
+	}
+	c.buf.Reset()
+}
+
+func (c *statsdClient) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flush()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Close flushes any buffered metrics and closes the underlying connection.
+func (c *statsdClient) Close() error {
+	close(c.stop)
+	c.flush()
+	return c.conn.Close()
+}
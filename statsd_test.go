@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsdClient(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	receiver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	c, err := newStatsdClient(receiver.LocalAddr().String(), "wiresteward.agent", true, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.count("lease_requests", 1, map[string]string{"device": "wg0", "server": "example.com"})
+	c.gauge("peer_handshake_age_seconds", 12.5, map[string]string{"device": "wg0"})
+	c.gauge("peer_receive_bytes", 100, nil)
+	// Closing the client should flush all metrics in a single packet
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, statsdMaxPacketSize)
+	n, _, err := receiver.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		"wiresteward.agent.lease_requests:1|c|#device:wg0,server:example.com",
+		"wiresteward.agent.peer_handshake_age_seconds:12.5|g|#device:wg0",
+		"wiresteward.agent.peer_receive_bytes:100|g",
+	}, strings.Split(string(buf[:n]), "\n"))
+}
+
+func TestStatsdClient_Batching(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	receiver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	c, err := newStatsdClient(receiver.LocalAddr().String(), "", false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Plain statsd lines should not carry tags and should be split in
+	// packets that do not exceed the maximum size
+	for i := 0; i < 200; i++ {
+		c.count("lease_requests", 1, map[string]string{"device": "wg0"})
+	}
+	receiver.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2*statsdMaxPacketSize)
+	n, _, err := receiver.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.LessOrEqual(t, n, statsdMaxPacketSize)
+	assert.Equal(t, "lease_requests:1|c", strings.Split(string(buf[:n]), "\n")[0])
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusTimeout bounds the requests of `wiresteward status` to the agent.
+const statusTimeout = 5 * time.Second
+
+// serveStatusSocket serves the agent status as json on the unix socket at
+// path, for `wiresteward status`. The socket only serves the status, so it is
+// accessible to every user, like the agent address.
+func (a *Agent) serveStatusSocket(path string) {
+	listener, err := listenUnixSocket(path, 0666, "")
+	if err != nil {
+		logger.Error.Printf("Cannot listen on status socket: %v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status.json", a.statusHandler)
+	logger.Info.Printf("Serving agent status at %s", path)
+	if err := http.Serve(listener, mux); err != nil {
+		logger.Error.Printf("Agent status server failed: %v", err)
+	}
+}
+
+// listenUnixSocket listens on the unix socket at path, replacing the socket
+// left behind by a previous agent, and restricts access to it to mode. If
+// group is set, it is made the group of the socket.
+func listenUnixSocket(path string, mode os.FileMode, group string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	fi, err := os.Lstat(path)
+	switch {
+	// Sockets are not reported as such on windows
+	case err == nil && fi.Mode()&os.ModeSocket == 0 && runtime.GOOS != "windows":
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	case err == nil:
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketAccess(path, mode, group); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// setSocketAccess sets the mode and group of the socket at path.
+func setSocketAccess(path string, mode os.FileMode, group string) error {
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return fmt.Errorf("group %s has a non numeric id %s", group, g.Gid)
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, mode)
+}
+
+// unixSocketClient returns an http client sending every request to the unix
+// socket at path.
+func unixSocketClient(path string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// fetchStatus returns the status of the agent listening on the unix socket at
+// path.
+func fetchStatus(path string) (*agentStatus, error) {
+	return getStatus(unixSocketClient(path, statusTimeout))
+}
+
+// getStatus returns the status of the agent client sends requests to.
+func getStatus(client *http.Client) (*agentStatus, error) {
+	resp, err := client.Get("http://agent/status.json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	status := &agentStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// statusCommand implements `wiresteward status`, printing the status of the
+// agent listening on the -agent-socket.
+func statusCommand(jsonOutput bool) {
+	status, err := fetchStatus(*flagAgentSocket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot get the status of the agent at %s: %v\n", *flagAgentSocket, err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(status)
+		return
+	}
+	printStatus(os.Stdout, status)
+}
+
+// printStatus writes status to w, for humans.
+func printStatus(w io.Writer, status *agentStatus) {
+	if len(status.Devices) == 0 {
+		fmt.Fprintln(w, "no devices")
+	}
+	for i, d := range status.Devices {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "device: %s", d.Name)
+		if d.Alias != "" {
+			fmt.Fprintf(w, " (%s)", d.Alias)
+		}
+		fmt.Fprintln(w)
+		if d.Address == "" {
+			fmt.Fprintln(w, "  no active lease")
+		} else {
+			fmt.Fprintf(w, "  address: %s\n", d.Address)
+			fmt.Fprintf(w, "  server: %s\n", d.Server)
+			fmt.Fprintf(w, "  lease expires: %s (in %s)\n", d.Expires.Format(timeFmt), d.Expires.Sub(status.Time).Round(time.Second))
+		}
+		for _, p := range d.Peers {
+			handshake := "never"
+			if !p.LastHandshake.IsZero() {
+				handshake = fmt.Sprintf("%s (%s ago)", p.LastHandshake.Format(timeFmt), status.Time.Sub(p.LastHandshake).Round(time.Second))
+			}
+			fmt.Fprintf(w, "  peer: %s\n", p.PublicKey)
+			fmt.Fprintf(w, "    endpoint: %s\n", p.Endpoint)
+			fmt.Fprintf(w, "    latest handshake: %s\n", handshake)
+			fmt.Fprintf(w, "    transfer: %s received, %s sent\n", formatBytes(float64(p.ReceiveBytes)), formatBytes(float64(p.TransmitBytes)))
+		}
+		if len(d.Routes) > 0 {
+			fmt.Fprintf(w, "  routes: %s\n", strings.Join(d.Routes, ", "))
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestStatusSocket(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	now := time.Now()
+	peer := newWgKey()
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	dm.config = &WirestewardPeerConfig{
+		LocalAddress: &net.IPNet{IP: net.ParseIP("10.90.0.2"), Mask: net.CIDRMask(32, 32)},
+		ServerURL:    "https://wiresteward.example.com",
+		Expires:      now.Add(time.Hour),
+		Routes: []net.IPNet{
+			{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)},
+			{IP: net.ParseIP("172.16.0.0"), Mask: net.CIDRMask(12, 32)},
+		},
+	}
+	dm.wireguardDevice = func(name string) (*wgtypes.Device, error) {
+		return &wgtypes.Device{Name: name, Peers: []wgtypes.Peer{{
+			PublicKey:         peer,
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 51820},
+			LastHandshakeTime: now.Add(-time.Minute),
+			ReceiveBytes:      2048,
+			TransmitBytes:     512,
+		}}}, nil
+	}
+	events := newEventQueue(defaultEventQueueSize)
+	a := &Agent{deviceManagers: []*DeviceManager{dm}, events: events}
+
+	path := filepath.Join(t.TempDir(), "run", "agent.sock")
+	// A socket left behind by a previous agent is replaced
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err := listenUnixSocket(path, 0666, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0666), fi.Mode().Perm())
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/status.json", r.URL.Path)
+		a.statusHandler(w, r)
+	}))
+	defer listener.Close()
+
+	status, err := fetchStatus(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"10.0.0.0/8", "172.16.0.0/12"}, status.Devices[0].Routes)
+
+	out := &bytes.Buffer{}
+	printStatus(out, status)
+	assert.Contains(t, out.String(), "device: wg_test (")
+	assert.Contains(t, out.String(), "  address: 10.90.0.2/32\n")
+	assert.Contains(t, out.String(), "  server: https://wiresteward.example.com\n")
+	assert.Contains(t, out.String(), "(in 1h0m0s)\n")
+	assert.Contains(t, out.String(), "  peer: "+peer.String()+"\n")
+	assert.Contains(t, out.String(), "    endpoint: 1.2.3.4:51820\n")
+	assert.Contains(t, out.String(), "(1m0s ago)\n")
+	assert.Contains(t, out.String(), "    transfer: 2.0 KiB received, 512 B sent\n")
+	assert.Contains(t, out.String(), "  routes: 10.0.0.0/8, 172.16.0.0/12\n")
+
+	_, err = fetchStatus(filepath.Join(t.TempDir(), "missing.sock"))
+	assert.Error(t, err)
+
+	// Other files are left alone
+	file := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(file, nil, 0600))
+	_, err = listenUnixSocket(file, 0666, "")
+	assert.Error(t, err)
+}
+
+func TestAgent_DeviceStatus(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	now := time.Now()
+	peer := newWgKey()
+	lease := &WirestewardPeerConfig{
+		LocalAddress: &net.IPNet{IP: net.ParseIP("10.90.0.2"), Mask: net.CIDRMask(32, 32)},
+		ServerURL:    "https://wiresteward.example.com",
+		Expires:      now.Add(time.Hour),
+		Routes:       []net.IPNet{{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)}},
+	}
+	withPeer := func(name string) (*wgtypes.Device, error) {
+		return &wgtypes.Device{Name: name, Peers: []wgtypes.Peer{{
+			PublicKey:         peer,
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 51820},
+			LastHandshakeTime: now,
+			ReceiveBytes:      2048,
+			TransmitBytes:     512,
+		}}}, nil
+	}
+	withoutPeers := func(name string) (*wgtypes.Device, error) {
+		return &wgtypes.Device{Name: name}, nil
+	}
+	missing := func(name string) (*wgtypes.Device, error) {
+		return nil, os.ErrNotExist
+	}
+	newDevice := func(name, alias string, config *WirestewardPeerConfig, device func(string) (*wgtypes.Device, error)) *DeviceManager {
+		dm := newDeviceManager(agentDeviceConfig{Name: name}, "")
+		dm.alias = alias
+		dm.config = config
+		dm.wireguardDevice = device
+		return dm
+	}
+	for _, tc := range []struct {
+		name    string
+		devices []*DeviceManager
+		status  []agentDeviceStatus
+	}{
+		{"no devices", nil, []agentDeviceStatus{}},
+		{
+			"no lease",
+			[]*DeviceManager{newDevice("wg_test", "", nil, withoutPeers)},
+			[]agentDeviceStatus{{Name: "wg_test"}},
+		},
+		{
+			"lease and peer",
+			[]*DeviceManager{newDevice("wg_test", "office", lease, withPeer)},
+			[]agentDeviceStatus{{
+				Name:    "wg_test",
+				Alias:   "office",
+				Address: "10.90.0.2/32",
+				Server:  "https://wiresteward.example.com",
+				Expires: lease.Expires,
+				Peers: []agentPeerStatus{{
+					PublicKey:     peer.String(),
+					Endpoint:      "1.2.3.4:51820",
+					LastHandshake: now,
+					ReceiveBytes:  2048,
+					TransmitBytes: 512,
+				}},
+				Routes: []string{"10.0.0.0/8"},
+			}},
+		},
+		{
+			"missing device",
+			[]*DeviceManager{newDevice("wg_a", "", lease, missing), newDevice("wg_b", "", nil, withoutPeers)},
+			[]agentDeviceStatus{
+				{Name: "wg_a", Address: "10.90.0.2/32", Server: "https://wiresteward.example.com", Expires: lease.Expires, Routes: []string{"10.0.0.0/8"}},
+				{Name: "wg_b"},
+			},
+		},
+	} {
+		a := &Agent{deviceManagers: tc.devices}
+		assert.Equal(t, tc.status, a.deviceStatus(), tc.name)
+	}
+}
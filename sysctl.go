@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sysctlRoot is the directory where the kernel exposes sysctls.
+var sysctlRoot = "/proc/sys"
+
+// Only sysctls under these trees are scoped to a single interface, eg.
+// net.ipv4.conf.<interface>.rp_filter
+var interfaceSysctlTrees = []string{
+	"net.ipv4.conf.",
+	"net.ipv4.neigh.",
+	"net.ipv6.conf.",
+	"net.ipv6.neigh.",
+}
+
+// interfaceSysctlPath returns the path of key relative to sysctlRoot, or an
+// error if key is not a sysctl scoped to the given interface.
+func interfaceSysctlPath(iface, key string) (string, error) {
+	for _, tree := range interfaceSysctlTrees {
+		prefix := tree + iface + "."
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		param := strings.TrimPrefix(key, prefix)
+		if param == "" || strings.ContainsAny(param, "./") {
+			break
+		}
+		dir := strings.ReplaceAll(strings.TrimSuffix(tree, "."), ".", "/")
+		return filepath.Join(dir, iface, param), nil
+	}
+	return "", fmt.Errorf("%s is not a sysctl of interface %s, expected net.{ipv4,ipv6}.{conf,neigh}.%s.<parameter>", key, iface, iface)
+}
+
+func readSysctl(path string) (string, error) {
+	v, err := os.ReadFile(filepath.Join(sysctlRoot, path))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(v)), nil
+}
+
+func writeSysctl(path, value string) error {
+	return os.WriteFile(filepath.Join(sysctlRoot, path), []byte(value), 0644)
+}
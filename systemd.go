@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States sent to the service manager, see sd_notify(3).
+const (
+	sdNotifyReady     = "READY=1"
+	sdNotifyReloading = "RELOADING=1"
+	sdNotifyStopping  = "STOPPING=1"
+	sdNotifyWatchdog  = "WATCHDOG=1"
+)
+
+// sdListenFDsStart is the first file descriptor passed by socket activation.
+const sdListenFDsStart = 3
+
+// sdNotify sends state to the service manager, when running as a systemd
+// service with Type=notify. It does nothing otherwise.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		logger.Error.Printf("Cannot notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logger.Error.Printf("Cannot notify systemd: %v", err)
+	}
+}
+
+// sdWatchdogInterval returns how often the systemd watchdog has to be
+// notified, half of the WatchdogSec of the service, or zero if it is not
+// enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdWatchdogLoop notifies the systemd watchdog every interval, as long as
+// alive returns. alive should block when the process hangs, eg. by taking
+// the locks that a deadlock would hold, so that systemd restarts it.
+func sdWatchdogLoop(interval time.Duration, alive func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		alive()
+		sdNotify(sdNotifyWatchdog)
+	}
+}
+
+// startSdWatchdog starts notifying the systemd watchdog, if it is enabled.
+func startSdWatchdog(alive func()) {
+	if interval := sdWatchdogInterval(); interval > 0 {
+		logger.Info.Printf("Notifying systemd watchdog every %s", interval)
+		go sdWatchdogLoop(interval, alive)
+	}
+}
+
+// sdListeners returns the sockets passed by systemd socket activation, if
+// any were passed to this process.
+func sdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	// The sockets are not meant for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		f := os.NewFile(uintptr(sdListenFDsStart+i), fmt.Sprintf("LISTEN_FD_%d", sdListenFDsStart+i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot use socket passed by systemd: %w", err)
+		}
+		listeners[i] = l
+	}
+	return listeners, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestSdNotify(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	// Nothing is sent outside of systemd
+	setenv(t, "NOTIFY_SOCKET", "")
+	sdNotify(sdNotifyReady)
+
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	setenv(t, "NOTIFY_SOCKET", socket)
+	sdNotify(sdNotifyReady)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "READY=1", string(buf[:n]))
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	setenv(t, "WATCHDOG_USEC", "")
+	setenv(t, "WATCHDOG_PID", "")
+	assert.Equal(t, time.Duration(0), sdWatchdogInterval())
+
+	setenv(t, "WATCHDOG_USEC", "30000000")
+	assert.Equal(t, 15*time.Second, sdWatchdogInterval())
+	setenv(t, "WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 15*time.Second, sdWatchdogInterval())
+	// The watchdog of another process
+	setenv(t, "WATCHDOG_PID", "1")
+	assert.Equal(t, time.Duration(0), sdWatchdogInterval())
+}
+
+func TestSdListeners_NotActivated(t *testing.T) {
+	setenv(t, "LISTEN_FDS", "1")
+	setenv(t, "LISTEN_PID", "1")
+	listeners, err := sdListeners()
+	assert.NoError(t, err)
+	assert.Empty(t, listeners)
+	// The sockets of another process are left alone
+	assert.Equal(t, "1", os.Getenv("LISTEN_FDS"))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cached tokens are refreshed this long before they expire, so that they do
+// not expire in flight.
+const tokenRefreshMargin = 30 * time.Second
+
+// tokenCache serves the token used for lease requests to all devices,
+// refreshing it just before it expires rather than on every request.
+type tokenCache struct {
+	// source returns a token, refreshing it with the identity provider if
+	// it has expired or force is set
+	source func(force bool) (string, error)
+	// ttl is how long tokens that do not carry an expiry are cached for,
+	// they are cached until rejected if zero
+	ttl    time.Duration
+	now    func() time.Time
+	token  string
+	expiry time.Time
+	mutex  sync.Mutex
+}
+
+func newTokenCache(source func(force bool) (string, error), ttl time.Duration) *tokenCache {
+	return &tokenCache{source: source, ttl: ttl, now: time.Now}
+}
+
+// set caches token, eg. after it was obtained via the web flow.
+func (c *tokenCache) set(token string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.setLocked(token)
+}
+
+func (c *tokenCache) setLocked(token string) {
+	c.token = token
+	c.expiry = time.Time{}
+	if exp, ok := jwtExpiry(token); ok {
+		c.expiry = exp
+	} else if c.ttl > 0 {
+		c.expiry = c.now().Add(c.ttl)
+	}
+}
+
+// get returns the cached token, refreshing it first if it is about to
+// expire.
+func (c *tokenCache) get() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.token != "" && (c.expiry.IsZero() || c.now().Add(tokenRefreshMargin).Before(c.expiry)) {
+		return c.token, nil
+	}
+	return c.refreshLocked(false)
+}
+
+// refresh bypasses the cache and returns a freshly issued token, eg. after a
+// server rejected the cached one.
+func (c *tokenCache) refresh() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.refreshLocked(true)
+}
+
+// retryRejected calls request with token and, if the server rejects it,
+// refreshes the token and calls request once more with the fresh one, so that
+// leases are renewed without waiting for the next attempt when the token
+// expired in the meantime. It returns the token request was last called with.
+func (c *tokenCache) retryRejected(token string, request func(token string) error) (string, error) {
+	err := request(token)
+	if !errors.Is(err, errLeaseUnauthorized) {
+		return token, err
+	}
+	fresh, refreshErr := c.refresh()
+	if refreshErr != nil {
+		logger.Error.Printf("Cannot refresh rejected token: %v", refreshErr)
+		return token, err
+	}
+	return fresh, request(fresh)
+}
+
+func (c *tokenCache) refreshLocked(force bool) (string, error) {
+	token, err := c.source(force)
+	if err != nil {
+		return "", err
+	}
+	c.setLocked(token)
+	return token, nil
+}
+
+// jwtExpiry returns the expiry of token if it is a JWT carrying an `exp`
+// claim. The token signature is not verified, the expiry is only used to
+// tell when to refresh it.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	claims := &struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, claims); err != nil || claims.Exp <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testJWT(exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":"foo","exp":%d}`, exp.Unix())))
+	return "eyJhbGciOiJSUzI1NiJ9." + payload + ".c2lnbmF0dXJl"
+}
+
+func TestTokenCache(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	calls, forced := 0, 0
+	tokens := []string{testJWT(now.Add(time.Hour)), testJWT(now.Add(2 * time.Hour)), testJWT(now.Add(3 * time.Hour))}
+	c := newTokenCache(func(force bool) (string, error) {
+		if force {
+			forced++
+		}
+		calls++
+		return tokens[calls-1], nil
+	}, 0)
+	c.now = func() time.Time { return now }
+
+	// The token is only requested from the source once until it is about
+	// to expire
+	for i := 0; i < 3; i++ {
+		token, err := c.get()
+		assert.NoError(t, err)
+		assert.Equal(t, tokens[0], token)
+	}
+	assert.Equal(t, 1, calls)
+	now = now.Add(time.Hour - tokenRefreshMargin)
+	token, err := c.get()
+	assert.NoError(t, err)
+	assert.Equal(t, tokens[1], token)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 0, forced)
+
+	// A rejected token is refreshed regardless of its expiry
+	token, err = c.refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, tokens[2], token)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, 1, forced)
+}
+
+func TestTokenCache_TTL(t *testing.T) {
+	now := time.Now()
+	calls := 0
+	c := newTokenCache(func(force bool) (string, error) {
+		calls++
+		return fmt.Sprintf("opaque%d", calls), nil
+	}, 10*time.Minute)
+	c.now = func() time.Time { return now }
+
+	// Tokens that are not JWTs are cached for the ttl
+	c.set("opaque0")
+	token, err := c.get()
+	assert.NoError(t, err)
+	assert.Equal(t, "opaque0", token)
+	now = now.Add(9 * time.Minute)
+	token, _ = c.get()
+	assert.Equal(t, "opaque0", token)
+	assert.Equal(t, 0, calls)
+	now = now.Add(time.Minute)
+	token, _ = c.get()
+	assert.Equal(t, "opaque1", token)
+	assert.Equal(t, 1, calls)
+
+	// and until they are rejected without a ttl
+	c.ttl = 0
+	c.set("opaque")
+	now = now.Add(24 * time.Hour)
+	token, _ = c.get()
+	assert.Equal(t, "opaque", token)
+	assert.Equal(t, 1, calls)
+}
+
+func TestTokenCache_RetryRejected(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	refreshed := "fresh"
+	c := newTokenCache(func(force bool) (string, error) {
+		assert.True(t, force)
+		if refreshed == "" {
+			return "", fmt.Errorf("refresh token revoked")
+		}
+		return refreshed, nil
+	}, 0)
+	var used []string
+	request := func(token string) error {
+		used = append(used, token)
+		if token != "fresh" {
+			return fmt.Errorf("lease request failed: %w", errLeaseUnauthorized)
+		}
+		return nil
+	}
+
+	// Accepted tokens are not refreshed
+	token, err := c.retryRejected("fresh", request)
+	assert.NoError(t, err)
+	assert.Equal(t, "fresh", token)
+	assert.Equal(t, []string{"fresh"}, used)
+
+	// A rejected token is refreshed and the request retried once
+	used = nil
+	token, err = c.retryRejected("expired", request)
+	assert.NoError(t, err)
+	assert.Equal(t, "fresh", token)
+	assert.Equal(t, []string{"expired", "fresh"}, used)
+
+	// The rejection is returned if the token cannot be refreshed
+	used, refreshed = nil, ""
+	token, err = c.retryRejected("expired", request)
+	assert.True(t, errors.Is(err, errLeaseUnauthorized))
+	assert.Equal(t, "expired", token)
+	assert.Equal(t, []string{"expired"}, used)
+
+	// and other errors are not retried
+	used = nil
+	_, err = c.retryRejected("fresh", func(token string) error {
+		used = append(used, token)
+		return fmt.Errorf("connection refused")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"fresh"}, used)
+}
+
+func TestJWTExpiry(t *testing.T) {
+	exp := time.Unix(1700000000, 0)
+	got, ok := jwtExpiry(testJWT(exp))
+	assert.True(t, ok)
+	assert.True(t, exp.Equal(got))
+	_, ok = jwtExpiry("opaque-token")
+	assert.False(t, ok)
+	_, ok = jwtExpiry("a.!!!.c")
+	assert.False(t, ok)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+)
+
+// tunnelControlURL returns the url to renew leases from through the tunnel,
+// if enabled for server and its tunnel is up: the current lease was granted
+// by server, which advertised a control url, and a handshake with its peer
+// has completed.
+func (dm *DeviceManager) tunnelControlURL(server agentPeerConfig) string {
+	config := dm.config
+	if !server.ControlViaTunnel || config == nil || config.ControlURL == "" || config.ServerURL != server.URL {
+		return ""
+	}
+	if dm.wireguardDevice == nil {
+		return ""
+	}
+	device, err := dm.wireguardDevice(dm.Name())
+	if err != nil {
+		return ""
+	}
+	for _, p := range device.Peers {
+		if p.PublicKey == config.PublicKey && !p.LastHandshakeTime.IsZero() {
+			return config.ControlURL
+		}
+	}
+	return ""
+}
+
+// requestPeerConfig requests a lease from server. If the server rejects the
+// token, it is refreshed and the request retried once by the token cache.
+func (dm *DeviceManager) requestPeerConfig(server agentPeerConfig, lr *leaseRequest) (*WirestewardPeerConfig, string, error) {
+	var config *WirestewardPeerConfig
+	var wgServerAddr string
+	request := func(token string) error {
+		var err error
+		config, wgServerAddr, err = dm.requestPeerConfigOnce(server, lr, token)
+		return err
+	}
+	if dm.tokens == nil {
+		err := request(dm.token())
+		return config, wgServerAddr, err
+	}
+	token, err := dm.tokens.retryRejected(dm.token(), request)
+	dm.setToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	return config, wgServerAddr, nil
+}
+
+// requestPeerConfigOnce requests a lease from server with token, through the
+// tunnel if it is up and enabled for server. Requests through the tunnel fall
+// back to the public url of the server if they fail for any reason other than
+// the token being rejected.
+func (dm *DeviceManager) requestPeerConfigOnce(server agentPeerConfig, lr *leaseRequest, token string) (*WirestewardPeerConfig, string, error) {
+	if controlURL := dm.tunnelControlURL(server); controlURL != "" {
+		tunneled := server
+		tunneled.URL = controlURL
+		config, wgServerAddr, err := requestWirestewardPeerConfig(tunneled, token, dm.resolver, lr)
+		if err == nil || errors.Is(err, errLeaseUnauthorized) {
+			return config, wgServerAddr, err
+		}
+		dm.logger.Error.Printf("Cannot renew lease through the tunnel from `%s`, falling back to `%s`: %v", controlURL, server.URL, err)
+	}
+	return requestWirestewardPeerConfig(dm.bypassFullTunnel(server), token, dm.resolver, lr)
+}
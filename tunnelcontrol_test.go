@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestDeviceManager_ControlViaTunnel(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	var mutex sync.Mutex
+	hits := map[string]int{}
+	counts := func() map[string]int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		ret := map[string]int{}
+		for k, v := range hits {
+			ret[k] = v
+		}
+		return ret
+	}
+	newServer := func(name string, controlURL *string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			hits[name]++
+			mutex.Unlock()
+			json.NewEncoder(w).Encode(&leaseResponse{
+				Status:     "success",
+				IP:         "10.90.0.2/32",
+				AllowedIPs: validAllowedIPs,
+				PubKey:     validPublicKey,
+				Expires:    time.Now().Add(time.Hour),
+				ControlURL: *controlURL,
+			})
+		}))
+	}
+	var controlURL string
+	public := newServer("public", &controlURL)
+	defer public.Close()
+	internal := newServer("internal", &controlURL)
+	controlURL = internal.URL
+
+	server := agentPeerConfig{URL: public.URL, ControlViaTunnel: true}
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", Peers: []agentPeerConfig{server}}, "")
+	dm.cachedToken = "token"
+	var handshake time.Time
+	dm.wireguardDevice = func(name string) (*wgtypes.Device, error) {
+		key, _ := wgtypes.ParseKey(validPublicKey)
+		return &wgtypes.Device{Name: name, Peers: []wgtypes.Peer{{PublicKey: key, LastHandshakeTime: handshake}}}, nil
+	}
+	lr := &leaseRequest{PubKey: validPublicKey}
+	renew := func() {
+		config, _, err := dm.requestPeerConfig(server, lr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.ServerURL = server.URL
+		dm.config = config
+	}
+
+	// The first lease is requested over the public url
+	renew()
+	assert.Equal(t, map[string]int{"public": 1}, counts())
+	assert.Equal(t, internal.URL, dm.config.ControlURL)
+
+	// and so are renewals until a handshake completed
+	renew()
+	assert.Equal(t, map[string]int{"public": 2}, counts())
+
+	// after which they go through the tunnel
+	handshake = time.Now()
+	renew()
+	renew()
+	assert.Equal(t, map[string]int{"public": 2, "internal": 2}, counts())
+
+	// falling back to the public url if the tunnel is unreachable
+	internal.Close()
+	renew()
+	assert.Equal(t, map[string]int{"public": 3, "internal": 2}, counts())
+
+	// Renewing through the tunnel is opt-in
+	server.ControlViaTunnel = false
+	assert.Equal(t, "", dm.tunnelControlURL(server))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	watchInterval  = 2 * time.Second
+	watchMaxEvents = 10
+
+	ansiClearScreen = "\033[H\033[2J"
+	ansiRed         = "\033[31m"
+	ansiReset       = "\033[0m"
+)
+
+// statusWatcher periodically fetches the status of a running agent from its
+// status socket and renders it on a terminal.
+type statusWatcher struct {
+	path     string
+	client   *http.Client
+	out      io.Writer
+	previous *agentStatus
+}
+
+func newStatusWatcher(path string, out io.Writer) *statusWatcher {
+	return &statusWatcher{
+		path:   path,
+		client: unixSocketClient(path, watchInterval),
+		out:    out,
+	}
+}
+
+// refresh fetches and renders the agent status. If the agent cannot be
+// reached, eg. because it is restarting, it renders the error and keeps
+// trying on the next refresh.
+func (sw *statusWatcher) refresh() error {
+	status, err := getStatus(sw.client)
+	if err != nil {
+		fmt.Fprintf(sw.out, "%swiresteward agent at %s - %s\n\n%sCannot reach the agent, reconnecting: %v%s\n", ansiClearScreen, sw.path, time.Now().Format(timeFmt), ansiRed, err, ansiReset)
+		sw.previous = nil
+		return err
+	}
+	renderStatus(sw.out, sw.path, status, sw.previous)
+	sw.previous = status
+	return nil
+}
+
+func (sw *statusWatcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sw.refresh()
+		<-ticker.C
+	}
+}
+
+// renderStatus writes status to w. Transfer rates are calculated against the
+// previous status, if there is one.
+func renderStatus(w io.Writer, address string, status, previous *agentStatus) {
+	fmt.Fprintf(w, "%swiresteward agent at %s - %s\n", ansiClearScreen, address, status.Time.Format(timeFmt))
+	previousBytes := map[string][2]int64{}
+	var elapsed float64
+	if previous != nil {
+		elapsed = status.Time.Sub(previous.Time).Seconds()
+		for _, d := range previous.Devices {
+			for _, p := range d.Peers {
+				previousBytes[d.Name+p.PublicKey] = [2]int64{p.ReceiveBytes, p.TransmitBytes}
+			}
+		}
+	}
+	for _, d := range status.Devices {
+		fmt.Fprintf(w, "\n%s", d.Name)
+		if d.Alias != "" {
+			fmt.Fprintf(w, " (%s)", d.Alias)
+		}
+		if d.Address == "" {
+			fmt.Fprintf(w, "\n  no active lease\n")
+		} else {
+			fmt.Fprintf(w, "\n  address %s, server %s, lease expires in %s\n", d.Address, d.Server, d.Expires.Sub(status.Time).Round(time.Second))
+		}
+		for _, p := range d.Peers {
+			handshake := "never"
+			if !p.LastHandshake.IsZero() {
+				handshake = status.Time.Sub(p.LastHandshake).Round(time.Second).String() + " ago"
+			}
+			if p.LastHandshake.IsZero() || status.Time.Sub(p.LastHandshake) > defaultHandshakeTimeout {
+				handshake = ansiRed + handshake + ansiReset
+			}
+			rates := ""
+			if prev, ok := previousBytes[d.Name+p.PublicKey]; ok && elapsed > 0 {
+				rates = fmt.Sprintf(", rx %s/s, tx %s/s",
+					formatBytes(float64(p.ReceiveBytes-prev[0])/elapsed),
+					formatBytes(float64(p.TransmitBytes-prev[1])/elapsed),
+				)
+			}
+			fmt.Fprintf(w, "  peer %s, endpoint %s, handshake %s%s\n", p.PublicKey, p.Endpoint, handshake, rates)
+		}
+	}
+	fmt.Fprintf(w, "\nEvents (%d dropped)\n", status.DroppedEvents)
+	events := status.Events
+	if len(events) > watchMaxEvents {
+		events = events[len(events)-watchMaxEvents:]
+	}
+	for _, e := range events {
+		fmt.Fprintf(w, "  %s %s %s: %s\n", e.Time.Format(timeFmt), e.Type, e.Device, e.Message)
+	}
+}
+
+func formatBytes(b float64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%.0f B", b)
+	}
+	div, exp := float64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", b/div, "KMGTPE"[exp])
+}
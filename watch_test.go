@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestStatusWatcher_Reconnect(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	now := time.Now()
+	peer := newWgKey()
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test"}, "")
+	dm.config = &WirestewardPeerConfig{
+		LocalAddress: &net.IPNet{IP: net.ParseIP("10.90.0.2"), Mask: net.CIDRMask(32, 32)},
+		ServerURL:    "https://wiresteward.example.com",
+		Expires:      now.Add(time.Hour),
+	}
+	dm.wireguardDevice = func(name string) (*wgtypes.Device, error) {
+		return &wgtypes.Device{Name: name, Peers: []wgtypes.Peer{{
+			PublicKey:         peer,
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 51820},
+			LastHandshakeTime: now.Add(-10 * time.Minute),
+		}}}, nil
+	}
+	events := newEventQueue(defaultEventQueueSize)
+	events.emit(eventLeaseExpired, "wg_test", "lease expired")
+	a := &Agent{deviceManagers: []*DeviceManager{dm}, events: events}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/status.json", r.URL.Path)
+		a.statusHandler(w, r)
+	})
+
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := httptest.NewUnstartedServer(handler)
+	agent.Listener = ln
+	agent.Start()
+
+	out := &bytes.Buffer{}
+	sw := newStatusWatcher(path, out)
+	assert.NoError(t, sw.refresh())
+	assert.Contains(t, out.String(), "address 10.90.0.2/32, server https://wiresteward.example.com")
+	assert.Contains(t, out.String(), "endpoint 1.2.3.4:51820")
+	// The handshake is stale
+	assert.Contains(t, out.String(), ansiRed+"10m0s ago"+ansiReset)
+	assert.Contains(t, out.String(), "LeaseExpired wg_test: lease expired")
+
+	// The agent restarts
+	agent.Close()
+	out.Reset()
+	assert.Error(t, sw.refresh())
+	assert.Contains(t, out.String(), "Cannot reach the agent, reconnecting")
+
+	ln, err = net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent = httptest.NewUnstartedServer(handler)
+	agent.Listener = ln
+	agent.Start()
+	defer agent.Close()
+	out.Reset()
+	assert.NoError(t, sw.refresh())
+	assert.Contains(t, out.String(), "address 10.90.0.2/32")
+}
+
+func TestRenderStatus_Rates(t *testing.T) {
+	now := time.Now()
+	previous := &agentStatus{Time: now, Devices: []agentDeviceStatus{{
+		Name:  "wg_test",
+		Peers: []agentPeerStatus{{PublicKey: "key", LastHandshake: now, ReceiveBytes: 0, TransmitBytes: 1024}},
+	}}}
+	status := &agentStatus{Time: now.Add(2 * time.Second), Devices: []agentDeviceStatus{{
+		Name:  "wg_test",
+		Peers: []agentPeerStatus{{PublicKey: "key", LastHandshake: now, ReceiveBytes: 4096, TransmitBytes: 1124}},
+	}}}
+	out := &bytes.Buffer{}
+	renderStatus(out, "localhost:7773", status, previous)
+	assert.Contains(t, out.String(), "handshake 2s ago, rx 2.0 KiB/s, tx 50 B/s")
+	assert.Contains(t, out.String(), "no active lease")
+}
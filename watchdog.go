@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	linkWatchInterval          = 5 * time.Second
+	reconcileInterval          = 30 * time.Second
+	defaultRecreateMinInterval = 10 * time.Second
+	defaultRecreateMaxAttempts = 5
+	defaultRecreateWindow      = 10 * time.Minute
+)
+
+// recreationBreaker limits how often a device is recreated after its link is
+// deleted, so that something repeatedly deleting it does not put the agent in
+// a tight create/delete loop. Recreations are spaced by at least minInterval
+// and the breaker trips once maxAttempts recreations happened within window,
+// after which the device is not recreated until the agent is restarted.
+type recreationBreaker struct {
+	attempts    []time.Time
+	givenUp     bool
+	maxAttempts int
+	minInterval time.Duration
+	window      time.Duration
+}
+
+func newRecreationBreaker(minInterval time.Duration, maxAttempts int, window time.Duration) *recreationBreaker {
+	if minInterval == 0 {
+		minInterval = defaultRecreateMinInterval
+	}
+	if maxAttempts == 0 {
+		maxAttempts = defaultRecreateMaxAttempts
+	}
+	if window == 0 {
+		window = defaultRecreateWindow
+	}
+	return &recreationBreaker{
+		maxAttempts: maxAttempts,
+		minInterval: minInterval,
+		window:      window,
+	}
+}
+
+// allow returns whether the device can be recreated at the time now, and
+// records the attempt if so.
+func (b *recreationBreaker) allow(now time.Time) bool {
+	if b.givenUp {
+		return false
+	}
+	recent := b.attempts[:0]
+	for _, a := range b.attempts {
+		if now.Sub(a) < b.window {
+			recent = append(recent, a)
+		}
+	}
+	b.attempts = recent
+	if len(b.attempts) >= b.maxAttempts {
+		b.givenUp = true
+		return false
+	}
+	if len(b.attempts) > 0 && now.Sub(b.attempts[len(b.attempts)-1]) < b.minInterval {
+		return false
+	}
+	b.attempts = append(b.attempts, now)
+	return true
+}
+
+// checkLink recreates the device if its link has been deleted, as long as
+// the recreation breaker allows it.
+func (dm *DeviceManager) checkLink(now time.Time) {
+	if dm.recreation.givenUp || dm.linkExists(dm.Name()) {
+		return
+	}
+	if !dm.recreation.allow(now) {
+		if dm.recreation.givenUp {
+			dm.logger.Error.Printf("Device %s was recreated %d times within %s, giving up, restart the agent to bring it back", dm.Name(), dm.recreation.maxAttempts, dm.recreation.window)
+			dm.events.emit(eventDeviceRecreationGivenUp, dm.Name(), "device deleted %d times within %s, not recreating it", dm.recreation.maxAttempts, dm.recreation.window)
+		}
+		return
+	}
+	dm.logger.Info.Printf("Device %s was deleted, recreating it", dm.Name())
+	if err := dm.recreateDevice(); err != nil {
+		dm.logger.Error.Printf("Cannot recreate device %s: %v", dm.Name(), err)
+	}
+}
+
+// recreateDevice starts the device again and requests a new lease for it,
+// as the previous configuration was lost along with the link.
+func (dm *DeviceManager) recreateDevice() error {
+	dm.agentDevice.Stop()
+	if err := dm.setup(); err != nil {
+		return err
+	}
+	dm.configMutex.Lock()
+	dm.config = nil
+	dm.configMutex.Unlock()
+	if len(dm.serverList()) > 0 {
+		go dm.triggerRenewal()
+	}
+	return nil
+}
+
+func (dm *DeviceManager) watchLink(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dm.checkLink(time.Now())
+		case <-dm.stop:
+			return
+		}
+	}
+}
+
+// reconcile restores the private key and peer of the device, and the
+// addresses and routes of the current lease, that were changed or removed by
+// something else, such as wg-quick, NetworkManager or a DHCP client, logging
+// each repair.
+func (dm *DeviceManager) reconcile() {
+	dm.configMutex.Lock()
+	defer dm.configMutex.Unlock()
+	repaired, err := dm.reconcileWireguardConfig(dm.config)
+	if err == nil && dm.config != nil {
+		var r []string
+		r, err = dm.reconcileDeviceConfig(dm.config)
+		repaired = append(repaired, r...)
+	}
+	for _, r := range repaired {
+		dm.logger.Info.Printf("Restored %s of device %s, it was changed or removed", r, dm.Name())
+		dm.events.emit(eventDeviceConfigRestored, dm.Name(), "restored %s", r)
+	}
+	if err != nil {
+		dm.logger.Error.Printf("Cannot reconcile config of device %s: %v", dm.Name(), err)
+	}
+}
+
+// reconcileWireguardConfig sets the private key of the device back to the one
+// set by the agent, and the peer of config, if nil, back on the device, if
+// they were changed, and returns a description of each repair. The private
+// key is left alone in coexist mode. It must be called with configMutex held.
+func (dm *DeviceManager) reconcileWireguardConfig(config *WirestewardPeerConfig) ([]string, error) {
+	key := dm.currentKey()
+	if key == (wgtypes.Key{}) {
+		return nil, nil
+	}
+	device, err := dm.wireguardDevice(dm.Name())
+	if err != nil {
+		return nil, err
+	}
+	var repaired []string
+	if device.PrivateKey != key && !dm.coexist {
+		if err := dm.configureDevice(dm.Name(), wgtypes.Config{PrivateKey: &key}); err != nil {
+			return nil, fmt.Errorf("cannot restore private key: %w", err)
+		}
+		repaired = append(repaired, "private key")
+	}
+	if config == nil {
+		return repaired, nil
+	}
+	if peerDrifted(device.Peers, *config.PeerConfig) || (!dm.coexist && len(foreignPeers(device.Peers, config.PublicKey, dm.drainingPeerKeys())) > 0) {
+		if err := dm.setPeer(nil, config); err != nil {
+			return repaired, fmt.Errorf("cannot restore peer %s: %w", config.PublicKey, err)
+		}
+		repaired = append(repaired, fmt.Sprintf("peer %s", config.PublicKey))
+	}
+	return repaired, nil
+}
+
+// peerDrifted returns whether the peer of want is missing from peers, or its
+// allowed IPs or preshared key differ. Endpoints are not compared, as they
+// change when the server roams.
+func peerDrifted(peers []wgtypes.Peer, want wgtypes.PeerConfig) bool {
+	for _, p := range peers {
+		if p.PublicKey != want.PublicKey {
+			continue
+		}
+		if want.PresharedKey != nil && p.PresharedKey != *want.PresharedKey {
+			return true
+		}
+		if len(p.AllowedIPs) != len(want.AllowedIPs) {
+			return true
+		}
+		have := make(map[string]bool, len(p.AllowedIPs))
+		for _, a := range p.AllowedIPs {
+			have[a.String()] = true
+		}
+		for _, a := range want.AllowedIPs {
+			if !have[a.String()] {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// foreignPeers returns the keys of the peers that are neither the peer of
+// the lease nor draining.
+func foreignPeers(peers []wgtypes.Peer, own wgtypes.Key, draining map[wgtypes.Key]bool) []wgtypes.Key {
+	var foreign []wgtypes.Key
+	for _, p := range peers {
+		if p.PublicKey != own && !draining[p.PublicKey] {
+			foreign = append(foreign, p.PublicKey)
+		}
+	}
+	return foreign
+}
+
+func (dm *DeviceManager) reconcileLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dm.reconcile()
+		case <-dm.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type fakeAgentDevice struct {
+	name string
+	runs int
+}
+
+func (d *fakeAgentDevice) Name() string { return d.name }
+func (d *fakeAgentDevice) Run() error   { d.runs++; return nil }
+func (d *fakeAgentDevice) Stop()        {}
+
+func TestDeviceManager_RecreationBreaker(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dev := &fakeAgentDevice{name: "wg_test"}
+	dm := newDeviceManager(agentDeviceConfig{
+		Name:                "wg_test",
+		RecreateMinInterval: duration{time.Second},
+		RecreateMaxAttempts: 3,
+		RecreateWindow:      duration{time.Minute},
+	}, "")
+	dm.agentDevice = dev
+	dm.events = newEventQueue(defaultEventQueueSize)
+	// Setting up the recreated device fails right after it is started, as
+	// there is no actual device to configure
+	dm.wireguardDevice = func(name string) (*wgtypes.Device, error) {
+		return nil, errors.New("no device")
+	}
+	// Something keeps deleting the device
+	dm.linkExists = func(name string) bool { return false }
+
+	now := time.Now()
+	dm.checkLink(now)
+	assert.Equal(t, 1, dev.runs)
+	// Recreations are spaced by the minimum interval
+	dm.checkLink(now.Add(500 * time.Millisecond))
+	assert.Equal(t, 1, dev.runs)
+	dm.checkLink(now.Add(2 * time.Second))
+	dm.checkLink(now.Add(4 * time.Second))
+	assert.Equal(t, 3, dev.runs)
+	assert.Equal(t, 0, len(dm.events.Events()))
+
+	// The breaker trips after the threshold and the device is not recreated
+	// anymore, even after the window has passed
+	dm.checkLink(now.Add(6 * time.Second))
+	assert.Equal(t, 3, dev.runs)
+	e := <-dm.events.Events()
+	assert.Equal(t, eventDeviceRecreationGivenUp, e.Type)
+	assert.Equal(t, "wg_test", e.Device)
+	dm.checkLink(now.Add(time.Hour))
+	assert.Equal(t, 3, dev.runs)
+	assert.Equal(t, 0, len(dm.events.Events()))
+}
+
+func TestRecreationBreaker_Window(t *testing.T) {
+	b := newRecreationBreaker(time.Second, 2, time.Minute)
+	now := time.Now()
+	assert.True(t, b.allow(now))
+	// Attempts outside of the window do not count towards the threshold
+	assert.True(t, b.allow(now.Add(2*time.Minute)))
+	assert.True(t, b.allow(now.Add(4*time.Minute)))
+	assert.False(t, b.givenUp)
+}
+
+func TestDeviceManager_ReconcileWireguardConfig(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	key := newWgKey()
+	peer, err := newPeerConfig(validPublicKey, "", "", validAllowedIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &WirestewardPeerConfig{PeerConfig: peer}
+
+	// The fake device holds a key and peers, as set by configureDevice
+	dev := &wgtypes.Device{Name: "wg_test"}
+	dm := newDeviceManager(agentDeviceConfig{Name: "wg_test", PeerManagement: peerManagementExclusive}, "")
+	dm.wireguardDevice = func(name string) (*wgtypes.Device, error) {
+		d := *dev
+		return &d, nil
+	}
+	dm.configureDevice = func(name string, cfg wgtypes.Config) error {
+		if cfg.PrivateKey != nil {
+			dev.PrivateKey = *cfg.PrivateKey
+		}
+		for _, p := range cfg.Peers {
+			peers := []wgtypes.Peer{}
+			for _, existing := range dev.Peers {
+				if existing.PublicKey != p.PublicKey {
+					peers = append(peers, existing)
+				}
+			}
+			if !p.Remove {
+				peers = append(peers, wgtypes.Peer{PublicKey: p.PublicKey, AllowedIPs: p.AllowedIPs})
+			}
+			dev.Peers = peers
+		}
+		return nil
+	}
+	dm.removePeer = func(name string, key wgtypes.Key) error {
+		return dm.configureDevice(name, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: key, Remove: true}}})
+	}
+
+	// Nothing is checked before the agent sets a key
+	repaired, err := dm.reconcileWireguardConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(repaired))
+
+	dm.setKey(key)
+	assert.NoError(t, dm.setPeer(nil, config))
+	repaired, err = dm.reconcileWireguardConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"private key"}, repaired)
+	assert.Equal(t, key, dev.PrivateKey)
+
+	// Something else, such as wg-quick, replaces the key and the peer, the
+	// foreign peer is removed in exclusive mode
+	foreign := newWgKey().PublicKey()
+	dev.PrivateKey = newWgKey()
+	dev.Peers = []wgtypes.Peer{{PublicKey: foreign}}
+	repaired, err = dm.reconcileWireguardConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"private key", "peer " + validPublicKey}, repaired)
+	assert.Equal(t, key, dev.PrivateKey)
+	assert.Equal(t, 0, len(foreignPeers(dev.Peers, config.PublicKey, nil)))
+	assert.False(t, peerDrifted(dev.Peers, *config.PeerConfig))
+
+	// Only the key is checked without a lease
+	dev.PrivateKey = newWgKey()
+	dev.Peers = nil
+	repaired, err = dm.reconcileWireguardConfig(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"private key"}, repaired)
+
+	// The key of an adopted device is left alone in coexist mode
+	dm.coexist = true
+	replaced := newWgKey()
+	dev.PrivateKey = replaced
+	repaired, err = dm.reconcileWireguardConfig(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(repaired))
+	assert.Equal(t, replaced, dev.PrivateKey)
+}
+
+func TestPeerDrifted(t *testing.T) {
+	peer, err := newPeerConfig(validPublicKey, "", "", validAllowedIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := wgtypes.Peer{PublicKey: peer.PublicKey, AllowedIPs: peer.AllowedIPs}
+	assert.False(t, peerDrifted([]wgtypes.Peer{live}, *peer))
+	assert.True(t, peerDrifted(nil, *peer))
+	// Endpoints roam and are not compared
+	roamed := live
+	roamed.Endpoint = &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 51820}
+	assert.False(t, peerDrifted([]wgtypes.Peer{roamed}, *peer))
+	narrowed := live
+	narrowed.AllowedIPs = nil
+	assert.True(t, peerDrifted([]wgtypes.Peer{narrowed}, *peer))
+	psk := newWgKey()
+	peer.PresharedKey = &psk
+	assert.True(t, peerDrifted([]wgtypes.Peer{live}, *peer))
+}
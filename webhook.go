@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookEventHeader carries the name of the event of webhook requests
+	webhookEventHeader = "X-Wiresteward-Event"
+	// webhookSignatureHeader carries the signature of webhook requests, as
+	// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">", so that
+	// receivers can verify the sender and reject replayed requests
+	webhookSignatureHeader = "X-Wiresteward-Signature"
+)
+
+// webhookEvents are the names lease events are sent to webhooks as.
+var webhookEvents = map[leaseEventType]string{
+	leaseEventGranted: "lease.created",
+	leaseEventRenewed: "lease.renewed",
+	leaseEventExpired: "lease.expired",
+	leaseEventRevoked: "lease.revoked",
+}
+
+// isWebhookEvent returns whether name is the name of a webhook event.
+func isWebhookEvent(name string) bool {
+	for _, e := range webhookEvents {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookPayload is the body of webhook requests, the lease event along
+// with the name of the webhook event.
+type webhookPayload struct {
+	Event string `json:"event"`
+	leaseEvent
+}
+
+// webhookPublisher POSTs lease events to a url, signed with a shared
+// secret.
+type webhookPublisher struct {
+	client *http.Client
+	url    string
+	secret []byte
+	// events are the webhook events sent, all of them if empty
+	events []string
+}
+
+func newWebhookPublisher(cfg *serverWebhookConfig) (*webhookPublisher, error) {
+	wp := &webhookPublisher{
+		client: &http.Client{},
+		url:    cfg.URL,
+		events: cfg.Events,
+	}
+	if cfg.SecretFilename != "" {
+		secret, err := os.ReadFile(cfg.SecretFilename)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read webhook secret: %w", err)
+		}
+		wp.secret = bytes.TrimSpace(secret)
+		if len(wp.secret) == 0 {
+			return nil, fmt.Errorf("webhook secret file %s is empty", cfg.SecretFilename)
+		}
+	}
+	return wp, nil
+}
+
+// sends returns whether the webhook event name is sent.
+func (wp *webhookPublisher) sends(name string) bool {
+	if len(wp.events) == 0 {
+		return true
+	}
+	for _, e := range wp.events {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (wp *webhookPublisher) Publish(ctx context.Context, event leaseEvent) error {
+	name := webhookEvents[event.Type]
+	if !wp.sends(name) {
+		return nil
+	}
+	body, err := json.Marshal(webhookPayload{Event: name, leaseEvent: event})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wp.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, name)
+	if wp.secret != nil {
+		req.Header.Set(webhookSignatureHeader, signWebhook(wp.secret, time.Now(), body))
+	}
+	resp, err := wp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s responded with %s", wp.url, resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the value of the signature header of body, sent at t.
+func signWebhook(secret []byte, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// leaseEventPublishers publishes events to each of its publishers in turn.
+type leaseEventPublishers []leaseEventPublisher
+
+func (ps leaseEventPublishers) Publish(ctx context.Context, event leaseEvent) error {
+	var errs []string
+	for _, p := range ps {
+		if err := p.Publish(ctx, event); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
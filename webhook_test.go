@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerConfig_Webhooks(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		err   bool
+	}{
+		{`{"webhooks": [{"url": "https://hooks.example.com/wiresteward"}]}`, false},
+		{`{"webhooks": [{"url": "http://inventory:8080/leases", "events": ["lease.created", "lease.revoked"]}]}`, false},
+		{`{"nats": {"url": "nats://nats:4222", "subject": "leases"}, "webhooks": [{"url": "https://hooks.example.com"}]}`, !natsSupported},
+		{`{}`, true},
+		{`{"webhooks": [{"url": "hooks.example.com"}]}`, true},
+		{`{"webhooks": [{"url": "ftp://hooks.example.com"}]}`, true},
+		{`{"webhooks": [{"url": "https://hooks.example.com", "events": ["LeaseGranted"]}]}`, true},
+	} {
+		cfg := &serverConfig{}
+		if err := json.Unmarshal([]byte(tc.input), &cfg.LeaseEvents); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyLeaseEventsConfig(cfg)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+		} else {
+			assert.NoError(t, err, tc.input)
+		}
+	}
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	secretFilename := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFilename, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	wp, err := newWebhookPublisher(&serverWebhookConfig{
+		URL:            server.URL,
+		SecretFilename: secretFilename,
+		Events:         []string{"lease.created", "lease.revoked"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := leaseEvent{Type: leaseEventGranted, Username: "alice@example.com", IP: "10.90.0.2"}
+	assert.NoError(t, wp.Publish(context.Background(), event))
+	r, body := <-requests, <-bodies
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	assert.Equal(t, "lease.created", r.Header.Get(webhookEventHeader))
+	var payload map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, "lease.created", payload["event"])
+	assert.Equal(t, "alice@example.com", payload["username"])
+	assert.Equal(t, "10.90.0.2", payload["ip"])
+
+	// The signature is the HMAC of the timestamp and body
+	signature := r.Header.Get(webhookSignatureHeader)
+	ts := strings.TrimPrefix(strings.Split(signature, ",")[0], "t=")
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	assert.NoError(t, err)
+	assert.Equal(t, signWebhook([]byte("s3cret"), time.Unix(unix, 0), body), signature)
+
+	// Events that are not configured are not sent
+	event.Type = leaseEventRenewed
+	assert.NoError(t, wp.Publish(context.Background(), event))
+	assert.Equal(t, 0, len(requests))
+
+	// and failed requests are errors
+	status = http.StatusInternalServerError
+	event.Type = leaseEventRevoked
+	assert.Error(t, wp.Publish(context.Background(), event))
+	assert.Equal(t, "lease.revoked", (<-requests).Header.Get(webhookEventHeader))
+}
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac s3cret
+	assert.Equal(t,
+		"t=1700000000,v1=97926816e98fbb41ccb1673225ff29a2f35369099990e1b1561651e7bd097ebf",
+		signWebhook([]byte("s3cret"), time.Unix(1700000000, 0), []byte("{}")),
+	)
+}
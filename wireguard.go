@@ -44,7 +44,15 @@ func newPeerConfig(publicKey string, presharedKey string, endpoint string, allow
 	return peer, nil
 }
 
+// setPeers configures the device with the given peers, removing any other
+// existing peers.
 func setPeers(deviceName string, peers []wgtypes.PeerConfig) error {
+	return setPeersKeeping(deviceName, peers, nil)
+}
+
+// setPeersKeeping configures the device with the given peers, removing any
+// other existing peers unless they are in keep.
+func setPeersKeeping(deviceName string, peers []wgtypes.PeerConfig, keep map[wgtypes.Key]bool) error {
 	wg, err := wgctrl.New()
 	if err != nil {
 		return err
@@ -62,7 +70,15 @@ func setPeers(deviceName string, peers []wgtypes.PeerConfig) error {
 	if err != nil {
 		return err
 	}
-	for _, ep := range device.Peers {
+	return wg.ConfigureDevice(deviceName, wgtypes.Config{Peers: reconcilePeers(device.Peers, peers, keep)})
+}
+
+// reconcilePeers returns the peer configuration that turns the existing peers
+// of a device into the desired ones. Existing peers that are not desired are
+// removed, unless they are in keep.
+func reconcilePeers(existing []wgtypes.Peer, desired []wgtypes.PeerConfig, keep map[wgtypes.Key]bool) []wgtypes.PeerConfig {
+	peers := desired
+	for _, ep := range existing {
 		found := false
 		for i, np := range peers {
 			peers[i].ReplaceAllowedIPs = true
@@ -71,11 +87,43 @@ func setPeers(deviceName string, peers []wgtypes.PeerConfig) error {
 				break
 			}
 		}
-		if !found {
+		if !found && !keep[ep.PublicKey] {
 			peers = append(peers, wgtypes.PeerConfig{PublicKey: ep.PublicKey, Remove: true})
 		}
 	}
-	return wg.ConfigureDevice(deviceName, wgtypes.Config{Peers: peers})
+	return peers
+}
+
+// configureDevice applies cfg to the device.
+func configureDevice(deviceName string, cfg wgtypes.Config) error {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := wg.Close(); err != nil {
+			logger.Error.Printf(
+				"Failed to close wireguard client: %v", err)
+		}
+	}()
+	return wg.ConfigureDevice(deviceName, cfg)
+}
+
+// removePeer removes a single peer from the device.
+func removePeer(deviceName string, key wgtypes.Key) error {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := wg.Close(); err != nil {
+			logger.Error.Printf(
+				"Failed to close wireguard client: %v", err)
+		}
+	}()
+	return wg.ConfigureDevice(deviceName, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: key, Remove: true}},
+	})
 }
 
 func setPrivateKey(deviceName string, privKey string) error {
@@ -100,6 +148,22 @@ func setPrivateKey(deviceName string, privKey string) error {
 	return wg.ConfigureDevice(deviceName, wgtypes.Config{PrivateKey: &key})
 }
 
+// getWireguardDevice returns the wireguard configuration of the device, as
+// reported by wgctrl.
+func getWireguardDevice(deviceName string) (*wgtypes.Device, error) {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := wg.Close(); err != nil {
+			logger.Error.Printf(
+				"Failed to close wireguard client: %v", err)
+		}
+	}()
+	return wg.Device(deviceName)
+}
+
 func getKeys(deviceName string) (string, string, error) {
 	wg, err := wgctrl.New()
 	if err != nil {